@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+)
+
+// backend is an init system whose services are configured by the files synced from src.
+type backend struct {
+	Dest   string                                           // default directory of the service files
+	New    func(cfg *systemd.Config) reconciler.Systemd     // manages the services
+	Target func(cfg *systemd.Config) reconciler.Destination // optional, defaults to copying files into the directory
+}
+
+var backends = map[string]*backend{
+	"systemd": {
+		Dest: "/etc/systemd/system",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewSystemctl(cfg) },
+	},
+	"openrc": {
+		Dest: "/etc/init.d",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewOpenRC(cfg) },
+	},
+	"runit": {
+		Dest: "/etc/sv",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewRunit(cfg) },
+		Target: func(cfg *systemd.Config) reconciler.Destination {
+			return &reconciler.RunitDir{Dir: cfg.Dir, ServiceDir: "/var/service"}
+		},
+	},
+	"supervisord": {
+		Dest: "/etc/supervisor/conf.d",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewSupervisord(cfg) },
+	},
+	"docker": {
+		Dest: "/etc/unitmgr/compose",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewCompose("docker", cfg) },
+	},
+	"podman": {
+		Dest: "/etc/unitmgr/compose",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewCompose("podman", cfg) },
+	},
+	"launchd": {
+		Dest: "/Library/LaunchDaemons",
+		New:  func(cfg *systemd.Config) reconciler.Systemd { return systemd.NewLaunchd(cfg) },
+	},
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/systemd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	for _, name := range backendNames() {
+		b := backends[name]
+		assert.NotEmpty(t, b.Dest, name)
+		assert.NotNil(t, b.New(&systemd.Config{Dir: b.Dest, Timeout: time.Second}), name)
+	}
+}
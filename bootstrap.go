@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// maxBundleSize bounds the size of bootstrap bundles and the user-data they're embedded in.
+const maxBundleSize = 16 << 20
+
+// bootstrapMarker is written to the src directory once a bundle was applied, so later boots skip it.
+const bootstrapMarker = ".unitmgr-bootstrapped"
+
+// bootstrapper writes the unit files of a bundle embedded in the instance's user-data into the src directory
+// on first boot, so a fresh VM runs its initial units before the regular source can be reached.
+type bootstrapper struct {
+	UserData string // path or http(s) url of the user-data, e.g. /var/lib/cloud/instance/user-data.txt
+	Dir      string
+	Client   *http.Client
+	Attempts int           // to read the user-data and fetch the bundle, defaults to one
+	Backoff  time.Duration // between attempts
+}
+
+// Run applies the bundle unless it was applied before, returning true if it wrote any units.
+// Failures are logged and retried on the next start, since the regular source takes over either way.
+func (b *bootstrapper) Run(ctx context.Context) bool {
+	marker := path.Join(b.Dir, bootstrapMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return false
+	}
+
+	var units []string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if units, err = b.apply(ctx); err == nil || attempt >= b.Attempts {
+			break
+		}
+		log.Printf("error while bootstrapping from %s, retrying: %s", b.UserData, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(b.Backoff):
+		}
+	}
+	if err != nil {
+		log.Printf("error while bootstrapping from %s: %s", b.UserData, err)
+		return false
+	}
+
+	if err := ioutil.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		log.Printf("error while writing %s: %s", marker, err)
+	}
+	if len(units) > 0 {
+		log.Printf("bootstrapped %d units from %s", len(units), b.UserData)
+	}
+	return len(units) > 0
+}
+
+// apply writes the units of the bundle into Dir, returning their names.
+func (b *bootstrapper) apply(ctx context.Context) ([]string, error) {
+	userData, err := b.read(ctx, b.UserData)
+	if err != nil {
+		return nil, fmt.Errorf("reading user-data: %w", err)
+	}
+	bundle, err := b.bundle(ctx, userData)
+	if err != nil || bundle == nil {
+		return nil, err
+	}
+
+	files, err := readBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return nil, err
+	}
+	var units []string
+	for _, file := range files {
+		if err := reconciler.WriteFileAtomic(path.Join(b.Dir, file.Name), file.Content); err != nil {
+			return nil, err
+		}
+		log.Printf("received unit from bootstrap bundle: %s", file.Name)
+		units = append(units, file.Name)
+	}
+	return units, nil
+}
+
+// bundle returns the tarball referenced by the user-data, or nil if it doesn't reference one. Leading comment lines
+// like "#unitmgr-bundle" are ignored, the rest is either the http(s) url of the tarball or its base64 encoded content.
+func (b *bootstrapper) bundle(ctx context.Context, userData []byte) ([]byte, error) {
+	if isTarball(userData) {
+		return userData, nil
+	}
+
+	var body []string
+	scanner := bufio.NewScanner(bytes.NewReader(userData))
+	scanner.Buffer(nil, maxBundleSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || (len(body) == 0 && strings.HasPrefix(line, "#")) {
+			continue
+		}
+		body = append(body, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	if len(body) == 1 && (strings.HasPrefix(body[0], "http://") || strings.HasPrefix(body[0], "https://")) {
+		return b.read(ctx, body[0])
+	}
+	bundle, err := base64.StdEncoding.DecodeString(strings.Join(body, ""))
+	if err != nil {
+		return nil, fmt.Errorf("user-data is neither the url of a bundle nor a base64 encoded tarball")
+	}
+	return bundle, nil
+}
+
+// read returns the content of a file or http(s) url.
+func (b *bootstrapper) read(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readLimited(file)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && location == b.UserData {
+		return nil, nil // instances launched without user-data
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, location)
+	}
+	return readLimited(resp.Body)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxBundleSize+1))
+	if err == nil && len(content) > maxBundleSize {
+		err = fmt.Errorf("larger than %d bytes", maxBundleSize)
+	}
+	return content, err
+}
+
+// isTarball returns true for gzip compressed content and uncompressed tarballs.
+func isTarball(content []byte) bool {
+	return bytes.HasPrefix(content, []byte{0x1f, 0x8b}) || (len(content) > 262 && string(content[257:262]) == "ustar")
+}
+
+// readBundle returns the unit files at the top level of an optionally gzip compressed tarball.
+func readBundle(bundle []byte) ([]*fleetUnit, error) {
+	var r io.Reader = bytes.NewReader(bundle)
+	if bytes.HasPrefix(bundle, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = io.LimitReader(gz, maxBundleSize)
+	}
+
+	var files []*fleetUnit
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading bundle: %w", err)
+		}
+		name := strings.TrimPrefix(path.Clean(header.Name), "./")
+		if (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA) || !validUnitName(name) {
+			continue // only top-level files are units, like for git sources
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s from bundle: %w", name, err)
+		}
+		files = append(files, &fleetUnit{Name: name, Content: content})
+	}
+}
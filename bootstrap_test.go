@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBundle(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestBootstrapperBase64(t *testing.T) {
+	bundle := testBundle(t, map[string]string{"./a.service": "a", "nested/b.service": "b", ".hidden": "c"})
+	userData := path.Join(t.TempDir(), "user-data.txt")
+	require.NoError(t, ioutil.WriteFile(userData, []byte("#unitmgr-bundle\n"+base64.StdEncoding.EncodeToString(bundle)+"\n"), 0644))
+
+	dir := t.TempDir()
+	b := &bootstrapper{UserData: userData, Dir: dir}
+	assert.True(t, b.Run(context.Background()))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+	assert.NoFileExists(t, path.Join(dir, "b.service"))
+	assert.NoFileExists(t, path.Join(dir, ".hidden"))
+	assert.FileExists(t, path.Join(dir, bootstrapMarker))
+
+	// The bundle is only applied on first boot
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("from source"), 0644))
+	assert.False(t, b.Run(context.Background()))
+	content, err = ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "from source", string(content))
+}
+
+func TestBootstrapperURL(t *testing.T) {
+	bundle := testBundle(t, map[string]string{"a.service": "a"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user-data":
+			w.Write([]byte("http://" + r.Host + "/bundle.tar.gz\n"))
+		case "/bundle.tar.gz":
+			w.Write(bundle)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	b := &bootstrapper{UserData: server.URL + "/user-data", Dir: dir, Client: server.Client()}
+	assert.True(t, b.Run(context.Background()))
+	assert.FileExists(t, path.Join(dir, "a.service"))
+
+	// Instances without user-data have nothing to bootstrap
+	dir = t.TempDir()
+	b = &bootstrapper{UserData: server.URL + "/missing", Dir: dir, Client: server.Client()}
+	assert.False(t, b.Run(context.Background()))
+	assert.FileExists(t, path.Join(dir, bootstrapMarker))
+}
+
+func TestBootstrapperInvalid(t *testing.T) {
+	userData := path.Join(t.TempDir(), "user-data.txt")
+	require.NoError(t, ioutil.WriteFile(userData, []byte("#cloud-config\npackages: [git]\n"), 0644))
+
+	// Failures are retried on the next start
+	dir := t.TempDir()
+	b := &bootstrapper{UserData: userData, Dir: dir, Attempts: 2}
+	assert.False(t, b.Run(context.Background()))
+	assert.NoFileExists(t, path.Join(dir, bootstrapMarker))
+
+	// Raw tarballs are accepted too
+	require.NoError(t, ioutil.WriteFile(userData, testBundle(t, map[string]string{"a.service": "a"}), 0644))
+	assert.True(t, b.Run(context.Background()))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.json.sig"
+)
+
+// bundleMarker records the manifest of the most recently applied bundle in the src directory, so older bundles
+// can't be applied again by accident or by replaying them.
+const bundleMarker = ".unitmgr-bundle"
+
+// offlineManifest lists the units of an offline bundle. Its ed25519 signature covers the checksums, so verifying
+// the manifest verifies every unit of the bundle.
+type offlineManifest struct {
+	Version     string            `json:"version"`
+	Created     time.Time         `json:"created"`
+	Description string            `json:"description,omitempty"`
+	Units       map[string]string `json:"units"` // unit -> hex sha256 of its content
+}
+
+type bundleResult struct {
+	Version string `json:"version"`
+	Units   int    `json:"units"`
+	Changed int    `json:"changed"`
+}
+
+// loadBundleKey reads a pem encoded ed25519 public key, e.g. as written by openssl pkey -pubout.
+func loadBundleKey(name string) (ed25519.PublicKey, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no pem encoded key found in %q", name)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing bundle key: %w", err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the bundle key %q isn't an ed25519 key", name)
+	}
+	return public, nil
+}
+
+// openBundle verifies the signed manifest of the tarball and returns it with the units it lists.
+func openBundle(tarball []byte, key ed25519.PublicKey) (*offlineManifest, map[string][]byte, error) {
+	files, err := readBundle(tarball)
+	if err != nil {
+		return nil, nil, err
+	}
+	units := map[string][]byte{}
+	var manifest, signature []byte
+	for _, file := range files {
+		switch file.Name {
+		case bundleManifest:
+			manifest = file.Content
+		case bundleSignature:
+			signature = file.Content
+		default:
+			units[file.Name] = file.Content
+		}
+	}
+	if manifest == nil || signature == nil {
+		return nil, nil, fmt.Errorf("the bundle must contain %s and %s", bundleManifest, bundleSignature)
+	}
+	if !ed25519.Verify(key, manifest, signature) {
+		return nil, nil, errors.New("the signature of the bundle's manifest is invalid")
+	}
+
+	m := &offlineManifest{}
+	dec := json.NewDecoder(bytes.NewReader(manifest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		return nil, nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	for unit, content := range units {
+		expected, ok := m.Units[unit]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s isn't listed in the manifest", unit)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != expected {
+			return nil, nil, fmt.Errorf("the checksum of %s doesn't match the manifest", unit)
+		}
+	}
+	for unit := range m.Units {
+		if _, ok := units[unit]; !ok {
+			return nil, nil, fmt.Errorf("%s is listed in the manifest, but missing from the bundle", unit)
+		}
+	}
+	return m, units, nil
+}
+
+// applyBundle replaces the units of rec's Src with those of the verified bundle, returning how many files changed.
+// Bundles created before the most recently applied one are rejected.
+func applyBundle(rec *reconciler.Reconciler, tarball []byte, key ed25519.PublicKey) (*bundleResult, error) {
+	manifest, units, err := openBundle(tarball, key)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := path.Join(rec.Src, bundleMarker)
+	if buf, err := ioutil.ReadFile(marker); err == nil {
+		previous := &offlineManifest{}
+		if err := json.Unmarshal(buf, previous); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", marker, err)
+		}
+		if manifest.Created.Before(previous.Created) {
+			return nil, fmt.Errorf("the bundle was created before the applied bundle %q, created %s", previous.Version, previous.Created.Format(time.RFC3339))
+		}
+	}
+
+	changed, err := replaceUnits(rec, units)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := reconciler.WriteFileAtomic(marker, buf); err != nil {
+		return nil, err
+	}
+	return &bundleResult{Version: manifest.Version, Units: len(units), Changed: changed}, nil
+}
+
+func applyBundleCommand() int {
+	if flag.NArg() != 1 || *bundleK == "" {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr -bundle-key <public key> apply-bundle <file>")
+		return exitFailed
+	}
+	if *invPath != "" {
+		fmt.Fprintln(os.Stderr, "bundles replace the unit files of -src, they can't be combined with -inventory")
+		return exitFailed
+	}
+	key, err := loadBundleKey(*bundleK)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while loading bundle key: %s\n", err)
+		return exitFailed
+	}
+	tarball, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading bundle: %s\n", err)
+		return exitFailed
+	}
+	content, err := readLimited(tarball)
+	tarball.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading bundle: %s\n", err)
+		return exitFailed
+	}
+
+	result, err := applyBundle(&reconciler.Reconciler{Src: *src}, content, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while applying bundle: %s\n", err)
+		return exitFailed
+	}
+
+	// A running instance applies the new unit files itself, otherwise they're applied with a one-shot sync
+	if *control != "" {
+		if _, err := getStatus(controlClient(*control)); err == nil {
+			if !structured(os.Stdout, result) {
+				fmt.Printf("wrote %d unit files of bundle %s, %d changed, the running instance is applying them\n", result.Units, result.Version, result.Changed)
+			}
+			return exitConverged
+		}
+	}
+	if *output == "table" {
+		fmt.Printf("wrote %d unit files of bundle %s, %d changed\n", result.Units, result.Version, result.Changed) // structured output is left to the sync
+	}
+	return syncCommand()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedBundle(t *testing.T, key ed25519.PrivateKey, created time.Time, units map[string]string) []byte {
+	manifest := &offlineManifest{Version: "v1", Created: created, Units: map[string]string{}}
+	files := map[string]string{}
+	for name, content := range units {
+		sum := sha256.Sum256([]byte(content))
+		manifest.Units[name] = hex.EncodeToString(sum[:])
+		files[name] = content
+	}
+	buf, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	files[bundleManifest] = string(buf)
+	files[bundleSignature] = string(ed25519.Sign(key, buf))
+	return testBundle(t, files)
+}
+
+func TestLoadBundleKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	name := path.Join(t.TempDir(), "bundle.pub")
+	require.NoError(t, ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	key, err := loadBundleKey(name)
+	require.NoError(t, err)
+	assert.Equal(t, public, key)
+
+	require.NoError(t, ioutil.WriteFile(name, []byte("not a key"), 0644))
+	_, err = loadBundleKey(name)
+	assert.Error(t, err)
+}
+
+func TestApplyBundle(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	src := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "old.service"), []byte("old"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("b"), 0644))
+	rec := &reconciler.Reconciler{Src: src}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	result, err := applyBundle(rec, signedBundle(t, private, now, map[string]string{"a.service": "a", "b.service": "b"}), public)
+	require.NoError(t, err)
+	assert.Equal(t, &bundleResult{Version: "v1", Units: 2, Changed: 2}, result)
+	units, err := rec.Units()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.service", "b.service"}, units)
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := applyBundle(rec, signedBundle(t, other, now, map[string]string{"a.service": "evil"}), public)
+		assert.EqualError(t, err, "the signature of the bundle's manifest is invalid")
+	})
+
+	t.Run("older bundle", func(t *testing.T) {
+		_, err := applyBundle(rec, signedBundle(t, private, now.Add(-time.Hour), map[string]string{"a.service": "a"}), public)
+		assert.Error(t, err)
+	})
+
+	t.Run("tampered unit", func(t *testing.T) {
+		bundle := signedBundle(t, private, now, map[string]string{"a.service": "a"})
+		files, err := readBundle(bundle)
+		require.NoError(t, err)
+		tampered := map[string]string{"a.service": "evil"}
+		for _, file := range files {
+			if file.Name != "a.service" {
+				tampered[file.Name] = string(file.Content)
+			}
+		}
+		_, err = applyBundle(rec, testBundle(t, tampered), public)
+		assert.EqualError(t, err, "the checksum of a.service doesn't match the manifest")
+
+		delete(tampered, "a.service")
+		_, err = applyBundle(rec, testBundle(t, tampered), public)
+		assert.Error(t, err)
+
+		tampered["a.service"], tampered["extra.service"] = "a", "extra"
+		_, err = applyBundle(rec, testBundle(t, tampered), public)
+		assert.EqualError(t, err, "extra.service isn't listed in the manifest")
+	})
+
+	content, err := ioutil.ReadFile(path.Join(src, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content), "rejected bundles aren't applied")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The completion command is registered by init, since completing the commands refers to them.
+func init() {
+	commands = append(commands, command{"completion", "print the shell completion script for bash, zsh, or fish, e.g. completion bash", true, completionCommand})
+}
+
+func completionCommand() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr completion bash | zsh | fish")
+		return exitFailed
+	}
+	if err := writeCompletion(os.Stdout, flag.CommandLine, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitConverged
+}
+
+// completionFlag is a flag as completed by the shells. Values of flags other than -output are completed as paths,
+// since most of them are.
+type completionFlag struct {
+	Name, Usage string
+	Bool        bool
+	Values      []string // the flag's only valid values, if known
+}
+
+func completionFlags(fs *flag.FlagSet) []*completionFlag {
+	var flags []*completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		cf := &completionFlag{Name: f.Name, Usage: f.Usage}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			cf.Bool = true
+		}
+		if f.Name == "output" {
+			cf.Values = outputFormats
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+// writeCompletion writes the completion script for the commands and flags of unitmgr.
+func writeCompletion(w io.Writer, fs *flag.FlagSet, shell string) error {
+	flags := completionFlags(fs)
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, flags)
+	case "zsh":
+		writeZshCompletion(w, flags)
+	case "fish":
+		writeFishCompletion(w, flags)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash, zsh, or fish", shell)
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer, flags []*completionFlag) {
+	var names, valued []string
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	var all []string
+	for _, f := range flags {
+		all = append(all, "-"+f.Name)
+		if len(f.Values) > 0 {
+			valued = append(valued, fmt.Sprintf("\t\t-%s|--%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.Name, f.Name, strings.Join(f.Values, " ")))
+		}
+	}
+
+	fmt.Fprintf(w, "# bash completion for unitmgr, e.g. unitmgr completion bash > /etc/bash_completion.d/unitmgr\n")
+	fmt.Fprintf(w, "_unitmgr() {\n")
+	fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "\tcase \"$prev\" in\n%s\tesac\n", strings.Join(valued, ""))
+	fmt.Fprintf(w, "\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(all, " "))
+	fmt.Fprintf(w, "\telif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintf(w, "\telse\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\tfi\n}\n")
+	fmt.Fprintf(w, "complete -F _unitmgr unitmgr\n")
+}
+
+func writeZshCompletion(w io.Writer, flags []*completionFlag) {
+	// Descriptions are single quoted, brackets delimit the descriptions of _arguments, and colons the fields of _describe
+	escape := strings.NewReplacer("'", `'\''`, "[", "(", "]", ")")
+	escapeCommand := strings.NewReplacer("'", `'\''`, ":", `\:`)
+
+	fmt.Fprintf(w, "#compdef unitmgr\n\n_unitmgr() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", cmd.Name, escapeCommand.Replace(cmd.Description))
+	}
+	fmt.Fprintf(w, "\t)\n\t_arguments -C \\\n")
+	for _, f := range flags {
+		switch {
+		case f.Bool:
+			fmt.Fprintf(w, "\t\t'-%s[%s]' \\\n", f.Name, escape.Replace(f.Usage))
+		case len(f.Values) > 0:
+			fmt.Fprintf(w, "\t\t'-%s+[%s]:%s:(%s)' \\\n", f.Name, escape.Replace(f.Usage), f.Name, strings.Join(f.Values, " "))
+		default:
+			fmt.Fprintf(w, "\t\t'-%s+[%s]:%s:_files' \\\n", f.Name, escape.Replace(f.Usage), f.Name)
+		}
+	}
+	fmt.Fprintf(w, "\t\t'1: :->command' \\\n\t\t'*:argument:_files'\n")
+	fmt.Fprintf(w, "\tcase $state in\n\tcommand)\n\t\t_describe command commands\n\t\t;;\n\tesac\n}\n\n_unitmgr \"$@\"\n")
+}
+
+func writeFishCompletion(w io.Writer, flags []*completionFlag) {
+	escape := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+	fmt.Fprintf(w, "# fish completion for unitmgr, e.g. unitmgr completion fish > ~/.config/fish/completions/unitmgr.fish\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c unitmgr -n __fish_use_subcommand -f -a %s -d '%s'\n", cmd.Name, escape.Replace(cmd.Description))
+	}
+	for _, f := range flags {
+		switch {
+		case f.Bool:
+			fmt.Fprintf(w, "complete -c unitmgr -o %s -d '%s'\n", f.Name, escape.Replace(f.Usage))
+		case len(f.Values) > 0:
+			fmt.Fprintf(w, "complete -c unitmgr -o %s -d '%s' -x -a '%s'\n", f.Name, escape.Replace(f.Usage), strings.Join(f.Values, " "))
+		default:
+			fmt.Fprintf(w, "complete -c unitmgr -o %s -d '%s' -r -F\n", f.Name, escape.Replace(f.Usage))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("once", false, "sync once")
+	fs.String("src", "", "path to the unit files [required]")
+	fs.String("output", "table", "format of command output")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeCompletion(buf, fs, "bash"))
+	assert.Contains(t, buf.String(), `-output|--output) COMPREPLY=($(compgen -W "table json yaml" -- "$cur")); return ;;`)
+	assert.Contains(t, buf.String(), `compgen -W "-once -output -src"`)
+	assert.Contains(t, buf.String(), "complete -F _unitmgr unitmgr\n")
+
+	buf.Reset()
+	require.NoError(t, writeCompletion(buf, fs, "zsh"))
+	assert.Contains(t, buf.String(), `'-once[sync once]'`)
+	assert.Contains(t, buf.String(), `'-src+[path to the unit files (required)]:src:_files'`)
+	assert.Contains(t, buf.String(), `'-output+[format of command output]:output:(table json yaml)'`)
+	assert.Contains(t, buf.String(), `'status:print the status of the running instance'`)
+
+	buf.Reset()
+	require.NoError(t, writeCompletion(buf, fs, "fish"))
+	assert.Contains(t, buf.String(), "complete -c unitmgr -n __fish_use_subcommand -f -a completion -d 'print the shell completion script for bash, zsh, or fish, e.g. completion bash'\n")
+	assert.Contains(t, buf.String(), "complete -c unitmgr -o src -d 'path to the unit files [required]' -r -F\n")
+
+	assert.EqualError(t, writeCompletion(buf, fs, "tcsh"), `unsupported shell "tcsh", expected bash, zsh, or fish`)
+}
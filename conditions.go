@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCondition is a property of the host that remote sources can be required to wait for,
+// e.g. being connected to an unmetered network.
+type hostCondition interface {
+	Met(ctx context.Context) (bool, error)
+}
+
+// hostConditions are the providers of -poll-when by name. Their argument follows a colon, e.g. exec:/usr/bin/check.
+var hostConditions = map[string]func(arg string) (hostCondition, error){
+	"unmetered": func(string) (hostCondition, error) { return &unmeteredNetwork{}, nil },
+	"ac-power":  func(string) (hostCondition, error) { return &acPower{Dir: "/sys/class/power_supply"}, nil },
+	"exec": func(arg string) (hostCondition, error) {
+		if arg == "" {
+			return nil, errors.New("the exec condition requires a command, e.g. exec:/usr/local/bin/on-wifi")
+		}
+		return &execCondition{Command: arg}, nil
+	},
+}
+
+func hostConditionNames() []string {
+	names := make([]string, 0, len(hostConditions))
+	for name := range hostConditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseHostConditions parses a comma-separated list of conditions, e.g. "unmetered,ac-power".
+func parseHostConditions(s string) (map[string]hostCondition, error) {
+	conditions := map[string]hostCondition{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, arg := spec, ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			name, arg = spec[:i], spec[i+1:]
+		}
+		provider, ok := hostConditions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown host condition %q, expected one of %s", name, strings.Join(hostConditionNames(), ", "))
+		}
+		condition, err := provider(arg)
+		if err != nil {
+			return nil, err
+		}
+		conditions[spec] = condition
+	}
+	return conditions, nil
+}
+
+// pollGate defers polls of remote sources until the host meets every condition and is within the window,
+// and downloads of large files while the host runs on battery.
+type pollGate struct {
+	Conditions map[string]hostCondition // by their spec, all must be met
+	Window     *maintenanceWindow       // optional, poll at any time when nil
+	Power      hostCondition            // optional, whether the host runs on AC power
+	MaxBattery int64                    // downloads larger than this are deferred unless Power is met, zero for no limit
+
+	mu     sync.Mutex
+	reason string // why the previous poll was deferred, to log changes only
+	now    func() time.Time
+}
+
+// Deferred returns true if remote sources shouldn't be polled now. A nil gate never defers polls.
+// Conditions whose providers fail count as unmet, since they were required explicitly.
+func (g *pollGate) Deferred(ctx context.Context) bool {
+	if g == nil {
+		return false
+	}
+	reason := g.check(ctx)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if reason != g.reason {
+		if reason != "" {
+			log.Printf("deferring polls of remote sources: %s", reason)
+		} else {
+			log.Printf("resuming polls of remote sources")
+		}
+		g.reason = reason
+	}
+	return reason != ""
+}
+
+func (g *pollGate) check(ctx context.Context) string {
+	now := time.Now
+	if g.now != nil {
+		now = g.now
+	}
+	if g.Window != nil && !g.Window.Contains(now()) {
+		return "outside of the poll window"
+	}
+
+	specs := make([]string, 0, len(g.Conditions))
+	for spec := range g.Conditions {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		met, err := g.Conditions[spec].Met(ctx)
+		if err != nil {
+			return fmt.Sprintf("error while checking %s: %s", spec, err)
+		}
+		if !met {
+			return fmt.Sprintf("%s isn't met", spec)
+		}
+	}
+	return ""
+}
+
+// AllowDownload returns an error if a download of the given size should be deferred. A nil gate allows every
+// download, as do gates without a MaxBattery or Power condition.
+func (g *pollGate) AllowDownload(ctx context.Context, size int64) error {
+	if g == nil || g.MaxBattery <= 0 || g.Power == nil || size <= g.MaxBattery {
+		return nil
+	}
+	if onAC, err := g.Power.Met(ctx); err != nil || !onAC {
+		return fmt.Errorf("deferring download of %d bytes while the host runs on battery", size)
+	}
+	return nil
+}
+
+// acPower is met unless the host has a battery and none of its external power supplies are online.
+// Hosts without batteries, like most servers, are always on AC power.
+type acPower struct {
+	Dir string // of the kernel's power supplies, i.e. /sys/class/power_supply
+}
+
+func (c *acPower) Met(ctx context.Context) (bool, error) {
+	supplies, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return true, nil // no power supply class, e.g. in containers
+	}
+	battery := false
+	for _, supply := range supplies {
+		kind, _ := ioutil.ReadFile(path.Join(c.Dir, supply.Name(), "type"))
+		switch strings.TrimSpace(string(kind)) {
+		case "Battery":
+			battery = true
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if online, _ := ioutil.ReadFile(path.Join(c.Dir, supply.Name(), "online")); strings.TrimSpace(string(online)) == "1" {
+				return true, nil
+			}
+		}
+	}
+	return !battery, nil
+}
+
+// unmeteredNetwork is met unless NetworkManager considers the host's primary connection metered, e.g. a cellular
+// modem or a phone's hotspot. Connections NetworkManager doesn't know to be metered or not count as unmetered.
+type unmeteredNetwork struct {
+	Run func(ctx context.Context) ([]byte, error) // optional, returns the output of busctl get-property
+}
+
+func (c *unmeteredNetwork) Met(ctx context.Context) (bool, error) {
+	run := c.Run
+	if run == nil {
+		run = func(ctx context.Context) ([]byte, error) {
+			return exec.CommandContext(ctx, "busctl", "get-property", "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+				"org.freedesktop.NetworkManager", "Metered").Output()
+		}
+	}
+	out, err := run(ctx)
+	if err != nil {
+		return false, fmt.Errorf("reading NetworkManager's metered property: %w", err)
+	}
+
+	// NMMetered: 0 unknown, 1 yes, 2 no, 3 guessed yes, 4 guessed no
+	switch strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(out)), "u")) {
+	case "1", "3":
+		return false, nil
+	case "0", "2", "4":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected metered property %q", strings.TrimSpace(string(out)))
+	}
+}
+
+// execCondition runs a command through the shell and is met when it exits with status zero.
+type execCondition struct {
+	Command string
+}
+
+func (c *execCondition) Met(ctx context.Context) (bool, error) {
+	err := exec.CommandContext(ctx, "/bin/sh", "-c", c.Command).Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return false, nil
+	}
+	return err == nil, err
+}
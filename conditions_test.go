@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCondition struct {
+	met bool
+	err error
+}
+
+func (f *fakeCondition) Met(ctx context.Context) (bool, error) {
+	return f.met, f.err
+}
+
+func TestParseHostConditions(t *testing.T) {
+	conditions, err := parseHostConditions("unmetered, ac-power,exec:test -e /tmp")
+	require.NoError(t, err)
+	assert.Len(t, conditions, 3)
+	assert.Equal(t, &execCondition{Command: "test -e /tmp"}, conditions["exec:test -e /tmp"])
+
+	_, err = parseHostConditions("wifi")
+	assert.Error(t, err)
+	_, err = parseHostConditions("exec")
+	assert.Error(t, err)
+}
+
+func TestPollGate(t *testing.T) {
+	var gate *pollGate
+	assert.False(t, gate.Deferred(context.Background()), "nil gates never defer")
+
+	window, err := parseMaintenanceWindow("01:00-05:00")
+	require.NoError(t, err)
+	now := time.Date(2026, 1, 1, 2, 0, 0, 0, time.Local)
+	network := &fakeCondition{met: true}
+	gate = &pollGate{Conditions: map[string]hostCondition{"unmetered": network}, Window: window, now: func() time.Time { return now }}
+	assert.False(t, gate.Deferred(context.Background()))
+
+	network.met = false
+	assert.True(t, gate.Deferred(context.Background()))
+	assert.Equal(t, "unmetered isn't met", gate.reason)
+
+	network.met, network.err = true, errors.New("busctl not found")
+	assert.True(t, gate.Deferred(context.Background()), "failing providers count as unmet")
+
+	network.err = nil
+	now = now.Add(4 * time.Hour)
+	assert.True(t, gate.Deferred(context.Background()))
+	assert.Equal(t, "outside of the poll window", gate.reason)
+}
+
+func TestPollGateAllowDownload(t *testing.T) {
+	power := &fakeCondition{met: false}
+	gate := &pollGate{Power: power, MaxBattery: 100}
+	assert.NoError(t, gate.AllowDownload(context.Background(), 100))
+	assert.NoError(t, gate.AllowDownload(context.Background(), -1), "unknown sizes are allowed")
+	assert.Error(t, gate.AllowDownload(context.Background(), 101))
+
+	power.met = true
+	assert.NoError(t, gate.AllowDownload(context.Background(), 101))
+
+	gate = nil
+	assert.NoError(t, gate.AllowDownload(context.Background(), 101))
+}
+
+func TestACPower(t *testing.T) {
+	dir := t.TempDir()
+	supply := func(name, kind, online string) {
+		require.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name, "type"), []byte(kind+"\n"), 0644))
+		if online != "" {
+			require.NoError(t, ioutil.WriteFile(path.Join(dir, name, "online"), []byte(online+"\n"), 0644))
+		}
+	}
+	c := &acPower{Dir: dir}
+
+	met, err := c.Met(context.Background())
+	require.NoError(t, err)
+	assert.True(t, met, "hosts without batteries are on AC power")
+
+	supply("BAT0", "Battery", "")
+	supply("AC", "Mains", "0")
+	met, err = c.Met(context.Background())
+	require.NoError(t, err)
+	assert.False(t, met)
+
+	supply("AC", "Mains", "1")
+	met, err = c.Met(context.Background())
+	require.NoError(t, err)
+	assert.True(t, met)
+
+	met, err = (&acPower{Dir: path.Join(dir, "missing")}).Met(context.Background())
+	require.NoError(t, err)
+	assert.True(t, met)
+}
+
+func TestUnmeteredNetwork(t *testing.T) {
+	for out, expected := range map[string]bool{"u 0\n": true, "u 1\n": false, "u 2\n": true, "u 3\n": false, "u 4\n": true} {
+		out := out
+		c := &unmeteredNetwork{Run: func(ctx context.Context) ([]byte, error) { return []byte(out), nil }}
+		met, err := c.Met(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expected, met, out)
+	}
+
+	_, err := (&unmeteredNetwork{Run: func(ctx context.Context) ([]byte, error) { return []byte("s yes"), nil }}).Met(context.Background())
+	assert.Error(t, err)
+	_, err = (&unmeteredNetwork{Run: func(ctx context.Context) ([]byte, error) { return nil, errors.New("no bus") }}).Met(context.Background())
+	assert.Error(t, err)
+}
+
+func TestExecCondition(t *testing.T) {
+	met, err := (&execCondition{Command: "exit 0"}).Met(context.Background())
+	require.NoError(t, err)
+	assert.True(t, met)
+
+	met, err = (&execCondition{Command: "exit 1"}).Met(context.Background())
+	require.NoError(t, err)
+	assert.False(t, met)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configLayer holds the flag values of a -config file, a json object like {"retry-max": "10m", "normalize": true}.
+type configLayer struct {
+	Name   string            `json:"name"`
+	Values map[string]string `json:"values"`
+
+	keys   map[string]configPosition // where each flag is set
+	values map[string]configPosition // where the value of each flag starts
+}
+
+// flagSources maps the flags that were set to where: the command line, the environment, or the -config layer.
+var flagSources = map[string]string{}
+
+// configLayers are the layers main applied, to locate the flags of configuration errors.
+var configLayers []*configLayer
+
+// configPosition is a line and column of a -config file, counted from 1.
+type configPosition struct {
+	Line, Col int
+}
+
+func positionAt(buf []byte, offset int64) configPosition {
+	pos := configPosition{Line: 1, Col: 1}
+	for _, b := range buf[:offset] {
+		if b == '\n' {
+			pos.Line, pos.Col = pos.Line+1, 1
+		} else {
+			pos.Col++
+		}
+	}
+	return pos
+}
+
+// configError is a problem at a position of a -config file.
+type configError struct {
+	Name string
+	configPosition
+	Msg string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Col, e.Msg)
+}
+
+// secretFlags are redacted by unitmgr config show.
+var secretFlags = map[string]bool{
+	"smtp-password": true,
+	"pagerduty-key": true,
+	"opsgenie-key":  true,
+	"consul-token":  true,
+	"vault-token":   true,
+	"report-token":  true,
+}
+
+// loadConfigLayer reads a layer, converting numbers and booleans to their flag syntax and lists to comma-separated values.
+// Errors are located in the file.
+func loadConfigLayer(name string) (*configLayer, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(offset int64, format string, args ...interface{}) error {
+		return &configError{Name: name, configPosition: positionAt(buf, offset), Msg: fmt.Sprintf(format, args...)}
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	invalid := func(err error) error {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) && syntax.Offset > 0 {
+			return fail(syntax.Offset-1, "%s", syntax) // the offset is after the offending byte
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fail(int64(len(buf)), "unexpected end of file")
+		}
+		return fail(dec.InputOffset(), "%s", err)
+	}
+
+	start := skipSpace(buf, 0)
+	if tok, err := dec.Token(); err != nil {
+		return nil, invalid(err)
+	} else if tok != json.Delim('{') {
+		return nil, fail(start, "expected an object of flag values")
+	}
+	layer := &configLayer{Name: name, Values: map[string]string{}, keys: map[string]configPosition{}, values: map[string]configPosition{}}
+	for dec.More() {
+		keyStart := skipSpace(buf, dec.InputOffset())
+		if keyStart < int64(len(buf)) && buf[keyStart] == ',' {
+			keyStart = skipSpace(buf, keyStart+1)
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, invalid(err)
+		}
+		key := tok.(string) // object keys are always strings
+		valueStart := skipSpace(buf, dec.InputOffset())
+		if valueStart < int64(len(buf)) && buf[valueStart] == ':' {
+			valueStart = skipSpace(buf, valueStart+1)
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return nil, invalid(err)
+		}
+		if _, ok := layer.keys[key]; ok {
+			return nil, fail(keyStart, "flag %q is set more than once", key)
+		}
+
+		var items []interface{}
+		if list, ok := value.([]interface{}); ok {
+			items = list
+		} else {
+			items = []interface{}{value}
+		}
+		strs := make([]string, len(items))
+		for i, item := range items {
+			switch v := item.(type) {
+			case string:
+				strs[i] = v
+			case json.Number, bool:
+				strs[i] = fmt.Sprint(v)
+			default:
+				return nil, fail(valueStart, "invalid value for %q, expected a string, number, boolean, or list of them", key)
+			}
+		}
+		layer.Values[key] = strings.Join(strs, ",")
+		layer.keys[key], layer.values[key] = positionAt(buf, keyStart), positionAt(buf, valueStart)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, invalid(err)
+	}
+	if end := skipSpace(buf, dec.InputOffset()); end < int64(len(buf)) {
+		return nil, fail(end, "unexpected content after the object")
+	}
+	return layer, nil
+}
+
+func skipSpace(buf []byte, offset int64) int64 {
+	for offset < int64(len(buf)) && strings.IndexByte(" \t\r\n", buf[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// loadConfigLayers reads the comma-separated layers of -config in order.
+func loadConfigLayers(names string) ([]*configLayer, error) {
+	var layers []*configLayer
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		layer, err := loadConfigLayer(name)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// applyConfig sets flags that weren't given on the command line or by environment variables from the layers,
+// later layers overriding earlier ones, e.g. defaults, then an environment, then a host class. It returns the
+// layer each flag was set from.
+func applyConfig(fs *flag.FlagSet, layers []*configLayer) (map[string]string, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	merged, sources := map[string]string{}, map[string]string{}
+	for _, layer := range layers {
+		for key, value := range layer.Values {
+			if fs.Lookup(key) == nil || key == "config" {
+				return nil, fmt.Errorf("config %s sets unknown flag %q", layer.Name, key)
+			}
+			merged[key], sources[key] = value, layer.Name
+		}
+	}
+
+	for key, value := range merged {
+		if given[key] {
+			delete(sources, key)
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s in config %s: %s", value, key, sources[key], err)
+		}
+	}
+	return sources, nil
+}
+
+// validateConfig returns every problem of the layers before any is applied: unknown flags and values their flags
+// can't parse, like malformed durations, located in their files.
+func validateConfig(fs *flag.FlagSet, layers []*configLayer) []error {
+	var errs []error
+	for _, layer := range layers {
+		keys := make([]string, 0, len(layer.Values))
+		for key := range layer.Values {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := layer.keys[keys[i]], layer.keys[keys[j]]
+			return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+		})
+
+		for _, key := range keys {
+			f := fs.Lookup(key)
+			if f == nil || key == "config" {
+				msg := fmt.Sprintf("unknown flag %q", key)
+				if similar := similarFlag(fs, key); similar != "" {
+					msg += fmt.Sprintf(", did you mean %q?", similar)
+				}
+				errs = append(errs, &configError{Name: layer.Name, configPosition: layer.keys[key], Msg: msg})
+				continue
+			}
+			if err := checkFlagValue(f, layer.Values[key]); err != nil {
+				errs = append(errs, &configError{Name: layer.Name, configPosition: layer.values[key], Msg: fmt.Sprintf("invalid value %q for %s: %s", layer.Values[key], key, err)})
+			}
+		}
+	}
+	return errs
+}
+
+// checkFlagValue parses the value like the flag would without setting it.
+func checkFlagValue(f *flag.Flag, value string) error {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	case int, int64:
+		_, err = strconv.ParseInt(value, 0, 64)
+	case uint, uint64:
+		_, err = strconv.ParseUint(value, 0, 64)
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		err = numErr.Err // the value is already part of the message
+	}
+	return err
+}
+
+// similarFlag returns the flag whose name is closest to the unknown one if it's likely a typo.
+func similarFlag(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance && f.Name != "config" {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+var flagMention = regexp.MustCompile(`(?:^|[\s("])-([a-z][a-z0-9-]*)`)
+
+// configLocations returns where the -config layers set the flags mentioned by an error, e.g. of flags that conflict,
+// like " (-reexec is set at prod.json:4:3)", or "" if none of them were set by a layer.
+func configLocations(msg string) string {
+	seen := map[string]bool{}
+	var locations []string
+	for _, match := range flagMention.FindAllStringSubmatch(msg, -1) {
+		name := match[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for i := len(configLayers) - 1; i >= 0; i-- { // the last layer setting it wins
+			layer := configLayers[i]
+			if pos, ok := layer.keys[name]; ok && flagSources[name] == layer.Name {
+				locations = append(locations, fmt.Sprintf("-%s is set at %s:%d:%d", name, layer.Name, pos.Line, pos.Col))
+				break
+			}
+		}
+	}
+	if len(locations) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(locations, ", ") + ")"
+}
+
+// validateConfigCommand checks the flags for conflicts once main validated and applied the -config layers.
+func validateConfigCommand() int {
+	if err := checkSetup(); err != nil {
+		return setupFailed(err)
+	}
+	fmt.Printf("configuration is valid: %d -config layers, %d flags set\n", len(configLayers), len(flagSources))
+	return exitConverged
+}
+
+// checkSetup returns the error setup and the schedulers return for conflicting or invalid flags, without managing anything.
+func checkSetup() error {
+	_, reconcilers, err := setup()
+	if err != nil {
+		return err
+	}
+	if _, err := newRebootScheduler(reconcilers); err != nil {
+		return err
+	}
+	if _, err := newReexecScheduler(reconcilers); err != nil {
+		return err
+	}
+	_, err = newPollGate()
+	return err
+}
+
+// recordSources attributes the flags that were set and aren't attributed yet to source.
+func recordSources(fs *flag.FlagSet, source string) {
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := flagSources[f.Name]; !ok {
+			flagSources[f.Name] = source
+		}
+	})
+}
+
+// effectiveFlag is the value of a flag after merging the layers, environment, and command line.
+type effectiveFlag struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // default, command line, environment, or the path of a -config layer
+}
+
+func effectiveConfig(fs *flag.FlagSet, sources map[string]string) []*effectiveFlag {
+	var flags []*effectiveFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			source = "default"
+		}
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		flags = append(flags, &effectiveFlag{Name: f.Name, Value: value, Source: source})
+	})
+	return flags
+}
+
+func configCommand() int {
+	args := flag.Args()
+	effective := len(args) == 2 && (args[1] == "--effective" || args[1] == "-effective")
+	if len(args) == 0 || args[0] != "show" || (len(args) == 2 && !effective) || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr config show [--effective]")
+		return exitFailed
+	}
+
+	if effective {
+		flags := effectiveConfig(flag.CommandLine, flagSources)
+		if !structured(os.Stdout, flags) {
+			printEffectiveConfig(os.Stdout, flags)
+		}
+		return exitConverged
+	}
+
+	layers, err := loadConfigLayers(*configF)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading the config: %s\n", err)
+		return exitFailed
+	}
+	for _, layer := range layers {
+		for key := range layer.Values {
+			if secretFlags[key] {
+				layer.Values[key] = "<redacted>"
+			}
+		}
+	}
+	if !structured(os.Stdout, layers) {
+		printConfigLayers(os.Stdout, layers)
+	}
+	return exitConverged
+}
+
+func printConfigLayers(w io.Writer, layers []*configLayer) {
+	if len(layers) == 0 {
+		fmt.Fprintln(w, "no -config layers")
+		return
+	}
+	for i, layer := range layers {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "# %s\n", layer.Name)
+		keys := make([]string, 0, len(layer.Values))
+		for key := range layer.Values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s = %s\n", key, layer.Values[key])
+		}
+	}
+}
+
+// printEffectiveConfig prints the flags that were set, followed by the defaults.
+func printEffectiveConfig(w io.Writer, flags []*effectiveFlag) {
+	sorted := append([]*effectiveFlag(nil), flags...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Source != "default" && sorted[j].Source == "default"
+	})
+	for _, f := range sorted {
+		fmt.Fprintf(w, "%s = %s  # %s\n", f.Name, f.Value, f.Source)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	base := path.Join(dir, "base.json")
+	prod := path.Join(dir, "prod.json")
+	host := path.Join(dir, "web.json")
+	require.NoError(t, ioutil.WriteFile(base, []byte(`{"src": "/units", "retry-max": "10m", "workers": 2, "notify": ["a", "b"]}`), 0644))
+	require.NoError(t, ioutil.WriteFile(prod, []byte(`{"retry-max": "30m", "normalize": true}`), 0644))
+	require.NoError(t, ioutil.WriteFile(host, []byte(`{"workers": 8, "src": "/from/host"}`), 0644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	src := fs.String("src", ".", "")
+	retryMax := fs.Duration("retry-max", time.Minute, "")
+	workers := fs.Int("workers", 1, "")
+	normalize := fs.Bool("normalize", false, "")
+	notify := fs.String("notify", "", "")
+	require.NoError(t, fs.Parse([]string{"-workers", "4"}))
+
+	layers, err := loadConfigLayers(base + ", " + prod + "," + host)
+	require.NoError(t, err)
+	sources, err := applyConfig(fs, layers)
+	require.NoError(t, err)
+	assert.Equal(t, "/from/host", *src, "later layers take precedence")
+	assert.Equal(t, 30*time.Minute, *retryMax)
+	assert.Equal(t, 4, *workers, "flags take precedence")
+	assert.True(t, *normalize)
+	assert.Equal(t, "a,b", *notify)
+	assert.Equal(t, map[string]string{"src": host, "retry-max": prod, "normalize": prod, "notify": base}, sources)
+
+	require.NoError(t, ioutil.WriteFile(host, []byte(`{"retries": 3}`), 0644))
+	layers, err = loadConfigLayers(host)
+	require.NoError(t, err)
+	_, err = applyConfig(fs, layers)
+	assert.EqualError(t, err, `config `+host+` sets unknown flag "retries"`)
+
+	require.NoError(t, ioutil.WriteFile(host, []byte(`{"workers": "many"}`), 0644))
+	layers, err = loadConfigLayers(host)
+	require.NoError(t, err)
+	_, err = applyConfig(flag.NewFlagSet("test", flag.ContinueOnError), layers)
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(host, []byte(`{"workers": {"min": 1}}`), 0644))
+	_, err = loadConfigLayers(host)
+	assert.EqualError(t, err, host+`:1:13: invalid value for "workers", expected a string, number, boolean, or list of them`)
+}
+
+func TestLoadConfigLayerErrors(t *testing.T) {
+	name := path.Join(t.TempDir(), "config.json")
+	for content, expected := range map[string]string{
+		"{\n  \"src\": \"/units\",\n  \"workers\": 2,\n}\n":     "3:15: invalid character ',' looking for beginning of value",
+		"{\n  \"src\": \"/units\",\n  \"src\": \"/other\"\n}\n": `3:3: flag "src" is set more than once`,
+		"{\n  \"src\": \"/units\"":                              "2:17: unexpected end of JSON input",
+		"[\"src\"]":                                             "1:1: expected an object of flag values",
+		"{\"src\": \"/units\"} {}":                              "1:19: unexpected content after the object",
+	} {
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+		_, err := loadConfigLayer(name)
+		assert.EqualError(t, err, name+":"+expected, content)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	name := path.Join(t.TempDir(), "config.json")
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{
+  "src": "/units",
+  "retry-mx": "10m",
+  "retry-max": "10 minutes",
+  "workers": 2.5,
+  "normalize": "yes please",
+  "config": "other.json"
+}
+`), 0644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("src", ".", "")
+	fs.String("config", "", "")
+	fs.Duration("retry-max", time.Minute, "")
+	fs.Int("workers", 1, "")
+	fs.Bool("normalize", false, "")
+	layer, err := loadConfigLayer(name)
+	require.NoError(t, err)
+
+	var msgs []string
+	for _, err := range validateConfig(fs, []*configLayer{layer}) {
+		msgs = append(msgs, strings.TrimPrefix(err.Error(), name+":"))
+	}
+	assert.Equal(t, []string{
+		`3:3: unknown flag "retry-mx", did you mean "retry-max"?`,
+		`4:16: invalid value "10 minutes" for retry-max: time: unknown unit " minutes" in duration "10 minutes"`,
+		`5:14: invalid value "2.5" for workers: invalid syntax`,
+		`6:16: invalid value "yes please" for normalize: invalid syntax`,
+		`7:3: unknown flag "config"`,
+	}, msgs)
+}
+
+func TestConfigLocations(t *testing.T) {
+	defer func(layers []*configLayer, sources map[string]string) {
+		configLayers, flagSources = layers, sources
+	}(configLayers, flagSources)
+	configLayers = []*configLayer{
+		{Name: "base.json", keys: map[string]configPosition{"host": {Line: 2, Col: 3}, "reexec": {Line: 3, Col: 3}}},
+		{Name: "prod.json", keys: map[string]configPosition{"reexec": {Line: 4, Col: 3}}},
+	}
+	flagSources = map[string]string{"host": "base.json", "reexec": "prod.json", "inventory": "command line"}
+
+	assert.Equal(t, " (-reexec is set at prod.json:4:3, -host is set at base.json:2:3)", configLocations("-reexec can't be combined with -host or -inventory"))
+	assert.Equal(t, "", configLocations("-inventory requires a file"))
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("src", ".", "")
+	fs.String("report-token", "", "")
+	fs.Int("workers", 1, "")
+	require.NoError(t, fs.Parse([]string{"-src", "/units", "-report-token", "hunter2"}))
+
+	flags := effectiveConfig(fs, map[string]string{"src": "command line", "report-token": "/etc/unitmgr/base.json"})
+	buf := &bytes.Buffer{}
+	printEffectiveConfig(buf, flags)
+	assert.Equal(t, "report-token = <redacted>  # /etc/unitmgr/base.json\nsrc = /units  # command line\nworkers = 1  # default\n", buf.String())
+
+	buf.Reset()
+	printConfigLayers(buf, []*configLayer{{Name: "base.json", Values: map[string]string{"src": "/units", "workers": "2"}}, {Name: "web.json", Values: map[string]string{"workers": "8"}}})
+	assert.Equal(t, "# base.json\nsrc = /units\nworkers = 2\n\n# web.json\nworkers = 8\n", buf.String())
+}
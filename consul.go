@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultConsulTTL is how long Consul and Vault lookups are cached when their TTL isn't set.
+const defaultConsulTTL = time.Second * 30
+
+// consulTemplateFuncs returns the functions of consul-template that don't need a backend, so its templates render unchanged.
+func consulTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"env":        os.Getenv,
+		"toLower":    strings.ToLower,
+		"toUpper":    strings.ToUpper,
+		"trimSpace":  strings.TrimSpace,
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, s []string) string { return strings.Join(s, sep) },
+		"replaceAll": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"toJSON": func(v interface{}) (string, error) {
+			js, err := json.Marshal(v)
+			return string(js), err
+		},
+	}
+}
+
+// consulBackend resolves the key, keyOrDefault, ls, and service functions of consul-template through Consul's http api.
+type consulBackend struct {
+	Addr   string // e.g. http://127.0.0.1:8500
+	Token  string // optional acl token
+	Client *http.Client
+	TTL    time.Duration // how long lookups are cached, defaults to defaultConsulTTL
+
+	cache ttlCache
+}
+
+// consulPair is a key of Consul's KV store listed by ls.
+type consulPair struct {
+	Key   string // relative to the listed prefix
+	Value string
+}
+
+// consulService is a healthy instance of a service.
+type consulService struct {
+	Node    string
+	Address string // of the service, or of its node if the service doesn't set one
+	ID      string
+	Name    string
+	Port    int
+	Tags    []string
+}
+
+// Funcs returns the template functions querying Consul with the given context.
+func (c *consulBackend) Funcs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"key": func(key string) (string, error) {
+			value, ok, err := c.Key(ctx, key)
+			if err == nil && !ok {
+				err = fmt.Errorf("key %q doesn't exist in consul", key)
+			}
+			return value, err
+		},
+		"keyOrDefault": func(key, fallback string) (string, error) {
+			value, ok, err := c.Key(ctx, key)
+			if !ok {
+				value = fallback
+			}
+			return value, err
+		},
+		"ls":      func(prefix string) ([]*consulPair, error) { return c.List(ctx, prefix) },
+		"service": func(name string) ([]*consulService, error) { return c.Service(ctx, name) },
+	}
+}
+
+// Key returns the value of a key, and false if it doesn't exist.
+func (c *consulBackend) Key(ctx context.Context, key string) (string, bool, error) {
+	value, err := c.get(ctx, "/v1/kv/"+strings.TrimPrefix(key, "/")+"?raw", func(body []byte) (interface{}, error) {
+		return string(body), nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if value == nil {
+		return "", false, nil
+	}
+	return value.(string), true, nil
+}
+
+// List returns the keys directly below a prefix, like consul-template's ls.
+func (c *consulBackend) List(ctx context.Context, prefix string) ([]*consulPair, error) {
+	prefix = strings.Trim(prefix, "/") + "/"
+	value, err := c.get(ctx, "/v1/kv/"+prefix+"?recurse", func(body []byte) (interface{}, error) {
+		var entries []struct {
+			Key   string
+			Value []byte // base64 in json
+		}
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, err
+		}
+		pairs := []*consulPair{}
+		for _, entry := range entries {
+			key := strings.TrimPrefix(entry.Key, prefix)
+			if key == "" || strings.Contains(key, "/") {
+				continue // the prefix itself or nested keys
+			}
+			pairs = append(pairs, &consulPair{Key: key, Value: string(entry.Value)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		return pairs, nil
+	})
+	if err != nil || value == nil {
+		return []*consulPair{}, err
+	}
+	return value.([]*consulPair), nil
+}
+
+// Service returns the healthy instances of a service, which can be filtered by tag and datacenter
+// like in consul-template, e.g. primary.web@dc2.
+func (c *consulBackend) Service(ctx context.Context, query string) ([]*consulService, error) {
+	params := url.Values{"passing": {"1"}}
+	name := query
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		params.Set("dc", name[i+1:])
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		params.Set("tag", name[:i])
+		name = name[i+1:]
+	}
+	value, err := c.get(ctx, "/v1/health/service/"+url.PathEscape(name)+"?"+params.Encode(), func(body []byte) (interface{}, error) {
+		var entries []struct {
+			Node struct {
+				Node    string
+				Address string
+			}
+			Service struct {
+				ID      string
+				Service string
+				Tags    []string
+				Address string
+				Port    int
+			}
+		}
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, err
+		}
+		services := []*consulService{}
+		for _, entry := range entries {
+			service := &consulService{Node: entry.Node.Node, Address: entry.Service.Address, ID: entry.Service.ID, Name: entry.Service.Service, Port: entry.Service.Port, Tags: entry.Service.Tags}
+			if service.Address == "" {
+				service.Address = entry.Node.Address
+			}
+			services = append(services, service)
+		}
+		sort.Slice(services, func(i, j int) bool {
+			if services[i].Node != services[j].Node {
+				return services[i].Node < services[j].Node
+			}
+			return services[i].ID < services[j].ID
+		})
+		return services, nil
+	})
+	if err != nil || value == nil {
+		return []*consulService{}, err
+	}
+	return value.([]*consulService), nil
+}
+
+// get returns the cached result of decoding the response to a request, or nil if Consul responded with 404.
+func (c *consulBackend) get(ctx context.Context, uri string, decode func([]byte) (interface{}, error)) (interface{}, error) {
+	if c.Addr == "" {
+		return nil, fmt.Errorf("-consul-addr is required to query consul")
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultConsulTTL
+	}
+	return c.cache.Get(uri, ttl, func() (interface{}, error) {
+		body, err := getBackend(ctx, c.Client, strings.TrimSuffix(c.Addr, "/")+uri, "X-Consul-Token", c.Token)
+		if err != nil || body == nil {
+			return nil, err
+		}
+		value, err := decode(body)
+		if err != nil {
+			return nil, fmt.Errorf("decoding response of consul: %w", err)
+		}
+		return value, nil
+	})
+}
+
+// vaultBackend resolves consul-template's secret function through Vault's http api.
+type vaultBackend struct {
+	Addr   string // e.g. https://vault.example.com:8200
+	Token  string
+	Client *http.Client
+	TTL    time.Duration // how long secrets are cached, defaults to defaultConsulTTL
+
+	cache ttlCache
+}
+
+// vaultSecret is a secret read from Vault. The secrets of KV version 2 engines are in Data.data.
+type vaultSecret struct {
+	Data          map[string]interface{}
+	LeaseDuration int
+	Renewable     bool
+}
+
+// Funcs returns the template functions querying Vault with the given context.
+func (v *vaultBackend) Funcs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(path string) (*vaultSecret, error) { return v.Secret(ctx, path) },
+	}
+}
+
+// Secret reads the secret at a path like secret/data/web.
+func (v *vaultBackend) Secret(ctx context.Context, path string) (*vaultSecret, error) {
+	if v.Addr == "" {
+		return nil, fmt.Errorf("-vault-addr is required to read secrets")
+	}
+	ttl := v.TTL
+	if ttl <= 0 {
+		ttl = defaultConsulTTL
+	}
+	value, err := v.cache.Get(path, ttl, func() (interface{}, error) {
+		body, err := getBackend(ctx, v.Client, strings.TrimSuffix(v.Addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), "X-Vault-Token", v.Token)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return nil, fmt.Errorf("secret %q doesn't exist in vault", path)
+		}
+		resp := struct {
+			Data          map[string]interface{} `json:"data"`
+			LeaseDuration int                    `json:"lease_duration"`
+			Renewable     bool                   `json:"renewable"`
+		}{}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("decoding response of vault: %w", err)
+		}
+		return &vaultSecret{Data: resp.Data, LeaseDuration: resp.LeaseDuration, Renewable: resp.Renewable}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*vaultSecret), nil
+}
+
+// getBackend returns the body of a successful request authenticated with a token header, or nil if the request returned 404.
+func getBackend(ctx context.Context, client *http.Client, u, header, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(header, token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.Path)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
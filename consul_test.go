@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulBackend(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/web/port":
+			w.Write([]byte("8080"))
+		case "/v1/kv/web/":
+			w.Write([]byte(`[{"Key": "web/", "Value": null}, {"Key": "web/port", "Value": "ODA4MA=="}, {"Key": "web/a/b", "Value": "Yg=="}]`))
+		case "/v1/health/service/web":
+			w.Write([]byte(`[
+				{"Node": {"Node": "node2", "Address": "10.0.0.2"}, "Service": {"ID": "web", "Service": "web", "Tags": ["primary"], "Port": 80}},
+				{"Node": {"Node": "node1", "Address": "10.0.0.1"}, "Service": {"ID": "web", "Service": "web", "Address": "172.16.0.1", "Port": 8080}}
+			]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	c := &consulBackend{Addr: server.URL, Token: "token", Client: server.Client()}
+
+	value, ok, err := c.Key(context.Background(), "web/port")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "8080", value)
+	_, ok, err = c.Key(context.Background(), "web/missing")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	pairs, err := c.List(context.Background(), "web")
+	require.NoError(t, err)
+	assert.Equal(t, []*consulPair{{Key: "port", Value: "8080"}}, pairs)
+
+	services, err := c.Service(context.Background(), "primary.web@dc2")
+	require.NoError(t, err)
+	assert.Equal(t, []*consulService{
+		{Node: "node1", Address: "172.16.0.1", ID: "web", Name: "web", Port: 8080},
+		{Node: "node2", Address: "10.0.0.2", ID: "web", Name: "web", Port: 80, Tags: []string{"primary"}},
+	}, services)
+	assert.Contains(t, requests, "/v1/health/service/web?dc=dc2&passing=1&tag=primary")
+
+	// Lookups are cached
+	n := len(requests)
+	_, _, err = c.Key(context.Background(), "web/port")
+	require.NoError(t, err)
+	assert.Len(t, requests, n)
+
+	_, _, err = (&consulBackend{}).Key(context.Background(), "web/port")
+	assert.Error(t, err)
+}
+
+func TestVaultBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/web" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"lease_duration": 0, "data": {"data": {"password": "hunter2"}, "metadata": {"version": 3}}}`))
+	}))
+	defer server.Close()
+	v := &vaultBackend{Addr: server.URL, Token: "token", Client: server.Client()}
+
+	secret, err := v.Secret(context.Background(), "secret/data/web")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"password": "hunter2"}, secret.Data["data"])
+
+	_, err = v.Secret(context.Background(), "secret/data/missing")
+	assert.Error(t, err)
+}
+
+func TestRendererConsulTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/web/port":
+			w.Write([]byte("8080"))
+		case "/v1/secret/data/web":
+			w.Write([]byte(`{"data": {"data": {"password": "hunter2"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	template := `[Service]
+Environment=PORT={{key "web/port"}} DEBUG={{keyOrDefault "web/debug" "false" | toUpper}}
+{{with secret "secret/data/web"}}Environment=PASSWORD={{.Data.data.password}}{{end}}
+`
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "web.service.tmpl"), []byte(template), 0600))
+	r := &renderer{Dir: dir, Consul: &consulBackend{Addr: server.URL, Client: server.Client()}, Vault: &vaultBackend{Addr: server.URL, Client: server.Client()}}
+	require.NoError(t, r.Render(context.Background()))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "web.service"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "[Service]\nEnvironment=PORT=8080 DEBUG=FALSE\nEnvironment=PASSWORD=hunter2\n"))
+}
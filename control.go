@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+)
+
+// controlServer exposes the state of the running instance to the other commands over a unix socket.
+type controlServer struct {
+	Rollback func(generation int64) (int, error)                         // optional, restores the unit files of a generation, see historyStore.Restore
+	Promote  func(ref string) (string, error)                            // optional, pins the git source to a ref, see gitSource.Promote
+	Trigger  func(name string)                                           // optional, syncs a file of a source as if it changed, see reconciler.Manager.Trigger
+	Reboot   func(ctx context.Context, rec *reconciler.Reconciler) error // optional, runs a queued reboot early, see rebootHost
+
+	mu          sync.Mutex
+	reports     []*reconciler.HostReport
+	reconcilers []*reconciler.Reconciler
+	events      []*controlEvent // the most recent maxEvents, oldest first
+	ok          bool
+}
+
+// maxEvents is how many unit state transitions the control server keeps for unitmgr top.
+const maxEvents = 50
+
+// controlEvent is a unit's change of state, see reconciler.Transition.
+type controlEvent struct {
+	Src    string               `json:"src,omitempty"`
+	Unit   string               `json:"unit"`
+	From   reconciler.UnitState `json:"from,omitempty"`
+	To     reconciler.UnitState `json:"to"`
+	Reason string               `json:"reason,omitempty"`
+	Time   time.Time            `json:"time"`
+}
+
+// hostUnits is the runtime state of a reconciler's units according to systemd.
+type hostUnits struct {
+	Host  string                        `json:"host"`
+	Src   string                        `json:"src,omitempty"`
+	Units map[string]*systemd.UnitState `json:"units"`
+}
+
+// unitStater is implemented by Systemd implementations that can query the runtime state of units, see systemd.Systemctl.
+type unitStater interface {
+	UnitStates(ctx context.Context, units []string) (map[string]*systemd.UnitState, error)
+}
+
+// Record returns a hook keeping the state transitions of the reconciler syncing src.
+func (c *controlServer) Record(src string) reconciler.TransitionHook {
+	return func(t *reconciler.Transition) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.events = append(c.events, &controlEvent{Src: src, Unit: t.Unit, From: t.From, To: t.To, Reason: t.Reason, Time: t.Time})
+		if len(c.events) > maxEvents {
+			c.events = c.events[len(c.events)-maxEvents:]
+		}
+	}
+}
+
+// SetReports stores a snapshot of every reconciler's state.
+func (c *controlServer) SetReports(reconcilers []*reconciler.Reconciler, ok bool) {
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(ok)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reports = reports
+	c.reconcilers = reconcilers
+	c.ok = ok
+}
+
+// units queries the runtime state of every managed unit. Reconcilers whose Systemd can't be queried are omitted.
+func (c *controlServer) units(ctx context.Context) ([]*hostUnits, error) {
+	c.mu.Lock()
+	reconcilers, reports := c.reconcilers, c.reports
+	c.mu.Unlock()
+
+	result := []*hostUnits{}
+	for i, rec := range reconcilers {
+		stater, ok := rec.Systemd.(unitStater)
+		if !ok {
+			continue
+		}
+		units := make([]string, 0, len(reports[i].Units))
+		for unit := range reports[i].Units {
+			units = append(units, unit)
+		}
+		sort.Strings(units)
+		states, err := stater.UnitStates(ctx, units)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &hostUnits{Host: reports[i].Host, Src: reports[i].Src, Units: states})
+	}
+	return result, nil
+}
+
+// Refresh updates the snapshots between syncs without changing the outcome or time of the last sync.
+func (c *controlServer) Refresh(reconcilers []*reconciler.Reconciler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.reports) != len(reconcilers) {
+		return // no sync has completed yet
+	}
+
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(c.ok)
+		reports[i].LastSync = c.reports[i].LastSync
+	}
+	c.reports = reports
+}
+
+func (c *controlServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		c.mu.Lock()
+		reports := c.reports
+		c.mu.Unlock()
+		if reports == nil {
+			reports = []*reconciler.HostReport{} // no sync has completed yet
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	})
+	mux.HandleFunc("/v1/units", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		units, err := c.units(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(units)
+	})
+	mux.HandleFunc("/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		c.mu.Lock()
+		events := append([]*controlEvent{}, c.events...)
+		c.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+	mux.HandleFunc("/v1/rollback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if c.Rollback == nil {
+			http.Error(w, "rollbacks require -history-dir", http.StatusNotImplemented)
+			return
+		}
+		req := &rollbackRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Generation <= 0 {
+			http.Error(w, "expected a json body with a positive generation", http.StatusBadRequest)
+			return
+		}
+
+		restored, err := c.Rollback(req.Generation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&rollbackResponse{Restored: restored})
+	})
+	mux.HandleFunc("/v1/queue", c.handleQueue)
+	mux.HandleFunc("/v1/queue/", c.handleQueue)
+	mux.HandleFunc("/v1/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if c.Promote == nil {
+			http.Error(w, "promotions require -git-url", http.StatusNotImplemented)
+			return
+		}
+		req := &promoteRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Ref == "" {
+			http.Error(w, "expected a json body with a ref", http.StatusBadRequest)
+			return
+		}
+
+		commit, err := c.Promote(req.Ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&promoteResponse{Commit: commit})
+	})
+	return mux
+}
+
+type rollbackRequest struct {
+	Generation int64 `json:"generation"`
+}
+
+type rollbackResponse struct {
+	Restored int `json:"restored"` // unit files changed in src
+}
+
+type promoteRequest struct {
+	Ref string `json:"ref"`
+}
+
+type promoteResponse struct {
+	Commit string `json:"commit"` // mirrored into src
+}
+
+// listenControl listens on the unix socket at name, replacing the socket of a previous instance.
+// Only root can connect since the control api isn't authenticated.
+func listenControl(name string) (net.Listener, error) {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(name, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// controlClient returns a client whose requests are sent to the control socket regardless of the url's host.
+func controlClient(name string) *http.Client {
+	return &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", name)
+			},
+		},
+	}
+}
+
+func getStatus(client *http.Client) ([]*reconciler.HostReport, error) {
+	resp, err := client.Get("http://unitmgr/v1/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var reports []*reconciler.HostReport
+	return reports, json.NewDecoder(resp.Body).Decode(&reports)
+}
+
+func getUnits(client *http.Client) ([]*hostUnits, error) {
+	resp, err := client.Get("http://unitmgr/v1/units")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var units []*hostUnits
+	return units, json.NewDecoder(resp.Body).Decode(&units)
+}
+
+func getEvents(client *http.Client) ([]*controlEvent, error) {
+	resp, err := client.Get("http://unitmgr/v1/events")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var events []*controlEvent
+	return events, json.NewDecoder(resp.Body).Decode(&events)
+}
+
+// notRunning returns true if a request to the control socket failed because no instance is listening on it.
+func notRunning(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// postPromote asks the running instance to pin its git source to a ref, returning the mirrored commit.
+func postPromote(client *http.Client, ref string) (string, error) {
+	body, err := json.Marshal(&promoteRequest{Ref: ref})
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Post("http://unitmgr/v1/promote", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	result := &promoteResponse{}
+	return result.Commit, json.NewDecoder(resp.Body).Decode(result)
+}
+
+// postRollback asks the running instance to roll back to a generation, returning how many unit files it restored.
+func postRollback(client *http.Client, generation int64) (int, error) {
+	body, err := json.Marshal(&rollbackRequest{Generation: generation})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Post("http://unitmgr/v1/rollback", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	result := &rollbackResponse{}
+	return result.Restored, json.NewDecoder(resp.Body).Decode(result)
+}
+
+func statusCommand() int {
+	reports, err := getStatus(controlClient(*control))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while querying %s, is unitmgr running? %s\n", *control, err)
+		return exitFailed
+	}
+	if !structured(os.Stdout, reports) {
+		printStatus(os.Stdout, reports)
+	}
+
+	for _, report := range reports {
+		if !report.OK {
+			return exitFailed
+		}
+	}
+	return exitConverged
+}
+
+func printStatus(w io.Writer, reports []*reconciler.HostReport) {
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "waiting for the first sync")
+	}
+	for _, report := range reports {
+		state := "ok"
+		if !report.OK {
+			state = "failing"
+		}
+		fmt.Fprintf(w, "%s %s: %s, %d units, generation %d, last synced %s\n", report.Host, report.Src, state, len(report.Units), report.Generation, report.LastSync.Local().Format(time.RFC3339))
+
+		units := make([]string, 0, len(report.Failures))
+		for unit := range report.Failures {
+			units = append(units, unit)
+		}
+		sort.Strings(units)
+		for _, unit := range units {
+			fmt.Fprintf(w, "  %s: %s\n", unit, report.Failures[unit])
+		}
+		flapping := make([]string, 0, len(report.Stability))
+		for unit, stability := range report.Stability {
+			if stability.Flapping {
+				flapping = append(flapping, unit)
+			}
+		}
+		sort.Strings(flapping)
+		for _, unit := range flapping {
+			fmt.Fprintf(w, "  %s: flapping, restarted %d times in the last hour\n", unit, report.Stability[unit].Restarts)
+		}
+		quarantined := make([]string, 0, len(report.States))
+		for unit, status := range report.States {
+			if status.State == reconciler.StateQuarantined {
+				quarantined = append(quarantined, unit)
+			}
+		}
+		sort.Strings(quarantined)
+		for _, unit := range quarantined {
+			fmt.Fprintf(w, "  %s: quarantined, %s\n", unit, report.States[unit].Reason)
+		}
+		if report.Freeze != "" {
+			fmt.Fprintf(w, "  changes frozen: %s\n", report.Freeze)
+		}
+		if len(report.Reboot) > 0 {
+			fmt.Fprintf(w, "  reboot required for changes to %s\n", strings.Join(report.Reboot, ", "))
+		}
+		for _, change := range report.Pending {
+			fmt.Fprintf(w, "  would %s %s\n", change.Action, change.Unit)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlServer(t *testing.T) {
+	name := path.Join(t.TempDir(), "unitmgr.sock")
+	listener, err := listenControl(name)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	cs := &controlServer{}
+	go http.Serve(listener, cs.Handler())
+	client := controlClient(name)
+
+	reports, err := getStatus(client)
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	r := &reconciler.Reconciler{
+		Src:      "/src",
+		State:    map[string]string{"a.service": "abc"},
+		Failures: map[string]string{"b.service": "oops"},
+	}
+	cs.SetReports([]*reconciler.Reconciler{r}, false)
+
+	reports, err = getStatus(client)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "/src", reports[0].Src)
+	assert.Equal(t, map[string]string{"a.service": "abc"}, reports[0].Units)
+	assert.Equal(t, map[string]string{"b.service": "oops"}, reports[0].Failures)
+	assert.False(t, reports[0].OK)
+
+	// Refreshing keeps the outcome and time of the last sync
+	lastSync := reports[0].LastSync
+	r.State["c.service"] = "def"
+	cs.Refresh([]*reconciler.Reconciler{r})
+	reports, err = getStatus(client)
+	require.NoError(t, err)
+	assert.Len(t, reports[0].Units, 2)
+	assert.False(t, reports[0].OK)
+	assert.True(t, lastSync.Equal(reports[0].LastSync))
+
+	_, err = postRollback(client, 3)
+	assert.EqualError(t, err, "unexpected status 501: rollbacks require -history-dir")
+
+	cs.Rollback = func(generation int64) (int, error) {
+		if generation != 3 {
+			return 0, fmt.Errorf("no snapshot of generation %d", generation)
+		}
+		return 2, nil
+	}
+	restored, err := postRollback(client, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 2, restored)
+	_, err = postRollback(client, 4)
+	assert.EqualError(t, err, "unexpected status 409: no snapshot of generation 4")
+
+	_, err = postPromote(client, "v1.4.2")
+	assert.EqualError(t, err, "unexpected status 501: promotions require -git-url")
+	cs.Promote = func(ref string) (string, error) { return "abc", nil }
+	commit, err := postPromote(client, "v1.4.2")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", commit)
+
+	// A new instance replaces the stale socket
+	listener, err = listenControl(name)
+	require.NoError(t, err)
+	listener.Close()
+}
+
+type statingSystemd struct {
+	fakeSystemd
+}
+
+func (s *statingSystemd) UnitStates(ctx context.Context, units []string) (map[string]*systemd.UnitState, error) {
+	states := map[string]*systemd.UnitState{}
+	for _, unit := range units {
+		states[unit] = &systemd.UnitState{Active: "active", Sub: "running", Enabled: "enabled"}
+	}
+	return states, nil
+}
+
+func TestControlServerUnitsAndEvents(t *testing.T) {
+	name := path.Join(t.TempDir(), "unitmgr.sock")
+	listener, err := listenControl(name)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	cs := &controlServer{}
+	go http.Serve(listener, cs.Handler())
+	client := controlClient(name)
+
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{"a.service": "abc"}, Systemd: &statingSystemd{}}
+	cs.SetReports([]*reconciler.Reconciler{r, {Src: "/other", Systemd: &fakeSystemd{}}}, true)
+	units, err := getUnits(client)
+	require.NoError(t, err)
+	require.Len(t, units, 1) // the fake can't be queried
+	assert.Equal(t, "/src", units[0].Src)
+	assert.Equal(t, map[string]*systemd.UnitState{"a.service": {Active: "active", Sub: "running", Enabled: "enabled"}}, units[0].Units)
+
+	events, err := getEvents(client)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	hook := cs.Record("/src")
+	for i := 0; i < maxEvents+5; i++ {
+		hook(&reconciler.Transition{Unit: fmt.Sprintf("%d.service", i), To: reconciler.StateCopied})
+	}
+	events, err = getEvents(client)
+	require.NoError(t, err)
+	require.Len(t, events, maxEvents)
+	assert.Equal(t, "5.service", events[0].Unit)
+	assert.Equal(t, "/src", events[0].Src)
+	assert.Equal(t, reconciler.StateCopied, events[0].To)
+}
+
+func TestPrintStatus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printStatus(buf, nil)
+	assert.Equal(t, "waiting for the first sync\n", buf.String())
+
+	buf.Reset()
+	printStatus(buf, []*reconciler.HostReport{{
+		Host:     "host1",
+		Src:      "/src",
+		Units:    map[string]string{"a.service": "abc", "b.service": "def"},
+		LastSync: time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local),
+		Failures: map[string]string{"b.service": "oops"},
+		Pending:  []*reconciler.Change{{Unit: "c.service", Action: "create"}},
+		Reboot:   []string{"a.service"},
+		Freeze:   "holidays",
+		Stability: map[string]*reconciler.UnitStability{
+			"a.service": {Restarts: 1},
+			"b.service": {Restarts: 9, Flapping: true},
+		},
+		States: map[string]*reconciler.UnitStatus{
+			"a.service": {State: reconciler.StateHealthy},
+			"d.service": {State: reconciler.StateQuarantined, Reason: "rejected by the policy or linter"},
+		},
+		Generation: 4,
+	}})
+	assert.Equal(t, "host1 /src: failing, 2 units, generation 4, last synced "+time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local).Format(time.RFC3339)+"\n  b.service: oops\n  b.service: flapping, restarted 9 times in the last hour\n  d.service: quarantined, rejected by the policy or linter\n  changes frozen: holidays\n  reboot required for changes to a.service\n  would create c.service\n", buf.String())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+func diffCommand() int {
+	_, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+	if _, err := loadState(reconcilers); err != nil { // removals are only known from the persisted state
+		return setupFailed(err)
+	}
+
+	code := exitConverged
+	var plans []*unitPlan
+	for _, rec := range reconcilers {
+		changes, err := planChanges(context.Background(), rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while planning changes for %s: %s\n", rec.Src, err)
+			return exitFailed
+		}
+		plans = append(plans, &unitPlan{Src: rec.Src, Changes: changes})
+		if len(changes) > 0 {
+			code = exitChanged
+		}
+	}
+	if !structured(os.Stdout, plans) {
+		for _, plan := range plans {
+			writePlan(os.Stdout, plan.Changes)
+		}
+	}
+	return code
+}
+
+// unitPlan is the changes the next sync of a reconciler would make, printed with -output json or yaml.
+type unitPlan struct {
+	Src     string           `json:"src"`
+	Changes []*plannedChange `json:"changes"`
+}
+
+type plannedChange struct {
+	reconciler.Change
+	Impact *reconciler.Impact `json:"impact"`
+	Diff   []string           `json:"diff,omitempty"` // see diffLines
+}
+
+// printPlan writes the changes the next sync of rec would make and returns true if there are any.
+func printPlan(w io.Writer, rec *reconciler.Reconciler) (bool, error) {
+	changes, err := planChanges(context.Background(), rec)
+	if err != nil {
+		return false, err
+	}
+	writePlan(w, changes)
+	return len(changes) > 0, nil
+}
+
+func writePlan(w io.Writer, changes []*plannedChange) {
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s %s: %s", change.Action, change.Unit, change.Impact.Action)
+		if change.Impact.Downtime > 0 {
+			fmt.Fprintf(w, ", about %s of downtime", change.Impact.Downtime.Round(time.Millisecond))
+		}
+		fmt.Fprintln(w)
+		for _, dependent := range change.Impact.Dependents {
+			fmt.Fprintf(w, "  also %ss %s\n", change.Impact.Action, dependent)
+		}
+		for _, socket := range change.Impact.Sockets {
+			fmt.Fprintf(w, "  %s stops listening\n", socket)
+		}
+		for _, line := range change.Diff {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
+
+// planChanges returns the changes the next sync of rec would make and their impact on the running units.
+// Updated unit files are diffed line by line when they're written to a local directory, with secrets redacted.
+func planChanges(ctx context.Context, rec *reconciler.Reconciler) ([]*plannedChange, error) {
+	changes, err := rec.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	planned := make([]*plannedChange, 0, len(changes))
+	for _, change := range changes {
+		pc := &plannedChange{Change: *change, Impact: rec.Impact(ctx, change)}
+		planned = append(planned, pc)
+		if change.Action != "update" || rec.Target != nil {
+			continue
+		}
+
+		current, err := ioutil.ReadFile(path.Join(rec.Dest, change.Unit))
+		if err != nil {
+			return nil, err
+		}
+		desired, err := ioutil.ReadFile(path.Join(rec.Src, change.Unit))
+		if err != nil {
+			return nil, err
+		}
+		pc.Diff = rec.Redact.Lines(diffLines(splitLines(string(current)), splitLines(string(desired))))
+	}
+	return planned, nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the lines removed from a prefixed with "-" and the lines added by b prefixed with "+",
+// using the longest common subsequence of the two. Unit files are small enough for the quadratic table.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
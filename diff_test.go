@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintPlan(t *testing.T) {
+	src := t.TempDir()
+	r := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\nUser=a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	buf := &bytes.Buffer{}
+	changed, err := printPlan(buf, r)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/b\nUser=a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("b"), 0644))
+
+	changed, err = printPlan(buf, r)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "update a.service: restart\n  -ExecStart=/bin/a\n  +ExecStart=/bin/b\ncreate b.service: start\n", buf.String())
+}
+
+func TestPrintPlanRedacted(t *testing.T) {
+	src := t.TempDir()
+	redactor, err := reconciler.NewRedactor(reconciler.DefaultRedactPattern)
+	require.NoError(t, err)
+	r := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}, Redact: redactor}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\nEnvironment=DB_PASSWORD=old\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\nEnvironment=DB_PASSWORD=new\n"), 0644))
+
+	buf := &bytes.Buffer{}
+	_, err = printPlan(buf, r)
+	require.NoError(t, err)
+	assert.Equal(t, "update a.service: restart\n  -Environment=DB_PASSWORD=<redacted>\n  +Environment=DB_PASSWORD=<redacted>\n", buf.String())
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Empty(t, diffLines([]string{"a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{"+a"}, diffLines(nil, []string{"a"}))
+	assert.Equal(t, []string{"-a"}, diffLines([]string{"a"}, nil))
+	assert.Equal(t, []string{"-b", "+c", "+d"}, diffLines([]string{"a", "b"}, []string{"a", "c", "d"}))
+	assert.Equal(t, []string{"-x", "+y"}, diffLines([]string{"a", "x", "b"}, []string{"a", "y", "b"}))
+}
+
+func TestWritePlanImpact(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writePlan(buf, []*plannedChange{
+		{
+			Change: reconciler.Change{Unit: "web.socket", Action: "update"},
+			Impact: &reconciler.Impact{Action: "restart", Dependents: []string{"web.service", "proxy.socket"}, Sockets: []string{"web.socket", "proxy.socket"}, Downtime: 1500 * time.Millisecond},
+		},
+		{Change: reconciler.Change{Unit: "old.service", Action: "remove"}, Impact: &reconciler.Impact{Action: "stop"}},
+	})
+	assert.Equal(t, "update web.socket: restart, about 1.5s of downtime\n  also restarts web.service\n  also restarts proxy.socket\n"+
+		"  web.socket stops listening\n  proxy.socket stops listening\nremove old.service: stop\n", buf.String())
+}
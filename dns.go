@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultDNSTTL is how long lookups are cached when dnsCache.TTL isn't set.
+const defaultDNSTTL = time.Second * 30
+
+// dnsCache resolves the DNS records templates reference through the srv and ips functions. Go's resolver doesn't
+// expose the records' TTLs, so results are cached for TTL instead, and sorted so only changes to the records,
+// not their order, render different units.
+type dnsCache struct {
+	Resolver *net.Resolver // defaults to net.DefaultResolver
+	TTL      time.Duration // defaults to defaultDNSTTL
+
+	cache ttlCache
+}
+
+// srvRecord is a resolved SRV record with the trailing dot of its target removed.
+type srvRecord struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// Funcs returns the template functions resolving records with the given context.
+func (c *dnsCache) Funcs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"srv": func(name string) ([]*srvRecord, error) { return c.SRV(ctx, name) },
+		"ips": func(name string) ([]string, error) { return c.IPs(ctx, name) },
+	}
+}
+
+// SRV returns the SRV records of a name like _http._tcp.example.com, ordered by priority.
+func (c *dnsCache) SRV(ctx context.Context, name string) ([]*srvRecord, error) {
+	value, err := c.lookup(ctx, "srv "+name, func(resolver *net.Resolver) (interface{}, error) {
+		_, addrs, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]*srvRecord, len(addrs))
+		for i, addr := range addrs {
+			records[i] = &srvRecord{Target: strings.TrimSuffix(addr.Target, "."), Port: addr.Port, Priority: addr.Priority, Weight: addr.Weight}
+		}
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.Priority != b.Priority {
+				return a.Priority < b.Priority
+			}
+			if a.Target != b.Target {
+				return a.Target < b.Target
+			}
+			return a.Port < b.Port
+		})
+		return records, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*srvRecord), nil
+}
+
+// IPs returns the sorted IPv4 and IPv6 addresses of a host.
+func (c *dnsCache) IPs(ctx context.Context, host string) ([]string, error) {
+	value, err := c.lookup(ctx, "ips "+host, func(resolver *net.Resolver) (interface{}, error) {
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(addrs)
+		return addrs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// lookup returns the cached result of a lookup, resolving it again once it expired. Failed lookups fail the template,
+// so it keeps its previously rendered unit rather than losing e.g. its backends.
+func (c *dnsCache) lookup(ctx context.Context, key string, fn func(*net.Resolver) (interface{}, error)) (interface{}, error) {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultDNSTTL
+	}
+	return c.cache.Get(key, ttl, func() (interface{}, error) {
+		resolver := c.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		value, err := fn(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", strings.SplitN(key, " ", 2)[1], err)
+		}
+		return value, nil
+	})
+}
+
+// ttlCache caches the results of the lookups made by template functions.
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]*ttlEntry
+}
+
+type ttlEntry struct {
+	Value   interface{}
+	Expires time.Time
+}
+
+// Get returns the cached value of key, calling fn to get it again once it's older than ttl. Errors aren't cached.
+func (c *ttlCache) Get(key string, ttl time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.Expires) {
+		return entry.Value, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if c.entries == nil {
+		c.entries = map[string]*ttlEntry{}
+	}
+	c.entries[key] = &ttlEntry{Value: value, Expires: time.Now().Add(ttl)}
+	return value, nil
+}
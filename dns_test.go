@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDNS answers SRV queries with srv and A queries with ipv4, and counts the queries it received.
+type fakeDNS struct {
+	mu      sync.Mutex
+	srv     []*srvRecord
+	ipv4    []net.IP
+	queries int
+}
+
+func (f *fakeDNS) resolver(t *testing.T) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go f.serve(conn)
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return net.Dial("udp", conn.LocalAddr().String())
+	}}
+}
+
+func (f *fakeDNS) serve(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		end := 12
+		for query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		question := query[12 : end+5]
+		qtype := binary.BigEndian.Uint16(query[end+1:])
+
+		f.mu.Lock()
+		f.queries++
+		var answers [][]byte
+		switch qtype {
+		case 33: // SRV
+			for _, record := range f.srv {
+				rdata := make([]byte, 6)
+				binary.BigEndian.PutUint16(rdata, record.Priority)
+				binary.BigEndian.PutUint16(rdata[2:], record.Weight)
+				binary.BigEndian.PutUint16(rdata[4:], record.Port)
+				for _, label := range strings.Split(record.Target, ".") {
+					rdata = append(append(rdata, byte(len(label))), label...)
+				}
+				answers = append(answers, append(rdata, 0))
+			}
+		case 1: // A
+			for _, ip := range f.ipv4 {
+				answers = append(answers, []byte(ip.To4()))
+			}
+		}
+		f.mu.Unlock()
+
+		resp := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0}, question...)
+		for _, rdata := range answers {
+			rr := []byte{0xc0, 0x0c, 0, byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata))}
+			resp = append(append(resp, rr...), rdata...)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	dns := &fakeDNS{
+		srv:  []*srvRecord{{Target: "b.example.com", Port: 80, Priority: 10}, {Target: "a.example.com", Port: 8080, Priority: 10}, {Target: "c.example.com", Port: 80, Priority: 5}},
+		ipv4: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")},
+	}
+	c := &dnsCache{Resolver: dns.resolver(t), TTL: time.Hour}
+
+	records, err := c.SRV(context.Background(), "_http._tcp.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []*srvRecord{
+		{Target: "c.example.com", Port: 80, Priority: 5},
+		{Target: "a.example.com", Port: 8080, Priority: 10},
+		{Target: "b.example.com", Port: 80, Priority: 10},
+	}, records)
+
+	ips, err := c.IPs(context.Background(), "db.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips)
+
+	// Lookups are cached until they expire
+	dns.mu.Lock()
+	queries := dns.queries
+	dns.mu.Unlock()
+	_, err = c.SRV(context.Background(), "_http._tcp.example.com")
+	require.NoError(t, err)
+	dns.mu.Lock()
+	assert.Equal(t, queries, dns.queries)
+	dns.mu.Unlock()
+}
+
+func TestRendererDNS(t *testing.T) {
+	dns := &fakeDNS{srv: []*srvRecord{{Target: "a.example.com", Port: 80}}}
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "lb.service.tmpl"), []byte(`{{range srv "_http._tcp.example.com"}}--backend {{.Target}}:{{.Port}} {{end}}`), 0644))
+	r := &renderer{Dir: dir, DNS: &dnsCache{Resolver: dns.resolver(t), TTL: time.Nanosecond}}
+	require.NoError(t, r.Render(context.Background()))
+	content, err := ioutil.ReadFile(path.Join(dir, "lb.service"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "\n--backend a.example.com:80 "))
+
+	// Changed records render the unit again, which restarts it
+	dns.mu.Lock()
+	dns.srv = append(dns.srv, &srvRecord{Target: "b.example.com", Port: 80})
+	dns.mu.Unlock()
+	require.NoError(t, r.Render(context.Background()))
+	content, err = ioutil.ReadFile(path.Join(dir, "lb.service"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "--backend a.example.com:80 --backend b.example.com:80 ")
+}
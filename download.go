@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloader fetches files over http with bounded parallelism, per-request timeouts, resumption of
+// interrupted downloads, and a bandwidth limit shared by every download, so a slow server can't stall syncs.
+type downloader struct {
+	Client   *http.Client  // without a timeout, downloads are bounded by Timeout instead
+	Parallel int           // concurrent downloads, defaults to one
+	Timeout  time.Duration // of each download, zero for none
+	Rate     int64         // bytes per second, zero for unlimited
+	Gate     *pollGate     // optional, defers large downloads while the host runs on battery
+
+	once    sync.Once
+	slots   chan struct{}
+	limiter *rateLimiter
+}
+
+func (d *downloader) init() {
+	d.once.Do(func() {
+		n := d.Parallel
+		if n < 1 {
+			n = 1
+		}
+		d.slots = make(chan struct{}, n)
+		if d.Rate > 0 {
+			d.limiter = &rateLimiter{Rate: d.Rate}
+		}
+	})
+}
+
+// partialName is where the content of name is downloaded to, hidden so it's never mistaken for a unit.
+func partialName(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".part")
+}
+
+// Fetch downloads url to name, verifying that its content has the given sha256.
+// Interrupted downloads are resumed by the next fetch of the same name, and name is only replaced once
+// the complete content was verified.
+func (d *downloader) Fetch(ctx context.Context, url, name, checksum string) error {
+	d.init()
+	select {
+	case d.slots <- struct{}{}:
+		defer func() { <-d.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	partial := partialName(name)
+	var offset int64
+	if stat, err := os.Stat(partial); err == nil {
+		offset = stat.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC // the server doesn't support ranges
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partial) // the content changed since the partial download, start over next time
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if err := d.Gate.AllowDownload(ctx, resp.ContentLength); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var body io.Reader = resp.Body
+	if d.limiter != nil {
+		body = &throttledReader{Reader: body, Limiter: d.limiter, Context: ctx}
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		return err // keep what was downloaded to resume from
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	actual, err := sha256File(partial)
+	if err != nil {
+		return err
+	}
+	if actual != checksum {
+		os.Remove(partial)
+		return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", url, checksum, actual)
+	}
+	return os.Rename(partial, name)
+}
+
+func sha256File(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rateLimiter spaces out reads so they don't exceed Rate bytes per second on average.
+type rateLimiter struct {
+	Rate int64
+
+	mu   sync.Mutex
+	next time.Time // when the next read may start
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.Rate))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	Reader  io.Reader
+	Limiter *rateLimiter
+	Context context.Context
+}
+
+// throttleChunk bounds reads so throttling is smooth rather than bursty.
+const throttleChunk = 16 << 10
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		if werr := t.Limiter.wait(t.Context, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
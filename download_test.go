@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloaderResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	name := path.Join(t.TempDir(), "test.service")
+	require.NoError(t, ioutil.WriteFile(partialName(name), content[:300], 0644))
+
+	d := &downloader{Client: server.Client()}
+	require.NoError(t, d.Fetch(context.Background(), server.URL, name, sha256Hex(content)))
+	assert.Equal(t, []string{"bytes=300-"}, ranges)
+
+	actual, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, actual)
+	assert.NoFileExists(t, partialName(name))
+}
+
+func TestDownloaderChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	name := path.Join(t.TempDir(), "test.service")
+	require.NoError(t, ioutil.WriteFile(name, []byte("current"), 0644))
+
+	d := &downloader{Client: server.Client()}
+	assert.Error(t, d.Fetch(context.Background(), server.URL, name, sha256Hex([]byte("expected"))))
+
+	// The current file is kept and the bad download discarded
+	actual, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "current", string(actual))
+	assert.NoFileExists(t, partialName(name))
+}
+
+func TestDownloaderBattery(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	power := &fakeCondition{}
+	name := path.Join(t.TempDir(), "test.service")
+	d := &downloader{Client: server.Client(), Gate: &pollGate{Power: power, MaxBattery: 500}}
+	assert.Error(t, d.Fetch(context.Background(), server.URL, name, sha256Hex(content)))
+	assert.NoFileExists(t, name)
+
+	power.met = true
+	require.NoError(t, d.Fetch(context.Background(), server.URL, name, sha256Hex(content)))
+	assert.FileExists(t, name)
+}
+
+func TestDownloaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	name := path.Join(t.TempDir(), "test.service")
+	d := &downloader{Client: server.Client(), Timeout: 50 * time.Millisecond}
+	assert.Error(t, d.Fetch(context.Background(), server.URL, name, sha256Hex([]byte("partial content"))))
+	assert.NoFileExists(t, name)
+
+	// What was downloaded is kept to be resumed
+	actual, err := ioutil.ReadFile(partialName(name))
+	require.NoError(t, err)
+	assert.Equal(t, "partial", string(actual))
+}
+
+func TestDownloaderParallel(t *testing.T) {
+	active, peak := 0, 0
+	ch := make(chan int, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch <- 1
+		time.Sleep(10 * time.Millisecond)
+		ch <- -1
+		w.Write([]byte("x"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	d := &downloader{Client: server.Client(), Parallel: 2}
+	done := make(chan error)
+	for i := 0; i < 6; i++ {
+		go func(i int) {
+			done <- d.Fetch(context.Background(), server.URL, path.Join(dir, string(rune('a'+i))), sha256Hex([]byte("x")))
+		}(i)
+	}
+	for i := 0; i < 6; i++ {
+		require.NoError(t, <-done)
+	}
+	close(ch)
+	for delta := range ch {
+		active += delta
+		if active > peak {
+			peak = active
+		}
+	}
+	assert.LessOrEqual(t, peak, 2)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{Rate: 1000}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.wait(context.Background(), 50))
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = &rateLimiter{Rate: 1000}
+	require.NoError(t, l.wait(ctx, 1000)) // a full second is now queued
+	assert.Error(t, l.wait(ctx, 1))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// emailNotifier sends digests as plain text emails over SMTP, using STARTTLS when the server supports it.
+type emailNotifier struct {
+	Addr string // host:port of the SMTP server
+	From string
+	To   []string
+	Auth smtp.Auth // optional
+
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error // defaults to smtp.SendMail
+}
+
+// newEmailNotifier authenticates with PLAIN when a user is given, which net/smtp only allows over TLS or to localhost.
+func newEmailNotifier(addr, from, to, user, password string) (*emailNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp server %q: %s", addr, err)
+	}
+	if from == "" || to == "" {
+		return nil, fmt.Errorf("-smtp-from and -smtp-to are required to send email")
+	}
+
+	e := &emailNotifier{Addr: addr, From: from}
+	for _, rcpt := range strings.Split(to, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			e.To = append(e.To, rcpt)
+		}
+	}
+	if user != "" {
+		e.Auth = smtp.PlainAuth("", user, password, host)
+	}
+	return e, nil
+}
+
+func (e *emailNotifier) Notify(d *digest) error {
+	send := e.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(e.Addr, e.Auth, e.From, e.To, e.message(d))
+}
+
+func (e *emailNotifier) message(d *digest) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", e.From)
+	fmt.Fprintf(b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(b, "Subject: unitmgr: %s\r\n", d.Summary())
+	fmt.Fprintf(b, "Date: %s\r\n", d.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	for _, line := range d.Lines() {
+		b.WriteString(line + "\r\n")
+	}
+	return b.Bytes()
+}
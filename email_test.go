@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEmailNotifier(t *testing.T) {
+	e, err := newEmailNotifier("mail.example.com:587", "unitmgr@example.com", "a@example.com, b@example.com", "user", "pass")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, e.To)
+	assert.NotNil(t, e.Auth)
+
+	e, err = newEmailNotifier("localhost:25", "unitmgr@example.com", "a@example.com", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, e.Auth)
+
+	_, err = newEmailNotifier("localhost", "unitmgr@example.com", "a@example.com", "", "")
+	assert.Error(t, err)
+
+	_, err = newEmailNotifier("localhost:25", "", "a@example.com", "", "")
+	assert.Error(t, err)
+}
+
+func TestEmailNotifier(t *testing.T) {
+	var sent []byte
+	var rcpts []string
+	e := &emailNotifier{
+		Addr: "localhost:25",
+		From: "unitmgr@example.com",
+		To:   []string{"ops@example.com"},
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			assert.Equal(t, "localhost:25", addr)
+			assert.Equal(t, "unitmgr@example.com", from)
+			rcpts, sent = to, msg
+			return nil
+		},
+	}
+
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, e.Notify(&digest{Host: "host1", Time: at, Events: []*notifyEvent{
+		{Src: "/src", Unit: "a.service", Kind: "changed", Detail: "restarted", Time: at},
+		{Src: "/src", Unit: "b.service", Kind: "failed", Detail: "multi\nline", Time: at},
+	}}))
+	assert.Equal(t, []string{"ops@example.com"}, rcpts)
+
+	ts := at.Local().Format(time.RFC3339)
+	assert.Equal(t, "From: unitmgr@example.com\r\n"+
+		"To: ops@example.com\r\n"+
+		"Subject: unitmgr: 1 change and 1 failure on host1\r\n"+
+		"Date: Fri, 01 Jan 2021 00:00:00 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+		ts+" changed a.service: restarted\r\n"+
+		ts+" failed b.service: multi line\r\n", string(sent))
+}
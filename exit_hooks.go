@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// exitHooks runs the commands units declare with ExecOnHealthy= and ExecOnFailed= in their UnitSection when their
+// reconciliation ends in that state, e.g. to deregister a host from a load balancer while its service is failing.
+// Commands run with /bin/sh on the host running unitmgr, with the unit, its state, and why it's in it in the environment.
+type exitHooks struct {
+	Src     string
+	Timeout time.Duration
+}
+
+var exitHookKeys = map[reconciler.UnitState]string{
+	reconciler.StateHealthy: "ExecOnHealthy",
+	reconciler.StateFailed:  "ExecOnFailed",
+}
+
+// Hook is the reconciler.TransitionHook running the commands.
+func (h *exitHooks) Hook(t *reconciler.Transition) {
+	key, ok := exitHookKeys[t.To]
+	if !ok {
+		return
+	}
+	file, err := os.Open(path.Join(h.Src, t.Unit))
+	if err != nil {
+		return // removed meanwhile
+	}
+	parsed, err := reconciler.ParseUnitFile(file)
+	file.Close()
+	if err != nil {
+		return
+	}
+
+	for _, command := range parsed.Values(reconciler.UnitSection, key) {
+		if err := h.run(command, t); err != nil {
+			log.Printf("error while running %s= of unit %s: %s", key, t.Unit, err)
+		}
+	}
+}
+
+func (h *exitHooks) run(command string, t *reconciler.Transition) error {
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"UNITMGR_UNIT="+t.Unit,
+		"UNITMGR_STATE="+string(t.To),
+		"UNITMGR_PREVIOUS_STATE="+string(t.From),
+		"UNITMGR_REASON="+t.Reason,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
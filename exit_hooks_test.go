@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitHooks(t *testing.T) {
+	src := t.TempDir()
+	out := path.Join(t.TempDir(), "out")
+	unit := "[Service]\nExecStart=/bin/a\n\n[X-Unitmgr]\nExecOnHealthy=echo \"$UNITMGR_UNIT $UNITMGR_PREVIOUS_STATE $UNITMGR_STATE\" >> " + out + "\nExecOnFailed=echo \"failed: $UNITMGR_REASON\" >> " + out + "\n"
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte(unit), 0644))
+
+	h := &exitHooks{Src: src}
+	h.Hook(&reconciler.Transition{Unit: "a.service", From: reconciler.StateRestarting, To: reconciler.StateHealthy})
+	h.Hook(&reconciler.Transition{Unit: "a.service", From: reconciler.StatePendingCopy, To: reconciler.StateCopied})
+	h.Hook(&reconciler.Transition{Unit: "a.service", From: reconciler.StateRestarting, To: reconciler.StateFailed, Reason: "oops"})
+	h.Hook(&reconciler.Transition{Unit: "missing.service", To: reconciler.StateFailed})
+
+	content, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "a.service Restarting Healthy\nfailed: oops\n", string(content))
+}
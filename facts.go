@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// cloudFacts describe the instance unitmgr runs on, as reported by its cloud's metadata service.
+type cloudFacts struct {
+	Provider     string
+	InstanceID   string
+	Name         string // hostname on aws
+	Region       string
+	Zone         string
+	InstanceType string
+	Account      string            // aws account, gcp project, or azure subscription
+	Tags         map[string]string // labels on gcp, and only available on aws when tags are allowed in metadata
+}
+
+// cloudProvider reads facts from a metadata service.
+type cloudProvider struct {
+	Endpoint string
+	Fetch    func(ctx context.Context, client *http.Client, endpoint string) (*cloudFacts, error)
+}
+
+var cloudProviders = map[string]*cloudProvider{
+	"aws":   {Endpoint: "http://169.254.169.254", Fetch: fetchAWSFacts},
+	"gcp":   {Endpoint: "http://metadata.google.internal", Fetch: fetchGCPFacts},
+	"azure": {Endpoint: "http://169.254.169.254", Fetch: fetchAzureFacts},
+}
+
+// cloudNames returns the supported values of -cloud.
+func cloudNames() []string {
+	names := []string{"auto"}
+	for name := range cloudProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// fetchCloudFacts reads the facts of the named provider, or of the first provider whose metadata service answers for auto.
+func fetchCloudFacts(ctx context.Context, client *http.Client, name string) (*cloudFacts, error) {
+	if name != "auto" {
+		provider, ok := cloudProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cloud %q, expected one of %s", name, strings.Join(cloudNames(), ", "))
+		}
+		return provider.Fetch(ctx, client, provider.Endpoint)
+	}
+
+	var errs []string
+	for _, name := range cloudNames()[1:] {
+		provider := cloudProviders[name]
+		facts, err := provider.Fetch(ctx, client, provider.Endpoint)
+		if err == nil {
+			return facts, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+	}
+	return nil, fmt.Errorf("no metadata service answered (%s)", strings.Join(errs, ", "))
+}
+
+// getMetadata returns the body of a successful request to a metadata service.
+func getMetadata(ctx context.Context, client *http.Client, method, u string, header map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &metadataStatusError{Code: resp.StatusCode, URL: u}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type metadataStatusError struct {
+	Code int
+	URL  string
+}
+
+func (e *metadataStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.Code, e.URL)
+}
+
+// fetchAWSFacts reads the instance identity document and tags using a session token (IMDSv2).
+func fetchAWSFacts(ctx context.Context, client *http.Client, endpoint string) (*cloudFacts, error) {
+	token, err := getMetadata(ctx, client, "PUT", endpoint+"/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "300"})
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	body, err := getMetadata(ctx, client, "GET", endpoint+"/latest/dynamic/instance-identity/document", header)
+	if err != nil {
+		return nil, err
+	}
+	doc := struct {
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		AccountID        string `json:"accountId"`
+	}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("decoding instance identity document: %w", err)
+	}
+	facts := &cloudFacts{Provider: "aws", InstanceID: doc.InstanceID, InstanceType: doc.InstanceType, Region: doc.Region, Zone: doc.AvailabilityZone, Account: doc.AccountID, Tags: map[string]string{}}
+
+	if hostname, err := getMetadata(ctx, client, "GET", endpoint+"/latest/meta-data/hostname", header); err == nil {
+		facts.Name = string(hostname)
+	}
+
+	keys, err := getMetadata(ctx, client, "GET", endpoint+"/latest/meta-data/tags/instance", header)
+	if status, ok := err.(*metadataStatusError); ok && status.Code == http.StatusNotFound {
+		return facts, nil // tags aren't allowed in the instance metadata
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Fields(string(keys)) {
+		value, err := getMetadata(ctx, client, "GET", endpoint+"/latest/meta-data/tags/instance/"+url.PathEscape(key), header)
+		if err != nil {
+			return nil, err
+		}
+		facts.Tags[key] = string(value)
+	}
+	return facts, nil
+}
+
+// fetchGCPFacts reads the instance's metadata, including its labels, in one request.
+func fetchGCPFacts(ctx context.Context, client *http.Client, endpoint string) (*cloudFacts, error) {
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	body, err := getMetadata(ctx, client, "GET", endpoint+"/computeMetadata/v1/instance/?recursive=true", header)
+	if err != nil {
+		return nil, err
+	}
+	instance := struct {
+		ID          json.Number       `json:"id"`
+		Name        string            `json:"name"`
+		Zone        string            `json:"zone"`        // projects/<number>/zones/<zone>
+		MachineType string            `json:"machineType"` // projects/<number>/machineTypes/<type>
+		Labels      map[string]string `json:"labels"`
+	}{}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return nil, fmt.Errorf("decoding instance metadata: %w", err)
+	}
+	project, _ := getMetadata(ctx, client, "GET", endpoint+"/computeMetadata/v1/project/project-id", header)
+
+	zone := path.Base(instance.Zone)
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	facts := &cloudFacts{Provider: "gcp", InstanceID: instance.ID.String(), Name: instance.Name, Region: region, Zone: zone, InstanceType: path.Base(instance.MachineType), Account: string(project), Tags: instance.Labels}
+	if facts.Tags == nil {
+		facts.Tags = map[string]string{}
+	}
+	return facts, nil
+}
+
+// fetchAzureFacts reads the compute metadata of the instance.
+func fetchAzureFacts(ctx context.Context, client *http.Client, endpoint string) (*cloudFacts, error) {
+	body, err := getMetadata(ctx, client, "GET", endpoint+"/metadata/instance/compute?api-version=2021-02-01", map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, err
+	}
+	compute := struct {
+		VMID           string `json:"vmId"`
+		Name           string `json:"name"`
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+		VMSize         string `json:"vmSize"`
+		SubscriptionID string `json:"subscriptionId"`
+		TagsList       []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"tagsList"`
+	}{}
+	if err := json.Unmarshal(body, &compute); err != nil {
+		return nil, fmt.Errorf("decoding instance metadata: %w", err)
+	}
+	facts := &cloudFacts{Provider: "azure", InstanceID: compute.VMID, Name: compute.Name, Region: compute.Location, Zone: compute.Zone, InstanceType: compute.VMSize, Account: compute.SubscriptionID, Tags: map[string]string{}}
+	for _, tag := range compute.TagsList {
+		facts.Tags[tag.Name] = tag.Value
+	}
+	return facts, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchAWSFacts(t *testing.T) {
+	tags := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			assert.Equal(t, "PUT", r.Method)
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/dynamic/instance-identity/document":
+			w.Write([]byte(`{"instanceId": "i-123", "instanceType": "t3.micro", "region": "eu-west-1", "availabilityZone": "eu-west-1a", "accountId": "42"}`))
+		case "/latest/meta-data/hostname":
+			w.Write([]byte("ip-10-0-0-1.ec2.internal"))
+		case "/latest/meta-data/tags/instance":
+			if !tags {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("Name\nteam"))
+		case "/latest/meta-data/tags/instance/Name":
+			w.Write([]byte("web-1"))
+		case "/latest/meta-data/tags/instance/team":
+			w.Write([]byte("web"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	facts, err := fetchAWSFacts(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, &cloudFacts{Provider: "aws", InstanceID: "i-123", Name: "ip-10-0-0-1.ec2.internal", Region: "eu-west-1", Zone: "eu-west-1a", InstanceType: "t3.micro", Account: "42", Tags: map[string]string{"Name": "web-1", "team": "web"}}, facts)
+
+	// Tags are optional
+	tags = false
+	facts, err = fetchAWSFacts(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.Empty(t, facts.Tags)
+}
+
+func TestFetchGCPFacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/":
+			w.Write([]byte(`{"id": 4520031799277581759, "name": "web-1", "zone": "projects/123/zones/us-central1-a", "machineType": "projects/123/machineTypes/e2-medium", "labels": {"team": "web"}}`))
+		case "/computeMetadata/v1/project/project-id":
+			w.Write([]byte("example"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	facts, err := fetchGCPFacts(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, &cloudFacts{Provider: "gcp", InstanceID: "4520031799277581759", Name: "web-1", Region: "us-central1", Zone: "us-central1-a", InstanceType: "e2-medium", Account: "example", Tags: map[string]string{"team": "web"}}, facts)
+}
+
+func TestFetchAzureFacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Path != "/metadata/instance/compute" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"vmId": "02aab8a4", "name": "web-1", "location": "westeurope", "zone": "1", "vmSize": "Standard_B1s", "subscriptionId": "sub", "tagsList": [{"name": "team", "value": "web"}]}`))
+	}))
+	defer server.Close()
+
+	facts, err := fetchAzureFacts(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, &cloudFacts{Provider: "azure", InstanceID: "02aab8a4", Name: "web-1", Region: "westeurope", Zone: "1", InstanceType: "Standard_B1s", Account: "sub", Tags: map[string]string{"team": "web"}}, facts)
+}
+
+func TestFetchCloudFactsAuto(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"vmId": "02aab8a4"}`))
+	}))
+	defer server.Close()
+
+	defer func(providers map[string]*cloudProvider) { cloudProviders = providers }(cloudProviders)
+	cloudProviders = map[string]*cloudProvider{
+		"aws":   {Endpoint: server.URL, Fetch: fetchAWSFacts},
+		"azure": {Endpoint: server.URL, Fetch: fetchAzureFacts},
+	}
+	facts, err := fetchCloudFacts(context.Background(), server.Client(), "auto")
+	require.NoError(t, err)
+	assert.Equal(t, "azure", facts.Provider)
+
+	_, err = fetchCloudFacts(context.Background(), server.Client(), "aws")
+	assert.Error(t, err)
+	_, err = fetchCloudFacts(context.Background(), server.Client(), "openstack")
+	assert.Error(t, err)
+}
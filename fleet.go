@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// fleetAssignment is the set of unit files assigned to an agent by the fleet server.
+type fleetAssignment struct {
+	Units []*fleetUnit `json:"units"`
+
+	// Deltas only contain the units that changed since the Base revision the agent already has, see fleetDelta
+	Base    string   `json:"base,omitempty"`
+	Removed []string `json:"removed,omitempty"` // units removed since Base
+}
+
+type fleetUnit struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content"`
+}
+
+// validUnitName returns true when the name can safely be used as a file name within src.
+func validUnitName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// loadTLSConfig builds a mutual TLS config from the given certificate, key, and CA bundle.
+// The CA is used to verify the remote side of the connection.
+func loadTLSConfig(cert, key, ca string) (*tls.Config, error) {
+	if cert == "" || key == "" || ca == "" {
+		return nil, errors.New("a certificate, key, and CA are required for fleet mode")
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %q", ca)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
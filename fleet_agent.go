@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// fleetAgent mirrors the units assigned by a fleet server into the local src directory
+// and reports the result of local reconciliation back to the server.
+type fleetAgent struct {
+	Server  string // base url of the fleet server
+	Dir     string
+	Client  *http.Client
+	Systemd reconciler.Systemd // optional, runs fleet operations when set
+	Gate    *pollGate          // optional, defers polls until the host meets its conditions
+
+	mu       sync.Mutex
+	report   *reconciler.HostReport
+	revision string           // of the assignment in Dir, protected by mu
+	last     *fleetAssignment // most recently applied, the base of the deltas sent by the server
+}
+
+func (a *fleetAgent) Run(interval time.Duration) {
+	for {
+		if err := a.Poll(); err != nil {
+			log.Printf("error while fetching fleet assignment: %s", err)
+		}
+		if a.Systemd != nil {
+			if err := a.runOperation(context.Background()); err != nil {
+				log.Printf("error while running fleet operation: %s", err)
+			}
+		}
+		if err := a.sendReport(); err != nil {
+			log.Printf("error while reporting status to fleet server: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// SetReport stores the most recent state of the local reconciliation to be sent with the next poll.
+func (a *fleetAgent) SetReport(report *reconciler.HostReport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report.Assignment = a.revision // so the server can tell which assignment a failure is about
+	a.report = report
+}
+
+// Poll fetches the agent's assignment and writes it to the src directory. Once an assignment was applied, the server
+// only sends the units that changed since, or nothing if none did.
+func (a *fleetAgent) Poll() error {
+	if a.Gate.Deferred(context.Background()) {
+		return nil
+	}
+	req := &assignmentRequest{}
+	if a.last != nil {
+		req.Base = a.last.Revision()
+	}
+	resp := &assignmentResponse{}
+	if err := invokeGRPC(context.Background(), a.Client, a.Server, "GetAssignment", req, resp); err != nil {
+		return err
+	}
+
+	if resp.NotModified {
+		if a.last == nil {
+			return errors.New("the server has no assignment for this agent yet")
+		}
+		return a.apply(a.last) // restores local modifications of src
+	}
+	assignment := resp.Assignment
+	if assignment == nil {
+		return errors.New("the response has no assignment")
+	}
+	if assignment.Base != "" {
+		var err error
+		if assignment, err = applyDelta(a.last, assignment); err != nil {
+			a.last = nil // fetch the complete assignment next time
+			return err
+		}
+	}
+	if resp.Revision != "" && resp.Revision != assignment.Revision() {
+		a.last = nil
+		return fmt.Errorf("the assignment doesn't match its revision %s", resp.Revision)
+	}
+
+	if err := a.apply(assignment); err != nil {
+		return err
+	}
+	a.last = assignment
+	a.mu.Lock()
+	a.revision = assignment.Revision()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *fleetAgent) apply(assignment *fleetAssignment) error {
+	assigned := map[string]bool{}
+	for _, unit := range assignment.Units {
+		if !validUnitName(unit.Name) {
+			return fmt.Errorf("invalid unit name %q in assignment", unit.Name)
+		}
+		assigned[unit.Name] = true
+
+		name := path.Join(a.Dir, unit.Name)
+		current, err := ioutil.ReadFile(name)
+		if err == nil && bytes.Equal(current, unit.Content) {
+			continue
+		}
+		if err := reconciler.WriteFileAtomic(name, unit.Content); err != nil {
+			return err
+		}
+		log.Printf("received unit from fleet server: %s", unit.Name)
+	}
+
+	files, err := ioutil.ReadDir(a.Dir)
+	if err != nil {
+		return err
+	}
+	for _, stat := range files {
+		if !stat.Mode().IsRegular() || !validUnitName(stat.Name()) || assigned[stat.Name()] || hasTemplate(a.Dir, stat.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(a.Dir, stat.Name())); err != nil {
+			return err
+		}
+		log.Printf("unit unassigned by fleet server: %s", stat.Name())
+	}
+
+	return nil
+}
+
+func (a *fleetAgent) sendReport() error {
+	a.mu.Lock()
+	report := a.report
+	a.mu.Unlock()
+	if report == nil {
+		return nil // no sync has completed yet
+	}
+	return invokeGRPC(context.Background(), a.Client, a.Server, "ReportStatus", report, &grpcEmpty{})
+}
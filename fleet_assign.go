@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// maxAssignmentsSize limits the assignment config written through the API.
+const maxAssignmentsSize = 1 << 20
+
+// fleetAssignments assigns profiles, i.e. the units in Dir/profiles/<name>, to hosts, host groups, and hosts
+// matching a label selector. Units of profiles take precedence over top level units of the same name, and units in
+// Dir/hosts/<name> over those of profiles.
+type fleetAssignments struct {
+	TokenSHA256 string                       `json:"tokenSHA256,omitempty"` // hex sha256 of the bearer token allowed to replace the assignments
+	Groups      map[string][]string          `json:"groups,omitempty"`      // group -> hosts
+	Labels      map[string]map[string]string `json:"labels,omitempty"`      // host -> labels
+	Rules       []*assignmentRule            `json:"assignments"`
+}
+
+// assignmentRule assigns its profiles to the hosts it lists, the members of its groups, and the hosts whose
+// labels include every label of its selector.
+type assignmentRule struct {
+	Profiles []string          `json:"profiles"`
+	Hosts    []string          `json:"hosts,omitempty"`
+	Groups   []string          `json:"groups,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// loadAssignments reads a json file of assignments, e.g.
+// {"groups": {"web": ["web1", "web2"]}, "assignments": [{"profiles": ["nginx"], "groups": ["web"]}]}.
+func loadAssignments(name string) (*fleetAssignments, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseAssignments(bytes.NewReader(buf))
+}
+
+func parseAssignments(r io.Reader) (*fleetAssignments, error) {
+	a := &fleetAssignments{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(a); err != nil {
+		return nil, fmt.Errorf("decoding assignments: %w", err)
+	}
+
+	if a.TokenSHA256 != "" {
+		if sum, err := hex.DecodeString(a.TokenSHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("assignments must set tokenSHA256 to a hex sha256 digest")
+		}
+	}
+	for group, hosts := range a.Groups {
+		if !validUnitName(group) {
+			return nil, fmt.Errorf("invalid group name %q", group)
+		}
+		for _, host := range hosts {
+			if !validUnitName(host) {
+				return nil, fmt.Errorf("invalid host %q in group %q", host, group)
+			}
+		}
+	}
+	for i, rule := range a.Rules {
+		if len(rule.Profiles) == 0 {
+			return nil, fmt.Errorf("assignment %d has no profiles", i)
+		}
+		if len(rule.Hosts) == 0 && len(rule.Groups) == 0 && len(rule.Selector) == 0 {
+			return nil, fmt.Errorf("assignment %d must set hosts, groups, or a selector", i)
+		}
+		for _, profile := range rule.Profiles {
+			if !validUnitName(profile) {
+				return nil, fmt.Errorf("invalid profile name %q", profile)
+			}
+		}
+		for _, group := range rule.Groups {
+			if _, ok := a.Groups[group]; !ok {
+				return nil, fmt.Errorf("assignment %d refers to undefined group %q", i, group)
+			}
+		}
+	}
+	return a, nil
+}
+
+// Profiles returns the profiles assigned to the host, in the order of the assignments that match it.
+func (a *fleetAssignments) Profiles(host string) []string {
+	var profiles []string
+	seen := map[string]bool{}
+	for _, rule := range a.Rules {
+		if !rule.matches(host, a) {
+			continue
+		}
+		for _, profile := range rule.Profiles {
+			if !seen[profile] {
+				seen[profile] = true
+				profiles = append(profiles, profile)
+			}
+		}
+	}
+	return profiles
+}
+
+func (r *assignmentRule) matches(host string, a *fleetAssignments) bool {
+	for _, h := range r.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		for _, h := range a.Groups[group] {
+			if h == host {
+				return true
+			}
+		}
+	}
+	if len(r.Selector) == 0 {
+		return false
+	}
+	labels := a.Labels[host]
+	for key, value := range r.Selector {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// profileUnits adds the units of the profiles assigned to the host.
+func (s *fleetServer) profileUnits(host string, ignore *reconciler.IgnoreRules, units map[string][]byte) error {
+	s.mu.Lock()
+	assignments := s.Assignments
+	s.mu.Unlock()
+	if assignments == nil {
+		return nil
+	}
+	for _, profile := range assignments.Profiles(host) {
+		if err := readUnits(s.Dir, path.Join(s.Dir, "profiles", profile), ignore, units); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type hostProfiles struct {
+	Host     string   `json:"host"`
+	Profiles []string `json:"profiles"`
+}
+
+// handleAssignments serves /v1/assignments. Agents and operators read the assignments, or the profiles of one
+// host given by the host query parameter, and the holder of the assignments' token replaces them with PUT.
+func (s *fleetServer) handleAssignments(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	assignments := s.Assignments
+	s.mu.Unlock()
+	if assignments == nil {
+		http.Error(w, "assignments are not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := agentName(r); !ok {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if host := r.URL.Query().Get("host"); host != "" {
+			profiles := assignments.Profiles(host)
+			if profiles == nil {
+				profiles = []string{}
+			}
+			json.NewEncoder(w).Encode(&hostProfiles{Host: host, Profiles: profiles})
+			return
+		}
+		redacted := *assignments
+		redacted.TokenSHA256 = ""
+		json.NewEncoder(w).Encode(&redacted)
+
+	case http.MethodPut:
+		if !bearerAuthorized(r, assignments.TokenSHA256) {
+			http.Error(w, "invalid assignments token", http.StatusUnauthorized)
+			return
+		}
+		buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAssignmentsSize))
+		if err != nil {
+			http.Error(w, "assignments too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		updated, err := parseAssignments(bytes.NewReader(buf))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if updated.TokenSHA256 == "" {
+			updated.TokenSHA256 = assignments.TokenSHA256 // the token can be rotated, but not removed through the api
+		}
+		if s.AssignPath != "" {
+			out, err := json.MarshalIndent(updated, "", "  ")
+			if err == nil {
+				err = reconciler.WriteFileAtomic(s.AssignPath, out)
+			}
+			if err != nil {
+				log.Printf("error while writing assignments: %s", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		s.mu.Lock()
+		s.Assignments = updated
+		s.mu.Unlock()
+		log.Printf("replaced fleet assignments from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
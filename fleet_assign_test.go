@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAssignments(t *testing.T) {
+	a, err := parseAssignments(strings.NewReader(`{
+		"groups": {"web": ["web1", "web2"]},
+		"labels": {"db1": {"env": "prod", "role": "db"}, "db2": {"env": "staging", "role": "db"}},
+		"assignments": [
+			{"profiles": ["base", "nginx"], "groups": ["web"]},
+			{"profiles": ["postgres"], "selector": {"role": "db", "env": "prod"}},
+			{"profiles": ["base", "debug"], "hosts": ["web2", "db2"]}
+		]
+	}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"base", "nginx"}, a.Profiles("web1"))
+	assert.Equal(t, []string{"base", "nginx", "debug"}, a.Profiles("web2"))
+	assert.Equal(t, []string{"postgres"}, a.Profiles("db1"))
+	assert.Equal(t, []string{"base", "debug"}, a.Profiles("db2"))
+	assert.Empty(t, a.Profiles("other"))
+
+	for _, invalid := range []string{
+		`{"assignments": [{"profiles": ["base"]}]}`,
+		`{"assignments": [{"hosts": ["web1"]}]}`,
+		`{"assignments": [{"profiles": ["../base"], "hosts": ["web1"]}]}`,
+		`{"assignments": [{"profiles": ["base"], "groups": ["missing"]}]}`,
+		`{"groups": {"web": ["../web1"]}, "assignments": []}`,
+		`{"tokenSHA256": "secret", "assignments": []}`,
+		`{"unknown": true}`,
+	} {
+		_, err := parseAssignments(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestFleetServerProfiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "profiles", "nginx"), 0755))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "hosts", "web1"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("top"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "profiles", "nginx", "a.service"), []byte("profile"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "profiles", "nginx", "nginx.service"), []byte("nginx"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hosts", "web1", "nginx.service"), []byte("host"), 0644))
+
+	s := &fleetServer{Dir: dir, Assignments: &fleetAssignments{Rules: []*assignmentRule{{Profiles: []string{"nginx"}, Hosts: []string{"web1", "web2"}}}}}
+	contents := func(host string) map[string]string {
+		assignment, err := s.assignment(host)
+		require.NoError(t, err)
+		m := map[string]string{}
+		for _, unit := range assignment.Units {
+			m[unit.Name] = string(unit.Content)
+		}
+		return m
+	}
+
+	assert.Equal(t, map[string]string{"a.service": "profile", "nginx.service": "host"}, contents("web1"))
+	assert.Equal(t, map[string]string{"a.service": "profile", "nginx.service": "nginx"}, contents("web2"))
+	assert.Equal(t, map[string]string{"a.service": "top"}, contents("db1"))
+}
+
+func TestFleetServerAssignmentsAPI(t *testing.T) {
+	sum := sha256.Sum256([]byte("assign-token"))
+	file := path.Join(t.TempDir(), "assignments.json")
+	s := &fleetServer{Dir: t.TempDir(), AssignPath: file, Assignments: &fleetAssignments{
+		TokenSHA256: hex.EncodeToString(sum[:]),
+		Rules:       []*assignmentRule{{Profiles: []string{"base"}, Hosts: []string{"web1"}}},
+	}}
+	handler := s.Handler()
+
+	request := func(req *http.Request, token string) *httptest.ResponseRecorder {
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("read", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request(httptest.NewRequest("GET", "/v1/assignments", nil), "").Code)
+
+		w := request(withClientCert(httptest.NewRequest("GET", "/v1/assignments", nil), "web1"), "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "tokenSHA256")
+
+		w = request(withClientCert(httptest.NewRequest("GET", "/v1/assignments?host=web1", nil), "web1"), "")
+		require.Equal(t, http.StatusOK, w.Code)
+		profiles := &hostProfiles{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(profiles))
+		assert.Equal(t, []string{"base"}, profiles.Profiles)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		body := `{"assignments": [{"profiles": ["nginx"], "hosts": ["web1"]}]}`
+		assert.Equal(t, http.StatusUnauthorized, request(httptest.NewRequest("PUT", "/v1/assignments", strings.NewReader(body)), "wrong").Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, request(httptest.NewRequest("PUT", "/v1/assignments", strings.NewReader(`{"assignments": [{"profiles": ["nginx"]}]}`)), "assign-token").Code)
+
+		require.Equal(t, http.StatusNoContent, request(httptest.NewRequest("PUT", "/v1/assignments", strings.NewReader(body)), "assign-token").Code)
+		assert.Equal(t, []string{"nginx"}, s.Assignments.Profiles("web1"))
+
+		// The token is kept, so the written file can be loaded again
+		loaded, err := loadAssignments(file)
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(sum[:]), loaded.TokenSHA256)
+		assert.Equal(t, []string{"nginx"}, loaded.Profiles("web1"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := &fleetServer{Dir: t.TempDir()}
+		w := httptest.NewRecorder()
+		disabled.Handler().ServeHTTP(w, withClientCert(httptest.NewRequest("GET", "/v1/assignments", nil), "web1"))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
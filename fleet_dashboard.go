@@ -0,0 +1,248 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// dashboardEvents is how many of the most recent unit state changes the dashboard shows.
+const dashboardEvents = 25
+
+// dashboardView is the state of the fleet rendered by the fleet server's read-only web dashboard.
+type dashboardView struct {
+	Time    time.Time
+	Rollout *rolloutStatus // nil when rollouts aren't enabled
+	Agents  []*dashboardAgent
+	Events  []*dashboardEvent // newest first
+}
+
+type dashboardAgent struct {
+	*reconciler.HostReport
+	Rows     []*dashboardUnit
+	HeldBack []*dashboardDiff // changes to the agent's assignment waiting for the rollout to admit it
+}
+
+type dashboardUnit struct {
+	Name    string
+	State   string
+	Action  string
+	Failure string
+	Drift   string // why the unit differs from the agent's assignment, empty when it doesn't
+}
+
+type dashboardDiff struct {
+	Unit  string
+	Lines []string // see diffLines
+}
+
+type dashboardEvent struct {
+	Host   string
+	Unit   string
+	State  reconciler.UnitState
+	Reason string
+	Since  time.Time
+}
+
+func (s *fleetServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if !s.operator(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	view, err := s.dashboard(time.Now())
+	if err != nil {
+		log.Printf("error while building dashboard: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, view); err != nil {
+		log.Printf("error while rendering dashboard: %s", err)
+	}
+}
+
+// dashboard returns the latest report of every agent, compared against the assignment it was given and the
+// assignment it would be given if no rollout was holding it back.
+func (s *fleetServer) dashboard(now time.Time) (*dashboardView, error) {
+	s.mu.Lock()
+	view := &dashboardView{Time: now}
+	if s.Rollout != nil {
+		view.Rollout = s.Rollout.Status()
+		sort.Strings(view.Rollout.Pending)
+	}
+	reports := make([]*reconciler.HostReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+	served := make(map[string]*fleetAssignment, len(s.served))
+	for host, assignment := range s.served {
+		served[host] = assignment
+	}
+	s.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Host < reports[j].Host })
+
+	for _, report := range reports {
+		agent := &dashboardAgent{HostReport: report, Rows: dashboardRows(report, served[report.Host])}
+		if current, ok := served[report.Host]; ok && s.Rollout != nil {
+			desired, err := s.assignment(report.Host)
+			if err != nil {
+				return nil, err
+			}
+			agent.HeldBack = assignmentDiff(current, desired)
+			for _, diff := range agent.HeldBack {
+				diff.Lines = s.Redact.Lines(diff.Lines)
+			}
+		}
+		view.Agents = append(view.Agents, agent)
+
+		for unit, status := range report.States {
+			view.Events = append(view.Events, &dashboardEvent{Host: report.Host, Unit: unit, State: status.State, Reason: status.Reason, Since: status.Since})
+		}
+	}
+	sort.Slice(view.Events, func(i, j int) bool { return view.Events[i].Since.After(view.Events[j].Since) })
+	if len(view.Events) > dashboardEvents {
+		view.Events = view.Events[:dashboardEvents]
+	}
+	return view, nil
+}
+
+// dashboardRows lists the units an agent reported or was assigned, sorted by name.
+func dashboardRows(report *reconciler.HostReport, assignment *fleetAssignment) []*dashboardUnit {
+	assigned := map[string]string{}
+	if assignment != nil {
+		for _, unit := range assignment.Units {
+			assigned[unit.Name] = unit.Checksum()
+		}
+	}
+
+	rows := map[string]*dashboardUnit{}
+	row := func(name string) *dashboardUnit {
+		if rows[name] == nil {
+			rows[name] = &dashboardUnit{Name: name}
+		}
+		return rows[name]
+	}
+	for name := range report.Units {
+		checksum, _ := report.Applied(name)
+		switch expected, ok := assigned[name]; {
+		case assignment != nil && !ok:
+			row(name).Drift = "no longer assigned"
+		case ok && expected != checksum:
+			row(name).Drift = "assignment not applied"
+		default:
+			row(name)
+		}
+	}
+	for name := range assigned {
+		if _, ok := report.Units[name]; !ok {
+			row(name).Drift = "assignment not applied"
+		}
+	}
+	for name, msg := range report.Failures {
+		row(name).Failure = msg
+	}
+	for name, status := range report.States {
+		row(name).State = string(status.State)
+	}
+	for name, action := range report.Actions {
+		row(name).Action = action.Action
+	}
+	for _, change := range report.Pending {
+		row(change.Unit).Drift = "would " + change.Action
+	}
+
+	sorted := make([]*dashboardUnit, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// assignmentDiff returns the line diff of every unit that differs between two assignments.
+func assignmentDiff(current, desired *fleetAssignment) []*dashboardDiff {
+	contents := func(a *fleetAssignment) map[string]string {
+		m := map[string]string{}
+		for _, unit := range a.Units {
+			m[unit.Name] = string(unit.Content)
+		}
+		return m
+	}
+	before, after := contents(current), contents(desired)
+
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []*dashboardDiff
+	for _, name := range names {
+		if before[name] != after[name] {
+			diffs = append(diffs, &dashboardDiff{Unit: name, Lines: diffLines(splitLines(before[name]), splitLines(after[name]))})
+		}
+	}
+	return diffs
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago": since,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>unitmgr fleet</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.failing { color: #b00; }
+.drift { color: #a60; }
+pre { background: #f4f4f4; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>unitmgr fleet</h1>
+<p>{{len .Agents}} agents, updated {{.Time.UTC.Format "2006-01-02 15:04:05 MST"}}.
+Export the inventory as <a href="/v1/inventory?format=csv">csv</a> or <a href="/v1/inventory">json</a>, or only its <a href="/v1/inventory?format=csv&drifted=true">drifted</a> and <a href="/v1/inventory?format=csv&failing=true">failing</a> units.</p>
+{{with .Rollout}}
+<h2>Rollout</h2>
+<p>{{.Percent}}% of agents at once{{if .Pending}}, updating {{range $i, $host := .Pending}}{{if $i}}, {{end}}{{$host}}{{end}}{{end}}</p>
+{{if .Halted}}<p class="failing">Halted: {{.Halted}}. Resume it with POST /v1/rollout/resume.</p>{{end}}
+{{end}}
+{{$now := .Time}}
+{{range .Agents}}
+<h2 id="{{.Host}}">{{.Host}} <span class="{{if .OK}}ok{{else}}failing{{end}}">{{if .OK}}ok{{else}}failing{{end}}</span></h2>
+<p>{{len .Units}} units, generation {{.Generation}}, last synced {{ago $now .LastSync}} ago</p>
+<table>
+<tr><th>Unit</th><th>State</th><th>Last action</th><th>Drift</th><th>Failure</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{.Action}}</td><td class="drift">{{.Drift}}</td><td class="failing">{{.Failure}}</td></tr>
+{{end}}</table>
+{{if .HeldBack}}<h3>Pending approval by the rollout</h3>
+{{range .HeldBack}}<p>{{.Unit}}</p>
+<pre>{{range .Lines}}{{.}}
+{{end}}</pre>
+{{end}}{{end}}
+{{end}}
+<h2>Recent events</h2>
+<table>
+<tr><th>Since</th><th>Agent</th><th>Unit</th><th>State</th><th>Reason</th></tr>
+{{range .Events}}<tr><td>{{.Since.UTC.Format "15:04:05"}}</td><td>{{.Host}}</td><td>{{.Unit}}</td><td>{{.State}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetDashboard(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "b.service"), []byte("[Service]\nExecStart=/bin/b\n"), 0644))
+
+	s := &fleetServer{Dir: dir, Rollout: &rollout{Percent: 50}, OpsToken: sha256Hex([]byte("ops-token"))}
+	handler := s.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ui", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withClientCert(httptest.NewRequest("GET", "/ui", nil), "host1"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "agent certificates can't read other agents' units")
+
+	assignment, err := s.assignment("host1")
+	require.NoError(t, err)
+	s.admit("host1", assignment, "")
+	now := time.Now()
+	s.reports = map[string]*reconciler.HostReport{"host1": {
+		Host:     "host1",
+		Units:    map[string]string{"a.service": assignment.Units[0].Checksum(), "c.service": "old"},
+		Failures: map[string]string{"c.service": "oops"},
+		LastSync: now,
+		States: map[string]*reconciler.UnitStatus{
+			"a.service": {State: reconciler.StateHealthy, Since: now.Add(-time.Minute)},
+			"c.service": {State: reconciler.StateFailed, Reason: "oops", Since: now},
+		},
+	}}
+
+	// Changes the rollout holds back are diffed
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	s.served["host2"] = assignment // a second agent keeps the rollout from admitting both
+	s.Rollout.Admit("host2", &fleetAssignment{}, 2, now)
+
+	view, err := s.dashboard(now)
+	require.NoError(t, err)
+	require.Len(t, view.Agents, 1)
+	assert.Equal(t, []*dashboardUnit{
+		{Name: "a.service", State: "Healthy"},
+		{Name: "b.service", Drift: "assignment not applied"},
+		{Name: "c.service", State: "Failed", Failure: "oops", Drift: "no longer assigned"},
+	}, view.Agents[0].Rows)
+	assert.Equal(t, []*dashboardDiff{{Unit: "a.service", Lines: []string{"-ExecStart=/bin/a", "+ExecStart=/bin/a2"}}}, view.Agents[0].HeldBack)
+	require.Len(t, view.Events, 2)
+	assert.Equal(t, "c.service", view.Events[0].Unit)
+	assert.Equal(t, []string{"host2"}, view.Rollout.Pending)
+
+	req := withClientCert(httptest.NewRequest("GET", "/ui", nil), "operator")
+	req.Header.Set("Authorization", "Bearer ops-token")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Pending approval by the rollout")
+	assert.Contains(t, w.Body.String(), "ExecStart=/bin/a2")
+}
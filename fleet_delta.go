@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// fleetDelta returns the units of desired that differ from current, and tombstones for the units of current that
+// desired no longer contains, so agents polling a large assignment only transfer what changed.
+func fleetDelta(current, desired *fleetAssignment) *fleetAssignment {
+	before := make(map[string]string, len(current.Units))
+	for _, unit := range current.Units {
+		before[unit.Name] = unit.Checksum()
+	}
+
+	delta := &fleetAssignment{Units: []*fleetUnit{}, Base: current.Revision()}
+	for _, unit := range desired.Units {
+		if checksum, ok := before[unit.Name]; !ok || checksum != unit.Checksum() {
+			delta.Units = append(delta.Units, unit)
+		}
+		delete(before, unit.Name)
+	}
+	for name := range before {
+		delta.Removed = append(delta.Removed, name)
+	}
+	sort.Strings(delta.Removed)
+	return delta
+}
+
+// applyDelta returns the assignment resulting from applying the delta to current, which must be its base.
+func applyDelta(current, delta *fleetAssignment) (*fleetAssignment, error) {
+	if current == nil || current.Revision() != delta.Base {
+		return nil, fmt.Errorf("received a delta against revision %s, which isn't the current assignment", delta.Base)
+	}
+	units := make(map[string][]byte, len(current.Units))
+	for _, unit := range current.Units {
+		units[unit.Name] = unit.Content
+	}
+	for _, name := range delta.Removed {
+		delete(units, name)
+	}
+	for _, unit := range delta.Units {
+		units[unit.Name] = unit.Content
+	}
+	return newAssignment(units), nil
+}
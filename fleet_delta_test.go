@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetDelta(t *testing.T) {
+	current := newAssignment(map[string][]byte{"a.service": []byte("a"), "b.service": []byte("b"), "c.service": []byte("c")})
+	desired := newAssignment(map[string][]byte{"a.service": []byte("a"), "b.service": []byte("b2"), "d.service": []byte("d")})
+
+	delta := fleetDelta(current, desired)
+	assert.Equal(t, current.Revision(), delta.Base)
+	assert.Equal(t, []string{"c.service"}, delta.Removed)
+	require.Len(t, delta.Units, 2)
+	assert.Equal(t, "b.service", delta.Units[0].Name)
+	assert.Equal(t, "d.service", delta.Units[1].Name)
+
+	applied, err := applyDelta(current, delta)
+	require.NoError(t, err)
+	assert.Equal(t, desired.Revision(), applied.Revision())
+
+	_, err = applyDelta(desired, delta)
+	assert.Error(t, err, "the delta doesn't apply to other revisions")
+	_, err = applyDelta(nil, delta)
+	assert.Error(t, err)
+}
+
+func TestFleetAgentDelta(t *testing.T) {
+	serverDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(serverDir, "a.service"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(serverDir, "b.service"), []byte("b"), 0644))
+
+	s := &fleetServer{Dir: serverDir}
+	handler := s.Handler()
+	var responses []*httptest.ResponseRecorder
+	server := newAgentServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		responses = append(responses, rec)
+		for key, values := range rec.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}), "host1")
+	defer server.Close()
+
+	dir := t.TempDir()
+	a := &fleetAgent{Server: server.URL, Dir: dir, Client: server.Client()}
+	require.NoError(t, a.Poll())
+	require.Len(t, responses, 1)
+	assert.NotContains(t, responses[0].Body.String(), `"base"`)
+
+	// Unchanged assignments aren't sent again, but local modifications are still reverted
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("local"), 0644))
+	require.NoError(t, a.Poll())
+	assert.Contains(t, responses[1].Body.String(), `"notModified":true`)
+	assert.NotContains(t, responses[1].Body.String(), `"units"`)
+	content, err := ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	// Changes are sent as deltas
+	require.NoError(t, ioutil.WriteFile(path.Join(serverDir, "c.service"), []byte("c"), 0644))
+	require.NoError(t, os.Remove(path.Join(serverDir, "b.service")))
+	require.NoError(t, a.Poll())
+	assert.Contains(t, responses[2].Body.String(), `"removed":["b.service"]`)
+	assert.NotContains(t, responses[2].Body.String(), `"a.service"`)
+	assert.NoFileExists(t, path.Join(dir, "b.service"))
+	content, err = ioutil.ReadFile(path.Join(dir, "c.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(content))
+
+	// Agents whose base the server doesn't know receive the complete assignment
+	a.last = newAssignment(map[string][]byte{"other.service": []byte("x")})
+	require.NoError(t, a.Poll())
+	assert.NotContains(t, responses[3].Body.String(), `"base"`)
+	assert.FileExists(t, path.Join(dir, "a.service"))
+}
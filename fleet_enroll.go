@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// enrollValidity is how long the client certificates issued to enrolled agents are valid.
+const enrollValidity = 365 * 24 * time.Hour
+
+// errInvalidEnrollment is returned for tokens that are unknown, expired, or already used.
+var errInvalidEnrollment = errors.New("invalid or expired enrollment token")
+
+// fleetEnrollment allows one agent to exchange a bootstrap token for a client certificate of the given host.
+type fleetEnrollment struct {
+	Host        string    `json:"host"`
+	TokenSHA256 string    `json:"tokenSHA256"`       // hex sha256 of the bootstrap token
+	Expires     time.Time `json:"expires,omitempty"` // the token can't be used afterwards, never expires when zero
+}
+
+// enroller issues client certificates signed by the fleet CA to agents presenting a bootstrap token.
+// Tokens are single use, so used enrollments are removed from the file at Path.
+type enroller struct {
+	Path string
+	CA   *x509.Certificate
+	Key  crypto.Signer
+
+	mu          sync.Mutex
+	enrollments []*fleetEnrollment
+}
+
+type enrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"` // pem encoded certificate request
+}
+
+type enrollResponse struct {
+	Certificate string `json:"certificate"` // pem encoded
+}
+
+// loadEnroller reads a json file of enrollments, e.g. {"enrollments": [{"host": "web1", "tokenSHA256": "..."}]},
+// and the CA certificate and key signing the issued certificates.
+func loadEnroller(name, caCert, caKey string) (*enroller, error) {
+	pair, err := tls.LoadX509KeyPair(caCert, caKey) // the CA's certificate must come first in the bundle
+	if err != nil {
+		return nil, fmt.Errorf("loading enrollment CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing enrollment CA: %w", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !ca.IsCA {
+		return nil, fmt.Errorf("the first certificate of %q isn't a CA matching the key", caCert)
+	}
+
+	e := &enroller{Path: name, CA: ca, Key: signer}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	config := &struct {
+		Enrollments []*fleetEnrollment `json:"enrollments"`
+	}{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("decoding enrollments: %w", err)
+	}
+	for _, enrollment := range config.Enrollments {
+		if !validUnitName(enrollment.Host) {
+			return nil, fmt.Errorf("invalid enrollment host %q", enrollment.Host)
+		}
+		if sum, err := hex.DecodeString(enrollment.TokenSHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("enrollment of %q must set tokenSHA256 to a hex sha256 digest", enrollment.Host)
+		}
+	}
+	e.enrollments = config.Enrollments
+	return e, nil
+}
+
+// Enroll consumes the token and returns a pem encoded client certificate for the public key of the certificate
+// request. The certificate's common name is the host the token was issued for, regardless of the request.
+func (e *enroller) Enroll(token string, csrPEM []byte, now time.Time) ([]byte, string, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, "", errors.New("expected a pem encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, "", err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sum := sha256.Sum256([]byte(token))
+	var enrollment *fleetEnrollment
+	remaining := make([]*fleetEnrollment, 0, len(e.enrollments))
+	for _, candidate := range e.enrollments {
+		expected, _ := hex.DecodeString(candidate.TokenSHA256)
+		if enrollment == nil && subtle.ConstantTimeCompare(sum[:], expected) == 1 {
+			enrollment = candidate
+			continue
+		}
+		remaining = append(remaining, candidate)
+	}
+	if enrollment == nil || (!enrollment.Expires.IsZero() && now.After(enrollment.Expires)) {
+		return nil, "", errInvalidEnrollment
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: enrollment.Host},
+		NotBefore:    now.Add(-5 * time.Minute), // tolerate clock skew
+		NotAfter:     now.Add(enrollValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, e.CA, csr.PublicKey, e.Key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The token is only consumed once the certificate was issued
+	if err := e.save(remaining); err != nil {
+		return nil, "", err
+	}
+	e.enrollments = remaining
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), enrollment.Host, nil
+}
+
+func (e *enroller) save(enrollments []*fleetEnrollment) error {
+	buf, err := json.MarshalIndent(map[string][]*fleetEnrollment{"enrollments": enrollments}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return reconciler.WriteFileAtomic(e.Path, buf)
+}
+
+// handleEnroll is the only endpoint agents can use without a client certificate.
+func (s *fleetServer) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Enroller == nil {
+		http.Error(w, "enrollment is not enabled", http.StatusNotFound)
+		return
+	}
+	req := &enrollRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(req); err != nil || req.Token == "" {
+		http.Error(w, "expected a json body with a token and csr", http.StatusBadRequest)
+		return
+	}
+
+	cert, host, err := s.Enroller.Enroll(req.Token, []byte(req.CSR), time.Now())
+	if err == errInvalidEnrollment {
+		log.Printf("rejected enrollment from %s: %s", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("error while enrolling agent from %s: %s", r.RemoteAddr, err)
+		http.Error(w, "enrollment failed", http.StatusBadRequest)
+		return
+	}
+	log.Printf("enrolled agent %q from %s", host, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&enrollResponse{Certificate: string(cert)})
+}
+
+// enroll exchanges the bootstrap token in tokenFile for a client certificate, writing it and its newly generated key
+// to cert and key. Agents that already have a certificate don't enroll again.
+func enroll(server, tokenFile, cert, key, ca string, timeout time.Duration) error {
+	if _, err := os.Stat(cert); err == nil {
+		return nil
+	}
+	if cert == "" || key == "" || ca == "" {
+		return errors.New("a certificate, key, and CA are required for fleet mode")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading enrollment token: %w", err)
+	}
+	caPEM, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return fmt.Errorf("reading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in CA file %q", ca)
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: hostname}}, private)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&enrollRequest{
+		Token: strings.TrimSpace(string(token)),
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+	resp, err := client.Post(strings.TrimSuffix(server, "/")+"/v1/enroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("enrollment failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	result := &enrollResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	// The certificate is written last, since its presence means the agent is enrolled
+	if err := reconciler.WriteFileAtomic(cert, []byte(result.Certificate)); err != nil {
+		return err
+	}
+	log.Printf("enrolled with fleet server %s", server)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCA writes a self-signed CA and its key to dir and returns their paths.
+func writeTestCA(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fleet CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert, keyFile := path.Join(dir, "ca.pem"), path.Join(dir, "ca-key.pem")
+	require.NoError(t, ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, keyFile
+}
+
+func TestEnroll(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := writeTestCA(t, dir)
+	enrollments := path.Join(dir, "enrollments.json")
+	require.NoError(t, ioutil.WriteFile(enrollments, []byte(`{"enrollments": [
+		{"host": "web1", "tokenSHA256": "`+sha256Hex([]byte("token1"))+`"},
+		{"host": "web2", "tokenSHA256": "`+sha256Hex([]byte("token2"))+`", "expires": "2020-01-01T00:00:00Z"}
+	]}`), 0600))
+	e, err := loadEnroller(enrollments, caCert, caKey)
+	require.NoError(t, err)
+
+	// The fleet server presents a certificate of the same CA
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, e.CA, &serverKey.PublicKey, e.Key)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(e.CA)
+
+	s := &fleetServer{Dir: dir, Enroller: e}
+	server := httptest.NewUnstartedServer(s.Handler())
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	agent := t.TempDir()
+	cert, key, token := path.Join(agent, "host.pem"), path.Join(agent, "host-key.pem"), path.Join(agent, "token")
+	require.NoError(t, ioutil.WriteFile(token, []byte("token1\n"), 0600))
+	require.NoError(t, enroll(server.URL, token, cert, key, caCert, time.Second*5))
+
+	// The issued certificate is trusted by the fleet CA and names the token's host
+	config, err := loadTLSConfig(cert, key, caCert)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "web1", leaf.Subject.CommonName)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+
+	// Enrolled agents don't enroll again, and tokens are single use
+	require.NoError(t, enroll(server.URL, token, cert, key, caCert, time.Second*5))
+	err = enroll(server.URL, token, path.Join(agent, "other.pem"), key, caCert, time.Second*5)
+	assert.EqualError(t, err, "enrollment failed with status 403: invalid or expired enrollment token")
+	buf, err := ioutil.ReadFile(enrollments)
+	require.NoError(t, err)
+	assert.NotContains(t, string(buf), "web1")
+
+	// Expired tokens are rejected
+	require.NoError(t, ioutil.WriteFile(token, []byte("token2"), 0600))
+	err = enroll(server.URL, token, path.Join(agent, "other.pem"), key, caCert, time.Second*5)
+	assert.EqualError(t, err, "enrollment failed with status 403: invalid or expired enrollment token")
+}
+
+func TestLoadEnrollerInvalid(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := writeTestCA(t, dir)
+	enrollments := path.Join(dir, "enrollments.json")
+
+	require.NoError(t, ioutil.WriteFile(enrollments, []byte(`{"enrollments": [{"host": "web1", "tokenSHA256": "abc"}]}`), 0600))
+	_, err := loadEnroller(enrollments, caCert, caKey)
+	assert.EqualError(t, err, `enrollment of "web1" must set tokenSHA256 to a hex sha256 digest`)
+
+	require.NoError(t, ioutil.WriteFile(enrollments, []byte(`{"enrollments": [{"host": "../etc", "tokenSHA256": "abc"}]}`), 0600))
+	_, err = loadEnroller(enrollments, caCert, caKey)
+	assert.EqualError(t, err, `invalid enrollment host "../etc"`)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// maxOperations is how many fleet operations the server remembers, the oldest are forgotten first.
+const maxOperations = 100
+
+// operationActions are the actions agents run for fleet operations.
+var operationActions = map[string]func(ctx context.Context, sysd reconciler.Systemd, unit string) error{
+	"restart": func(ctx context.Context, sysd reconciler.Systemd, unit string) error { return sysd.Restart(ctx, unit) },
+	"start": func(ctx context.Context, sysd reconciler.Systemd, unit string) error {
+		_, err := sysd.EnsureRunning(ctx, unit)
+		return err
+	},
+	"stop": func(ctx context.Context, sysd reconciler.Systemd, unit string) error {
+		_, err := sysd.EnsureStopped(ctx, unit)
+		return err
+	},
+}
+
+// fleetOperation runs an action on one unit of every targeted agent, e.g. restarting nginx.service on the hosts
+// labeled role=web, a percentage of them at a time. Agents pick up the operation when they poll the server, and
+// the operation halts as soon as one of them fails.
+type fleetOperation struct {
+	ID       string                      `json:"id"`
+	Action   string                      `json:"action"`
+	Unit     string                      `json:"unit"`
+	Percent  int                         `json:"percent,omitempty"` // of the targets running the action at once, all of them when zero
+	Hosts    []string                    `json:"hosts,omitempty"`
+	Groups   []string                    `json:"groups,omitempty"` // see fleetAssignments
+	Selector map[string]string           `json:"selector,omitempty"`
+	Created  time.Time                   `json:"created"`
+	Targets  []string                    `json:"targets"` // agents matching the hosts, groups, or selector when the operation was created
+	Results  map[string]*operationResult `json:"results"`
+	Halted   string                      `json:"halted,omitempty"` // why no more agents are given the operation
+
+	dispatched map[string]bool
+}
+
+type operationResult struct {
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// Done returns true once every target reported a result, or the operation halted and no target is still running it.
+func (o *fleetOperation) Done() bool {
+	return len(o.Results) == len(o.Targets) || (o.Halted != "" && o.running() == 0)
+}
+
+func (o *fleetOperation) running() int {
+	n := 0
+	for host := range o.dispatched {
+		if _, ok := o.Results[host]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// batch returns how many targets may run the operation at once.
+func (o *fleetOperation) batch() int {
+	if o.Percent <= 0 || o.Percent >= 100 {
+		return len(o.Targets)
+	}
+	n := len(o.Targets) * o.Percent / 100
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Dispatch returns true if the host should run the operation now. Hosts that were given the operation before but
+// didn't report a result yet are given it again, e.g. after the agent restarted.
+func (o *fleetOperation) Dispatch(host string) bool {
+	if _, ok := o.Results[host]; ok {
+		return false
+	}
+	if o.dispatched[host] {
+		return true
+	}
+	if o.Halted != "" || o.running() >= o.batch() {
+		return false
+	}
+	for _, target := range o.Targets {
+		if target == host {
+			o.dispatched[host] = true
+			return true
+		}
+	}
+	return false
+}
+
+// Complete records the result of the operation on the host.
+func (o *fleetOperation) Complete(host string, result *operationResult) error {
+	if !o.dispatched[host] {
+		return errors.New("the operation wasn't dispatched to this agent")
+	}
+	o.Results[host] = result
+	if !result.OK && o.Halted == "" {
+		o.Halted = fmt.Sprintf("failed on %s: %s", host, result.Error)
+	}
+	return nil
+}
+
+// createOperation validates the operation and targets it at the agents known to the server.
+func (s *fleetServer) createOperation(op *fleetOperation, now time.Time) error {
+	if operationActions[op.Action] == nil {
+		return fmt.Errorf("unknown action %q, expected restart, start, or stop", op.Action)
+	}
+	if !validUnitName(op.Unit) {
+		return fmt.Errorf("invalid unit name %q", op.Unit)
+	}
+	if len(op.Hosts) == 0 && len(op.Groups) == 0 && len(op.Selector) == 0 {
+		return errors.New("the operation must set hosts, groups, or a selector")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignments := s.Assignments
+	if assignments == nil {
+		assignments = &fleetAssignments{}
+	}
+	for _, group := range op.Groups {
+		if _, ok := assignments.Groups[group]; !ok {
+			return fmt.Errorf("undefined group %q", group)
+		}
+	}
+
+	known := map[string]bool{}
+	for host := range s.reports {
+		known[host] = true
+	}
+	for host := range s.served {
+		known[host] = true
+	}
+	rule := &assignmentRule{Hosts: op.Hosts, Groups: op.Groups, Selector: op.Selector}
+	op.Targets = []string{}
+	for host := range known {
+		if rule.matches(host, assignments) {
+			op.Targets = append(op.Targets, host)
+		}
+	}
+	if len(op.Targets) == 0 {
+		return errors.New("no agents match the operation")
+	}
+	sort.Strings(op.Targets)
+
+	s.operationSeq++
+	op.ID = strconv.Itoa(s.operationSeq)
+	op.Created = now
+	op.Results = map[string]*operationResult{}
+	op.Halted = ""
+	op.dispatched = map[string]bool{}
+	s.operations = append(s.operations, op)
+	if len(s.operations) > maxOperations {
+		s.operations = s.operations[len(s.operations)-maxOperations:]
+	}
+	return nil
+}
+
+// handleOperations serves /v1/operations and its subpaths, agents run operations through the fleet service instead:
+//
+//	POST /v1/operations                starts an operation, requires the operations token
+//	GET  /v1/operations[/<id>]         lists the operations and their results
+func (s *fleetServer) handleOperations(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/operations"), "/"), "/")
+	if parts[0] == "" && r.Method == http.MethodPost {
+		s.handleCreateOperation(w, r)
+		return
+	}
+
+	if _, ok := agentName(r); !ok {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if len(parts) != 1 || r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	var v interface{} = s.operations
+	if parts[0] == "" {
+		if s.operations == nil {
+			v = []*fleetOperation{}
+		}
+	} else {
+		op := s.operation(parts[0])
+		if op == nil {
+			s.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		v = op
+	}
+	buf, err := json.Marshal(v) // while holding the lock, since results are updated in place
+	s.mu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
+
+// takeOperation serves NextOperation: the action the host should run now, or nil.
+func (s *fleetServer) takeOperation(host string) *fleetOperation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.nextOperation(host)
+	if op == nil {
+		return nil
+	}
+	return &fleetOperation{ID: op.ID, Action: op.Action, Unit: op.Unit} // a copy, since results are updated in place
+}
+
+// completeOperation serves ReportOperationResult.
+func (s *fleetServer) completeOperation(host, id string, result *operationResult) error {
+	result.Finished = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.operation(id)
+	if op == nil {
+		return errors.New("unknown operation")
+	}
+	if err := op.Complete(host, result); err != nil {
+		return err
+	}
+	if !result.OK {
+		log.Printf("fleet operation %s failed on agent %q: %s", op.ID, host, result.Error)
+	}
+	if op.Done() {
+		log.Printf("fleet operation %s finished on %d of %d agents", op.ID, len(op.Results), len(op.Targets))
+	}
+	return nil
+}
+
+func (s *fleetServer) handleCreateOperation(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, s.OpsToken) {
+		http.Error(w, "invalid operations token", http.StatusUnauthorized)
+		return
+	}
+	op := &fleetOperation{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(op); err != nil {
+		http.Error(w, "invalid operation", http.StatusBadRequest)
+		return
+	}
+	if err := s.createOperation(op, time.Now().UTC()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("started fleet operation %s: %s %s on %d agents", op.ID, op.Action, op.Unit, len(op.Targets))
+
+	s.mu.Lock()
+	buf, err := json.Marshal(op)
+	s.mu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(append(buf, '\n'))
+}
+
+// operation returns the operation with the given id, or nil. The caller must hold s.mu.
+func (s *fleetServer) operation(id string) *fleetOperation {
+	for _, op := range s.operations {
+		if op.ID == id {
+			return op
+		}
+	}
+	return nil
+}
+
+// nextOperation returns the oldest operation the host should run now, or nil. The caller must hold s.mu.
+func (s *fleetServer) nextOperation(host string) *fleetOperation {
+	for _, op := range s.operations {
+		if op.Dispatch(host) {
+			return op
+		}
+	}
+	return nil
+}
+
+// runOperation runs the operation the server has for this agent, if any, and reports its result.
+// Only units assigned by the fleet server can be operated on.
+func (a *fleetAgent) runOperation(ctx context.Context) error {
+	resp := &operationResponse{}
+	err := invokeGRPC(ctx, a.Client, a.Server, "NextOperation", &grpcEmpty{}, resp)
+	var gerr *grpcError
+	if errors.As(err, &gerr) && gerr.Code == grpcUnimplemented {
+		return nil // the server doesn't support operations
+	}
+	if err != nil {
+		return err
+	}
+	op := resp.Operation
+	if op == nil {
+		return nil
+	}
+
+	result := &operationResult{OK: true}
+	action := operationActions[op.Action]
+	if _, err := os.Stat(path.Join(a.Dir, op.Unit)); !validUnitName(op.Unit) || err != nil {
+		result = &operationResult{Error: fmt.Sprintf("unit %q isn't assigned to this agent", op.Unit)}
+	} else if action == nil {
+		result = &operationResult{Error: fmt.Sprintf("unknown action %q", op.Action)}
+	} else if err := action(ctx, a.Systemd, op.Unit); err != nil {
+		result = &operationResult{Error: err.Error()}
+	}
+	log.Printf("ran fleet operation %s: %s %s (ok: %t)", op.ID, op.Action, op.Unit, result.OK)
+
+	if err := invokeGRPC(ctx, a.Client, a.Server, "ReportOperationResult", &operationResultRequest{ID: op.ID, Result: result}, &grpcEmpty{}); err != nil {
+		return fmt.Errorf("reporting the result of operation %s: %w", op.ID, err)
+	}
+	return nil
+}
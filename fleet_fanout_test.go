@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetOperationBatches(t *testing.T) {
+	op := &fleetOperation{Percent: 50, Targets: []string{"a", "b", "c", "d"}, Results: map[string]*operationResult{}, dispatched: map[string]bool{}}
+
+	assert.True(t, op.Dispatch("a"))
+	assert.True(t, op.Dispatch("b"))
+	assert.False(t, op.Dispatch("c"), "half of the targets are already running the operation")
+	assert.False(t, op.Dispatch("other"))
+	assert.True(t, op.Dispatch("a"), "dispatched again until the result is reported")
+
+	require.NoError(t, op.Complete("a", &operationResult{OK: true}))
+	assert.False(t, op.Dispatch("a"))
+	assert.True(t, op.Dispatch("c"))
+	assert.Error(t, op.Complete("d", &operationResult{OK: true}))
+
+	require.NoError(t, op.Complete("b", &operationResult{Error: "oops"}))
+	assert.Equal(t, "failed on b: oops", op.Halted)
+	assert.False(t, op.Dispatch("d"), "halted operations aren't dispatched")
+	assert.False(t, op.Done())
+	require.NoError(t, op.Complete("c", &operationResult{OK: true}))
+	assert.True(t, op.Done())
+}
+
+func TestFleetOperations(t *testing.T) {
+	sum := sha256.Sum256([]byte("ops-token"))
+	s := &fleetServer{Dir: t.TempDir(), OpsToken: hex.EncodeToString(sum[:]), Assignments: &fleetAssignments{
+		Groups: map[string][]string{"web": {"web1", "web2"}},
+		Labels: map[string]map[string]string{"db1": {"role": "db"}},
+	}}
+	s.reports = map[string]*reconciler.HostReport{"web1": {Host: "web1"}, "web2": {Host: "web2"}, "db1": {Host: "db1"}}
+	handler := s.Handler()
+
+	create := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/operations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	agent := func(method, url, host string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withClientCert(httptest.NewRequest(method, url, nil), host))
+		return w
+	}
+	next := func(host string) *fleetOperation {
+		resp := &operationResponse{}
+		require.NoError(t, callAgent(handler, host, "NextOperation", &grpcEmpty{}, resp))
+		return resp.Operation
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, create(`{"action": "restart", "unit": "a.service", "groups": ["web"]}`, "wrong").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, create(`{"action": "reboot", "unit": "a.service", "groups": ["web"]}`, "ops-token").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, create(`{"action": "restart", "unit": "a.service"}`, "ops-token").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, create(`{"action": "restart", "unit": "a.service", "groups": ["missing"]}`, "ops-token").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, create(`{"action": "restart", "unit": "a.service", "selector": {"role": "cache"}}`, "ops-token").Code)
+
+	w := create(`{"action": "restart", "unit": "a.service", "groups": ["web"], "percent": 50}`, "ops-token")
+	require.Equal(t, http.StatusCreated, w.Code)
+	op := &fleetOperation{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(op))
+	assert.Equal(t, []string{"web1", "web2"}, op.Targets)
+
+	assert.Nil(t, next("db1"))
+	dispatched := next("web1")
+	require.NotNil(t, dispatched)
+	assert.Equal(t, &fleetOperation{ID: op.ID, Action: "restart", Unit: "a.service"}, dispatched)
+	assert.Nil(t, next("web2"), "one agent at a time")
+
+	complete := func(host string) error {
+		return callAgent(handler, host, "ReportOperationResult", &operationResultRequest{ID: op.ID, Result: &operationResult{OK: true}}, &grpcEmpty{})
+	}
+	err := complete("web2")
+	require.IsType(t, &grpcError{}, err)
+	assert.Equal(t, grpcFailedPrecondition, err.(*grpcError).Code)
+	require.NoError(t, complete("web1"))
+	assert.NotNil(t, next("web2"))
+
+	w = agent("GET", "/v1/operations/"+op.ID, "admin")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(op))
+	assert.True(t, op.Results["web1"].OK)
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/v1/operations/100", "admin").Code)
+	assert.Equal(t, http.StatusUnauthorized, agent("GET", "/v1/operations", "").Code)
+}
+
+func TestFleetAgentRunOperation(t *testing.T) {
+	sum := sha256.Sum256([]byte("ops-token"))
+	s := &fleetServer{Dir: t.TempDir(), OpsToken: hex.EncodeToString(sum[:])}
+	s.reports = map[string]*reconciler.HostReport{"web1": {Host: "web1"}}
+	handler := s.Handler()
+	server := newAgentServer(handler, "web1")
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("a"), 0644))
+	sysd := &fakeSystemd{}
+	a := &fleetAgent{Server: server.URL, Dir: dir, Client: server.Client(), Systemd: sysd}
+	run := func(unit string) *operationResult {
+		op := &fleetOperation{Action: "restart", Unit: unit, Hosts: []string{"web1"}}
+		require.NoError(t, s.createOperation(op, time.Now()))
+		require.NoError(t, a.runOperation(context.Background()))
+		return op.Results["web1"]
+	}
+
+	require.NoError(t, a.runOperation(context.Background()), "nothing to do")
+	assert.True(t, run("a.service").OK)
+	assert.Equal(t, `unit "b.service" isn't assigned to this agent`, run("b.service").Error)
+	sysd.fail = true
+	assert.False(t, run("a.service").OK)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// Agents talk to the fleet server over gRPC: they call the unary methods of the unitmgr.fleet.v1.Fleet service over
+// HTTP/2 with mutual TLS, and are identified by the common name of their client certificate. Messages use gRPC's json
+// codec (application/grpc+json) rather than protobuf, so the service is served by net/http without generated code,
+// and other gRPC clients need a json codec for the message types below, e.g. with grpc-go's grpc.ForceCodec.
+// Operators use the json endpoints of fleetServer.Handler instead.
+const (
+	fleetServicePath = "/unitmgr.fleet.v1.Fleet/"
+	grpcContentType  = "application/grpc+json"
+	grpcMaxMessage   = 16 << 20 // assignments carry the content of every unit file of the agent
+)
+
+// gRPC status codes used by the fleet service and its client.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is a gRPC status other than OK.
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.Code, e.Message)
+}
+
+// Messages of the fleet service, besides reconciler.HostReport, which agents send to ReportStatus.
+type (
+	assignmentRequest struct {
+		Base string `json:"base,omitempty"` // revision of the agent's current assignment
+	}
+	assignmentResponse struct {
+		Assignment  *fleetAssignment `json:"assignment,omitempty"` // only the changes since the request's base if its Base is set, see fleetDelta
+		Revision    string           `json:"revision,omitempty"`
+		NotModified bool             `json:"notModified,omitempty"` // the agent keeps its current assignment
+	}
+	operationResponse struct {
+		Operation *fleetOperation `json:"operation,omitempty"` // nil when the agent has nothing to run
+	}
+	operationResultRequest struct {
+		ID     string           `json:"id"`
+		Result *operationResult `json:"result"`
+	}
+	grpcEmpty struct{}
+)
+
+// handleGRPC serves the methods of the fleet service:
+//
+//	GetAssignment(assignmentRequest) assignmentResponse           returns the calling agent's assignment
+//	ReportStatus(reconciler.HostReport) grpcEmpty                 records the result of the calling agent's last sync
+//	NextOperation(grpcEmpty) operationResponse                    returns the fleet operation the calling agent should run, if any
+//	ReportOperationResult(operationResultRequest) grpcEmpty       records the calling agent's result of an operation
+func (s *fleetServer) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if mediaType != "application/grpc" && !strings.HasPrefix(mediaType, "application/grpc+") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	ctx, cancel, err := grpcContext(r)
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+	defer cancel()
+	host, ok := agentName(r)
+	switch {
+	case mediaType != grpcContentType:
+		err = &grpcError{Code: grpcUnimplemented, Message: "the fleet service only supports the json codec (" + grpcContentType + ")"}
+	case r.Header.Get("TE") != "trailers":
+		err = &grpcError{Code: grpcInvalidArgument, Message: `requests must send "TE: trailers"`}
+	case !ok:
+		err = &grpcError{Code: grpcUnauthenticated, Message: "client certificate required"}
+	}
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+
+	resp, err := s.callGRPC(ctx, host, strings.TrimPrefix(r.URL.Path, fleetServicePath), r.Body)
+	if err == nil {
+		err = contextStatus(ctx) // the response would be discarded
+	}
+	if err == nil {
+		err = writeGRPCMessage(w, resp)
+	}
+	writeGRPCStatus(w, err)
+}
+
+// grpcContext returns the context of the request, with the deadline of its grpc-timeout header if it has one.
+func grpcContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := r.Header.Get("Grpc-Timeout")
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	d, err := parseGRPCTimeout(timeout)
+	if err != nil {
+		return nil, nil, &grpcError{Code: grpcInvalidArgument, Message: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	return ctx, cancel, nil
+}
+
+// grpcTimeoutUnits are the units of grpc-timeout headers.
+var grpcTimeoutUnits = map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header: up to 8 digits followed by a unit.
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	if max := uint64(math.MaxInt64 / unit); n > max {
+		n = max
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// formatGRPCTimeout returns the grpc-timeout header for the duration, rounded up to what the header can express.
+func formatGRPCTimeout(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"n", time.Nanosecond}, {"u", time.Microsecond}, {"m", time.Millisecond}, {"S", time.Second}, {"M", time.Minute}} {
+		if n := (d + unit.d - 1) / unit.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64((d+time.Hour-1)/time.Hour), 10) + "H"
+}
+
+// contextStatus returns the status of a call whose context is done, or nil.
+func contextStatus(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return &grpcError{Code: grpcDeadlineExceeded, Message: "deadline exceeded"}
+	default:
+		return &grpcError{Code: grpcCanceled, Message: "canceled"}
+	}
+}
+
+// callGRPC runs a method of the fleet service for the agent and returns its response.
+// Methods don't run once the context is done.
+func (s *fleetServer) callGRPC(ctx context.Context, host, method string, body io.Reader) (interface{}, error) {
+	decode := func(v interface{}) error {
+		if err := readGRPCMessage(body, v); err != nil {
+			return &grpcError{Code: grpcInvalidArgument, Message: err.Error()}
+		}
+		return contextStatus(ctx)
+	}
+
+	switch method {
+	case "GetAssignment":
+		req := &assignmentRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return s.getAssignment(host, req.Base)
+
+	case "ReportStatus":
+		report := &reconciler.HostReport{}
+		if err := decode(report); err != nil {
+			return nil, err
+		}
+		s.reportStatus(host, report)
+		return &grpcEmpty{}, nil
+
+	case "NextOperation":
+		if err := decode(&grpcEmpty{}); err != nil {
+			return nil, err
+		}
+		return &operationResponse{Operation: s.takeOperation(host)}, nil
+
+	case "ReportOperationResult":
+		req := &operationResultRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		if req.Result == nil {
+			return nil, &grpcError{Code: grpcInvalidArgument, Message: "missing result"}
+		}
+		if err := s.completeOperation(host, req.ID, req.Result); err != nil {
+			return nil, &grpcError{Code: grpcFailedPrecondition, Message: err.Error()}
+		}
+		return &grpcEmpty{}, nil
+
+	default:
+		return nil, &grpcError{Code: grpcUnimplemented, Message: fmt.Sprintf("unknown method %q", method)}
+	}
+}
+
+// invokeGRPC calls a method of the fleet service on the server and decodes its response into resp.
+func invokeGRPC(ctx context.Context, client *http.Client, server, method string, req, resp interface{}) error {
+	body := &bytes.Buffer{}
+	if err := writeGRPCMessage(body, req); err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+fleetServicePath+method, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", grpcContentType)
+	r.Header.Set("TE", "trailers")
+	deadline, ok := ctx.Deadline()
+	if client.Timeout > 0 && (!ok || time.Until(deadline) > client.Timeout) {
+		deadline, ok = time.Now().Add(client.Timeout), true
+	}
+	if ok {
+		r.Header.Set("Grpc-Timeout", formatGRPCTimeout(time.Until(deadline)))
+	}
+
+	res, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &grpcError{Code: httpStatusCode(res.StatusCode), Message: fmt.Sprintf("unexpected HTTP status %d", res.StatusCode)}
+	}
+
+	// The status is in the trailers, which are only available once the body has been read
+	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, grpcMaxMessage+6))
+	if err != nil {
+		return err
+	}
+	if err := grpcStatus(res); err != nil {
+		return err
+	}
+	return readGRPCMessage(bytes.NewReader(msg), resp)
+}
+
+// httpStatusCode maps the HTTP status of a response without a gRPC status to a gRPC status code, like gRPC clients do.
+func httpStatusCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// grpcStatus returns the error of a response's gRPC status, or nil if it's OK.
+func grpcStatus(res *http.Response) error {
+	status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message") // trailers-only responses
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return errors.New("the response has no grpc-status")
+	}
+	if code == grpcOK {
+		return nil
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return &grpcError{Code: code, Message: message}
+}
+
+// writeGRPCStatus writes the status of the error as the trailers of the response: OK if it's nil, INTERNAL for
+// errors other than grpcError.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		code, message = gerr.Code, gerr.Message
+	case err != nil:
+		log.Printf("error while serving fleet agent: %s", err)
+		code, message = grpcInternal, "internal error"
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// writeGRPCMessage writes the json encoding of v as a length-prefixed gRPC message.
+func writeGRPCMessage(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 5, 5+len(buf)) // uncompressed flag and length
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(buf)))
+	_, err = w.Write(append(msg, buf...))
+	return err
+}
+
+// readGRPCMessage decodes a length-prefixed gRPC message into v. Compression isn't negotiated, so compressed
+// messages are rejected.
+func readGRPCMessage(r io.Reader, v interface{}) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+	if prefix[0] != 0 {
+		return errors.New("compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d", size, grpcMaxMessage)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("decoding message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// inventoryColumns are the header of the csv export, in the order of inventoryItem's fields.
+var inventoryColumns = []string{"host", "unit", "checksum", "assigned_checksum", "state", "drift", "failure", "last_sync", "generation"}
+
+// inventoryItem is one unit on one host, as of the host's latest report.
+type inventoryItem struct {
+	Host       string    `json:"host"`
+	Unit       string    `json:"unit"`
+	Checksum   string    `json:"checksum,omitempty"`         // of the applied unit file, empty if the unit isn't applied
+	Assigned   string    `json:"assignedChecksum,omitempty"` // of the assigned configuration, empty if the unit isn't assigned
+	State      string    `json:"state,omitempty"`
+	Drift      string    `json:"drift,omitempty"` // see dashboardRows
+	Failure    string    `json:"failure,omitempty"`
+	LastSync   time.Time `json:"lastSync"`
+	Generation int64     `json:"generation,omitempty"`
+}
+
+// inventoryFilter selects inventory items, its zero value selects every item.
+type inventoryFilter struct {
+	Host, Unit string
+	Drifted    bool
+	Failing    bool
+}
+
+func (f *inventoryFilter) Match(item *inventoryItem) bool {
+	return (f.Host == "" || f.Host == item.Host) && (f.Unit == "" || f.Unit == item.Unit) &&
+		(!f.Drifted || item.Drift != "") && (!f.Failing || item.Failure != "")
+}
+
+// inventory returns every unit reported or assigned to every agent, sorted by host and unit.
+func (s *fleetServer) inventory(filter *inventoryFilter) []*inventoryItem {
+	s.mu.Lock()
+	reports := make([]*reconciler.HostReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+	served := make(map[string]*fleetAssignment, len(s.served))
+	for host, assignment := range s.served {
+		served[host] = assignment
+	}
+	s.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Host < reports[j].Host })
+
+	items := []*inventoryItem{}
+	for _, report := range reports {
+		assigned := map[string]string{}
+		if assignment := served[report.Host]; assignment != nil {
+			for _, unit := range assignment.Units {
+				assigned[unit.Name] = unit.Checksum()
+			}
+		}
+		for _, row := range dashboardRows(report, served[report.Host]) {
+			checksum, _ := report.Applied(row.Name)
+			item := &inventoryItem{
+				Host:       report.Host,
+				Unit:       row.Name,
+				Checksum:   checksum,
+				Assigned:   assigned[row.Name],
+				State:      row.State,
+				Drift:      row.Drift,
+				Failure:    row.Failure,
+				LastSync:   report.LastSync,
+				Generation: report.Generation,
+			}
+			if filter.Match(item) {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// handleInventory serves /v1/inventory as json, or as csv with format=csv. The host and unit query parameters
+// select a single host or unit, and drifted=true and failing=true only the units that are.
+func (s *fleetServer) handleInventory(w http.ResponseWriter, r *http.Request) {
+	if !s.operator(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := &inventoryFilter{Host: query.Get("host"), Unit: query.Get("unit")}
+	filter.Drifted, _ = strconv.ParseBool(query.Get("drifted"))
+	filter.Failing, _ = strconv.ParseBool(query.Get("failing"))
+	items := s.inventory(filter)
+
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+		writeInventoryCSV(w, items)
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+func writeInventoryCSV(w io.Writer, items []*inventoryItem) {
+	out := csv.NewWriter(w)
+	out.Write(inventoryColumns)
+	for _, item := range items {
+		var generation string
+		if item.Generation != 0 {
+			generation = strconv.FormatInt(item.Generation, 10)
+		}
+		out.Write([]string{item.Host, item.Unit, item.Checksum, item.Assigned, item.State, item.Drift, item.Failure, item.LastSync.UTC().Format(time.RFC3339), generation})
+	}
+	out.Flush()
+}
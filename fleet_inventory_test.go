@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetInventory(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "b.service"), []byte("b"), 0644))
+
+	s := &fleetServer{Dir: dir, OpsToken: sha256Hex([]byte("ops-token"))}
+	handler := s.Handler()
+	assignment, err := s.assignment("host1")
+	require.NoError(t, err)
+	s.admit("host1", assignment, "")
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.reports = map[string]*reconciler.HostReport{
+		"host1": {
+			Host:       "host1",
+			Units:      map[string]string{"a.service": assignment.Units[0].Checksum(), "b.service": "old"},
+			Failures:   map[string]string{"b.service": "oops, failed"},
+			LastSync:   now,
+			Generation: 3,
+			States:     map[string]*reconciler.UnitStatus{"a.service": {State: reconciler.StateHealthy}},
+		},
+		"host2": {Host: "host2", Units: map[string]string{"c.service": "sum"}, LastSync: now},
+	}
+
+	request := func(url string) *httptest.ResponseRecorder {
+		req := withClientCert(httptest.NewRequest("GET", url, nil), "admin")
+		req.Header.Set("Authorization", "Bearer ops-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("json", func(t *testing.T) {
+		w := request("/v1/inventory")
+		require.Equal(t, http.StatusOK, w.Code)
+		var items []*inventoryItem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&items))
+		require.Len(t, items, 3)
+		assert.Equal(t, &inventoryItem{Host: "host1", Unit: "a.service", Checksum: assignment.Units[0].Checksum(), Assigned: assignment.Units[0].Checksum(), State: "Healthy", LastSync: now, Generation: 3}, items[0])
+		assert.Equal(t, "assignment not applied", items[1].Drift)
+		assert.Equal(t, &inventoryItem{Host: "host2", Unit: "c.service", Checksum: "sum", LastSync: now}, items[2])
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		var items []*inventoryItem
+		require.NoError(t, json.NewDecoder(request("/v1/inventory?failing=true").Body).Decode(&items))
+		require.Len(t, items, 1)
+		assert.Equal(t, "b.service", items[0].Unit)
+
+		items = nil
+		require.NoError(t, json.NewDecoder(request("/v1/inventory?host=host2&drifted=true").Body).Decode(&items))
+		assert.Empty(t, items)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := request("/v1/inventory?format=csv&unit=b.service")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+		assert.Equal(t, "host,unit,checksum,assigned_checksum,state,drift,failure,last_sync,generation\n"+
+			"host1,b.service,old,"+assignment.Units[1].Checksum()+",,assignment not applied,\"oops, failed\",2026-01-02T03:04:05Z,3\n", w.Body.String())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, request("/v1/inventory?format=xml").Code)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/inventory", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, withClientCert(httptest.NewRequest("GET", "/v1/inventory", nil), "host1"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "agent certificates can't read other agents' units")
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// maxNamespaceUnitSize limits the unit files written through the namespace API.
+const maxNamespaceUnitSize = 1 << 20
+
+// fleetNamespace is a subtree of the fleet server's Dir owned by one team.
+//
+// Units in Dir/namespaces/<name> are assigned to every agent, and units in Dir/namespaces/<name>/hosts/<host>
+// only to that agent. Their names must start with "<name>-", so namespaces never collide with each other,
+// and they never replace units of the same name outside the namespace.
+type fleetNamespace struct {
+	Name        string `json:"name"`
+	TokenSHA256 string `json:"tokenSHA256"` // hex sha256 of the bearer token allowed to alter the namespace
+	Policy      string `json:"policy"`      // optional, path to the policy the namespace's units must satisfy
+
+	policy *reconciler.Policy
+}
+
+// loadNamespaces reads a json file of namespaces, e.g. {"namespaces": [{"name": "web", "tokenSHA256": "..."}]}.
+func loadNamespaces(name string) (map[string]*fleetNamespace, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &struct {
+		Namespaces []*fleetNamespace `json:"namespaces"`
+	}{}
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("decoding namespaces: %w", err)
+	}
+
+	namespaces := map[string]*fleetNamespace{}
+	for _, ns := range config.Namespaces {
+		if !validUnitName(ns.Name) {
+			return nil, fmt.Errorf("invalid namespace name %q", ns.Name)
+		}
+		if namespaces[ns.Name] != nil {
+			return nil, fmt.Errorf("namespace %q is defined more than once", ns.Name)
+		}
+		if sum, err := hex.DecodeString(ns.TokenSHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("namespace %q must set tokenSHA256 to a hex sha256 digest", ns.Name)
+		}
+		if ns.Policy != "" {
+			if ns.policy, err = reconciler.LoadPolicy(ns.Policy); err != nil {
+				return nil, fmt.Errorf("loading policy of namespace %q: %w", ns.Name, err)
+			}
+		}
+		namespaces[ns.Name] = ns
+	}
+	// Units belong to a namespace by their name's prefix, so e.g. namespace "web" could shadow the units of "web-api"
+	for name := range namespaces {
+		for other := range namespaces {
+			if strings.HasPrefix(other, name+"-") {
+				return nil, fmt.Errorf("namespace %q can't be a prefix of namespace %q", name, other)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// Authorized returns true if the request carries the namespace's bearer token.
+func (n *fleetNamespace) Authorized(r *http.Request) bool {
+	return bearerAuthorized(r, n.TokenSHA256)
+}
+
+// bearerAuthorized returns true if the request carries a bearer token with the given hex sha256.
+func bearerAuthorized(r *http.Request, tokenSHA256 string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") || tokenSHA256 == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(tokenSHA256))) == 1
+}
+
+// Check returns an error if the unit file doesn't belong in the namespace or violates its policy.
+//
+// Units can't declare aliases, since agents link them by names outside of the namespace.
+func (n *fleetNamespace) Check(unit string, content []byte) error {
+	if !validUnitName(unit) || !strings.HasPrefix(unit, n.Name+"-") {
+		return fmt.Errorf("unit names in namespace %q must start with %q", n.Name, n.Name+"-")
+	}
+	parsed, err := reconciler.ParseUnitFile(bytes.NewReader(content))
+	if err != nil { // agents would apply it regardless, without the checks below
+		return fmt.Errorf("unable to parse: %w", err)
+	}
+	if len(parsed.Values("Install", "Alias")) > 0 {
+		return fmt.Errorf("units in namespace %q can't declare Alias=", n.Name)
+	}
+	if n.policy == nil {
+		return nil
+	}
+	var violations []string
+	for _, v := range n.policy.Evaluate(unit, parsed) {
+		violations = append(violations, v.String())
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("policy violation %s", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// dir returns the directory of the namespace's units, for every agent or the given host.
+func (n *fleetNamespace) dir(root, host string) string {
+	if host == "" {
+		return path.Join(root, "namespaces", n.Name)
+	}
+	return path.Join(root, "namespaces", n.Name, "hosts", host)
+}
+
+// namespaceUnits returns the units assigned to the host by every namespace, skipping units that don't pass the
+// namespace's checks or are already assigned from outside the namespace.
+func (s *fleetServer) namespaceUnits(host string, ignore *reconciler.IgnoreRules, units map[string][]byte) error {
+	names := make([]string, 0, len(s.Namespaces))
+	for name := range s.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := s.Namespaces[name]
+		owned := map[string][]byte{}
+		if err := readUnits(s.Dir, ns.dir(s.Dir, ""), ignore, owned); err != nil {
+			return err
+		}
+		if err := readUnits(s.Dir, ns.dir(s.Dir, host), ignore, owned); err != nil {
+			return err
+		}
+		for unit, content := range owned {
+			if err := ns.Check(unit, content); err != nil {
+				log.Printf("not assigning unit %q of namespace %q to agent %q: %s", unit, name, host, err)
+				continue
+			}
+			if _, ok := units[unit]; ok {
+				log.Printf("not assigning unit %q of namespace %q to agent %q: it's already assigned outside of the namespace", unit, name, host)
+				continue
+			}
+			units[unit] = content
+		}
+	}
+	return nil
+}
+
+// handleNamespace serves /v1/namespaces/<name>/units[/<unit>], listing, writing, and removing the namespace's units.
+// The host query parameter selects the units of a single agent instead of those assigned to every agent.
+func (s *fleetServer) handleNamespace(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/namespaces/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "units" {
+		http.NotFound(w, r)
+		return
+	}
+	ns, ok := s.Namespaces[parts[0]]
+	if !ok || !ns.Authorized(r) {
+		http.Error(w, "invalid namespace token", http.StatusUnauthorized)
+		return
+	}
+	host := r.URL.Query().Get("host")
+	if host != "" && !validUnitName(host) {
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return
+	}
+	dir := ns.dir(s.Dir, host)
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		units := map[string][]byte{}
+		if err := readUnits(s.Dir, dir, nil, units); err != nil {
+			log.Printf("error while listing units of namespace %q: %s", ns.Name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newAssignment(units))
+		return
+	}
+
+	unit := parts[2]
+	switch r.Method {
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxNamespaceUnitSize))
+		if err != nil {
+			http.Error(w, "unit file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := ns.Check(unit, content); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := os.MkdirAll(dir, 0755); err == nil {
+			err = reconciler.WriteFileAtomic(path.Join(dir, unit), content)
+		}
+		if err != nil {
+			log.Printf("error while writing unit %q of namespace %q: %s", unit, ns.Name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("namespace %q wrote unit %q", ns.Name, path.Join(strings.TrimPrefix(dir, path.Clean(s.Dir)+"/"), unit))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !validUnitName(unit) {
+			http.NotFound(w, r)
+			return
+		}
+		err := os.Remove(path.Join(dir, unit))
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("error while removing unit %q of namespace %q: %s", unit, ns.Name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("namespace %q removed unit %q", ns.Name, path.Join(strings.TrimPrefix(dir, path.Clean(s.Dir)+"/"), unit))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha256.Sum256([]byte("web-token"))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "policy.json"), []byte(`{"rules": [{"section": "Service", "key": "User", "require": true}]}`), 0644))
+
+	write := func(content string) (map[string]*fleetNamespace, error) {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, "namespaces.json"), []byte(content), 0644))
+		return loadNamespaces(path.Join(dir, "namespaces.json"))
+	}
+
+	namespaces, err := write(`{"namespaces": [{"name": "web", "tokenSHA256": "` + hex.EncodeToString(sum[:]) + `", "policy": "` + path.Join(dir, "policy.json") + `"}]}`)
+	require.NoError(t, err)
+	require.NotNil(t, namespaces["web"].policy)
+
+	_, err = write(`{"namespaces": [{"name": "web", "tokenSHA256": "secret"}]}`)
+	assert.Error(t, err)
+
+	_, err = write(`{"namespaces": [{"name": "../web", "tokenSHA256": "` + hex.EncodeToString(sum[:]) + `"}]}`)
+	assert.Error(t, err)
+
+	// web could otherwise write web-api-*.service units
+	_, err = write(`{"namespaces": [{"name": "web-api", "tokenSHA256": "` + hex.EncodeToString(sum[:]) + `"}, {"name": "web", "tokenSHA256": "` + hex.EncodeToString(sum[:]) + `"}]}`)
+	assert.EqualError(t, err, `namespace "web" can't be a prefix of namespace "web-api"`)
+}
+
+func TestFleetServerNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "namespaces", "web"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "web-admin.service"), []byte("admin"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "namespaces", "web", "web-admin.service"), []byte("team"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "namespaces", "web", "db.service"), []byte("stray"), 0644))
+	policy := path.Join(t.TempDir(), "policy.json")
+	require.NoError(t, ioutil.WriteFile(policy, []byte(`{"rules": [{"section": "Service", "key": "User", "require": true}]}`), 0644))
+
+	token := func(name string) string {
+		sum := sha256.Sum256([]byte(name + "-token"))
+		return hex.EncodeToString(sum[:])
+	}
+	s := &fleetServer{Dir: dir, Namespaces: map[string]*fleetNamespace{
+		"web": {Name: "web", TokenSHA256: token("web")},
+		"db":  {Name: "db", TokenSHA256: token("db")},
+	}}
+	var err error
+	s.Namespaces["db"].policy, err = reconciler.LoadPolicy(policy)
+	require.NoError(t, err)
+	handler := s.Handler()
+
+	request := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request("PUT", "/v1/namespaces/web/units/web-api.service", "", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, request("PUT", "/v1/namespaces/web/units/web-api.service", "db-token", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, request("GET", "/v1/namespaces/other/units", "web-token", "").Code)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, request("PUT", "/v1/namespaces/web/units/web-api.service", "web-token", "[Service]\nExecStart=/bin/api\n").Code)
+		assert.Equal(t, http.StatusNoContent, request("PUT", "/v1/namespaces/web/units/web-api.service?host=host1", "web-token", "[Service]\nExecStart=/bin/api -host1\n").Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, request("PUT", "/v1/namespaces/web/units/db-api.service", "web-token", "[Service]\nExecStart=/bin/api\n").Code)
+		assert.Equal(t, http.StatusBadRequest, request("PUT", "/v1/namespaces/web/units/web-api.service?host=..", "web-token", "[Service]\nExecStart=/bin/api\n").Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, request("PUT", "/v1/namespaces/web/units/web-ssh.service", "web-token", "[Install]\nAlias=sshd.service\n").Code)
+
+		// Unparseable units are rejected without a policy too, since agents would apply them
+		w := request("PUT", "/v1/namespaces/web/units/web-broken.service", "web-token", "Alias=sshd.service\n[Install\n")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "unable to parse")
+		assert.NoFileExists(t, path.Join(dir, "namespaces", "web", "web-broken.service"))
+
+		content, err := ioutil.ReadFile(path.Join(dir, "namespaces", "web", "hosts", "host1", "web-api.service"))
+		require.NoError(t, err)
+		assert.Equal(t, "[Service]\nExecStart=/bin/api -host1\n", string(content))
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		w := request("PUT", "/v1/namespaces/db/units/db-main.service", "db-token", "[Service]\nExecStart=/bin/db\n")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "User= must be set")
+
+		assert.Equal(t, http.StatusNoContent, request("PUT", "/v1/namespaces/db/units/db-main.service", "db-token", "[Service]\nUser=db\n").Code)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := request("GET", "/v1/namespaces/web/units", "web-token", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assignment := &fleetAssignment{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(assignment))
+		assert.Len(t, assignment.Units, 3)
+	})
+
+	t.Run("assignment", func(t *testing.T) {
+		assignment, err := s.assignment("host1")
+		require.NoError(t, err)
+		assert.Equal(t, []*fleetUnit{
+			{Name: "db-main.service", Content: []byte("[Service]\nUser=db\n")},
+			{Name: "web-admin.service", Content: []byte("admin")}, // namespaces can't replace units outside of them
+			{Name: "web-api.service", Content: []byte("[Service]\nExecStart=/bin/api -host1\n")},
+		}, assignment.Units)
+
+		assignment, err = s.assignment("host2")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("[Service]\nExecStart=/bin/api\n"), assignment.Units[2].Content)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, request("DELETE", "/v1/namespaces/web/units/web-api.service", "web-token", "").Code)
+		assert.Equal(t, http.StatusNotFound, request("DELETE", "/v1/namespaces/web/units/web-api.service", "web-token", "").Code)
+	})
+}
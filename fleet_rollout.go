@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// rollout limits how many agents may be updating to a new assignment at the same time.
+//
+// Agents are given their new assignment until Percent of the known agents are waiting to report back healthy.
+// An agent is healthy once it reports a successful sync that applied every unit it was assigned.
+// If an updating agent reports a failure of its new assignment, or doesn't become healthy within Timeout, the rollout halts
+// and agents that haven't been updated keep their previous assignment until the rollout is resumed.
+type rollout struct {
+	Percent int
+	Timeout time.Duration
+
+	pending map[string]*pendingUpdate // host -> update waiting for a healthy report
+	halted  string                    // reason the rollout was halted
+}
+
+type pendingUpdate struct {
+	Assignment *fleetAssignment
+	Since      time.Time // by the server's clock, reports are matched by content since agents' clocks may be skewed
+}
+
+// rolloutStatus is the externally visible state of a rollout.
+type rolloutStatus struct {
+	Percent int      `json:"percent"`
+	Pending []string `json:"pending"`
+	Halted  string   `json:"halted,omitempty"`
+}
+
+// Admit returns true when the host may be updated to the given assignment.
+func (r *rollout) Admit(host string, assignment *fleetAssignment, known int, now time.Time) bool {
+	if r.pending == nil {
+		r.pending = map[string]*pendingUpdate{}
+	}
+	r.checkTimeouts(now)
+	if r.halted != "" {
+		return false
+	}
+
+	if p, ok := r.pending[host]; ok {
+		if p.Assignment.Revision() != assignment.Revision() {
+			r.pending[host] = &pendingUpdate{Assignment: assignment, Since: now}
+		}
+		return true // already part of the rollout
+	}
+
+	size := known * r.Percent / 100
+	if size < 1 {
+		size = 1
+	}
+	if len(r.pending) >= size {
+		return false
+	}
+
+	r.pending[host] = &pendingUpdate{Assignment: assignment, Since: now}
+	return true
+}
+
+// Observe updates the rollout with a status report from an agent. Failures only count once the agent reports
+// having the new assignment, and the agent is healthy once it reports the checksums of the new units as applied.
+func (r *rollout) Observe(report *reconciler.HostReport, now time.Time) {
+	p, ok := r.pending[report.Host]
+	if !ok {
+		return
+	}
+
+	if !report.OK {
+		if report.Assignment == p.Assignment.Revision() {
+			r.halted = fmt.Sprintf("agent %q failed to sync after being updated", report.Host)
+		}
+		return // otherwise the failure predates the update
+	}
+	for _, unit := range p.Assignment.Units {
+		if applied, _ := report.Applied(unit.Name); applied != unit.Checksum() {
+			return // not applied yet
+		}
+	}
+	delete(r.pending, report.Host)
+}
+
+func (r *rollout) Resume() {
+	r.halted = ""
+	r.pending = nil
+}
+
+func (r *rollout) Status() *rolloutStatus {
+	status := &rolloutStatus{Percent: r.Percent, Pending: []string{}, Halted: r.halted}
+	for host := range r.pending {
+		status.Pending = append(status.Pending, host)
+	}
+	return status
+}
+
+func (r *rollout) checkTimeouts(now time.Time) {
+	if r.Timeout <= 0 || r.halted != "" {
+		return
+	}
+	for host, p := range r.pending {
+		if now.Sub(p.Since) > r.Timeout {
+			r.halted = fmt.Sprintf("agent %q did not become healthy within %s", host, r.Timeout)
+			return
+		}
+	}
+}
+
+// Revision uniquely identifies the content of an assignment.
+func (a *fleetAssignment) Revision() string {
+	h := sha256.New()
+	for _, unit := range a.Units {
+		fmt.Fprintf(h, "%s\x00%s\x00", unit.Name, unit.Checksum())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (u *fleetUnit) Checksum() string {
+	sum := sha256.Sum256(u.Content)
+	return hex.EncodeToString(sum[:])
+}
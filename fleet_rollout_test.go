@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollout(t *testing.T) {
+	now := time.Now()
+	r := &rollout{Percent: 50, Timeout: time.Minute}
+	v2 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("v2")}}}
+
+	// Only half of the four agents may update at once
+	assert.True(t, r.Admit("host1", v2, 4, now))
+	assert.True(t, r.Admit("host2", v2, 4, now))
+	assert.False(t, r.Admit("host3", v2, 4, now))
+	assert.True(t, r.Admit("host1", v2, 4, now), "pending agents keep their update")
+
+	// Failures of the previous assignment are ignored, even if the agent's clock is ahead
+	r.Observe(&reconciler.HostReport{Host: "host1", OK: false, LastSync: now.Add(time.Hour), Assignment: "v1"}, now)
+	assert.Empty(t, r.Status().Halted)
+
+	// Reports that haven't applied the update yet don't count as healthy
+	r.Observe(&reconciler.HostReport{Host: "host1", OK: true, LastSync: now.Add(time.Hour), Units: map[string]string{"test.service": "v1"}}, now)
+	assert.Len(t, r.Status().Pending, 2)
+
+	// A healthy report frees up a slot, even if the agent's clock is behind
+	r.Observe(&reconciler.HostReport{Host: "host1", OK: true, LastSync: now.Add(-time.Hour), Units: map[string]string{"test.service": v2.Units[0].Checksum()}}, now)
+	assert.True(t, r.Admit("host3", v2, 4, now))
+	assert.False(t, r.Admit("host4", v2, 4, now))
+
+	// A failed report halts the rollout
+	r.Observe(&reconciler.HostReport{Host: "host2", OK: false, LastSync: now.Add(-time.Hour), Assignment: v2.Revision()}, now)
+	assert.Contains(t, r.Status().Halted, `agent "host2" failed to sync`)
+	assert.False(t, r.Admit("host4", v2, 4, now))
+
+	r.Resume()
+	assert.True(t, r.Admit("host4", v2, 4, now))
+
+	// Agents that don't become healthy in time halt the rollout
+	assert.False(t, r.Admit("host5", v2, 4, now.Add(time.Minute*2)))
+	assert.Contains(t, r.Status().Halted, `agent "host4" did not become healthy`)
+}
+
+func TestRolloutNormalizingAgent(t *testing.T) {
+	now := time.Now()
+	r := &rollout{Percent: 100, Timeout: time.Minute}
+	v2 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("# v2\n[Service]\nExecStart=/bin/test\n")}}}
+	assert.True(t, r.Admit("host1", v2, 1, now))
+
+	// The agent reports normalized checksums for its applied configuration, and the checksums of the files themselves
+	src := t.TempDir()
+	agent := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}, Normalize: true}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), v2.Units[0].Content, 0644))
+	require.True(t, agent.Sync(context.Background()))
+	report := agent.Report(true)
+	report.Host = "host1"
+	assert.NotEqual(t, v2.Units[0].Checksum(), report.Units["test.service"])
+
+	r.Observe(report, now)
+	assert.Empty(t, r.Status().Pending)
+
+	// Changes that normalize to the same configuration are observed too
+	v3 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("# v3\n[Service]\nExecStart=/bin/test\n")}}}
+	assert.True(t, r.Admit("host1", v3, 1, now))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), v3.Units[0].Content, 0644))
+	require.True(t, agent.Sync(context.Background()))
+	report = agent.Report(true)
+	report.Host = "host1"
+	r.Observe(report, now)
+	assert.Empty(t, r.Status().Pending)
+}
+
+func TestRolloutConvertingAgent(t *testing.T) {
+	for _, agent := range []*reconciler.Reconciler{{Sanitize: true}, {Portable: true}} {
+		now := time.Now()
+		r := &rollout{Percent: 100, Timeout: time.Minute}
+		v2 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("[Service]\r\nExecStart=/bin/test\r\n")}}}
+		assert.True(t, r.Admit("host1", v2, 1, now))
+
+		// The agent reports checksums of the converted files for its applied configuration, and the checksums of the files themselves
+		src := t.TempDir()
+		agent.Src, agent.Dest, agent.State, agent.Systemd = src, t.TempDir(), map[string]string{}, &fakeSystemd{}
+		require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), v2.Units[0].Content, 0644))
+		require.True(t, agent.Sync(context.Background()))
+		report := agent.Report(true)
+		report.Host = "host1"
+		assert.NotEqual(t, v2.Units[0].Checksum(), report.Units["test.service"])
+
+		r.Observe(report, now)
+		assert.Empty(t, r.Status().Pending)
+	}
+}
+
+func TestFleetServerRollout(t *testing.T) {
+	s := &fleetServer{Rollout: &rollout{Percent: 1, Timeout: time.Minute}}
+	v1 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("v1")}}}
+	v2 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("v2")}}}
+
+	// New agents receive their assignment immediately
+	assert.Equal(t, v1, s.admit("host1", v1, ""))
+	assert.Equal(t, v1, s.admit("host2", v1, ""))
+
+	// Only one agent is updated at a time
+	assert.Equal(t, v2, s.admit("host1", v2, v1.Revision()))
+	assert.Equal(t, v1, s.admit("host2", v2, v1.Revision()))
+
+	// Agents with an assignment the server didn't serve, e.g. since it restarted, are held back too
+	assert.Nil(t, s.admit("host3", v2, v1.Revision()))
+	assert.Equal(t, v2, s.admit("host4", v2, ""), "agents without an assignment have nothing to keep")
+}
+
+func TestFleetServerRolloutResume(t *testing.T) {
+	s := &fleetServer{Rollout: &rollout{Percent: 50, halted: "oops"}, OpsToken: sha256Hex([]byte("ops-token"))}
+	handler := s.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, withClientCert(httptest.NewRequest("POST", "/v1/rollout/resume", nil), "host1"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "agent certificates can't resume the rollout")
+	assert.Equal(t, "oops", s.Rollout.Status().Halted)
+
+	req := withClientCert(httptest.NewRequest("POST", "/v1/rollout/resume", nil), "admin")
+	req.Header.Set("Authorization", "Bearer ops-token")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, s.Rollout.Status().Halted)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// fleetServer serves unit assignments to agents and collects their status reports.
+//
+// Units in the top level of Dir are assigned to every agent.
+// Units in Dir/profiles/<profile> are assigned to the agents given the profile by Assignments, see fleetAssignments.
+// Units in Dir/hosts/<name> are only assigned to the agent whose client certificate has the common name <name>,
+// and take precedence over top level units of the same name.
+// Units in Dir/namespaces/<namespace> are managed by the teams owning the namespaces, see fleetNamespace.
+type fleetServer struct {
+	Dir        string
+	Rollout    *rollout                   // optional, update every agent at once when nil
+	Namespaces map[string]*fleetNamespace // optional, by name
+	Enroller   *enroller                  // optional, issues client certificates to agents with a bootstrap token
+	AssignPath string                     // optional, where assignments replaced through the api are written
+	OpsToken   string                     // optional, hex sha256 of the operator bearer token allowed to start operations, resume rollouts, and read every agent's units
+	StatePath  string                     // optional, where the served assignments and the rollout are persisted, see fleetState
+	Redact     *reconciler.Redactor       // optional, masks secrets in the unit diffs of the dashboard
+
+	mu           sync.Mutex
+	Assignments  *fleetAssignments // optional, assigns profiles to hosts, protected by mu
+	reports      map[string]*reconciler.HostReport
+	served       map[string]*fleetAssignment // host -> most recent assignment given to the agent
+	operations   []*fleetOperation           // oldest first
+	operationSeq int
+}
+
+func (s *fleetServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(fleetServicePath, s.handleGRPC)
+	mux.HandleFunc("/v1/agents", s.handleAgents)
+	mux.HandleFunc("/v1/inventory", s.handleInventory)
+	mux.HandleFunc("/v1/rollout", s.handleRollout)
+	mux.HandleFunc("/v1/rollout/resume", s.handleRolloutResume)
+	mux.HandleFunc("/v1/namespaces/", s.handleNamespace)
+	mux.HandleFunc("/ui", s.handleDashboard)
+	mux.HandleFunc("/v1/enroll", s.handleEnroll)
+	mux.HandleFunc("/v1/assignments", s.handleAssignments)
+	mux.HandleFunc("/v1/operations", s.handleOperations)
+	mux.HandleFunc("/v1/operations/", s.handleOperations)
+	return mux
+}
+
+// getAssignment serves GetAssignment: the agent's assignment, only the changes since base if the agent has the
+// previous one it was given.
+func (s *fleetServer) getAssignment(host, base string) (*assignmentResponse, error) {
+	assignment, err := s.assignment(host)
+	if err != nil {
+		log.Printf("error while building assignment for agent %q: %s", host, err)
+		return nil, &grpcError{Code: grpcInternal, Message: "internal error"}
+	}
+	s.mu.Lock()
+	previous := s.served[host]
+	s.mu.Unlock()
+	if assignment = s.admit(host, assignment, base); assignment == nil {
+		return &assignmentResponse{NotModified: true}, nil // the agent keeps the assignment it has until the rollout admits it
+	}
+
+	revision := assignment.Revision()
+	if base != "" {
+		switch {
+		case base == revision:
+			return &assignmentResponse{Revision: revision, NotModified: true}, nil
+		case previous != nil && base == previous.Revision():
+			assignment = fleetDelta(previous, assignment)
+		}
+	}
+	return &assignmentResponse{Assignment: assignment, Revision: revision}, nil
+}
+
+// reportStatus serves ReportStatus.
+func (s *fleetServer) reportStatus(host string, report *reconciler.HostReport) {
+	report.Host = host // trust the certificate, not the payload
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports == nil {
+		s.reports = map[string]*reconciler.HostReport{}
+	}
+	s.reports[host] = report
+	if s.Rollout != nil {
+		before := s.Rollout.Status()
+		s.Rollout.Observe(report, time.Now())
+		if after := s.Rollout.Status(); after.Halted != before.Halted || len(after.Pending) != len(before.Pending) {
+			s.saveState()
+		}
+	}
+}
+
+// operator returns true if the request carries a client certificate and the operator token, or responds with an
+// error. Every agent has a client certificate, so it alone doesn't allow reading other agents' units and reports.
+func (s *fleetServer) operator(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := agentName(r); !ok {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return false
+	}
+	if !bearerAuthorized(r, s.OpsToken) {
+		http.Error(w, "invalid operations token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *fleetServer) handleAgents(w http.ResponseWriter, r *http.Request) {
+	if !s.operator(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	reports := make([]*reconciler.HostReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+	s.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Host < reports[j].Host })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+func (s *fleetServer) handleRollout(w http.ResponseWriter, r *http.Request) {
+	if _, ok := agentName(r); !ok {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if s.Rollout == nil {
+		http.Error(w, "rollouts are not enabled", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	status := s.Rollout.Status()
+	s.mu.Unlock()
+	sort.Strings(status.Pending)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *fleetServer) handleRolloutResume(w http.ResponseWriter, r *http.Request) {
+	if !s.operator(w, r) { // agents can't resume a rollout they halted
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Rollout == nil {
+		http.Error(w, "rollouts are not enabled", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	s.Rollout.Resume()
+	s.saveState()
+	s.mu.Unlock()
+	log.Printf("rollout resumed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// admit returns the assignment the agent should receive, which may be its previous one if a rollout is holding it back.
+// Agents the server didn't serve yet, e.g. since it was restarted without StatePath, but that already have the current
+// revision of another assignment are updated by the rollout as well; admit returns nil while it holds them back.
+func (s *fleetServer) admit(host string, desired *fleetAssignment, current string) *fleetAssignment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.served == nil {
+		s.served = map[string]*fleetAssignment{}
+	}
+	previous, ok := s.served[host]
+	switch {
+	case ok && previous.Revision() == desired.Revision():
+		return desired
+	case s.Rollout != nil && (ok || (current != "" && current != desired.Revision())):
+		known := len(s.served)
+		if len(s.reports) > known {
+			known = len(s.reports) // agents held back since a restart only report
+		}
+		if !s.Rollout.Admit(host, desired, known, time.Now()) {
+			return previous
+		}
+		log.Printf("rolling out new assignment to agent %q", host)
+	}
+
+	s.served[host] = desired
+	s.saveState()
+	return desired
+}
+
+func (s *fleetServer) assignment(host string) (*fleetAssignment, error) {
+	ignore, err := reconciler.LoadIgnoreRules(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	units := map[string][]byte{}
+	if err := readUnits(s.Dir, s.Dir, ignore, units); err != nil {
+		return nil, err
+	}
+	if err := s.profileUnits(host, ignore, units); err != nil {
+		return nil, err
+	}
+	if err := readUnits(s.Dir, path.Join(s.Dir, "hosts", host), ignore, units); err != nil {
+		return nil, err
+	}
+	if err := s.namespaceUnits(host, ignore, units); err != nil {
+		return nil, err
+	}
+	return newAssignment(units), nil
+}
+
+// readUnits adds the unit files in dir to units, skipping those ignored by the rules of root.
+func readUnits(root, dir string, ignore *reconciler.IgnoreRules, units map[string][]byte) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, stat := range files {
+		if !stat.Mode().IsRegular() || !validUnitName(stat.Name()) {
+			continue
+		}
+		if rel := strings.TrimPrefix(path.Join(dir, stat.Name()), path.Clean(root)+"/"); ignore != nil && ignore.Ignored(rel, false) {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, stat.Name()))
+		if err != nil {
+			return err
+		}
+		units[stat.Name()] = content
+	}
+	return nil
+}
+
+// newAssignment returns an assignment of the units, sorted by name.
+func newAssignment(units map[string][]byte) *fleetAssignment {
+	assignment := &fleetAssignment{Units: []*fleetUnit{}}
+	for name, content := range units {
+		assignment.Units = append(assignment.Units, &fleetUnit{Name: name, Content: content})
+	}
+	sort.Slice(assignment.Units, func(i, j int) bool { return assignment.Units[i].Name < assignment.Units[j].Name })
+	return assignment
+}
+
+// agentName returns the common name of the verified client certificate.
+func agentName(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	name := r.TLS.PeerCertificates[0].Subject.CommonName
+	return name, validUnitName(name)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// fleetState is what a fleet server persists across restarts, so it doesn't hand agents that were held back by
+// a halted or incomplete rollout their new assignment just because it forgot what they were served.
+type fleetState struct {
+	Assignments map[string]*fleetAssignment `json:"assignments"` // by revision
+	Served      map[string]string           `json:"served"`      // host -> revision of the assignment it was served
+	Pending     map[string]*pendingState    `json:"pending,omitempty"`
+	Halted      string                      `json:"halted,omitempty"`
+}
+
+type pendingState struct {
+	Revision string    `json:"revision"`
+	Since    time.Time `json:"since"`
+}
+
+// loadState restores the served assignments and the rollout from StatePath, if it exists.
+func (s *fleetServer) loadState() error {
+	content, err := ioutil.ReadFile(s.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &fleetState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.served = map[string]*fleetAssignment{}
+	for host, revision := range state.Served {
+		if assignment, ok := state.Assignments[revision]; ok {
+			s.served[host] = assignment
+		}
+	}
+	if s.Rollout != nil {
+		s.Rollout.halted = state.Halted
+		s.Rollout.pending = map[string]*pendingUpdate{}
+		for host, p := range state.Pending {
+			if assignment, ok := state.Assignments[p.Revision]; ok {
+				s.Rollout.pending[host] = &pendingUpdate{Assignment: assignment, Since: p.Since}
+			}
+		}
+	}
+	return nil
+}
+
+// saveState writes the served assignments and the rollout to StatePath, the caller must hold mu.
+func (s *fleetServer) saveState() {
+	if s.StatePath == "" {
+		return
+	}
+	state := &fleetState{Assignments: map[string]*fleetAssignment{}, Served: map[string]string{}}
+	for host, assignment := range s.served {
+		revision := assignment.Revision()
+		state.Assignments[revision] = assignment
+		state.Served[host] = revision
+	}
+	if s.Rollout != nil {
+		state.Halted = s.Rollout.halted
+		state.Pending = map[string]*pendingState{}
+		for host, p := range s.Rollout.pending {
+			revision := p.Assignment.Revision()
+			state.Assignments[revision] = p.Assignment
+			state.Pending[host] = &pendingState{Revision: revision, Since: p.Since}
+		}
+	}
+
+	content, err := json.Marshal(state)
+	if err == nil {
+		err = reconciler.WriteFileAtomic(s.StatePath, content)
+	}
+	if err != nil {
+		log.Printf("error while writing fleet state: %s", err)
+	}
+}
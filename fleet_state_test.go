@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetServerState(t *testing.T) {
+	statePath := path.Join(t.TempDir(), "fleet.json")
+	s := &fleetServer{Rollout: &rollout{Percent: 1}, StatePath: statePath}
+	v1 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("v1")}}}
+	v2 := &fleetAssignment{Units: []*fleetUnit{{Name: "test.service", Content: []byte("v2")}}}
+
+	s.admit("host1", v1, "")
+	s.admit("host2", v1, "")
+	assert.Equal(t, v2, s.admit("host1", v2, v1.Revision()))
+	s.mu.Lock()
+	s.Rollout.Observe(&reconciler.HostReport{Host: "host1", OK: false, Assignment: v2.Revision()}, time.Now())
+	s.saveState()
+	s.mu.Unlock()
+
+	// A restarted server keeps holding back agents while the rollout is halted
+	restarted := &fleetServer{Rollout: &rollout{Percent: 1}, StatePath: statePath}
+	require.NoError(t, restarted.loadState())
+	assert.Contains(t, restarted.Rollout.Status().Halted, `agent "host1" failed to sync`)
+	assert.Equal(t, []string{"host1"}, restarted.Rollout.Status().Pending)
+	assert.Equal(t, v1, restarted.admit("host2", v2, v1.Revision()))
+	assert.Equal(t, v2, restarted.admit("host1", v2, v2.Revision()))
+
+	// Servers without a state file start empty
+	empty := &fleetServer{StatePath: path.Join(t.TempDir(), "fleet.json")}
+	require.NoError(t, empty.loadState())
+	assert.Empty(t, empty.served)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetServerAssignment(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "hosts", "host1"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "common.service"), []byte("common"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "override.service"), []byte("default"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hosts", "host1", "override.service"), []byte("host1"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hosts", "host1", "NOTES.md"), []byte("notes"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, reconciler.IgnoreFile), []byte("*.md\n"), 0644))
+
+	s := &fleetServer{Dir: dir, OpsToken: sha256Hex([]byte("ops-token"))}
+	handler := s.Handler()
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		err := callAgent(handler, "", "GetAssignment", &assignmentRequest{}, &assignmentResponse{})
+		assert.Equal(t, &grpcError{Code: grpcUnauthenticated, Message: "client certificate required"}, err)
+	})
+
+	t.Run("http/1.1", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withClientCert(httptest.NewRequest("POST", fleetServicePath+"GetAssignment", nil), "host1"))
+		assert.Equal(t, http.StatusHTTPVersionNotSupported, w.Code)
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		err := callAgent(handler, "host1", "GetSecrets", &grpcEmpty{}, &grpcEmpty{})
+		assert.Equal(t, &grpcError{Code: grpcUnimplemented, Message: `unknown method "GetSecrets"`}, err)
+	})
+
+	t.Run("host override", func(t *testing.T) {
+		resp := &assignmentResponse{}
+		require.NoError(t, callAgent(handler, "host1", "GetAssignment", &assignmentRequest{}, resp))
+		assert.Equal(t, []*fleetUnit{
+			{Name: "common.service", Content: []byte("common")},
+			{Name: "override.service", Content: []byte("host1")},
+		}, resp.Assignment.Units)
+		assert.Equal(t, resp.Assignment.Revision(), resp.Revision)
+	})
+
+	t.Run("other host", func(t *testing.T) {
+		resp := &assignmentResponse{}
+		require.NoError(t, callAgent(handler, "host2", "GetAssignment", &assignmentRequest{}, resp))
+		assert.Equal(t, []byte("default"), resp.Assignment.Units[1].Content)
+	})
+
+	t.Run("status reports", func(t *testing.T) {
+		report := &reconciler.HostReport{Host: "spoofed", Units: map[string]string{"common.service": "abc"}, OK: true}
+		require.NoError(t, callAgent(handler, "host1", "ReportStatus", report, &grpcEmpty{}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withClientCert(httptest.NewRequest("GET", "/v1/agents", nil), "host2"))
+		require.Equal(t, http.StatusUnauthorized, w.Code, "agent certificates can't read other agents' reports")
+
+		req := withClientCert(httptest.NewRequest("GET", "/v1/agents", nil), "admin")
+		req.Header.Set("Authorization", "Bearer ops-token")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		reports := []*reconciler.HostReport{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&reports))
+		require.Len(t, reports, 1)
+		assert.Equal(t, "host1", reports[0].Host)
+		assert.Equal(t, "abc", reports[0].Units["common.service"])
+	})
+}
+
+func TestFleetAgent(t *testing.T) {
+	serverDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(serverDir, "test1.service"), []byte("test1"), 0644))
+
+	s := &fleetServer{Dir: serverDir}
+	server := newAgentServer(s.Handler(), "host1")
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "stale.service"), []byte("stale"), 0644))
+
+	a := &fleetAgent{Server: server.URL, Dir: dir, Client: server.Client()}
+	require.NoError(t, a.Poll())
+
+	content, err := ioutil.ReadFile(path.Join(dir, "test1.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "test1", string(content))
+	assert.NoFileExists(t, path.Join(dir, "stale.service"))
+
+	a.SetReport(&reconciler.HostReport{Units: map[string]string{"test1.service": "abc"}, OK: true})
+	require.NoError(t, a.sendReport())
+	assert.Equal(t, "host1", s.reports["host1"].Host)
+	assert.Equal(t, a.last.Revision(), s.reports["host1"].Assignment, "reports identify the assignment they're about")
+}
+
+func TestFleetGRPC(t *testing.T) {
+	s := &fleetServer{Dir: t.TempDir()}
+	handler := s.Handler()
+	call := func(header http.Header) *http.Response {
+		body := &bytes.Buffer{}
+		require.NoError(t, writeGRPCMessage(body, &assignmentRequest{}))
+		r := withClientCert(httptest.NewRequest("POST", fleetServicePath+"GetAssignment", body), "host1")
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+		r.Header = header
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	status := func(res *http.Response) error {
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return grpcStatus(res)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, status(call(http.Header{"Content-Type": {grpcContentType}, "Te": {"trailers"}, "Grpc-Timeout": {"10S"}})))
+	})
+
+	t.Run("expired deadline", func(t *testing.T) {
+		err := status(call(http.Header{"Content-Type": {grpcContentType}, "Te": {"trailers"}, "Grpc-Timeout": {"1n"}}))
+		assert.Equal(t, &grpcError{Code: grpcDeadlineExceeded, Message: "deadline exceeded"}, err)
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		err := status(call(http.Header{"Content-Type": {grpcContentType}, "Te": {"trailers"}, "Grpc-Timeout": {"10d"}}))
+		assert.Equal(t, &grpcError{Code: grpcInvalidArgument, Message: `invalid grpc-timeout "10d"`}, err)
+	})
+
+	t.Run("missing te", func(t *testing.T) {
+		err := status(call(http.Header{"Content-Type": {grpcContentType}}))
+		assert.Equal(t, grpcInvalidArgument, err.(*grpcError).Code)
+	})
+
+	t.Run("protobuf codec", func(t *testing.T) {
+		err := status(call(http.Header{"Content-Type": {"application/grpc"}, "Te": {"trailers"}}))
+		assert.Equal(t, grpcUnimplemented, err.(*grpcError).Code)
+	})
+
+	t.Run("not grpc", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnsupportedMediaType, call(http.Header{"Content-Type": {"application/json"}}).StatusCode)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		var timeout string
+		server := newAgentServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout = r.Header.Get("Grpc-Timeout")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}), "host1")
+		defer server.Close()
+
+		client := server.Client()
+		client.Timeout = time.Minute
+		err := invokeGRPC(context.Background(), client, server.URL, "GetAssignment", &assignmentRequest{}, &assignmentResponse{})
+		assert.Equal(t, &grpcError{Code: grpcUnavailable, Message: "unexpected HTTP status 503"}, err)
+		d, err := parseGRPCTimeout(timeout)
+		require.NoError(t, err)
+		assert.InDelta(t, time.Minute, d, float64(time.Second))
+	})
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, time.Second, 99999999 * time.Nanosecond, time.Hour * 24 * 365} {
+		parsed, err := parseGRPCTimeout(formatGRPCTimeout(d))
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, int64(parsed), int64(d), formatGRPCTimeout(d))
+	}
+	assert.Equal(t, "100000u", formatGRPCTimeout(100*time.Millisecond))
+
+	for _, invalid := range []string{"", "S", "123456789S", "-1S", "1x"} {
+		_, err := parseGRPCTimeout(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// newAgentServer serves the handler over HTTP/2 as if every request carried a client certificate with the name.
+func newAgentServer(handler http.Handler, name string) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, withClientCert(r, name))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+// callAgent calls a method of the fleet service through the handler, as the agent with the name or without a
+// client certificate if it's empty.
+func callAgent(handler http.Handler, name, method string, req, resp interface{}) error {
+	body := &bytes.Buffer{}
+	if err := writeGRPCMessage(body, req); err != nil {
+		return err
+	}
+	r := httptest.NewRequest("POST", fleetServicePath+method, body)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	r.Header.Set("Content-Type", grpcContentType)
+	r.Header.Set("TE", "trailers")
+	if name != "" {
+		withClientCert(r, name)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	if err := grpcStatus(res); err != nil {
+		return err
+	}
+	return readGRPCMessage(res.Body, resp)
+}
+
+func withClientCert(r *http.Request, name string) *http.Request {
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: name}}}}
+	return r
+}
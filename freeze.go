@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// freezePeriod is a change freeze imported from a calendar.
+type freezePeriod struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+// freezeCalendar holds the change freezes of an iCal feed or JSON calendar, see -freeze-calendar.
+// It keeps the freezes of its last successful refresh, so a calendar that becomes unreachable doesn't end a freeze.
+type freezeCalendar struct {
+	Source string // http(s) URL or path of the calendar
+	Client *http.Client
+
+	mu      sync.Mutex
+	periods []*freezePeriod
+}
+
+// Frozen returns the reasons of the freezes containing now, joined by commas, or an empty string.
+func (c *freezeCalendar) Frozen(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var reasons []string
+	for _, period := range c.periods {
+		if !now.Before(period.Start) && now.Before(period.End) {
+			reasons = append(reasons, period.Reason)
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Refresh reads the calendar again.
+func (c *freezeCalendar) Refresh(ctx context.Context) error {
+	buf, err := c.read(ctx)
+	if err != nil {
+		return err
+	}
+	periods, err := parseFreezeCalendar(buf)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.periods = periods
+	return nil
+}
+
+func (c *freezeCalendar) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(c.Source, "http://") && !strings.HasPrefix(c.Source, "https://") {
+		return ioutil.ReadFile(c.Source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Run refreshes the calendar until the context is canceled.
+func (c *freezeCalendar) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(ctx); err != nil {
+				log.Printf("error while refreshing the freeze calendar, keeping the previous freezes: %s", err)
+			}
+		}
+	}
+}
+
+// parseFreezeCalendar parses the VEVENTs of an iCal feed, or a JSON array of objects with a start, end, and reason,
+// into freezes ordered by their start.
+func parseFreezeCalendar(buf []byte) ([]*freezePeriod, error) {
+	var periods []*freezePeriod
+	trimmed := bytes.TrimSpace(buf)
+	if bytes.HasPrefix(trimmed, []byte("BEGIN:VCALENDAR")) {
+		var err error
+		if periods, err = parseICal(trimmed); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(trimmed, &periods); err != nil {
+		return nil, fmt.Errorf("expected an iCal feed or a json array of freezes: %s", err)
+	}
+
+	for _, period := range periods {
+		if !period.End.After(period.Start) {
+			return nil, fmt.Errorf("freeze %q ends before it starts", period.Reason)
+		}
+		if period.Reason == "" {
+			period.Reason = "change freeze"
+		}
+	}
+	sort.SliceStable(periods, func(i, j int) bool { return periods[i].Start.Before(periods[j].Start) })
+	return periods, nil
+}
+
+// parseICal parses the start, end, and summary of every VEVENT. Recurrences aren't expanded, only their first
+// occurrence freezes changes.
+func parseICal(buf []byte) ([]*freezePeriod, error) {
+	var (
+		lines   []string
+		periods []*freezePeriod
+		event   *freezePeriod
+		allDay  bool
+		recurs  bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:] // unfold continuation lines
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		params := strings.Split(line[:i], ";")
+		name, value := strings.ToUpper(params[0]), line[i+1:]
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			event, allDay, recurs = &freezePeriod{}, false, false
+		case event == nil:
+		case name == "END" && value == "VEVENT":
+			if event.Start.IsZero() {
+				return nil, fmt.Errorf("event %q has no DTSTART", event.Reason)
+			}
+			if event.End.IsZero() && allDay {
+				event.End = event.Start.AddDate(0, 0, 1)
+			}
+			if recurs {
+				log.Printf("warning: only the first occurrence of the recurring freeze %q is imported", event.Reason)
+			}
+			periods = append(periods, event)
+			event = nil
+		case name == "DTSTART" || name == "DTEND":
+			t, date, err := parseICalTime(value, params[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of event %q: %s", name, event.Reason, err)
+			}
+			if name == "DTSTART" {
+				event.Start, allDay = t, date
+			} else {
+				event.End = t
+			}
+		case name == "SUMMARY":
+			event.Reason = strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+		case name == "RRULE":
+			recurs = true
+		}
+	}
+	return periods, nil
+}
+
+// parseICalTime parses a DATE-TIME in UTC, in the zone of its TZID parameter, or floating in local time,
+// or a DATE, which is reported as true.
+func parseICalTime(value string, params []string) (time.Time, bool, error) {
+	loc := time.Local
+	for _, param := range params {
+		if strings.HasPrefix(strings.ToUpper(param), "TZID=") {
+			tz, err := time.LoadLocation(strings.Trim(param[len("TZID="):], `"`))
+			if err != nil {
+				return time.Time{}, false, err
+			}
+			loc = tz
+		}
+	}
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	case strings.Contains(value, "T"):
+		t, err := time.ParseInLocation("20060102T150405", value, loc)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+}
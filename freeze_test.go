@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFreezeICal = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Year-end\\, holidays\r\nDTSTART:20211220T000000Z\r\nDTEND:20220103T000000Z\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Black\r\n  Friday\r\nDTSTART;VALUE=DATE:20211126\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nSUMMARY:Launch\r\nDTSTART;TZID=America/New_York:20211001T090000\r\nDTEND;TZID=America/New_York:20211001T170000\r\nEND:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseFreezeCalendarICal(t *testing.T) {
+	periods, err := parseFreezeCalendar([]byte(testFreezeICal))
+	require.NoError(t, err)
+	require.Len(t, periods, 3)
+
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	assert.Equal(t, "Launch", periods[0].Reason)
+	assert.True(t, time.Date(2021, 10, 1, 9, 0, 0, 0, ny).Equal(periods[0].Start))
+	assert.True(t, time.Date(2021, 10, 1, 17, 0, 0, 0, ny).Equal(periods[0].End))
+
+	// All-day events without an end last a day
+	assert.Equal(t, "Black Friday", periods[1].Reason)
+	assert.True(t, time.Date(2021, 11, 26, 0, 0, 0, 0, time.Local).Equal(periods[1].Start))
+	assert.True(t, time.Date(2021, 11, 27, 0, 0, 0, 0, time.Local).Equal(periods[1].End))
+
+	assert.Equal(t, "Year-end, holidays", periods[2].Reason)
+	assert.True(t, time.Date(2021, 12, 20, 0, 0, 0, 0, time.UTC).Equal(periods[2].Start))
+
+	_, err = parseFreezeCalendar([]byte("BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:x\nDTSTART:2021\nEND:VEVENT\nEND:VCALENDAR\n"))
+	assert.Error(t, err)
+}
+
+func TestParseFreezeCalendarJSON(t *testing.T) {
+	periods, err := parseFreezeCalendar([]byte(`[{"start": "2021-12-20T00:00:00Z", "end": "2022-01-03T00:00:00Z", "reason": "holidays"}, {"start": "2021-11-26T00:00:00Z", "end": "2021-11-27T00:00:00Z"}]`))
+	require.NoError(t, err)
+	require.Len(t, periods, 2)
+	assert.Equal(t, "change freeze", periods[0].Reason)
+	assert.Equal(t, "holidays", periods[1].Reason)
+
+	_, err = parseFreezeCalendar([]byte(`[{"start": "2022-01-03T00:00:00Z", "end": "2021-12-20T00:00:00Z", "reason": "backwards"}]`))
+	assert.EqualError(t, err, `freeze "backwards" ends before it starts`)
+	_, err = parseFreezeCalendar([]byte(`holidays`))
+	assert.Error(t, err)
+}
+
+func TestFreezeCalendar(t *testing.T) {
+	body := testFreezeICal
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cal := &freezeCalendar{Source: server.URL, Client: server.Client()}
+	assert.Empty(t, cal.Frozen(time.Date(2021, 12, 24, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, cal.Refresh(context.Background()))
+	assert.Equal(t, "Year-end, holidays", cal.Frozen(time.Date(2021, 12, 24, 0, 0, 0, 0, time.UTC)))
+	assert.Empty(t, cal.Frozen(time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC)))
+
+	// Freezes are kept while the calendar is unavailable
+	body = ""
+	assert.EqualError(t, cal.Refresh(context.Background()), "unexpected status 500")
+	assert.Equal(t, "Year-end, holidays", cal.Frozen(time.Date(2021, 12, 24, 0, 0, 0, 0, time.UTC)))
+
+	name := path.Join(t.TempDir(), "freezes.json")
+	require.NoError(t, ioutil.WriteFile(name, []byte(`[{"start": "2021-12-20T00:00:00Z", "end": "2022-01-03T00:00:00Z", "reason": "holidays"}]`), 0644))
+	cal = &freezeCalendar{Source: name}
+	require.NoError(t, cal.Refresh(context.Background()))
+	assert.Equal(t, "holidays", cal.Frozen(time.Date(2021, 12, 24, 0, 0, 0, 0, time.UTC)))
+}
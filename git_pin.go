@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// pinFile is the name of the file in a git source's Repo holding the promoted ref, which overrides Ref.
+const pinFile = "unitmgr-pin"
+
+// semver is a semantic version like 1.4.2 or v1.4.2-rc.1.
+type semver struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+func parseSemver(s string) (*semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+	v := &semver{}
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		if s[i] == '-' {
+			v.Pre = strings.SplitN(s[i+1:], "+", 2)[0]
+		}
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	for i, dst := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		*dst = n
+	}
+	return v, true
+}
+
+// compare returns -1, 0, or 1 if v is lower than, equal to, or greater than o.
+// Prereleases are lower than the release of the same version.
+func (v *semver) compare(o *semver) int {
+	for _, pair := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		switch {
+		case pair[0] < pair[1]:
+			return -1
+		case pair[0] > pair[1]:
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// semverConstraint is a comparison of versions, e.g. >=1.2.0.
+type semverConstraint struct {
+	Op      string
+	Version *semver
+}
+
+// semverRange matches the versions satisfying every constraint, see parseSemverRange.
+type semverRange []*semverConstraint
+
+// isSemverRange returns true for refs that are meant as ranges rather than names, e.g. ^1.4 or 1.x.
+func isSemverRange(ref string) bool {
+	return (ref != "" && strings.ContainsAny(ref[:1], "^~<>=")) || strings.Contains(ref, ".x") || strings.Contains(ref, ".*") || ref == "*"
+}
+
+// parseSemverRange parses space-separated constraints that must all be satisfied: comparisons like >=1.2.0 or <2,
+// caret ranges like ^1.4 (compatible with 1.4.0), tilde ranges like ~1.4.2 (patches of 1.4), and wildcards like 1.x.
+func parseSemverRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, field := range strings.Fields(s) {
+		version := strings.TrimLeft(field, "^~<>=")
+		op := field[:len(field)-len(version)]
+		parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid version range %q", s)
+		}
+
+		// Missing and wildcard components make the range cover every value of them
+		var n [3]int
+		specified := 0
+		for i, part := range parts {
+			if part == "x" || part == "*" {
+				break
+			}
+			value, err := strconv.Atoi(part)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid version range %q", s)
+			}
+			n[i], specified = value, i+1
+		}
+		v := &semver{Major: n[0], Minor: n[1], Patch: n[2]}
+
+		switch op {
+		case "", "=":
+			if specified == 3 {
+				r = append(r, &semverConstraint{"=", v})
+				break
+			}
+			r = append(r, &semverConstraint{">=", v}, &semverConstraint{"<", bump(v, specified)})
+		case "~":
+			if specified == 3 {
+				specified = 2
+			}
+			r = append(r, &semverConstraint{">=", v}, &semverConstraint{"<", bump(v, specified)})
+		case "^":
+			fixed := 1 // the first non-zero component may not change
+			for fixed < specified && n[fixed-1] == 0 {
+				fixed++
+			}
+			r = append(r, &semverConstraint{">=", v}, &semverConstraint{"<", bump(v, fixed)})
+		case ">", ">=", "<", "<=":
+			r = append(r, &semverConstraint{op, v})
+		default:
+			return nil, fmt.Errorf("invalid operator %q in version range %q", op, s)
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("empty version range")
+	}
+	return r, nil
+}
+
+// bump returns the lowest version whose first n components are greater than v's, e.g. 1.5.0 for 1.4.2 and 2.
+func bump(v *semver, n int) *semver {
+	switch n {
+	case 0:
+		return &semver{Major: int(^uint(0) >> 1)}
+	case 1:
+		return &semver{Major: v.Major + 1}
+	case 2:
+		return &semver{Major: v.Major, Minor: v.Minor + 1}
+	default:
+		return &semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+}
+
+// Matches returns true if the version satisfies every constraint. Prereleases never match,
+// since they're pinned explicitly rather than rolled out by ranges.
+func (r semverRange) Matches(v *semver) bool {
+	if v.Pre != "" {
+		return false
+	}
+	for _, c := range r {
+		cmp := v.compare(c.Version)
+		var ok bool
+		switch c.Op {
+		case "=":
+			ok = cmp == 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveRef returns the name to fetch for a ref: the ref itself for branches and tags,
+// or the highest tag matching a tag glob or semver range.
+func (s *gitSource) resolveRef(ctx context.Context, ref string) (string, error) {
+	glob := strings.ContainsAny(ref, "*?[") && !isSemverRange(ref)
+	if !glob && !isSemverRange(ref) {
+		return ref, nil
+	}
+	var r semverRange
+	if !glob {
+		var err error
+		if r, err = parseSemverRange(ref); err != nil {
+			return "", err
+		}
+	}
+
+	out, err := s.git(ctx, "ls-remote", "--tags", "--refs", s.URL)
+	if err != nil {
+		return "", err
+	}
+	var best string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		tag := strings.TrimPrefix(fields[1], "refs/tags/")
+		if glob {
+			if matched, _ := path.Match(ref, tag); !matched {
+				continue
+			}
+		} else if version, ok := parseSemver(tag); !ok || !r.Matches(version) {
+			continue
+		}
+		if best == "" || newerTag(tag, best) {
+			best = tag
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no tag matches %q", ref)
+	}
+	return "refs/tags/" + best, nil
+}
+
+// newerTag returns true if tag a is preferred over tag b: versions over other names, then higher versions or later names.
+func newerTag(a, b string) bool {
+	va, aok := parseSemver(a)
+	vb, bok := parseSemver(b)
+	switch {
+	case aok && bok:
+		return va.compare(vb) > 0
+	case aok != bok:
+		return aok
+	default:
+		return a > b
+	}
+}
+
+// ref returns the promoted ref if any, or Ref.
+func (s *gitSource) ref() string {
+	if pin, err := ioutil.ReadFile(path.Join(s.Repo, pinFile)); err == nil && len(strings.TrimSpace(string(pin))) > 0 {
+		return strings.TrimSpace(string(pin))
+	}
+	return s.Ref
+}
+
+// Promote pins the source to a branch, tag, tag glob, or semver range, overriding Ref until the next promotion,
+// and mirrors it right away, returning the mirrored commit. The pin only changes if the ref can be mirrored.
+func (s *gitSource) Promote(ctx context.Context, ref string) (string, error) {
+	s.poll.Lock()
+	defer s.poll.Unlock()
+
+	commit, err := s.mirror(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if err := reconciler.WriteFileAtomic(path.Join(s.Repo, pinFile), []byte(ref+"\n")); err != nil {
+		return "", err
+	}
+	log.Printf("promoted %s to %s", s.URL, ref)
+	return commit, nil
+}
+
+func promoteCommand() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr promote <branch, tag, tag glob, or semver range>")
+		return exitFailed
+	}
+	ref := flag.Arg(0)
+
+	if *control != "" {
+		commit, err := postPromote(controlClient(*control), ref)
+		switch {
+		case err == nil:
+			printPromoted(ref, commit)
+			return exitConverged
+		case !notRunning(err):
+			fmt.Fprintf(os.Stderr, "error while promoting: %s\n", err)
+			return exitFailed
+		}
+	}
+
+	// No instance is running, so pin the source for the next sync
+	src, err := newSource()
+	if err != nil {
+		return setupFailed(err)
+	}
+	s, ok := src.(*gitSource)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "-git-url is required")
+		return exitFailed
+	}
+	commit, err := s.Promote(context.Background(), ref)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while promoting: %s\n", err)
+		return exitFailed
+	}
+	printPromoted(ref, commit)
+	return exitConverged
+}
+
+type promoteResult struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+func printPromoted(ref, commit string) {
+	if !structured(os.Stdout, &promoteResult{Ref: ref, Commit: commit}) {
+		fmt.Printf("promoted %s, mirrored commit %s\n", ref, commit)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemverRange(t *testing.T) {
+	for _, tc := range []struct {
+		Range    string
+		Matching []string
+		Other    []string
+	}{
+		{"^1.4", []string{"1.4.0", "v1.9.3"}, []string{"1.3.9", "2.0.0", "1.5.0-rc.1"}},
+		{"^0.4.2", []string{"0.4.2", "0.4.9"}, []string{"0.5.0", "0.4.1"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.7"}, []string{"1.5.0", "1.4.1"}},
+		{"~1", []string{"1.0.0", "1.9.9"}, []string{"2.0.0"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"0.9.0", "2.0.0"}},
+		{"1.4.*", []string{"1.4.0", "1.4.9"}, []string{"1.5.0"}},
+		{"*", []string{"0.0.1", "99.0.0"}, []string{"1.0.0-beta"}},
+		{">=1.2.0 <2", []string{"1.2.0", "1.99.0"}, []string{"1.1.9", "2.0.0"}},
+		{"=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+	} {
+		r, err := parseSemverRange(tc.Range)
+		require.NoError(t, err, tc.Range)
+		for _, version := range tc.Matching {
+			v, ok := parseSemver(version)
+			require.True(t, ok, version)
+			assert.True(t, r.Matches(v), "%s should match %s", tc.Range, version)
+		}
+		for _, version := range tc.Other {
+			v, ok := parseSemver(version)
+			require.True(t, ok, version)
+			assert.False(t, r.Matches(v), "%s shouldn't match %s", tc.Range, version)
+		}
+	}
+
+	for _, invalid := range []string{"^1.a", ">=1.2.3.4", "!1.2"} {
+		_, err := parseSemverRange(invalid)
+		assert.Error(t, err, invalid)
+	}
+	assert.True(t, isSemverRange("^1.4"))
+	assert.True(t, isSemverRange("2.x"))
+	assert.False(t, isSemverRange("main"))
+	assert.False(t, isSemverRange("v1.4.2"))
+	assert.False(t, isSemverRange("release-*"))
+}
+
+func TestGitSourcePin(t *testing.T) {
+	repo := newTestRepo(t)
+	dir := t.TempDir()
+	s := &gitSource{URL: repo.Dir, Ref: "^1.4", Dir: dir, Repo: dir + "/.unitmgr-cache"}
+
+	for _, version := range []string{"1.3.0", "1.4.0", "1.4.10", "1.5.0-rc.1", "2.0.0"} {
+		repo.commit(map[string]string{"a.service": version})
+		repo.git("tag", "v"+version)
+	}
+	repo.commit(map[string]string{"a.service": "release-b"})
+	repo.git("tag", "release-b")
+	repo.commit(map[string]string{"a.service": "release-a"})
+	repo.git("tag", "release-a")
+	repo.commit(map[string]string{"a.service": "main"})
+
+	// Ranges track the highest matching release
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "1.4.10"})
+
+	// Globs of tags that aren't versions pick the last name in order
+	s.Ref = "release-*"
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "release-b"})
+
+	// Promotions override the configured ref, and are kept across restarts
+	commit, err := s.Promote(context.Background(), "v1.5.0-rc.1")
+	require.NoError(t, err)
+	assert.Equal(t, repo.git("rev-parse", "v1.5.0-rc.1^{commit}"), commit)
+	assertFiles(t, dir, map[string]string{"a.service": "1.5.0-rc.1"})
+
+	s = &gitSource{URL: repo.Dir, Ref: "main", Dir: dir, Repo: dir + "/.unitmgr-cache"}
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "1.5.0-rc.1"})
+
+	// Refs that can't be mirrored aren't pinned
+	_, err = s.Promote(context.Background(), "^3")
+	assert.EqualError(t, err, `no tag matches "^3"`)
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "1.5.0-rc.1"})
+
+	_, err = s.Promote(context.Background(), "main")
+	require.NoError(t, err)
+	assertFiles(t, dir, map[string]string{"a.service": "main"})
+}
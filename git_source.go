@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// gitSource mirrors the unit files of a git repository into the local src directory,
+// optionally writing the reconciliation status of the mirrored commit back to the repository.
+type gitSource struct {
+	URL     string // of the repository, anything git fetch accepts
+	Ref     string // branch or tag to track
+	Path    string // optional, directory of the repository holding the unit files
+	Dir     string
+	Repo    string        // bare repository the commits are fetched into
+	Status  string        // optional, where to write the status back to: notes or branch
+	Host    string        // names the notes ref or branch of this host's status
+	Timeout time.Duration // of each git command, zero for none
+	Gate    *pollGate     // optional, defers polls until the host meets its conditions
+
+	poll    sync.Mutex // serializes polls and promotions
+	mu      sync.Mutex
+	commit  string    // mirrored into Dir
+	since   time.Time // when commit was mirrored
+	report  *reconciler.HostReport
+	written string // status last written back
+}
+
+// gitStatus is the reconciliation status of a commit on a host.
+type gitStatus struct {
+	Host       string            `json:"host"`
+	Commit     string            `json:"commit"`
+	OK         bool              `json:"ok"`
+	Generation int64             `json:"generation,omitempty"`
+	Failures   map[string]string `json:"failures,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Run polls the repository until the context is canceled, writing the status back after every poll.
+func (s *gitSource) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := s.Poll(ctx); err != nil {
+			log.Printf("error while polling git source: %s", err)
+		}
+		if err := s.WriteStatus(ctx); err != nil {
+			log.Printf("error while writing status to git source: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// SetReport stores the most recent state of the local reconciliation to be written back by WriteStatus.
+func (s *gitSource) SetReport(report *reconciler.HostReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = report
+}
+
+// Poll fetches the promoted ref or Ref and mirrors the unit files of its commit into Dir.
+func (s *gitSource) Poll(ctx context.Context) error {
+	if s.Gate.Deferred(ctx) {
+		return nil
+	}
+	s.poll.Lock()
+	defer s.poll.Unlock()
+	_, err := s.mirror(ctx, s.ref())
+	return err
+}
+
+// mirror fetches a ref and mirrors the unit files of its commit into Dir, returning the commit.
+// Every changed file is read from the repository before Dir is touched.
+func (s *gitSource) mirror(ctx context.Context, ref string) (string, error) {
+	if _, err := os.Stat(s.Repo); os.IsNotExist(err) {
+		if err := os.MkdirAll(s.Repo, 0755); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, "init", "--quiet", "--bare", "."); err != nil {
+			return "", err
+		}
+	}
+	resolved, err := s.resolveRef(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.git(ctx, "fetch", "--quiet", "--depth", "1", "--force", s.URL, resolved); err != nil {
+		return "", err
+	}
+	commit, err := s.git(ctx, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", err
+	}
+
+	tree := commit
+	if dir := strings.Trim(s.Path, "/"); dir != "" {
+		tree += ":" + dir
+	}
+	entries, err := s.tree(ctx, tree)
+	if err != nil {
+		return "", err
+	}
+
+	listed := map[string]bool{}
+	contents := map[string][]byte{}
+	for _, entry := range entries {
+		listed[entry.Name] = true
+		if current, err := ioutil.ReadFile(path.Join(s.Dir, entry.Name)); err == nil && gitBlobID(current, len(entry.Object)) == entry.Object {
+			continue
+		}
+		content, err := s.command(ctx, nil, "cat-file", "blob", entry.Object)
+		if err != nil {
+			return "", err
+		}
+		contents[entry.Name] = content
+	}
+
+	for _, entry := range entries {
+		content, changed := contents[entry.Name]
+		name := path.Join(s.Dir, entry.Name)
+		if changed {
+			if err := reconciler.WriteFileAtomic(name, content); err != nil {
+				return "", err
+			}
+			log.Printf("received unit from git source: %s", entry.Name)
+		}
+		if err := os.Chmod(name, entry.Mode); err != nil {
+			return "", err
+		}
+	}
+	if err := removeUnlisted(s.Dir, listed); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if commit != s.commit {
+		log.Printf("mirrored commit %s of %s", commit, strings.TrimPrefix(resolved, "refs/tags/"))
+		s.commit, s.since = commit, time.Now()
+	}
+	return commit, nil
+}
+
+type gitTreeEntry struct {
+	Name   string
+	Object string
+	Mode   os.FileMode
+}
+
+// tree returns the regular files of a tree, skipping directories, symlinks, and submodules.
+func (s *gitSource) tree(ctx context.Context, tree string) ([]*gitTreeEntry, error) {
+	out, err := s.git(ctx, "ls-tree", "-z", tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*gitTreeEntry
+	for _, line := range strings.Split(out, "\x00") {
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		name := line[tab+1:]
+		if len(fields) != 3 || fields[1] != "blob" || !validUnitName(name) {
+			continue
+		}
+		mode := os.FileMode(0644)
+		switch fields[0] {
+		case "100644":
+		case "100755":
+			mode = 0755
+		default:
+			continue // symlinks
+		}
+		entries = append(entries, &gitTreeEntry{Name: name, Object: fields[2], Mode: mode})
+	}
+	return entries, nil
+}
+
+// gitBlobID returns the id git assigns to a file's content, for repositories using
+// sha1 or sha256 object ids of the given hex length.
+func gitBlobID(content []byte, length int) string {
+	var h hash.Hash
+	if length == sha256.Size*2 {
+		h = sha256.New()
+	} else {
+		h = sha1.New()
+	}
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WriteStatus writes the status of the mirrored commit back to the repository once it has been synced,
+// unless it's unchanged since the last write.
+func (s *gitSource) WriteStatus(ctx context.Context) error {
+	s.mu.Lock()
+	report, commit, since := s.report, s.commit, s.since
+	s.mu.Unlock()
+	if s.Status == "" || report == nil || commit == "" || report.LastSync.Before(since) {
+		return nil
+	}
+
+	status := &gitStatus{Host: s.Host, Commit: commit, OK: report.OK, Generation: report.Generation, Failures: report.Failures, Time: report.LastSync}
+	key, err := json.Marshal(&gitStatus{Commit: commit, OK: report.OK, Generation: report.Generation, Failures: report.Failures})
+	if err != nil {
+		return err
+	}
+	if string(key) == s.written {
+		return nil
+	}
+	buf, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch s.Status {
+	case "notes":
+		err = s.writeNote(ctx, commit, buf)
+	case "branch":
+		err = s.writeBranch(ctx, status, buf)
+	default:
+		err = fmt.Errorf("unknown status mode %q", s.Status)
+	}
+	if err != nil {
+		return err
+	}
+	s.written = string(key)
+	return nil
+}
+
+// writeNote annotates the commit with the status in this host's notes ref,
+// so several hosts never push to the same ref.
+func (s *gitSource) writeNote(ctx context.Context, commit string, status []byte) error {
+	ref := "refs/notes/unitmgr/" + s.Host
+	s.fetchRef(ctx, ref)
+	if _, err := s.git(ctx, "notes", "--ref", ref, "add", "--force", "--message", string(status), commit); err != nil {
+		return err
+	}
+	_, err := s.git(ctx, "push", "--quiet", s.URL, ref+":"+ref)
+	return err
+}
+
+// writeBranch commits the status as status.json to this host's status branch.
+func (s *gitSource) writeBranch(ctx context.Context, status *gitStatus, buf []byte) error {
+	ref := "refs/heads/unitmgr/status/" + s.Host
+	s.fetchRef(ctx, ref)
+
+	blob, err := s.command(ctx, append(buf, '\n'), "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	tree, err := s.command(ctx, []byte("100644 blob "+strings.TrimSpace(string(blob))+"\tstatus.json\n"), "mktree")
+	if err != nil {
+		return err
+	}
+	state := "ok"
+	if !status.OK {
+		state = "failing"
+	}
+	args := []string{"commit-tree", strings.TrimSpace(string(tree)), "-m", fmt.Sprintf("%s: %s %s", s.Host, state, status.Commit)}
+	if parent, err := s.git(ctx, "rev-parse", "--verify", "--quiet", ref); err == nil {
+		args = append(args, "-p", parent)
+	}
+	commit, err := s.git(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if _, err := s.git(ctx, "update-ref", ref, commit); err != nil {
+		return err
+	}
+	_, err = s.git(ctx, "push", "--quiet", s.URL, ref+":"+ref)
+	return err
+}
+
+// fetchRef updates a local ref from the repository, so it's only pushed as a fast-forward.
+// Refs that don't exist yet are created by the push.
+func (s *gitSource) fetchRef(ctx context.Context, ref string) {
+	s.git(ctx, "fetch", "--quiet", s.URL, "+"+ref+":"+ref)
+}
+
+// git runs a git command in Repo, returning its trimmed output.
+func (s *gitSource) git(ctx context.Context, args ...string) (string, error) {
+	out, err := s.command(ctx, nil, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// command runs a git command in Repo with the given input, returning its output.
+func (s *gitSource) command(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", s.Repo}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=unitmgr", "GIT_AUTHOR_EMAIL=unitmgr@"+s.Host,
+		"GIT_COMMITTER_NAME=unitmgr", "GIT_COMMITTER_EMAIL=unitmgr@"+s.Host,
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitStatusModes are the supported values of -git-status.
+var gitStatusModes = map[string]bool{"": true, "notes": true, "branch": true}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepo is a git repository serving as the remote of a git source.
+type testRepo struct {
+	t   *testing.T
+	Dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	r := &testRepo{t: t, Dir: t.TempDir()}
+	r.git("init", "--quiet", "--initial-branch", "main")
+	return r
+}
+
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.Dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// commit replaces the content of the repository with the given files, mapping names to content.
+func (r *testRepo) commit(files map[string]string) string {
+	r.git("rm", "--quiet", "-r", "--ignore-unmatch", ".")
+	for name, content := range files {
+		require.NoError(r.t, os.MkdirAll(path.Dir(path.Join(r.Dir, name)), 0755))
+		require.NoError(r.t, ioutil.WriteFile(path.Join(r.Dir, name), []byte(content), 0644))
+	}
+	r.git("add", "--all")
+	r.git("commit", "--quiet", "--allow-empty", "-m", "update")
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestGitSource(t *testing.T) {
+	repo := newTestRepo(t)
+	dir := t.TempDir()
+	s := &gitSource{URL: repo.Dir, Ref: "main", Path: "units", Dir: dir, Repo: path.Join(dir, ".unitmgr-cache")}
+
+	repo.commit(map[string]string{"units/a.service": "a1", "units/b.service": "b1", "units/nested/c.service": "c1", "README.md": "docs"})
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "stale.service"), []byte("stale"), 0644))
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "a1", "b.service": "b1"})
+
+	repo.commit(map[string]string{"units/a.service": "a2"})
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "a2"})
+
+	// Local changes are reverted
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.service"), []byte("local"), 0644))
+	require.NoError(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "a2"})
+
+	s.Ref = "missing"
+	assert.Error(t, s.Poll(context.Background()))
+	assertFiles(t, dir, map[string]string{"a.service": "a2"})
+}
+
+func assertFiles(t *testing.T, dir string, expected map[string]string) {
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	actual := map[string]string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		require.NoError(t, err)
+		actual[file.Name()] = string(content)
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestGitSourceStatus(t *testing.T) {
+	for _, mode := range []string{"notes", "branch"} {
+		t.Run(mode, func(t *testing.T) {
+			repo := newTestRepo(t)
+			dir := t.TempDir()
+			s := &gitSource{URL: repo.Dir, Ref: "main", Dir: dir, Repo: path.Join(dir, ".unitmgr-cache"), Status: mode, Host: "host1"}
+
+			// Nothing is written until the mirrored commit was synced
+			commit := repo.commit(map[string]string{"a.service": "a1"})
+			require.NoError(t, s.WriteStatus(context.Background()))
+			require.NoError(t, s.Poll(context.Background()))
+			s.SetReport(&reconciler.HostReport{OK: true, Generation: 1, LastSync: time.Now().Add(-time.Hour)})
+			require.NoError(t, s.WriteStatus(context.Background()))
+
+			read := func(commit string) *gitStatus {
+				var out string
+				if mode == "notes" {
+					out = repo.git("notes", "--ref", "unitmgr/host1", "show", commit)
+				} else {
+					out = repo.git("show", "unitmgr/status/host1:status.json")
+				}
+				status := &gitStatus{}
+				require.NoError(t, json.Unmarshal([]byte(out), status))
+				return status
+			}
+
+			s.SetReport(&reconciler.HostReport{OK: false, Generation: 1, LastSync: time.Now(), Failures: map[string]string{"a.service": "oops"}})
+			require.NoError(t, s.WriteStatus(context.Background()))
+			status := read(commit)
+			assert.Equal(t, "host1", status.Host)
+			assert.Equal(t, commit, status.Commit)
+			assert.False(t, status.OK)
+			assert.Equal(t, map[string]string{"a.service": "oops"}, status.Failures)
+
+			// Changed statuses are written again
+			s.SetReport(&reconciler.HostReport{OK: true, Generation: 2, LastSync: time.Now()})
+			require.NoError(t, s.WriteStatus(context.Background()))
+			assert.True(t, read(commit).OK)
+
+			next := repo.commit(map[string]string{"a.service": "a2"})
+			require.NoError(t, s.Poll(context.Background()))
+			s.SetReport(&reconciler.HostReport{OK: true, Generation: 3, LastSync: time.Now()})
+			require.NoError(t, s.WriteStatus(context.Background()))
+			assert.Equal(t, next, read(next).Commit)
+			if mode == "notes" {
+				assert.True(t, read(commit).OK) // the previous commit's note is kept
+			} else {
+				assert.Equal(t, "3", repo.git("rev-list", "--count", "unitmgr/status/host1"))
+			}
+		})
+	}
+}
+
+func TestGitBlobID(t *testing.T) {
+	assert.Equal(t, "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", gitBlobID(nil, 40))
+	assert.Equal(t, "473a0f4c3be8a93681a267e3b1e9a7dcda1185436fe141f7749120a303721813", gitBlobID(nil, 64))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// graphDirectives are the dependencies units declare to systemd, by section.
+var graphDirectives = map[string][]string{
+	"Unit":    {"After", "Before", "Requires", "Requisite", "Wants", "BindsTo", "PartOf"},
+	"Install": {"WantedBy", "RequiredBy"},
+}
+
+// unitGraph is the managed units and the units they declare dependencies on.
+type unitGraph struct {
+	Nodes []*graphNode `json:"nodes"`
+	Edges []*graphEdge `json:"edges"`
+}
+
+type graphNode struct {
+	Unit    string `json:"unit"`
+	Src     string `json:"src,omitempty"` // empty for units that aren't managed, but referenced by managed units
+	Managed bool   `json:"managed"`
+}
+
+// graphEdge is a dependency declared by From on To, e.g. From=web.service After=To.
+// Kind is the directive, WaitForUnit for unitmgr's prerequisites, or Group for the -group target's units.
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+func graphCommand() int {
+	if flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr graph [unit]")
+		return exitFailed
+	}
+	_, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+	g, err := buildGraph(reconcilers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading units: %s\n", err)
+		return exitFailed
+	}
+	if flag.NArg() == 1 {
+		if g = g.Around(flag.Arg(0)); g == nil {
+			fmt.Fprintf(os.Stderr, "unit %q isn't managed or referenced by a managed unit\n", flag.Arg(0))
+			return exitFailed
+		}
+	}
+	if !structured(os.Stdout, g) {
+		writeDOT(os.Stdout, g)
+	}
+	return exitConverged
+}
+
+// buildGraph reads the dependencies declared by the units of every reconciler.
+func buildGraph(reconcilers []*reconciler.Reconciler) (*unitGraph, error) {
+	nodes := map[string]*graphNode{}
+	edges := map[graphEdge]bool{}
+	for _, rec := range reconcilers {
+		units, err := rec.Units()
+		if err != nil {
+			return nil, err
+		}
+		for _, unit := range units {
+			nodes[unit] = &graphNode{Unit: unit, Src: rec.Src, Managed: true}
+			file, err := os.Open(path.Join(rec.Src, unit))
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := reconciler.ParseUnitFile(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", unit, err)
+			}
+
+			for section, keys := range graphDirectives {
+				for _, key := range keys {
+					for _, dep := range strings.Fields(strings.Join(parsed.Values(section, key), " ")) {
+						edges[graphEdge{From: unit, To: dep, Kind: key}] = true
+					}
+				}
+			}
+			for _, dep := range strings.Fields(strings.Join(parsed.Values(reconciler.UnitSection, "WaitForUnit"), " ")) {
+				edges[graphEdge{From: unit, To: dep, Kind: "WaitForUnit"}] = true
+			}
+			if rec.Group != "" && unit != rec.Group {
+				edges[graphEdge{From: rec.Group, To: unit, Kind: "Group"}] = true
+			}
+		}
+	}
+
+	g := &unitGraph{Nodes: []*graphNode{}, Edges: []*graphEdge{}}
+	for edge := range edges {
+		edge := edge
+		g.Edges = append(g.Edges, &edge)
+		for _, unit := range []string{edge.From, edge.To} {
+			if nodes[unit] == nil {
+				nodes[unit] = &graphNode{Unit: unit}
+			}
+		}
+	}
+	for _, node := range nodes {
+		g.Nodes = append(g.Nodes, node)
+	}
+	g.sort()
+	return g, nil
+}
+
+func (g *unitGraph) sort() {
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Unit < g.Nodes[j].Unit })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// Around returns the subgraph of the units connected to the given unit in either direction, i.e. the units a
+// change to it can ripple through and the units it depends on, or nil if the graph doesn't contain the unit.
+func (g *unitGraph) Around(unit string) *unitGraph {
+	adjacent := map[string][]string{}
+	for _, edge := range g.Edges {
+		adjacent[edge.From] = append(adjacent[edge.From], edge.To)
+		adjacent[edge.To] = append(adjacent[edge.To], edge.From)
+	}
+	found := false
+	for _, node := range g.Nodes {
+		found = found || node.Unit == unit
+	}
+	if !found {
+		return nil
+	}
+
+	connected := map[string]bool{unit: true}
+	queue := []string{unit}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range adjacent[current] {
+			if !connected[next] {
+				connected[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	sub := &unitGraph{Nodes: []*graphNode{}, Edges: []*graphEdge{}}
+	for _, node := range g.Nodes {
+		if connected[node.Unit] {
+			sub.Nodes = append(sub.Nodes, node)
+		}
+	}
+	for _, edge := range g.Edges {
+		if connected[edge.From] {
+			sub.Edges = append(sub.Edges, edge)
+		}
+	}
+	return sub
+}
+
+// writeDOT writes the graph in Graphviz's DOT language, e.g. for dot -Tsvg. Units that aren't managed are dashed,
+// and ordering-only dependencies are drawn as dotted edges.
+func writeDOT(w io.Writer, g *unitGraph) {
+	fmt.Fprintf(w, "digraph units {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, node := range g.Nodes {
+		if node.Managed {
+			fmt.Fprintf(w, "\t%s;\n", dotID(node.Unit))
+		} else {
+			fmt.Fprintf(w, "\t%s [style=dashed];\n", dotID(node.Unit))
+		}
+	}
+	for _, edge := range g.Edges {
+		style := ""
+		if edge.Kind == "After" || edge.Kind == "Before" {
+			style = ", style=dotted"
+		}
+		fmt.Fprintf(w, "\t%s -> %s [label=%s%s];\n", dotID(edge.From), dotID(edge.To), dotID(edge.Kind), style)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// dotID quotes a DOT identifier, which only escapes double quotes.
+func dotID(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildGraph(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.service"), []byte("[Unit]\nAfter=network.target db.service\nRequires=db.service\n\n[X-Unitmgr]\nWaitForUnit=cache.service\n\n[Install]\nWantedBy=multi-user.target\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "db.service"), []byte("[Service]\nExecStart=/bin/db\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "sidecar.service"), []byte("[Unit]\nPartOf=web.service\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "other.service"), []byte("[Unit]\nAfter=network.target\n"), 0644))
+
+	g, err := buildGraph([]*reconciler.Reconciler{{Src: src, Group: "unitmgr.target"}})
+	require.NoError(t, err)
+	assert.Contains(t, g.Nodes, &graphNode{Unit: "web.service", Src: src, Managed: true})
+	assert.Contains(t, g.Nodes, &graphNode{Unit: "network.target"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "web.service", To: "db.service", Kind: "After"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "web.service", To: "db.service", Kind: "Requires"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "web.service", To: "cache.service", Kind: "WaitForUnit"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "web.service", To: "multi-user.target", Kind: "WantedBy"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "sidecar.service", To: "web.service", Kind: "PartOf"})
+	assert.Contains(t, g.Edges, &graphEdge{From: "unitmgr.target", To: "db.service", Kind: "Group"})
+
+	// The units connected to db.service, ignoring the group target, which connects every unit
+	g, err = buildGraph([]*reconciler.Reconciler{{Src: src}})
+	require.NoError(t, err)
+	around := g.Around("db.service")
+	var units []string
+	for _, node := range around.Nodes {
+		units = append(units, node.Unit)
+	}
+	assert.Equal(t, []string{"cache.service", "db.service", "multi-user.target", "network.target", "other.service", "sidecar.service", "web.service"}, units)
+	assert.Nil(t, g.Around("missing.service"))
+}
+
+func TestWriteDOT(t *testing.T) {
+	g := &unitGraph{
+		Nodes: []*graphNode{{Unit: "db.service", Managed: true}, {Unit: "network.target"}},
+		Edges: []*graphEdge{{From: "db.service", To: "network.target", Kind: "After"}, {From: "db.service", To: "network.target", Kind: "Wants"}},
+	}
+	buf := &bytes.Buffer{}
+	writeDOT(buf, g)
+	assert.Equal(t, `digraph units {
+	rankdir=LR;
+	node [shape=box];
+	"db.service";
+	"network.target" [style=dashed];
+	"db.service" -> "network.target" [label="After", style=dotted];
+	"db.service" -> "network.target" [label="Wants"];
+}
+`, buf.String())
+}
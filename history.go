@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// snapshotLayout names snapshot files so they sort chronologically.
+const snapshotLayout = "20060102T150405.000000000Z"
+
+// objectsDir is the directory in Dir holding the applied content of the units of every snapshot, named by checksum.
+const objectsDir = "objects"
+
+// snapshot is the managed state at a point in time.
+type snapshot struct {
+	Time  time.Time                    `json:"time"`
+	Units map[string]map[string]string `json:"units"` // src -> unit -> checksum of the applied configuration
+
+	Generations map[string]int64 `json:"generations,omitempty"` // src -> generation of the most recently applied change set
+}
+
+// state returns what identifies the managed state of the snapshot regardless of when it was taken.
+func (s *snapshot) state() ([]byte, error) {
+	return json.Marshal([]interface{}{s.Units, s.Generations})
+}
+
+// historyStore records a snapshot of the managed state in Dir whenever it differs from the previous snapshot.
+type historyStore struct {
+	Dir    string
+	Sealer *reconciler.Sealer // optional, encrypts the snapshots and the stored unit contents
+
+	// Retention of old snapshots, zero values keep every snapshot
+	Keep    int           // most recent snapshots kept
+	MaxAge  time.Duration // snapshots older than this are removed
+	MaxSize int64         // bytes of snapshots kept, oldest are removed first
+
+	last []byte // state of the latest snapshot
+}
+
+// Record writes a snapshot of the reconcilers' state unless it's unchanged since the latest snapshot.
+func (h *historyStore) Record(reconcilers []*reconciler.Reconciler, now time.Time) error {
+	snap := &snapshot{Time: now.UTC(), Units: map[string]map[string]string{}, Generations: map[string]int64{}}
+	for _, rec := range reconcilers {
+		report := rec.Report(true)
+		snap.Units[rec.Src] = report.Units
+		if report.Generation > 0 {
+			snap.Generations[rec.Src] = report.Generation
+		}
+	}
+
+	state, err := snap.state()
+	if err != nil {
+		return err
+	}
+	if h.last == nil {
+		if latest, err := h.At(now); err == nil {
+			h.last, _ = latest.state()
+		}
+	}
+	if string(state) == string(h.last) {
+		return nil
+	}
+
+	if err := h.storeObjects(reconcilers, snap); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := h.write(path.Join(h.Dir, snap.Time.Format(snapshotLayout)+".json"), buf); err != nil {
+		return err
+	}
+	h.last = state
+	return nil
+}
+
+// storeObjects keeps the applied content of the snapshot's units that isn't stored yet, so it can be restored by rollbacks.
+func (h *historyStore) storeObjects(reconcilers []*reconciler.Reconciler, snap *snapshot) error {
+	if err := os.MkdirAll(path.Join(h.Dir, objectsDir), 0700); err != nil {
+		return err
+	}
+	for _, rec := range reconcilers {
+		for _, unit := range sortedKeys(snap.Units[rec.Src]) {
+			checksum := snap.Units[rec.Src][unit]
+			name := h.object(checksum)
+			if _, err := os.Stat(name); err == nil {
+				continue
+			}
+			content, err := rec.ReadApplied(unit)
+			if os.IsNotExist(err) {
+				continue // removed from dest by someone else, it can't be restored
+			}
+			if err != nil {
+				return fmt.Errorf("reading applied unit %s: %w", unit, err)
+			}
+			if rec.ConfigChecksum(content) != checksum {
+				continue // e.g. written but not restarted yet, the applied configuration is unknown
+			}
+			if err := h.write(name, content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *historyStore) object(checksum string) string {
+	return path.Join(h.Dir, objectsDir, checksum)
+}
+
+// write stores a snapshot or unit content, which only root can read since units may hold secrets.
+func (h *historyStore) write(name string, content []byte) error {
+	if h.Sealer != nil {
+		var err error
+		if content, err = h.Sealer.Seal(content); err != nil {
+			return err
+		}
+	}
+	return reconciler.WriteFileAtomicMode(name, content, 0600)
+}
+
+// readFile returns the content of a snapshot or unit content, decrypting it if it was sealed.
+func (h *historyStore) readFile(name string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sealer.Open(buf)
+}
+
+// Seal encrypts the snapshots and unit contents written before the Sealer was configured.
+func (h *historyStore) Seal() error {
+	for _, dir := range []string{h.Dir, path.Join(h.Dir, objectsDir)} {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue // e.g. temporary files
+			}
+			name := path.Join(dir, entry.Name())
+			buf, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if reconciler.IsSealed(buf) {
+				continue
+			}
+			if err := h.write(name, buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List returns the times of every snapshot, oldest first.
+func (h *historyStore) List() ([]time.Time, error) {
+	entries, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []time.Time
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue // e.g. temporary files of snapshots being written
+		}
+		t, err := time.Parse(snapshotLayout, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times, nil
+}
+
+// At returns the latest snapshot taken at or before t, which describes the managed state at t.
+func (h *historyStore) At(t time.Time) (*snapshot, error) {
+	times, err := h.List()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(t) })
+	if i == 0 {
+		return nil, fmt.Errorf("no snapshot was taken before %s", t.Local().Format(time.RFC3339))
+	}
+	return h.read(times[i-1])
+}
+
+// Generation returns the latest snapshot of the given generation of src.
+func (h *historyStore) Generation(src string, generation int64) (*snapshot, error) {
+	times, err := h.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(times) - 1; i >= 0; i-- {
+		snap, err := h.read(times[i])
+		if err != nil {
+			return nil, err
+		}
+		if snap.Generations[src] == generation {
+			return snap, nil
+		}
+	}
+	return nil, fmt.Errorf("no snapshot of generation %d of %s was recorded", generation, src)
+}
+
+func (h *historyStore) read(t time.Time) (*snapshot, error) {
+	buf, err := h.readFile(path.Join(h.Dir, t.Format(snapshotLayout)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{}
+	if err := json.Unmarshal(buf, snap); err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// GC removes the snapshots exceeding the retention, returning how many were removed.
+// The latest snapshot describes the current state, so it's always kept.
+func (h *historyStore) GC(now time.Time) (int, error) {
+	times, err := h.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64 // of this and every newer snapshot
+	removed := 0
+	for i := len(times) - 1; i >= 0; i-- {
+		name := path.Join(h.Dir, times[i].Format(snapshotLayout)+".json")
+		info, err := os.Stat(name)
+		if err != nil {
+			return removed, err
+		}
+		size += info.Size()
+
+		newer := len(times) - 1 - i
+		if newer == 0 {
+			continue
+		}
+		if (h.Keep > 0 && newer >= h.Keep) || (h.MaxAge > 0 && now.Sub(times[i]) > h.MaxAge) || (h.MaxSize > 0 && size > h.MaxSize) {
+			if err := os.Remove(name); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		if err := h.pruneObjects(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// pruneObjects removes the stored unit contents no remaining snapshot references.
+func (h *historyStore) pruneObjects() error {
+	times, err := h.List()
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, t := range times {
+		snap, err := h.read(t)
+		if err != nil {
+			return err
+		}
+		for _, units := range snap.Units {
+			for _, checksum := range units {
+				referenced[checksum] = true
+			}
+		}
+	}
+
+	objects, err := ioutil.ReadDir(path.Join(h.Dir, objectsDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !referenced[object.Name()] {
+			if err := os.Remove(h.object(object.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restore replaces the unit files in the reconciler's src with the ones applied when the snapshot was taken
+// and removes the units that didn't exist then, returning how many files it changed. The next sync applies
+// them like any other change, restarting the affected units. Nothing is changed unless every unit can be restored.
+func (h *historyStore) Restore(rec *reconciler.Reconciler, snap *snapshot) (int, error) {
+	units := snap.Units[rec.Src]
+	contents := make(map[string][]byte, len(units))
+	for unit, checksum := range units {
+		content, err := h.readFile(h.object(checksum))
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("the content of %s wasn't recorded in the snapshot of %s", unit, snap.Time.Local().Format(time.RFC3339))
+		}
+		if err != nil {
+			return 0, err
+		}
+		contents[unit] = content
+	}
+
+	return replaceUnits(rec, contents)
+}
+
+// replaceUnits writes the unit files to the reconciler's Src and removes the others, returning how many files changed.
+func replaceUnits(rec *reconciler.Reconciler, units map[string][]byte) (int, error) {
+	current, err := rec.Units()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, unit := range current {
+		if _, ok := units[unit]; ok {
+			continue
+		}
+		if err := os.Remove(path.Join(rec.Src, unit)); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	for _, unit := range sortedUnits(units) {
+		name := path.Join(rec.Src, unit)
+		if existing, err := ioutil.ReadFile(name); err == nil && bytes.Equal(existing, units[unit]) {
+			continue
+		}
+		if err := reconciler.WriteFileAtomic(name, units[unit]); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// sortedUnits returns the names of the units, sorted.
+func sortedUnits(units map[string][]byte) []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// historyChange is a unit that appeared, disappeared, or changed between two snapshots.
+type historyChange struct {
+	Src    string `json:"src"`
+	Unit   string `json:"unit"`
+	Change string `json:"change"`
+}
+
+func diffSnapshots(a, b *snapshot) []*historyChange {
+	srcs := map[string]bool{}
+	for src := range a.Units {
+		srcs[src] = true
+	}
+	for src := range b.Units {
+		srcs[src] = true
+	}
+
+	var changes []*historyChange
+	for _, src := range sortedSet(srcs) {
+		before, after := a.Units[src], b.Units[src]
+		units := map[string]bool{}
+		for unit := range before {
+			units[unit] = true
+		}
+		for unit := range after {
+			units[unit] = true
+		}
+		for _, unit := range sortedSet(units) {
+			old, existed := before[unit]
+			current, exists := after[unit]
+			switch {
+			case !existed:
+				changes = append(changes, &historyChange{Src: src, Unit: unit, Change: "appeared"})
+			case !exists:
+				changes = append(changes, &historyChange{Src: src, Unit: unit, Change: "disappeared"})
+			case old != current:
+				changes = append(changes, &historyChange{Src: src, Unit: unit, Change: "changed"})
+			}
+		}
+	}
+	return changes
+}
+
+func sortedSet(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseHistoryTime parses an absolute time in local time, "now", or a duration meaning that long ago.
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2021-01-02 15:04, 2h (ago), or now", s)
+}
+
+func historyCommand() int {
+	if *historyD == "" {
+		fmt.Fprintln(os.Stderr, "-history-dir is required")
+		return exitFailed
+	}
+	h, err := newHistoryStore()
+	if err != nil {
+		return setupFailed(err)
+	}
+	args := flag.Args()
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		times, err := h.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while listing snapshots: %s\n", err)
+			return exitFailed
+		}
+		if structured(os.Stdout, times) {
+			return exitConverged
+		}
+		for _, t := range times {
+			fmt.Println(t.Local().Format(time.RFC3339))
+		}
+		return exitConverged
+
+	case len(args) == 3 && args[0] == "diff":
+		now := time.Now()
+		var snaps [2]*snapshot
+		for i, arg := range args[1:] {
+			t, err := parseHistoryTime(arg, now)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitFailed
+			}
+			if snaps[i], err = h.At(t); err != nil {
+				fmt.Fprintf(os.Stderr, "error while reading snapshot: %s\n", err)
+				return exitFailed
+			}
+		}
+		if changes := diffSnapshots(snaps[0], snaps[1]); structured(os.Stdout, changes) {
+			if len(changes) > 0 {
+				return exitChanged
+			}
+		} else if printHistoryDiff(os.Stdout, snaps[0], snaps[1]) {
+			return exitChanged
+		}
+		return exitConverged
+
+	default:
+		fmt.Fprintln(os.Stderr, "usage: unitmgr history list | diff <t1> <t2>")
+		return exitFailed
+	}
+}
+
+// printHistoryDiff writes the changes between two snapshots and returns true if there are any.
+func printHistoryDiff(w io.Writer, a, b *snapshot) bool {
+	changes := diffSnapshots(a, b)
+	several := len(a.Units) > 1 || len(b.Units) > 1
+	for _, change := range changes {
+		if several {
+			fmt.Fprintf(w, "%s %s (%s)\n", change.Change, change.Unit, change.Src)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", change.Change, change.Unit)
+		}
+	}
+	return len(changes) > 0
+}
+
+type gcResult struct {
+	Removed int `json:"removed"`
+}
+
+func gcCommand() int {
+	if *historyD == "" {
+		fmt.Fprintln(os.Stderr, "-history-dir is required")
+		return exitFailed
+	}
+	h, err := newHistoryStore()
+	if err != nil {
+		return setupFailed(err)
+	}
+	if h.Keep == 0 && h.MaxAge == 0 && h.MaxSize == 0 {
+		fmt.Fprintln(os.Stderr, "one of -history-keep, -history-max-age, or -history-max-size is required")
+		return exitFailed
+	}
+
+	removed, err := h.GC(time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while removing snapshots: %s\n", err)
+		return exitFailed
+	}
+	if !structured(os.Stdout, &gcResult{Removed: removed}) {
+		fmt.Printf("removed %d snapshots\n", removed)
+	}
+	return exitConverged
+}
+
+// rollback restores the unit files of a generation of the reconciler's src, see historyStore.Restore.
+func rollback(h *historyStore, rec *reconciler.Reconciler, generation int64) (int, error) {
+	snap, err := h.Generation(rec.Src, generation)
+	if err != nil {
+		return 0, err
+	}
+	restored, err := h.Restore(rec, snap)
+	if err != nil {
+		return restored, err
+	}
+	log.Printf("rolled back %s to generation %d, restored %d unit files", rec.Src, generation, restored)
+	return restored, nil
+}
+
+type rollbackResult struct {
+	Generation int64 `json:"generation"`
+	Restored   int   `json:"restored"`
+}
+
+func rollbackCommand() int {
+	if *historyD == "" || *toGen <= 0 {
+		fmt.Fprintln(os.Stderr, "-history-dir and -to-generation are required")
+		return exitFailed
+	}
+	if *invPath != "" {
+		fmt.Fprintln(os.Stderr, "rollbacks restore the unit files of -src, they can't be combined with -inventory")
+		return exitFailed
+	}
+
+	if *control != "" {
+		restored, err := postRollback(controlClient(*control), *toGen)
+		switch {
+		case err == nil:
+			if !structured(os.Stdout, &rollbackResult{Generation: *toGen, Restored: restored}) {
+				fmt.Printf("restored %d unit files of generation %d, the running instance is applying them\n", restored, *toGen)
+			}
+			return exitConverged
+		case !notRunning(err):
+			fmt.Fprintf(os.Stderr, "error while rolling back: %s\n", err)
+			return exitFailed
+		}
+	}
+
+	// No instance is running, so apply the restored files with a one-shot sync
+	h, err := newHistoryStore()
+	if err != nil {
+		return setupFailed(err)
+	}
+	restored, err := rollback(h, &reconciler.Reconciler{Src: *src}, *toGen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while rolling back: %s\n", err)
+		return exitFailed
+	}
+	if *output == "table" {
+		fmt.Printf("restored %d unit files of generation %d\n", restored, *toGen) // structured output is left to the sync
+	}
+	return syncCommand()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{"a.service": "1", "b.service": "2"}}
+
+	h := &historyStore{Dir: dir}
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(time.Minute))) // unchanged
+
+	r.State = map[string]string{"a.service": "3", "c.service": "4"}
+	h = &historyStore{Dir: dir} // the latest snapshot is read after restarts
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(time.Hour)))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(2*time.Hour)))
+
+	// Ignores temporary files
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".20210101T000000.000000000Z.json.tmp"), nil, 0644))
+
+	times, err := h.List()
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{t1, t1.Add(time.Hour)}, times)
+
+	_, err = h.At(t1.Add(-time.Second))
+	assert.Error(t, err)
+
+	before, err := h.At(t1.Add(time.Minute * 30))
+	require.NoError(t, err)
+	assert.Equal(t, t1, before.Time)
+	assert.Equal(t, map[string]string{"a.service": "1", "b.service": "2"}, before.Units["/src"])
+
+	after, err := h.At(t1.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, t1.Add(time.Hour), after.Time)
+
+	// Generations that didn't change the applied units, e.g. starting stopped units, are recorded too
+	r.SetGeneration(2)
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(3*time.Hour)))
+	latest, err := h.At(t1.Add(3 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"/src": 2}, latest.Generations)
+
+	buf := &bytes.Buffer{}
+	assert.True(t, printHistoryDiff(buf, before, after))
+	assert.Equal(t, "changed a.service\ndisappeared b.service\nappeared c.service\n", buf.String())
+	assert.False(t, printHistoryDiff(buf, after, after))
+}
+
+func TestHistoryRollback(t *testing.T) {
+	src := t.TempDir()
+	dir := t.TempDir()
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+	h := &historyStore{Dir: dir}
+	write := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644))
+	}
+
+	write("a.service", "a1")
+	write("b.service", "b1")
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1))
+
+	write("a.service", "a2")
+	write("c.service", "c2")
+	require.NoError(t, os.Remove(filepath.Join(src, "b.service")))
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(time.Hour)))
+	require.Equal(t, int64(2), r.Generation())
+
+	_, err := rollback(h, r, 7)
+	assert.EqualError(t, err, "no snapshot of generation 7 of "+src+" was recorded")
+
+	// Every unit file is restored, including the removed ones
+	restored, err := rollback(h, r, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, restored)
+	units, err := r.Units()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.service", "b.service"}, units)
+	content, err := ioutil.ReadFile(filepath.Join(src, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a1", string(content))
+
+	// Applying the rollback is a new generation
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, int64(3), r.Generation())
+	content, err = ioutil.ReadFile(filepath.Join(r.Dest, "b.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "b1", string(content))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(2*time.Hour)))
+
+	// Contents only referenced by removed snapshots are removed too
+	h.Keep = 1
+	_, err = h.GC(t1.Add(2 * time.Hour))
+	require.NoError(t, err)
+	objects, err := ioutil.ReadDir(filepath.Join(dir, objectsDir))
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	// Nothing is restored unless every unit's content was recorded
+	write("a.service", "a3")
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, objectsDir)))
+	_, err = rollback(h, r, 3)
+	assert.Error(t, err)
+	content, err = ioutil.ReadFile(filepath.Join(src, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a3", string(content))
+}
+
+func TestHistoryStoreSealed(t *testing.T) {
+	src := t.TempDir()
+	dir := t.TempDir()
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.service"), []byte("password=hunter2"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, (&historyStore{Dir: dir}).Record([]*reconciler.Reconciler{r}, t1))
+
+	// Files written before the key was configured are encrypted
+	sealer, err := reconciler.NewSealer([]byte("key"))
+	require.NoError(t, err)
+	h := &historyStore{Dir: dir, Sealer: sealer}
+	require.NoError(t, h.Seal())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.service"), []byte("password=hunter3"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(time.Hour)))
+
+	for _, pattern := range []string{"*.json", filepath.Join(objectsDir, "*")} {
+		names, err := filepath.Glob(filepath.Join(dir, pattern))
+		require.NoError(t, err)
+		require.Len(t, names, 2)
+		for _, name := range names {
+			buf, err := ioutil.ReadFile(name)
+			require.NoError(t, err)
+			assert.True(t, reconciler.IsSealed(buf), name)
+			assert.NotContains(t, string(buf), "hunter")
+			stat, err := os.Stat(name)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), stat.Mode().Perm(), name)
+		}
+	}
+
+	_, err = rollback(h, r, 1)
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(src, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "password=hunter2", string(content))
+
+	_, err = (&historyStore{Dir: dir}).At(t1)
+	assert.ErrorIs(t, err, reconciler.ErrSealed)
+}
+
+func TestDiffSnapshotsSeveralSrcs(t *testing.T) {
+	a := &snapshot{Units: map[string]map[string]string{"/host1": {"a.service": "1"}}}
+	b := &snapshot{Units: map[string]map[string]string{"/host1": {"a.service": "1"}, "/host2": {"a.service": "1"}}}
+
+	buf := &bytes.Buffer{}
+	assert.True(t, printHistoryDiff(buf, a, b))
+	assert.Equal(t, "appeared a.service (/host2)\n", buf.String())
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		in       string
+		expected time.Time
+	}{
+		{"now", now},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"2021-01-01T00:00:00Z", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2021-01-01 12:30", time.Date(2021, 1, 1, 12, 30, 0, 0, time.Local)},
+		{"2021-01-01", time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		actual, err := parseHistoryTime(tc.in, now)
+		require.NoError(t, err, tc.in)
+		assert.True(t, tc.expected.Equal(actual), tc.in)
+	}
+
+	_, err := parseHistoryTime("yesterday", now)
+	assert.Error(t, err)
+}
+
+func TestHistoryGC(t *testing.T) {
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := func(t *testing.T, h *historyStore, n int) {
+		r := &reconciler.Reconciler{Src: "/src", State: map[string]string{}}
+		for i := 0; i < n; i++ {
+			r.State["a.service"] = strconv.Itoa(i)
+			require.NoError(t, h.Record([]*reconciler.Reconciler{r}, t1.Add(time.Duration(i)*time.Hour)))
+		}
+	}
+	now := t1.Add(4 * time.Hour)
+
+	t.Run("unlimited", func(t *testing.T) {
+		h := &historyStore{Dir: t.TempDir()}
+		record(t, h, 5)
+		removed, err := h.GC(now)
+		require.NoError(t, err)
+		assert.Equal(t, 0, removed)
+	})
+
+	t.Run("count", func(t *testing.T) {
+		h := &historyStore{Dir: t.TempDir(), Keep: 2}
+		record(t, h, 5)
+		removed, err := h.GC(now)
+		require.NoError(t, err)
+		assert.Equal(t, 3, removed)
+
+		times, err := h.List()
+		require.NoError(t, err)
+		assert.Equal(t, []time.Time{t1.Add(3 * time.Hour), t1.Add(4 * time.Hour)}, times)
+	})
+
+	t.Run("age", func(t *testing.T) {
+		h := &historyStore{Dir: t.TempDir(), MaxAge: 90 * time.Minute}
+		record(t, h, 5)
+		removed, err := h.GC(now)
+		require.NoError(t, err)
+		assert.Equal(t, 3, removed)
+
+		// The latest snapshot is kept regardless of its age
+		removed, err = h.GC(now.Add(24 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		times, err := h.List()
+		require.NoError(t, err)
+		assert.Equal(t, []time.Time{now}, times)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		dir := t.TempDir()
+		h := &historyStore{Dir: dir}
+		record(t, h, 5)
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+
+		h.MaxSize = entries[0].Size()*2 + 1
+		removed, err := h.GC(now)
+		require.NoError(t, err)
+		assert.Equal(t, 3, removed)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// incident is a problem that needs attention, identified by Key across syncs.
+type incident struct {
+	Key     string // e.g. /units/web.service/failing
+	Summary string
+	Details map[string]string
+}
+
+// incidentNotifier opens and resolves incidents in a paging system like PagerDuty or Opsgenie.
+type incidentNotifier interface {
+	Trigger(inc *incident) error
+	Resolve(key string) error
+}
+
+// incidentManager opens incidents for units that keep failing to be reconciled for longer than After,
+// or that are flapping, and resolves them once the units recover.
+type incidentManager struct {
+	Notifiers []incidentNotifier
+	After     time.Duration
+
+	failing map[string]time.Time // key -> when the problem was first seen
+	open    map[string]bool
+	ch      chan []*reconciler.HostReport
+	now     func() time.Time
+
+	mu     sync.Mutex
+	synced bool
+	ok     bool // outcome of the last sync
+}
+
+func newIncidentManager(notifiers []incidentNotifier, after time.Duration) *incidentManager {
+	return &incidentManager{
+		Notifiers: notifiers,
+		After:     after,
+		failing:   map[string]time.Time{},
+		open:      map[string]bool{},
+		ch:        make(chan []*reconciler.HostReport, 1),
+		now:       time.Now,
+	}
+}
+
+// Synced queues the state of the reconcilers after a sync to be checked for incidents.
+func (m *incidentManager) Synced(reconcilers []*reconciler.Reconciler, ok bool) {
+	m.mu.Lock()
+	m.synced, m.ok = true, ok
+	m.mu.Unlock()
+	m.Refresh(reconcilers)
+}
+
+// Refresh queues the state of the reconcilers between syncs, e.g. once unit restarts were checked.
+func (m *incidentManager) Refresh(reconcilers []*reconciler.Reconciler) {
+	m.mu.Lock()
+	synced, ok := m.synced, m.ok
+	m.mu.Unlock()
+	if !synced {
+		return
+	}
+
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(ok)
+	}
+
+	// Only the latest state matters, replace the queued one if it hasn't been checked yet
+	select {
+	case <-m.ch:
+	default:
+	}
+	select {
+	case m.ch <- reports:
+	default:
+	}
+}
+
+// Run checks the queued states until the queue is closed.
+func (m *incidentManager) Run() {
+	for reports := range m.ch {
+		m.check(reports)
+	}
+}
+
+// Close stops accepting states, Run returns once the queued one is checked.
+func (m *incidentManager) Close() {
+	close(m.ch)
+}
+
+// check triggers and resolves incidents. Incidents that couldn't be delivered are retried by the next check.
+func (m *incidentManager) check(reports []*reconciler.HostReport) {
+	now := m.now()
+	current := map[string]*incident{}
+	for _, report := range reports {
+		generation := strconv.FormatInt(report.Generation, 10) // that was current when the problem was seen
+		for unit, msg := range report.Failures {
+			key := report.Src + "/" + unit + "/failing"
+			current[key] = &incident{
+				Key:     key,
+				Summary: fmt.Sprintf("unitmgr is failing to reconcile %s on %s", unit, report.Host),
+				Details: map[string]string{"host": report.Host, "src": report.Src, "unit": unit, "error": msg, "generation": generation},
+			}
+		}
+		if !report.OK && len(report.Failures) == 0 {
+			key := report.Src + "/failing"
+			current[key] = &incident{
+				Key:     key,
+				Summary: fmt.Sprintf("unitmgr is failing to sync %s on %s", report.Src, report.Host),
+				Details: map[string]string{"host": report.Host, "src": report.Src, "generation": generation},
+			}
+		}
+		for unit, stability := range report.Stability {
+			if !stability.Flapping {
+				continue
+			}
+			key := report.Src + "/" + unit + "/flapping"
+			current[key] = &incident{
+				Key:     key,
+				Summary: fmt.Sprintf("%s on %s is crash looping", unit, report.Host),
+				Details: map[string]string{"host": report.Host, "src": report.Src, "unit": unit, "restarts": fmt.Sprintf("%d in the last hour", stability.Restarts), "generation": generation},
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := m.failing[key]; !ok {
+			m.failing[key] = now
+		}
+		if m.open[key] || (now.Sub(m.failing[key]) < m.After && !isFlapping(key)) {
+			continue
+		}
+		if m.deliver(func(n incidentNotifier) error { return n.Trigger(current[key]) }) {
+			log.Printf("opened incident: %s", current[key].Summary)
+			m.open[key] = true
+		}
+	}
+
+	for key := range m.failing {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		if !m.open[key] {
+			delete(m.failing, key)
+			continue
+		}
+		if m.deliver(func(n incidentNotifier) error { return n.Resolve(key) }) {
+			log.Printf("resolved incident: %s", key)
+			delete(m.open, key)
+			delete(m.failing, key)
+		}
+	}
+}
+
+// isFlapping is true for the keys of flapping units, which don't need to persist for long to be a problem.
+func isFlapping(key string) bool {
+	return strings.HasSuffix(key, "/flapping")
+}
+
+// deliver returns true if every notifier succeeded.
+func (m *incidentManager) deliver(fn func(n incidentNotifier) error) bool {
+	ok := true
+	for _, n := range m.Notifiers {
+		if err := fn(n); err != nil {
+			log.Printf("error while updating incident: %s", err)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncidentManager(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := &fakeIncidents{}
+	m := newIncidentManager([]incidentNotifier{n}, 15*time.Minute)
+	m.now = func() time.Time { return now }
+
+	failing := []*reconciler.HostReport{{Host: "host1", Src: "/src", Failures: map[string]string{"a.service": "oops"}}}
+	m.check(failing)
+	assert.Empty(t, n.Calls)
+
+	// Failing for longer than the threshold
+	now = now.Add(15 * time.Minute)
+	m.check(failing)
+	assert.Equal(t, []string{"trigger /src/a.service/failing: unitmgr is failing to reconcile a.service on host1"}, n.Calls)
+	m.check(failing)
+	assert.Len(t, n.Calls, 1) // already open
+
+	// Flapping units don't have to wait for the threshold
+	flapping := []*reconciler.HostReport{{
+		Host:      "host1",
+		Src:       "/src",
+		OK:        true,
+		Stability: map[string]*reconciler.UnitStability{"b.service": {Restarts: 9, Flapping: true}},
+	}}
+	n.Calls = nil
+	m.check(flapping)
+	assert.Equal(t, []string{
+		"trigger /src/b.service/flapping: b.service on host1 is crash looping",
+		"resolve /src/a.service/failing",
+	}, n.Calls)
+
+	// Failed deliveries are retried
+	n.Calls = nil
+	n.Err = errors.New("oops")
+	m.check([]*reconciler.HostReport{{Host: "host1", Src: "/src", OK: true}})
+	n.Err = nil
+	m.check([]*reconciler.HostReport{{Host: "host1", Src: "/src", OK: true}})
+	assert.Equal(t, []string{"resolve /src/b.service/flapping", "resolve /src/b.service/flapping"}, n.Calls)
+
+	// Units that recover before the threshold never open an incident
+	n.Calls = nil
+	m.check([]*reconciler.HostReport{{Host: "host1", Src: "/src"}})
+	now = now.Add(time.Minute)
+	m.check([]*reconciler.HostReport{{Host: "host1", Src: "/src", OK: true}})
+	assert.Empty(t, n.Calls)
+	assert.Empty(t, m.failing)
+}
+
+func TestIncidentManagerQueue(t *testing.T) {
+	n := &fakeIncidents{}
+	m := newIncidentManager([]incidentNotifier{n}, 0)
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{}, Failures: map[string]string{"a.service": "oops"}}
+
+	m.Refresh([]*reconciler.Reconciler{r}) // ignored until the first sync
+	m.Synced([]*reconciler.Reconciler{r}, false)
+	m.Close()
+	m.Run()
+	require.Len(t, n.Calls, 1)
+	assert.Contains(t, n.Calls[0], "trigger /src/a.service/failing")
+}
+
+type fakeIncidents struct {
+	Calls []string
+	Err   error
+}
+
+func (f *fakeIncidents) Trigger(inc *incident) error {
+	f.Calls = append(f.Calls, "trigger "+inc.Key+": "+inc.Summary)
+	return f.Err
+}
+
+func (f *fakeIncidents) Resolve(key string) error {
+	f.Calls = append(f.Calls, "resolve "+key)
+	return f.Err
+}
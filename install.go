@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+)
+
+const installName = "unitmgr.service"
+
+// installSandbox hardens the unitmgr service without preventing it from writing unit files,
+// reading sources and ssh keys, or talking to systemd.
+var installSandbox = []string{
+	"NoNewPrivileges=yes",
+	"ProtectSystem=true",
+	"ProtectHome=read-only",
+	"PrivateTmp=yes",
+	"ProtectKernelTunables=yes",
+	"ProtectKernelModules=yes",
+	"ProtectKernelLogs=yes",
+	"ProtectControlGroups=yes",
+	"ProtectClock=yes",
+	"ProtectHostname=yes",
+	"RestrictNamespaces=yes",
+	"RestrictRealtime=yes",
+	"RestrictSUIDSGID=yes",
+	"LockPersonality=yes",
+	"MemoryDenyWriteExecute=yes",
+	"SystemCallArchitectures=native",
+}
+
+// installResult is what the install command prints with -output json or yaml.
+type installResult struct {
+	Unit    string `json:"unit"`
+	Changed bool   `json:"changed"` // the unit file was written and the service restarted
+}
+
+// installCommand writes a unit file running unitmgr with the given flags, then enables and (re)starts it.
+// Running it again updates the unit file and only restarts unitmgr if the file changed.
+func installCommand() int {
+	if *backendN != "systemd" || *host != "" || *invPath != "" {
+		fmt.Fprintln(os.Stderr, "install requires the systemd backend on the local host")
+		return exitFailed
+	}
+	if *dest == "" {
+		*dest = backends["systemd"].Dest
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while finding the unitmgr binary: %s\n", err)
+		return exitFailed
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+
+	name := path.Join(*dest, installName)
+	content := installUnit(exe, args, *runAs, *privilege == "sudo", *readyB)
+	current, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "error while reading %s: %s\n", name, err)
+		return exitFailed
+	}
+	changed := !bytes.Equal(current, content)
+	if changed {
+		if err := reconciler.WriteFileAtomic(name, content); err != nil {
+			fmt.Fprintf(os.Stderr, "error while writing %s: %s\n", name, err)
+			return exitFailed
+		}
+	}
+
+	sysd := systemd.NewSystemctl(&systemd.Config{
+		Dir:           *dest,
+		Timeout:       *timeout,
+		QueryTimeout:  *timeoutQ,
+		StartTimeout:  *timeoutS,
+		ReloadTimeout: *timeoutR,
+	})
+	ctx := context.Background()
+	if err := sysd.Enable(ctx, installName); err != nil {
+		fmt.Fprintf(os.Stderr, "error while enabling %s: %s\n", installName, err)
+		return exitFailed
+	}
+	if changed {
+		err = sysd.Restart(ctx, installName)
+	} else {
+		_, err = sysd.EnsureRunning(ctx, installName)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while starting %s: %s\n", installName, err)
+		return exitFailed
+	}
+
+	log.Printf("installed %s", name)
+	structured(os.Stdout, &installResult{Unit: name, Changed: changed})
+	return exitConverged
+}
+
+// installUnit returns the unit file running unitmgr from exe with the given flags, optionally as an unprivileged user.
+// Escalating with sudo requires the sandbox to allow gaining privileges. With a before target, unitmgr is started
+// before it and only reports being started once it converged, bounded by -ready-timeout rather than systemd.
+func installUnit(exe string, args []string, user string, sudo bool, before string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Managed by unitmgr install, changes will be overwritten\n")
+	fmt.Fprintf(buf, "[Unit]\nDescription=Systemd unit manager\nAfter=network-online.target\nWants=network-online.target\n")
+	if before != "" {
+		fmt.Fprintf(buf, "Before=%s\n", before)
+	}
+	fmt.Fprintf(buf, "\n[Service]\nExecStart=%s\nRestart=always\nRestartSec=5\n", execLine(append([]string{exe, "run"}, args...)))
+	if before != "" {
+		fmt.Fprintf(buf, "Type=notify\nTimeoutStartSec=infinity\n")
+	}
+	if user != "" {
+		fmt.Fprintf(buf, "User=%s\n", user)
+	}
+	for _, directive := range installSandbox {
+		if sudo && (directive == "NoNewPrivileges=yes" || directive == "RestrictSUIDSGID=yes") {
+			continue
+		}
+		fmt.Fprintln(buf, directive)
+	}
+	fmt.Fprintf(buf, "\n[Install]\nWantedBy=multi-user.target\n")
+	if before != "" && before != "multi-user.target" {
+		fmt.Fprintf(buf, "WantedBy=%s\n", before)
+	}
+	return buf.Bytes()
+}
+
+// execLine quotes the arguments of an ExecStart= command line.
+func execLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		// Specifiers and environment variables are expanded by systemd
+		arg = strings.ReplaceAll(arg, "%", "%%")
+		arg = strings.ReplaceAll(arg, "$", "$$")
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\;") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
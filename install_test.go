@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallUnit(t *testing.T) {
+	unit := string(installUnit("/usr/local/bin/unitmgr", []string{"-src=/opt/units", "-lint=strict"}, "", false, ""))
+	assert.Contains(t, unit, "\nExecStart=/usr/local/bin/unitmgr run -src=/opt/units -lint=strict\n")
+	assert.Contains(t, unit, "\nNoNewPrivileges=yes\n")
+	assert.Contains(t, unit, "\nWantedBy=multi-user.target\n")
+	assert.NotContains(t, unit, "User=")
+
+	// sudo can't gain privileges with NoNewPrivileges
+	unit = string(installUnit("/usr/local/bin/unitmgr", []string{"-privilege=sudo"}, "unitmgr", true, ""))
+	assert.Contains(t, unit, "\nUser=unitmgr\n")
+	assert.NotContains(t, unit, "NoNewPrivileges")
+	assert.NotContains(t, unit, "RestrictSUIDSGID")
+	assert.NotContains(t, unit, "Type=notify")
+
+	// Ordering before a target waits for the first successful sync
+	unit = string(installUnit("/usr/local/bin/unitmgr", nil, "", false, "cloud-init.target"))
+	assert.Contains(t, unit, "\nBefore=cloud-init.target\n")
+	assert.Contains(t, unit, "\nType=notify\n")
+	assert.Contains(t, unit, "\nWantedBy=multi-user.target\nWantedBy=cloud-init.target\n")
+}
+
+func TestExecLine(t *testing.T) {
+	assert.Equal(t, `/bin/unitmgr run`, execLine([]string{"/bin/unitmgr", "run"}))
+	assert.Equal(t, `/bin/unitmgr "-src=/my units" "-report-token=a\"b" -lint-disable=`, execLine([]string{"/bin/unitmgr", "-src=/my units", `-report-token=a"b`, "-lint-disable="}))
+	assert.Equal(t, `/bin/unitmgr -src=/units/%%i/$$HOME`, execLine([]string{"/bin/unitmgr", "-src=/units/%i/$HOME"}))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalEntry is a log message of a managed unit.
+type journalEntry struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Unit     string    `json:"unit"`
+	Priority int       `json:"priority"` // syslog priority, 0 (emerg) to 7 (debug)
+	Message  string    `json:"message"`
+}
+
+// parseJournalEntry parses a line of journalctl -o json.
+func parseJournalEntry(line []byte) (*journalEntry, error) {
+	var fields struct {
+		Realtime string          `json:"__REALTIME_TIMESTAMP"`
+		Hostname string          `json:"_HOSTNAME"`
+		Unit     string          `json:"_SYSTEMD_UNIT"`
+		Priority string          `json:"PRIORITY"`
+		Message  json.RawMessage `json:"MESSAGE"`
+	}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+
+	usec, err := strconv.ParseInt(fields.Realtime, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", fields.Realtime)
+	}
+	entry := &journalEntry{
+		Time: time.Unix(0, usec*int64(time.Microsecond)).UTC(),
+		Host: fields.Hostname,
+		Unit: fields.Unit,
+	}
+	entry.Priority, err = strconv.Atoi(fields.Priority)
+	if err != nil {
+		entry.Priority = 6 // info, the default of journald
+	}
+
+	// Messages that aren't valid utf-8 are encoded as arrays of bytes
+	if err := json.Unmarshal(fields.Message, &entry.Message); err != nil {
+		var raw []byte
+		var ints []int
+		if err := json.Unmarshal(fields.Message, &ints); err != nil {
+			return nil, fmt.Errorf("invalid message: %s", err)
+		}
+		for _, b := range ints {
+			raw = append(raw, byte(b))
+		}
+		entry.Message = string(bytes.ToValidUTF8(raw, []byte("�")))
+	}
+	return entry, nil
+}
+
+// journalSink receives batches of journal entries.
+type journalSink interface {
+	Send(entries []*journalEntry) error
+}
+
+// newJournalSink returns the sink for a path or url: a file that entries are appended to as json lines,
+// an http(s) url that batches are posted to as json arrays, or a loki+http(s) url of a Loki server.
+func newJournalSink(target string, timeout time.Duration) (journalSink, error) {
+	if !strings.Contains(target, "://") {
+		return &fileSink{Path: target}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	switch u.Scheme {
+	case "file":
+		return &fileSink{Path: u.Path}, nil
+	case "http", "https":
+		return &httpSink{URL: target, Client: client}, nil
+	case "loki+http", "loki+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "loki+")
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/loki/api/v1/push"
+		}
+		return &lokiSink{URL: u.String(), Client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported journal sink %q", target)
+	}
+}
+
+type fileSink struct {
+	Path string
+}
+
+func (f *fileSink) Send(entries []*journalEntry) error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+type httpSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *httpSink) Send(entries []*journalEntry) error {
+	return postJSON(h.Client, h.URL, entries)
+}
+
+// lokiSink pushes entries to Loki, labeled by host and unit.
+type lokiSink struct {
+	URL    string
+	Client *http.Client
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // nanosecond timestamp, line
+}
+
+func (l *lokiSink) Send(entries []*journalEntry) error {
+	var streams []*lokiStream
+	index := map[[2]string]*lokiStream{}
+	for _, entry := range entries {
+		key := [2]string{entry.Host, entry.Unit}
+		stream, ok := index[key]
+		if !ok {
+			stream = &lokiStream{Stream: map[string]string{"job": "unitmgr", "host": entry.Host, "unit": entry.Unit}}
+			index[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), entry.Message})
+	}
+	return postJSON(l.Client, l.URL, map[string]interface{}{"streams": streams})
+}
+
+func postJSON(client *http.Client, url string, body interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// journalForwarder tails the journal and forwards the entries of managed units to a sink.
+type journalForwarder struct {
+	Sink     journalSink
+	Priority string // passed to journalctl -p, e.g. err to only forward errors
+	Command  string // optional, defaults to journalctl
+
+	// Forward returns true for the units whose entries are forwarded, given when the entry was logged.
+	Forward func(unit string, at time.Time) bool
+
+	mu      sync.Mutex
+	pending []*journalEntry
+}
+
+const (
+	journalBatchSize     = 100
+	journalFlushInterval = time.Second
+	journalMaxPending    = 10000 // entries are dropped when the sink falls behind
+)
+
+// Run forwards entries until the context is canceled, restarting journalctl if it exits.
+func (j *journalForwarder) Run(ctx context.Context) {
+	go j.flushLoop(ctx)
+	for {
+		if err := j.tail(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error while reading the journal: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func (j *journalForwarder) tail(ctx context.Context) error {
+	command := j.Command
+	if command == "" {
+		command = "journalctl"
+	}
+	args := []string{"--follow", "--output=json", "--lines=0"}
+	if j.Priority != "" {
+		args = append(args, "--priority="+j.Priority)
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, err := parseJournalEntry(scanner.Bytes())
+		if err != nil {
+			log.Printf("error while parsing journal entry: %s", err)
+			continue
+		}
+		if entry.Unit != "" && j.Forward(entry.Unit, entry.Time) {
+			j.add(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+func (j *journalForwarder) add(entry *journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.pending) >= journalMaxPending {
+		return
+	}
+	j.pending = append(j.pending, entry)
+}
+
+func (j *journalForwarder) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(journalFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			j.flush()
+			return
+		case <-ticker.C:
+			j.flush()
+		}
+	}
+}
+
+// flush sends the pending entries in batches, keeping them for the next flush if the sink fails.
+func (j *journalForwarder) flush() {
+	for {
+		j.mu.Lock()
+		n := len(j.pending)
+		if n > journalBatchSize {
+			n = journalBatchSize
+		}
+		batch := j.pending[:n]
+		j.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		if err := j.Sink.Send(batch); err != nil {
+			log.Printf("error while forwarding journal entries: %s", err)
+			return
+		}
+
+		j.mu.Lock()
+		j.pending = j.pending[n:]
+		j.mu.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJournalEntry(t *testing.T) {
+	entry, err := parseJournalEntry([]byte(`{"__REALTIME_TIMESTAMP":"1609459200000001","_HOSTNAME":"host1","_SYSTEMD_UNIT":"web.service","PRIORITY":"3","MESSAGE":"oops"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &journalEntry{
+		Time:     time.Date(2021, 1, 1, 0, 0, 0, 1000, time.UTC),
+		Host:     "host1",
+		Unit:     "web.service",
+		Priority: 3,
+		Message:  "oops",
+	}, entry)
+
+	// Binary messages
+	entry, err = parseJournalEntry([]byte(`{"__REALTIME_TIMESTAMP":"1609459200000000","MESSAGE":[104,105,255]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "hi�", entry.Message)
+	assert.Equal(t, 6, entry.Priority)
+
+	_, err = parseJournalEntry([]byte(`{"MESSAGE":"no timestamp"}`))
+	assert.Error(t, err)
+}
+
+func TestNewJournalSink(t *testing.T) {
+	sink, err := newJournalSink("/var/log/units.log", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, &fileSink{Path: "/var/log/units.log"}, sink)
+
+	sink, err = newJournalSink("file:///var/log/units.log", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, &fileSink{Path: "/var/log/units.log"}, sink)
+
+	sink, err = newJournalSink("https://logs.example.com/ingest", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "https://logs.example.com/ingest", sink.(*httpSink).URL)
+
+	sink, err = newJournalSink("loki+http://loki:3100", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "http://loki:3100/loki/api/v1/push", sink.(*lokiSink).URL)
+
+	_, err = newJournalSink("ftp://example.com", time.Second)
+	assert.Error(t, err)
+}
+
+func TestJournalSinks(t *testing.T) {
+	entries := []*journalEntry{
+		{Time: time.Unix(1, 0).UTC(), Host: "host1", Unit: "a.service", Priority: 6, Message: "one"},
+		{Time: time.Unix(2, 0).UTC(), Host: "host1", Unit: "b.service", Priority: 3, Message: "two"},
+		{Time: time.Unix(3, 0).UTC(), Host: "host1", Unit: "a.service", Priority: 6, Message: "three"},
+	}
+
+	t.Run("file", func(t *testing.T) {
+		name := path.Join(t.TempDir(), "units.log")
+		sink := &fileSink{Path: name}
+		require.NoError(t, sink.Send(entries[:1]))
+		require.NoError(t, sink.Send(entries[1:2]))
+
+		content, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, `{"time":"1970-01-01T00:00:01Z","host":"host1","unit":"a.service","priority":6,"message":"one"}`+"\n"+
+			`{"time":"1970-01-01T00:00:02Z","host":"host1","unit":"b.service","priority":3,"message":"two"}`+"\n", string(content))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		var received []*journalEntry
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			json.NewDecoder(r.Body).Decode(&received)
+		}))
+		defer server.Close()
+
+		require.NoError(t, (&httpSink{URL: server.URL, Client: server.Client()}).Send(entries))
+		assert.Equal(t, entries, received)
+	})
+
+	t.Run("loki", func(t *testing.T) {
+		var received struct {
+			Streams []*lokiStream `json:"streams"`
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&received)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		require.NoError(t, (&lokiSink{URL: server.URL, Client: server.Client()}).Send(entries))
+		assert.Equal(t, []*lokiStream{
+			{Stream: map[string]string{"job": "unitmgr", "host": "host1", "unit": "a.service"}, Values: [][2]string{{"1000000000", "one"}, {"3000000000", "three"}}},
+			{Stream: map[string]string{"job": "unitmgr", "host": "host1", "unit": "b.service"}, Values: [][2]string{{"2000000000", "two"}}},
+		}, received.Streams)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+		assert.EqualError(t, (&httpSink{URL: server.URL, Client: server.Client()}).Send(entries), "unexpected status 502")
+	})
+}
+
+func TestJournalForwarder(t *testing.T) {
+	// Fake journalctl printing a few entries before exiting
+	dir := t.TempDir()
+	fake := path.Join(dir, "journalctl")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\ncat <<'EOF'\n" +
+		`{"__REALTIME_TIMESTAMP":"1000000","_SYSTEMD_UNIT":"managed.service","PRIORITY":"3","MESSAGE":"one"}` + "\n" +
+		`{"__REALTIME_TIMESTAMP":"2000000","_SYSTEMD_UNIT":"other.service","PRIORITY":"3","MESSAGE":"two"}` + "\n" +
+		`not json` + "\n" +
+		`{"__REALTIME_TIMESTAMP":"3000000","MESSAGE":"kernel"}` + "\n" +
+		`{"__REALTIME_TIMESTAMP":"4000000","_SYSTEMD_UNIT":"managed.service","PRIORITY":"3","MESSAGE":"three"}` + "\n" +
+		"EOF\n"
+	require.NoError(t, ioutil.WriteFile(fake, []byte(script), 0755))
+
+	sink := &recordingSink{}
+	j := &journalForwarder{
+		Sink:     sink,
+		Priority: "err",
+		Command:  fake,
+		Forward:  func(unit string, at time.Time) bool { return unit == "managed.service" },
+	}
+	require.NoError(t, j.tail(context.Background()))
+	j.flush()
+
+	args, err := ioutil.ReadFile(path.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--follow --output=json --lines=0 --priority=err\n", string(args))
+
+	require.Len(t, sink.Entries, 2)
+	assert.Equal(t, "one", sink.Entries[0].Message)
+	assert.Equal(t, "three", sink.Entries[1].Message)
+	assert.Empty(t, j.pending)
+}
+
+func TestJournalForwarderRetries(t *testing.T) {
+	sink := &recordingSink{Err: assert.AnError}
+	j := &journalForwarder{Sink: sink}
+	for i := 0; i < journalBatchSize+1; i++ {
+		j.add(&journalEntry{Message: "test"})
+	}
+
+	// Entries are kept until the sink accepts them
+	j.flush()
+	assert.Len(t, j.pending, journalBatchSize+1)
+
+	sink.Err = nil
+	j.flush()
+	assert.Empty(t, j.pending)
+	assert.Len(t, sink.Entries, journalBatchSize+1)
+}
+
+type recordingSink struct {
+	Entries []*journalEntry
+	Err     error
+}
+
+func (r *recordingSink) Send(entries []*journalEntry) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	r.Entries = append(r.Entries, entries...)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// leaderLease elects a single active instance among several unitmgr processes sharing a network-mounted src.
+//
+// The lease is a file holding the current leader's identity and expiration time.
+// Instances take over expired leases and the leader renews its lease well before it expires.
+// This relies on roughly synchronized clocks between the instances.
+type leaderLease struct {
+	Path string
+	ID   string
+	TTL  time.Duration
+
+	mu   sync.Mutex
+	held bool
+}
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *leaderLease) Run() {
+	for {
+		held, err := l.Acquire(time.Now())
+		if err != nil {
+			log.Printf("error while acquiring leader lease: %s", err)
+		}
+
+		l.mu.Lock()
+		if held != l.held {
+			if held {
+				log.Printf("acquired leader lease %s", l.Path)
+			} else {
+				log.Printf("lost leader lease %s", l.Path)
+			}
+		}
+		l.held = held
+		l.mu.Unlock()
+
+		time.Sleep(l.TTL / 3)
+	}
+}
+
+// Held returns true while this instance is the leader.
+func (l *leaderLease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// Acquire takes or renews the lease if it's available.
+func (l *leaderLease) Acquire(now time.Time) (bool, error) {
+	current, err := l.read()
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if current != nil && current.Holder != l.ID && now.Before(current.Expires) {
+		return false, nil // held by another instance
+	}
+	if current != nil && current.Holder == l.ID && current.Expires.Sub(now) > l.TTL/2 {
+		return true, nil // no need to renew yet
+	}
+
+	buf, err := json.Marshal(&leaseRecord{Holder: l.ID, Expires: now.Add(l.TTL)})
+	if err != nil {
+		return false, err
+	}
+	if err := reconciler.WriteFileAtomic(l.Path, buf); err != nil {
+		return false, err
+	}
+
+	// Another instance may have written the lease concurrently, the last write wins
+	current, err = l.read()
+	if err != nil {
+		return false, err
+	}
+	return current.Holder == l.ID, nil
+}
+
+func (l *leaderLease) read() (*leaseRecord, error) {
+	buf, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &leaseRecord{}
+	if err := json.Unmarshal(buf, record); err != nil {
+		return nil, fmt.Errorf("decoding lease: %w", err)
+	}
+	return record, nil
+}
+
+func defaultLeaseID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
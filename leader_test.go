@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderLease(t *testing.T) {
+	name := path.Join(t.TempDir(), ".unitmgr-leader")
+	a := &leaderLease{Path: name, ID: "a", TTL: time.Minute}
+	b := &leaderLease{Path: name, ID: "b", TTL: time.Minute}
+	now := time.Now()
+
+	held, err := a.Acquire(now)
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	held, err = b.Acquire(now.Add(time.Second))
+	require.NoError(t, err)
+	assert.False(t, held)
+
+	// The leader renews its lease before it expires
+	held, err = a.Acquire(now.Add(time.Second * 40))
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	held, err = b.Acquire(now.Add(time.Second * 90))
+	require.NoError(t, err)
+	assert.False(t, held)
+
+	// Expired leases are taken over
+	held, err = b.Acquire(now.Add(time.Second * 101))
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	held, err = a.Acquire(now.Add(time.Second * 102))
+	require.NoError(t, err)
+	assert.False(t, held)
+}
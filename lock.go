@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the given file, which is held until the file is closed or the process exits.
+func lockFile(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder, _ := ioutil.ReadAll(file)
+		file.Close()
+		if pid := strings.TrimSpace(string(holder)); pid != "" {
+			return nil, fmt.Errorf("another unitmgr instance (pid %s) holds the lock on %s", pid, name)
+		}
+		return nil, fmt.Errorf("another unitmgr instance holds the lock on %s", name)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %w", name, err)
+	}
+
+	// Record the holder to make the error more helpful for other instances
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+
+	return file, nil
+}
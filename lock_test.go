@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	name := path.Join(t.TempDir(), ".unitmgr.lock")
+
+	file, err := lockFile(name)
+	require.NoError(t, err)
+
+	_, err = lockFile(name)
+	assert.EqualError(t, err, fmt.Sprintf("another unitmgr instance (pid %d) holds the lock on %s", os.Getpid(), name))
+
+	file.Close()
+	file, err = lockFile(name)
+	require.NoError(t, err)
+	file.Close()
+}
@@ -3,270 +3,1447 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
 )
 
+var (
+	src       = flag.String("src", ".", "path to directory containing your unit files")
+	dest      = flag.String("dest", "", "path to the init system's unit file directory (defaults to /etc/systemd/system for systemd)")
+	destRoots = flag.String("dest-roots", "", "comma-separated unit directories besides -dest that units can select with Root= in their [X-Unitmgr] section, the first below /run also holds units with Placement=runtime")
+	backendN  = flag.String("backend", "systemd", "init system managing the units: "+strings.Join(backendNames(), ", "))
+	resync    = flag.Duration("resync", time.Hour, "how often to check for unit file consistency")
+	retry     = flag.Duration("retry", time.Second, "initial delay before retrying failed operations, doubled after every consecutive failure")
+	retryM    = flag.Duration("retry-max", time.Minute*5, "maximum delay between retries of failed operations")
+	timeout   = flag.Duration("timeout", time.Second*10, "timeout for systemctl operations")
+	timeoutQ  = flag.Duration("timeout-query", 0, "timeout for checking whether units are running (defaults to -timeout)")
+	timeoutS  = flag.Duration("timeout-start", 0, "timeout for starting and restarting units (defaults to -timeout)")
+	timeoutA  = flag.Float64("timeout-start-factor", 0, "time out starts and restarts of units with at least 5 recorded restarts after this multiple of their 99th percentile restart duration, at least 10s, instead of -timeout-start, zero to disable")
+	timeoutP  = flag.Duration("timeout-stop", 0, "timeout for stopping units (defaults to -timeout)")
+	timeoutR  = flag.Duration("timeout-reload", 0, "timeout for systemd daemon-reloads (defaults to -timeout)")
+	jobMode   = flag.String("job-mode", "wait", "what to do when systemd already has a job queued for a unit, e.g. a manual stop: wait for it to finish (up to the operation's timeout), replace it, or fail")
+	rebootM   = flag.String("reboot", "report", "what to do when applied unit changes require a reboot, e.g. for units in early boot targets: report it in the status, or schedule a reboot")
+	rebootW   = flag.String("reboot-window", "", "maintenance window for scheduled reboots in local time, e.g. \"Sat,Sun 02:00-04:00\" (defaults to any time)")
+	reexec    = flag.Bool("reexec", false, "re-execute systemd with systemctl daemon-reexec once its binary or package on disk is newer than the running manager, e.g. after an upgrade")
+	reexecW   = flag.String("reexec-window", "", "maintenance window for -reexec in local time, e.g. \"Sat,Sun 02:00-04:00\" (defaults to any time)")
+	stabI     = flag.Duration("stability-interval", 0, "how often to check how many times managed units restarted, zero to disable")
+	flapN     = flag.Int("flap-threshold", 5, "report units as flapping when they restart more than this many times an hour without changes to their unit files")
+	journalS  = flag.String("journal-sink", "", "forward the journal entries of managed units to this file, http(s) url, or loki+http(s) url of a Loki server")
+	journalP  = flag.String("journal-priority", "", "only forward journal entries of this syslog priority or more important, e.g. err (defaults to every entry)")
+	journalW  = flag.Duration("journal-after-change", 0, "only forward journal entries logged within this duration after unitmgr changed their unit, zero to forward every entry")
+	smtpAddr  = flag.String("smtp-server", "", "email a digest of the changes and failures of every sync through this SMTP server (host:port)")
+	smtpFrom  = flag.String("smtp-from", "", "sender address of notification emails")
+	smtpTo    = flag.String("smtp-to", "", "comma-separated recipients of notification emails")
+	smtpUser  = flag.String("smtp-user", "", "user to authenticate to the SMTP server as, which requires TLS")
+	smtpPass  = flag.String("smtp-password", "", "password of -smtp-user, preferably set with UNITMGR_SMTP_PASSWORD")
+	routesF   = flag.String("notify-routes", "", "path to a json file routing notifications to email addresses or webhooks by unit, event, and severity")
+	pdKey     = flag.String("pagerduty-key", "", "integration key of a PagerDuty service to open incidents in for failing and flapping units")
+	ogKey     = flag.String("opsgenie-key", "", "api key of an Opsgenie integration to open alerts with for failing and flapping units")
+	ogURL     = flag.String("opsgenie-url", opsgenieURL, "url of the Opsgenie api, e.g. https://api.eu.opsgenie.com")
+	incAfter  = flag.Duration("incident-after", time.Minute*15, "open incidents for units that keep failing to be reconciled for this long")
+	onExit    = flag.String("on-exit", "leave", "what to do with managed units when unitmgr terminates: leave them running, or stop them")
+	once      = flag.Bool("once", false, "perform a single sync and exit, same as the sync command")
+	statePath = flag.String("state", "", "path to a file used to persist the state of applied units across restarts")
+	stateTTL  = flag.Duration("state-tombstone-ttl", 0, "forget units recorded in -state that were removed from -src longer ago than this instead of stopping and removing them, e.g. when restoring an old state file, zero to always remove them")
+	encKey    = flag.String("encryption-key", "", "path to a key encrypting the -state file and the -source-url cache at rest, generated if it doesn't exist, e.g. a TPM-sealed systemd credential")
+	statusF   = flag.String("status-file", "", "path to a json file describing the state of every managed unit, replaced after every sync")
+	historyD  = flag.String("history-dir", "", "directory to record a snapshot of the managed state to whenever it changes, see the history command")
+	historyK  = flag.Int("history-keep", 0, "number of history snapshots to keep, zero to keep every snapshot")
+	historyA  = flag.Duration("history-max-age", 0, "remove history snapshots older than this, zero to keep every snapshot")
+	historyS  = flag.String("history-max-size", "", "total size of history snapshots to keep, e.g. 100M (defaults to unlimited)")
+	bundleK   = flag.String("bundle-key", "", "path to the pem encoded ed25519 public key verifying the bundles of apply-bundle")
+	toGen     = flag.Int64("to-generation", 0, "generation of -src to restore with the rollback command")
+	metricsD  = flag.String("metrics-dir", "", "directory of node_exporter's textfile collector to write unitmgr.prom to after every sync")
+	readyB    = flag.String("ready-before", "", "with install, run unitmgr as a Type=notify service ordered before this target, e.g. multi-user.target, so it waits for the first successful sync")
+	readyT    = flag.Duration("ready-timeout", time.Minute*5, "signal readiness to systemd this long after starting even if no sync succeeded, zero to wait forever")
+	waitConv  = flag.Bool("converged", false, "with the wait command, wait until the running instance applied every unit")
+	waitT     = flag.Duration("wait-timeout", 0, "how long the wait command waits, zero to wait forever")
+	topI      = flag.Duration("top-interval", time.Second*2, "how often the top command refreshes")
+	redactP   = flag.String("redact", reconciler.DefaultRedactPattern, "regular expression of the environment variables, directives, and options whose values are redacted from the unit content of diffs, logs, and reports, empty to disable")
+	configF   = flag.String("config", "", "comma-separated json files of flag values merged in order, e.g. defaults, environment, then host class, with later files, environment variables, and the command line taking precedence")
+	output    = flag.String("output", "table", "format of command output: table, json, or yaml")
+	control   = flag.String("control-socket", "/run/unitmgr.sock", "path to the unix socket serving the status of the running instance, empty to disable")
+	atomic    = flag.Bool("atomic", false, "verify every changed unit file before applying any of them, holding back all changes while any is invalid")
+	maxSize   = flag.String("max-unit-size", "", "skip files in -src larger than this with a warning rather than applying them, e.g. 1M (defaults to unlimited)")
+	guardLoad = flag.Float64("restart-max-load", 0, "defer restarts of changed units while the 1 minute load average per cpu exceeds this, zero to disable")
+	guardMem  = flag.String("restart-min-memory", "", "defer restarts of changed units while less memory than this is available, e.g. 512M")
+	guardDisk = flag.String("restart-min-disk", "", "defer restarts of changed units while the file system of -dest has less free space than this, e.g. 1G")
+	freezeCal = flag.String("freeze-calendar", "", "http(s) URL or path of an iCal feed or JSON calendar of change freezes, during which restarts of changed units are deferred")
+	freezeCp  = flag.Bool("freeze-copies", false, "also defer writing changed unit files during change freezes, rather than only restarting them")
+	freezeI   = flag.Duration("freeze-interval", 15*time.Minute, "how often -freeze-calendar is read again")
+	checksumA = flag.String("checksum", "sha256", "algorithm of unit file checksums: "+strings.Join(reconciler.HasherNames(), ", "))
+	reloadDr  = flag.Bool("reload-drift", true, "daemon-reload during full syncs when systemd reports its loaded configuration of managed units as stale with NeedDaemonReload, e.g. after out-of-band edits of their drop-ins")
+	normalize = flag.Bool("normalize", false, "don't restart units for changes to comments, whitespace, or key order")
+	portable  = flag.Bool("portable", false, "tolerate unit files authored on other platforms like Windows: convert their CRLF line endings and byte order marks when writing them, and warn about these and other artifacts like typographic quotes")
+	sanitize  = flag.Bool("sanitize", false, "write unit files with LF line endings and a trailing newline and without a byte order mark, rejecting files that aren't valid UTF-8")
+	activate  = flag.Bool("activation", true, "leave starting services to the .socket or .timer of the same name in -src, stopping and removing them together")
+	group     = flag.String("group", "", "target whose .wants directory links every applied unit so they start and are ordered as a group, e.g. unitmgr.target")
+	execHooks = flag.Bool("exit-hooks", false, "run the ExecOnHealthy= and ExecOnFailed= commands units declare in [X-Unitmgr] when they become healthy or fail")
+	restartD  = flag.Bool("restart-dependents", false, "also restart the active units that declare Requires=, BindsTo=, or PartOf= on a restarted unit")
+	semantic  = flag.Bool("semantic-restart", false, "reload or re-enable changed units instead of restarting them when only directives that allow it changed")
+	audit     = flag.Bool("audit-only", false, "never write unit files or manage units, only log and report the changes that would be made")
+	workers   = flag.Int("workers", 4, "number of units to reconcile concurrently")
+	poll      = flag.String("poll", "auto", "poll source directories for changes instead of relying on inotify: auto (for network and fuse mounts), always, or never")
+	pollI     = flag.Duration("poll-interval", time.Second*5, "how often to poll source directories")
+	settle    = flag.Duration("debounce", time.Millisecond*250, "wait for file changes to settle for this long before syncing")
+	pol       = flag.String("policy", "", "path to a json file of policy rules that unit files must satisfy before being applied")
+	lint      = flag.String("lint", "off", "lint unit files before applying them: off, warn, or strict (block units with findings)")
+	nolint    = flag.String("lint-disable", "", "comma-separated list of lint rules to skip")
+	secscan   = flag.Bool("security-score", false, "score applied services with systemd-analyze security")
+	secmax    = flag.Float64("security-threshold", 0, "stop services with an exposure score above this value (requires -security-score)")
+	fleetL    = flag.String("fleet-listen", "", "run as a fleet server on this address, serving the units in -src to agents")
+	fleetS    = flag.String("fleet-server", "", "run as a fleet agent, mirroring units assigned by the fleet server at this url into -src")
+	fleetNS   = flag.String("fleet-namespaces", "", "path to a json file of namespaces whose units teams may alter through the fleet server's api")
+	fleetA    = flag.String("fleet-assignments", "", "path to a json file assigning the profiles in -src/profiles to fleet hosts, host groups, and label selectors")
+	opsToken  = flag.String("fleet-operations-token", "", "hex sha256 of the operator bearer token allowed to start operations, e.g. restarts, on fleet agents, resume rollouts, and read the fleet's units and reports")
+	fleetI    = flag.Duration("fleet-interval", time.Second*30, "how often fleet agents poll the server")
+	sourceU   = flag.String("source-url", "", "mirror the unit files listed by the json manifest at this url into -src")
+	sourceC   = flag.String("source-cache", "", "content-addressed cache of files downloaded from -source-url, or the repository -git-url is fetched into (defaults to .unitmgr-cache in -src)")
+	templates = flag.Bool("templates", false, "render files in -src named <unit>.tmpl with Go templates into <unit> next to them, see Templates")
+	cloud     = flag.String("cloud", "", "make the instance metadata of this cloud available to templates as .Cloud: "+strings.Join(cloudNames(), ", "))
+	renderI   = flag.Duration("render-interval", time.Second*10, "how often to render templates")
+	consulA   = flag.String("consul-addr", "", "address of the Consul agent resolving the key, keyOrDefault, ls, and service functions of templates, e.g. http://127.0.0.1:8500")
+	consulT   = flag.String("consul-token", "", "acl token of -consul-addr, preferably set with UNITMGR_CONSUL_TOKEN")
+	vaultA    = flag.String("vault-addr", "", "address of the Vault server resolving the secret function of templates, e.g. https://vault.example.com:8200")
+	vaultT    = flag.String("vault-token", "", "token of -vault-addr, preferably set with UNITMGR_VAULT_TOKEN")
+	dnsTTL    = flag.Duration("dns-ttl", time.Second*30, "how long the DNS lookups of templates are cached before resolving them again")
+	bootstrap = flag.String("bootstrap", "", "on first boot, write the unit bundle embedded in this user-data file or http(s) url into -src before starting -source-url, -git-url, or -fleet-server, e.g. /var/lib/cloud/instance/user-data.txt")
+	sourceI   = flag.Duration("source-interval", time.Second*30, "how often to poll -source-url or -git-url")
+	gitURL    = flag.String("git-url", "", "mirror the unit files of this git repository into -src")
+	gitRef    = flag.String("git-ref", "main", "branch, tag, tag glob (e.g. release-*), or semver range (e.g. ^1.4) of -git-url to mirror, until the promote command pins another")
+	gitPath   = flag.String("git-path", "", "directory of -git-url holding the unit files (defaults to the top level)")
+	gitStat   = flag.String("git-status", "", "write the reconciliation status of the mirrored commit back to -git-url: notes (a note per commit in refs/notes/unitmgr/<host>) or branch (status.json in unitmgr/status/<host>)")
+	dlPar     = flag.Int("download-parallel", 4, "number of files downloaded from -source-url concurrently")
+	dlTO      = flag.Duration("download-timeout", time.Minute*5, "timeout for downloading a single file from -source-url or running a git command for -git-url, interrupted downloads are resumed by the next poll")
+	pollWhen  = flag.String("poll-when", "", "comma-separated host conditions required to poll -source-url, -git-url, or -fleet-server: "+strings.Join(hostConditionNames(), ", ")+", e.g. unmetered,exec:/usr/local/bin/on-wifi")
+	pollWin   = flag.String("poll-window", "", "only poll -source-url, -git-url, or -fleet-server within this window of local time, e.g. \"Sat,Sun 01:00-05:00\"")
+	batMax    = flag.String("battery-max-download", "", "defer downloading files from -source-url larger than this size, e.g. 1M, while the host runs on battery")
+	dlRate    = flag.String("download-rate", "", "bandwidth limit of downloads from -source-url in bytes per second, e.g. 1M (defaults to unlimited)")
+	rollPct   = flag.Int("rollout-percent", 0, "percentage of fleet agents that may be updating at once, zero to update every agent immediately")
+	rollTO    = flag.Duration("rollout-timeout", time.Minute*10, "halt a rollout when an updated agent doesn't report healthy within this duration")
+	tlsCert   = flag.String("tls-cert", "", "path to the fleet certificate")
+	tlsKey    = flag.String("tls-key", "", "path to the fleet certificate's private key")
+	tlsCA     = flag.String("tls-ca", "", "path to the CA bundle used to verify fleet peers")
+	enrollF   = flag.String("fleet-enrollments", "", "path to a json file of single-use bootstrap tokens agents exchange for a client certificate of their host, requires -enroll-ca-key")
+	enrollK   = flag.String("enroll-ca-key", "", "path to the key of the first CA in -tls-ca, which signs the certificates of enrolled agents")
+	enrollT   = flag.String("enroll-token", "", "path to a bootstrap token a fleet agent without a -tls-cert exchanges for its client certificate")
+	repURL    = flag.String("report-url", "", "periodically post the host's reconciliation status to this url")
+	repTok    = flag.String("report-token", "", "bearer token sent with status reports")
+	repI      = flag.Duration("report-interval", time.Minute, "how often to post status reports")
+	host      = flag.String("host", "", "manage a remote host by forwarding systemctl operations with systemctl -H and writing unit files over ssh")
+	lockF     = flag.String("lock-file", "", "path to a lock file preventing several instances from managing the same units (defaults to <dest>/.unitmgr.lock)")
+	lease     = flag.String("leader-lease", "", "path to a lease file shared by several instances, only the instance holding the lease applies changes")
+	leaseT    = flag.Duration("leader-ttl", time.Second*30, "how long the leader lease is valid without being renewed")
+	privilege = flag.String("privilege", "none", "how unitmgr gets the privileges to manage units when it isn't root: none, sudo, or polkit")
+	runAs     = flag.String("user", "", "unprivileged user running unitmgr, used by the install and privileges commands")
+	filesOnly = flag.Bool("files-only", false, "only sync unit files without managing services, e.g. in containers or image builds without a running systemd")
+	sandboxed = flag.Bool("sandbox", false, "restrict unitmgr's filesystem access with landlock and deny unneeded syscalls with seccomp")
+	invPath   = flag.String("inventory", "", "path to a json inventory of remote hosts to manage over ssh instead of the local host")
+)
+
+type command struct {
+	Name        string
+	Description string
+	Args        bool       // accepts positional arguments
+	Run         func() int // returns the process exit code
+}
+
+var commands = []command{
+	{"run", "sync continuously, the default", false, runCommand},
+	{"sync", "perform a single sync and exit with 0 when converged, 3 when changes were applied, 2 on invalid configuration, 4, 5, 6, or 7 on source, copy, systemd, or validation errors, or 1 on other errors", false, syncCommand},
+	{"status", "print the status of the running instance", false, statusCommand},
+	{"top", "show the managed units of the running instance and their recent changes, refreshed every -top-interval", false, topCommand},
+	{"diff", "print the changes the next sync would make and exit with 3 if there are any", false, diffCommand},
+	{"graph", "print the dependencies of the managed units as DOT, optionally only those connected to the given unit", true, graphCommand},
+	{"history", "list snapshots of -history-dir, or diff <t1> <t2> to print the units that changed in between", true, historyCommand},
+	{"apply-bundle", "verify the signed offline bundle at the given path and apply its units to -src", true, applyBundleCommand},
+	{"rollback", "restore the unit files of -src to -to-generation recorded in -history-dir and apply them", false, rollbackCommand},
+	{"queue", "list the restarts and reboots postponed by the running instance, or run or cancel one, e.g. queue run restart:web.service", true, queueCommand},
+	{"promote", "pin -git-url to a branch, tag, tag glob, or semver range, e.g. promote v1.4.2", true, promoteCommand},
+	{"gc", "remove the snapshots of -history-dir exceeding the -history-* retention", false, gcCommand},
+	{"state", "check the -state file for entries that could stop, remove, or restart the wrong units, or repair or compact it while unitmgr isn't running", true, stateCommand},
+	{"verify", "hash the applied unit files again and compare them with the recorded checksums and systemd's loaded configuration, exiting with 1 on discrepancies", false, verifyCommand},
+	{"validate", "lint and evaluate the policy against every unit file and exit with 1 on problems", false, validateCommand},
+	{"privileges", "print the polkit rule or sudoers entry allowing -user to run unitmgr with -privilege", false, privilegesCommand},
+	{"privileged", "run a single operation of -privilege=sudo as root, see privileges", true, privilegedCommand},
+	{"install", "install, enable, and start unitmgr as a systemd service running with the given flags", false, installCommand},
+	{"wait", "wait until the running instance converged, e.g. wait -converged -wait-timeout 10m", false, waitCommand},
+	{"validate-config", "check the flags, environment, and -config layers for unknown flags, invalid values, and conflicts, and exit with 2 on problems", false, validateConfigCommand},
+	{"config", "print the -config layers, or with show --effective every flag after merging them with the environment and command line", true, configCommand},
+	{"version", "print version and build information", false, versionCommand},
+}
+
 func main() {
-	var (
-		src     = flag.String("src", ".", "path to directory containing your unit files")
-		dest    = flag.String("dest", "/etc/systemd/system", "path to systemd's unit file directory")
-		resync  = flag.Duration("resync", time.Hour, "how often to check for unit file consistency")
-		retry   = flag.Duration("retry", time.Second, "how often to retry failed operations")
-		timeout = flag.Duration("timeout", time.Second*10, "timeout for systemctl operations")
-	)
-	flag.Parse()
-
-	watcher, err := fsnotify.NewWatcher()
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "privileged" {
+		// Run by sudo as root, it mustn't read flags, the environment, or -config, which the caller controls
+		os.Exit(privilegedCommand())
+	}
+
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	recordSources(flag.CommandLine, "command line")
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	recordSources(flag.CommandLine, "environment")
+	layers, err := loadConfigLayers(*configF)
+	if err == nil {
+		if errs := validateConfig(flag.CommandLine, layers); len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(exitConfig)
+		}
+		configLayers = layers
+		var sources map[string]string
+		sources, err = applyConfig(flag.CommandLine, layers)
+		for name, source := range sources {
+			flagSources[name] = source
+		}
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	redactor, err := newRedactor()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	log.SetOutput(redactor.Writer(os.Stderr))
+	if !validOutput(*output) {
+		fmt.Fprintf(os.Stderr, "invalid value %q for -output, expected one of %s\n", *output, strings.Join(outputFormats, ", "))
+		os.Exit(2)
 	}
-	defer watcher.Close()
 
-	if err := os.MkdirAll(*src, 0755); err != nil {
-		panic(err)
+	for _, cmd := range commands {
+		if cmd.Name != name {
+			continue
+		}
+		if flag.NArg() > 0 && !cmd.Args {
+			fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(cmd.Run())
 	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+	flag.Usage()
+	os.Exit(2)
+}
 
-	err = watcher.Add(*src)
-	if err != nil {
-		panic(err)
+// ConfigError is returned by setup and the constructors of the components it configures for invalid flags and
+// configuration, like unknown modes, conflicting flags, or a policy that can't be parsed.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// configErrorf returns a ConfigError with the formatted message.
+func configErrorf(format string, args ...interface{}) error {
+	return &ConfigError{Err: fmt.Errorf(format, args...)}
+}
+
+// invalidConfig returns err as a ConfigError, or nil if it's nil.
+func invalidConfig(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ConfigError{Err: err}
+}
+
+// setupFailed prints an error returned by setup or a constructor and returns the exit code: exitConfig for a
+// ConfigError, along with the -config layers that set the flags it names, and exitFailed otherwise.
+func setupFailed(err error) int {
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		fmt.Fprintf(os.Stderr, "unitmgr: %s\n", err)
+		return exitFailed
 	}
+	fmt.Fprintf(os.Stderr, "unitmgr: %s%s\n", err, configLocations(err.Error()))
+	return exitConfig
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: unitmgr [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.Name, cmd.Description)
+	}
+	fmt.Fprintf(out, "\nFlags can also be set by environment variables, e.g. UNITMGR_RETRY_MAX for -retry-max, or by the json files of -config.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// applyEnv sets flags that weren't given on the command line from their UNITMGR_* environment variables.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
 
-	state := map[string]string{}
-	sysd := &systemctl{Timeout: *timeout}
-	err = runLoop(watcher, func() time.Duration {
-		if sync(*src, *dest, state, sysd) {
-			return *resync
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		key := envName(f.Name)
+		value, ok := lookup(key)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", value, key, setErr)
 		}
-		return *retry
 	})
+	return err
+}
+
+func envName(flagName string) string {
+	return "UNITMGR_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// newRedactor returns nil unless -redact is set.
+func newRedactor() (*reconciler.Redactor, error) {
+	redactor, err := reconciler.NewRedactor(*redactP)
+	return redactor, invalidConfig(err)
+}
+
+// setup validates the flags and builds a reconciler for the local host or every host in the inventory.
+// The first return value reconciles -src and is the source of status reports.
+func setup() (*reconciler.Reconciler, []*reconciler.Reconciler, error) {
+	if *onExit != "leave" && *onExit != "stop" {
+		return nil, nil, configErrorf("unknown on-exit mode %q", *onExit)
+	}
+	if *jobMode != "wait" && *jobMode != "replace" && *jobMode != "fail" {
+		return nil, nil, configErrorf("unknown job mode %q", *jobMode)
+	}
+	if *rebootM != "report" && *rebootM != "schedule" {
+		return nil, nil, configErrorf("unknown reboot mode %q", *rebootM)
+	}
+
+	b, ok := backends[*backendN]
+	if !ok {
+		return nil, nil, configErrorf("unknown backend %q", *backendN)
+	}
+	if *backendN != "systemd" && (*host != "" || *invPath != "" || *secscan || *group != "") {
+		return nil, nil, configErrorf("-host, -inventory, -security-score, and -group require the systemd backend")
+	}
+	if !privilegeModes[*privilege] {
+		return nil, nil, configErrorf("unknown privilege mode %q", *privilege)
+	}
+	if *privilege == "sudo" && (*host != "" || *invPath != "" || *backendN != "systemd") {
+		return nil, nil, configErrorf("-privilege=sudo is only supported for local hosts with the systemd backend")
+	}
+	helper := ""
+	if *privilege == "sudo" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, nil, err
+		}
+		helper = exe
+	}
+	if *filesOnly && *secscan {
+		return nil, nil, configErrorf("-security-score requires managing services, it can't be combined with -files-only")
+	}
+	if *journalS != "" && (*backendN != "systemd" || *host != "" || *invPath != "" || *filesOnly) {
+		return nil, nil, configErrorf("-journal-sink requires managing services of the local host with the systemd backend")
+	}
+	if *reexec && (*backendN != "systemd" || *host != "" || *invPath != "") {
+		return nil, nil, configErrorf("-reexec requires managing the local host with the systemd backend")
+	}
+	if *destRoots != "" && (*backendN != "systemd" || *host != "" || *invPath != "" || *privilege == "sudo") {
+		return nil, nil, configErrorf("-dest-roots requires writing the unit files of the local host with the systemd backend")
+	}
+	hasher, ok := reconciler.Hashers[*checksumA]
+	if !ok {
+		return nil, nil, configErrorf("unknown checksum algorithm %q", *checksumA)
+	}
+	if *checksumA != "sha256" && (*host != "" || *invPath != "" || *fleetS != "" || *fleetL != "") {
+		return nil, nil, configErrorf("-host, -inventory, and fleet mode require the sha256 checksum algorithm")
+	}
+	if *privilege == "sudo" && *sandboxed {
+		return nil, nil, configErrorf("-sandbox prevents escalating privileges with sudo")
+	}
+	if *sandboxed {
+		if err := sandboxSupported(); err != nil {
+			return nil, nil, configErrorf("-sandbox can't be used: %s", err)
+		}
+	}
+	if *dest == "" {
+		*dest = b.Dest
+	}
+
+	newBackendConfig := func(host string) *systemd.Config {
+		return &systemd.Config{
+			Dir:           *dest,
+			Host:          host,
+			Timeout:       *timeout,
+			QueryTimeout:  *timeoutQ,
+			StartTimeout:  *timeoutS,
+			StopTimeout:   *timeoutP,
+			ReloadTimeout: *timeoutR,
+			Prefix:        privilegePrefix(*privilege, helper, *dest),
+			JobMode:       *jobMode,
+		}
+	}
+	sysd := b.New(newBackendConfig(*host))
+	cache := reconciler.NewChecksumCache()
+	cache.Hasher = hasher
+	r := &reconciler.Reconciler{
+		Src:       *src,
+		Dest:      *dest,
+		State:     map[string]string{},
+		Systemd:   sysd,
+		Backoff:   reconciler.NewBackoff(*retry, *retryM),
+		Cache:     cache,
+		Hasher:    hasher,
+		Workers:   *workers,
+		Normalize: *normalize,
+		Semantic:  *semantic,
+		Audit:     *audit,
+		Atomic:    *atomic,
+	}
+	r.Dependents, r.Activation, r.Group = *restartD, *activate, *group
+	r.Sanitize, r.Portable = *sanitize, *portable
+	if *execHooks {
+		r.OnState = append(r.OnState, (&exitHooks{Src: *src, Timeout: *timeout}).Hook)
+	}
+	if b.Target != nil {
+		r.Target = b.Target(newBackendConfig(*host))
+		if runit, ok := r.Target.(*reconciler.RunitDir); ok {
+			runit.Hasher = hasher
+		}
+	}
+	if *host != "" {
+		r.Target = &sshDir{Address: *host, Dir: *dest, Timeout: *timeout}
+	}
+	if *privilege == "sudo" {
+		r.Target = &sudoDir{LocalDir: reconciler.LocalDir{Dir: *dest, Cache: r.Cache}, Timeout: *timeout, Helper: helper}
+	}
+	if *destRoots != "" {
+		roots := &reconciler.RootDirs{Default: *dest, Src: *src}
+		for _, dir := range reconciler.SortRoots(destRootDirs()) {
+			roots.Roots = append(roots.Roots, &reconciler.LocalDir{Dir: dir, Cache: r.Cache})
+			if roots.Runtime == "" && strings.HasPrefix(path.Clean(dir), "/run/") {
+				roots.Runtime = dir // the first tmpfs directory holds runtime units
+			}
+		}
+		r.Target = roots
+	}
+	if *secscan {
+		r.Security = reconciler.NewSecurityReport(*secmax, sysd.(*systemd.Systemctl).SecurityScore)
+	}
+	if *stabI > 0 {
+		r.Stability = reconciler.NewStabilityTracker(*flapN)
+	}
+	r.Durations = reconciler.NewDurationTracker(*timeoutA)
+	if ctl, ok := sysd.(*systemd.Systemctl); ok && *timeoutA > 0 {
+		ctl.UnitTimeout = r.Durations.Timeout
+	}
+	var err error
+	if *maxSize != "" {
+		if r.MaxSize, err = reconciler.ParseByteSize(*maxSize); err != nil {
+			return nil, nil, invalidConfig(err)
+		}
+	}
+	if *guardLoad > 0 || *guardMem != "" || *guardDisk != "" {
+		if *host != "" || *invPath != "" {
+			return nil, nil, configErrorf("-restart-max-load, -restart-min-memory, and -restart-min-disk measure the local host and can't be used with -host or -inventory")
+		}
+		r.Guard = &reconciler.ResourceGuard{MaxLoad: *guardLoad, DiskPath: *dest}
+		if *guardMem != "" {
+			if r.Guard.MinMemory, err = reconciler.ParseByteSize(*guardMem); err != nil {
+				return nil, nil, invalidConfig(err)
+			}
+		}
+		if *guardDisk != "" {
+			if r.Guard.MinDisk, err = reconciler.ParseByteSize(*guardDisk); err != nil {
+				return nil, nil, invalidConfig(err)
+			}
+		}
+	}
+	if r.Redact, err = newRedactor(); err != nil {
+		return nil, nil, err
+	}
+	r.ReloadDrift = *reloadDr
+	if *freezeCal != "" {
+		cal := &freezeCalendar{Source: *freezeCal, Client: &http.Client{Timeout: *timeout}}
+		if err := cal.Refresh(context.Background()); err != nil {
+			log.Printf("error while reading the freeze calendar, retrying every %s: %s", *freezeI, err)
+		}
+		r.Freeze, r.FreezeCopies = cal, *freezeCp
+	}
+	if *pol != "" {
+		r.Policy, err = reconciler.LoadPolicy(*pol)
+		if err != nil {
+			return nil, nil, invalidConfig(err)
+		}
+	}
+
+	r.Linter, err = reconciler.NewLinter(*lint, *nolint)
 	if err != nil {
-		panic(err)
+		return nil, nil, invalidConfig(err)
 	}
-}
 
-func runLoop(watcher *fsnotify.Watcher, fn func() time.Duration) error {
-	ticker := time.NewTimer(1)
-	defer ticker.Stop()
+	if *invPath == "" {
+		if *filesOnly {
+			r.Systemd = systemd.Noop{}
+		}
+		return r, []*reconciler.Reconciler{r}, nil
+	}
+
+	inv, err := loadInventory(*invPath, *src)
+	if err != nil {
+		return nil, nil, invalidConfig(err)
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			ticker.Reset(fn())
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return nil
+	var reconcilers []*reconciler.Reconciler
+	for _, host := range inv.Hosts {
+		hostSysd := b.New(newBackendConfig(host.Address)).(*systemd.Systemctl)
+		hr := &reconciler.Reconciler{
+			Src:       host.Src,
+			Target:    &sshDir{Address: host.Address, Dir: *dest, Timeout: *timeout},
+			State:     map[string]string{},
+			Systemd:   hostSysd,
+			Policy:    r.Policy,
+			Linter:    r.Linter,
+			Backoff:   reconciler.NewBackoff(*retry, *retryM),
+			Cache:     reconciler.NewChecksumCache(),
+			Workers:   *workers,
+			Normalize: *normalize,
+			Semantic:  *semantic,
+			Audit:     *audit,
+			Atomic:    *atomic,
+		}
+		if *secscan {
+			hr.Security = reconciler.NewSecurityReport(*secmax, hostSysd.SecurityScore)
+		}
+		if *stabI > 0 {
+			hr.Stability = reconciler.NewStabilityTracker(*flapN)
+		}
+		hr.Durations = reconciler.NewDurationTracker(*timeoutA)
+		if *timeoutA > 0 {
+			hostSysd.UnitTimeout = hr.Durations.Timeout
+		}
+		hr.MaxSize = r.MaxSize
+		hr.Dependents, hr.Activation, hr.Group = r.Dependents, r.Activation, r.Group
+		hr.OnState, hr.Sanitize, hr.Portable = r.OnState, r.Sanitize, r.Portable
+		hr.Freeze, hr.FreezeCopies = r.Freeze, r.FreezeCopies
+		hr.Redact, hr.ReloadDrift = r.Redact, r.ReloadDrift
+		if *filesOnly {
+			hr.Systemd = systemd.Noop{}
+		}
+		reconcilers = append(reconcilers, hr)
+	}
+	return r, reconcilers, nil
+}
+
+// lock prevents other instances from managing the same units until the returned file is closed.
+// Audits don't write to dest, so they don't take the lock by default.
+func lock() *os.File {
+	if *host == "" && *invPath == "" && !*audit {
+		switch {
+		case *privilege != "none":
+			// Unprivileged instances can't write to dest
+			if *lockF == "" {
+				*lockF = path.Join(os.TempDir(), "unitmgr"+strings.ReplaceAll(path.Clean(*dest), "/", "-")+".lock")
 			}
-			switch event.Op {
-			case fsnotify.Write, fsnotify.Create, fsnotify.Remove, fsnotify.Rename:
-				ticker.Reset(fn())
+		default:
+			// Backends like compose use directories that don't exist on a fresh host
+			if err := os.MkdirAll(*dest, 0755); err != nil {
+				log.Fatalf("unable to start: %s", err)
 			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return nil
+			if *lockF == "" {
+				*lockF = path.Join(*dest, ".unitmgr.lock")
 			}
-			return fmt.Errorf("watcher error: %w", err)
 		}
 	}
+	if *lockF == "" {
+		return nil
+	}
+
+	file, err := lockFile(*lockF)
+	if err != nil {
+		log.Fatalf("unable to start: %s", err)
+	}
+	return file
 }
 
-func sync(src, dest string, state map[string]string, sysd systemd) bool {
-	files, err := ioutil.ReadDir(src)
+func loadState(reconcilers []*reconciler.Reconciler) (*reconciler.StateStore, error) {
+	if *statePath == "" {
+		return nil, nil
+	}
+	sealer, err := newSealer()
 	if err != nil {
-		log.Printf("error while listing unit files: %s", err)
-		return false
+		return nil, err
+	}
+	store := &reconciler.StateStore{Path: *statePath, Sealer: sealer, TombstoneTTL: *stateTTL, Hasher: reconciler.Hashers[*checksumA]}
+	if err := store.Load(reconcilers); err != nil {
+		return nil, err
 	}
+	return store, nil
+}
 
-	ok := true
-	for _, stat := range files {
-		if strings.HasSuffix(stat.Name(), ".swp") || strings.HasSuffix(stat.Name(), "~") {
-			continue // skip vim files
+func newAgent() (*fleetAgent, error) {
+	if *fleetS == "" {
+		return nil, nil
+	}
+	if *enrollT != "" {
+		if err := enroll(*fleetS, *enrollT, *tlsCert, *tlsKey, *tlsCA, *timeout); err != nil {
+			return nil, fmt.Errorf("error while enrolling with fleet server: %w", err)
 		}
+	}
+	tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+	if err != nil {
+		return nil, invalidConfig(err)
+	}
+	gate, err := newPollGate()
+	if err != nil {
+		return nil, err
+	}
+	return &fleetAgent{
+		Server: *fleetS,
+		Dir:    *src,
+		Client: &http.Client{Timeout: *timeout, Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}, // gRPC requires HTTP/2
+		Gate:   gate,
+	}, nil
+}
 
-		unit := path.Base(stat.Name())
-		name := path.Join(src, unit)
+// newPollGate returns nil unless -poll-when, -poll-window, or -battery-max-download is set.
+func newPollGate() (*pollGate, error) {
+	if *pollWhen == "" && *pollWin == "" && *batMax == "" {
+		return nil, nil
+	}
+	gate := &pollGate{}
+	var err error
+	if gate.Conditions, err = parseHostConditions(*pollWhen); err != nil {
+		return nil, invalidConfig(err)
+	}
+	if *pollWin != "" {
+		if gate.Window, err = parseMaintenanceWindow(*pollWin); err != nil {
+			return nil, configErrorf("invalid poll window: %s", err)
+		}
+	}
+	if *batMax != "" {
+		if gate.MaxBattery, err = reconciler.ParseByteSize(*batMax); err != nil {
+			return nil, invalidConfig(err)
+		}
+		gate.Power = &acPower{Dir: "/sys/class/power_supply"}
+	}
+	return gate, nil
+}
+
+// newSource returns nil unless -source-url or -git-url is set.
+func newSource() (source, error) {
+	if *sourceU == "" && *gitURL == "" {
+		return nil, nil
+	}
+	if *fleetS != "" || (*sourceU != "" && *gitURL != "") {
+		return nil, configErrorf("-source-url, -git-url, and -fleet-server all mirror units into -src, only one can be used")
+	}
+	if *gitURL != "" && !gitStatusModes[*gitStat] {
+		return nil, configErrorf("unknown git status mode %q", *gitStat)
+	}
+	gate, err := newPollGate()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(*src, 0755); err != nil {
+		return nil, err
+	}
+
+	if *gitURL != "" {
+		repo := *sourceC
+		if repo == "" {
+			repo = path.Join(*src, ".unitmgr-cache") // hidden files and directories in src aren't units
+		}
+		hostname, _ := os.Hostname()
+		return &gitSource{URL: *gitURL, Ref: *gitRef, Path: *gitPath, Dir: *src, Repo: repo, Status: *gitStat, Host: hostname, Timeout: *dlTO, Gate: gate}, nil
+	}
+
+	d := &downloader{Client: &http.Client{}, Parallel: *dlPar, Timeout: *dlTO, Gate: gate}
+	if *dlRate != "" {
+		if d.Rate, err = reconciler.ParseByteSize(*dlRate); err != nil {
+			return nil, invalidConfig(err)
+		}
+	}
+	sealer, err := newSealer()
+	if err != nil {
+		return nil, err
+	}
+	cache := *sourceC
+	if cache == "" {
+		cache = path.Join(*src, ".unitmgr-cache")
+	}
+	return &httpSource{URL: *sourceU, Dir: *src, Cache: cache, Client: &http.Client{Timeout: *timeout}, Downloader: d, Sealer: sealer, Gate: gate}, nil
+}
+
+// newSealer returns nil unless -encryption-key is set.
+func newSealer() (*reconciler.Sealer, error) {
+	if *encKey == "" {
+		return nil, nil
+	}
+	sealer, err := reconciler.LoadSealer(*encKey)
+	return sealer, invalidConfig(err)
+}
 
-		checksum, err := getChecksum(name)
+// newRenderer returns nil unless -templates is set.
+func newRenderer() (*renderer, error) {
+	if !*templates {
+		if *cloud != "" || *consulA != "" || *vaultA != "" {
+			return nil, configErrorf("-cloud, -consul-addr, and -vault-addr require -templates")
+		}
+		return nil, nil
+	}
+	if _, ok := cloudProviders[*cloud]; !ok && *cloud != "" && *cloud != "auto" {
+		return nil, configErrorf("unknown cloud %q, expected one of %s", *cloud, strings.Join(cloudNames(), ", "))
+	}
+	client := &http.Client{Timeout: *timeout}
+	return &renderer{
+		Dir:      *src,
+		Cloud:    *cloud,
+		Client:   client,
+		FactsTTL: time.Minute * 15,
+		DNS:      &dnsCache{TTL: *dnsTTL},
+		Consul:   &consulBackend{Addr: *consulA, Token: *consulT, Client: client},
+		Vault:    &vaultBackend{Addr: *vaultA, Token: *vaultT, Client: client},
+	}, nil
+}
+
+// newHistoryStore returns the store of -history-dir with the configured retention, encrypted with -encryption-key.
+func newHistoryStore() (*historyStore, error) {
+	h := &historyStore{Dir: *historyD, Keep: *historyK, MaxAge: *historyA}
+	if *historyS != "" {
+		var err error
+		if h.MaxSize, err = reconciler.ParseByteSize(*historyS); err != nil {
+			return nil, invalidConfig(err)
+		}
+	}
+	sealer, err := newSealer()
+	if err != nil {
+		return nil, err
+	}
+	if h.Sealer = sealer; sealer != nil {
+		if err := h.Seal(); err != nil {
+			return nil, configErrorf("-history-dir %s can't be encrypted with -encryption-key: %s", h.Dir, err)
+		}
+	}
+	return h, nil
+}
+
+// newNotifiers returns the configured notification channels.
+func newNotifiers() ([]notifier, error) {
+	var notifiers []notifier
+	if *smtpAddr != "" && (*smtpTo != "" || *routesF == "") {
+		email, err := newEmailNotifier(*smtpAddr, *smtpFrom, *smtpTo, *smtpUser, *smtpPass)
 		if err != nil {
-			log.Printf("error reading unit file %q: %s", unit, err)
-			ok = false
-			continue
+			return nil, invalidConfig(err)
 		}
-		if os.IsNotExist(err) {
-			continue // file was removed between the time of the notification and now
+		notifiers = append(notifiers, email)
+	}
+	if *routesF != "" {
+		routes, err := loadNotifyRoutes(*routesF, newNotifyTarget)
+		if err != nil {
+			return nil, invalidConfig(err)
 		}
+		notifiers = append(notifiers, routes)
+	}
+	return notifiers, nil
+}
 
-		target := path.Join(dest, unit)
-		currentChecksum, err := getChecksum(target)
-		if err != nil && !os.IsNotExist(err) {
-			log.Printf("error reading current unit file %q: %s", unit, err)
-			ok = false
-			continue
+// newNotifyTarget returns the notifier of a notification route's target.
+func newNotifyTarget(to string) (notifier, error) {
+	switch {
+	case strings.HasPrefix(to, "mailto:"):
+		if *smtpAddr == "" {
+			return nil, fmt.Errorf("-smtp-server is required to send email")
 		}
+		return newEmailNotifier(*smtpAddr, *smtpFrom, strings.TrimPrefix(to, "mailto:"), *smtpUser, *smtpPass)
+	case strings.HasPrefix(to, "http://"), strings.HasPrefix(to, "https://"):
+		return &webhookNotifier{URL: to, Client: &http.Client{Timeout: *timeout}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported target %q, expected mailto: addresses or an http(s) url", to)
+	}
+}
+
+// newIncidents returns nil unless a paging system is configured.
+func newIncidents() *incidentManager {
+	var notifiers []incidentNotifier
+	if *pdKey != "" {
+		notifiers = append(notifiers, &pagerDuty{RoutingKey: *pdKey, URL: pagerDutyURL, Client: &http.Client{Timeout: *timeout}})
+	}
+	if *ogKey != "" {
+		notifiers = append(notifiers, &opsgenie{APIKey: *ogKey, URL: *ogURL, Client: &http.Client{Timeout: *timeout}})
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return newIncidentManager(notifiers, *incAfter)
+}
+
+func newReporter() *statusReporter {
+	if *repURL == "" {
+		return nil
+	}
+	return &statusReporter{URL: *repURL, Token: *repTok, Client: &http.Client{Timeout: *timeout}}
+}
 
-		// Make sure the unit file is in sync
-		if checksum != currentChecksum {
-			if err := copyFile(name, target); err != nil {
-				log.Printf("error while copying unit file %q: %s", unit, err)
-				ok = false
-				continue
+func runCommand() int {
+	if *once {
+		return syncCommand()
+	}
+
+	if *fleetL != "" {
+		tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			return setupFailed(invalidConfig(err))
+		}
+		fs := &fleetServer{Dir: *src}
+		if fs.Redact, err = newRedactor(); err != nil {
+			return setupFailed(err)
+		}
+		if *fleetNS != "" {
+			if fs.Namespaces, err = loadNamespaces(*fleetNS); err != nil {
+				return setupFailed(invalidConfig(err))
 			}
-			log.Printf("wrote unit: %s", unit)
 		}
-
-		// Make sure unit is running if it's new or already in the correct state
-		if checksum == currentChecksum || currentChecksum == "" {
-			changed, err := sysd.EnsureRunning(unit)
-			if err != nil {
-				log.Printf("error while ensuring unit %q is running: %s", unit, err)
-				ok = false
-				continue
+		if *fleetA != "" {
+			if fs.Assignments, err = loadAssignments(*fleetA); err != nil {
+				return setupFailed(invalidConfig(err))
 			}
-			if changed {
-				log.Printf("started unit: %s", unit)
+			fs.AssignPath = *fleetA
+		}
+		if *opsToken != "" {
+			if sum, err := hex.DecodeString(*opsToken); err != nil || len(sum) != sha256.Size {
+				return setupFailed(configErrorf("-fleet-operations-token must be a hex sha256 digest"))
 			}
-			state[unit] = checksum
-			continue
+			fs.OpsToken = *opsToken
 		}
-
-		// Restart units when their last configuration doesn't match the current one
-		if checksum != state[unit] {
-			err = sysd.Restart(unit)
-			if err != nil {
-				log.Printf("error while restarting unit %q: %s", unit, err)
-				ok = false
-				continue
+		if *rollPct > 0 {
+			fs.Rollout = &rollout{Percent: *rollPct, Timeout: *rollTO}
+		}
+		if *statePath != "" {
+			fs.StatePath = *statePath
+			if err := fs.loadState(); err != nil {
+				return setupFailed(err)
+			}
+		}
+		if *enrollF != "" {
+			if fs.Enroller, err = loadEnroller(*enrollF, *tlsCA, *enrollK); err != nil {
+				return setupFailed(invalidConfig(err))
 			}
-			log.Printf("restarted unit: %s", unit)
-			state[unit] = checksum
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven // agents enroll before they have a certificate
 		}
+		server := &http.Server{
+			Addr:      *fleetL,
+			Handler:   fs.Handler(),
+			TLSConfig: tlsConfig,
+			// Bound how long unauthenticated clients can hold connections, including the TLS handshake
+			ReadHeaderTimeout: time.Second * 10,
+			IdleTimeout:       time.Minute * 2,
+		}
+		log.Printf("error while serving fleet: %s", server.ListenAndServeTLS("", ""))
+		return exitFailed
 	}
 
-	for unit := range state {
-		if _, err := os.Stat(path.Join(src, unit)); err == nil {
-			continue // file still exists
+	r, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+	rend, err := newRenderer()
+	if err != nil {
+		return setupFailed(err)
+	}
+	rs, err := newRebootScheduler(reconcilers)
+	if err != nil {
+		return setupFailed(err)
+	}
+	xs, err := newReexecScheduler(reconcilers)
+	if err != nil {
+		return setupFailed(err)
+	}
+	notifiers, err := newNotifiers()
+	if err != nil {
+		return setupFailed(err)
+	}
+	var history *historyStore
+	if *historyD != "" {
+		if history, err = newHistoryStore(); err != nil {
+			return setupFailed(err)
+		}
+	}
+	var sink journalSink
+	if *journalS != "" && !*audit {
+		if sink, err = newJournalSink(*journalS, *timeout); err != nil {
+			return setupFailed(invalidConfig(err))
 		}
+	}
+	checkSystemd(reconcilers)
+	if file := lock(); file != nil {
+		defer file.Close()
+	}
+	store, err := loadState(reconcilers)
+	if err != nil {
+		return setupFailed(err)
+	}
+	agent, err := newAgent()
+	if err != nil {
+		return setupFailed(err)
+	}
+	source, err := newSource()
+	if err != nil {
+		return setupFailed(err)
+	}
 
-		changed, err := sysd.EnsureStopped(unit)
-		if err != nil {
-			log.Printf("error while stopping unit %q: %s", unit, err)
-			ok = false
-			continue
+	// Canceling ctx only stops scheduling new work, the units in flight finish first (see reconciler.Reconciler.each)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() // a second signal terminates immediately, rather than waiting for the units in flight
+	}()
+
+	bootstrapped := false
+	if *bootstrap != "" {
+		b := &bootstrapper{UserData: *bootstrap, Dir: *src, Client: &http.Client{Timeout: *timeout}, Attempts: 5, Backoff: time.Second * 5}
+		bootstrapped = b.Run(ctx)
+	}
+
+	if agent != nil {
+		agent.Systemd = r.Systemd
+	}
+	var sourcesStarted sync.Once
+	startSources := func() {
+		sourcesStarted.Do(func() {
+			if agent != nil {
+				go agent.Run(*fleetI)
+			}
+			if source != nil {
+				go source.Run(ctx, *sourceI)
+			}
+		})
+	}
+	if !bootstrapped {
+		startSources()
+	} // otherwise the bootstrapped units are applied before the regular source replaces them
+
+	if rend != nil {
+		if err := rend.Render(ctx); err != nil {
+			log.Printf("error while rendering templates: %s", err)
+		}
+		go rend.Run(ctx, *renderI)
+	}
+	reporter := newReporter()
+	if reporter != nil {
+		go reporter.Run(*repI)
+	}
+
+	var leader *leaderLease
+	if *lease != "" {
+		leader = &leaderLease{Path: *lease, ID: defaultLeaseID(), TTL: *leaseT}
+		go leader.Run()
+	}
+
+	if cal, ok := r.Freeze.(*freezeCalendar); ok {
+		go cal.Run(ctx, *freezeI)
+	}
+	if rs != nil {
+		if leader != nil {
+			rs.Paused = func() bool { return !leader.Held() }
 		}
-		if changed {
-			log.Printf("stopped unit: %s", unit)
+		go rs.Run(ctx, time.Minute)
+	}
+	if xs != nil {
+		if leader != nil {
+			xs.Paused = func() bool { return !leader.Held() }
 		}
+		go xs.Run(ctx, time.Minute)
+	}
 
-		target := path.Join(dest, unit)
-		if err := os.Remove(target); err != nil {
-			log.Printf("error while removing unit %q: %s", unit, err)
-			ok = false
-			continue
+	trigger := make(chan string, 16)
+	cs := &controlServer{
+		Trigger: func(name string) { trigger <- name },
+		Reboot:  rebootHost,
+	}
+	for _, rec := range reconcilers {
+		rec.OnState = append(rec.OnState[:len(rec.OnState):len(rec.OnState)], cs.Record(rec.Src)) // hosts share r's hooks
+	}
+	if gs, ok := source.(*gitSource); ok {
+		cs.Promote = func(ref string) (string, error) { return gs.Promote(ctx, ref) }
+	}
+	if *control != "" {
+		listener, err := listenControl(*control)
+		if err != nil {
+			log.Printf("error while listening on control socket: %s", err)
+		} else {
+			defer listener.Close()
+			go http.Serve(listener, cs.Handler())
 		}
-		log.Printf("removed unit: %s", unit)
+	}
 
-		delete(state, unit)
+	if *sandboxed {
+		applySandbox(agent != nil || source != nil || rend != nil || *historyD != "", reconcilers) // rollbacks restore units into src
 	}
 
-	return ok
-}
+	if sink != nil {
+		jf := &journalForwarder{Sink: sink, Priority: *journalP, Forward: func(unit string, at time.Time) bool {
+			if *journalW == 0 {
+				return r.Manages(unit)
+			}
+			touched, ok := r.Touched(unit)
+			return ok && !at.Before(touched) && at.Sub(touched) <= *journalW
+		}}
+		go jf.Run(ctx)
+	}
 
-func getChecksum(name string) (string, error) {
-	file, err := os.Open(name)
-	if err != nil {
-		return "", err
+	incidents := newIncidents()
+	if incidents != nil {
+		go incidents.Run()
 	}
-	defer file.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, file); err != nil {
-		return "", err
+	if *stabI > 0 && !*audit {
+		go func() {
+			ticker := time.NewTicker(*stabI)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				for _, rec := range reconcilers {
+					rec.CheckStability(ctx)
+				}
+				cs.Refresh(reconcilers)
+				if incidents != nil {
+					incidents.Refresh(reconcilers)
+				}
+			}
+		}()
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
-}
 
-func copyFile(src, dest string) error {
-	srcf, err := os.Open(src)
-	if err != nil {
-		return err
+	if history != nil {
+		cs.Rollback = func(generation int64) (int, error) {
+			return rollback(history, r, generation) // the watcher syncs the restored files
+		}
 	}
-	defer srcf.Close()
 
-	destf, err := os.Create(dest)
-	if err != nil {
-		return err
+	ready := &readiness{Timeout: *readyT}
+	go ready.Run(ctx)
+
+	var nq *notifyQueue
+	if len(notifiers) > 0 {
+		nq = newNotifyQueue(notifiers)
+		go nq.Run()
 	}
-	defer destf.Close()
 
-	_, err = io.Copy(destf, srcf)
-	return err
-}
+	m := &reconciler.Manager{
+		Reconcilers:  reconcilers,
+		Resync:       *resync,
+		Debounce:     *settle,
+		Poll:         *poll,
+		PollInterval: *pollI,
+		Trigger:      trigger,
+		Hooks: reconciler.Hooks{
+			Synced: func(ok bool) {
+				if agent != nil {
+					agent.SetReport(r.Report(ok))
+				}
+				if reporter != nil {
+					reporter.SetReport(r.Report(ok))
+				}
+				if writer, isWriter := source.(statusSource); isWriter {
+					writer.SetReport(r.Report(ok)) // written back by the source's next poll
+				}
+				if store != nil {
+					if err := store.Save(reconcilers); err != nil {
+						log.Printf("error while saving state: %s", err)
+					}
+				}
+				cs.SetReports(reconcilers, ok)
+				if *statusF != "" {
+					if err := writeStatusFile(*statusF, reconcilers, ok); err != nil {
+						log.Printf("error while writing status file: %s", err)
+					}
+				}
+				if *metricsD != "" {
+					if err := writeMetrics(*metricsD, reconcilers, ok); err != nil {
+						log.Printf("error while writing metrics: %s", err)
+					}
+				}
+				if history != nil {
+					if err := history.Record(reconcilers, time.Now()); err != nil {
+						log.Printf("error while recording history: %s", err)
+					}
+					if _, err := history.GC(time.Now()); err != nil {
+						log.Printf("error while removing old history: %s", err)
+					}
+				}
+				if nq != nil {
+					nq.Synced(reconcilers, ok)
+				}
+				if incidents != nil {
+					incidents.Synced(reconcilers, ok)
+				}
+				ready.Synced(ok)
+				startSources()
+			},
+		},
+	}
+	if leader != nil {
+		m.Hooks.Paused = func() (bool, time.Duration) {
+			return !leader.Held(), *leaseT / 3 // check again once the lease may have changed hands
+		}
+	}
+	code := 0
+	if err := m.Run(ctx); err != nil {
+		log.Printf("error while watching src: %s", err)
+		code = exitSource
+	} else {
+		log.Printf("shutting down")
+		if *onExit == "stop" && !*audit && (leader == nil || leader.Held()) {
+			for _, rec := range reconcilers {
+				rec.StopAll(context.Background())
+			}
+		}
+	}
 
-type systemd interface {
-	Restart(unit string) error
-	EnsureRunning(unit string) (bool, error)
-	EnsureStopped(unit string) (bool, error)
+	// The units applied before src failed are still running, so their state is saved either way
+	if store != nil {
+		if err := store.Save(reconcilers); err != nil {
+			log.Fatalf("error while saving state: %s", err)
+		}
+	}
+	return code
 }
 
-type systemctl struct {
-	Timeout time.Duration
+// checkSystemd fails fast when systemd can't be reached, rather than failing every operation later.
+func checkSystemd(reconcilers []*reconciler.Reconciler) {
+	if *audit {
+		return // audits don't use systemctl
+	}
+	for _, rec := range reconcilers {
+		sysd, ok := rec.Systemd.(*systemd.Systemctl)
+		if !ok {
+			continue
+		}
+		if err := sysd.Ping(context.Background()); err != nil {
+			target := "this host"
+			if sysd.Host != "" {
+				target = sysd.Host
+			}
+			log.Fatalf("unable to reach systemd on %s, pass -files-only to only sync unit files (e.g. in containers): %s", target, err)
+		}
+	}
 }
 
-func (s *systemctl) Restart(unit string) error {
-	ctx, done := context.WithTimeout(context.Background(), s.Timeout)
-	defer done()
+// applySandbox restricts unitmgr to the paths it's configured to use, see sandbox.
+func applySandbox(mirror bool, reconcilers []*reconciler.Reconciler) {
+	// Landlock rules can only be added for existing paths
+	if err := os.MkdirAll(*src, 0755); err != nil {
+		log.Fatalf("unable to sandbox: %s", err)
+	}
 
-	if err := s.exec(ctx, "daemon-reload"); err != nil {
-		return err
+	var home string
+	if *host != "" || *invPath != "" || *gitURL != "" {
+		home, _ = os.UserHomeDir() // for ssh keys and git config
+	}
+	paths := sandboxPaths(*src, *dest, *statePath, *lockF, *control, mirror, home)
+	if *statusF != "" {
+		paths = append(paths, &sandboxPath{Path: path.Dir(*statusF), Write: true})
+	}
+	if *metricsD != "" {
+		paths = append(paths, &sandboxPath{Path: *metricsD, Write: true})
+	}
+	if *sourceC != "" {
+		if err := os.MkdirAll(*sourceC, 0755); err != nil {
+			log.Fatalf("unable to sandbox: %s", err)
+		}
+		paths = append(paths, &sandboxPath{Path: *sourceC, Write: true})
+	}
+	if *historyD != "" {
+		if err := os.MkdirAll(*historyD, 0700); err != nil {
+			log.Fatalf("unable to sandbox: %s", err)
+		}
+		paths = append(paths, &sandboxPath{Path: *historyD, Write: true})
+	}
+	if *lease != "" {
+		paths = append(paths, &sandboxPath{Path: path.Dir(*lease), Write: true})
+	}
+	if *routesF != "" {
+		paths = append(paths, &sandboxPath{Path: path.Dir(*routesF)})
+	}
+	if *freezeCal != "" && !strings.HasPrefix(*freezeCal, "http://") && !strings.HasPrefix(*freezeCal, "https://") {
+		paths = append(paths, &sandboxPath{Path: path.Dir(*freezeCal)}) // read again every -freeze-interval
+	}
+	for _, rec := range reconcilers {
+		if rec.Src == *src {
+			continue
+		}
+		// Inventory hosts can read units from outside src
+		if err := os.MkdirAll(rec.Src, 0755); err != nil {
+			log.Fatalf("unable to sandbox: %s", err)
+		}
+		paths = append(paths, &sandboxPath{Path: rec.Src, Write: mirror})
+	}
+	for _, dir := range destRootDirs()[1:] {
+		paths = append(paths, &sandboxPath{Path: dir, Write: true})
+	}
+	if *journalS != "" {
+		paths = append(paths, &sandboxPath{Path: "/var/log/journal"})
+		if !strings.Contains(*journalS, "://") || strings.HasPrefix(*journalS, "file://") {
+			paths = append(paths, &sandboxPath{Path: path.Dir(strings.TrimPrefix(*journalS, "file://")), Write: true})
+		}
+	}
+	if err := sandbox(paths); err != nil {
+		log.Fatalf("unable to sandbox: %s", err)
 	}
+}
 
-	return s.exec(ctx, "restart", unit)
+// destRootDirs returns -dest followed by the directories of -dest-roots.
+func destRootDirs() []string {
+	dirs := []string{*dest}
+	for _, dir := range strings.Split(*destRoots, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" && path.Clean(dir) != path.Clean(*dest) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
 }
 
-func (s *systemctl) EnsureRunning(unit string) (bool, error) {
-	ctx, done := context.WithTimeout(context.Background(), s.Timeout)
-	defer done()
+// Exit codes of one-shot commands.
+const (
+	exitConverged  = 0
+	exitFailed     = 1
+	exitConfig     = 2 // invalid flags or configuration, like the flag package's usage errors
+	exitChanged    = 3
+	exitSource     = 4
+	exitCopy       = 5
+	exitSystemd    = 6
+	exitValidation = 7
+)
 
-	if s.isRunning(ctx, unit) {
-		return false, nil // already running
-	}
+// classExitCodes are the exit codes of syncs that failed with an error of the class.
+var classExitCodes = map[reconciler.ErrorClass]int{
+	reconciler.SourceError:     exitSource,
+	reconciler.CopyError:       exitCopy,
+	reconciler.SystemdError:    exitSystemd,
+	reconciler.ValidationError: exitValidation,
+}
 
-	return true, s.exec(ctx, "restart", unit)
+// succeeded returns true if the exit code is of a sync that didn't fail.
+func succeeded(code int) bool {
+	return code == exitConverged || code == exitChanged
 }
 
-func (s *systemctl) EnsureStopped(unit string) (bool, error) {
-	ctx, done := context.WithTimeout(context.Background(), s.Timeout)
-	defer done()
+func syncCommand() int {
+	r, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+	rs, err := newRebootScheduler(reconcilers)
+	if err != nil {
+		return setupFailed(err)
+	}
+	rend, err := newRenderer()
+	if err != nil {
+		return setupFailed(err)
+	}
+	notifiers, err := newNotifiers()
+	if err != nil {
+		return setupFailed(err)
+	}
+	var history *historyStore
+	if *historyD != "" {
+		if history, err = newHistoryStore(); err != nil {
+			return setupFailed(err)
+		}
+	}
+	checkSystemd(reconcilers)
+	if file := lock(); file != nil {
+		defer file.Close()
+	}
+	store, err := loadState(reconcilers)
+	if err != nil {
+		return setupFailed(err)
+	}
+	agent, err := newAgent()
+	if err != nil {
+		return setupFailed(err)
+	}
+	source, err := newSource()
+	if err != nil {
+		return setupFailed(err)
+	}
+
+	// Canceling ctx only stops scheduling new work, the units in flight finish first (see reconciler.Reconciler.each)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() // a second signal terminates immediately, rather than waiting for the units in flight
+	}()
+
+	if *sandboxed {
+		applySandbox(agent != nil || source != nil || rend != nil, reconcilers)
+	}
 
-	if !s.isRunning(ctx, unit) {
-		return false, nil // already stopped
+	if *lease != "" {
+		held, err := (&leaderLease{Path: *lease, ID: defaultLeaseID(), TTL: *leaseT}).Acquire(time.Now())
+		if err != nil {
+			log.Printf("error while acquiring leader lease: %s", err)
+			return exitFailed
+		}
+		if !held {
+			log.Printf("leader lease %s is held by another instance", *lease)
+			return exitConverged
+		}
+	}
+	if agent != nil {
+		if err := agent.Poll(); err != nil {
+			log.Printf("error while polling fleet server: %s", err)
+			return exitSource
+		}
+	}
+	if source != nil {
+		if err := source.Poll(ctx); err != nil {
+			log.Printf("error while polling source: %s", err)
+			return exitSource
+		}
+	}
+	if rend != nil {
+		if err := rend.Render(ctx); err != nil {
+			log.Printf("error while rendering templates: %s", err)
+			return exitSource
+		}
 	}
 
-	return true, s.exec(ctx, "stop", unit)
+	code := syncOnce(ctx, reconcilers)
+	if store != nil {
+		if err := store.Save(reconcilers); err != nil {
+			log.Printf("error while saving state: %s", err)
+			code = exitFailed
+		}
+	}
+	if *statusF != "" {
+		if err := writeStatusFile(*statusF, reconcilers, succeeded(code)); err != nil {
+			log.Printf("error while writing status file: %s", err)
+		}
+	}
+	if *metricsD != "" {
+		if err := writeMetrics(*metricsD, reconcilers, succeeded(code)); err != nil {
+			log.Printf("error while writing metrics: %s", err)
+		}
+	}
+	if history != nil {
+		if err := history.Record(reconcilers, time.Now()); err != nil {
+			log.Printf("error while recording history: %s", err)
+		}
+		if _, err := history.GC(time.Now()); err != nil {
+			log.Printf("error while removing old history: %s", err)
+		}
+	}
+	if len(notifiers) > 0 {
+		nq := newNotifyQueue(notifiers)
+		nq.Synced(reconcilers, succeeded(code))
+		nq.Close()
+		nq.Run()
+	}
+	if reporter := newReporter(); reporter != nil {
+		if err := postReport(reporter.Client, reporter.URL, reporter.Token, r.Report(succeeded(code))); err != nil {
+			log.Printf("error while reporting status: %s", err)
+		}
+	}
+	if writer, ok := source.(statusSource); ok {
+		writer.SetReport(r.Report(succeeded(code)))
+		if err := writer.WriteStatus(ctx); err != nil {
+			log.Printf("error while writing status to source: %s", err)
+		}
+	}
+	if rs != nil {
+		rs.check(ctx) // reboots required by this sync are forgotten if it's outside the window
+	}
+	if *output != "table" {
+		reports := make([]*reconciler.HostReport, len(reconcilers))
+		for i, rec := range reconcilers {
+			reports[i] = rec.Report(succeeded(code))
+		}
+		structured(os.Stdout, reports)
+	}
+	return code
 }
 
-func (s *systemctl) isRunning(ctx context.Context, unit string) bool {
-	return exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", unit).Run() == nil
+// newRebootScheduler returns nil unless reboots should be scheduled, see -reboot.
+func newRebootScheduler(reconcilers []*reconciler.Reconciler) (*rebootScheduler, error) {
+	if *rebootM != "schedule" || *audit {
+		return nil, nil
+	}
+	rs := &rebootScheduler{Reconcilers: reconcilers}
+	if *rebootW != "" {
+		window, err := parseMaintenanceWindow(*rebootW)
+		if err != nil {
+			return nil, configErrorf("invalid reboot window: %s", err)
+		}
+		rs.Window = window
+	}
+	return rs, nil
 }
 
-func (s *systemctl) exec(ctx context.Context, args ...string) error {
-	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
-	if err == nil {
-		return nil
+// newReexecScheduler returns nil unless -reexec is set.
+func newReexecScheduler(reconcilers []*reconciler.Reconciler) (*reexecScheduler, error) {
+	if !*reexec || *audit || len(reconcilers) == 0 {
+		return nil, nil
 	}
-	if len(out) > 0 {
-		return fmt.Errorf("systemctl error msg: %s", out)
+	sysd, ok := reconcilers[0].Systemd.(reexecer)
+	if !ok {
+		return nil, nil
+	}
+	xs := &reexecScheduler{Systemd: sysd}
+	if *reexecW != "" {
+		window, err := parseMaintenanceWindow(*reexecW)
+		if err != nil {
+			return nil, configErrorf("invalid reexec window: %s", err)
+		}
+		xs.Window = window
+	}
+	return xs, nil
+}
+
+// syncOnce performs a single full sync of every reconciler and returns the process exit code.
+// Failed syncs exit with the code of their first error class in the order of reconciler.ErrorClasses.
+func syncOnce(ctx context.Context, reconcilers []*reconciler.Reconciler) int {
+	code := exitConverged
+	for _, rec := range reconcilers {
+		if !rec.Sync(ctx) {
+			if succeeded(code) {
+				code = exitFailed
+				if classes := rec.Classes(); len(classes) > 0 {
+					code = classExitCodes[classes[0]]
+				}
+			}
+		} else if rec.Changes() > 0 && code == exitConverged {
+			code = exitChanged
+		}
 	}
-	return fmt.Errorf("systemctl error: %w", err)
+	return code
 }
@@ -1,101 +1,96 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"io/ioutil"
-	"os"
 	"path"
 	"testing"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/jveski/unitmgr/pkg/reconciler"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestRunLoop(t *testing.T) {
-	watcher, err := fsnotify.NewWatcher()
-	require.NoError(t, err)
-	defer watcher.Close()
-
-	dir := t.TempDir()
-	err = watcher.Add(dir)
-	require.NoError(t, err)
-
-	n := 0
-	runLoop(watcher, func() time.Duration {
-		n++
-		switch n {
-		case 1: // initial resync
-			err := ioutil.WriteFile(path.Join(dir, "test1"), []byte("test1"), 0644)
-			require.NoError(t, err)
-			return time.Hour
-		case 2: // file changed
-			return time.Nanosecond
-		case 3: // resync
-			watcher.Close()
-		}
-		return time.Hour
-	})
-}
-
-func TestSync(t *testing.T) {
+func TestSyncOnce(t *testing.T) {
 	src := t.TempDir()
-	dest := t.TempDir()
-	state := map[string]string{}
 	sysd := &fakeSystemd{}
+	r := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+
+	assert.Equal(t, exitChanged, syncOnce(context.Background(), []*reconciler.Reconciler{r}))
+
+	r = &reconciler.Reconciler{Src: src, Dest: r.Dest, State: r.State, Systemd: sysd}
+	assert.Equal(t, exitConverged, syncOnce(context.Background(), []*reconciler.Reconciler{r}))
+
+	sysd.fail = true
+	assert.Equal(t, exitSystemd, syncOnce(context.Background(), []*reconciler.Reconciler{r}))
+
+	r = &reconciler.Reconciler{Src: path.Join(src, "missing"), Dest: r.Dest, State: r.State, Systemd: sysd}
+	assert.Equal(t, exitSource, syncOnce(context.Background(), []*reconciler.Reconciler{r}))
+}
 
-	t.Run("zero units", func(t *testing.T) {
-		assert.True(t, sync(src, dest, state, sysd))
-	})
-
-	t.Run("create unit", func(t *testing.T) {
-		err := ioutil.WriteFile(path.Join(src, "test1.service"), []byte("test1"), 0644)
-		require.NoError(t, err)
-
-		assert.True(t, sync(src, dest, state, sysd))
-		assert.FileExists(t, path.Join(dest, "test1.service"))
-		assert.Equal(t, "EnsureRunning test1.service", sysd.LastCmd)
-	})
-
-	t.Run("sync unit no change", func(t *testing.T) {
-		assert.True(t, sync(src, dest, state, sysd))
-		assert.FileExists(t, path.Join(dest, "test1.service"))
-	})
-
-	t.Run("change unit", func(t *testing.T) {
-		err := ioutil.WriteFile(path.Join(src, "test1.service"), []byte("test2"), 0644)
-		require.NoError(t, err)
-
-		assert.True(t, sync(src, dest, state, sysd))
-		assert.FileExists(t, path.Join(dest, "test1.service"))
-		assert.Equal(t, "Restart test1.service", sysd.LastCmd)
-	})
-
-	t.Run("remove unit", func(t *testing.T) {
-		err := os.Remove(path.Join(src, "test1.service"))
-		require.NoError(t, err)
-
-		assert.True(t, sync(src, dest, state, sysd))
-		assert.NoFileExists(t, path.Join(dest, "test1.service"))
-		assert.Equal(t, "EnsureStopped test1.service", sysd.LastCmd)
-	})
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	src := fs.String("src", ".", "")
+	retryMax := fs.Duration("retry-max", time.Minute, "")
+	once := fs.Bool("once", false, "")
+	require.NoError(t, fs.Parse([]string{"-src", "/from/args"}))
+
+	env := map[string]string{
+		"UNITMGR_SRC":       "/from/env",
+		"UNITMGR_RETRY_MAX": "5s",
+		"UNITMGR_ONCE":      "true",
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	require.NoError(t, applyEnv(fs, lookup))
+	assert.Equal(t, "/from/args", *src, "flags take precedence")
+	assert.Equal(t, time.Second*5, *retryMax)
+	assert.True(t, *once)
+
+	env["UNITMGR_RETRY_MAX"] = "soon"
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("retry-max", time.Minute, "")
+	assert.EqualError(t, applyEnv(fs, lookup), `invalid value "soon" for UNITMGR_RETRY_MAX: parse error`)
 }
 
 type fakeSystemd struct {
-	LastCmd string
+	fail bool
 }
 
-func (f *fakeSystemd) Restart(unit string) error {
-	f.LastCmd = "Restart " + unit
-	return nil
+func (f *fakeSystemd) Restart(ctx context.Context, unit string) error {
+	return f.err()
+}
+
+func (f *fakeSystemd) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	return false, f.err()
 }
 
-func (f *fakeSystemd) EnsureRunning(unit string) (bool, error) {
-	f.LastCmd = "EnsureRunning " + unit
-	return false, nil
+func (f *fakeSystemd) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	return false, f.err()
+}
+
+func (f *fakeSystemd) err() error {
+	if f.fail {
+		return errors.New("oops")
+	}
+	return nil
 }
 
-func (f *fakeSystemd) EnsureStopped(unit string) (bool, error) {
-	f.LastCmd = "EnsureStopped " + unit
-	return false, nil
+func TestSetupConfigError(t *testing.T) {
+	defer func(mode string) { *onExit = mode }(*onExit)
+	*onExit = "pause"
+	_, _, err := setup()
+	var cerr *ConfigError
+	require.True(t, errors.As(err, &cerr))
+	assert.EqualError(t, err, `unknown on-exit mode "pause"`)
+	assert.Equal(t, exitConfig, setupFailed(err))
+
+	// Errors that aren't caused by the configuration exit like other failures
+	assert.Equal(t, exitFailed, setupFailed(errors.New("permission denied")))
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// metricsFile is the name of the file written to -metrics-dir, which node_exporter's textfile collector reads.
+const metricsFile = "unitmgr.prom"
+
+// writeMetrics atomically replaces the metrics file in dir with the state of every reconciler.
+func writeMetrics(dir string, reconcilers []*reconciler.Reconciler, ok bool) error {
+	buf := &bytes.Buffer{}
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	changes := make([]int, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(ok)
+		changes[i] = rec.Changes()
+	}
+	formatMetrics(buf, reports, changes)
+	return reconciler.WriteFileAtomic(path.Join(dir, metricsFile), buf.Bytes())
+}
+
+// formatMetrics writes the reports in the Prometheus text exposition format.
+// changes is the number of modifications made by each report's reconciler so far.
+func formatMetrics(w io.Writer, reports []*reconciler.HostReport, changes []int) {
+	metric := func(name, typ, help string, values func(emit func(labels string, value float64))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		values(func(labels string, value float64) {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, labels, value)
+		})
+	}
+	each := func(fn func(report *reconciler.HostReport, labels string, i int)) {
+		for i, report := range reports {
+			fn(report, "src="+quoteLabel(report.Src), i)
+		}
+	}
+
+	metric("unitmgr_last_sync_timestamp_seconds", "gauge", "Time of the last sync.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(report.LastSync.Unix()))
+		})
+	})
+	metric("unitmgr_sync_ok", "gauge", "Whether the last sync succeeded.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, boolValue(report.OK))
+		})
+	})
+	metric("unitmgr_units", "gauge", "Number of applied units.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(len(report.Units)))
+		})
+	})
+	metric("unitmgr_changes_total", "counter", "Modifications made to units since unitmgr started.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(changes[i]))
+		})
+	})
+	metric("unitmgr_errors_total", "counter", "Failures of each error class since unitmgr started.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			for _, class := range reconciler.ErrorClasses {
+				emit(labels+",class="+quoteLabel(string(class)), float64(report.Errors[class]))
+			}
+		})
+	})
+	metric("unitmgr_generation", "gauge", "Generation of the most recently applied change set.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(report.Generation))
+		})
+	})
+	metric("unitmgr_pending_changes", "gauge", "Changes found but not made in audit mode.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(len(report.Pending)))
+		})
+	})
+	metric("unitmgr_reboot_required", "gauge", "Units whose applied changes require a reboot.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			emit(labels, float64(len(report.Reboot)))
+		})
+	})
+	metric("unitmgr_unit_failing", "gauge", "Whether the unit failed to be reconciled.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			for _, unit := range sortedKeys(report.Failures) {
+				emit(labels+",unit="+quoteLabel(unit)+",generation="+quoteLabel(strconv.FormatInt(report.Generation, 10)), 1)
+			}
+		})
+	})
+	metric("unitmgr_unit_lint_findings", "gauge", "Lint findings of the unit's current file.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			units := make([]string, 0, len(report.Lint))
+			for unit := range report.Lint {
+				units = append(units, unit)
+			}
+			sort.Strings(units)
+			for _, unit := range units {
+				emit(labels+",unit="+quoteLabel(unit), float64(report.Lint[unit]))
+			}
+		})
+	})
+	metric("unitmgr_unit_security_exposure", "gauge", "systemd-analyze security exposure score of the unit's applied configuration.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			units := make([]string, 0, len(report.Security))
+			for unit := range report.Security {
+				units = append(units, unit)
+			}
+			sort.Strings(units)
+			for _, unit := range units {
+				emit(labels+",unit="+quoteLabel(unit), report.Security[unit])
+			}
+		})
+	})
+	metric("unitmgr_unit_restarts", "gauge", "Restarts of the unit in the last hour not caused by changes to its unit file.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			for _, unit := range sortedStability(report.Stability) {
+				emit(labels+",unit="+quoteLabel(unit), float64(report.Stability[unit].Restarts))
+			}
+		})
+	})
+	metric("unitmgr_unit_flapping", "gauge", "Whether the unit restarts more often than the flap threshold.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			for _, unit := range sortedStability(report.Stability) {
+				emit(labels+",unit="+quoteLabel(unit), boolValue(report.Stability[unit].Flapping))
+			}
+		})
+	})
+	metric("unitmgr_unit_restart_duration_seconds", "gauge", "Percentiles of how long the unit took to stop and become active again when it was restarted.", func(emit func(string, float64)) {
+		each(func(report *reconciler.HostReport, labels string, i int) {
+			units := make([]string, 0, len(report.Durations))
+			for unit := range report.Durations {
+				units = append(units, unit)
+			}
+			sort.Strings(units)
+			for _, unit := range units {
+				d := report.Durations[unit]
+				emit(labels+",unit="+quoteLabel(unit)+`,quantile="0.5"`, d.P50.Seconds())
+				emit(labels+",unit="+quoteLabel(unit)+`,quantile="0.9"`, d.P90.Seconds())
+				emit(labels+",unit="+quoteLabel(unit)+`,quantile="0.99"`, d.P99.Seconds())
+			}
+		})
+	})
+}
+
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedStability(m map[string]*reconciler.UnitStability) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
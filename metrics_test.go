@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatMetrics(t *testing.T) {
+	buf := &bytes.Buffer{}
+	formatMetrics(buf, []*reconciler.HostReport{{
+		Src:        `/src/"quoted"`,
+		Units:      map[string]string{"a.service": "abc", "b.service": "def"},
+		LastSync:   time.Unix(1609459200, 0),
+		Failures:   map[string]string{"b.service": "oops"},
+		Reboot:     []string{"a.service"},
+		Stability:  map[string]*reconciler.UnitStability{"a.service": {Restarts: 7, Flapping: true}},
+		Durations:  map[string]*reconciler.RestartDurations{"a.service": {Count: 3, P50: time.Second, P90: 1500 * time.Millisecond, P99: 2 * time.Second}},
+		Generation: 5,
+		Errors:     map[reconciler.ErrorClass]int64{reconciler.SystemdError: 2},
+		Lint:       map[string]int{"b.service": 2, "a.service": 0},
+		Security:   map[string]float64{"a.service": 4.2},
+	}}, []int{3})
+
+	assert.Equal(t, `# HELP unitmgr_last_sync_timestamp_seconds Time of the last sync.
+# TYPE unitmgr_last_sync_timestamp_seconds gauge
+unitmgr_last_sync_timestamp_seconds{src="/src/\"quoted\""} 1.6094592e+09
+# HELP unitmgr_sync_ok Whether the last sync succeeded.
+# TYPE unitmgr_sync_ok gauge
+unitmgr_sync_ok{src="/src/\"quoted\""} 0
+# HELP unitmgr_units Number of applied units.
+# TYPE unitmgr_units gauge
+unitmgr_units{src="/src/\"quoted\""} 2
+# HELP unitmgr_changes_total Modifications made to units since unitmgr started.
+# TYPE unitmgr_changes_total counter
+unitmgr_changes_total{src="/src/\"quoted\""} 3
+# HELP unitmgr_errors_total Failures of each error class since unitmgr started.
+# TYPE unitmgr_errors_total counter
+unitmgr_errors_total{src="/src/\"quoted\"",class="source"} 0
+unitmgr_errors_total{src="/src/\"quoted\"",class="copy"} 0
+unitmgr_errors_total{src="/src/\"quoted\"",class="systemd"} 2
+unitmgr_errors_total{src="/src/\"quoted\"",class="validation"} 0
+# HELP unitmgr_generation Generation of the most recently applied change set.
+# TYPE unitmgr_generation gauge
+unitmgr_generation{src="/src/\"quoted\""} 5
+# HELP unitmgr_pending_changes Changes found but not made in audit mode.
+# TYPE unitmgr_pending_changes gauge
+unitmgr_pending_changes{src="/src/\"quoted\""} 0
+# HELP unitmgr_reboot_required Units whose applied changes require a reboot.
+# TYPE unitmgr_reboot_required gauge
+unitmgr_reboot_required{src="/src/\"quoted\""} 1
+# HELP unitmgr_unit_failing Whether the unit failed to be reconciled.
+# TYPE unitmgr_unit_failing gauge
+unitmgr_unit_failing{src="/src/\"quoted\"",unit="b.service",generation="5"} 1
+# HELP unitmgr_unit_lint_findings Lint findings of the unit's current file.
+# TYPE unitmgr_unit_lint_findings gauge
+unitmgr_unit_lint_findings{src="/src/\"quoted\"",unit="a.service"} 0
+unitmgr_unit_lint_findings{src="/src/\"quoted\"",unit="b.service"} 2
+# HELP unitmgr_unit_security_exposure systemd-analyze security exposure score of the unit's applied configuration.
+# TYPE unitmgr_unit_security_exposure gauge
+unitmgr_unit_security_exposure{src="/src/\"quoted\"",unit="a.service"} 4.2
+# HELP unitmgr_unit_restarts Restarts of the unit in the last hour not caused by changes to its unit file.
+# TYPE unitmgr_unit_restarts gauge
+unitmgr_unit_restarts{src="/src/\"quoted\"",unit="a.service"} 7
+# HELP unitmgr_unit_flapping Whether the unit restarts more often than the flap threshold.
+# TYPE unitmgr_unit_flapping gauge
+unitmgr_unit_flapping{src="/src/\"quoted\"",unit="a.service"} 1
+# HELP unitmgr_unit_restart_duration_seconds Percentiles of how long the unit took to stop and become active again when it was restarted.
+# TYPE unitmgr_unit_restart_duration_seconds gauge
+unitmgr_unit_restart_duration_seconds{src="/src/\"quoted\"",unit="a.service",quantile="0.5"} 1
+unitmgr_unit_restart_duration_seconds{src="/src/\"quoted\"",unit="a.service",quantile="0.9"} 1.5
+unitmgr_unit_restart_duration_seconds{src="/src/\"quoted\"",unit="a.service",quantile="0.99"} 2
+`, buf.String())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	dir := t.TempDir()
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{"a.service": "abc"}}
+	require.NoError(t, writeMetrics(dir, []*reconciler.Reconciler{r}, true))
+
+	buf, err := ioutil.ReadFile(path.Join(dir, "unitmgr.prom"))
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "unitmgr_sync_ok{src=\"/src\"} 1\n")
+	assert.Contains(t, string(buf), "unitmgr_units{src=\"/src\"} 1\n")
+}
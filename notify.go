@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// notifyEvent is something that happened to a unit during a sync.
+type notifyEvent struct {
+	Src    string    `json:"src"`
+	Unit   string    `json:"unit"`
+	Kind   string    `json:"kind"`             // changed, failed, or recovered
+	Detail string    `json:"detail,omitempty"` // the action taken or the error
+	Time   time.Time `json:"time"`
+
+	Generation int64 `json:"generation,omitempty"` // of the change set the action belongs to, or that was current when the unit failed or recovered
+}
+
+// digest is a batch of the events of a sync pass.
+type digest struct {
+	Host   string         `json:"host"`
+	Time   time.Time      `json:"time"`
+	Events []*notifyEvent `json:"events"`
+}
+
+// Summary counts the digest's events by kind, e.g. "2 changes and 1 failure on host1".
+func (d *digest) Summary() string {
+	counts := map[string]int{}
+	for _, event := range d.Events {
+		counts[event.Kind]++
+	}
+
+	var parts []string
+	for _, kind := range []struct{ name, singular, plural string }{
+		{"changed", "change", "changes"},
+		{"failed", "failure", "failures"},
+		{"recovered", "recovery", "recoveries"},
+	} {
+		switch n := counts[kind.name]; n {
+		case 0:
+		case 1:
+			parts = append(parts, "1 "+kind.singular)
+		default:
+			parts = append(parts, fmt.Sprintf("%d %s", n, kind.plural))
+		}
+	}
+	if len(parts) > 1 {
+		parts = append(parts[:len(parts)-2], parts[len(parts)-2]+" and "+parts[len(parts)-1])
+	}
+	return strings.Join(parts, ", ") + " on " + d.Host
+}
+
+// Lines formats each event on a single line, mentioning the source directory of digests of several hosts of an inventory.
+func (d *digest) Lines() []string {
+	several := false
+	for _, event := range d.Events {
+		several = several || event.Src != d.Events[0].Src
+	}
+
+	lines := make([]string, len(d.Events))
+	for i, event := range d.Events {
+		line := fmt.Sprintf("%s %s %s", event.Time.Local().Format(time.RFC3339), event.Kind, event.Unit)
+		if event.Detail != "" {
+			line += ": " + event.Detail
+		}
+		var labels []string
+		if event.Generation > 0 {
+			labels = append(labels, fmt.Sprintf("generation %d", event.Generation))
+		}
+		if several {
+			labels = append(labels, event.Src)
+		}
+		if len(labels) > 0 {
+			line += " (" + strings.Join(labels, ", ") + ")"
+		}
+		lines[i] = strings.ReplaceAll(line, "\n", " ")
+	}
+	return lines
+}
+
+// notifier delivers digests, e.g. by email.
+type notifier interface {
+	Notify(d *digest) error
+}
+
+// digester turns successive reports into digests of what happened since the previous one.
+type digester struct {
+	seen     map[string]time.Time         // src -> time of the latest action already digested
+	failures map[string]map[string]string // src -> unit -> error already digested
+}
+
+func newDigester() *digester {
+	return &digester{seen: map[string]time.Time{}, failures: map[string]map[string]string{}}
+}
+
+// Digest returns the events since the previous digest, or nil if nothing happened.
+func (d *digester) Digest(reports []*reconciler.HostReport) *digest {
+	result := &digest{Time: time.Now().UTC()}
+	for _, report := range reports {
+		result.Host = report.Host
+		seen := d.seen[report.Src]
+		for _, unit := range sortedActions(report.Actions) {
+			action := report.Actions[unit]
+			if !action.Time.After(d.seen[report.Src]) {
+				continue
+			}
+			result.Events = append(result.Events, &notifyEvent{Src: report.Src, Unit: unit, Kind: "changed", Detail: action.Action, Time: action.Time, Generation: action.Generation})
+			if action.Time.After(seen) {
+				seen = action.Time
+			}
+		}
+		d.seen[report.Src] = seen
+
+		previous := d.failures[report.Src]
+		for _, unit := range sortedKeys(report.Failures) {
+			if msg := report.Failures[unit]; previous[unit] != msg {
+				result.Events = append(result.Events, &notifyEvent{Src: report.Src, Unit: unit, Kind: "failed", Detail: msg, Time: report.LastSync, Generation: report.Generation})
+			}
+		}
+		for _, unit := range sortedKeys(previous) {
+			if _, failing := report.Failures[unit]; !failing {
+				result.Events = append(result.Events, &notifyEvent{Src: report.Src, Unit: unit, Kind: "recovered", Time: report.LastSync, Generation: report.Generation})
+			}
+		}
+		d.failures[report.Src] = report.Failures
+	}
+
+	if len(result.Events) == 0 {
+		return nil
+	}
+	return result
+}
+
+func sortedActions(m map[string]*reconciler.UnitAction) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// notifyQueue delivers digests in the background so slow notifiers don't delay syncs.
+type notifyQueue struct {
+	Notifiers []notifier
+	digester  *digester
+	ch        chan *digest
+}
+
+func newNotifyQueue(notifiers []notifier) *notifyQueue {
+	return &notifyQueue{Notifiers: notifiers, digester: newDigester(), ch: make(chan *digest, 16)}
+}
+
+// Synced queues a digest of the events since the previous sync, if there were any.
+func (q *notifyQueue) Synced(reconcilers []*reconciler.Reconciler, ok bool) {
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(ok)
+	}
+	d := q.digester.Digest(reports)
+	if d == nil {
+		return
+	}
+
+	select {
+	case q.ch <- d:
+	default:
+		log.Printf("dropping notification since the notifiers are falling behind: %s", d.Summary())
+	}
+}
+
+// Run delivers queued digests until the queue is closed.
+func (q *notifyQueue) Run() {
+	for d := range q.ch {
+		q.deliver(d)
+	}
+}
+
+// Close stops accepting digests, Run returns once the queued ones are delivered.
+func (q *notifyQueue) Close() {
+	close(q.ch)
+}
+
+func (q *notifyQueue) deliver(d *digest) {
+	for _, n := range q.Notifiers {
+		if err := n.Notify(d); err != nil {
+			log.Printf("error while sending notification: %s", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// severities of notification events, from least to most important.
+var severities = map[string]int{"info": 0, "warning": 1, "error": 2}
+
+// eventSeverity is error for failures, warning for recoveries, and info for changes.
+func eventSeverity(event *notifyEvent) int {
+	switch event.Kind {
+	case "failed":
+		return severities["error"]
+	case "recovered":
+		return severities["warning"]
+	default:
+		return severities["info"]
+	}
+}
+
+// notifyRoutes sends the events matching each route to the route's target.
+type notifyRoutes struct {
+	Routes []*notifyRoute `json:"routes"`
+
+	now func() time.Time
+}
+
+type notifyRoute struct {
+	Name       string   `json:"name"`
+	Units      string   `json:"units"`      // glob matched against the unit name, all units when empty
+	Events     []string `json:"events"`     // event kinds (changed, failed, recovered) or actions (e.g. restarted), all events when empty
+	Severity   string   `json:"severity"`   // least important severity sent: info, warning, or error (defaults to info)
+	MaxPerHour int      `json:"maxPerHour"` // digests sent per hour, zero for no limit
+	To         string   `json:"to"`         // mailto: addresses or an http(s) webhook url
+
+	notifier notifier
+	severity int
+	sent     []time.Time
+}
+
+// loadNotifyRoutes reads the routes from a json file, creating the notifier of each target with newTarget.
+func loadNotifyRoutes(name string, newTarget func(to string) (notifier, error)) (*notifyRoutes, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	n := &notifyRoutes{now: time.Now}
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(n); err != nil {
+		return nil, fmt.Errorf("decoding notification routes: %w", err)
+	}
+
+	for i, route := range n.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if _, err := path.Match(route.Units, ""); err != nil {
+			return nil, fmt.Errorf("notification route %q has invalid units glob: %w", route.Name, err)
+		}
+		if route.Severity != "" {
+			severity, ok := severities[route.Severity]
+			if !ok {
+				return nil, fmt.Errorf("notification route %q has invalid severity %q", route.Name, route.Severity)
+			}
+			route.severity = severity
+		}
+		if route.notifier, err = newTarget(route.To); err != nil {
+			return nil, fmt.Errorf("notification route %q: %w", route.Name, err)
+		}
+	}
+	return n, nil
+}
+
+// Notify sends each route the events it matches, skipping routes that exceeded their rate limit.
+func (n *notifyRoutes) Notify(d *digest) error {
+	now := n.now()
+	var failed []string
+	for _, route := range n.Routes {
+		filtered := route.filter(d)
+		if filtered == nil {
+			continue
+		}
+		if !route.allow(now) {
+			log.Printf("dropping notification for route %q since it exceeded %d per hour: %s", route.Name, route.MaxPerHour, filtered.Summary())
+			continue
+		}
+		if err := route.notifier.Notify(filtered); err != nil {
+			failed = append(failed, fmt.Sprintf("route %q: %s", route.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// filter returns a digest of the events matching the route, or nil if none do.
+func (r *notifyRoute) filter(d *digest) *digest {
+	var events []*notifyEvent
+	for _, event := range d.Events {
+		if r.matches(event) {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return &digest{Host: d.Host, Time: d.Time, Events: events}
+}
+
+func (r *notifyRoute) matches(event *notifyEvent) bool {
+	if r.Units != "" {
+		if ok, _ := path.Match(r.Units, event.Unit); !ok {
+			return false
+		}
+	}
+	if eventSeverity(event) < r.severity {
+		return false
+	}
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, name := range r.Events {
+		if name == event.Kind || (event.Kind == "changed" && name == event.Detail) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow records a digest being sent unless the route already sent MaxPerHour in the last hour.
+func (r *notifyRoute) allow(now time.Time) bool {
+	for len(r.sent) > 0 && now.Sub(r.sent[0]) >= time.Hour {
+		r.sent = r.sent[1:]
+	}
+	if r.MaxPerHour > 0 && len(r.sent) >= r.MaxPerHour {
+		return false
+	}
+	r.sent = append(r.sent, now)
+	return true
+}
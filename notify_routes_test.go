@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNotifyRoutes(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "routes.json")
+	targets := map[string]*recordingNotifier{}
+	newTarget := func(to string) (notifier, error) {
+		if to == "" {
+			return nil, errors.New("missing target")
+		}
+		targets[to] = &recordingNotifier{}
+		return targets[to], nil
+	}
+
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"routes": [
+		{"name": "deploys", "events": ["restarted"], "to": "https://hooks.example.com/deploys"},
+		{"units": "db-*", "severity": "warning", "maxPerHour": 2, "to": "mailto:dba@example.com"}
+	]}`), 0644))
+	routes, err := loadNotifyRoutes(name, newTarget)
+	require.NoError(t, err)
+	require.Len(t, routes.Routes, 2)
+	assert.Equal(t, "deploys", routes.Routes[0].Name)
+	assert.Equal(t, "route-1", routes.Routes[1].Name)
+	assert.Equal(t, severities["warning"], routes.Routes[1].severity)
+	assert.Len(t, targets, 2)
+
+	for _, tc := range []struct{ name, body string }{
+		{"invalid severity", `{"routes": [{"severity": "critical", "to": "x"}]}`},
+		{"invalid glob", `{"routes": [{"units": "[", "to": "x"}]}`},
+		{"missing target", `{"routes": [{"name": "x"}]}`},
+		{"unknown field", `{"routes": [{"unit": "a.service", "to": "x"}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(name, []byte(tc.body), 0644))
+			_, err := loadNotifyRoutes(name, newTarget)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNotifyRoutes(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	deploys, oncall, db := &recordingNotifier{}, &recordingNotifier{}, &recordingNotifier{}
+	routes := &notifyRoutes{
+		Routes: []*notifyRoute{
+			{Name: "deploys", Events: []string{"restarted", "started"}, notifier: deploys},
+			{Name: "oncall", severity: severities["warning"], MaxPerHour: 1, notifier: oncall},
+			{Name: "db", Units: "db-*", notifier: db},
+		},
+		now: func() time.Time { return now },
+	}
+
+	restarted := &notifyEvent{Unit: "web.service", Kind: "changed", Detail: "restarted"}
+	wrote := &notifyEvent{Unit: "db-1.service", Kind: "changed", Detail: "wrote"}
+	failed := &notifyEvent{Unit: "db-2.service", Kind: "failed", Detail: "oops"}
+	require.NoError(t, routes.Notify(&digest{Host: "host1", Events: []*notifyEvent{restarted, wrote, failed}}))
+
+	require.Len(t, deploys.Digests, 1)
+	assert.Equal(t, []*notifyEvent{restarted}, deploys.Digests[0].Events)
+	assert.Equal(t, "host1", deploys.Digests[0].Host)
+	require.Len(t, oncall.Digests, 1)
+	assert.Equal(t, []*notifyEvent{failed}, oncall.Digests[0].Events)
+	require.Len(t, db.Digests, 1)
+	assert.Equal(t, []*notifyEvent{wrote, failed}, db.Digests[0].Events)
+
+	// Rate limited
+	recovered := &notifyEvent{Unit: "db-2.service", Kind: "recovered"}
+	require.NoError(t, routes.Notify(&digest{Host: "host1", Events: []*notifyEvent{recovered}}))
+	assert.Len(t, oncall.Digests, 1)
+	assert.Len(t, db.Digests, 2)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, routes.Notify(&digest{Host: "host1", Events: []*notifyEvent{recovered}}))
+	assert.Len(t, oncall.Digests, 2)
+	assert.Len(t, deploys.Digests, 1)
+}
+
+func TestNotifyRoutesError(t *testing.T) {
+	routes := &notifyRoutes{
+		Routes: []*notifyRoute{{Name: "broken", notifier: &failingNotifier{}}, {Name: "ok", notifier: &recordingNotifier{}}},
+		now:    time.Now,
+	}
+	err := routes.Notify(&digest{Host: "host1", Events: []*notifyEvent{{Unit: "a.service", Kind: "failed"}}})
+	assert.EqualError(t, err, `route "broken": oops`)
+	assert.Len(t, routes.Routes[1].notifier.(*recordingNotifier).Digests, 1)
+}
+
+type failingNotifier struct{}
+
+func (f *failingNotifier) Notify(d *digest) error {
+	return errors.New("oops")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestSummary(t *testing.T) {
+	d := &digest{Host: "host1", Events: []*notifyEvent{{Kind: "changed"}}}
+	assert.Equal(t, "1 change on host1", d.Summary())
+
+	d.Events = append(d.Events, &notifyEvent{Kind: "changed"}, &notifyEvent{Kind: "failed"})
+	assert.Equal(t, "2 changes and 1 failure on host1", d.Summary())
+
+	d.Events = append(d.Events, &notifyEvent{Kind: "recovered"}, &notifyEvent{Kind: "recovered"})
+	assert.Equal(t, "2 changes, 1 failure and 2 recoveries on host1", d.Summary())
+}
+
+func TestDigestLines(t *testing.T) {
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)
+	d := &digest{Host: "host1", Events: []*notifyEvent{
+		{Src: "/src", Unit: "a.service", Kind: "changed", Detail: "restarted", Time: t1, Generation: 4},
+		{Src: "/src", Unit: "b.service", Kind: "recovered", Time: t1},
+	}}
+	ts := t1.Format(time.RFC3339)
+	assert.Equal(t, []string{ts + " changed a.service: restarted (generation 4)", ts + " recovered b.service"}, d.Lines())
+
+	d.Events[1].Src = "/other"
+	assert.Equal(t, []string{ts + " changed a.service: restarted (generation 4, /src)", ts + " recovered b.service (/other)"}, d.Lines())
+}
+
+func TestDigester(t *testing.T) {
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := newDigester()
+
+	assert.Nil(t, d.Digest([]*reconciler.HostReport{{Host: "host1", Src: "/src"}}))
+
+	result := d.Digest([]*reconciler.HostReport{{
+		Host:     "host1",
+		Src:      "/src",
+		LastSync: t1,
+		Actions:  map[string]*reconciler.UnitAction{"a.service": {Action: "restarted", Time: t1}},
+		Failures: map[string]string{"b.service": "oops"},
+	}})
+	require.NotNil(t, result)
+	assert.Equal(t, "host1", result.Host)
+	assert.Equal(t, []*notifyEvent{
+		{Src: "/src", Unit: "a.service", Kind: "changed", Detail: "restarted", Time: t1},
+		{Src: "/src", Unit: "b.service", Kind: "failed", Detail: "oops", Time: t1},
+	}, result.Events)
+
+	// Nothing new happened
+	assert.Nil(t, d.Digest([]*reconciler.HostReport{{
+		Host:     "host1",
+		Src:      "/src",
+		LastSync: t1.Add(time.Minute),
+		Actions:  map[string]*reconciler.UnitAction{"a.service": {Action: "restarted", Time: t1}},
+		Failures: map[string]string{"b.service": "oops"},
+	}}))
+
+	t2 := t1.Add(time.Hour)
+	result = d.Digest([]*reconciler.HostReport{{
+		Host:     "host1",
+		Src:      "/src",
+		LastSync: t2,
+		Actions:  map[string]*reconciler.UnitAction{"a.service": {Action: "restarted", Time: t1}, "b.service": {Action: "started", Time: t2}},
+	}})
+	require.NotNil(t, result)
+	assert.Equal(t, []*notifyEvent{
+		{Src: "/src", Unit: "b.service", Kind: "changed", Detail: "started", Time: t2},
+		{Src: "/src", Unit: "b.service", Kind: "recovered", Time: t2},
+	}, result.Events)
+}
+
+func TestNotifyQueue(t *testing.T) {
+	n := &recordingNotifier{}
+	q := newNotifyQueue([]notifier{n})
+
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{}, Failures: map[string]string{"a.service": "oops"}}
+	q.Synced([]*reconciler.Reconciler{r}, false)
+	q.Synced([]*reconciler.Reconciler{r}, false) // nothing new
+	q.Close()
+	q.Run()
+
+	require.Len(t, n.Digests, 1)
+	assert.Equal(t, "failed", n.Digests[0].Events[0].Kind)
+}
+
+type recordingNotifier struct {
+	Digests []*digest
+}
+
+func (r *recordingNotifier) Notify(d *digest) error {
+	r.Digests = append(r.Digests, d)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const opsgenieURL = "https://api.opsgenie.com"
+
+// opsgenie opens and closes alerts with the Opsgenie Alert API.
+type opsgenie struct {
+	APIKey string
+	URL    string // e.g. https://api.eu.opsgenie.com for the EU instance
+	Client *http.Client
+}
+
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Source      string            `json:"source"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+func (o *opsgenie) Trigger(inc *incident) error {
+	source, _ := os.Hostname()
+	message := inc.Summary
+	if len(message) > 130 {
+		message = message[:130] // the maximum length of alert messages
+	}
+	return o.post("/v2/alerts", &opsgenieAlert{
+		Message:     message,
+		Alias:       incidentID(inc.Key),
+		Description: inc.Summary,
+		Source:      source,
+		Details:     inc.Details,
+	})
+}
+
+func (o *opsgenie) Resolve(key string) error {
+	source, _ := os.Hostname()
+	return o.post("/v2/alerts/"+url.PathEscape(incidentID(key))+"/close?identifierType=alias", map[string]string{"source": source})
+}
+
+func (o *opsgenie) post(path string, body interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.URL, "/")+path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+o.APIKey)
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
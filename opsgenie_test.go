@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpsgenie(t *testing.T) {
+	var requests []string
+	var alert *opsgenieAlert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GenieKey key", r.Header.Get("Authorization"))
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.URL.Path == "/v2/alerts" {
+			alert = &opsgenieAlert{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(alert))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	o := &opsgenie{APIKey: "key", URL: server.URL + "/", Client: server.Client()}
+	require.NoError(t, o.Trigger(&incident{Key: "/src/a.service/failing", Summary: strings.Repeat("x", 200)}))
+	require.NoError(t, o.Resolve("/src/a.service/failing"))
+
+	id := incidentID("/src/a.service/failing")
+	assert.Equal(t, []string{"POST /v2/alerts", "POST /v2/alerts/" + id + "/close?identifierType=alias"}, requests)
+	assert.Equal(t, id, alert.Alias)
+	assert.Len(t, alert.Message, 130)
+	assert.Len(t, alert.Description, 200)
+}
+
+func TestOpsgenieError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	o := &opsgenie{APIKey: "key", URL: server.URL, Client: server.Client()}
+	assert.EqualError(t, o.Resolve("/src/a.service/failing"), "unexpected status 401")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// outputFormats are the values of -output. Commands print tables for humans unless json or yaml is requested.
+var outputFormats = []string{"table", "json", "yaml"}
+
+func validOutput(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// structured writes v as -output json or yaml and returns true, or returns false if the command should print its
+// table. Values are encoded as json first, so yaml output has the same field names.
+func structured(w io.Writer, v interface{}) bool {
+	switch *output {
+	case "json":
+		buf, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			panic(err) // only fails for values that can't be encoded, i.e. bugs
+		}
+		fmt.Fprintf(w, "%s\n", buf)
+		return true
+	case "yaml":
+		if err := writeYAML(w, v); err != nil {
+			panic(err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// writeYAML writes v as a block style yaml document.
+func writeYAML(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	encodeYAML(out, generic, 0)
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+func encodeYAML(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.WriteString(pad + yamlScalar(key) + ":")
+			if nested(v[key]) {
+				b.WriteString("\n")
+				encodeYAML(b, v[key], indent+2)
+			} else {
+				b.WriteString(" " + yamlScalar(v[key]) + "\n")
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			if !nested(item) {
+				b.WriteString(pad + "- " + yamlScalar(item) + "\n")
+				continue
+			}
+			// Nested values start on the line of their dash
+			block := &bytes.Buffer{}
+			encodeYAML(block, item, indent+2)
+			b.WriteString(pad + "- ")
+			b.Write(block.Bytes()[indent+2:])
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// nested returns true for maps and lists that aren't empty, which are written as blocks.
+func nested(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	default:
+		return false
+	}
+}
+
+// plainYAML matches strings that can be written without quotes and aren't read back as another type.
+var plainYAML = regexp.MustCompile(`^[A-Za-z_/.][A-Za-z0-9_/.@+-]*( [A-Za-z0-9_/.@+-]+)*$`)
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	case bool:
+		return fmt.Sprint(v)
+	case json.Number:
+		return v.String()
+	case string:
+		switch strings.ToLower(v) {
+		case "true", "false", "yes", "no", "on", "off", "null", "y", "n":
+		default:
+			if plainYAML.MatchString(v) {
+				return v
+			}
+		}
+		buf, _ := json.Marshal(v) // json strings are valid double quoted yaml
+		return string(buf)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStructured(t *testing.T) {
+	defer func(format string) { *output = format }(*output)
+	value := &rollbackResult{Generation: 3, Restored: 2}
+
+	buf := &bytes.Buffer{}
+	*output = "table"
+	assert.False(t, structured(buf, value))
+	assert.Empty(t, buf.String())
+
+	*output = "json"
+	require.True(t, structured(buf, value))
+	assert.Equal(t, "{\n  \"generation\": 3,\n  \"restored\": 2\n}\n", buf.String())
+
+	buf.Reset()
+	*output = "yaml"
+	require.True(t, structured(buf, value))
+	assert.Equal(t, "generation: 3\nrestored: 2\n", buf.String())
+
+	assert.True(t, validOutput("yaml"))
+	assert.False(t, validOutput("xml"))
+}
+
+func TestWriteYAML(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeYAML(buf, map[string]interface{}{
+		"units": []interface{}{
+			map[string]interface{}{"unit": "a.service", "diff": []string{"-ExecStart=/bin/a", "+ExecStart=/bin/b"}},
+			map[string]interface{}{"unit": "b.service", "action": "remove"},
+		},
+		"empty":   []string{},
+		"none":    nil,
+		"ok":      true,
+		"quoted":  "yes",
+		"message": "error: oops\nagain",
+		"ref":     "v1.4.2",
+	}))
+	assert.Equal(t, `empty: []
+message: "error: oops\nagain"
+none: null
+ok: true
+quoted: "yes"
+ref: v1.4.2
+units:
+  - diff:
+      - "-ExecStart=/bin/a"
+      - "+ExecStart=/bin/b"
+    unit: a.service
+  - action: remove
+    unit: b.service
+`, buf.String())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+)
+
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDuty opens and resolves incidents with the PagerDuty Events API v2.
+type pagerDuty struct {
+	RoutingKey string // integration key of the service
+	URL        string
+	Client     *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // trigger or resolve
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+func (p *pagerDuty) Trigger(inc *incident) error {
+	source, _ := os.Hostname()
+	return postJSON(p.Client, p.URL, &pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    incidentID(inc.Key),
+		Payload:     &pagerDutyPayload{Summary: inc.Summary, Source: source, Severity: "error", CustomDetails: inc.Details},
+	})
+}
+
+func (p *pagerDuty) Resolve(key string) error {
+	return postJSON(p.Client, p.URL, &pagerDutyEvent{RoutingKey: p.RoutingKey, EventAction: "resolve", DedupKey: incidentID(key)})
+}
+
+// incidentID returns a stable identifier of an incident that's unique across hosts,
+// since the keys of different hosts with the same src are the same.
+func incidentID(key string) string {
+	host, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(host + ":" + key))
+	return "unitmgr-" + hex.EncodeToString(sum[:16])
+}
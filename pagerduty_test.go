@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPagerDuty(t *testing.T) {
+	var events []*pagerDutyEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &pagerDutyEvent{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(event))
+		events = append(events, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	p := &pagerDuty{RoutingKey: "key", URL: server.URL, Client: server.Client()}
+	require.NoError(t, p.Trigger(&incident{Key: "/src/a.service/failing", Summary: "oops", Details: map[string]string{"unit": "a.service"}}))
+	require.NoError(t, p.Resolve("/src/a.service/failing"))
+
+	require.Len(t, events, 2)
+	assert.Equal(t, "trigger", events[0].EventAction)
+	assert.Equal(t, "key", events[0].RoutingKey)
+	assert.Equal(t, "oops", events[0].Payload.Summary)
+	assert.Equal(t, "error", events[0].Payload.Severity)
+	assert.Equal(t, map[string]string{"unit": "a.service"}, events[0].Payload.CustomDetails)
+	assert.Equal(t, "resolve", events[1].EventAction)
+	assert.Equal(t, events[0].DedupKey, events[1].DedupKey)
+	assert.Nil(t, events[1].Payload)
+}
+
+func TestIncidentID(t *testing.T) {
+	assert.Equal(t, incidentID("/src/a.service/failing"), incidentID("/src/a.service/failing"))
+	assert.NotEqual(t, incidentID("/src/a.service/failing"), incidentID("/src/b.service/failing"))
+	assert.Regexp(t, "^unitmgr-[0-9a-f]{32}$", incidentID("/src/a.service/failing"))
+}
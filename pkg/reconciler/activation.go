@@ -0,0 +1,74 @@
+package reconciler
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// activatingTypes are the suffixes of units that start the service of the same name on demand.
+var activatingTypes = []string{".socket", ".timer"}
+
+// activator returns the socket or timer in Src that activates a service, if Activation is set.
+func (r *Reconciler) activator(unit string) (string, bool) {
+	for _, name := range r.activators(unit) {
+		if _, err := os.Stat(path.Join(r.Src, name)); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// activators returns the names of the units that could activate a service.
+func (r *Reconciler) activators(unit string) []string {
+	if !r.Activation || path.Ext(unit) != ".service" {
+		return nil
+	}
+	base := strings.TrimSuffix(unit, ".service")
+	names := make([]string, len(activatingTypes))
+	for i, suffix := range activatingTypes {
+		names[i] = base + suffix
+	}
+	return names
+}
+
+// restartActivated applies a changed unit file to a service that's started by its activator,
+// returning false if the service isn't activated and should be restarted as usual.
+// Inactive services are left for their activator to start, rather than being started before they're needed.
+func (r *Reconciler) restartActivated(ctx context.Context, unit string) (bool, error) {
+	activator, ok := r.activator(unit)
+	if !ok {
+		return false, nil
+	}
+	checker, ok := r.Systemd.(ActiveChecker)
+	if !ok {
+		return false, nil
+	}
+	if active, err := checker.IsActive(ctx, unit); err != nil || active {
+		return false, err
+	}
+
+	if reloader, ok := r.Systemd.(Reloader); ok {
+		if err := reloader.Reload(ctx, unit); err != nil {
+			return true, err
+		}
+	}
+	log.Printf("not restarting unit %s since it's inactive and activated by %s", unit, activator)
+	return true, nil
+}
+
+// stopActivators stops the sockets and timers of a removed service that are being removed too,
+// so they don't start it again before they're removed themselves.
+func (r *Reconciler) stopActivators(ctx context.Context, unit string) bool {
+	for _, name := range r.activators(unit) {
+		if _, err := os.Stat(path.Join(r.Src, name)); err == nil || !r.Manages(name) {
+			continue
+		}
+		if !r.stopUnit(ctx, name) {
+			return false
+		}
+	}
+	return true
+}
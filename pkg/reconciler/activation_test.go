@@ -0,0 +1,53 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivation(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{Active: map[string]bool{}}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Activation: true}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.service"), []byte("[Service]\nExecStart=/bin/web\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.socket"), []byte("[Socket]\nListenStream=80\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "backup.service"), []byte("[Service]\nType=oneshot\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "backup.timer"), []byte("[Timer]\nOnCalendar=daily\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "db.service"), []byte("[Service]\nExecStart=/bin/db\n"), 0644))
+
+	// Only the activators and services without one are started
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning backup.timer", "EnsureRunning db.service", "EnsureRunning web.socket"}, sysd.Cmds)
+	assert.True(t, r.Manages("web.service"))
+
+	// Inactive services are only reloaded when they change, active ones are restarted
+	sysd.Cmds = nil
+	sysd.Active["web.service"] = true
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.service"), []byte("[Service]\nExecStart=/bin/web2\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "backup.service"), []byte("[Service]\nType=oneshot\nExecStart=/bin/backup\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Contains(t, sysd.Cmds, "Reload backup.service")
+	assert.NotContains(t, sysd.Cmds, "Restart backup.service")
+	assert.Contains(t, sysd.Cmds, "Restart web.service")
+
+	// Removed services stop their removed activators first
+	sysd.Cmds = nil
+	require.NoError(t, os.Remove(path.Join(src, "web.service")))
+	require.NoError(t, os.Remove(path.Join(src, "web.socket")))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureStopped web.socket", "EnsureStopped web.service", "EnsureStopped web.socket"}, sysd.Cmds[2:])
+	assert.False(t, r.Manages("web.socket"))
+
+	// Without Activation, every service is started
+	sysd.Cmds = nil
+	r.Activation = false
+	r.State = map[string]string{}
+	require.True(t, r.Sync(context.Background()))
+	assert.Contains(t, sysd.Cmds, "EnsureRunning backup.service")
+}
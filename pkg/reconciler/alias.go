@@ -0,0 +1,156 @@
+package reconciler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// unitAliases returns the names a unit declares with Alias= in its [Install] section. Like systemd, it only
+// accepts names of units of the same type, so e.g. db.service can alias postgresql.service but not db.socket.
+func unitAliases(unit string, parsed *UnitFile) ([]string, error) {
+	seen := map[string]bool{}
+	var aliases []string
+	for _, value := range parsed.Values("Install", "Alias") {
+		for _, alias := range strings.Fields(value) {
+			if alias == unit || seen[alias] {
+				continue
+			}
+			if strings.Contains(alias, "/") || path.Ext(alias) != path.Ext(unit) || strings.HasPrefix(alias, ".") {
+				return nil, fmt.Errorf("invalid alias %q, aliases must be names of %s units", alias, strings.TrimPrefix(path.Ext(unit), "."))
+			}
+			seen[alias] = true
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+// linkAliases links the aliases to the unit in its directory, and removes the links to the unit this instance
+// made for aliases it no longer declares. Aliases are only linked for enabled units, since systemd creates them
+// when enabling units, so others pass no aliases to remove their links.
+func (r *Reconciler) linkAliases(unit string, aliases []string) error {
+	linker, ok := r.target().(Linker)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	previous := r.aliases[unit]
+	r.mu.Unlock()
+
+	for _, alias := range aliases {
+		if _, err := os.Lstat(path.Join(r.Src, alias)); err == nil {
+			return fmt.Errorf("alias %s conflicts with the unit file of the same name", alias)
+		}
+		if !r.ownsName(unit, alias) {
+			if err := r.checkAliasFree(unit, alias); err != nil {
+				return err
+			}
+		}
+		if err := linker.Link(alias, unit); err != nil {
+			return fmt.Errorf("linking alias %s: %w", alias, err)
+		}
+	}
+	declared := map[string]bool{}
+	for _, alias := range aliases {
+		declared[alias] = true
+	}
+	for _, alias := range previous {
+		if declared[alias] {
+			continue
+		}
+		if err := linker.Unlink(alias); err != nil {
+			return fmt.Errorf("unlinking alias %s: %w", alias, err)
+		}
+		log.Printf("removed alias %s of unit %s", alias, unit)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(aliases) == 0 {
+		delete(r.aliases, unit)
+		return nil
+	}
+	if r.aliases == nil {
+		r.aliases = map[string][]string{}
+	}
+	r.aliases[unit] = aliases
+	return nil
+}
+
+// ownsName returns true if the name is already linked as one of the unit's aliases or is a unit file this instance
+// manages, so linking an alias by that name doesn't replace unit files written by others.
+func (r *Reconciler) ownsName(unit, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, alias := range r.aliases[unit] {
+		if alias == name {
+			return true
+		}
+	}
+	_, ok := r.State[name]
+	return ok
+}
+
+// checkAliasFree returns an error if something other than a link to the unit exists by the alias' name. Links to the
+// unit are already its alias, e.g. linked before unitmgr restarted without -state or by systemctl enable, but regular
+// files and links to other units aren't replaced. Destinations that can't read links fall back to checking whether a
+// unit file exists by that name.
+func (r *Reconciler) checkAliasFree(unit, alias string) error {
+	reader, ok := r.target().(LinkReader)
+	if !ok {
+		_, err := r.target().Checksum(alias)
+		if err == nil {
+			return fmt.Errorf("alias %s conflicts with a unit file not managed by unitmgr", alias)
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("checking alias %s: %w", alias, err)
+		}
+		return nil
+	}
+
+	target, err := reader.Readlink(alias)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case errors.Is(err, syscall.EINVAL):
+		return fmt.Errorf("alias %s conflicts with a unit file not managed by unitmgr", alias)
+	case err != nil:
+		return fmt.Errorf("checking alias %s: %w", alias, err)
+	case target != unit:
+		return fmt.Errorf("alias %s conflicts with a link to %s not managed by unitmgr", alias, target)
+	}
+	return nil
+}
+
+// aliasOf returns the applied unit the name is a linked alias of, or "" if it isn't one.
+func (r *Reconciler) aliasOf(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for unit, aliases := range r.aliases {
+		for _, alias := range aliases {
+			if alias == name {
+				return unit
+			}
+		}
+	}
+	return ""
+}
+
+// Aliases returns the aliases linked to each unit, see linkAliases.
+func (r *Reconciler) Aliases() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	aliases := make(map[string][]string, len(r.aliases))
+	for unit, names := range r.aliases {
+		aliases[unit] = append([]string(nil), names...)
+	}
+	return aliases
+}
@@ -0,0 +1,128 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitAliases(t *testing.T) {
+	parsed, err := ParseUnitFile(strings.NewReader("[Install]\nAlias=pg.service db.service\nAlias=db.service postgres.service\n"))
+	require.NoError(t, err)
+	aliases, err := unitAliases("postgres.service", parsed)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db.service", "pg.service"}, aliases)
+
+	for _, invalid := range []string{"db.socket", "../db.service", ".db.service"} {
+		parsed, err := ParseUnitFile(strings.NewReader("[Install]\nAlias=" + invalid + "\n"))
+		require.NoError(t, err)
+		_, err = unitAliases("postgres.service", parsed)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	sysd := &enablingSystemd{&fakeSystemd{}}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	unit := path.Join(src, "postgres.service")
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Install]\nWantedBy=multi-user.target\nAlias=db.service pg.service\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "cache.service"), []byte("[Install]\nAlias=memcached.service\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	for _, alias := range []string{"db.service", "pg.service"} {
+		target, err := os.Readlink(path.Join(dest, alias))
+		require.NoError(t, err)
+		assert.Equal(t, "postgres.service", target)
+	}
+	assert.NoFileExists(t, path.Join(dest, "memcached.service"), "units that aren't enabled have no aliases")
+	assert.Equal(t, map[string][]string{"postgres.service": {"db.service", "pg.service"}}, r.Aliases())
+
+	// Aliases that are no longer declared are removed
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Install]\nWantedBy=multi-user.target\nAlias=db.service\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.FileExists(t, path.Join(dest, "db.service"))
+	assert.NoFileExists(t, path.Join(dest, "pg.service"))
+
+	// Removing the unit removes its aliases without stopping it through them
+	sysd.Cmds = nil
+	require.NoError(t, os.Remove(unit))
+	require.True(t, r.Sync(context.Background()))
+	assert.NoFileExists(t, path.Join(dest, "postgres.service"))
+	_, err := os.Lstat(path.Join(dest, "db.service"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"EnsureRunning cache.service", "EnsureStopped postgres.service"}, sysd.Cmds)
+	assert.Empty(t, r.Aliases())
+}
+
+func TestAliasReplacingUnit(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	sysd := &enablingSystemd{&fakeSystemd{}}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "db.service"), []byte("[Service]\nExecStart=/bin/db\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "postgres.service"), []byte("[Install]\nAlias=db.service\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["postgres.service"], "alias db.service conflicts with the unit file of the same name")
+
+	// The unit the alias replaces isn't stopped or removed as an orphan
+	sysd.Cmds = nil
+	require.NoError(t, os.Remove(path.Join(src, "db.service")))
+	require.True(t, r.Sync(context.Background()))
+	target, err := os.Readlink(path.Join(dest, "db.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "postgres.service", target)
+	assert.NotContains(t, sysd.Cmds, "EnsureStopped db.service")
+	assert.NotContains(t, r.State, "db.service")
+}
+
+func TestAliasReplacingUnmanagedFile(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &enablingSystemd{&fakeSystemd{}}}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "sshd.service"), []byte("[Service]\nExecStart=/usr/sbin/sshd\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "evil.service"), []byte("[Install]\nAlias=sshd.service\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["evil.service"], "alias sshd.service conflicts with a unit file not managed by unitmgr")
+
+	content, err := ioutil.ReadFile(path.Join(dest, "sshd.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/usr/sbin/sshd\n", string(content))
+	assert.Empty(t, r.Aliases())
+}
+
+func TestAliasLinkedBeforeRestart(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	unit := "[Install]\nWantedBy=multi-user.target\nAlias=db.service pg.service\n\n[X-Unitmgr]\nPlacement=persistent\n"
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "postgres.service"), []byte(unit), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "postgres.service"), []byte(unit), 0644))
+
+	// Linked by a previous instance without -state, and by systemctl enable
+	require.NoError(t, os.Symlink("postgres.service", path.Join(dest, "db.service")))
+	require.NoError(t, os.Symlink(path.Join(dest, "postgres.service"), path.Join(dest, "pg.service")))
+
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &enablingSystemd{&fakeSystemd{}}}
+	require.True(t, r.Sync(context.Background()), "%v", r.Failures)
+	assert.Equal(t, map[string][]string{"postgres.service": {"db.service", "pg.service"}}, r.Aliases())
+	require.True(t, r.Sync(context.Background()), "%v", r.Failures)
+}
+
+func TestAliasReplacingUnmanagedLink(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &enablingSystemd{&fakeSystemd{}}}
+
+	require.NoError(t, os.Symlink("/lib/systemd/system/sshd.service", path.Join(dest, "ssh.service")))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "evil.service"), []byte("[Install]\nAlias=ssh.service\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["evil.service"], "alias ssh.service conflicts with a link to /lib/systemd/system/sshd.service not managed by unitmgr")
+
+	target, err := os.Readlink(path.Join(dest, "ssh.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "/lib/systemd/system/sshd.service", target)
+}
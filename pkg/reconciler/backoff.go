@@ -0,0 +1,74 @@
+package reconciler
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff schedules retries of failing units with exponential backoff and jitter.
+type Backoff struct {
+	Base, Cap time.Duration
+
+	rand    *rand.Rand
+	entries map[string]*backoffEntry // unit (or "" for failures that aren't specific to a unit) -> retry state
+}
+
+type backoffEntry struct {
+	Failures int
+	Next     time.Time
+}
+
+func NewBackoff(base, cap time.Duration) *Backoff {
+	return &Backoff{
+		Base:    base,
+		Cap:     cap,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		entries: map[string]*backoffEntry{},
+	}
+}
+
+// Failed records a failed attempt and schedules the next one.
+func (b *Backoff) Failed(key string, now time.Time) {
+	entry, ok := b.entries[key]
+	if !ok {
+		entry = &backoffEntry{}
+		b.entries[key] = entry
+	}
+	entry.Failures++
+	entry.Next = now.Add(b.delay(entry.Failures))
+}
+
+// Succeeded resets the backoff of a key after a successful attempt.
+func (b *Backoff) Succeeded(key string) {
+	delete(b.entries, key)
+}
+
+// Next returns the time of the earliest scheduled retry.
+func (b *Backoff) Next() (time.Time, bool) {
+	var (
+		next time.Time
+		ok   bool
+	)
+	for _, entry := range b.entries {
+		if !ok || entry.Next.Before(next) {
+			next = entry.Next
+			ok = true
+		}
+	}
+	return next, ok
+}
+
+// delay returns a duration between half of and the full exponential backoff for the given number of failures.
+func (b *Backoff) delay(failures int) time.Duration {
+	d := b.Base
+	for i := 1; i < failures && d < b.Cap; i++ {
+		d *= 2
+	}
+	if d > b.Cap {
+		d = b.Cap
+	}
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(b.rand.Int63n(int64(d/2)))
+}
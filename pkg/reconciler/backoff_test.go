@@ -0,0 +1,101 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute)
+	for failures, max := range map[int]time.Duration{
+		1:  time.Second,
+		2:  time.Second * 2,
+		3:  time.Second * 4,
+		7:  time.Minute,
+		50: time.Minute,
+	} {
+		for i := 0; i < 20; i++ {
+			d := b.delay(failures)
+			assert.GreaterOrEqual(t, int64(d), int64(max/2))
+			assert.Less(t, int64(d), int64(max))
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	now := time.Now()
+	b := NewBackoff(time.Second, time.Minute)
+
+	_, ok := b.Next()
+	assert.False(t, ok)
+
+	b.Failed("a.service", now)
+	b.Failed("a.service", now)
+	b.Failed("b.service", now)
+	assert.Equal(t, 2, b.entries["a.service"].Failures)
+
+	next, ok := b.Next()
+	assert.True(t, ok)
+	assert.Equal(t, b.entries["b.service"].Next, next)
+
+	b.Succeeded("b.service")
+	next, _ = b.Next()
+	assert.Equal(t, b.entries["a.service"].Next, next)
+}
+
+func TestSyncBackoff(t *testing.T) {
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}, Backoff: NewBackoff(time.Second, time.Minute)}
+
+	assert.True(t, r.Sync(context.Background()))
+	_, ok := r.NextRetry()
+	assert.False(t, ok)
+
+	r.Src = "/does/not/exist"
+	assert.False(t, r.Sync(context.Background()))
+	_, ok = r.NextRetry()
+	assert.True(t, ok)
+
+	r.Src = src
+	assert.True(t, r.Sync(context.Background()))
+	_, ok = r.NextRetry()
+	assert.False(t, ok)
+}
+
+func TestRetryFailedUnitsOnly(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{Errs: map[string]error{"broken.service": errors.New("oops")}}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Backoff: NewBackoff(time.Second, time.Minute)}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "broken.service"), []byte("broken"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "healthy.service"), []byte("healthy"), 0644))
+
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures, "broken.service")
+
+	// Nothing is due yet
+	sysd.Cmds = nil
+	assert.False(t, r.Retry(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+
+	// Only the failed unit is retried once due
+	r.Backoff.entries["broken.service"].Next = time.Now()
+	assert.False(t, r.Retry(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning broken.service"}, sysd.Cmds)
+	assert.Equal(t, 2, r.Backoff.entries["broken.service"].Failures)
+
+	// Recovered units are removed from the backoff
+	delete(sysd.Errs, "broken.service")
+	r.Backoff.entries["broken.service"].Next = time.Now()
+	assert.True(t, r.Retry(context.Background()))
+	assert.Empty(t, r.Failures)
+	_, ok := r.NextRetry()
+	assert.False(t, ok)
+}
@@ -0,0 +1,111 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+)
+
+// unitTypes are the suffixes of systemd unit files, which must parse to be applied atomically.
+// Other files, like the scripts of other init systems, are only checked when they parse.
+var unitTypes = map[string]bool{
+	".service": true, ".socket": true, ".device": true, ".mount": true, ".automount": true, ".swap": true,
+	".target": true, ".path": true, ".timer": true, ".slice": true, ".scope": true,
+}
+
+// dependencyKeys are the [Unit] directives that fail a unit when the units they name don't exist.
+var dependencyKeys = []string{"Requires", "Requisite", "BindsTo", "PartOf", "Upholds"}
+
+// Problem is a reason a batch of changes can't be applied.
+type Problem struct {
+	Unit    string
+	Message string
+}
+
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Unit, p.Message)
+}
+
+// Verify checks every pending change as a whole before any is applied: changed unit files must parse
+// and satisfy the linter and policy, and must not depend on units the same changes remove.
+func (r *Reconciler) Verify() ([]*Problem, error) {
+	changes, err := r.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[string]bool{}
+	for _, change := range changes {
+		if change.Action == "remove" {
+			removed[change.Unit] = true
+		}
+	}
+
+	var problems []*Problem
+	for _, change := range changes {
+		if change.Action != "create" && change.Action != "update" {
+			continue
+		}
+		problems = append(problems, r.verifyUnit(change.Unit, removed)...)
+	}
+	return problems, nil
+}
+
+func (r *Reconciler) verifyUnit(unit string, removed map[string]bool) []*Problem {
+	file, err := os.Open(path.Join(r.Src, unit))
+	if err != nil {
+		return []*Problem{{Unit: unit, Message: err.Error()}}
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		if unitTypes[path.Ext(unit)] {
+			return []*Problem{{Unit: unit, Message: fmt.Sprintf("unable to parse: %s", err)}}
+		}
+		return nil
+	}
+
+	var problems []*Problem
+	if r.Linter != nil && r.Linter.Strict {
+		for _, finding := range r.Linter.Lint(unit, parsed) {
+			problems = append(problems, &Problem{Unit: unit, Message: "lint error " + finding.String()})
+		}
+	}
+	if r.Policy != nil {
+		for _, v := range r.Policy.Evaluate(unit, parsed) {
+			problems = append(problems, &Problem{Unit: unit, Message: "policy violation " + v.String()})
+		}
+	}
+	for _, key := range dependencyKeys {
+		for _, dep := range splitValues(parsed.Values("Unit", key)) {
+			if removed[dep] {
+				problems = append(problems, &Problem{Unit: unit, Message: fmt.Sprintf("%s=%s is removed by the same changes", key, dep)})
+			}
+		}
+	}
+	return problems
+}
+
+// verifyBatch returns false and fails the offending units if the pending changes can't be applied as a whole.
+func (r *Reconciler) verifyBatch() bool {
+	if !r.Atomic {
+		return true
+	}
+	problems, err := r.Verify()
+	if err != nil {
+		log.Printf("error while verifying changes: %s", err)
+		return false
+	}
+	if len(problems) == 0 {
+		return true
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Unit < problems[j].Unit })
+	for _, p := range problems {
+		r.fail(p.Unit, ValidationError, "not applying any changes since unit %q is invalid: %s", p.Unit, p.Message)
+	}
+	return false
+}
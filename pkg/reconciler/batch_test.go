@@ -0,0 +1,61 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncAtomic(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd, Atomic: true}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "db.service"), []byte("[Service]\nExecStart=/bin/db\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.service"), []byte("[Unit]\nRequires=db.service\n[Service]\nExecStart=/bin/web\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "broken.service"), []byte("not a unit file"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "openrc-script"), []byte("#!/sbin/openrc-run"), 0755))
+
+	// Nothing is applied while any changed unit is invalid
+	assert.False(t, r.Sync(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+	assert.NoFileExists(t, path.Join(dest, "db.service"))
+	assert.Contains(t, r.Failures["broken.service"], "unable to parse")
+
+	// Changes held back are applied once the batch is fixed, even if only the broken unit changed
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "broken.service"), []byte("[Service]\nExecStart=/bin/fixed\n"), 0644))
+	assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "broken.service")}))
+	assert.FileExists(t, path.Join(dest, "db.service"))
+	assert.FileExists(t, path.Join(dest, "web.service"))
+	assert.FileExists(t, path.Join(dest, "openrc-script"))
+
+	// Units can't depend on units removed by the same changes
+	sysd.Cmds = nil
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "web.service"), []byte("[Unit]\nRequires=db.service\n[Service]\nExecStart=/bin/web2\n"), 0644))
+	require.NoError(t, os.Remove(path.Join(src, "db.service")))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Equal(t, "not applying any changes since unit \"web.service\" is invalid: Requires=db.service is removed by the same changes", r.Failures["web.service"])
+	assert.Empty(t, sysd.Cmds)
+	assert.FileExists(t, path.Join(dest, "db.service"))
+}
+
+func TestVerify(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	linter, err := NewLinter("strict", "")
+	require.NoError(t, err)
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Linter: linter}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	problems, err := r.Verify()
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, "a.service", problems[0].Unit)
+	assert.Contains(t, problems[0].String(), "lint error")
+}
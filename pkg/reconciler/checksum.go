@@ -0,0 +1,87 @@
+package reconciler
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// ChecksumCache avoids re-hashing files whose size and modification time haven't changed.
+type ChecksumCache struct {
+	Hasher Hasher // optional, defaults to sha256
+
+	mu      sync.Mutex
+	entries map[string]*checksumEntry
+	now     func() time.Time
+}
+
+type checksumEntry struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+}
+
+// racyWindow is how recently a file must have been modified for its checksum to not be cached.
+// A file could be modified again within the resolution of its mtime without changing the metadata.
+const racyWindow = time.Second * 2
+
+func NewChecksumCache() *ChecksumCache {
+	return &ChecksumCache{entries: map[string]*checksumEntry{}, now: time.Now}
+}
+
+func (c *ChecksumCache) Checksum(name string) (string, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		c.forget(name)
+		return "", err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && entry.Size == stat.Size() && entry.ModTime.Equal(stat.ModTime()) {
+		return entry.Checksum, nil
+	}
+
+	checksum, err := HashFile(c.Hasher, name)
+	if err != nil {
+		c.forget(name)
+		return "", err
+	}
+
+	if c.now().Sub(stat.ModTime()) <= racyWindow {
+		c.forget(name)
+		return checksum, nil
+	}
+
+	c.mu.Lock()
+	c.entries[name] = &checksumEntry{Size: stat.Size(), ModTime: stat.ModTime(), Checksum: checksum}
+	c.mu.Unlock()
+	return checksum, nil
+}
+
+func (c *ChecksumCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// NormalizedChecksum returns the hex-encoded sha256 checksum of the normalized unit file, see UnitFile.Normalize.
+// Files that can't be parsed as unit files, like the scripts of other init systems, are hashed verbatim.
+func NormalizedChecksum(name string) (string, error) {
+	return normalizedChecksum(nil, name)
+}
+
+func normalizedChecksum(hasher Hasher, name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return HashFile(hasher, name)
+	}
+	return contentChecksum(orDefault(hasher), []byte(parsed.Normalize())), nil
+}
@@ -0,0 +1,82 @@
+package reconciler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumCache(t *testing.T) {
+	name := path.Join(t.TempDir(), "test.service")
+	require.NoError(t, ioutil.WriteFile(name, []byte("test1"), 0644))
+
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(name, old, old))
+
+	c := NewChecksumCache()
+	checksum, err := c.Checksum(name)
+	require.NoError(t, err)
+	expected, _ := FileChecksum(name)
+	assert.Equal(t, expected, checksum)
+	assert.Contains(t, c.entries, name)
+
+	// Cached checksums are returned while the metadata is unchanged
+	c.entries[name].Checksum = "cached"
+	checksum, err = c.Checksum(name)
+	require.NoError(t, err)
+	assert.Equal(t, "cached", checksum)
+
+	// Changed files are re-hashed, but not cached while their mtime is too recent
+	require.NoError(t, ioutil.WriteFile(name, []byte("test2"), 0644))
+	checksum, err = c.Checksum(name)
+	require.NoError(t, err)
+	expected, _ = FileChecksum(name)
+	assert.Equal(t, expected, checksum)
+	assert.NotContains(t, c.entries, name)
+
+	// Removed files are forgotten
+	require.NoError(t, os.Remove(name))
+	_, err = c.Checksum(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNormalizedChecksum(t *testing.T) {
+	dir := t.TempDir()
+	a, b := path.Join(dir, "a.service"), path.Join(dir, "b.service")
+	require.NoError(t, ioutil.WriteFile(a, []byte("[Service]\nExecStart=/bin/foo\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(b, []byte("# cosmetic\n[Service]\n\nExecStart = /bin/foo\n"), 0644))
+
+	checksumA, err := NormalizedChecksum(a)
+	require.NoError(t, err)
+	checksumB, err := NormalizedChecksum(b)
+	require.NoError(t, err)
+	assert.Equal(t, checksumA, checksumB)
+
+	// Other formats are hashed verbatim
+	require.NoError(t, ioutil.WriteFile(a, []byte("#!/sbin/openrc-run\ncommand=/bin/foo\n"), 0755))
+	checksumA, err = NormalizedChecksum(a)
+	require.NoError(t, err)
+	expected, _ := FileChecksum(a)
+	assert.Equal(t, expected, checksumA)
+}
+
+func TestFileChecksumLarge(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), mmapThreshold/16+1)
+	name := path.Join(t.TempDir(), "large")
+	require.NoError(t, ioutil.WriteFile(name, content, 0644))
+
+	checksum, err := FileChecksum(name)
+	require.NoError(t, err)
+	assert.Equal(t, contentChecksum(Hashers["sha256"], content), checksum)
+
+	require.NoError(t, ioutil.WriteFile(name, content[:100], 0644))
+	checksum, err = FileChecksum(name)
+	require.NoError(t, err)
+	assert.Equal(t, contentChecksum(Hashers["sha256"], content[:100]), checksum)
+}
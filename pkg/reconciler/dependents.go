@@ -0,0 +1,47 @@
+package reconciler
+
+import (
+	"context"
+	"log"
+)
+
+// DependentsReader is implemented by Systemd implementations that can list the units depending on a unit.
+type DependentsReader interface {
+	// Dependents returns the units that declare Requires=, BindsTo=, or PartOf= on the unit.
+	Dependents(ctx context.Context, unit string) ([]string, error)
+}
+
+// restartDependents restarts the active units depending on a unit that was restarted for a changed unit file,
+// so tightly coupled services like sidecars stay consistent with it. Inactive dependents aren't started.
+func (r *Reconciler) restartDependents(ctx context.Context, unit string) {
+	if !r.Dependents {
+		return
+	}
+	reader, ok := r.Systemd.(DependentsReader)
+	if !ok {
+		return
+	}
+	dependents, err := reader.Dependents(ctx, unit)
+	if err != nil {
+		log.Printf("error while listing the units depending on %q: %s", unit, err)
+		return
+	}
+
+	checker, _ := r.Systemd.(ActiveChecker)
+	for _, dependent := range dependents {
+		if dependent == unit {
+			continue
+		}
+		if checker != nil {
+			if active, err := checker.IsActive(ctx, dependent); err != nil || !active {
+				continue
+			}
+		}
+		if err := r.restart(ctx, dependent); err != nil {
+			log.Printf("error while restarting unit %q, which depends on %q: %s", dependent, unit, err)
+			continue
+		}
+		log.Printf("restarted unit %s since it depends on %s", dependent, unit)
+		r.recordChange(dependent, "restarted")
+	}
+}
@@ -0,0 +1,52 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dependentsSystemd struct {
+	*fakeSystemd
+	dependents map[string][]string
+}
+
+func (d *dependentsSystemd) Dependents(ctx context.Context, unit string) ([]string, error) {
+	return d.dependents[unit], nil
+}
+
+func TestRestartDependents(t *testing.T) {
+	src := t.TempDir()
+	sysd := &dependentsSystemd{
+		fakeSystemd: &fakeSystemd{Active: map[string]bool{"sidecar.service": true}},
+		dependents:  map[string][]string{"main.service": {"sidecar.service", "stopped.service"}},
+	}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Dependents: true}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Service]\nExecStart=/bin/main\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning main.service"}, sysd.Cmds) // new units have no running dependents to update
+
+	// Only active dependents are restarted
+	sysd.Cmds = nil
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Service]\nExecStart=/bin/main2\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Restart main.service", "Restart sidecar.service"}, sysd.Cmds)
+	assert.Equal(t, "restarted", r.Report(true).Actions["sidecar.service"].Action)
+
+	// Reloads don't affect dependents
+	sysd.Cmds = nil
+	r.Semantic = true
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Unit]\nDescription=main\n[Service]\nExecStart=/bin/main2\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Reload main.service"}, sysd.Cmds)
+
+	sysd.Cmds = nil
+	r.Dependents = false
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Unit]\nDescription=main\n[Service]\nExecStart=/bin/main3\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Restart main.service"}, sysd.Cmds)
+}
@@ -0,0 +1,190 @@
+package reconciler
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// FileChecksum returns the hex-encoded sha256 checksum of the file.
+func FileChecksum(name string) (string, error) {
+	return HashFile(nil, name)
+}
+
+// HashFile returns the hex-encoded checksum of the file computed by the hasher, or sha256 if it's nil.
+func HashFile(hasher Hasher, name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := orDefault(hasher).New()
+	if stat.Size() >= mmapThreshold {
+		ok, err := hashMapped(h, file, stat.Size())
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+	}
+
+	buf := hashBuffers.Get().(*[]byte)
+	defer hashBuffers.Put(buf)
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{file}, *buf); err != nil { // hide WriteTo so the buffer is used
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mmapThreshold is the size of files that are mapped into memory to be hashed rather than read through a buffer.
+const mmapThreshold = 4 << 20
+
+// hashBuffers are reused between checksums, since concurrent workers hash many files each resync.
+var hashBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 256<<10)
+	return &buf
+}}
+
+func copyFile(src, dest string) error {
+	srcf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcf.Close()
+
+	stat, err := srcf.Stat()
+	if err != nil {
+		return err
+	}
+
+	destf, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer destf.Close()
+
+	if err := destf.Chmod(stat.Mode().Perm()); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destf, srcf)
+	return err
+}
+
+// Destination is where the reconciler writes unit files.
+type Destination interface {
+	Checksum(unit string) (string, error) // returns an error satisfying os.IsNotExist if the unit doesn't exist
+	Read(unit string) ([]byte, error)     // returns an error satisfying os.IsNotExist if the unit doesn't exist
+	Copy(src, unit string) error          // preserves the permissions of src
+	Remove(unit string) error
+	Mode(unit string) (os.FileMode, error)
+	Chmod(unit string, mode os.FileMode) error
+}
+
+// LocalDir is a unit file directory on the local host.
+type LocalDir struct {
+	Dir    string
+	Cache  *ChecksumCache // optional, its Hasher is used instead of the directory's
+	Hasher Hasher         // optional, defaults to sha256
+}
+
+func (d *LocalDir) Checksum(unit string) (string, error) {
+	if d.Cache != nil {
+		return d.Cache.Checksum(path.Join(d.Dir, unit))
+	}
+	return HashFile(d.Hasher, path.Join(d.Dir, unit))
+}
+
+func (d *LocalDir) Read(unit string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(d.Dir, unit))
+}
+
+func (d *LocalDir) Copy(src, unit string) error {
+	return copyFile(src, path.Join(d.Dir, unit))
+}
+
+func (d *LocalDir) Remove(unit string) error {
+	return os.Remove(path.Join(d.Dir, unit))
+}
+
+func (d *LocalDir) Mode(unit string) (os.FileMode, error) {
+	stat, err := os.Stat(path.Join(d.Dir, unit))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Mode().Perm(), nil
+}
+
+func (d *LocalDir) Chmod(unit string, mode os.FileMode) error {
+	return os.Chmod(path.Join(d.Dir, unit), mode)
+}
+
+// RunitDir stores each unit as the run script of a service directory, <Dir>/<unit>/run,
+// and links the service directory into ServiceDir to have runsvdir supervise it.
+type RunitDir struct {
+	Dir        string
+	ServiceDir string
+	Hasher     Hasher // optional, defaults to sha256
+}
+
+func (d *RunitDir) Checksum(unit string) (string, error) {
+	return HashFile(d.Hasher, d.script(unit))
+}
+
+func (d *RunitDir) Read(unit string) ([]byte, error) {
+	return ioutil.ReadFile(d.script(unit))
+}
+
+func (d *RunitDir) Copy(src, unit string) error {
+	if err := os.MkdirAll(path.Join(d.Dir, unit), 0755); err != nil {
+		return err
+	}
+
+	// Replace the script atomically since runsv may be executing it
+	tmp := path.Join(d.Dir, unit, ".run.tmp")
+	if err := copyFile(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.script(unit)); err != nil {
+		return err
+	}
+
+	err := os.Symlink(path.Join(d.Dir, unit), path.Join(d.ServiceDir, unit))
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *RunitDir) Remove(unit string) error {
+	if err := os.Remove(path.Join(d.ServiceDir, unit)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(path.Join(d.Dir, unit))
+}
+
+func (d *RunitDir) Mode(unit string) (os.FileMode, error) {
+	stat, err := os.Stat(d.script(unit))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Mode().Perm(), nil
+}
+
+func (d *RunitDir) Chmod(unit string, mode os.FileMode) error {
+	return os.Chmod(d.script(unit), mode)
+}
+
+func (d *RunitDir) script(unit string) string {
+	return path.Join(d.Dir, unit, "run")
+}
@@ -0,0 +1,46 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunitDir(t *testing.T) {
+	d := &RunitDir{Dir: t.TempDir(), ServiceDir: t.TempDir()}
+
+	_, err := d.Checksum("web")
+	assert.True(t, os.IsNotExist(err))
+
+	src := path.Join(t.TempDir(), "web")
+	require.NoError(t, ioutil.WriteFile(src, []byte("#!/bin/sh\nexec web\n"), 0755))
+	require.NoError(t, d.Copy(src, "web"))
+	require.NoError(t, d.Copy(src, "web")) // already linked
+
+	expected, err := FileChecksum(src)
+	require.NoError(t, err)
+	checksum, err := d.Checksum("web")
+	require.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+
+	content, err := d.Read("web")
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\nexec web\n", string(content))
+
+	mode, err := d.Mode("web")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	link, err := os.Readlink(path.Join(d.ServiceDir, "web"))
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(d.Dir, "web"), link)
+
+	require.NoError(t, d.Remove("web"))
+	assert.NoDirExists(t, path.Join(d.Dir, "web"))
+	_, err = os.Lstat(path.Join(d.ServiceDir, "web"))
+	assert.True(t, os.IsNotExist(err))
+}
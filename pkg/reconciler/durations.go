@@ -0,0 +1,146 @@
+package reconciler
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	durationSamples    = 50 // restarts remembered per unit, the oldest are forgotten first
+	minTimeoutSamples  = 5  // restarts recorded before a unit's timeout is derived from them
+	minAdaptiveTimeout = 10 * time.Second
+)
+
+// DurationTracker records how long units take to stop and become active again when they're restarted,
+// to estimate the downtime of future restarts and derive per-unit timeouts from them.
+type DurationTracker struct {
+	Factor float64 // timeouts are this multiple of a unit's 99th percentile, zero to not derive timeouts
+
+	mu    sync.Mutex
+	units map[string][]time.Duration
+}
+
+// RestartDurations summarizes the recorded restarts of a unit.
+type RestartDurations struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+func NewDurationTracker(factor float64) *DurationTracker {
+	return &DurationTracker{Factor: factor, units: map[string][]time.Duration{}}
+}
+
+// Record adds a restart of the unit.
+func (d *DurationTracker) Record(unit string, duration time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	samples := append(d.units[unit], duration)
+	if len(samples) > durationSamples {
+		samples = samples[len(samples)-durationSamples:]
+	}
+	d.units[unit] = samples
+}
+
+// Percentile returns the duration that p percent of the unit's recorded restarts didn't exceed,
+// or false if none were recorded. A nil tracker has no recorded restarts.
+func (d *DurationTracker) Percentile(unit string, p float64) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.units[unit]) == 0 {
+		return 0, false
+	}
+	return percentile(sortedDurations(d.units[unit]), p), true
+}
+
+// Timeout returns how long starting or restarting the unit may take, or zero for the default timeout
+// if Factor isn't set or too few of its restarts were recorded. It's never below 10s.
+func (d *DurationTracker) Timeout(unit string) time.Duration {
+	if d == nil || d.Factor <= 0 {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.units[unit]) < minTimeoutSamples {
+		return 0
+	}
+	timeout := time.Duration(float64(percentile(sortedDurations(d.units[unit]), 99)) * d.Factor)
+	if timeout < minAdaptiveTimeout {
+		return minAdaptiveTimeout
+	}
+	return timeout
+}
+
+// Snapshot returns the percentiles of every unit with recorded restarts.
+func (d *DurationTracker) Snapshot() map[string]*RestartDurations {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := make(map[string]*RestartDurations, len(d.units))
+	for unit, samples := range d.units {
+		sorted := sortedDurations(samples)
+		snapshot[unit] = &RestartDurations{Count: len(samples), P50: percentile(sorted, 50), P90: percentile(sorted, 90), P99: percentile(sorted, 99)}
+	}
+	return snapshot
+}
+
+// Samples returns a copy of the recorded restarts of every unit, oldest first, e.g. to persist them.
+func (d *DurationTracker) Samples() map[string][]time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	samples := make(map[string][]time.Duration, len(d.units))
+	for unit, durations := range d.units {
+		samples[unit] = append([]time.Duration(nil), durations...)
+	}
+	return samples
+}
+
+func (d *DurationTracker) forget(unit string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.units, unit)
+}
+
+func sortedDurations(samples []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted, which must not be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// restart restarts the unit and records how long it took if Durations is set. systemd's own timestamps are
+// preferred when the Systemd implementation is a RestartTimer, since they exclude the daemon-reload.
+func (r *Reconciler) restart(ctx context.Context, unit string) error {
+	start := time.Now()
+	if err := r.Systemd.Restart(ctx, unit); err != nil {
+		return err
+	}
+	if r.Durations == nil {
+		return nil
+	}
+	duration := time.Since(start)
+	if timer, ok := r.Systemd.(RestartTimer); ok {
+		if measured, err := timer.LastRestart(ctx, unit); err == nil && measured > 0 {
+			duration = measured
+		}
+	}
+	r.Durations.Record(unit, duration)
+	return nil
+}
@@ -0,0 +1,74 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationTracker(t *testing.T) {
+	d := NewDurationTracker(3)
+	_, ok := d.Percentile("a.service", 50)
+	assert.False(t, ok)
+
+	for i := 1; i <= 4; i++ {
+		d.Record("a.service", time.Duration(i)*time.Second)
+	}
+	median, ok := d.Percentile("a.service", 50)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, median)
+	assert.Zero(t, d.Timeout("a.service")) // too few restarts
+
+	d.Record("a.service", 5*time.Second)
+	assert.Equal(t, 15*time.Second, d.Timeout("a.service"))
+	assert.Equal(t, map[string]*RestartDurations{"a.service": {Count: 5, P50: 3 * time.Second, P90: 5 * time.Second, P99: 5 * time.Second}}, d.Snapshot())
+
+	// Timeouts have a floor
+	for i := 0; i < 5; i++ {
+		d.Record("fast.service", 10*time.Millisecond)
+	}
+	assert.Equal(t, 10*time.Second, d.Timeout("fast.service"))
+
+	// Only the most recent restarts are kept
+	for i := 0; i < durationSamples; i++ {
+		d.Record("a.service", time.Second)
+	}
+	assert.Equal(t, &RestartDurations{Count: durationSamples, P50: time.Second, P90: time.Second, P99: time.Second}, d.Snapshot()["a.service"])
+
+	d.Factor = 0
+	assert.Zero(t, d.Timeout("a.service"))
+	assert.Zero(t, (*DurationTracker)(nil).Timeout("a.service"))
+}
+
+func TestRecordRestartDurations(t *testing.T) {
+	src := t.TempDir()
+	sysd := &impactSystemd{
+		dependentsSystemd: &dependentsSystemd{fakeSystemd: &fakeSystemd{}},
+		restarts:          map[string]time.Duration{"a.service": 3 * time.Second},
+	}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Durations: NewDurationTracker(0)}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Durations.Samples()) // starts aren't restarts
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/b\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, map[string][]time.Duration{"a.service": {3 * time.Second}}, r.Durations.Samples())
+	assert.Equal(t, 3*time.Second, r.Report(true).Durations["a.service"].P50)
+
+	// The recorded restarts estimate the downtime of the next one
+	sysd.restarts["a.service"] = time.Minute
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/c\n"), 0644))
+	assert.Equal(t, 3*time.Second, r.Impact(context.Background(), &Change{Unit: "a.service", Action: "update"}).Downtime)
+
+	// Removed units are forgotten
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Durations.Samples())
+}
@@ -0,0 +1,101 @@
+package reconciler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrorClass categorizes failures, so wrappers and alerts can react to what failed rather than parse messages.
+type ErrorClass string
+
+const (
+	SourceError     ErrorClass = "source"     // reading unit files in Src, or mirroring them into it
+	CopyError       ErrorClass = "copy"       // reading, writing, or removing unit files in Dest or Target
+	SystemdError    ErrorClass = "systemd"    // operations of the init system
+	ValidationError ErrorClass = "validation" // invalid unit files, e.g. holding back a batch, see Reconciler.Atomic
+)
+
+// ErrorClasses lists every class in the order their exit codes take precedence, see Classes.
+var ErrorClasses = []ErrorClass{SourceError, CopyError, SystemdError, ValidationError}
+
+// UnitError is a failure to reconcile a unit.
+type UnitError struct {
+	Unit  string
+	Class ErrorClass
+	Err   error
+}
+
+func (e *UnitError) Error() string { return e.Err.Error() }
+
+func (e *UnitError) Unwrap() error { return e.Err }
+
+// ClassOf returns the class of an error wrapping a UnitError, or false if it doesn't wrap one.
+func ClassOf(err error) (ErrorClass, bool) {
+	var unitErr *UnitError
+	if errors.As(err, &unitErr) {
+		return unitErr.Class, true
+	}
+	return "", false
+}
+
+// fail logs a unit-level error and records it until the unit is reconciled successfully.
+func (r *Reconciler) fail(unit string, class ErrorClass, format string, args ...interface{}) {
+	r.transition(unit, StateFailed, r.record(unit, class, format, args...))
+}
+
+// record logs and records a unit-level error like fail, without moving the unit to Failed.
+func (r *Reconciler) record(unit string, class ErrorClass, format string, args ...interface{}) string {
+	err := &UnitError{Unit: unit, Class: class, Err: fmt.Errorf(format, args...)}
+	msg := r.Redact.String(err.Error())
+	log.Print(msg)
+
+	r.mu.Lock()
+	if r.Failures == nil {
+		r.Failures = map[string]string{}
+	}
+	r.Failures[unit] = msg
+	if r.classes == nil {
+		r.classes = map[string]ErrorClass{}
+	}
+	r.classes[unit] = class
+	r.countError(class)
+	r.mu.Unlock()
+	return msg
+}
+
+// countError counts a failure of the class, the caller must hold mu.
+func (r *Reconciler) countError(class ErrorClass) {
+	if r.errors == nil {
+		r.errors = map[ErrorClass]int64{}
+	}
+	r.errors[class]++
+}
+
+// Errors returns how many failures of each class happened since the reconciler was created.
+func (r *Reconciler) Errors() map[ErrorClass]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	errors := make(map[ErrorClass]int64, len(r.errors))
+	for class, n := range r.errors {
+		errors[class] = n
+	}
+	return errors
+}
+
+// Classes returns the classes of the current failures, ordered like ErrorClasses.
+func (r *Reconciler) Classes() []ErrorClass {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[ErrorClass]bool{r.syncError: true}
+	for unit := range r.Failures {
+		seen[r.classes[unit]] = true
+	}
+	var classes []ErrorClass
+	for _, class := range ErrorClasses {
+		if seen[class] {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
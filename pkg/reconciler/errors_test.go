@@ -0,0 +1,59 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorClasses(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{Errs: map[string]error{}}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Classes())
+	assert.Empty(t, r.Errors())
+
+	// Failing systemd operations
+	sysd.Errs["a.service"] = errors.New("oops")
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Equal(t, []ErrorClass{SystemdError}, r.Classes())
+	report := r.Report(false)
+	assert.Equal(t, map[string]ErrorClass{"a.service": SystemdError}, report.Classes)
+	assert.Equal(t, map[ErrorClass]int64{SystemdError: 1}, report.Errors)
+
+	// Failing to read src takes precedence
+	require.NoError(t, os.Rename(src, src+".moved"))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Equal(t, []ErrorClass{SourceError}, r.Classes())
+	assert.Equal(t, int64(1), r.Errors()[SourceError])
+
+	// Classes are cleared once the units are reconciled, counters aren't
+	require.NoError(t, os.Rename(src+".moved", src))
+	delete(sysd.Errs, "a.service")
+	assert.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Classes())
+	assert.Empty(t, r.Report(true).Classes)
+	assert.Equal(t, map[ErrorClass]int64{SourceError: 1, SystemdError: 1}, r.Errors())
+}
+
+func TestClassOf(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &UnitError{Unit: "a.service", Class: CopyError, Err: errors.New("oops")})
+	class, ok := ClassOf(err)
+	assert.True(t, ok)
+	assert.Equal(t, CopyError, class)
+	assert.Equal(t, "wrapped: oops", err.Error())
+
+	_, ok = ClassOf(errors.New("oops"))
+	assert.False(t, ok)
+}
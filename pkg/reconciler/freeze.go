@@ -0,0 +1,66 @@
+package reconciler
+
+import (
+	"log"
+	"time"
+)
+
+// Freezer reports change freezes, during which restarts of changed units are deferred, see Reconciler.Freeze.
+type Freezer interface {
+	// Frozen returns why changes are frozen at the given time, or an empty string if they aren't.
+	Frozen(now time.Time) string
+}
+
+// Frozen returns why changes are currently frozen, or an empty string if they aren't or Freeze isn't set.
+func (r *Reconciler) Frozen() string {
+	if r.Freeze == nil {
+		return ""
+	}
+	return r.Freeze.Frozen(time.Now())
+}
+
+// deferFrozen returns true if the changed unit should wait for the active change freeze to end. It's checked before
+// the unit file is copied if FreezeCopies is set, and before the unit is restarted otherwise, in which case the copied
+// file is restarted by the first sync after the freeze. Queued restarts run early or cancelled aren't deferred.
+func (r *Reconciler) deferFrozen(unit string, copying bool) bool {
+	if r.Freeze == nil || copying != r.FreezeCopies {
+		return false
+	}
+	reason := r.Frozen()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reason == "" || r.forced[unit] || r.cancelled[unit] {
+		r.dequeue("restart", unit)
+		return false
+	}
+	reason = "change freeze: " + reason
+	if r.deferred[unit] != reason {
+		log.Printf("warning: deferring restart of unit %s until the %s ends", unit, reason)
+	}
+	if r.deferred == nil {
+		r.deferred = map[string]string{}
+	}
+	r.deferred[unit] = reason
+	r.enqueue("restart", unit)
+	return true
+}
+
+// copiedFrozen returns true if the unit's changed file was copied during a change freeze, but the unit wasn't restarted.
+func (r *Reconciler) copiedFrozen(unit string) bool {
+	if r.Freeze == nil || r.FreezeCopies {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.deferred[unit]
+	return ok
+}
+
+// deferredRetry is how often deferred restarts are retried.
+func (r *Reconciler) deferredRetry() time.Duration {
+	if r.Guard != nil {
+		return r.Guard.retry()
+	}
+	return DefaultGuardRetry
+}
@@ -0,0 +1,76 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeFreezer struct {
+	Reason string
+}
+
+func (f *fakeFreezer) Frozen(now time.Time) string { return f.Reason }
+
+func TestFreezeDefersRestarts(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	freezer := &fakeFreezer{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Freeze: freezer}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Report(true).Freeze)
+
+	// Changed files are copied, but not restarted until the freeze ends
+	freezer.Reason = "holidays"
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/b\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Contains(t, sysd.Cmds, "EnsureRunning b.service") // new units are started regardless
+	assert.NotContains(t, sysd.Cmds, "Restart a.service")
+	assert.Equal(t, map[string]string{"a.service": "change freeze: holidays"}, r.Deferred())
+	assert.Equal(t, "holidays", r.Report(true).Freeze)
+	applied, err := ioutil.ReadFile(path.Join(r.Dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a2\n", string(applied))
+
+	assert.True(t, r.Retry(context.Background()))
+	assert.NotContains(t, sysd.Cmds, "Restart a.service")
+
+	freezer.Reason = ""
+	assert.True(t, r.Retry(context.Background()))
+	assert.Contains(t, sysd.Cmds, "Restart a.service")
+	assert.Empty(t, r.Deferred())
+}
+
+func TestFreezeDefersCopies(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	freezer := &fakeFreezer{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Freeze: freezer, FreezeCopies: true}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	freezer.Reason = "release"
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, map[string]string{"a.service": "change freeze: release"}, r.Deferred())
+	applied, err := ioutil.ReadFile(path.Join(r.Dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a\n", string(applied))
+
+	// Queued restarts can still be run early
+	_, err = r.RunQueued("restart:a.service")
+	require.NoError(t, err)
+	assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "a.service")}))
+	assert.Contains(t, sysd.Cmds, "Restart a.service")
+	assert.Empty(t, r.Deferred())
+	applied, err = ioutil.ReadFile(path.Join(r.Dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a2\n", string(applied))
+}
@@ -0,0 +1,45 @@
+package reconciler
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// Generation returns the number of the most recently applied change set. Every sync pass that modifies
+// units is assigned the next generation, so failures can be traced back to the changes that introduced them.
+func (r *Reconciler) Generation() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// SetGeneration restores the generation, e.g. from the persisted state.
+func (r *Reconciler) SetGeneration(generation int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation = generation
+}
+
+// commitGeneration assigns the next generation to the changes made since the pass started with the
+// given number of changes, if there were any. Call it with defer at the start of every pass.
+func (r *Reconciler) commitGeneration(before int) {
+	n := r.Changes() - before
+	if n == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.generation++
+	generation := r.generation
+	var units []string
+	for unit, action := range r.touched {
+		if action.Generation == generation {
+			units = append(units, unit)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Strings(units)
+	log.Printf("applied generation %d of %s: %d changes to %s", generation, r.Src, n, strings.Join(units, ", "))
+}
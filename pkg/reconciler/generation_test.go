@@ -0,0 +1,44 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneration(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &fakeSystemd{}}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("b"), 0644))
+
+	// Every change of a pass belongs to the same generation
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, int64(1), r.Generation())
+	report := r.Report(true)
+	assert.Equal(t, int64(1), report.Generation)
+	assert.Equal(t, int64(1), report.Actions["a.service"].Generation)
+	assert.Equal(t, int64(1), report.Actions["b.service"].Generation)
+
+	// Passes without changes don't start a generation
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, int64(1), r.Generation())
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("b2"), 0644))
+	assert.True(t, r.SyncUnits(context.Background(), []string{"b.service"}))
+	assert.Equal(t, int64(2), r.Generation())
+	report = r.Report(true)
+	assert.Equal(t, int64(1), report.Actions["a.service"].Generation)
+	assert.Equal(t, int64(2), report.Actions["b.service"].Generation)
+
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, int64(3), r.Generation())
+	assert.Equal(t, int64(3), r.Report(true).Actions["a.service"].Generation)
+}
@@ -0,0 +1,157 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Linker is implemented by Destinations that can maintain symlinks within their directory, see Reconciler.Group.
+type Linker interface {
+	Link(name, target string) error // creates or replaces the symlink at the relative path, creating its directory
+	Unlink(name string) error       // succeeds if the symlink doesn't exist
+}
+
+// LinkReader is implemented by Linkers that can read the symlinks within their directory, see linkAliases.
+type LinkReader interface {
+	// Readlink returns the target of the symlink at the relative path, relative to the directory if it's within it.
+	// Like os.Readlink, it fails with os.ErrNotExist if nothing exists at the path and another error if it's not a symlink.
+	Readlink(name string) (string, error)
+}
+
+// groupTarget is the unit file written for a Group target that isn't in Src. It's reached once every
+// unit in its .wants directory has started, since targets are ordered after the units they want.
+const groupTarget = `[Unit]
+Description=Units managed by unitmgr
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func (l *LocalDir) Link(name, target string) error {
+	name = path.Join(l.Dir, name)
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	if current, err := os.Readlink(name); err == nil && current == target {
+		return nil
+	}
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (l *LocalDir) Readlink(name string) (string, error) {
+	target, err := os.Readlink(path.Join(l.Dir, name))
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		return path.Join(path.Dir(name), target), nil
+	}
+	dir, err := filepath.Abs(l.Dir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, target); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return rel, nil
+	}
+	return path.Clean(target), nil
+}
+
+func (l *LocalDir) Unlink(name string) error {
+	if err := os.Remove(path.Join(l.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// grouped returns true for the applied units that are linked into the Group target: every unit except the target itself
+// and templates, which can't be started without an instance.
+func (r *Reconciler) grouped(unit string) bool {
+	return r.Group != "" && unit != r.Group && !strings.Contains(unit, "@.")
+}
+
+// joinGroup links an applied unit into the Group target's .wants directory, so starting the target starts it.
+func (r *Reconciler) joinGroup(unit string) {
+	if !r.grouped(unit) {
+		return
+	}
+	linker, ok := r.target().(Linker)
+	if !ok {
+		return
+	}
+
+	r.groupMu.Lock()
+	defer r.groupMu.Unlock()
+	if r.linked[unit] {
+		return
+	}
+	if !r.groupReady {
+		if err := r.installGroup(linker); err != nil {
+			log.Printf("error while installing %s: %s", r.Group, err)
+			return
+		}
+		r.groupReady = true
+	}
+	if err := linker.Link(path.Join(r.Group+".wants", unit), path.Join("..", unit)); err != nil {
+		log.Printf("error while linking unit %q into %s: %s", unit, r.Group, err)
+		return
+	}
+	if r.linked == nil {
+		r.linked = map[string]bool{}
+	}
+	r.linked[unit] = true
+}
+
+// leaveGroup removes a unit's link from the Group target's .wants directory.
+func (r *Reconciler) leaveGroup(unit string) {
+	linker, ok := r.target().(Linker)
+	if r.Group == "" || !ok {
+		return
+	}
+
+	r.groupMu.Lock()
+	defer r.groupMu.Unlock()
+	if err := linker.Unlink(path.Join(r.Group+".wants", unit)); err != nil {
+		log.Printf("error while unlinking unit %q from %s: %s", unit, r.Group, err)
+		return
+	}
+	delete(r.linked, unit)
+}
+
+// installGroup writes the Group target unless it's in Src, and enables it so it's started on boot.
+func (r *Reconciler) installGroup(linker Linker) error {
+	if _, err := os.Stat(path.Join(r.Src, r.Group)); err == nil {
+		return nil // managed like any other unit
+	}
+
+	if current, err := r.target().Read(r.Group); err != nil || string(current) != groupTarget {
+		tmp, err := ioutil.TempFile("", "unitmgr-group")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = tmp.WriteString(groupTarget)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0644)
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.target().Copy(tmp.Name(), r.Group); err != nil {
+			return err
+		}
+		log.Printf("wrote group target: %s", r.Group)
+	}
+	return linker.Link(path.Join("multi-user.target.wants", r.Group), path.Join("..", r.Group))
+}
@@ -0,0 +1,63 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &fakeSystemd{}, Group: "unitmgr.target", Activation: true}
+	for name, content := range map[string]string{
+		"a.service":       "a",
+		"b.service":       "b",
+		"b.socket":        "b",
+		"worker@.service": "worker",
+	} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, name), []byte(content), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+
+	links, err := ioutil.ReadDir(path.Join(dest, "unitmgr.target.wants"))
+	require.NoError(t, err)
+	var names []string
+	for _, link := range links {
+		names = append(names, link.Name())
+	}
+	assert.Equal(t, []string{"a.service", "b.service", "b.socket"}, names) // templates aren't linked
+	target, err := os.Readlink(path.Join(dest, "unitmgr.target.wants", "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "../a.service", target)
+
+	// The target is generated and enabled
+	content, err := ioutil.ReadFile(path.Join(dest, "unitmgr.target"))
+	require.NoError(t, err)
+	assert.Equal(t, groupTarget, string(content))
+	target, err = os.Readlink(path.Join(dest, "multi-user.target.wants", "unitmgr.target"))
+	require.NoError(t, err)
+	assert.Equal(t, "../unitmgr.target", target)
+	assert.False(t, r.Manages("unitmgr.target"))
+
+	// Removed units leave the group
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	require.True(t, r.Sync(context.Background()))
+	_, err = os.Lstat(path.Join(dest, "unitmgr.target.wants", "a.service"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Links removed by others are restored by new instances
+	require.NoError(t, os.Remove(path.Join(dest, "unitmgr.target.wants", "b.socket")))
+	require.NoError(t, os.Remove(path.Join(dest, "unitmgr.target.wants", "b.service")))
+	r = &Reconciler{Src: src, Dest: dest, State: r.State, Systemd: &fakeSystemd{}, Group: "unitmgr.target", Activation: true}
+	require.True(t, r.Sync(context.Background()))
+	_, err = os.Lstat(path.Join(dest, "unitmgr.target.wants", "b.socket"))
+	assert.NoError(t, err)
+	_, err = os.Lstat(path.Join(dest, "unitmgr.target.wants", "b.service"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,172 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResourceGuard defers restarts of changed units while the host is under pressure, preferring stability over immediacy.
+// Units can override each threshold with RestartMaxLoad=, RestartMinMemory=, and RestartMinDisk= in their UnitSection,
+// or opt out of the guard with RestartGuard=no.
+type ResourceGuard struct {
+	MaxLoad   float64       // optional, 1 minute load average per CPU above which restarts are deferred
+	MinMemory int64         // optional, bytes of available memory below which restarts are deferred
+	MinDisk   int64         // optional, bytes of free space on DiskPath below which restarts are deferred
+	DiskPath  string        // defaults to /
+	Retry     time.Duration // how often deferred restarts are retried, defaults to DefaultGuardRetry
+}
+
+// DefaultGuardRetry is how often deferred restarts are retried when ResourceGuard.Retry isn't set.
+const DefaultGuardRetry = time.Minute
+
+func (g *ResourceGuard) retry() time.Duration {
+	if g.Retry > 0 {
+		return g.Retry
+	}
+	return DefaultGuardRetry
+}
+
+// HostUsage is a measurement of the host's headroom.
+type HostUsage struct {
+	Load   float64 // 1 minute load average per CPU
+	Memory int64   // bytes of available memory
+	Disk   int64   // bytes of free disk space
+}
+
+// measureHost is replaced by tests.
+var measureHost = readHostUsage
+
+// Pressure returns the thresholds the host currently exceeds for the given unit file, which may be nil.
+func (g *ResourceGuard) Pressure(file *UnitFile) ([]string, error) {
+	limits := *g
+	if file != nil {
+		if value, ok := file.Value(UnitSection, "RestartGuard"); ok {
+			switch strings.ToLower(value) {
+			case "no", "false", "off", "0":
+				return nil, nil
+			}
+		}
+		if err := limits.override(file); err != nil {
+			return nil, err
+		}
+	}
+	if limits.MaxLoad <= 0 && limits.MinMemory <= 0 && limits.MinDisk <= 0 {
+		return nil, nil
+	}
+
+	disk := limits.DiskPath
+	if disk == "" {
+		disk = "/"
+	}
+	usage, err := measureHost(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	var exceeded []string
+	if limits.MaxLoad > 0 && usage.Load > limits.MaxLoad {
+		exceeded = append(exceeded, fmt.Sprintf("load %.2f per cpu exceeds %.2f", usage.Load, limits.MaxLoad))
+	}
+	if limits.MinMemory > 0 && usage.Memory < limits.MinMemory {
+		exceeded = append(exceeded, fmt.Sprintf("%d bytes of available memory is below %d", usage.Memory, limits.MinMemory))
+	}
+	if limits.MinDisk > 0 && usage.Disk < limits.MinDisk {
+		exceeded = append(exceeded, fmt.Sprintf("%d bytes of free space on %s is below %d", usage.Disk, disk, limits.MinDisk))
+	}
+	return exceeded, nil
+}
+
+// override applies the thresholds set by the unit file.
+func (g *ResourceGuard) override(file *UnitFile) error {
+	if value, ok := file.Value(UnitSection, "RestartMaxLoad"); ok {
+		load, err := strconv.ParseFloat(value, 64)
+		if err != nil || load < 0 {
+			return fmt.Errorf("invalid RestartMaxLoad=%s", value)
+		}
+		g.MaxLoad = load
+	}
+	for key, dst := range map[string]*int64{"RestartMinMemory": &g.MinMemory, "RestartMinDisk": &g.MinDisk} {
+		if value, ok := file.Value(UnitSection, key); ok {
+			size, err := ParseByteSize(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s=%s: %s", key, value, err)
+			}
+			*dst = size
+		}
+	}
+	return nil
+}
+
+// ParseByteSize parses a number of bytes with an optional K, M, or G suffix for powers of 1024.
+func ParseByteSize(s string) (int64, error) {
+	digits, shift := s, uint(0)
+	for suffix, n := range map[string]uint{"K": 10, "M": 20, "G": 30} {
+		if strings.HasSuffix(s, suffix) {
+			digits, shift = strings.TrimSuffix(s, suffix), n
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 100M", s)
+	}
+	return n << shift, nil
+}
+
+// deferRestart returns true if the restart the changed unit file in Src would cause should wait for the host to have
+// more headroom. The file isn't applied meanwhile, so the next sync tries again.
+func (r *Reconciler) deferRestart(unit, name string) bool {
+	if r.Guard == nil {
+		return false
+	}
+	r.mu.Lock()
+	overridden := r.forced[unit] || r.cancelled[unit]
+	r.mu.Unlock()
+	if overridden {
+		r.mu.Lock()
+		r.dequeue("restart", unit)
+		r.mu.Unlock()
+		return false // the queued restart was run early or cancelled
+	}
+
+	var parsed *UnitFile
+	if file, err := os.Open(name); err == nil {
+		parsed, _ = ParseUnitFile(file)
+		file.Close()
+	}
+	exceeded, err := r.Guard.Pressure(parsed)
+	if err != nil {
+		log.Printf("error while checking headroom before restarting unit %q, restarting anyway: %s", unit, err)
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(exceeded) == 0 {
+		r.dequeue("restart", unit)
+		return false
+	}
+	reason := strings.Join(exceeded, ", ")
+	log.Printf("warning: deferring restart of unit %s since the host is under pressure: %s", unit, reason)
+	if r.deferred == nil {
+		r.deferred = map[string]string{}
+	}
+	r.deferred[unit] = reason
+	r.enqueue("restart", unit)
+	return true
+}
+
+// Deferred returns the units whose restarts are waiting for the host to have more headroom or the end of a change freeze,
+// mapped to why.
+func (r *Reconciler) Deferred() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deferred := make(map[string]string, len(r.deferred))
+	for unit, reason := range r.deferred {
+		deferred[unit] = reason
+	}
+	return deferred
+}
@@ -0,0 +1,59 @@
+package reconciler
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readHostUsage measures the host's headroom from /proc and the file system holding disk.
+func readHostUsage(disk string) (*HostUsage, error) {
+	usage := &HostUsage{}
+
+	loadavg, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(loadavg))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("unexpected /proc/loadavg %q", loadavg)
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected /proc/loadavg %q", loadavg)
+	}
+	usage.Load = load / float64(runtime.NumCPU())
+
+	meminfo, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer meminfo.Close()
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected /proc/meminfo line %q", scanner.Text())
+		}
+		usage.Memory = kb << 10
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(disk, &stat); err != nil {
+		return nil, err
+	}
+	usage.Disk = int64(stat.Bavail) * int64(stat.Bsize)
+	return usage, nil
+}
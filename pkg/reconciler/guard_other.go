@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package reconciler
+
+import "errors"
+
+func readHostUsage(disk string) (*HostUsage, error) {
+	return nil, errors.New("measuring the host's headroom is only supported on linux")
+}
@@ -0,0 +1,80 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceGuard(t *testing.T) {
+	usage := &HostUsage{Load: 0.5, Memory: 1 << 30, Disk: 10 << 30}
+	defer func(fn func(string) (*HostUsage, error)) { measureHost = fn }(measureHost)
+	measureHost = func(string) (*HostUsage, error) { return usage, nil }
+
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Guard: &ResourceGuard{MaxLoad: 2, MinMemory: 512 << 20}}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	// New units are started regardless of pressure, changed ones wait for headroom
+	usage.Load = 3
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/b\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, "EnsureRunning b.service", sysd.LastCmd)
+	assert.Contains(t, r.Deferred()["a.service"], "load 3.00 per cpu exceeds 2.00")
+	assert.Contains(t, r.Report(true).Deferred, "a.service")
+	applied, err := ioutil.ReadFile(path.Join(r.Dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a\n", string(applied))
+
+	// Deferred restarts are retried soon rather than at the next full sync
+	next, ok := r.NextRetry()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(DefaultGuardRetry), next, time.Second)
+
+	// The restart is made once the host recovers
+	usage.Load = 1
+	assert.True(t, r.Retry(context.Background()))
+	assert.Contains(t, sysd.Cmds, "Restart a.service")
+	assert.Empty(t, r.Deferred())
+
+	// Units can opt out or set their own thresholds
+	usage.Memory = 256 << 20
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a3\n[X-Unitmgr]\nRestartGuard=no\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/b2\n[X-Unitmgr]\nRestartMinMemory=128M\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Deferred())
+	assert.Equal(t, 2, strings.Count(strings.Join(sysd.Cmds, "\n"), "Restart a.service"))
+	assert.Contains(t, sysd.Cmds, "Restart b.service")
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, expected := range map[string]int64{"512": 512, "2K": 2048, "100M": 100 << 20, "1G": 1 << 30} {
+		actual, err := ParseByteSize(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, expected, actual, in)
+	}
+	for _, in := range []string{"", "M", "-1", "1T"} {
+		_, err := ParseByteSize(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestReadHostUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only supported on linux")
+	}
+	usage, err := readHostUsage(t.TempDir())
+	require.NoError(t, err)
+	assert.Greater(t, usage.Memory, int64(0))
+	assert.Greater(t, usage.Disk, int64(0))
+}
@@ -0,0 +1,162 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"math/bits"
+	"sort"
+)
+
+// Hasher computes the checksums identifying the content of unit files.
+type Hasher interface {
+	Name() string // recorded in the persisted state
+	New() hash.Hash
+}
+
+type hasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h *hasher) Name() string   { return h.name }
+func (h *hasher) New() hash.Hash { return h.new() }
+
+// Hashers are the supported checksum algorithms by name.
+// xxh64 is much faster than sha256 for large trees, but it isn't cryptographic.
+var Hashers = map[string]Hasher{
+	"sha256": &hasher{name: "sha256", new: sha256.New},
+	"xxh64":  &hasher{name: "xxh64", new: func() hash.Hash { return newXXH64() }},
+}
+
+// orDefault returns the hasher, or sha256 if it's nil. The Hasher fields of Reconciler, StateStore, ChecksumCache,
+// and the destinations are optional, but must agree, since checksums of different algorithms can't be compared.
+func orDefault(h Hasher) Hasher {
+	if h == nil {
+		return Hashers["sha256"]
+	}
+	return h
+}
+
+// HasherNames returns the names of the supported checksum algorithms.
+func HasherNames() []string {
+	names := make([]string, 0, len(Hashers))
+	for name := range Hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contentChecksum(h Hasher, content []byte) string {
+	w := h.New()
+	w.Write(content)
+	return hex.EncodeToString(w.Sum(nil))
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 is the 64 bit variant of xxHash with a seed of zero.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int // bytes buffered in mem
+}
+
+func newXXH64() *xxh64 {
+	x := &xxh64{}
+	x.Reset()
+	return x
+}
+
+func (x *xxh64) Reset() {
+	p1, p2 := xxhPrime1, xxhPrime2 // wrap around like the reference implementation rather than overflow as constants
+	x.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	x.total, x.n = 0, 0
+}
+
+func (x *xxh64) Size() int      { return 8 }
+func (x *xxh64) BlockSize() int { return 32 }
+
+func (x *xxh64) Write(b []byte) (int, error) {
+	n := len(b)
+	x.total += uint64(n)
+
+	if x.n > 0 {
+		copied := copy(x.mem[x.n:], b)
+		x.n += copied
+		b = b[copied:]
+		if x.n < 32 {
+			return n, nil
+		}
+		x.stripe(x.mem[:])
+		x.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		x.stripe(b)
+	}
+	x.n = copy(x.mem[:], b)
+	return n, nil
+}
+
+func (x *xxh64) stripe(b []byte) {
+	for i := range x.v {
+		x.v[i] = xxhRound(x.v[i], binary.LittleEndian.Uint64(b[i*8:]))
+	}
+}
+
+func (x *xxh64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) + bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h ^= xxhRound(0, v)
+			h = h*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		h = xxhPrime5
+	}
+	h += x.total
+
+	b := x.mem[:x.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (x *xxh64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], x.Sum64())
+	return append(b, sum[:]...)
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxhPrime1
+}
@@ -0,0 +1,67 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXXH64(t *testing.T) {
+	for in, expected := range map[string]string{
+		"":    "ef46db3751d8e999",
+		"a":   "d24ec4f1a98c6e5b",
+		"abc": "44bc2cf5ad770999",
+		"Nobody inspects the spammish repetition": "fbcea83c8a378bf1",
+	} {
+		assert.Equal(t, expected, contentChecksum(Hashers["xxh64"], []byte(in)), in)
+	}
+}
+
+func TestXXH64Streaming(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789abcdef", 20) + "tail")
+	expected := contentChecksum(Hashers["xxh64"], content)
+
+	for _, size := range []int{1, 3, 7, 31, 32, 33, 100} {
+		h := newXXH64()
+		for b := content; len(b) > 0; {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			h.Write(b[:n])
+			b = b[n:]
+		}
+		assert.Equal(t, expected, hex.EncodeToString(h.Sum(nil)), size)
+	}
+}
+
+func TestReconcilerHashers(t *testing.T) {
+	// Reconcilers in the same process can use different algorithms
+	var reconcilers []*Reconciler
+	for _, hasher := range []Hasher{nil, Hashers["xxh64"]} {
+		src := t.TempDir()
+		require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+		cache := NewChecksumCache()
+		cache.Hasher = hasher
+		reconcilers = append(reconcilers, &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}, Cache: cache, Hasher: hasher})
+	}
+	for _, r := range reconcilers {
+		require.True(t, r.Sync(context.Background()))
+	}
+
+	content := []byte("[Service]\nExecStart=/bin/a\n")
+	assert.Equal(t, contentChecksum(Hashers["sha256"], content), reconcilers[0].State["a.service"])
+	assert.Equal(t, contentChecksum(Hashers["xxh64"], content), reconcilers[1].State["a.service"])
+	for _, r := range reconcilers {
+		sysd := r.Systemd.(*fakeSystemd)
+		sysd.Cmds = nil
+		require.True(t, r.Sync(context.Background()))
+		assert.Equal(t, []string{"EnsureRunning a.service"}, sysd.Cmds, "unchanged units aren't restarted")
+	}
+}
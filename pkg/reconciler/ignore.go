@@ -0,0 +1,171 @@
+package reconciler
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the file in Src listing the files that aren't managed, in gitignore syntax.
+const IgnoreFile = ".unitmgrignore"
+
+// UnitSection is the unit file section holding directives for unitmgr, which systemd ignores since it starts with X-.
+const UnitSection = "X-Unitmgr"
+
+// IgnoreRules are the patterns of a gitignore-style file.
+type IgnoreRules struct {
+	rules []*ignoreRule
+}
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// LoadIgnoreRules reads the ignore file of a source directory, returning empty rules if it doesn't exist.
+func LoadIgnoreRules(dir string) (*IgnoreRules, error) {
+	file, err := os.Open(path.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return &IgnoreRules{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseIgnoreRules(file)
+}
+
+// ParseIgnoreRules parses gitignore syntax, see gitignore(5).
+func ParseIgnoreRules(r io.Reader) (*IgnoreRules, error) {
+	rules := &IgnoreRules{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := &ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // escaped leading ! or #
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		// Patterns without a slash match at any depth, others are relative to the directory
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := globRegexp(line)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+		pattern, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, err
+		}
+		rule.pattern = pattern
+		rules.rules = append(rules.rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// globRegexp translates a gitignore glob to a regular expression.
+func globRegexp(glob string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Ignored returns true if the slash-separated path relative to the directory, or any of its parents, is ignored.
+func (g *IgnoreRules) Ignored(name string, isDir bool) bool {
+	parts := strings.Split(path.Clean(name), "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if g.match(strings.Join(parts[:i+1], "/"), isDir || !last) {
+			return true // files within ignored directories can't be re-included
+		}
+	}
+	return false
+}
+
+func (g *IgnoreRules) match(name string, isDir bool) bool {
+	ignored := false
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(name) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// skipped returns true for unit files opting out of management with Ignore=yes in their UnitSection.
+func skipped(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return false // not a unit file
+	}
+	value, _ := parsed.Value(UnitSection, "Ignore")
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// ignoredUnit returns true if the unit file in Src exists but isn't managed.
+func (r *Reconciler) ignoredUnit(ignore *IgnoreRules, unit string) bool {
+	return ignore.Ignored(unit, false) || skipped(path.Join(r.Src, unit))
+}
@@ -0,0 +1,64 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := ParseIgnoreRules(strings.NewReader(`
+# docs and scratch files
+*.md
+!KEEP.md
+scratch?.service
+/local.service
+docs/
+build/**/*.tmp
+[ab].timer
+\#literal
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name    string
+		IsDir   bool
+		Ignored bool
+	}{
+		{"README.md", false, true},
+		{"nested/README.md", false, true},
+		{"KEEP.md", false, false},
+		{"scratch1.service", false, true},
+		{"scratch10.service", false, false},
+		{"local.service", false, true},
+		{"nested/local.service", false, false},
+		{"docs", true, true},
+		{"docs", false, false},
+		{"docs/web.service", false, true},
+		{"build/a/b/c.tmp", false, true},
+		{"build/c.tmp", false, true},
+		{"a.timer", false, true},
+		{"c.timer", false, false},
+		{"#literal", false, true},
+		{"web.service", false, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.Ignored, rules.Ignored(tc.Name, tc.IsDir), tc.Name)
+	}
+}
+
+func TestLoadIgnoreRules(t *testing.T) {
+	dir := t.TempDir()
+	rules, err := LoadIgnoreRules(dir)
+	require.NoError(t, err)
+	assert.False(t, rules.Ignored("web.service", false))
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, IgnoreFile), []byte("web.*\n"), 0644))
+	rules, err = LoadIgnoreRules(dir)
+	require.NoError(t, err)
+	assert.True(t, rules.Ignored("web.service", false))
+}
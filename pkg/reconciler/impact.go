@@ -0,0 +1,100 @@
+package reconciler
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+// RestartTimer is implemented by Systemd implementations that know how long restarting a unit took before.
+type RestartTimer interface {
+	// LastRestart returns how long the unit was down the last time it was restarted or started, or zero if unknown.
+	LastRestart(ctx context.Context, unit string) (time.Duration, error)
+}
+
+// Impact is the effect a planned change would have on the running units.
+type Impact struct {
+	Action     string        `json:"action"`               // restart, reload, reenable, start, stop, or none
+	Dependents []string      `json:"dependents,omitempty"` // active units restarted or stopped along with it, see DependentsReader
+	Sockets    []string      `json:"sockets,omitempty"`    // sockets that stop listening while the change is applied
+	Downtime   time.Duration `json:"downtime,omitempty"`   // the median of the unit's recorded restarts, or its previous restart, zero if unknown
+}
+
+// Impact estimates how the next sync would apply the planned change to the unit and the units depending on it.
+// Questions the Systemd implementation can't answer are left out rather than failing the plan.
+func (r *Reconciler) Impact(ctx context.Context, change *Change) *Impact {
+	impact := &Impact{Action: r.impactAction(ctx, change)}
+	if impact.Action != "restart" && impact.Action != "stop" {
+		return impact
+	}
+
+	if reader, ok := r.Systemd.(DependentsReader); ok {
+		dependents, _ := reader.Dependents(ctx, change.Unit)
+		checker, _ := r.Systemd.(ActiveChecker)
+		for _, dependent := range dependents {
+			if dependent == change.Unit {
+				continue
+			}
+			if checker != nil {
+				if active, err := checker.IsActive(ctx, dependent); err != nil || !active {
+					continue
+				}
+			}
+			impact.Dependents = append(impact.Dependents, dependent)
+		}
+	}
+	if impact.Action == "restart" {
+		for _, unit := range append([]string{change.Unit}, impact.Dependents...) {
+			if path.Ext(unit) == ".socket" {
+				impact.Sockets = append(impact.Sockets, unit)
+			}
+		}
+		if median, ok := r.Durations.Percentile(change.Unit, 50); ok {
+			impact.Downtime = median
+		} else if timer, ok := r.Systemd.(RestartTimer); ok {
+			impact.Downtime, _ = timer.LastRestart(ctx, change.Unit)
+		}
+	}
+	return impact
+}
+
+// impactAction mirrors the decisions of syncUnit and restartUnit for a planned change.
+func (r *Reconciler) impactAction(ctx context.Context, change *Change) string {
+	switch change.Action {
+	case "create":
+		if _, ok := r.activator(change.Unit); ok {
+			return "none" // left for the activator to start
+		}
+		return "start"
+	case "remove":
+		return "stop"
+	case "chmod":
+		return "none"
+	}
+
+	if _, ok := r.activator(change.Unit); ok {
+		if checker, ok := r.Systemd.(ActiveChecker); ok {
+			if active, err := checker.IsActive(ctx, change.Unit); err == nil && !active {
+				return "reload"
+			}
+		}
+	}
+	if _, ok := r.Systemd.(Reloader); !r.Semantic || !ok {
+		return "restart"
+	}
+	previous, err := r.target().Read(change.Unit)
+	if err != nil {
+		return "restart"
+	}
+	action := changeAction(previous, path.Join(r.Src, change.Unit))
+	switch {
+	case action&ActionRestart != 0:
+		return "restart"
+	case action&ActionReload != 0:
+		return "reload"
+	case action&ActionReenable != 0:
+		return "reenable"
+	default:
+		return "none"
+	}
+}
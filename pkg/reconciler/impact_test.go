@@ -0,0 +1,64 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type impactSystemd struct {
+	*dependentsSystemd
+	restarts map[string]time.Duration
+}
+
+func (i *impactSystemd) LastRestart(ctx context.Context, unit string) (time.Duration, error) {
+	return i.restarts[unit], nil
+}
+
+func TestImpact(t *testing.T) {
+	src := t.TempDir()
+	sysd := &impactSystemd{
+		dependentsSystemd: &dependentsSystemd{
+			fakeSystemd: &fakeSystemd{Active: map[string]bool{"sidecar.service": true, "web.socket": true}},
+			dependents:  map[string][]string{"main.service": {"main.service", "sidecar.service", "stopped.service", "web.socket"}},
+		},
+		restarts: map[string]time.Duration{"main.service": 2 * time.Second},
+	}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Service]\nExecStart=/bin/main\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "old.service"), []byte("[Service]\nExecStart=/bin/old\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	ctx := context.Background()
+
+	assert.Equal(t, &Impact{Action: "start"}, r.Impact(ctx, &Change{Unit: "new.service", Action: "create"}))
+	assert.Equal(t, &Impact{Action: "none"}, r.Impact(ctx, &Change{Unit: "main.service", Action: "chmod"}))
+	assert.Equal(t, &Impact{Action: "stop"}, r.Impact(ctx, &Change{Unit: "old.service", Action: "remove"}))
+
+	// Restarts propagate to the active dependents, including sockets
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Service]\nExecStart=/bin/main2\n"), 0644))
+	assert.Equal(t, &Impact{
+		Action:     "restart",
+		Dependents: []string{"sidecar.service", "web.socket"},
+		Sockets:    []string{"web.socket"},
+		Downtime:   2 * time.Second,
+	}, r.Impact(ctx, &Change{Unit: "main.service", Action: "update"}))
+
+	// Semantic changes only reload the unit
+	r.Semantic = true
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.service"), []byte("[Unit]\nDescription=main\n[Service]\nExecStart=/bin/main\n"), 0644))
+	assert.Equal(t, &Impact{Action: "reload"}, r.Impact(ctx, &Change{Unit: "main.service", Action: "update"}))
+
+	// Inactive services are left for their activator
+	r.Activation = true
+	r.Semantic = false
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "main.socket"), []byte("[Socket]\nListenStream=80\n"), 0644))
+	assert.Equal(t, &Impact{Action: "reload"}, r.Impact(ctx, &Change{Unit: "main.service", Action: "update"}))
+	assert.Equal(t, &Impact{Action: "start"}, r.Impact(ctx, &Change{Unit: "other.service", Action: "create"}))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "other.socket"), []byte("[Socket]\nListenStream=81\n"), 0644))
+	assert.Equal(t, &Impact{Action: "none"}, r.Impact(ctx, &Change{Unit: "other.service", Action: "create"}))
+}
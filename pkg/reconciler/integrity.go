@@ -0,0 +1,117 @@
+package reconciler
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DaemonReloadChecker is implemented by Systemd implementations that know whether systemd's loaded configuration of
+// units is older than their files on disk.
+type DaemonReloadChecker interface {
+	NeedDaemonReload(ctx context.Context, units []string) (map[string]bool, error)
+}
+
+// DaemonReloader is implemented by Systemd implementations that can reload systemd's configuration of every unit.
+type DaemonReloader interface {
+	DaemonReload(ctx context.Context) error
+}
+
+// Discrepancy is a difference between an applied unit and what the reconciler recorded, see VerifyApplied.
+type Discrepancy struct {
+	Unit    string `json:"unit"`
+	Problem string `json:"problem"` // missing, modified, unreadable, or stale
+	Detail  string `json:"detail"`
+}
+
+// VerifyApplied hashes every applied unit file in the destination again and compares it with State, and asks systemd
+// whether its loaded configuration of the units is stale if the Systemd implementation is a DaemonReloadChecker.
+// Nothing is changed, so discrepancies remain until the next sync or daemon-reload.
+func (r *Reconciler) VerifyApplied(ctx context.Context) ([]*Discrepancy, error) {
+	r.mu.Lock()
+	units := make([]string, 0, len(r.State))
+	recorded := make(map[string]string, len(r.State))
+	for unit, checksum := range r.State {
+		units = append(units, unit)
+		recorded[unit] = checksum
+	}
+	r.mu.Unlock()
+	sort.Strings(units)
+
+	var (
+		discrepancies []*Discrepancy
+		present       []string
+	)
+	for _, unit := range units {
+		content, err := r.target().Read(unit)
+		switch {
+		case os.IsNotExist(err):
+			discrepancies = append(discrepancies, &Discrepancy{Unit: unit, Problem: "missing", Detail: "the applied unit file was removed"})
+			continue
+		case err != nil:
+			discrepancies = append(discrepancies, &Discrepancy{Unit: unit, Problem: "unreadable", Detail: err.Error()})
+			continue
+		}
+		present = append(present, unit)
+		if checksum := r.ConfigChecksum(content); checksum != recorded[unit] {
+			discrepancies = append(discrepancies, &Discrepancy{Unit: unit, Problem: "modified", Detail: "checksum " + checksum + " doesn't match the applied " + recorded[unit]})
+		}
+	}
+
+	if checker, ok := r.Systemd.(DaemonReloadChecker); ok && len(present) > 0 {
+		stale, err := checker.NeedDaemonReload(ctx, present)
+		if err != nil {
+			return nil, err
+		}
+		for _, unit := range present {
+			if stale[unit] {
+				discrepancies = append(discrepancies, &Discrepancy{Unit: unit, Problem: "stale", Detail: "systemd's loaded configuration is older than the unit file, it needs a daemon-reload"})
+			}
+		}
+		sort.SliceStable(discrepancies, func(i, j int) bool { return discrepancies[i].Unit < discrepancies[j].Unit })
+	}
+	return discrepancies, nil
+}
+
+// reloadDrifted reloads systemd's configuration when it's stale for any applied unit, e.g. since a drop-in was edited
+// out of band, rather than only reloading around the reconciler's own restarts. It's done by full syncs if
+// ReloadDrift is set and the Systemd implementation is a DaemonReloadChecker and DaemonReloader.
+func (r *Reconciler) reloadDrifted(ctx context.Context) {
+	checker, ok := r.Systemd.(DaemonReloadChecker)
+	reloader, canReload := r.Systemd.(DaemonReloader)
+	if !r.ReloadDrift || !ok || !canReload {
+		return
+	}
+
+	r.mu.Lock()
+	units := make([]string, 0, len(r.State))
+	for unit := range r.State {
+		units = append(units, unit)
+	}
+	r.mu.Unlock()
+	if len(units) == 0 {
+		return
+	}
+	sort.Strings(units)
+
+	needed, err := checker.NeedDaemonReload(ctx, units)
+	if err != nil {
+		log.Printf("error while checking whether systemd's configuration is stale: %s", err)
+		return
+	}
+	var stale []string
+	for _, unit := range units {
+		if needed[unit] {
+			stale = append(stale, unit)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	log.Printf("reloading systemd since its configuration of units %s is older than their files", strings.Join(stale, ", "))
+	if err := reloader.DaemonReload(ctx); err != nil {
+		log.Printf("error while reloading systemd: %s", err)
+	}
+}
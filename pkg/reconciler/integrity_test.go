@@ -0,0 +1,81 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reloadCheckingSystemd struct {
+	fakeSystemd
+	stale   map[string]bool
+	reloads int
+}
+
+func (s *reloadCheckingSystemd) NeedDaemonReload(ctx context.Context, units []string) (map[string]bool, error) {
+	return s.stale, nil
+}
+
+func (s *reloadCheckingSystemd) DaemonReload(ctx context.Context) error {
+	s.reloads++
+	s.stale = nil
+	return nil
+}
+
+func TestVerifyApplied(t *testing.T) {
+	src := t.TempDir()
+	sysd := &reloadCheckingSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	for _, unit := range []string{"a.service", "b.service", "c.service", "d.service"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, unit), []byte("[Service]\nExecStart=/bin/"+unit+"\n"), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+
+	discrepancies, err := r.VerifyApplied(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+
+	// Out of band changes are found without being reverted
+	require.NoError(t, ioutil.WriteFile(path.Join(r.Dest, "a.service"), []byte("[Service]\nExecStart=/bin/edited\n"), 0644))
+	require.NoError(t, os.Remove(path.Join(r.Dest, "b.service")))
+	sysd.stale = map[string]bool{"a.service": true, "c.service": true}
+	discrepancies, err = r.VerifyApplied(context.Background())
+	require.NoError(t, err)
+	require.Len(t, discrepancies, 4)
+	assert.Equal(t, "a.service", discrepancies[0].Unit)
+	assert.Equal(t, "modified", discrepancies[0].Problem)
+	assert.Equal(t, "a.service", discrepancies[1].Unit)
+	assert.Equal(t, "stale", discrepancies[1].Problem)
+	assert.Equal(t, &Discrepancy{Unit: "b.service", Problem: "missing", Detail: "the applied unit file was removed"}, discrepancies[2])
+	assert.Equal(t, "c.service", discrepancies[3].Unit)
+	assert.Equal(t, "stale", discrepancies[3].Problem)
+
+	content, err := ioutil.ReadFile(path.Join(r.Dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/edited\n", string(content))
+}
+
+func TestReloadDrift(t *testing.T) {
+	src := t.TempDir()
+	sysd := &reloadCheckingSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	sysd.stale = map[string]bool{"a.service": true}
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, 0, sysd.reloads, "disabled")
+
+	r.ReloadDrift = true
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, 1, sysd.reloads)
+	assert.NotContains(t, sysd.Cmds, "Restart a.service")
+
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, 1, sysd.reloads, "only when stale")
+}
@@ -0,0 +1,141 @@
+package reconciler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Linter runs the built-in lint rules against unit files.
+type Linter struct {
+	Strict   bool // block units with lint findings from being applied
+	Disabled map[string]bool
+}
+
+type lintRule struct {
+	Name  string
+	Check func(unit string, file *UnitFile) []string
+}
+
+var lintRules = []*lintRule{
+	{Name: "missing-restart", Check: lintMissingRestart},
+	{Name: "deprecated-directive", Check: lintDeprecated},
+	{Name: "suspicious-wantedby", Check: lintWantedBy},
+	{Name: "world-writable-envfile", Check: lintEnvironmentFile},
+}
+
+// NewLinter parses the -lint flag value ("off", "warn", or "strict") and the list of disabled rules.
+func NewLinter(mode, disabled string) (*Linter, error) {
+	l := &Linter{Disabled: map[string]bool{}}
+	switch mode {
+	case "off":
+		return nil, nil
+	case "warn":
+	case "strict":
+		l.Strict = true
+	default:
+		return nil, fmt.Errorf("unknown lint mode %q", mode)
+	}
+
+	known := map[string]bool{}
+	for _, rule := range lintRules {
+		known[rule.Name] = true
+	}
+	for _, name := range strings.Split(disabled, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+		l.Disabled[name] = true
+	}
+
+	return l, nil
+}
+
+func (l *Linter) Lint(unit string, file *UnitFile) []*Violation {
+	var findings []*Violation
+	for _, rule := range lintRules {
+		if l.Disabled[rule.Name] {
+			continue
+		}
+		for _, msg := range rule.Check(unit, file) {
+			findings = append(findings, &Violation{Rule: rule.Name, Message: msg})
+		}
+	}
+	return findings
+}
+
+func lintMissingRestart(unit string, file *UnitFile) []string {
+	if path.Ext(unit) != ".service" {
+		return nil
+	}
+	if typ, _ := file.Value("Service", "Type"); typ == "oneshot" {
+		return nil // oneshot services can't be restarted automatically
+	}
+	if _, ok := file.Value("Service", "Restart"); ok {
+		return nil
+	}
+	return []string{"Restart= is not set, the service will not be restarted if it exits"}
+}
+
+// deprecatedDirectives maps directives that have been deprecated by systemd to their replacements.
+var deprecatedDirectives = map[string]string{
+	"Service.PermissionsStartOnly": "the + prefix on Exec*= lines",
+	"Service.MemoryLimit":          "MemoryMax=",
+	"Service.CPUShares":            "CPUWeight=",
+	"Service.StartupCPUShares":     "StartupCPUWeight=",
+	"Service.BlockIOWeight":        "IOWeight=",
+	"Service.StartLimitInterval":   "StartLimitIntervalSec= in [Unit]",
+	"Service.StartLimitBurst":      "StartLimitBurst= in [Unit]",
+	"Unit.StartLimitInterval":      "StartLimitIntervalSec=",
+}
+
+func lintDeprecated(unit string, file *UnitFile) []string {
+	var msgs []string
+	for _, entry := range file.Entries {
+		replacement, ok := deprecatedDirectives[entry.Section+"."+entry.Key]
+		if !ok {
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("line %d: %s= is deprecated, use %s instead", entry.Line, entry.Key, replacement))
+	}
+	return msgs
+}
+
+func lintWantedBy(unit string, file *UnitFile) []string {
+	var msgs []string
+	for _, key := range []string{"WantedBy", "RequiredBy"} {
+		for _, val := range file.Values("Install", key) {
+			for _, target := range strings.Fields(val) {
+				switch {
+				case target == unit:
+					msgs = append(msgs, fmt.Sprintf("%s=%s refers to the unit itself", key, target))
+				case target == "default.target":
+					msgs = append(msgs, fmt.Sprintf("%s=default.target is usually meant for user units, consider multi-user.target", key))
+				case path.Ext(target) != ".target":
+					msgs = append(msgs, fmt.Sprintf("%s=%s is not a target", key, target))
+				}
+			}
+		}
+	}
+	return msgs
+}
+
+func lintEnvironmentFile(unit string, file *UnitFile) []string {
+	var msgs []string
+	for _, val := range file.Values("Service", "EnvironmentFile") {
+		name := strings.TrimPrefix(val, "-")
+		info, err := os.Stat(name)
+		if err != nil {
+			continue // missing files are handled by systemd
+		}
+		if info.Mode().Perm()&0002 != 0 {
+			msgs = append(msgs, fmt.Sprintf("EnvironmentFile %s is world-writable", name))
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,76 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	envFile := path.Join(t.TempDir(), "env")
+	require.NoError(t, ioutil.WriteFile(envFile, []byte("A=1"), 0644))
+	require.NoError(t, os.Chmod(envFile, 0666))
+
+	file, err := ParseUnitFile(strings.NewReader(`
+[Service]
+ExecStart=/bin/true
+MemoryLimit=1G
+EnvironmentFile=-` + envFile + `
+
+[Install]
+WantedBy=multi-user.service
+`))
+	require.NoError(t, err)
+
+	l, err := NewLinter("warn", "")
+	require.NoError(t, err)
+
+	var msgs []string
+	for _, finding := range l.Lint("test.service", file) {
+		msgs = append(msgs, finding.String())
+	}
+	assert.Equal(t, []string{
+		"missing-restart: Restart= is not set, the service will not be restarted if it exits",
+		"deprecated-directive: line 4: MemoryLimit= is deprecated, use MemoryMax= instead",
+		"suspicious-wantedby: WantedBy=multi-user.service is not a target",
+		"world-writable-envfile: EnvironmentFile " + envFile + " is world-writable",
+	}, msgs)
+
+	l, err = NewLinter("strict", "missing-restart, deprecated-directive,suspicious-wantedby,world-writable-envfile")
+	require.NoError(t, err)
+	assert.True(t, l.Strict)
+	assert.Empty(t, l.Lint("test.service", file))
+}
+
+func TestNewLinter(t *testing.T) {
+	l, err := NewLinter("off", "")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	_, err = NewLinter("loud", "")
+	assert.EqualError(t, err, `unknown lint mode "loud"`)
+
+	_, err = NewLinter("warn", "nope")
+	assert.EqualError(t, err, `unknown lint rule "nope"`)
+}
+
+func TestLintReport(t *testing.T) {
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}, Linter: &Linter{}}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/b\nRestart=always\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, map[string]int{"a.service": 1, "b.service": 0}, r.Report(true).Lint)
+
+	// Fixed and removed units no longer count
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\nRestart=always\n"), 0644))
+	require.NoError(t, os.Remove(path.Join(src, "b.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, map[string]int{"a.service": 0}, r.Report(true).Lint)
+}
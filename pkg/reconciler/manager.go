@@ -0,0 +1,147 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jveski/unitmgr/pkg/watch"
+)
+
+// Manager keeps the units of its reconcilers in sync with their source directories.
+//
+// Changed units are reconciled as soon as their files change, failed units are retried with backoff,
+// and every unit is reconciled again every Resync.
+type Manager struct {
+	Reconcilers  []*Reconciler
+	Resync       time.Duration
+	Debounce     time.Duration // optional, wait for file changes to settle for this long before syncing
+	Poll         string        // poll source directories instead of relying on inotify: auto (for network and fuse mounts), always, or never (default)
+	PollInterval time.Duration
+	WatchCheck   time.Duration // how often to check that the watches of source directories weren't lost, defaults to watch.DefaultCheckInterval
+	Trigger      <-chan string // optional, files to sync as if they changed, e.g. the units of queued actions run early
+	Hooks        Hooks
+}
+
+// Hooks are optional callbacks invoked by the Manager.
+type Hooks struct {
+	// Paused is called before every sync. Syncs are skipped while it returns true, and checked again after the returned duration.
+	Paused func() (bool, time.Duration)
+
+	// Synced is called after every sync, ok is false while any unit is failing.
+	Synced func(ok bool)
+}
+
+// Run syncs until the context is canceled.
+func (m *Manager) Run(ctx context.Context) error {
+	poller := watch.NewPoller(m.PollInterval)
+	dirs := make([]string, len(m.Reconcilers))
+	for i, rec := range m.Reconcilers {
+		if err := os.MkdirAll(rec.Src, 0755); err != nil {
+			return err
+		}
+		dirs[i] = rec.Src
+
+		poll, err := m.shouldPoll(rec.Src)
+		if err != nil {
+			return err
+		}
+		if poll {
+			poller.Dirs = append(poller.Dirs, rec.Src)
+		}
+	}
+
+	// Watches are lost when a source directory is removed, replaced, or remounted, the watcher recreates them
+	// and sends the directory as changed, which resyncs its reconciler.
+	watcher, err := watch.NewWatcher(dirs, m.WatchCheck)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go watcher.Run(ctx)
+
+	var events <-chan fsnotify.Event = watcher.Events
+	if len(poller.Dirs) > 0 {
+		go poller.Run()
+		events = watch.MergeEvents(watcher.Events, poller.Events)
+	}
+	if m.Trigger != nil {
+		triggered := make(chan fsnotify.Event)
+		go func() {
+			for name := range m.Trigger {
+				triggered <- fsnotify.Event{Name: name, Op: fsnotify.Write}
+			}
+		}()
+		events = watch.MergeEvents(events, triggered)
+	}
+
+	var lastResync time.Time
+	return watch.Loop(ctx, events, watcher.Errors, m.Debounce, func(changed []string) time.Duration {
+		if m.Hooks.Paused != nil {
+			if paused, next := m.Hooks.Paused(); paused {
+				return next
+			}
+		}
+
+		// Only reconcile the changed or failed units unless a resync is due
+		full := time.Since(lastResync) >= m.Resync
+		if full {
+			lastResync = time.Now()
+		}
+
+		ok := true
+		for _, rec := range m.Reconcilers {
+			var recOK bool
+			switch {
+			case full:
+				recOK = rec.Sync(ctx)
+			case len(changed) > 0:
+				recOK = rec.SyncChanged(ctx, changed)
+			default:
+				recOK = rec.Retry(ctx)
+			}
+			if !recOK {
+				ok = false
+			}
+		}
+		if m.Hooks.Synced != nil {
+			m.Hooks.Synced(ok)
+		}
+
+		next := m.Resync - time.Since(lastResync)
+		for _, rec := range m.Reconcilers {
+			if retryAt, ok := rec.NextRetry(); ok && time.Until(retryAt) < next {
+				next = time.Until(retryAt)
+			}
+		}
+		if next < 1 {
+			next = 1
+		}
+		return next
+	})
+}
+
+func (m *Manager) shouldPoll(dir string) (bool, error) {
+	switch m.Poll {
+	case "always":
+		return true, nil
+	case "never", "":
+		return false, nil
+	case "auto":
+		fs, err := watch.NetworkFilesystem(dir)
+		if err != nil {
+			return false, err
+		}
+		if fs == "" {
+			return false, nil
+		}
+		log.Printf("polling %s for changes since it's on a %s filesystem", dir, fs)
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown poll mode %q", m.Poll)
+	}
+}
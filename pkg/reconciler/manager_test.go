@@ -0,0 +1,69 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	synced := make(chan bool, 10)
+	m := &Manager{
+		Reconcilers: []*Reconciler{r},
+		Resync:      time.Hour,
+		Hooks:       Hooks{Synced: func(ok bool) { synced <- ok }},
+	}
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	assert.True(t, <-synced) // initial resync
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	assert.True(t, <-synced) // file changed
+
+	cancel()
+	require.NoError(t, <-done)
+
+	sysd.mu.Lock()
+	defer sysd.mu.Unlock()
+	assert.Equal(t, "EnsureRunning test.service", sysd.LastCmd)
+}
+
+func TestManagerPaused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	paused := 0
+	m := &Manager{
+		Reconcilers: []*Reconciler{{Src: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}},
+		Resync:      time.Hour,
+		Hooks: Hooks{
+			Paused: func() (bool, time.Duration) {
+				paused++
+				if paused == 3 {
+					cancel()
+				}
+				return true, time.Millisecond
+			},
+			Synced: func(ok bool) { t.Error("synced while paused") },
+		},
+	}
+	require.NoError(t, m.Run(ctx))
+	assert.Equal(t, 3, paused)
+}
+
+func TestManagerInvalidPoll(t *testing.T) {
+	m := &Manager{Reconcilers: []*Reconciler{{Src: t.TempDir()}}, Poll: "sometimes"}
+	assert.Error(t, m.Run(context.Background()))
+}
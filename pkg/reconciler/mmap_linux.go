@@ -0,0 +1,29 @@
+package reconciler
+
+import (
+	"fmt"
+	"hash"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// hashMapped hashes a file by mapping it into memory, which avoids copying large files through a buffer.
+// Returns false if the file can't be mapped. Faults from the file being truncated while it's mapped are
+// returned as errors rather than crashing the process.
+func hashMapped(h hash.Hash, file *os.File, size int64) (ok bool, err error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return false, nil
+	}
+	defer syscall.Munmap(data)
+
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			ok, err = true, fmt.Errorf("file changed while it was hashed: %v", r)
+		}
+	}()
+	h.Write(data)
+	return true, nil
+}
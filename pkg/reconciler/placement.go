@@ -0,0 +1,81 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Placement is how a unit is installed, declared with Placement= in its UnitSection.
+type Placement string
+
+const (
+	PlacementDefault    Placement = ""           // written to its Root= or the default root, and never enabled
+	PlacementPersistent Placement = "persistent" // written to RootDirs.Default and enabled, so systemd starts it on boot
+	PlacementRuntime    Placement = "runtime"    // written to RootDirs.Runtime, which doesn't survive reboots, and never enabled
+)
+
+// Enabler is implemented by Systemd implementations that can create and remove the [Install] symlinks of units.
+type Enabler interface {
+	Enable(ctx context.Context, unit string) error
+	Disable(ctx context.Context, unit string) error
+}
+
+func parsePlacement(parsed *UnitFile) (Placement, error) {
+	value, _ := parsed.Value(UnitSection, "Placement")
+	switch placement := Placement(strings.ToLower(value)); placement {
+	case PlacementDefault, PlacementPersistent, PlacementRuntime:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("unknown placement %q, expected persistent or runtime", value)
+	}
+}
+
+// placeUnit enables persistent units and disables runtime units, since runtime units are started by unitmgr after every
+// boot and may have been enabled while they were persistent. The Alias= names of persistent units are linked to them,
+// and removed once they're no longer declared. It's called until the unit's configuration was applied, so failures are retried.
+func (r *Reconciler) placeUnit(ctx context.Context, unit, name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+		return false
+	}
+	defer file.Close()
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return true // not a unit file
+	}
+	placement, err := parsePlacement(parsed)
+	if roots, ok := r.target().(*RootDirs); err == nil && placement == PlacementRuntime && (!ok || roots.Runtime == "") {
+		err = fmt.Errorf("runtime units require a runtime unit directory, e.g. /run/systemd/system")
+	}
+	var aliases []string
+	if err == nil && placement == PlacementPersistent {
+		aliases, err = unitAliases(unit, parsed)
+	}
+	if err != nil {
+		r.fail(unit, ValidationError, "error while installing unit %q: %s", unit, err)
+		return false
+	}
+	if err := r.linkAliases(unit, aliases); err != nil {
+		r.fail(unit, CopyError, "error while installing unit %q: %s", unit, err)
+		return false
+	}
+	enabler, ok := r.Systemd.(Enabler)
+	if !ok {
+		return true
+	}
+
+	switch {
+	case placement == PlacementPersistent && parsed.HasSection("Install"):
+		err = enabler.Enable(ctx, unit)
+	case placement == PlacementRuntime:
+		err = enabler.Disable(ctx, unit)
+	}
+	if err != nil {
+		r.fail(unit, SystemdError, "error while installing unit %q: %s", unit, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type enablingSystemd struct {
+	*fakeSystemd
+}
+
+func (e *enablingSystemd) Enable(ctx context.Context, unit string) error {
+	return e.record("Enable", unit)
+}
+
+func (e *enablingSystemd) Disable(ctx context.Context, unit string) error {
+	return e.record("Disable", unit)
+}
+
+func TestPlacement(t *testing.T) {
+	src, etc, run := t.TempDir(), t.TempDir(), t.TempDir()
+	sysd := &enablingSystemd{&fakeSystemd{}}
+	roots := &RootDirs{Roots: []*LocalDir{{Dir: etc}, {Dir: run}}, Default: etc, Runtime: run, Src: src}
+	r := &Reconciler{Src: src, Dest: etc, Target: roots, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Install]\nWantedBy=multi-user.target\n\n[X-Unitmgr]\nPlacement=persistent\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Install]\nWantedBy=multi-user.target\n\n[X-Unitmgr]\nPlacement=runtime\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "c.service"), []byte("[Install]\nWantedBy=multi-user.target\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.FileExists(t, path.Join(etc, "a.service"))
+	assert.FileExists(t, path.Join(run, "b.service"))
+	assert.FileExists(t, path.Join(etc, "c.service"))
+	assert.ElementsMatch(t, []string{"Enable a.service", "EnsureRunning a.service", "Disable b.service", "EnsureRunning b.service", "EnsureRunning c.service"}, sysd.Cmds)
+
+	// Runtime units are recreated after reboots
+	sysd.Cmds = nil
+	require.NoError(t, os.Remove(path.Join(run, "b.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.FileExists(t, path.Join(run, "b.service"))
+	assert.Equal(t, []string{"EnsureRunning a.service", "EnsureRunning b.service", "EnsureRunning c.service"}, sysd.Cmds)
+}
+
+func TestPlacementInvalid(t *testing.T) {
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &enablingSystemd{&fakeSystemd{}}}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[X-Unitmgr]\nPlacement=runtime\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[X-Unitmgr]\nPlacement=sometimes\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["a.service"], "runtime units require a runtime unit directory")
+	assert.Contains(t, r.Failures["b.service"], `unknown placement "sometimes"`)
+	assert.Equal(t, []ErrorClass{ValidationError}, r.Classes())
+}
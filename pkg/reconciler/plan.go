@@ -0,0 +1,89 @@
+package reconciler
+
+import (
+	"log"
+	"os"
+	"path"
+)
+
+// Change is a modification that a sync would make.
+type Change struct {
+	Unit   string `json:"unit"`
+	Action string `json:"action"` // create, update, chmod, or remove
+}
+
+// Plan returns the changes a full sync would make to the unit files without making them.
+// Units whose file is unchanged aren't included, even if they aren't running.
+func (r *Reconciler) Plan() ([]*Change, error) {
+	units, ignore, err := r.units()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	for _, unit := range units {
+		name := path.Join(r.Src, unit)
+		if r.tooLarge(unit, name) {
+			continue
+		}
+		checksum, err := r.sourceChecksum(name)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := r.target().Checksum(unit)
+		if os.IsNotExist(err) {
+			changes = append(changes, &Change{Unit: unit, Action: "create"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if current != checksum {
+			changes = append(changes, &Change{Unit: unit, Action: "update"})
+			continue
+		}
+
+		stat, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		mode, err := r.target().Mode(unit)
+		if err != nil {
+			return nil, err
+		}
+		if mode != stat.Mode().Perm() {
+			changes = append(changes, &Change{Unit: unit, Action: "chmod"})
+		}
+	}
+
+	for _, unit := range r.removed(ignore) {
+		changes = append(changes, &Change{Unit: unit, Action: "remove"})
+	}
+	return changes, nil
+}
+
+// audit logs the changes a sync would make without making them, and keeps them for reports.
+// Changes are only logged when first found.
+func (r *Reconciler) audit() bool {
+	changes, err := r.Plan()
+	if err != nil {
+		log.Printf("error while auditing unit files: %s", err)
+		return false
+	}
+
+	r.mu.Lock()
+	previous := map[Change]bool{}
+	for _, change := range r.pending {
+		previous[*change] = true
+	}
+	r.pending = changes
+	r.mu.Unlock()
+
+	for _, change := range changes {
+		if !previous[*change] {
+			log.Printf("audit: would %s unit: %s", change.Action, change.Unit)
+		}
+	}
+	return true
+}
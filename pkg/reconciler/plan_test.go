@@ -0,0 +1,89 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+
+	for _, name := range []string{"chmod.service", "same.service", "update.service", "remove.service"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, name), []byte(name), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+
+	require.NoError(t, os.Chmod(path.Join(src, "chmod.service"), 0600))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "update.service"), []byte("changed"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "create.service"), []byte("new"), 0644))
+	require.NoError(t, os.Remove(path.Join(src, "remove.service")))
+
+	changes, err := r.Plan()
+	require.NoError(t, err)
+	assert.Equal(t, []*Change{
+		{Unit: "chmod.service", Action: "chmod"},
+		{Unit: "create.service", Action: "create"},
+		{Unit: "update.service", Action: "update"},
+		{Unit: "remove.service", Action: "remove"},
+	}, changes)
+
+	// Nothing was changed
+	_, err = os.Stat(path.Join(r.Dest, "create.service"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, r.State, "remove.service")
+}
+
+func TestValidate(t *testing.T) {
+	src := t.TempDir()
+	linter, err := NewLinter("warn", "")
+	require.NoError(t, err)
+	r := &Reconciler{
+		Src:    src,
+		Linter: linter,
+		Policy: &Policy{Rules: []*policyRule{{Name: "user", Section: "Service", Key: "User", Require: true}}},
+	}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "good.service"), []byte("[Service]\nUser=app\nRestart=always\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "bad.service"), []byte("[Service]\nRestart=always\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "broken.service"), []byte("[Service\n"), 0644))
+
+	problems, err := r.Validate("good.service")
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	problems, err = r.Validate("bad.service")
+	require.NoError(t, err)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "policy violation user")
+
+	problems, err = r.Validate("broken.service")
+	require.NoError(t, err)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "unable to parse")
+
+	_, err = r.Validate("missing.service")
+	assert.Error(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	src := t.TempDir()
+	dest := path.Join(t.TempDir(), "missing")
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd, Audit: true}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "test.service")}))
+
+	assert.Empty(t, sysd.Cmds)
+	assert.NoDirExists(t, dest)
+	assert.Empty(t, r.State)
+	assert.Equal(t, []*Change{{Unit: "test.service", Action: "create"}}, r.Report(true).Pending)
+}
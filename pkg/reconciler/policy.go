@@ -0,0 +1,106 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Policy is a set of rules evaluated against unit files before they are applied.
+type Policy struct {
+	Rules []*policyRule `json:"rules"`
+}
+
+type policyRule struct {
+	Name    string   `json:"name"`
+	Units   string   `json:"units"` // glob matched against the unit name, all units when empty
+	Section string   `json:"section"`
+	Key     string   `json:"key"`
+	Require bool     `json:"require"` // the key must be set
+	Forbid  []string `json:"forbid"`  // regexps that no value of the key may match
+	Message string   `json:"message"`
+
+	forbid []*regexp.Regexp
+}
+
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+func (v *Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Rule, v.Message)
+}
+
+func LoadPolicy(name string) (*Policy, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := &Policy{}
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("decoding policy: %w", err)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Section == "" || rule.Key == "" {
+			return nil, fmt.Errorf("policy rule %q must set section and key", rule.Name)
+		}
+		if _, err := path.Match(rule.Units, ""); err != nil {
+			return nil, fmt.Errorf("policy rule %q has invalid units glob: %w", rule.Name, err)
+		}
+		for _, expr := range rule.Forbid {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("policy rule %q has invalid forbid expression: %w", rule.Name, err)
+			}
+			rule.forbid = append(rule.forbid, re)
+		}
+	}
+
+	return p, nil
+}
+
+// Evaluate returns the rules violated by the given unit file.
+func (p *Policy) Evaluate(unit string, file *UnitFile) []*Violation {
+	var violations []*Violation
+	for _, rule := range p.Rules {
+		if rule.Units != "" {
+			if ok, _ := path.Match(rule.Units, unit); !ok {
+				continue
+			}
+		}
+
+		vals := file.Values(rule.Section, rule.Key)
+		if rule.Require && len(vals) == 0 {
+			violations = append(violations, &Violation{Rule: rule.Name, Message: rule.explain(fmt.Sprintf("%s= must be set in [%s]", rule.Key, rule.Section))})
+			continue
+		}
+
+		for _, val := range vals {
+			for _, re := range rule.forbid {
+				if re.MatchString(val) {
+					violations = append(violations, &Violation{Rule: rule.Name, Message: rule.explain(fmt.Sprintf("%s=%s is not allowed", rule.Key, val))})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+func (r *policyRule) explain(msg string) string {
+	if r.Message == "" {
+		return msg
+	}
+	return strings.TrimSpace(r.Message) + " (" + msg + ")"
+}
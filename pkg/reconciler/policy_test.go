@@ -0,0 +1,58 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	name := path.Join(t.TempDir(), "policy.json")
+	err := ioutil.WriteFile(name, []byte(`{"rules": [
+		{"name": "require-user", "units": "*.service", "section": "Service", "key": "User", "require": true},
+		{"name": "no-root", "section": "Service", "key": "User", "forbid": ["^(root|0)$"], "message": "services must not run as root"}
+	]}`), 0644)
+	require.NoError(t, err)
+
+	p, err := LoadPolicy(name)
+	require.NoError(t, err)
+
+	t.Run("passing", func(t *testing.T) {
+		file, err := ParseUnitFile(strings.NewReader("[Service]\nUser=app\n"))
+		require.NoError(t, err)
+		assert.Empty(t, p.Evaluate("test.service", file))
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		file, err := ParseUnitFile(strings.NewReader("[Service]\nExecStart=/bin/true\n"))
+		require.NoError(t, err)
+
+		violations := p.Evaluate("test.service", file)
+		require.Len(t, violations, 1)
+		assert.Equal(t, "require-user: User= must be set in [Service]", violations[0].String())
+
+		assert.Empty(t, p.Evaluate("test.timer", file))
+	})
+
+	t.Run("forbidden value", func(t *testing.T) {
+		file, err := ParseUnitFile(strings.NewReader("[Service]\nUser=root\n"))
+		require.NoError(t, err)
+
+		violations := p.Evaluate("test.service", file)
+		require.Len(t, violations, 1)
+		assert.Equal(t, "no-root: services must not run as root (User=root is not allowed)", violations[0].String())
+	})
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	name := path.Join(t.TempDir(), "policy.json")
+	err := ioutil.WriteFile(name, []byte(`{"rules": [{"name": "bad", "section": "Service"}]}`), 0644)
+	require.NoError(t, err)
+
+	_, err = LoadPolicy(name)
+	assert.EqualError(t, err, `policy rule "bad" must set section and key`)
+}
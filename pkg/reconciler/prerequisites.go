@@ -0,0 +1,151 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ActiveChecker is implemented by Systemd implementations that can report whether a unit is active.
+type ActiveChecker interface {
+	IsActive(ctx context.Context, unit string) (bool, error)
+}
+
+// DefaultWaitTimeout bounds how long a unit's prerequisites are waited for when it doesn't set WaitTimeout=.
+const DefaultWaitTimeout = time.Minute
+
+// prerequisitePollInterval is how often unmet prerequisites are checked again.
+var prerequisitePollInterval = time.Second
+
+// Prerequisites are the conditions a unit declares in its UnitSection that must hold before it's first started.
+type Prerequisites struct {
+	Units   []string // WaitForUnit=, units that must be active
+	Paths   []string // WaitForPath=, paths that must exist, e.g. mount points of data volumes
+	Ports   []string // WaitForPort=, host:port addresses that must accept TCP connections
+	Timeout time.Duration
+}
+
+// ParsePrerequisites returns the prerequisites declared by a unit file, or nil if it doesn't declare any.
+func ParsePrerequisites(u *UnitFile) (*Prerequisites, error) {
+	p := &Prerequisites{
+		Units:   splitValues(u.Values(UnitSection, "WaitForUnit")),
+		Paths:   splitValues(u.Values(UnitSection, "WaitForPath")),
+		Ports:   splitValues(u.Values(UnitSection, "WaitForPort")),
+		Timeout: DefaultWaitTimeout,
+	}
+	for _, port := range p.Ports {
+		if _, _, err := net.SplitHostPort(port); err != nil {
+			return nil, fmt.Errorf("invalid WaitForPort=%s: %s", port, err)
+		}
+	}
+	if value, ok := u.Value(UnitSection, "WaitTimeout"); ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WaitTimeout=%s: %s", value, err)
+		}
+		p.Timeout = timeout
+	}
+	if len(p.Units) == 0 && len(p.Paths) == 0 && len(p.Ports) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// splitValues splits space-separated lists, like systemd does for Wants= and friends.
+func splitValues(values []string) []string {
+	var all []string
+	for _, value := range values {
+		all = append(all, strings.Fields(value)...)
+	}
+	return all
+}
+
+// Wait blocks until every prerequisite is met, returning an error that lists the unmet ones once the timeout passes
+// or the context's error if it's canceled first.
+func (p *Prerequisites) Wait(parent context.Context, sysd Systemd) error {
+	ctx, cancel := context.WithTimeout(parent, p.Timeout)
+	defer cancel()
+
+	for {
+		unmet := p.unmet(ctx, sysd)
+		if len(unmet) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := parent.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("prerequisites not met after %s: %s", p.Timeout, strings.Join(unmet, ", "))
+		case <-time.After(prerequisitePollInterval):
+		}
+	}
+}
+
+// unmet returns a description of each prerequisite that currently doesn't hold.
+func (p *Prerequisites) unmet(ctx context.Context, sysd Systemd) []string {
+	var unmet []string
+	for _, unit := range p.Units {
+		checker, ok := sysd.(ActiveChecker)
+		if !ok {
+			unmet = append(unmet, fmt.Sprintf("unit %s (the init system can't report unit states)", unit))
+			continue
+		}
+		active, err := checker.IsActive(ctx, unit)
+		if err != nil {
+			unmet = append(unmet, fmt.Sprintf("unit %s (%s)", unit, err))
+			continue
+		}
+		if !active {
+			unmet = append(unmet, fmt.Sprintf("unit %s to be active", unit))
+		}
+	}
+	for _, name := range p.Paths {
+		if _, err := os.Stat(name); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				unmet = append(unmet, fmt.Sprintf("path %s to exist", name))
+				continue
+			}
+			unmet = append(unmet, fmt.Sprintf("path %s (%s)", name, err))
+		}
+	}
+	for _, addr := range p.Ports {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			unmet = append(unmet, fmt.Sprintf("port %s to accept connections", addr))
+			continue
+		}
+		conn.Close()
+	}
+	return unmet
+}
+
+// waitForPrerequisites blocks until the prerequisites declared by a unit file in Src are met.
+// Files that can't be parsed as unit files don't have prerequisites. Unlike the rest of a unit in flight,
+// the wait is interrupted when unitmgr is stopped, since nothing has been started yet.
+func (r *Reconciler) waitForPrerequisites(ctx context.Context, unit, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return nil
+	}
+	prereqs, err := ParsePrerequisites(parsed)
+	if err != nil || prereqs == nil {
+		return err
+	}
+	if unmet := prereqs.unmet(ctx, r.Systemd); len(unmet) > 0 {
+		log.Printf("waiting up to %s to start unit %s for %s", prereqs.Timeout, unit, strings.Join(unmet, ", "))
+	}
+	return prereqs.Wait(cancelable(ctx), r.Systemd)
+}
@@ -0,0 +1,114 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrerequisites(t *testing.T) {
+	parse := func(content string) (*Prerequisites, error) {
+		u, err := ParseUnitFile(strings.NewReader(content))
+		require.NoError(t, err)
+		return ParsePrerequisites(u)
+	}
+
+	p, err := parse("[Service]\nExecStart=/bin/foo\n")
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = parse("[X-Unitmgr]\nWaitForUnit=a.service b.service\nWaitForPath=/mnt/data\nWaitForPort=localhost:5432\nWaitTimeout=5m\n")
+	require.NoError(t, err)
+	assert.Equal(t, &Prerequisites{
+		Units:   []string{"a.service", "b.service"},
+		Paths:   []string{"/mnt/data"},
+		Ports:   []string{"localhost:5432"},
+		Timeout: 5 * time.Minute,
+	}, p)
+
+	_, err = parse("[X-Unitmgr]\nWaitForPath=/mnt/data\nWaitTimeout=soon\n")
+	assert.EqualError(t, err, `invalid WaitTimeout=soon: time: invalid duration "soon"`)
+
+	_, err = parse("[X-Unitmgr]\nWaitForPort=5432\n")
+	assert.Error(t, err)
+}
+
+func TestPrerequisitesWait(t *testing.T) {
+	prerequisitePollInterval = time.Millisecond
+	defer func() { prerequisitePollInterval = time.Second }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	dir := t.TempDir()
+	sysd := &fakeSystemd{Active: map[string]bool{"db.service": true}}
+	p := &Prerequisites{
+		Units:   []string{"db.service"},
+		Paths:   []string{path.Join(dir, "data")},
+		Ports:   []string{listener.Addr().String()},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	err = p.Wait(context.Background(), sysd)
+	assert.EqualError(t, err, "prerequisites not met after 20ms: path "+path.Join(dir, "data")+" to exist")
+
+	require.NoError(t, os.Mkdir(path.Join(dir, "data"), 0755))
+	assert.NoError(t, p.Wait(context.Background(), sysd))
+
+	sysd.Active["db.service"] = false
+	assert.EqualError(t, p.Wait(context.Background(), sysd), "prerequisites not met after 20ms: unit db.service to be active")
+}
+
+func TestSyncPrerequisites(t *testing.T) {
+	prerequisitePollInterval = time.Millisecond
+	defer func() { prerequisitePollInterval = time.Second }()
+
+	src := t.TempDir()
+	dest := t.TempDir()
+	volume := path.Join(t.TempDir(), "volume")
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("[Service]\nExecStart=/bin/foo\n\n[X-Unitmgr]\nWaitForPath="+volume+"\nWaitTimeout=10ms\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+	assert.Contains(t, r.Failures["test.service"], "prerequisites not met after 10ms: path "+volume+" to exist")
+
+	// The unit starts once its volume is mounted
+	require.NoError(t, os.Mkdir(volume, 0755))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning test.service"}, sysd.Cmds)
+
+	// Prerequisites are only checked before the first start
+	require.NoError(t, os.Remove(volume))
+	assert.True(t, r.Sync(context.Background()))
+}
+
+func TestSyncPrerequisitesCanceled(t *testing.T) {
+	prerequisitePollInterval = time.Millisecond
+	defer func() { prerequisitePollInterval = time.Second }()
+
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("[Service]\nExecStart=/bin/foo\n\n[X-Unitmgr]\nWaitForPath=/nonexistent\nWaitTimeout=1h\n"), 0644))
+
+	// Stopping unitmgr interrupts the wait, even though the unit is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	assert.False(t, r.Sync(ctx))
+	assert.Less(t, int64(time.Since(start)), int64(time.Minute))
+	assert.Contains(t, r.Failures["test.service"], "context canceled")
+	assert.Empty(t, sysd.Cmds)
+}
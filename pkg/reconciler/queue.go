@@ -0,0 +1,177 @@
+package reconciler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QueuedAction is an action the reconciler postponed: the restart of a changed unit deferred by the ResourceGuard or a change freeze,
+// or a reboot required by applied changes that's waiting for the reboot window.
+type QueuedAction struct {
+	ID     string    `json:"id"` // the action and unit, e.g. restart:web.service
+	Unit   string    `json:"unit"`
+	Action string    `json:"action"` // restart or reboot
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`          // when the action was first postponed
+	Boot   string    `json:"boot,omitempty"` // of the host when a reboot was queued, it's forgotten once the host rebooted
+}
+
+// readBootID is replaced by tests.
+var readBootID = func() string {
+	buf, _ := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(buf))
+}
+
+func queuedID(action, unit string) string {
+	return action + ":" + unit
+}
+
+// Queue returns the postponed actions, oldest first.
+func (r *Reconciler) Queue() []*QueuedAction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queue()
+}
+
+// queue returns the postponed actions. The caller must hold r.mu.
+func (r *Reconciler) queue() []*QueuedAction {
+	var actions []*QueuedAction
+	add := func(action string, entries map[string]string) {
+		for unit, reason := range entries {
+			id := queuedID(action, unit)
+			queued := &QueuedAction{ID: id, Unit: unit, Action: action, Reason: reason, Since: r.queuedSince[id]}
+			if action == "reboot" {
+				queued.Boot = r.queuedBoot
+			}
+			actions = append(actions, queued)
+		}
+	}
+	add("restart", r.deferred)
+	add("reboot", r.reboot)
+	sort.Slice(actions, func(i, j int) bool {
+		if !actions[i].Since.Equal(actions[j].Since) {
+			return actions[i].Since.Before(actions[j].Since)
+		}
+		return actions[i].ID < actions[j].ID
+	})
+	return actions
+}
+
+// enqueue records when an action was first postponed. The caller must hold r.mu.
+func (r *Reconciler) enqueue(action, unit string) {
+	if r.queuedSince == nil {
+		r.queuedSince = map[string]time.Time{}
+	}
+	if _, ok := r.queuedSince[queuedID(action, unit)]; !ok {
+		r.queuedSince[queuedID(action, unit)] = time.Now().UTC()
+	}
+	if action == "reboot" && r.queuedBoot == "" {
+		r.queuedBoot = readBootID()
+	}
+}
+
+// dequeue forgets a postponed action. The caller must hold r.mu.
+func (r *Reconciler) dequeue(action, unit string) {
+	delete(r.queuedSince, queuedID(action, unit))
+	switch action {
+	case "restart":
+		delete(r.deferred, unit)
+	case "reboot":
+		delete(r.reboot, unit)
+	}
+}
+
+// RunQueued runs a postponed restart with the next sync of its unit, regardless of the ResourceGuard or Freeze, and returns
+// the unit. Reboots are run by the caller, see RebootRequired.
+func (r *Reconciler) RunQueued(id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	action, err := r.queued(id)
+	if err != nil {
+		return "", err
+	}
+	if action.Action != "restart" {
+		return "", fmt.Errorf("%s can't be run by the reconciler", id)
+	}
+	if r.forced == nil {
+		r.forced = map[string]bool{}
+	}
+	r.forced[action.Unit] = true
+	log.Printf("running the queued restart of unit %s early", action.Unit)
+	return action.Unit, nil
+}
+
+// CancelQueued drops a postponed action and returns the unit. Cancelled restarts write the changed unit file
+// without restarting the unit, so the change takes effect when the unit is restarted next. Cancelled reboots
+// are no longer reported as required.
+func (r *Reconciler) CancelQueued(id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	action, err := r.queued(id)
+	if err != nil {
+		return "", err
+	}
+	if action.Action == "restart" {
+		if r.cancelled == nil {
+			r.cancelled = map[string]bool{}
+		}
+		r.cancelled[action.Unit] = true
+	}
+	r.dequeue(action.Action, action.Unit)
+	log.Printf("cancelled the queued %s of unit %s", action.Action, action.Unit)
+	return action.Unit, nil
+}
+
+// queued returns the postponed action with the given id. The caller must hold r.mu.
+func (r *Reconciler) queued(id string) (*QueuedAction, error) {
+	for _, action := range r.queue() {
+		if action.ID == id {
+			return action, nil
+		}
+	}
+	return nil, fmt.Errorf("no action %q is queued", id)
+}
+
+// restoreQueue restores the postponed actions persisted by the StateStore. Deferred restarts are checked again by
+// the next sync, and dropped without a ResourceGuard or Freeze. Reboots queued before the host last rebooted are dropped.
+func (r *Reconciler) restoreQueue(actions []*QueuedAction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	boot := readBootID()
+	for _, action := range actions {
+		switch {
+		case action.Action == "restart" && (r.Guard != nil || r.Freeze != nil):
+			if r.deferred == nil {
+				r.deferred = map[string]string{}
+			}
+			r.deferred[action.Unit] = action.Reason
+		case action.Action == "reboot" && action.Boot != "" && action.Boot == boot:
+			if r.reboot == nil {
+				r.reboot = map[string]string{}
+			}
+			r.reboot[action.Unit] = action.Reason
+			r.queuedBoot = boot
+		default:
+			continue
+		}
+		if r.queuedSince == nil {
+			r.queuedSince = map[string]time.Time{}
+		}
+		r.queuedSince[action.ID] = action.Since
+	}
+}
+
+// takeCancelled returns true once if the unit's queued restart was cancelled, and forgets whether it was run early,
+// since the unit is about to be restarted or not.
+func (r *Reconciler) takeCancelled(unit string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancelled := r.cancelled[unit]
+	delete(r.cancelled, unit)
+	delete(r.forced, unit)
+	return cancelled
+}
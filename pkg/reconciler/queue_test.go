@@ -0,0 +1,106 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueDeferredRestarts(t *testing.T) {
+	usage := &HostUsage{Load: 0.5, Memory: 1 << 30, Disk: 10 << 30}
+	defer func(fn func(string) (*HostUsage, error)) { measureHost = fn }(measureHost)
+	measureHost = func(string) (*HostUsage, error) { return usage, nil }
+
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Guard: &ResourceGuard{MaxLoad: 2}}
+	for _, unit := range []string{"a.service", "b.service"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, unit), []byte("[Service]\nExecStart=/bin/"+unit+"\n"), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+
+	usage.Load = 3
+	for _, unit := range []string{"a.service", "b.service"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, unit), []byte("[Service]\nExecStart=/bin/"+unit+"2\n"), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+	queue := r.Queue()
+	require.Len(t, queue, 2)
+	assert.Equal(t, "restart:a.service", queue[0].ID)
+	assert.Equal(t, "restart", queue[0].Action)
+	assert.Contains(t, queue[0].Reason, "load 3.00 per cpu exceeds 2.00")
+	assert.False(t, queue[0].Since.IsZero())
+
+	// The queue survives syncs without losing when actions were first postponed
+	since := queue[0].Since
+	require.True(t, r.Retry(context.Background()))
+	assert.True(t, since.Equal(r.Queue()[0].Since))
+
+	_, err := r.RunQueued("restart:c.service")
+	assert.EqualError(t, err, `no action "restart:c.service" is queued`)
+
+	// Running a restart early ignores the guard
+	unit, err := r.RunQueued("restart:a.service")
+	require.NoError(t, err)
+	assert.Equal(t, "a.service", unit)
+	require.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "a.service")}))
+	assert.Contains(t, sysd.Cmds, "Restart a.service")
+	require.Len(t, r.Queue(), 1)
+
+	// Cancelling a restart applies the file without restarting the unit
+	_, err = r.CancelQueued("restart:b.service")
+	require.NoError(t, err)
+	assert.Empty(t, r.Queue())
+	require.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "b.service")}))
+	assert.NotContains(t, sysd.Cmds, "Restart b.service")
+	applied, err := ioutil.ReadFile(path.Join(r.Dest, "b.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/b.service2\n", string(applied))
+	assert.Empty(t, r.Queue())
+}
+
+func TestQueueReboots(t *testing.T) {
+	boot := "first"
+	defer func(fn func() string) { readBootID = fn }(readBootID)
+	readBootID = func() string { return boot }
+
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+	name := path.Join(src, "test.service")
+	require.NoError(t, ioutil.WriteFile(name, []byte("[Service]\nExecStart=/bin/a\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	require.NoError(t, ioutil.WriteFile(name, []byte("[Service]\nExecStart=/bin/b\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	queue := r.Queue()
+	require.Len(t, queue, 1)
+	assert.Equal(t, "reboot:test.service", queue[0].ID)
+	assert.Equal(t, "first", queue[0].Boot)
+	_, err := r.RunQueued(queue[0].ID)
+	assert.Error(t, err) // reboots are run by the caller
+
+	// Reboots are only restored on the same boot
+	restored := &Reconciler{Src: src, State: map[string]string{}}
+	restored.restoreQueue(queue)
+	assert.Equal(t, []string{"test.service"}, restored.RebootRequired())
+	boot = "second"
+	restored = &Reconciler{Src: src, State: map[string]string{}}
+	restored.restoreQueue(queue)
+	assert.Empty(t, restored.RebootRequired())
+
+	// Deferred restarts are only restored with a guard
+	restarts := []*QueuedAction{{ID: "restart:a.service", Unit: "a.service", Action: "restart", Reason: "load"}}
+	restored.restoreQueue(restarts)
+	assert.Empty(t, restored.Queue())
+	restored.Guard = &ResourceGuard{}
+	restored.restoreQueue(restarts)
+	assert.Equal(t, map[string]string{"a.service": "load"}, restored.Deferred())
+
+	_, err = r.CancelQueued("reboot:test.service")
+	require.NoError(t, err)
+	assert.Empty(t, r.RebootRequired())
+}
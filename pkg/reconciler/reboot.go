@@ -0,0 +1,90 @@
+package reconciler
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// earlyBootTargets are the targets reached before regular services start.
+// Changes to the units they pull in only fully take effect on the next boot.
+var earlyBootTargets = map[string]bool{
+	"local-fs-pre.target":   true,
+	"local-fs.target":       true,
+	"remote-fs-pre.target":  true,
+	"sysinit.target":        true,
+	"initrd.target":         true,
+	"initrd-fs.target":      true,
+	"initrd-root-fs.target": true,
+}
+
+// rebootReason returns why changes to a unit file require a reboot, or an empty string if they don't.
+// Units can flag themselves with RebootRequired=yes in their UnitSection, or opt out with RebootRequired=no.
+func rebootReason(name string) string {
+	file, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return "" // not a unit file
+	}
+	if value, ok := parsed.Value(UnitSection, "RebootRequired"); ok {
+		switch strings.ToLower(value) {
+		case "yes", "true", "on", "1":
+			return "RebootRequired=yes"
+		default:
+			return ""
+		}
+	}
+	for _, key := range []string{"WantedBy", "RequiredBy"} {
+		for _, target := range splitValues(parsed.Values("Install", key)) {
+			if earlyBootTargets[target] {
+				return "installed into " + target
+			}
+		}
+	}
+	return ""
+}
+
+// flagReboot records that the changes just applied to a unit only fully take effect after a reboot.
+func (r *Reconciler) flagReboot(unit, name string) {
+	reason := rebootReason(name)
+	if reason == "" {
+		return
+	}
+	log.Printf("reboot required to apply changes to unit %s: %s", unit, reason)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reboot == nil {
+		r.reboot = map[string]string{}
+	}
+	r.reboot[unit] = reason
+	r.enqueue("reboot", unit)
+}
+
+// RebootRequired returns the units whose changes have been applied since the last reboot but require one.
+func (r *Reconciler) RebootRequired() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	units := make([]string, 0, len(r.reboot))
+	for unit := range r.reboot {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+	return units
+}
+
+// Rebooted forgets the units requiring a reboot, once the host has been rebooted.
+func (r *Reconciler) Rebooted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for unit := range r.reboot {
+		r.dequeue("reboot", unit)
+	}
+	r.queuedBoot = ""
+}
@@ -0,0 +1,48 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebootReason(t *testing.T) {
+	dir := t.TempDir()
+	reason := func(content string) string {
+		name := path.Join(dir, "test.service")
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+		return rebootReason(name)
+	}
+
+	assert.Equal(t, "", reason("[Install]\nWantedBy=multi-user.target\n"))
+	assert.Equal(t, "installed into sysinit.target", reason("[Install]\nWantedBy=multi-user.target sysinit.target\n"))
+	assert.Equal(t, "installed into local-fs.target", reason("[Install]\nRequiredBy=local-fs.target\n"))
+	assert.Equal(t, "RebootRequired=yes", reason("[Install]\nWantedBy=multi-user.target\n\n[X-Unitmgr]\nRebootRequired=yes\n"))
+	assert.Equal(t, "", reason("[Install]\nWantedBy=sysinit.target\n\n[X-Unitmgr]\nRebootRequired=no\n"))
+	assert.Equal(t, "", reason("#!/sbin/openrc-run\n"))
+}
+
+func TestSyncRebootRequired(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+
+	// New units are started right away
+	name := path.Join(src, "test.service")
+	require.NoError(t, ioutil.WriteFile(name, []byte("[Service]\nExecStart=/bin/a\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.RebootRequired())
+
+	require.NoError(t, ioutil.WriteFile(name, []byte("[Service]\nExecStart=/bin/b\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"test.service"}, r.RebootRequired())
+	assert.Equal(t, []string{"test.service"}, r.Report(true).Reboot)
+
+	r.Rebooted()
+	assert.Empty(t, r.RebootRequired())
+	assert.Empty(t, r.Report(true).Reboot)
+}
@@ -0,0 +1,822 @@
+// Package reconciler syncs unit files from a source directory and manages the corresponding services.
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Systemd manages the services configured by the unit files, see package systemd for implementations.
+type Systemd interface {
+	Restart(ctx context.Context, unit string) error
+	EnsureRunning(ctx context.Context, unit string) (bool, error)
+	EnsureStopped(ctx context.Context, unit string) (bool, error)
+}
+
+// Forgetter is implemented by Systemd implementations that keep state about units after their files are removed.
+type Forgetter interface {
+	Forget(ctx context.Context, unit string) error
+}
+
+// Reconciler syncs unit files from Src to Dest and manages the corresponding systemd units.
+type Reconciler struct {
+	Src, Dest    string
+	Target       Destination       // optional, defaults to the local Dest directory
+	State        map[string]string // unit -> checksum of the last applied configuration, normalized if Normalize is set
+	Systemd      Systemd
+	Policy       *Policy           // optional
+	Linter       *Linter           // optional
+	Security     *SecurityReport   // optional
+	Failures     map[string]string // unit -> most recent error, cleared once the unit is reconciled
+	Backoff      *Backoff          // optional
+	Cache        *ChecksumCache    // optional
+	Hasher       Hasher            // optional, computes the checksums, defaults to sha256; Cache and Target must agree
+	Workers      int               // number of units reconciled concurrently, defaults to one
+	Normalize    bool              // optional, don't restart units for changes to comments, whitespace, or key order
+	Semantic     bool              // optional, reload or re-enable changed units instead of restarting them when the changed directives allow it
+	Audit        bool              // optional, only log and report the changes syncs would make without making them
+	Stability    *StabilityTracker // optional
+	Durations    *DurationTracker  // optional, records how long restarts take
+	MaxSize      int64             // optional, files in Src larger than this many bytes are skipped with a warning
+	Atomic       bool              // optional, apply no changes unless every changed unit file passes Verify, every sync is a full sync
+	Guard        *ResourceGuard    // optional, defer restarts while the host is under pressure
+	Freeze       Freezer           // optional, defer restarts during change freezes
+	FreezeCopies bool              // optional, also defer copying changed unit files during change freezes
+	Dependents   bool              // optional, also restart the active units depending on restarted units, see DependentsReader
+	Activation   bool              // optional, leave starting services to the .socket or .timer of the same name in Src
+	Group        string            // optional, target whose .wants directory links every applied unit, e.g. unitmgr.target, see Linker
+	OnState      []TransitionHook  // optional, called after every change of a unit's state
+	Sanitize     bool              // optional, write unit files with LF line endings and a trailing newline, and reject invalid UTF-8, see Sanitize
+	ReloadDrift  bool              // optional, daemon-reload during full syncs when systemd's configuration of applied units is stale, see DaemonReloadChecker
+	Redact       *Redactor         // optional, masks secrets in the unit content of logged and reported failures
+	Portable     bool              // optional, convert the CRLF line endings and byte order marks of unit files authored on other platforms, see Artifacts
+
+	changes     int32                  // number of modifications made to units, accessed atomically
+	generation  int64                  // of the most recently applied change set, see Generation
+	pending     []*Change              // changes found by the most recent audit
+	deferred    map[string]string      // unit -> why its restart is waiting for headroom or the end of a change freeze
+	forced      map[string]bool        // units whose deferred restart runs with the next sync, see RunQueued
+	cancelled   map[string]bool        // units whose deferred restart was cancelled, see CancelQueued
+	queuedSince map[string]time.Time   // queued action id -> when it was first postponed
+	queuedBoot  string                 // boot id of the host when the first queued reboot was required
+	reboot      map[string]string      // unit -> why its applied changes require a reboot
+	aliases     map[string][]string    // unit -> the aliases linked to it, see linkAliases
+	lint        map[string]int         // unit -> number of lint findings of its current file, see admit
+	sources     map[string]string      // unit -> checksum of its applied source file when State holds normalized or converted checksums
+	touched     map[string]*UnitAction // unit -> its last modification
+	states      map[string]*UnitStatus // unit -> its current state
+	classes     map[string]ErrorClass  // unit -> class of its failure in Failures
+	errors      map[ErrorClass]int64   // failures since the reconciler was created
+	syncError   ErrorClass             // class of the failure of the last sync that wasn't specific to a unit
+	mu          sync.Mutex             // guards State, Failures, Security, generation, pending, the queue, touched, states, lint, sources, and the errors while units are reconciled concurrently
+	linked      map[string]bool        // units linked into Group by this instance
+	groupReady  bool                   // the Group target has been installed
+	groupMu     sync.Mutex             // guards linked and groupReady
+}
+
+// Sync reconciles every unit in Src and removes the applied units that no longer exist, returning false if anything failed.
+func (r *Reconciler) Sync(ctx context.Context) bool {
+	ok := r.sync(ctx)
+
+	if r.Backoff != nil {
+		now := time.Now()
+		if ok || len(r.Failures) > 0 {
+			r.Backoff.Succeeded("")
+		} else {
+			r.Backoff.Failed("", now) // the failure wasn't specific to a unit
+		}
+		for unit := range r.Backoff.entries {
+			if _, failed := r.Failures[unit]; !failed && unit != "" {
+				r.Backoff.Succeeded(unit)
+			}
+		}
+		for unit := range r.Failures {
+			r.Backoff.Failed(unit, now)
+		}
+	}
+
+	return ok
+}
+
+// NextRetry returns when failed units or deferred restarts should be retried.
+func (r *Reconciler) NextRetry() (time.Time, bool) {
+	var (
+		next time.Time
+		ok   bool
+	)
+	if r.Backoff != nil {
+		next, ok = r.Backoff.Next()
+	}
+	if len(r.Deferred()) > 0 {
+		if retry := time.Now().Add(r.deferredRetry()); !ok || retry.Before(next) {
+			next, ok = retry, true
+		}
+	}
+	return next, ok
+}
+
+func (r *Reconciler) sync(ctx context.Context) bool {
+	if r.Audit {
+		return r.audit()
+	}
+
+	r.mu.Lock()
+	r.Failures = map[string]string{}
+	r.classes = map[string]ErrorClass{}
+	r.syncError = ""
+	r.mu.Unlock()
+
+	units, ignore, err := r.units()
+	if err != nil {
+		log.Printf("error while listing unit files: %s", err)
+		r.mu.Lock()
+		r.syncError = SourceError
+		r.countError(SourceError)
+		r.mu.Unlock()
+		return false
+	}
+	if !r.verifyBatch() {
+		return false
+	}
+	defer r.commitGeneration(r.Changes())
+
+	ok := true
+	if !r.each(ctx, units, r.applyUnit) {
+		ok = false
+	}
+	if !r.each(ctx, r.removed(ignore), r.removeUnit) {
+		ok = false
+	}
+	r.pruneDependencies()
+	if ctx.Err() == nil {
+		r.reloadDrifted(ctx)
+	}
+
+	return ok
+}
+
+// Units returns the names of the unit files in Src, excluding the files ignored by IgnoreFile or their own Ignore= directive.
+func (r *Reconciler) Units() ([]string, error) {
+	units, _, err := r.units()
+	return units, err
+}
+
+func (r *Reconciler) units() ([]string, *IgnoreRules, error) {
+	ignore, err := LoadIgnoreRules(r.Src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := ioutil.ReadDir(r.Src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var units []string
+	for _, stat := range files {
+		if ignoredFile(stat.Name()) || stat.IsDir() || r.ignoredUnit(ignore, stat.Name()) {
+			continue
+		}
+		units = append(units, path.Base(stat.Name()))
+	}
+	return units, ignore, nil
+}
+
+// removed returns the applied units whose files no longer exist in Src or are now ignored.
+func (r *Reconciler) removed(ignore *IgnoreRules) []string {
+	var removed []string
+	for unit := range r.State {
+		if _, err := os.Stat(path.Join(r.Src, unit)); err == nil && !r.ignoredUnit(ignore, unit) {
+			continue // file still exists
+		}
+		removed = append(removed, unit)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// each calls fn for every unit using up to Workers goroutines and returns false if any call failed.
+// Units that haven't been started when the context is canceled are skipped, but the units in flight aren't
+// canceled with it, so e.g. a restart isn't interrupted halfway by unitmgr being stopped.
+func (r *Reconciler) each(ctx context.Context, units []string, fn func(ctx context.Context, unit string) bool) bool {
+	work := inFlight{ctx}
+	if r.Workers <= 1 {
+		ok := true
+		for _, unit := range units {
+			if ctx.Err() != nil {
+				return false
+			}
+			if !fn(work, unit) {
+				ok = false
+			}
+		}
+		return ok
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed int32
+		queue  = make(chan string)
+	)
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for unit := range queue {
+				if !fn(work, unit) {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for _, unit := range units {
+		if ctx.Err() != nil {
+			atomic.StoreInt32(&failed, 1)
+			break
+		}
+		queue <- unit
+	}
+	close(queue)
+	wg.Wait()
+
+	return atomic.LoadInt32(&failed) == 0
+}
+
+// inFlight carries the values of its context without its cancelation or deadline, see each.
+type inFlight struct {
+	context.Context
+}
+
+func (inFlight) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (inFlight) Done() <-chan struct{}       { return nil }
+func (inFlight) Err() error                  { return nil }
+
+// cancelable returns the context each was called with, for the steps of a unit in flight that can be interrupted.
+func cancelable(ctx context.Context) context.Context {
+	if work, ok := ctx.(inFlight); ok {
+		return work.Context
+	}
+	return ctx
+}
+
+// Retry reconciles only the failed units that are due to be retried and returns false while any unit is still failing.
+// A full sync is performed if the previous failure wasn't specific to a unit.
+func (r *Reconciler) Retry(ctx context.Context) bool {
+	if r.Backoff == nil {
+		return r.Sync(ctx)
+	}
+
+	now := time.Now()
+	var due []string
+	for key, entry := range r.Backoff.entries {
+		if entry.Next.After(now) {
+			continue
+		}
+		if key == "" {
+			return r.Sync(ctx)
+		}
+		due = append(due, key)
+	}
+	for unit := range r.Deferred() {
+		if _, ok := r.Backoff.entries[unit]; !ok {
+			due = append(due, unit)
+		}
+	}
+	sort.Strings(due)
+
+	return r.SyncUnits(ctx, due)
+}
+
+// SyncChanged reconciles the units corresponding to the given changed file paths.
+// A full sync is performed if the src directory itself changed.
+func (r *Reconciler) SyncChanged(ctx context.Context, changed []string) bool {
+	src := path.Clean(r.Src)
+
+	var units []string
+	for _, name := range changed {
+		name = path.Clean(name)
+		if name == src || name == path.Join(src, IgnoreFile) {
+			return r.Sync(ctx)
+		}
+		if path.Dir(name) != src || ignoredFile(path.Base(name)) {
+			continue
+		}
+		units = append(units, path.Base(name))
+	}
+
+	return r.SyncUnits(ctx, units)
+}
+
+// SyncUnits reconciles the given units and returns false while any unit is still failing.
+func (r *Reconciler) SyncUnits(ctx context.Context, units []string) bool {
+	if r.Audit && len(units) > 0 {
+		return r.audit() // audits are cheap enough to always cover every unit
+	}
+	if r.Atomic && len(units) > 0 {
+		return r.Sync(ctx) // changes are verified and applied together, including the ones held back by previous syncs
+	}
+	defer r.commitGeneration(r.Changes())
+
+	r.mu.Lock()
+	for _, unit := range units {
+		delete(r.Failures, unit)
+		delete(r.classes, unit)
+	}
+	r.mu.Unlock()
+	r.each(ctx, units, r.syncUnit)
+
+	if r.Backoff != nil {
+		now := time.Now()
+		for _, unit := range units {
+			if _, failed := r.Failures[unit]; failed {
+				r.Backoff.Failed(unit, now)
+				continue
+			}
+			r.Backoff.Succeeded(unit)
+		}
+	}
+	return len(r.Failures) == 0
+}
+
+// syncUnit reconciles a single unit, applying its file if it exists in src or removing it otherwise.
+func (r *Reconciler) syncUnit(ctx context.Context, unit string) bool {
+	ignore, err := LoadIgnoreRules(r.Src)
+	if err != nil {
+		r.fail(unit, SourceError, "error while reading %s: %s", IgnoreFile, err)
+		return false
+	}
+
+	stat, err := os.Stat(path.Join(r.Src, unit))
+	if os.IsNotExist(err) || (err == nil && !stat.IsDir() && r.ignoredUnit(ignore, unit)) {
+		if _, ok := r.applied(unit); !ok {
+			return true // never applied
+		}
+		return r.removeUnit(ctx, unit)
+	}
+	if err == nil && stat.IsDir() {
+		return true
+	}
+	return r.applyUnit(ctx, unit)
+}
+
+// TemplateSuffix marks files in src that are rendered into the unit named without it rather than applied.
+const TemplateSuffix = ".tmpl"
+
+// ignoredFile returns true for files in src that aren't units.
+func ignoredFile(name string) bool {
+	if strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, "~") {
+		return true // skip vim files
+	}
+	if strings.HasPrefix(name, ".") {
+		return true // skip hidden files, including in-progress atomic writes
+	}
+	if strings.HasSuffix(name, TemplateSuffix) {
+		return true // applied once rendered
+	}
+	return false
+}
+
+func (r *Reconciler) applyUnit(ctx context.Context, unit string) bool {
+	name := path.Join(r.Src, unit)
+	if r.tooLarge(unit, name) {
+		return true
+	}
+
+	checksum, err := r.sourceChecksum(name)
+	if os.IsNotExist(err) {
+		return true // file was removed between the time of the notification and now
+	}
+	if errors.Is(err, ErrInvalidUTF8) {
+		r.fail(unit, ValidationError, "error reading unit file %q: %s", unit, err)
+		return false
+	}
+	if err != nil {
+		r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+		return false
+	}
+	source := checksum
+	if r.converted() {
+		if source, err = r.checksum(name); err != nil {
+			r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+			return false
+		}
+	}
+	config := checksum
+	if r.Normalize {
+		if config, err = normalizedChecksum(r.Hasher, name); err != nil {
+			r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+			return false
+		}
+	}
+	if r.securityRejected(unit, config) {
+		r.transition(unit, StateQuarantined, "security exposure exceeds the threshold")
+		return true // this configuration already failed the security check
+	}
+
+	currentChecksum, err := r.target().Checksum(unit)
+	if err != nil && !os.IsNotExist(err) {
+		r.fail(unit, CopyError, "error reading current unit file %q: %s", unit, err)
+		return false
+	}
+
+	// Make sure the unit file is in sync
+	var previous []byte
+	if checksum != currentChecksum {
+		r.transition(unit, StatePendingCopy, "")
+		if !r.admit(unit, name) {
+			r.quarantine(unit, "rejected by the policy or linter")
+			return false
+		}
+		if applied, _ := r.applied(unit); currentChecksum != "" && config != applied && (r.deferFrozen(unit, true) || r.deferRestart(unit, name)) {
+			return true
+		}
+		if r.Semantic && currentChecksum != "" {
+			if previous, err = r.target().Read(unit); err != nil {
+				log.Printf("error while reading current unit file %q, it will be restarted: %s", unit, err)
+			}
+		}
+		if err := r.copyUnit(name, unit); err != nil {
+			r.fail(unit, CopyError, "error while copying unit file %q: %s", unit, err)
+			return false
+		}
+		log.Printf("wrote unit: %s", unit)
+		r.recordChange(unit, "wrote")
+		r.transition(unit, StateCopied, "")
+	} else if !r.admit(unit, name) {
+		// Applied units are evaluated again, so they're covered by a newly loaded policy. They keep running.
+		r.quarantine(unit, "rejected by the policy or linter")
+		return false
+	} else if !r.syncMode(unit, name) {
+		return false
+	}
+
+	// Make sure unit is running if it's new or already in the correct state
+	if (checksum == currentChecksum || currentChecksum == "") && !r.copiedFrozen(unit) {
+		if applied, ok := r.applied(unit); !ok || config != applied {
+			if !r.placeUnit(ctx, unit, name) {
+				return false
+			}
+		}
+		if activator, ok := r.activator(unit); ok {
+			if _, ok := r.applied(unit); !ok {
+				log.Printf("not starting unit %s since it's activated by %s", unit, activator)
+			}
+			secure := r.checkSecurity(ctx, unit, config)
+			r.setApplied(unit, config, source)
+			r.joinGroup(unit)
+			r.healthy(unit, secure)
+			return true
+		}
+		if _, ok := r.applied(unit); !ok {
+			r.transition(unit, StateRestarting, "starting")
+			if err := r.waitForPrerequisites(ctx, unit, name); err != nil {
+				r.fail(unit, SystemdError, "error while starting unit %q: %s", unit, err)
+				return false
+			}
+		}
+		changed, err := r.Systemd.EnsureRunning(ctx, unit)
+		if err != nil {
+			r.fail(unit, SystemdError, "error while ensuring unit %q is running: %s", unit, err)
+			return false
+		}
+		if changed {
+			log.Printf("started unit: %s", unit)
+			r.recordChange(unit, "started")
+		}
+		secure := r.checkSecurity(ctx, unit, config)
+		r.setApplied(unit, config, source)
+		r.joinGroup(unit)
+		r.healthy(unit, secure)
+		return true
+	}
+
+	// Restart units when their last configuration doesn't match the current one
+	if applied, _ := r.applied(unit); config != applied {
+		if r.deferFrozen(unit, false) {
+			return true
+		}
+		if !r.placeUnit(ctx, unit, name) {
+			return false
+		}
+		if r.takeCancelled(unit) {
+			log.Printf("not restarting unit %s since its queued restart was cancelled, the change takes effect when it's restarted next", unit)
+		} else if err := r.restartUnit(ctx, unit, name, previous); err != nil {
+			r.fail(unit, SystemdError, "error while restarting unit %q: %s", unit, err)
+			return false
+		}
+		if r.Stability != nil {
+			r.Stability.expect(unit)
+		}
+		r.flagReboot(unit, name)
+		secure := r.checkSecurity(ctx, unit, config)
+		r.setApplied(unit, config, source)
+		r.joinGroup(unit)
+		r.healthy(unit, secure)
+	} else {
+		r.setApplied(unit, config, source) // the file changed in ways Normalize ignores, e.g. comments
+	}
+	return true
+}
+
+// tooLarge returns true for files exceeding MaxSize, which are skipped rather than hashed and copied
+// since they're unlikely to be units, e.g. payloads that happen to be stored next to them.
+func (r *Reconciler) tooLarge(unit, name string) bool {
+	if r.MaxSize <= 0 {
+		return false
+	}
+	stat, err := os.Stat(name)
+	if err != nil || stat.Size() <= r.MaxSize {
+		return false
+	}
+	log.Printf("skipping %s since its %d bytes exceed the maximum unit file size", unit, stat.Size())
+	return true
+}
+
+// syncMode makes sure the permissions of the applied unit file match the source,
+// since units may reference credentials that should only be readable by some users.
+func (r *Reconciler) syncMode(unit, name string) bool {
+	stat, err := os.Stat(name)
+	if err != nil {
+		r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+		return false
+	}
+
+	current, err := r.target().Mode(unit)
+	if err != nil {
+		r.fail(unit, CopyError, "error reading current unit file %q: %s", unit, err)
+		return false
+	}
+	if current == stat.Mode().Perm() {
+		return true
+	}
+
+	if err := r.target().Chmod(unit, stat.Mode().Perm()); err != nil {
+		r.fail(unit, CopyError, "error while updating permissions of unit file %q: %s", unit, err)
+		return false
+	}
+	log.Printf("updated permissions of unit: %s", unit)
+	r.recordChange(unit, "updated permissions")
+	return true
+}
+
+func (r *Reconciler) removeUnit(ctx context.Context, unit string) bool {
+	if owner := r.aliasOf(unit); owner != "" {
+		// stopping or removing it would stop the unit it aliases or remove the alias' link
+		log.Printf("forgetting unit %s without removing it since it's now an alias of %s", unit, owner)
+		r.mu.Lock()
+		delete(r.State, unit)
+		r.mu.Unlock()
+		return true
+	}
+	if !r.stopActivators(ctx, unit) || !r.stopUnit(ctx, unit) {
+		return false
+	}
+
+	if err := r.linkAliases(unit, nil); err != nil {
+		r.fail(unit, CopyError, "error while removing unit %q: %s", unit, err)
+		return false
+	}
+	if err := r.target().Remove(unit); err != nil {
+		r.fail(unit, CopyError, "error while removing unit %q: %s", unit, err)
+		return false
+	}
+	log.Printf("removed unit: %s", unit)
+	r.recordChange(unit, "removed")
+	r.leaveGroup(unit)
+	if err := r.unlinkDependencies(unit); err != nil {
+		log.Printf("error while removing the .wants and .requires links of removed unit %q: %s", unit, err)
+	}
+
+	if forgetter, ok := r.Systemd.(Forgetter); ok {
+		if err := forgetter.Forget(ctx, unit); err != nil {
+			log.Printf("error while resetting the failed state of removed unit %q: %s", unit, err)
+		}
+	}
+
+	if r.Stability != nil {
+		r.Stability.forget(unit)
+	}
+	if r.Durations != nil {
+		r.Durations.forget(unit)
+	}
+
+	r.mu.Lock()
+	delete(r.State, unit)
+	r.dequeue("restart", unit)
+	r.dequeue("reboot", unit)
+	if r.Security != nil {
+		delete(r.Security.Scores, unit)
+		delete(r.Security.Rejected, unit)
+	}
+	delete(r.lint, unit)
+	delete(r.sources, unit)
+	r.mu.Unlock()
+	r.transition(unit, StateRemoved, "")
+	return true
+}
+
+// StopAll stops every applied unit without removing its unit file, so it's started again by the next sync.
+func (r *Reconciler) StopAll(ctx context.Context) bool {
+	r.mu.Lock()
+	units := make([]string, 0, len(r.State))
+	for unit := range r.State {
+		units = append(units, unit)
+	}
+	r.mu.Unlock()
+	sort.Strings(units)
+
+	defer r.commitGeneration(r.Changes())
+	return r.each(ctx, units, r.stopUnit)
+}
+
+func (r *Reconciler) stopUnit(ctx context.Context, unit string) bool {
+	changed, err := r.Systemd.EnsureStopped(ctx, unit)
+	if err != nil {
+		r.fail(unit, SystemdError, "error while stopping unit %q: %s", unit, err)
+		return false
+	}
+	if changed {
+		log.Printf("stopped unit: %s", unit)
+		r.recordChange(unit, "stopped")
+	}
+	return true
+}
+
+// Changes returns the number of modifications made to units so far.
+func (r *Reconciler) Changes() int {
+	return int(atomic.LoadInt32(&r.changes))
+}
+
+// UnitAction is a modification made to a unit or its file.
+type UnitAction struct {
+	Action     string    `json:"action"` // e.g. wrote, started, restarted, or removed
+	Time       time.Time `json:"time"`
+	Generation int64     `json:"generation,omitempty"` // of the change set the modification belongs to
+}
+
+func (r *Reconciler) recordChange(unit, action string) {
+	atomic.AddInt32(&r.changes, 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.touched == nil {
+		r.touched = map[string]*UnitAction{}
+	}
+	r.touched[unit] = &UnitAction{Action: action, Time: time.Now().UTC(), Generation: r.generation + 1} // committed once the pass completes
+}
+
+// Touched returns when a unit or its file was last modified by this reconciler, if ever.
+func (r *Reconciler) Touched(unit string) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if action, ok := r.touched[unit]; ok {
+		return action.Time, true
+	}
+	return time.Time{}, false
+}
+
+// Manages returns true if the unit has been applied.
+func (r *Reconciler) Manages(unit string) bool {
+	_, ok := r.applied(unit)
+	return ok
+}
+
+// ReadApplied returns the content of a unit file as it was applied to Dest or Target.
+func (r *Reconciler) ReadApplied(unit string) ([]byte, error) {
+	return r.target().Read(unit)
+}
+
+// applied returns the checksum of the unit's last applied configuration.
+func (r *Reconciler) applied(unit string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	checksum, ok := r.State[unit]
+	return checksum, ok
+}
+
+// setApplied records the applied configuration of a unit, and the checksum of its source file too when the
+// configuration's checksum differs from it, i.e. with Normalize, Sanitize, or Portable.
+func (r *Reconciler) setApplied(unit, checksum, source string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.State[unit] = checksum
+	if r.Normalize || r.converted() {
+		if r.sources == nil {
+			r.sources = map[string]string{}
+		}
+		r.sources[unit] = source
+	}
+}
+
+func (r *Reconciler) target() Destination {
+	if r.Target != nil {
+		return r.Target
+	}
+	return &LocalDir{Dir: r.Dest, Cache: r.Cache, Hasher: r.Hasher}
+}
+
+func (r *Reconciler) checksum(name string) (string, error) {
+	if r.Cache != nil {
+		return r.Cache.Checksum(name)
+	}
+	return HashFile(r.Hasher, name)
+}
+
+// Validate returns the lint findings and policy violations of a unit file in Src, regardless of the lint mode.
+func (r *Reconciler) Validate(unit string) ([]string, error) {
+	file, err := os.Open(path.Join(r.Src, unit))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to parse: %s", err)}, nil
+	}
+
+	var problems []string
+	if _, err := ParsePrerequisites(parsed); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if content, err := ioutil.ReadFile(path.Join(r.Src, unit)); err == nil {
+		if r.converted() {
+			content = ConvertLineEndings(content) // only report what isn't converted
+		}
+		for _, artifact := range Artifacts(content) {
+			problems = append(problems, "authoring artifact: "+artifact)
+		}
+	}
+	if r.Linter != nil {
+		for _, finding := range r.Linter.Lint(unit, parsed) {
+			problems = append(problems, "lint error "+finding.String())
+		}
+	}
+	if r.Policy != nil {
+		for _, v := range r.Policy.Evaluate(unit, parsed) {
+			problems = append(problems, "policy violation "+v.String())
+		}
+	}
+	return problems, nil
+}
+
+// admit runs the configured policy and linter against a unit file that is about to be applied.
+func (r *Reconciler) admit(unit, name string) bool {
+	if r.Policy == nil && r.Linter == nil {
+		return true
+	}
+	blocking := r.Policy != nil || r.Linter.Strict
+
+	file, err := os.Open(name)
+	if err != nil {
+		r.fail(unit, SourceError, "error reading unit file %q: %s", unit, err)
+		return false
+	}
+	defer file.Close()
+
+	parsed, err := ParseUnitFile(file)
+	if err != nil {
+		if !blocking {
+			log.Printf("lint warning for unit %q: unable to parse: %s", unit, err)
+			return true
+		}
+		log.Printf("rejected unit %q: unable to parse: %s", unit, err)
+		return false
+	}
+
+	ok := true
+	if r.Linter != nil {
+		findings := r.Linter.Lint(unit, parsed)
+		for _, finding := range findings {
+			if r.Linter.Strict {
+				log.Printf("rejected unit %q: lint error %s", unit, r.Redact.String(finding.String()))
+				ok = false
+				continue
+			}
+			log.Printf("lint warning for unit %q: %s", unit, r.Redact.String(finding.String()))
+		}
+		r.mu.Lock()
+		if r.lint == nil {
+			r.lint = map[string]int{}
+		}
+		r.lint[unit] = len(findings)
+		r.mu.Unlock()
+	}
+	if r.Policy != nil {
+		for _, v := range r.Policy.Evaluate(unit, parsed) {
+			log.Printf("rejected unit %q: policy violation %s", unit, r.Redact.String(v.String()))
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,391 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	t.Run("zero units", func(t *testing.T) {
+		assert.True(t, r.Sync(context.Background()))
+	})
+
+	t.Run("create unit", func(t *testing.T) {
+		err := ioutil.WriteFile(path.Join(src, "test1.service"), []byte("test1"), 0644)
+		require.NoError(t, err)
+
+		assert.True(t, r.Sync(context.Background()))
+		assert.FileExists(t, path.Join(dest, "test1.service"))
+		assert.Equal(t, "EnsureRunning test1.service", sysd.LastCmd)
+	})
+
+	t.Run("sync unit no change", func(t *testing.T) {
+		assert.True(t, r.Sync(context.Background()))
+		assert.FileExists(t, path.Join(dest, "test1.service"))
+	})
+
+	t.Run("change unit", func(t *testing.T) {
+		err := ioutil.WriteFile(path.Join(src, "test1.service"), []byte("test2"), 0644)
+		require.NoError(t, err)
+
+		assert.True(t, r.Sync(context.Background()))
+		assert.FileExists(t, path.Join(dest, "test1.service"))
+		assert.Equal(t, "Restart test1.service", sysd.LastCmd)
+	})
+
+	t.Run("change unit permissions", func(t *testing.T) {
+		err := os.Chmod(path.Join(src, "test1.service"), 0600)
+		require.NoError(t, err)
+
+		assert.True(t, r.Sync(context.Background()))
+		stat, err := os.Stat(path.Join(dest, "test1.service"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	})
+
+	t.Run("unit rejected by policy", func(t *testing.T) {
+		r.Policy = &Policy{Rules: []*policyRule{{Name: "test", Section: "Service", Key: "User", Require: true}}}
+		defer func() { r.Policy = nil }()
+
+		err := ioutil.WriteFile(path.Join(src, "test2.service"), []byte("[Service]\nExecStart=/bin/true\n"), 0644)
+		require.NoError(t, err)
+		defer os.Remove(path.Join(src, "test2.service"))
+
+		assert.False(t, r.Sync(context.Background()))
+		assert.Equal(t, []ErrorClass{ValidationError}, r.Classes())
+		assert.NoFileExists(t, path.Join(dest, "test2.service"))
+	})
+
+	t.Run("applied unit rejected by a new policy", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, "test3.service"), []byte("[Service]\nExecStart=/bin/true\n"), 0644))
+		require.True(t, r.Sync(context.Background()))
+		defer func() {
+			require.NoError(t, os.Remove(path.Join(src, "test3.service")))
+			require.True(t, r.Sync(context.Background()))
+		}()
+
+		sysd.Cmds = nil
+		r.Policy = &Policy{Rules: []*policyRule{{Name: "test", Section: "Service", Key: "User", Require: true}}}
+		defer func() { r.Policy = nil }()
+		assert.False(t, r.Sync(context.Background()))
+		assert.Equal(t, []ErrorClass{ValidationError}, r.Classes())
+		assert.Equal(t, StateQuarantined, r.States()["test3.service"].State)
+		assert.FileExists(t, path.Join(dest, "test3.service"))
+		assert.Empty(t, sysd.Cmds, "applied units keep running")
+	})
+
+	t.Run("unit rejected by strict linter", func(t *testing.T) {
+		r.Linter = &Linter{Strict: true}
+		defer func() { r.Linter = nil }()
+
+		err := ioutil.WriteFile(path.Join(src, "test2.service"), []byte("[Service]\nExecStart=/bin/true\n"), 0644)
+		require.NoError(t, err)
+		defer os.Remove(path.Join(src, "test2.service"))
+
+		assert.False(t, r.Sync(context.Background()))
+		assert.Equal(t, []ErrorClass{ValidationError}, r.Classes())
+		assert.NoFileExists(t, path.Join(dest, "test2.service"))
+	})
+
+	t.Run("remove unit", func(t *testing.T) {
+		err := os.Remove(path.Join(src, "test1.service"))
+		require.NoError(t, err)
+
+		assert.True(t, r.Sync(context.Background()))
+		assert.NoFileExists(t, path.Join(dest, "test1.service"))
+		assert.Equal(t, "EnsureStopped test1.service", sysd.LastCmd)
+	})
+}
+
+func TestSyncForgetsRemovedUnits(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &forgettingSystemd{fakeSystemd: &fakeSystemd{}}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	sysd.Cmds = nil
+	require.NoError(t, os.Remove(path.Join(src, "test.service")))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureStopped test.service", "Forget test.service"}, sysd.Cmds)
+
+	// Failing to reset the failed state doesn't fail the removal
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "other.service"), []byte("test"), 0644))
+	r.State["other.service"] = "abc"
+	sysd.forgetErr = errors.New("oops")
+	assert.True(t, r.Sync(context.Background()))
+	assert.NoFileExists(t, path.Join(dest, "other.service"))
+}
+
+func TestTouched(t *testing.T) {
+	src := t.TempDir()
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: &fakeSystemd{}}
+
+	_, ok := r.Touched("test.service")
+	assert.False(t, ok)
+	assert.False(t, r.Manages("test.service"))
+
+	start := time.Now()
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	touched, ok := r.Touched("test.service")
+	assert.True(t, ok)
+	assert.False(t, touched.Before(start))
+	assert.True(t, r.Manages("test.service"))
+	assert.Equal(t, "wrote", r.Report(true).Actions["test.service"].Action)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test2"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, "restarted", r.Report(true).Actions["test.service"].Action)
+}
+
+func TestSyncChanged(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test1.service"), []byte("test1"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test2.service"), []byte("test2"), 0644))
+
+	t.Run("changed unit", func(t *testing.T) {
+		assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "test1.service"), path.Join(src, ".test2.service.swp"), "/elsewhere/test2.service"}))
+		assert.Equal(t, []string{"EnsureRunning test1.service"}, sysd.Cmds)
+		assert.FileExists(t, path.Join(dest, "test1.service"))
+		assert.NoFileExists(t, path.Join(dest, "test2.service"))
+	})
+
+	t.Run("removed unit", func(t *testing.T) {
+		sysd.Cmds = nil
+		require.NoError(t, os.Remove(path.Join(src, "test1.service")))
+
+		assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "test1.service")}))
+		assert.Equal(t, []string{"EnsureStopped test1.service"}, sysd.Cmds)
+		assert.NoFileExists(t, path.Join(dest, "test1.service"))
+	})
+
+	t.Run("src changed", func(t *testing.T) {
+		sysd.Cmds = nil
+		assert.True(t, r.SyncChanged(context.Background(), []string{src}))
+		assert.Equal(t, []string{"EnsureRunning test2.service"}, sysd.Cmds)
+	})
+}
+
+func TestSyncIgnore(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, IgnoreFile), []byte("*.md\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "README.md"), []byte("docs"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"+TemplateSuffix), []byte("{{.Host}}"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning test.service"}, sysd.Cmds)
+	assert.NoFileExists(t, path.Join(dest, "README.md"))
+	assert.NoFileExists(t, path.Join(dest, "test.service"+TemplateSuffix))
+
+	sysd.Cmds = nil
+	assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, "README.md")}))
+	assert.Empty(t, sysd.Cmds)
+
+	// Units that become ignored are no longer managed
+	require.NoError(t, ioutil.WriteFile(path.Join(src, IgnoreFile), []byte("*.md\ntest.*\n"), 0644))
+	assert.True(t, r.SyncChanged(context.Background(), []string{path.Join(src, IgnoreFile)}))
+	assert.Equal(t, []string{"EnsureStopped test.service"}, sysd.Cmds)
+	assert.NoFileExists(t, path.Join(dest, "test.service"))
+
+	// Unit files can opt out themselves
+	sysd.Cmds = nil
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "draft.service"), []byte("[Service]\nExecStart=/bin/draft\n\n[X-Unitmgr]\nIgnore=yes\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+	assert.NoFileExists(t, path.Join(dest, "draft.service"))
+}
+
+func TestSyncMaxSize(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd, MaxSize: 8}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "payload.bin"), []byte("too large to be a unit"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning test.service"}, sysd.Cmds)
+	assert.NoFileExists(t, path.Join(dest, "payload.bin"))
+
+	changes, err := r.Plan()
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestSyncNormalize(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd, Normalize: true}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("[Service]\nExecStart=/bin/foo\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"EnsureRunning test.service"}, sysd.Cmds)
+
+	// Cosmetic changes are written without restarting the unit
+	sysd.Cmds = nil
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("# the foo service\n[Service]\nExecStart = /bin/foo\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+	current, err := ioutil.ReadFile(path.Join(dest, "test.service"))
+	require.NoError(t, err)
+	assert.Contains(t, string(current), "# the foo service")
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("[Service]\nExecStart=/bin/bar\n"), 0644))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Restart test.service"}, sysd.Cmds)
+}
+
+func TestSyncWorkers(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{Errs: map[string]error{"test3.service": errors.New("oops")}}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd, Cache: NewChecksumCache(), Workers: 3}
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("test%d.service", i)
+		require.NoError(t, ioutil.WriteFile(path.Join(src, name), []byte(name), 0644))
+	}
+
+	assert.False(t, r.Sync(context.Background()))
+	assert.Len(t, r.State, 9)
+	assert.Len(t, r.Failures, 1)
+	assert.Contains(t, r.Failures, "test3.service")
+
+	sort.Strings(sysd.Cmds)
+	assert.Len(t, sysd.Cmds, 10)
+	assert.Equal(t, "EnsureRunning test0.service", sysd.Cmds[0])
+}
+
+func TestSyncWorkersCancel(t *testing.T) {
+	r := &Reconciler{Workers: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var synced []string
+	units := []string{"a.service", "b.service", "c.service", "d.service", "e.service", "f.service"}
+	ok := r.each(ctx, units, func(work context.Context, unit string) bool {
+		mu.Lock()
+		synced = append(synced, unit)
+		mu.Unlock()
+		cancel()
+		assert.NoError(t, work.Err(), "units in flight aren't canceled")
+		return false
+	})
+	assert.False(t, ok)
+	assert.Less(t, len(synced), len(units), "no units are queued once the context is canceled")
+
+	// Without workers
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	synced = nil
+	r.Workers = 0
+	ok = r.each(ctx, units, func(work context.Context, unit string) bool {
+		synced = append(synced, unit)
+		cancel()
+		assert.NoError(t, work.Err())
+		return true
+	})
+	assert.False(t, ok)
+	assert.Equal(t, []string{"a.service"}, synced)
+}
+
+func TestStopAll(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+
+	for _, name := range []string{"a.service", "b.service"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, name), []byte(name), 0644))
+	}
+	require.True(t, r.Sync(context.Background()))
+
+	sysd.Cmds = nil
+	assert.True(t, r.StopAll(context.Background()))
+	assert.Equal(t, []string{"EnsureStopped a.service", "EnsureStopped b.service"}, sysd.Cmds)
+
+	// Unit files and state are kept so the units start again on the next run
+	assert.FileExists(t, path.Join(dest, "a.service"))
+	assert.Len(t, r.State, 2)
+}
+
+type fakeSystemd struct {
+	mu      sync.Mutex
+	LastCmd string
+	Cmds    []string
+	Errs    map[string]error // unit -> error returned by every operation
+	Active  map[string]bool
+}
+
+func (f *fakeSystemd) record(cmd, unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.LastCmd = cmd + " " + unit
+	f.Cmds = append(f.Cmds, f.LastCmd)
+	return f.Errs[unit]
+}
+
+func (f *fakeSystemd) Restart(ctx context.Context, unit string) error {
+	return f.record("Restart", unit)
+}
+
+func (f *fakeSystemd) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	return false, f.record("EnsureRunning", unit)
+}
+
+func (f *fakeSystemd) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	return false, f.record("EnsureStopped", unit)
+}
+
+func (f *fakeSystemd) Reload(ctx context.Context, unit string) error {
+	return f.record("Reload", unit)
+}
+
+func (f *fakeSystemd) Reenable(ctx context.Context, unit string) error {
+	return f.record("Reenable", unit)
+}
+
+func (f *fakeSystemd) IsActive(ctx context.Context, unit string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Active[unit], nil
+}
+
+type forgettingSystemd struct {
+	*fakeSystemd
+	forgetErr error
+}
+
+func (f *forgettingSystemd) Forget(ctx context.Context, unit string) error {
+	f.record("Forget", unit)
+	return f.forgetErr
+}
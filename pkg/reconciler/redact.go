@@ -0,0 +1,108 @@
+package reconciler
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// DefaultRedactPattern matches the names of environment variables, directives, and options whose values are secrets.
+const DefaultRedactPattern = `(?i)pass(word|wd)?|secret|token|credential|api_?key|private_?key`
+
+// Redacted replaces the values of secrets.
+const Redacted = "<redacted>"
+
+// assignmentPattern matches name=value assignments in unit file content, e.g. Environment=DB_PASSWORD=hunter2 or
+// --token=abc in an ExecStart= command line. Quoted values are matched whole.
+var assignmentPattern = regexp.MustCompile(`([A-Za-z0-9_.-]+)=("[^"]*"|'[^']*'|[^\s"']+)`)
+
+// Redactor masks the values of secrets in unit file content before it's shown in diffs, logs, failures, and reports,
+// so the observability surface doesn't leak what the unit files hold. A nil Redactor leaves content as is.
+type Redactor struct {
+	Names *regexp.Regexp // of the assignments whose values are redacted
+}
+
+// NewRedactor returns a Redactor of the assignments whose names match pattern, or nil if pattern is empty.
+func NewRedactor(pattern string) (*Redactor, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	names, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction pattern: %w", err)
+	}
+	return &Redactor{Names: names}, nil
+}
+
+// String returns s with the values of secret assignments replaced by Redacted. The values of other assignments are
+// redacted recursively, e.g. the secret variables of Environment="A=1 DB_PASSWORD=hunter2". Assignments quoted as
+// a whole, like "DB_PASSWORD=hunter2 hunter3", are redacted up to the closing quote.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range assignmentPattern.FindAllStringSubmatchIndex(s, -1) {
+		if m[0] < last {
+			continue // within the quoted value of a redacted assignment
+		}
+		name, value, end := s[m[2]:m[3]], s[m[4]:m[5]], m[1]
+		b.WriteString(s[last:m[0]])
+		switch {
+		case r.Names.MatchString(name):
+			if m[0] > 0 && (s[m[0]-1] == '"' || s[m[0]-1] == '\'') {
+				if i := strings.IndexByte(s[m[4]:], s[m[0]-1]); i >= 0 {
+					end = m[4] + i
+				}
+			}
+			b.WriteString(name + "=" + Redacted)
+		case len(value) >= 2 && (value[0] == '"' || value[0] == '\''):
+			inner := value[1 : len(value)-1]
+			if n := assignmentPattern.FindStringSubmatchIndex(inner); n != nil && n[0] == 0 && r.Names.MatchString(inner[n[2]:n[3]]) {
+				inner = inner[n[2]:n[3]] + "=" + Redacted // the quoted value is a single secret assignment
+			} else {
+				inner = r.String(inner)
+			}
+			b.WriteString(name + "=" + value[:1] + inner + value[:1])
+		default:
+			b.WriteString(name + "=" + r.String(value))
+		}
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Lines redacts every line, e.g. of a diff.
+func (r *Redactor) Lines(lines []string) []string {
+	if r == nil {
+		return lines
+	}
+	redacted := make([]string, len(lines))
+	for i, line := range lines {
+		redacted[i] = r.String(line)
+	}
+	return redacted
+}
+
+// Writer returns a writer redacting what's written to w, e.g. by the log package, which writes a line at a time.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return &redactWriter{Redactor: r, w: w}
+}
+
+type redactWriter struct {
+	*Redactor
+	w io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package reconciler
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(DefaultRedactPattern)
+	require.NoError(t, err)
+
+	for in, expected := range map[string]string{
+		"Environment=DB_PASSWORD=hunter2":                       "Environment=DB_PASSWORD=<redacted>",
+		`Environment="A=1" "API_KEY=abc def"`:                   `Environment="A=1" "API_KEY=<redacted>"`,
+		`Environment="A=1 GITHUB_TOKEN=ghp_x"`:                  `Environment="A=1 GITHUB_TOKEN=<redacted>"`,
+		"ExecStart=/bin/app --token=abc --port=80":              "ExecStart=/bin/app --token=<redacted> --port=80",
+		"SetCredential=db:hunter2":                              "SetCredential=<redacted>",
+		"+Environment=SECRET=x":                                 "+Environment=SECRET=<redacted>",
+		`policy: Environment=PASSWD=x is not allowed`:           `policy: Environment=PASSWD=<redacted> is not allowed`,
+		"ExecStart=/bin/app":                                    "ExecStart=/bin/app",
+		"Description=Rotates the tokens":                        "Description=Rotates the tokens",
+		"Environment=\"PRIVATE_KEY=-----BEGIN KEY-----\" FOO=1": "Environment=\"PRIVATE_KEY=<redacted>\" FOO=1",
+	} {
+		assert.Equal(t, expected, r.String(in), in)
+	}
+	assert.Equal(t, []string{"-Environment=TOKEN=<redacted>", "+Environment=TOKEN=<redacted>"}, r.Lines([]string{"-Environment=TOKEN=a", "+Environment=TOKEN=b"}))
+
+	var nilRedactor *Redactor
+	assert.Equal(t, "Environment=DB_PASSWORD=hunter2", nilRedactor.String("Environment=DB_PASSWORD=hunter2"))
+	r, err = NewRedactor("")
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	_, err = NewRedactor("(")
+	assert.Error(t, err)
+}
+
+func TestRedactorWriter(t *testing.T) {
+	r, err := NewRedactor("(?i)password")
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	logger := log.New(r.Writer(buf), "", 0)
+	logger.Printf("error while restarting unit: Environment=PASSWORD=hunter2")
+	assert.Equal(t, "error while restarting unit: Environment=PASSWORD=<redacted>\n", buf.String())
+}
+
+func TestReconcilerRedactsFailures(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactPattern)
+	require.NoError(t, err)
+	r := &Reconciler{Redact: redactor}
+	r.fail("a.service", ValidationError, "invalid line %q", "Environment=API_TOKEN=abc")
+	assert.Equal(t, `invalid line "Environment=API_TOKEN=<redacted>"`, r.Failures["a.service"])
+}
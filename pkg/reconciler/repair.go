@@ -0,0 +1,138 @@
+package reconciler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StateProblem is an entry of a state file that could cause the wrong units to be stopped, removed, or restarted.
+type StateProblem struct {
+	Src     string `json:"src,omitempty"`
+	Unit    string `json:"unit,omitempty"`
+	Problem string `json:"problem"` // corrupt, unsupported-version, unknown-source, invalid-unit, invalid-checksum, or tombstone
+	Detail  string `json:"detail"`
+}
+
+// StateCheck is the result of checking a state file against the reconcilers it's loaded into.
+type StateCheck struct {
+	Path     string          `json:"path"`
+	Version  int             `json:"version"` // of the file's schema, zero if it doesn't exist or can't be decoded
+	Units    int             `json:"units"`   // recorded for the reconcilers
+	Problems []*StateProblem `json:"problems"`
+}
+
+// Check reports the problems of the state file without changing it or the reconcilers.
+func (s *StateStore) Check(reconcilers []*Reconciler) *StateCheck {
+	check := &StateCheck{Path: s.Path, Problems: []*StateProblem{}}
+	file, _, _, err := s.read()
+	if err != nil {
+		check.Problems = append(check.Problems, &StateProblem{Problem: "corrupt", Detail: err.Error()})
+		return check
+	}
+	if file == nil {
+		return check
+	}
+	check.Version = file.Version
+	if file.Version > StateVersion {
+		check.Problems = append(check.Problems, &StateProblem{Problem: "unsupported-version", Detail: fmt.Sprintf("schema version %d is newer than the supported %d", file.Version, StateVersion)})
+		return check
+	}
+	algorithm := file.Algorithm
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	hasher, ok := Hashers[algorithm]
+	if !ok {
+		check.Problems = append(check.Problems, &StateProblem{Problem: "corrupt", Detail: fmt.Sprintf("unknown checksum algorithm %q", algorithm)})
+		return check
+	}
+
+	configured := map[string]*Reconciler{}
+	for _, r := range reconcilers {
+		configured[r.Src] = r
+	}
+	s.tombstones = map[string]map[string]time.Time{}
+	for src, units := range file.Units {
+		r, ok := configured[src]
+		if !ok {
+			check.Problems = append(check.Problems, &StateProblem{Src: src, Problem: "unknown-source", Detail: fmt.Sprintf("%d units are recorded for a source that isn't configured", len(units))})
+			continue
+		}
+		check.Units += len(units)
+		for unit, checksum := range units {
+			if problem := s.checkEntry(file, r, hasher, unit, checksum); problem != nil {
+				problem.Src, problem.Unit = src, unit
+				check.Problems = append(check.Problems, problem)
+			}
+		}
+	}
+	sort.Slice(check.Problems, func(i, j int) bool {
+		a, b := check.Problems[i], check.Problems[j]
+		if a.Src != b.Src {
+			return a.Src < b.Src
+		}
+		return a.Unit < b.Unit
+	})
+	return check
+}
+
+func (s *StateStore) checkEntry(file *stateFile, r *Reconciler, hasher Hasher, unit, checksum string) *StateProblem {
+	if unit == "" || strings.Contains(unit, "/") || strings.HasPrefix(unit, ".") {
+		return &StateProblem{Problem: "invalid-unit", Detail: "not the name of a unit file"}
+	}
+	if raw, err := hex.DecodeString(checksum); err != nil || len(raw) != hasher.New().Size() {
+		return &StateProblem{Problem: "invalid-checksum", Detail: fmt.Sprintf("%q isn't a %s checksum, the unit would be restarted", checksum, hasher.Name())}
+	}
+	since, ok := s.tombstone(file, r, unit)
+	if !ok {
+		return nil
+	}
+	age := s.now().Sub(since).Truncate(time.Second)
+	if s.TombstoneTTL > 0 && age > s.TombstoneTTL {
+		return &StateProblem{Problem: "tombstone", Detail: fmt.Sprintf("removed from src %s ago, it's forgotten rather than removed", age)}
+	}
+	return &StateProblem{Problem: "tombstone", Detail: fmt.Sprintf("removed from src %s ago, the next sync stops and removes it", age)}
+}
+
+// Repair rewrites the state file without the problems found by Check, returning them. Entries of sources that
+// aren't configured and invalid entries are dropped, as are expired tombstones or, when compacting, every tombstone,
+// so those units are forgotten rather than removed. Files that can't be decoded or were written by a newer version
+// are moved aside to a .bak file and replaced by an empty state, which removes nothing.
+func (s *StateStore) Repair(reconcilers []*Reconciler, compact bool) (*StateCheck, error) {
+	check := s.Check(reconcilers)
+	if check.Version == 0 && len(check.Problems) == 0 {
+		return check, nil // there's no state file
+	}
+	for _, problem := range check.Problems {
+		if problem.Problem != "corrupt" && problem.Problem != "unsupported-version" {
+			continue
+		}
+		if err := os.Rename(s.Path, s.Path+".bak"); err != nil {
+			return nil, err
+		}
+		log.Printf("moved state file %s aside to %s.bak: %s", s.Path, s.Path, problem.Detail)
+		s.last, s.tombstones = nil, nil
+		return check, s.Save(reconcilers)
+	}
+
+	if err := s.Load(reconcilers); err != nil {
+		return nil, err
+	}
+	for _, problem := range check.Problems {
+		if problem.Unit == "" || (problem.Problem == "tombstone" && !compact) {
+			continue
+		}
+		for _, r := range reconcilers {
+			if r.Src == problem.Src {
+				delete(r.State, problem.Unit)
+			}
+		}
+	}
+	s.last = nil
+	return check, s.Save(reconcilers)
+}
@@ -0,0 +1,76 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStoreCheck(t *testing.T) {
+	src := t.TempDir()
+	name := path.Join(t.TempDir(), "state.json")
+	valid := strings.Repeat("ab", 32)
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"version": 2, "units": {
+		"`+src+`": {"a.service": "`+valid+`", "b.service": "abc", "gone.service": "`+valid+`"},
+		"/old": {"c.service": "`+valid+`"}
+	}, "tombstones": {"`+src+`": {"gone.service": "2021-01-01T00:00:00Z"}}}`), 0644))
+	now := time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)
+	store := &StateStore{Path: name, clock: func() time.Time { return now }}
+	r := &Reconciler{Src: src, State: map[string]string{}}
+
+	check := store.Check([]*Reconciler{r})
+	assert.Equal(t, 2, check.Version)
+	assert.Equal(t, 3, check.Units)
+	assert.Equal(t, []*StateProblem{
+		{Src: "/old", Problem: "unknown-source", Detail: "1 units are recorded for a source that isn't configured"},
+		{Src: src, Unit: "b.service", Problem: "invalid-checksum", Detail: `"abc" isn't a sha256 checksum, the unit would be restarted`},
+		{Src: src, Unit: "gone.service", Problem: "tombstone", Detail: "removed from src 48h0m0s ago, the next sync stops and removes it"},
+	}, check.Problems)
+	assert.Empty(t, r.State, "checks don't load the state")
+
+	// Repairs drop the invalid entries and unknown sources, but keep tombstones
+	_, err := store.Repair([]*Reconciler{r}, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a.service": valid, "gone.service": valid}, r.State)
+	check = (&StateStore{Path: name, clock: func() time.Time { return now }}).Check([]*Reconciler{r})
+	assert.Len(t, check.Problems, 1)
+	assert.Equal(t, "tombstone", check.Problems[0].Problem)
+
+	// Compacting also drops tombstones
+	r = &Reconciler{Src: src, State: map[string]string{}}
+	_, err = (&StateStore{Path: name}).Repair([]*Reconciler{r}, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a.service": valid}, r.State)
+	assert.Empty(t, (&StateStore{Path: name}).Check([]*Reconciler{r}).Problems)
+}
+
+func TestStateStoreRepairCorrupt(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, ioutil.WriteFile(name, []byte("{not json"), 0644))
+	r := &Reconciler{Src: "/units", State: map[string]string{}}
+
+	check, err := (&StateStore{Path: name}).Repair([]*Reconciler{r}, false)
+	require.NoError(t, err)
+	require.Len(t, check.Problems, 1)
+	assert.Equal(t, "corrupt", check.Problems[0].Problem)
+	backup, err := ioutil.ReadFile(name + ".bak")
+	require.NoError(t, err)
+	assert.Equal(t, "{not json", string(backup))
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{r}))
+	assert.Empty(t, r.State)
+
+	// There's nothing to repair without a state file
+	missing := path.Join(t.TempDir(), "state.json")
+	_, err = (&StateStore{Path: missing}).Repair([]*Reconciler{r}, false)
+	require.NoError(t, err)
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+}
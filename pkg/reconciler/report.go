@@ -0,0 +1,130 @@
+package reconciler
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// HostReport describes the state of a host's reconciliation.
+type HostReport struct {
+	Host       string                       `json:"host"`
+	Src        string                       `json:"src,omitempty"`
+	Units      map[string]string            `json:"units"` // unit -> checksum of the applied configuration
+	LastSync   time.Time                    `json:"lastSync"`
+	OK         bool                         `json:"ok"`
+	Failures   map[string]string            `json:"failures,omitempty"`         // unit -> most recent error
+	Sources    map[string]string            `json:"sources,omitempty"`          // unit -> checksum of the applied source file, if Units are normalized or converted
+	Pending    []*Change                    `json:"pending,omitempty"`          // changes that weren't made in audit mode
+	Reboot     []string                     `json:"rebootRequired,omitempty"`   // units whose applied changes require a reboot
+	Deferred   map[string]string            `json:"deferred,omitempty"`         // unit -> why its restart is waiting for headroom or the end of a change freeze
+	Freeze     string                       `json:"freeze,omitempty"`           // why changes are frozen, if they are
+	Stability  map[string]*UnitStability    `json:"stability,omitempty"`        // unit -> recent restarts, if tracked
+	Durations  map[string]*RestartDurations `json:"restartDurations,omitempty"` // unit -> how long its restarts took, if tracked
+	Actions    map[string]*UnitAction       `json:"actions,omitempty"`          // unit -> last modification made by this instance
+	Generation int64                        `json:"generation,omitempty"`       // of the most recently applied change set
+	States     map[string]*UnitStatus       `json:"states,omitempty"`           // unit -> its current state
+	Classes    map[string]ErrorClass        `json:"failureClasses,omitempty"`   // unit -> class of its failure
+	Errors     map[ErrorClass]int64         `json:"errors,omitempty"`           // failures of each class since unitmgr started
+	Lint       map[string]int               `json:"lintFindings,omitempty"`     // unit -> number of lint findings, if linted
+	Security   map[string]float64           `json:"securityExposure,omitempty"` // unit -> systemd-analyze security exposure score, if scored
+	Assignment string                       `json:"assignment,omitempty"`       // revision of the fleet assignment in Src, set by fleet agents
+}
+
+// Applied returns the checksum of the unit's applied source file, which unlike Units can be compared with the
+// checksum of the file the unit was assigned even when the reconciler normalizes or converts unit files.
+func (h *HostReport) Applied(unit string) (string, bool) {
+	if checksum, ok := h.Sources[unit]; ok {
+		return checksum, true
+	}
+	checksum, ok := h.Units[unit]
+	return checksum, ok
+}
+
+// Report returns a snapshot of the reconciler's state.
+func (r *Reconciler) Report(ok bool) *HostReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &HostReport{
+		Src:        r.Src,
+		Units:      make(map[string]string, len(r.State)),
+		LastSync:   time.Now().UTC(),
+		OK:         ok,
+		Failures:   make(map[string]string, len(r.Failures)),
+		Generation: r.generation,
+	}
+	report.Host, _ = os.Hostname()
+	for unit, checksum := range r.State {
+		report.Units[unit] = checksum
+	}
+	for unit, msg := range r.Failures {
+		report.Failures[unit] = msg
+	}
+	if len(r.sources) > 0 {
+		report.Sources = make(map[string]string, len(r.sources))
+		for unit, checksum := range r.sources {
+			report.Sources[unit] = checksum
+		}
+	}
+	if len(r.classes) > 0 {
+		report.Classes = make(map[string]ErrorClass, len(r.classes))
+		for unit, class := range r.classes {
+			report.Classes[unit] = class
+		}
+	}
+	if len(r.errors) > 0 {
+		report.Errors = make(map[ErrorClass]int64, len(r.errors))
+		for class, n := range r.errors {
+			report.Errors[class] = n
+		}
+	}
+	if len(r.lint) > 0 {
+		report.Lint = make(map[string]int, len(r.lint))
+		for unit, n := range r.lint {
+			report.Lint[unit] = n
+		}
+	}
+	if r.Security != nil && len(r.Security.Scores) > 0 {
+		report.Security = make(map[string]float64, len(r.Security.Scores))
+		for unit, score := range r.Security.Scores {
+			report.Security[unit] = score
+		}
+	}
+	if len(r.touched) > 0 {
+		report.Actions = make(map[string]*UnitAction, len(r.touched))
+		for unit, action := range r.touched {
+			report.Actions[unit] = &UnitAction{Action: action.Action, Time: action.Time, Generation: action.Generation}
+		}
+	}
+	if len(r.deferred) > 0 {
+		report.Deferred = make(map[string]string, len(r.deferred))
+		for unit, reason := range r.deferred {
+			report.Deferred[unit] = reason
+		}
+	}
+	if r.Freeze != nil {
+		report.Freeze = r.Freeze.Frozen(time.Now())
+	}
+	for unit := range r.reboot {
+		report.Reboot = append(report.Reboot, unit)
+	}
+	sort.Strings(report.Reboot)
+	for _, change := range r.pending {
+		report.Pending = append(report.Pending, &Change{Unit: change.Unit, Action: change.Action})
+	}
+	if len(r.states) > 0 {
+		report.States = make(map[string]*UnitStatus, len(r.states))
+		for unit, status := range r.states {
+			copied := *status
+			report.States[unit] = &copied
+		}
+	}
+	if r.Stability != nil {
+		report.Stability = r.Stability.Snapshot()
+	}
+	if r.Durations != nil {
+		report.Durations = r.Durations.Snapshot()
+	}
+	return report
+}
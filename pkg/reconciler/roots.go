@@ -0,0 +1,199 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+)
+
+// UnitPaths are systemd's system unit directories ordered by precedence, a unit file in an earlier
+// directory shadows the files of the same name in later ones.
+var UnitPaths = []string{
+	"/etc/systemd/system.control",
+	"/run/systemd/system.control",
+	"/run/systemd/transient",
+	"/run/systemd/generator.early",
+	"/etc/systemd/system",
+	"/etc/systemd/system.attached",
+	"/run/systemd/system",
+	"/run/systemd/system.attached",
+	"/run/systemd/generator",
+	"/usr/local/lib/systemd/system",
+	"/usr/lib/systemd/system",
+	"/lib/systemd/system",
+	"/run/systemd/generator.late",
+}
+
+// SortRoots orders unit directories like UnitPaths. Directories systemd doesn't load units from keep their order after the others.
+func SortRoots(roots []string) []string {
+	rank := func(root string) int {
+		for i, dir := range UnitPaths {
+			if dir == path.Clean(root) {
+				return i
+			}
+		}
+		return len(UnitPaths)
+	}
+	sorted := append([]string{}, roots...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+	return sorted
+}
+
+// RootDirs spreads units over several unit directories of the local host, e.g. /etc/systemd/system and /run/systemd/system.
+// Units select their directory with Root= or Placement= in their UnitSection, and are written to Default otherwise.
+//
+// A unit only keeps the copy in its own root. Copies in other roots are removed whenever it's written, since a stale copy
+// in a root of higher precedence would shadow it. Checksum, Read, and Mode return the copy systemd loads, so a unit is
+// written again once its root changed or a shadowing copy appeared.
+type RootDirs struct {
+	Roots   []*LocalDir // ordered by precedence, see SortRoots
+	Default string      // Dir of the root of units that don't select one, and of persistent units
+	Runtime string      // optional, Dir of the root of runtime units, see Placement
+	Src     string
+}
+
+// root returns the directory the unit file at the path selects, Root= taking precedence over Placement=.
+func (d *RootDirs) root(name string) (*LocalDir, error) {
+	want := d.Default
+	if file, err := os.Open(name); err == nil {
+		parsed, err := ParseUnitFile(file)
+		file.Close()
+		if err == nil {
+			placement, err := parsePlacement(parsed)
+			if err != nil {
+				return nil, err
+			}
+			if value, ok := parsed.Value(UnitSection, "Root"); ok && value != "" {
+				want = value
+			} else if placement == PlacementRuntime {
+				if d.Runtime == "" {
+					return nil, fmt.Errorf("runtime units require a runtime unit directory, e.g. /run/systemd/system")
+				}
+				want = d.Runtime
+			}
+		}
+	}
+	for _, root := range d.Roots {
+		if path.Clean(root.Dir) == path.Clean(want) {
+			return root, nil
+		}
+	}
+	return nil, fmt.Errorf("root %s isn't a managed unit directory", want)
+}
+
+// effective returns the root holding the copy of the unit that systemd loads, or nil if there's none.
+func (d *RootDirs) effective(unit string) *LocalDir {
+	for _, root := range d.Roots {
+		if _, err := os.Lstat(path.Join(root.Dir, unit)); err == nil {
+			return root
+		}
+	}
+	return nil
+}
+
+// Checksum returns the checksum of the unit's effective copy. It's prefixed with the copy's root if that isn't the root
+// the unit selects, so it never matches the unit in Src.
+func (d *RootDirs) Checksum(unit string) (string, error) {
+	current := d.effective(unit)
+	if current == nil {
+		return "", &os.PathError{Op: "stat", Path: path.Join(d.Default, unit), Err: os.ErrNotExist}
+	}
+	checksum, err := current.Checksum(unit)
+	if err != nil {
+		return "", err
+	}
+	want, err := d.root(path.Join(d.Src, unit))
+	if err != nil {
+		return "", err
+	}
+	if want != current {
+		return current.Dir + ":" + checksum, nil
+	}
+	return checksum, nil
+}
+
+func (d *RootDirs) Read(unit string) ([]byte, error) {
+	current := d.effective(unit)
+	if current == nil {
+		return nil, &os.PathError{Op: "open", Path: path.Join(d.Default, unit), Err: os.ErrNotExist}
+	}
+	return current.Read(unit)
+}
+
+// Copy writes the unit to the root it selects and removes its copies in every other root.
+func (d *RootDirs) Copy(src, unit string) error {
+	want, err := d.root(src)
+	if err != nil {
+		return err
+	}
+	if err := want.Copy(src, unit); err != nil {
+		return err
+	}
+	for _, root := range d.Roots {
+		if root == want {
+			continue
+		}
+		if err := root.Remove(unit); err == nil {
+			log.Printf("removed copy of unit %s from %s", unit, root.Dir)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the unit from every root.
+func (d *RootDirs) Remove(unit string) error {
+	removed := false
+	for _, root := range d.Roots {
+		err := root.Remove(unit)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed = removed || err == nil
+	}
+	if !removed {
+		return &os.PathError{Op: "remove", Path: path.Join(d.Default, unit), Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (d *RootDirs) Mode(unit string) (os.FileMode, error) {
+	current := d.effective(unit)
+	if current == nil {
+		return 0, &os.PathError{Op: "stat", Path: path.Join(d.Default, unit), Err: os.ErrNotExist}
+	}
+	return current.Mode(unit)
+}
+
+func (d *RootDirs) Chmod(unit string, mode os.FileMode) error {
+	current := d.effective(unit)
+	if current == nil {
+		return &os.PathError{Op: "chmod", Path: path.Join(d.Default, unit), Err: os.ErrNotExist}
+	}
+	return current.Chmod(unit, mode)
+}
+
+// Link maintains symlinks in the Default root, e.g. the .wants directory of Reconciler.Group.
+func (d *RootDirs) Link(name, target string) error {
+	return d.defaultRoot().Link(name, target)
+}
+
+func (d *RootDirs) Readlink(name string) (string, error) {
+	return d.defaultRoot().Readlink(name)
+}
+
+func (d *RootDirs) Unlink(name string) error {
+	return d.defaultRoot().Unlink(name)
+}
+
+func (d *RootDirs) defaultRoot() *LocalDir {
+	for _, root := range d.Roots {
+		if path.Clean(root.Dir) == path.Clean(d.Default) {
+			return root
+		}
+	}
+	return &LocalDir{Dir: d.Default}
+}
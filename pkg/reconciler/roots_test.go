@@ -0,0 +1,60 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortRoots(t *testing.T) {
+	assert.Equal(t, []string{"/etc/systemd/system", "/run/systemd/system/", "/usr/lib/systemd/system", "/opt/units"},
+		SortRoots([]string{"/opt/units", "/usr/lib/systemd/system", "/run/systemd/system/", "/etc/systemd/system"}))
+}
+
+func TestRootDirs(t *testing.T) {
+	src, etc, run := t.TempDir(), t.TempDir(), t.TempDir()
+	sysd := &fakeSystemd{}
+	roots := &RootDirs{Roots: []*LocalDir{{Dir: etc}, {Dir: run}}, Default: etc, Src: src}
+	r := &Reconciler{Src: src, Dest: etc, Target: roots, State: map[string]string{}, Systemd: sysd}
+
+	// Units are written to the default root
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.FileExists(t, path.Join(etc, "a.service"))
+	assert.NoFileExists(t, path.Join(run, "a.service"))
+
+	// Units moved to another root don't leave their old copy behind
+	moved := []byte("[Service]\nExecStart=/bin/a\n\n[X-Unitmgr]\nRoot=" + run + "\n")
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), moved, 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.NoFileExists(t, path.Join(etc, "a.service"))
+	content, err := ioutil.ReadFile(path.Join(run, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, moved, content)
+
+	// Stale copies shadowing the unit are removed
+	require.NoError(t, ioutil.WriteFile(path.Join(etc, "a.service"), moved, 0644))
+	checksum, err := roots.Checksum("a.service")
+	require.NoError(t, err)
+	assert.Contains(t, checksum, etc+":")
+	require.True(t, r.Sync(context.Background()))
+	assert.NoFileExists(t, path.Join(etc, "a.service"))
+	assert.FileExists(t, path.Join(run, "a.service"))
+
+	// Removed units are removed from every root
+	require.NoError(t, ioutil.WriteFile(path.Join(etc, "a.service"), moved, 0644))
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.NoFileExists(t, path.Join(etc, "a.service"))
+	assert.NoFileExists(t, path.Join(run, "a.service"))
+
+	// Units can't select unmanaged roots
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[X-Unitmgr]\nRoot=/elsewhere\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["b.service"], "/elsewhere isn't a managed unit directory")
+}
@@ -0,0 +1,152 @@
+package reconciler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned for unit files that aren't valid UTF-8 when Reconciler.Sanitize is set.
+var ErrInvalidUTF8 = errors.New("not valid UTF-8")
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// Sanitize returns unit file content as it's written when Reconciler.Sanitize is set: without a byte order mark,
+// with LF line endings, and ending with a newline. Content that isn't valid UTF-8 is rejected, since systemd
+// would misparse it rather than fail.
+func Sanitize(content []byte) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, ErrInvalidUTF8
+	}
+	content = ConvertLineEndings(content)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return content, nil
+}
+
+// ConvertLineEndings returns unit file content with LF line endings and without a UTF-8 byte order mark,
+// as it's written when Reconciler.Portable is set.
+func ConvertLineEndings(content []byte) []byte {
+	content = bytes.TrimPrefix(content, utf8BOM)
+	if bytes.IndexByte(content, '\r') < 0 {
+		return content
+	}
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(content, []byte("\r"), []byte("\n")) // classic Mac OS
+}
+
+// artifactChars are characters that editors and word processors substitute or insert, which systemd takes literally.
+var artifactChars = []struct {
+	Char rune
+	Name string
+}{
+	{'\u00a0', "non-breaking space"},
+	{'\u200b', "zero-width space"},
+	{'\ufeff', "byte order mark"},
+	{'\u2018', "typographic quote"},
+	{'\u2019', "typographic quote"},
+	{'\u201c', "typographic quote"},
+	{'\u201d', "typographic quote"},
+	{'\u2013', "en dash"},
+}
+
+// Artifacts describes the traces of authoring unit file content on other platforms: CRLF line endings and a leading
+// byte order mark, which ConvertLineEndings converts, and substituted characters like typographic quotes, which it doesn't.
+func Artifacts(content []byte) []string {
+	var artifacts []string
+	if bytes.HasPrefix(content, utf8BOM) {
+		artifacts = append(artifacts, "leading byte order mark")
+		content = content[len(utf8BOM):]
+	}
+	if bytes.Contains(content, []byte("\r\n")) {
+		artifacts = append(artifacts, "CRLF line endings")
+	}
+	if bytes.Count(content, []byte("\r")) > bytes.Count(content, []byte("\r\n")) {
+		artifacts = append(artifacts, "CR line endings")
+	}
+
+	seen := map[string]bool{}
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		for _, artifact := range artifactChars {
+			if !seen[artifact.Name] && bytes.ContainsRune(line, artifact.Char) {
+				seen[artifact.Name] = true
+				artifacts = append(artifacts, fmt.Sprintf("%s on line %d", artifact.Name, i+1))
+			}
+		}
+	}
+	return artifacts
+}
+
+// converted returns true if unit files are converted when they're written, see Sanitize and Portable.
+func (r *Reconciler) converted() bool {
+	return r.Sanitize || r.Portable
+}
+
+// convert returns the content of a unit file in Src as it's written to Dest.
+func (r *Reconciler) convert(content []byte) ([]byte, error) {
+	if r.Sanitize {
+		return Sanitize(content)
+	}
+	return ConvertLineEndings(content), nil
+}
+
+// sourceChecksum returns the checksum of a unit file in Src as it's written to Dest.
+func (r *Reconciler) sourceChecksum(name string) (string, error) {
+	if !r.converted() {
+		return r.checksum(name)
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	if content, err = r.convert(content); err != nil {
+		return "", err
+	}
+	return contentChecksum(orDefault(r.Hasher), content), nil
+}
+
+// copyUnit writes a unit file in Src to Dest, converted if Sanitize or Portable is set.
+// Artifacts of authoring it on another platform are logged, since some can't be converted.
+func (r *Reconciler) copyUnit(name, unit string) error {
+	if !r.converted() {
+		return r.target().Copy(name, unit)
+	}
+	original, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if artifacts := Artifacts(original); len(artifacts) > 0 {
+		log.Printf("unit %s contains artifacts of authoring it on another platform: %s", unit, strings.Join(artifacts, ", "))
+	}
+	content, err := r.convert(original)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "unitmgr-converted")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), stat.Mode().Perm()) // copies preserve the permissions of their source
+	}
+	if err != nil {
+		return err
+	}
+	return r.target().Copy(tmp.Name(), unit)
+}
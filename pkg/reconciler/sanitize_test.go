@@ -0,0 +1,90 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := map[string]string{
+		"[Service]\nExecStart=/bin/a\n":     "[Service]\nExecStart=/bin/a\n",
+		"[Service]\r\nExecStart=/bin/a\r\n": "[Service]\nExecStart=/bin/a\n",
+		"\ufeff[Service]\nExecStart=/bin/a": "[Service]\nExecStart=/bin/a\n",
+		"[Service]\rExecStart=/bin/a\r":     "[Service]\nExecStart=/bin/a\n",
+		"[Service]\nExecStart=/bin/ä\r\n":   "[Service]\nExecStart=/bin/ä\n",
+		"":                                  "",
+	}
+	for content, expected := range tests {
+		sanitized, err := Sanitize([]byte(content))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(sanitized), "sanitizing %q", content)
+	}
+
+	_, err := Sanitize([]byte("[Service]\nExecStart=/bin/\xe4\n"))
+	assert.Equal(t, ErrInvalidUTF8, err)
+}
+
+func TestReconcilerSanitize(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &fakeSystemd{}, Sanitize: true}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("\ufeff[Service]\r\nExecStart=/bin/a"), 0600))
+	require.True(t, r.Sync(context.Background()))
+	content, err := ioutil.ReadFile(path.Join(dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a\n", string(content))
+	stat, err := os.Stat(path.Join(dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// Sanitized files aren't written again
+	changes := r.Changes()
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, changes, r.Changes())
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/\xe4\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Contains(t, r.Failures["b.service"], "not valid UTF-8")
+	assert.Equal(t, []ErrorClass{ValidationError}, r.Classes())
+	assert.NoFileExists(t, path.Join(dest, "b.service"))
+}
+
+func TestArtifacts(t *testing.T) {
+	assert.Empty(t, Artifacts([]byte("[Service]\nExecStart=/bin/a \"b c\"\n")))
+	assert.Equal(t, []string{"leading byte order mark", "CRLF line endings"}, Artifacts([]byte("\ufeff[Service]\r\nExecStart=/bin/a\r\n")))
+	assert.Equal(t, []string{"CR line endings"}, Artifacts([]byte("[Service]\rExecStart=/bin/a\r")))
+	assert.Equal(t, []string{"typographic quote on line 2", "non-breaking space on line 3"},
+		Artifacts([]byte("[Service]\nExecStart=/bin/a “b c”\nEnvironment=A=\u00a0b\nDescription=‘x’\n")))
+}
+
+func TestReconcilerPortable(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &fakeSystemd{}}
+
+	crlf := []byte("[Service]\r\nExecStart=/bin/a “b”\r\n")
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), crlf, 0644))
+	problems, err := r.Validate("a.service")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"authoring artifact: CRLF line endings", "authoring artifact: typographic quote on line 2"}, problems)
+
+	r.Portable = true
+	problems, err = r.Validate("a.service")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"authoring artifact: typographic quote on line 2"}, problems)
+
+	require.True(t, r.Sync(context.Background()))
+	content, err := ioutil.ReadFile(path.Join(dest, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nExecStart=/bin/a “b”\n", string(content))
+
+	// Converted files aren't written again
+	changes := r.Changes()
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, changes, r.Changes())
+}
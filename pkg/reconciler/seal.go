@@ -0,0 +1,95 @@
+package reconciler
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// sealedMagic prefixes content encrypted by a Sealer, so files written before encryption was enabled are still read.
+var sealedMagic = []byte("unitmgr-sealed-v1\n")
+
+// ErrSealed is returned when reading encrypted content without a Sealer.
+var ErrSealed = errors.New("content is encrypted, but no encryption key is configured")
+
+// Sealer encrypts content that's kept at rest outside of the unit directory, e.g. the state file and the
+// staging cache of sources, with AES-256-GCM.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer returns a Sealer using a key derived from the given secret, which may have any length.
+func NewSealer(secret []byte) (*Sealer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("the encryption key is empty")
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// LoadSealer returns a Sealer using the key in the named file, which is generated if it doesn't exist.
+// The file can be provided by systemd's LoadCredentialEncrypted=, which seals it with the host's TPM.
+func LoadSealer(name string) (*Sealer, error) {
+	secret, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(name, secret, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %w", err)
+	}
+	return NewSealer(bytes.TrimSpace(secret))
+}
+
+// IsSealed returns true if the content was encrypted by a Sealer.
+func IsSealed(content []byte) bool {
+	return bytes.HasPrefix(content, sealedMagic)
+}
+
+// Seal encrypts the content.
+func (s *Sealer) Seal(content []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, sealedMagic...), nonce...)
+	return s.aead.Seal(sealed, nonce, content, sealedMagic), nil
+}
+
+// Open decrypts content encrypted by Seal. Content that isn't encrypted is returned as is, and a nil Sealer
+// returns ErrSealed for encrypted content.
+func (s *Sealer) Open(content []byte) ([]byte, error) {
+	if !IsSealed(content) {
+		return content, nil
+	}
+	if s == nil {
+		return nil, ErrSealed
+	}
+	content = content[len(sealedMagic):]
+	if len(content) < s.aead.NonceSize() {
+		return nil, errors.New("encrypted content is truncated")
+	}
+	nonce, ciphertext := content[:s.aead.NonceSize()], content[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, sealedMagic)
+	if err != nil {
+		return nil, errors.New("decrypting content failed, was it encrypted with another key?")
+	}
+	return plain, nil
+}
@@ -0,0 +1,79 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealer(t *testing.T) {
+	sealer, err := NewSealer([]byte("secret"))
+	require.NoError(t, err)
+
+	sealed, err := sealer.Seal([]byte("[Service]\nEnvironment=TOKEN=abc\n"))
+	require.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, string(sealed), "TOKEN")
+	content, err := sealer.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nEnvironment=TOKEN=abc\n", string(content))
+
+	// Content written before encryption was enabled is read as is
+	content, err = sealer.Open([]byte("plain"))
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(content))
+
+	other, err := NewSealer([]byte("other"))
+	require.NoError(t, err)
+	_, err = other.Open(sealed)
+	assert.EqualError(t, err, "decrypting content failed, was it encrypted with another key?")
+	_, err = (*Sealer)(nil).Open(sealed)
+	assert.Equal(t, ErrSealed, err)
+
+	_, err = NewSealer(nil)
+	assert.Error(t, err)
+}
+
+func TestLoadSealer(t *testing.T) {
+	name := path.Join(t.TempDir(), "key")
+	sealer, err := LoadSealer(name)
+	require.NoError(t, err)
+	stat, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// The generated key is reused
+	sealed, err := sealer.Seal([]byte("a"))
+	require.NoError(t, err)
+	reloaded, err := LoadSealer(name)
+	require.NoError(t, err)
+	content, err := reloaded.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+}
+
+func TestStateStoreSealed(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	r := &Reconciler{Src: "/units", State: map[string]string{"a.service": "abc"}}
+	require.NoError(t, (&StateStore{Path: name}).Save([]*Reconciler{r}))
+
+	// Existing state files are encrypted by the next save
+	sealer, err := NewSealer([]byte("secret"))
+	require.NoError(t, err)
+	store := &StateStore{Path: name, Sealer: sealer}
+	require.NoError(t, store.Load([]*Reconciler{r}))
+	require.NoError(t, store.Save([]*Reconciler{r}))
+	buf, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.True(t, IsSealed(buf))
+	assert.NotContains(t, string(buf), "a.service")
+
+	restored := &Reconciler{Src: "/units", State: map[string]string{}}
+	require.NoError(t, (&StateStore{Path: name, Sealer: sealer}).Load([]*Reconciler{restored}))
+	assert.Equal(t, r.State, restored.State)
+	assert.ErrorIs(t, (&StateStore{Path: name}).Load([]*Reconciler{restored}), ErrSealed)
+}
@@ -0,0 +1,72 @@
+package reconciler
+
+import (
+	"context"
+	"log"
+	"path"
+)
+
+// SecurityReport tracks the systemd-analyze exposure score of managed services.
+type SecurityReport struct {
+	Threshold float64 // services scoring worse than this are stopped, zero to only report
+	Analyze   func(unit string) (float64, error)
+
+	Scores   map[string]float64 // unit -> exposure score of the applied configuration
+	Rejected map[string]string  // unit -> checksum of the configuration that exceeded the threshold
+}
+
+func NewSecurityReport(threshold float64, analyze func(string) (float64, error)) *SecurityReport {
+	return &SecurityReport{
+		Threshold: threshold,
+		Analyze:   analyze,
+		Scores:    map[string]float64{},
+		Rejected:  map[string]string{},
+	}
+}
+
+// checkSecurity scores a service that was just applied and stops it if it exceeds the threshold.
+func (r *Reconciler) checkSecurity(ctx context.Context, unit, checksum string) bool {
+	if r.Security == nil || path.Ext(unit) != ".service" {
+		return true
+	}
+	r.mu.Lock()
+	_, scored := r.Security.Scores[unit]
+	current := r.State[unit] == checksum
+	r.mu.Unlock()
+	if scored && current {
+		return true // already scored this configuration
+	}
+
+	score, err := r.Security.Analyze(unit)
+	if err != nil {
+		log.Printf("error while analyzing security of unit %q: %s", unit, err)
+		return true // scoring is best effort
+	}
+	r.mu.Lock()
+	r.Security.Scores[unit] = score
+	r.mu.Unlock()
+	log.Printf("security exposure of unit %s: %.1f", unit, score)
+
+	if r.Security.Threshold <= 0 || score <= r.Security.Threshold {
+		return true
+	}
+
+	log.Printf("rejected unit %q: security exposure %.1f exceeds threshold %.1f", unit, score, r.Security.Threshold)
+	r.mu.Lock()
+	r.Security.Rejected[unit] = checksum
+	r.mu.Unlock()
+	if _, err := r.Systemd.EnsureStopped(ctx, unit); err != nil {
+		log.Printf("error while stopping unit %q: %s", unit, err)
+	}
+	return false
+}
+
+// securityRejected returns true if the given configuration of the unit exceeded the security threshold.
+func (r *Reconciler) securityRejected(unit, checksum string) bool {
+	if r.Security == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Security.Rejected[unit] == checksum
+}
@@ -0,0 +1,50 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityReport(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	sysd := &fakeSystemd{}
+	score := 5.0
+	r := &Reconciler{
+		Src:     src,
+		Dest:    dest,
+		State:   map[string]string{},
+		Systemd: sysd,
+		Security: NewSecurityReport(7, func(unit string) (float64, error) {
+			return score, nil
+		}),
+	}
+
+	err := ioutil.WriteFile(path.Join(src, "test.service"), []byte("test1"), 0644)
+	require.NoError(t, err)
+
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, 5.0, r.Security.Scores["test.service"])
+	assert.Empty(t, r.Security.Rejected)
+	assert.Equal(t, map[string]float64{"test.service": 5.0}, r.Report(true).Security)
+
+	// Exceed the threshold
+	score = 9.6
+	err = ioutil.WriteFile(path.Join(src, "test.service"), []byte("test2"), 0644)
+	require.NoError(t, err)
+
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, 9.6, r.Security.Scores["test.service"])
+	assert.Equal(t, r.State["test.service"], r.Security.Rejected["test.service"])
+	assert.Equal(t, "EnsureStopped test.service", sysd.LastCmd)
+
+	// The rejected configuration isn't started again
+	sysd.LastCmd = ""
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, "", sysd.LastCmd)
+}
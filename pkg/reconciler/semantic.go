@@ -0,0 +1,162 @@
+package reconciler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+)
+
+// Reloader is implemented by Systemd implementations that can apply unit file changes without restarting units.
+type Reloader interface {
+	Reload(ctx context.Context, unit string) error   // reloads the unit files, and the unit itself if it supports reloading
+	Reenable(ctx context.Context, unit string) error // reloads the unit files and recreates the unit's [Install] symlinks
+}
+
+// Action is a set of operations that apply a unit file change to its unit.
+type Action int
+
+const (
+	ActionReenable Action = 1 << iota // [Install] changed
+	ActionReload                      // directives that take effect without a restart changed
+	ActionRestart                     // anything else changed
+
+	ActionNone Action = 0 // only comments or formatting changed
+)
+
+// reloadSafe are the directives whose changes take effect once the unit files are reloaded,
+// since they're only used when the unit is stopped, reloaded, or described.
+var reloadSafe = map[string]map[string]bool{
+	"Unit": {
+		"Description":   true,
+		"Documentation": true,
+	},
+	"Service": {
+		"ExecReload":               true,
+		"ExecStop":                 true,
+		"ExecStopPost":             true,
+		"Restart":                  true,
+		"RestartSec":               true,
+		"RestartPreventExitStatus": true,
+		"SuccessExitStatus":        true,
+		"TimeoutStopSec":           true,
+	},
+}
+
+// ChangeAction returns the operations needed to apply the changes from one unit file to another.
+func ChangeAction(from, to *UnitFile) Action {
+	values := func(u *UnitFile) map[UnitEntry][]string {
+		m := map[UnitEntry][]string{}
+		for _, entry := range u.Entries {
+			key := UnitEntry{Section: entry.Section, Key: entry.Key}
+			m[key] = append(m[key], entry.Value)
+		}
+		return m
+	}
+	oldValues, newValues := values(from), values(to)
+
+	changed := map[UnitEntry]bool{}
+	for key, vals := range oldValues {
+		if !equalStrings(vals, newValues[key]) {
+			changed[key] = true
+		}
+	}
+	for key := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			changed[key] = true
+		}
+	}
+
+	action := ActionNone
+	for key := range changed {
+		switch {
+		case key.Section == "Install":
+			action |= ActionReenable
+		case reloadSafe[key.Section][key.Key]:
+			action |= ActionReload
+		default:
+			action |= ActionRestart
+		}
+	}
+	return action
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// changeAction compares the previously applied unit file with the one at name.
+// Files that can't be parsed as unit files always require a restart.
+func changeAction(previous []byte, name string) Action {
+	current, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ActionRestart
+	}
+	from, err := ParseUnitFile(bytes.NewReader(previous))
+	if err != nil {
+		return ActionRestart
+	}
+	to, err := ParseUnitFile(bytes.NewReader(current))
+	if err != nil {
+		return ActionRestart
+	}
+	return ChangeAction(from, to)
+}
+
+// restartUnit applies a changed unit file to its unit, restarting it unless Semantic is set
+// and the changed directives allow it to be reloaded or re-enabled instead, or it's an inactive activated service.
+// previous is the unit file that was replaced, or nil if unknown.
+func (r *Reconciler) restartUnit(ctx context.Context, unit, name string, previous []byte) error {
+	if activated, err := r.restartActivated(ctx, unit); activated || err != nil {
+		return err
+	}
+
+	reloader, ok := r.Systemd.(Reloader)
+	if !r.Semantic || !ok || previous == nil {
+		r.transition(unit, StateRestarting, "")
+		if err := r.restart(ctx, unit); err != nil {
+			return err
+		}
+		log.Printf("restarted unit: %s", unit)
+		r.recordChange(unit, "restarted")
+		r.restartDependents(ctx, unit)
+		return nil
+	}
+
+	action := changeAction(previous, name)
+	switch {
+	case action&ActionRestart != 0:
+		r.transition(unit, StateRestarting, "")
+		if err := r.restart(ctx, unit); err != nil {
+			return err
+		}
+		log.Printf("restarted unit: %s", unit)
+		r.recordChange(unit, "restarted")
+		r.restartDependents(ctx, unit)
+	case action&ActionReload != 0:
+		r.transition(unit, StateReloading, "")
+		if err := reloader.Reload(ctx, unit); err != nil {
+			return err
+		}
+		log.Printf("reloaded unit: %s", unit)
+		r.recordChange(unit, "reloaded")
+	case action == ActionNone:
+		log.Printf("unit %s only changed cosmetically, not restarting", unit)
+	}
+	if action&ActionReenable != 0 {
+		if err := reloader.Reenable(ctx, unit); err != nil {
+			return err
+		}
+		log.Printf("re-enabled unit: %s", unit)
+		r.recordChange(unit, "re-enabled")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeAction(t *testing.T) {
+	const base = "[Unit]\nDescription=test\n\n[Service]\nExecStart=/bin/test\nExecReload=/bin/kill -HUP $MAINPID\n\n[Install]\nWantedBy=multi-user.target\n"
+
+	tests := []struct {
+		Name     string
+		To       string
+		Expected Action
+	}{
+		{"comments", "# comment\n" + base, ActionNone},
+		{"install", strings.Replace(base, "multi-user", "graphical", 1), ActionReenable},
+		{"description", strings.Replace(base, "Description=test", "Description=other", 1), ActionReload},
+		{"added reload-safe key", base + "[Service]\nTimeoutStopSec=5\n", ActionReload},
+		{"exec", strings.Replace(base, "/bin/test", "/bin/other", 1), ActionRestart},
+		{"removed key", strings.Replace(base, "ExecStart=/bin/test\n", "", 1), ActionRestart},
+		{"exec and install", strings.Replace(strings.Replace(base, "/bin/test", "/bin/other", 1), "multi-user", "graphical", 1), ActionRestart | ActionReenable},
+	}
+	from, err := ParseUnitFile(strings.NewReader(base))
+	require.NoError(t, err)
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			to, err := ParseUnitFile(strings.NewReader(tc.To))
+			require.NoError(t, err)
+			assert.Equal(t, tc.Expected, ChangeAction(from, to))
+		})
+	}
+}
+
+func TestSyncSemantic(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Semantic: true}
+
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte(content), 0644))
+	}
+	write("[Service]\nExecStart=/bin/test\n")
+	require.True(t, r.Sync(context.Background()))
+
+	sysd.Cmds = nil
+	write("# cosmetic\n[Service]\nExecStart=/bin/test\n")
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, sysd.Cmds)
+
+	write("[Service]\nExecStart=/bin/test\nTimeoutStopSec=5\n\n[Install]\nWantedBy=multi-user.target\n")
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Reload test.service", "Reenable test.service"}, sysd.Cmds)
+
+	sysd.Cmds = nil
+	write("[Service]\nExecStart=/bin/other\nTimeoutStopSec=5\n\n[Install]\nWantedBy=multi-user.target\n")
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Restart test.service"}, sysd.Cmds)
+
+	// Other formats are always restarted
+	sysd.Cmds = nil
+	write("#!/bin/sh\nexec test\n")
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"Restart test.service"}, sysd.Cmds)
+}
@@ -0,0 +1,138 @@
+package reconciler
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsReader is implemented by Systemd implementations that can report how often units restart.
+type StatsReader interface {
+	// Stats returns a counter of the unit's automatic restarts and when it last became active,
+	// or the zero time if it isn't active.
+	Stats(ctx context.Context, unit string) (int, time.Time, error)
+}
+
+// flapWindow is how far back restarts are counted.
+const flapWindow = time.Hour
+
+// StabilityTracker counts the restarts of units that weren't caused by changes to their unit files.
+type StabilityTracker struct {
+	Threshold int // restarts within an hour that mark a unit as flapping, zero to never mark units as flapping
+
+	mu    sync.Mutex
+	units map[string]*unitHistory
+	now   func() time.Time
+}
+
+type unitHistory struct {
+	Restarts    int       // last observed counter of automatic restarts
+	ActiveSince time.Time // last observed activation
+	Events      []time.Time
+	Expected    bool // the unit was just (re)started because its unit file changed
+	Flapping    bool
+}
+
+// UnitStability describes the recent restarts of a unit.
+type UnitStability struct {
+	Restarts    int       `json:"restarts"` // in the last hour, not counting restarts caused by changes to the unit file
+	ActiveSince time.Time `json:"activeSince,omitempty"`
+	Flapping    bool      `json:"flapping,omitempty"`
+}
+
+func NewStabilityTracker(threshold int) *StabilityTracker {
+	return &StabilityTracker{Threshold: threshold, units: map[string]*unitHistory{}, now: time.Now}
+}
+
+// expect records that the unit was started or restarted by unitmgr to apply a changed unit file,
+// so its next activation isn't counted.
+func (s *StabilityTracker) expect(unit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.units[unit]; ok {
+		h.Expected = true
+	}
+}
+
+func (s *StabilityTracker) forget(unit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.units, unit)
+}
+
+// observe records the current restart counter and activation time of a unit, returning true if it just started flapping.
+func (s *StabilityTracker) observe(unit string, restarts int, since time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	h, ok := s.units[unit]
+	if !ok {
+		s.units[unit] = &unitHistory{Restarts: restarts, ActiveSince: since}
+		return false // first observation is the baseline
+	}
+
+	starts := 0
+	if restarts > h.Restarts {
+		starts = restarts - h.Restarts
+	}
+	if starts == 0 && !since.IsZero() && !since.Equal(h.ActiveSince) {
+		starts = 1 // started again by someone other than systemd's Restart=
+	}
+	if h.Expected && starts > 0 {
+		starts--
+		h.Expected = false
+	}
+	h.Restarts, h.ActiveSince = restarts, since
+	for i := 0; i < starts; i++ {
+		h.Events = append(h.Events, now)
+	}
+	for len(h.Events) > 0 && now.Sub(h.Events[0]) > flapWindow {
+		h.Events = h.Events[1:]
+	}
+
+	flapping := s.Threshold > 0 && len(h.Events) > s.Threshold
+	started := flapping && !h.Flapping
+	h.Flapping = flapping
+	return started
+}
+
+// Snapshot returns the stability of every tracked unit.
+func (s *StabilityTracker) Snapshot() map[string]*UnitStability {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]*UnitStability, len(s.units))
+	for unit, h := range s.units {
+		snapshot[unit] = &UnitStability{Restarts: len(h.Events), ActiveSince: h.ActiveSince, Flapping: h.Flapping}
+	}
+	return snapshot
+}
+
+// CheckStability observes the restarts of every applied unit, see StabilityTracker.
+func (r *Reconciler) CheckStability(ctx context.Context) {
+	reader, ok := r.Systemd.(StatsReader)
+	if r.Stability == nil || !ok {
+		return
+	}
+
+	r.mu.Lock()
+	units := make([]string, 0, len(r.State))
+	for unit := range r.State {
+		units = append(units, unit)
+	}
+	r.mu.Unlock()
+	sort.Strings(units)
+
+	for _, unit := range units {
+		restarts, since, err := reader.Stats(ctx, unit)
+		if err != nil {
+			log.Printf("error while checking restarts of unit %q: %s", unit, err)
+			continue
+		}
+		if r.Stability.observe(unit, restarts, since) {
+			log.Printf("unit %s is flapping: it restarted more than %d times in the last hour without changes to its unit file", unit, r.Stability.Threshold)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStabilityTracker(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStabilityTracker(2)
+	s.now = func() time.Time { return now }
+	since := now.Add(-time.Hour)
+
+	assert.False(t, s.observe("a.service", 0, since))
+	assert.Equal(t, &UnitStability{ActiveSince: since}, s.Snapshot()["a.service"])
+
+	// Automatic restarts are counted, even between observations
+	now = now.Add(time.Minute)
+	since = now
+	assert.False(t, s.observe("a.service", 2, since))
+	assert.Equal(t, 2, s.Snapshot()["a.service"].Restarts)
+
+	// So are manual starts
+	now = now.Add(time.Minute)
+	since = now
+	assert.True(t, s.observe("a.service", 2, since))
+	assert.True(t, s.Snapshot()["a.service"].Flapping)
+	assert.False(t, s.observe("a.service", 2, since)) // only reported once
+
+	// Restarts applying changes aren't
+	s.expect("a.service")
+	now = now.Add(time.Minute)
+	since = now
+	s.observe("a.service", 2, since)
+	assert.Equal(t, 3, s.Snapshot()["a.service"].Restarts)
+
+	// Restarts older than an hour are forgotten
+	now = now.Add(time.Hour)
+	s.observe("a.service", 2, since)
+	assert.Equal(t, &UnitStability{ActiveSince: since}, s.Snapshot()["a.service"])
+
+	s.forget("a.service")
+	assert.Empty(t, s.Snapshot())
+}
+
+func TestCheckStability(t *testing.T) {
+	src := t.TempDir()
+	sysd := &statsSystemd{fakeSystemd: &fakeSystemd{}, restarts: map[string]int{}}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd, Stability: NewStabilityTracker(1)}
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test1"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	r.CheckStability(context.Background())
+
+	// Restarting the unit for a changed unit file isn't counted
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "test.service"), []byte("test2"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	sysd.restarts["test.service"]++
+	r.CheckStability(context.Background())
+	assert.Equal(t, 0, r.Report(true).Stability["test.service"].Restarts)
+
+	sysd.restarts["test.service"] += 2
+	r.CheckStability(context.Background())
+	assert.Equal(t, &UnitStability{Restarts: 2, Flapping: true}, r.Report(true).Stability["test.service"])
+
+	require.NoError(t, os.Remove(path.Join(src, "test.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, r.Report(true).Stability)
+}
+
+type statsSystemd struct {
+	*fakeSystemd
+	restarts map[string]int
+}
+
+func (s *statsSystemd) Stats(ctx context.Context, unit string) (int, time.Time, error) {
+	return s.restarts[unit], time.Time{}, nil
+}
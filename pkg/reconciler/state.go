@@ -0,0 +1,287 @@
+package reconciler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// StateStore persists the checksums of applied units across restarts,
+// so units removed from src while unitmgr wasn't running are still cleaned up.
+type StateStore struct {
+	Path         string
+	Sealer       *Sealer       // optional, encrypts the state file
+	TombstoneTTL time.Duration // optional, forget recorded units removed from Src longer ago than this instead of removing them
+	Hasher       Hasher        // optional, the algorithm of the recorded checksums, must match the Hasher of the reconcilers
+
+	last       []byte
+	tombstones map[string]map[string]time.Time // src -> unit removed from it -> since when
+	clock      func() time.Time
+}
+
+type stateFile struct {
+	Version     int                             `json:"version,omitempty"`          // of the schema, see StateVersion
+	Algorithm   string                          `json:"algorithm,omitempty"`        // of the checksums, sha256 when empty
+	Units       map[string]map[string]string    `json:"units"`                      // src -> unit -> checksum of the applied configuration
+	Generations map[string]int64                `json:"generations,omitempty"`      // src -> generation of the most recently applied change set
+	Durations   map[string]map[string][]int64   `json:"restartDurations,omitempty"` // src -> unit -> milliseconds its recorded restarts took, see DurationTracker
+	Queue       map[string][]*QueuedAction      `json:"queue,omitempty"`            // src -> postponed actions, see Reconciler.Queue
+	Aliases     map[string]map[string][]string  `json:"aliases,omitempty"`          // src -> unit -> the aliases linked to it, see Reconciler.Aliases
+	Tombstones  map[string]map[string]time.Time `json:"tombstones,omitempty"`       // src -> unit removed from it that's still recorded -> since when, see StateStore.TombstoneTTL
+
+	modified time.Time // when a file of an earlier version was last written
+}
+
+// StateVersion is the schema version of the state files written by this version. Files without one are version 1.
+const StateVersion = 2
+
+// Load restores the state of each reconciler.
+func (s *StateStore) Load(reconcilers []*Reconciler) error {
+	file, buf, sealed, err := s.read()
+	if file == nil {
+		return err
+	}
+	if file.Version > StateVersion {
+		return fmt.Errorf("state file has schema version %d, but this version of unitmgr only supports up to %d", file.Version, StateVersion)
+	}
+
+	algorithm := file.Algorithm
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	previous, ok := Hashers[algorithm]
+	if !ok {
+		return fmt.Errorf("state file uses unknown checksum algorithm %q", algorithm)
+	}
+
+	s.tombstones = map[string]map[string]time.Time{}
+	for _, r := range reconcilers {
+		for unit, checksum := range file.Units[r.Src] {
+			if since, ok := s.tombstone(file, r, unit); ok && s.TombstoneTTL > 0 && s.now().Sub(since) > s.TombstoneTTL {
+				log.Printf("forgetting unit %s rather than removing it, since it was removed from %s over %s ago", unit, r.Src, s.TombstoneTTL)
+				continue
+			}
+			if previous != orDefault(r.Hasher) {
+				checksum = r.rehash(unit, checksum, previous)
+			}
+			r.State[unit] = checksum
+		}
+		r.SetGeneration(file.Generations[r.Src])
+		r.restoreQueue(file.Queue[r.Src])
+		for unit, aliases := range file.Aliases[r.Src] {
+			if r.aliases == nil {
+				r.aliases = map[string][]string{}
+			}
+			r.aliases[unit] = aliases
+		}
+		if r.Durations != nil {
+			for unit, samples := range file.Durations[r.Src] {
+				for _, ms := range samples {
+					r.Durations.Record(unit, time.Duration(ms)*time.Millisecond)
+				}
+			}
+		}
+	}
+	if sealed || s.Sealer == nil {
+		s.last = buf // otherwise the next save encrypts the file even if nothing changed
+	}
+	return nil
+}
+
+// read decodes the state file, returning a nil file if it doesn't exist.
+func (s *StateStore) read() (*stateFile, []byte, bool, error) {
+	buf, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	sealed := IsSealed(buf)
+	if buf, err = s.Sealer.Open(buf); err != nil {
+		return nil, nil, false, fmt.Errorf("decrypting state file: %w", err)
+	}
+
+	file := &stateFile{}
+	if err := json.Unmarshal(buf, file); err != nil {
+		return nil, nil, false, fmt.Errorf("decoding state file: %w", err)
+	}
+	if file.Version == 0 {
+		file.Version = 1
+	}
+	if file.Version < StateVersion {
+		// Version 1 didn't record tombstones, units it lists that were removed from src are dated to its last write
+		if stat, err := os.Stat(s.Path); err == nil {
+			file.modified = stat.ModTime()
+		}
+	}
+	return file, buf, sealed, nil
+}
+
+// tombstone returns since when the recorded unit has been removed from the reconciler's Src, or false if it still exists.
+// Tombstones are kept in memory and written by Save until the unit was removed or exists again.
+func (s *StateStore) tombstone(file *stateFile, r *Reconciler, unit string) (time.Time, bool) {
+	if _, err := os.Lstat(path.Join(r.Src, unit)); err == nil {
+		return time.Time{}, false
+	}
+	since, ok := file.Tombstones[r.Src][unit]
+	if !ok {
+		since = file.modified
+	}
+	if since.IsZero() {
+		since = s.now()
+	}
+	if s.tombstones[r.Src] == nil {
+		s.tombstones[r.Src] = map[string]time.Time{}
+	}
+	s.tombstones[r.Src][unit] = since
+	return since, true
+}
+
+func (s *StateStore) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// rehash converts the checksum of an applied unit computed by another algorithm, so changing
+// the algorithm doesn't restart every unit. Checksums that don't match the applied unit file are kept,
+// since the unit's configuration is unknown.
+func (r *Reconciler) rehash(unit, checksum string, previous Hasher) string {
+	content, err := r.target().Read(unit)
+	if err != nil {
+		return checksum
+	}
+	if r.configChecksum(previous, content) != checksum {
+		return checksum
+	}
+	return r.ConfigChecksum(content)
+}
+
+// ConfigChecksum returns the checksum of a unit file's content as it's recorded in State.
+func (r *Reconciler) ConfigChecksum(content []byte) string {
+	return r.configChecksum(orDefault(r.Hasher), content)
+}
+
+func (r *Reconciler) configChecksum(h Hasher, content []byte) string {
+	if r.Normalize {
+		if parsed, err := ParseUnitFile(bytes.NewReader(content)); err == nil {
+			content = []byte(parsed.Normalize())
+		}
+	}
+	return contentChecksum(h, content)
+}
+
+// Save writes the state of each reconciler if it has changed since the last save.
+func (s *StateStore) Save(reconcilers []*Reconciler) error {
+	file := &stateFile{Version: StateVersion, Algorithm: orDefault(s.Hasher).Name(), Units: map[string]map[string]string{}, Generations: map[string]int64{}, Durations: map[string]map[string][]int64{}, Queue: map[string][]*QueuedAction{}, Aliases: map[string]map[string][]string{}, Tombstones: map[string]map[string]time.Time{}}
+	tombstones := map[string]map[string]time.Time{}
+	for _, r := range reconcilers {
+		if orDefault(r.Hasher) != orDefault(s.Hasher) {
+			return fmt.Errorf("checksums of %s are computed with %s, but the state records %s", r.Src, orDefault(r.Hasher).Name(), orDefault(s.Hasher).Name())
+		}
+		r.mu.Lock()
+		units := make(map[string]string, len(r.State))
+		for unit, checksum := range r.State {
+			units[unit] = checksum
+		}
+		r.mu.Unlock()
+		file.Units[r.Src] = units
+		for unit := range units {
+			if _, err := os.Lstat(path.Join(r.Src, unit)); err == nil {
+				continue
+			}
+			since, ok := s.tombstones[r.Src][unit]
+			if !ok {
+				since = s.now().UTC().Truncate(time.Second)
+			}
+			if tombstones[r.Src] == nil {
+				tombstones[r.Src] = map[string]time.Time{}
+			}
+			tombstones[r.Src][unit] = since
+		}
+		if len(tombstones[r.Src]) > 0 {
+			file.Tombstones[r.Src] = tombstones[r.Src]
+		}
+		if generation := r.Generation(); generation > 0 {
+			file.Generations[r.Src] = generation
+		}
+		if queue := r.Queue(); len(queue) > 0 {
+			file.Queue[r.Src] = queue
+		}
+		if aliases := r.Aliases(); len(aliases) > 0 {
+			file.Aliases[r.Src] = aliases
+		}
+		if r.Durations != nil {
+			if samples := r.Durations.Samples(); len(samples) > 0 {
+				file.Durations[r.Src] = make(map[string][]int64, len(samples))
+				for unit, durations := range samples {
+					for _, duration := range durations {
+						file.Durations[r.Src][unit] = append(file.Durations[r.Src][unit], duration.Milliseconds())
+					}
+				}
+			}
+		}
+	}
+
+	buf, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(buf, s.last) {
+		return nil
+	}
+
+	content := buf
+	if s.Sealer != nil {
+		if content, err = s.Sealer.Seal(buf); err != nil {
+			return err
+		}
+	}
+	if err := WriteFileAtomic(s.Path, content); err != nil {
+		return err
+	}
+	s.last, s.tombstones = buf, tombstones
+	return nil
+}
+
+// WriteFileAtomic writes to a hidden temporary file next to the target and renames it into place,
+// so the reconciler never observes a partially written file.
+func WriteFileAtomic(name string, content []byte) error {
+	return WriteFileAtomicMode(name, content, 0644)
+}
+
+// WriteFileAtomicMode is WriteFileAtomic for files with the given mode, which the temporary file is created
+// with, so content like secrets is never readable by others, even while it's written.
+func WriteFileAtomicMode(name string, content []byte, mode os.FileMode) error {
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+	os.Remove(tmp) // left behind by a crash, possibly with another mode
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(mode) // regardless of the umask
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	r := &Reconciler{Src: "/units", State: map[string]string{"a.service": "abc"}}
+	r.SetGeneration(3)
+
+	store := &StateStore{Path: name}
+	require.NoError(t, store.Load([]*Reconciler{r})) // missing file is fine
+	require.NoError(t, store.Save([]*Reconciler{r}))
+
+	restored := &Reconciler{Src: "/units", State: map[string]string{}}
+	other := &Reconciler{Src: "/other", State: map[string]string{}}
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{restored, other}))
+	assert.Equal(t, r.State, restored.State)
+	assert.Equal(t, int64(3), restored.Generation())
+	assert.Empty(t, other.State)
+	assert.Zero(t, other.Generation())
+
+	// Unchanged state isn't rewritten
+	require.NoError(t, os.Remove(name))
+	require.NoError(t, store.Save([]*Reconciler{r}))
+	_, err := os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStateStoreDurations(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	r := &Reconciler{Src: "/units", State: map[string]string{"a.service": "abc"}, Durations: NewDurationTracker(0)}
+	r.Durations.Record("a.service", 1500*time.Millisecond)
+	r.Durations.Record("a.service", 2*time.Second)
+	require.NoError(t, (&StateStore{Path: name}).Save([]*Reconciler{r}))
+
+	restored := &Reconciler{Src: "/units", State: map[string]string{}, Durations: NewDurationTracker(0)}
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{restored}))
+	assert.Equal(t, map[string][]time.Duration{"a.service": {1500 * time.Millisecond, 2 * time.Second}}, restored.Durations.Samples())
+}
+
+func TestStateStoreInvalid(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, ioutil.WriteFile(name, []byte("not json"), 0644))
+	assert.Error(t, (&StateStore{Path: name}).Load(nil))
+}
+
+func TestStateRemovesUnitsDeletedWhileStopped(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "gone.service"), []byte("gone"), 0644))
+
+	name := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"units": {"`+src+`": {"gone.service": "abc"}}}`), 0644))
+
+	sysd := &fakeSystemd{}
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: sysd}
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{r}))
+
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, "EnsureStopped gone.service", sysd.LastCmd)
+	_, err := os.Stat(path.Join(dest, "gone.service"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStateStoreChangedAlgorithm(t *testing.T) {
+	dest := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "a.service"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dest, "b.service"), []byte("b"), 0644))
+
+	name := path.Join(t.TempDir(), "state.json")
+	sha := contentChecksum(Hashers["sha256"], []byte("a"))
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"units": {"/units": {"a.service": "`+sha+`", "b.service": "stale"}}}`), 0644))
+
+	r := &Reconciler{Src: "/units", Dest: dest, State: map[string]string{}, Hasher: Hashers["xxh64"]}
+	store := &StateStore{Path: name, Hasher: Hashers["xxh64"]}
+	require.NoError(t, store.Load([]*Reconciler{r}))
+	assert.Equal(t, map[string]string{
+		"a.service": contentChecksum(Hashers["xxh64"], []byte("a")),
+		"b.service": "stale", // doesn't match the applied file
+	}, r.State)
+
+	require.NoError(t, store.Save([]*Reconciler{r}))
+	buf, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), `"algorithm": "xxh64"`)
+	assert.Error(t, (&StateStore{Path: name}).Save([]*Reconciler{r}), "the state can't mix algorithms")
+
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"algorithm": "md5", "units": {}}`), 0644))
+	assert.Error(t, (&StateStore{Path: name}).Load([]*Reconciler{r}))
+}
+
+func TestStateStoreQueue(t *testing.T) {
+	defer func(fn func() string) { readBootID = fn }(readBootID)
+	readBootID = func() string { return "boot" }
+
+	name := path.Join(t.TempDir(), "state.json")
+	r := &Reconciler{Src: "/units", State: map[string]string{}, Guard: &ResourceGuard{}}
+	r.restoreQueue([]*QueuedAction{
+		{ID: "restart:a.service", Unit: "a.service", Action: "restart", Reason: "load", Since: time.Unix(100, 0).UTC()},
+		{ID: "reboot:b.service", Unit: "b.service", Action: "reboot", Reason: "sysinit", Since: time.Unix(200, 0).UTC(), Boot: "boot"},
+	})
+	require.NoError(t, (&StateStore{Path: name}).Save([]*Reconciler{r}))
+
+	restored := &Reconciler{Src: "/units", State: map[string]string{}, Guard: &ResourceGuard{}}
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{restored}))
+	assert.Equal(t, r.Queue(), restored.Queue())
+}
+
+func TestStateStoreAliases(t *testing.T) {
+	name := path.Join(t.TempDir(), "state.json")
+	r := &Reconciler{Src: "/units", State: map[string]string{"postgres.service": "abc"}, aliases: map[string][]string{"postgres.service": {"db.service"}}}
+	require.NoError(t, (&StateStore{Path: name}).Save([]*Reconciler{r}))
+
+	restored := &Reconciler{Src: "/units", State: map[string]string{}}
+	require.NoError(t, (&StateStore{Path: name}).Load([]*Reconciler{restored}))
+	assert.Equal(t, map[string][]string{"postgres.service": {"db.service"}}, restored.Aliases())
+	assert.Equal(t, "postgres.service", restored.aliasOf("db.service"))
+}
+
+func TestStateStoreTombstones(t *testing.T) {
+	src := t.TempDir()
+	name := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), nil, 0644))
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	r := &Reconciler{Src: src, State: map[string]string{"a.service": "abc", "gone.service": "def"}}
+	require.NoError(t, (&StateStore{Path: name, clock: clock}).Save([]*Reconciler{r}))
+
+	// Tombstones keep the time their unit was first found removed
+	now = now.Add(time.Hour * 24)
+	store := &StateStore{Path: name, clock: clock, TombstoneTTL: time.Hour * 48}
+	restored := &Reconciler{Src: src, State: map[string]string{}}
+	require.NoError(t, store.Load([]*Reconciler{restored}))
+	assert.Equal(t, r.State, restored.State)
+	restored.State["new.service"] = "ghi"
+	require.NoError(t, store.Save([]*Reconciler{restored}))
+
+	now = now.Add(time.Hour * 25)
+	restored = &Reconciler{Src: src, State: map[string]string{}}
+	require.NoError(t, (&StateStore{Path: name, clock: clock, TombstoneTTL: time.Hour * 48}).Load([]*Reconciler{restored}))
+	assert.Equal(t, map[string]string{"a.service": "abc", "new.service": "ghi"}, restored.State, "expired tombstones are forgotten")
+}
+
+func TestStateStoreVersions(t *testing.T) {
+	src := t.TempDir()
+	name := path.Join(t.TempDir(), "state.json")
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Units of version 1 files that were removed from src are dated to the file's last write
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"units": {"`+src+`": {"gone.service": "abc"}}}`), 0644))
+	require.NoError(t, os.Chtimes(name, now.Add(-time.Hour*24*90), now.Add(-time.Hour*24*90)))
+	r := &Reconciler{Src: src, State: map[string]string{}}
+	require.NoError(t, (&StateStore{Path: name, clock: func() time.Time { return now }, TombstoneTTL: time.Hour * 24 * 30}).Load([]*Reconciler{r}))
+	assert.Empty(t, r.State)
+
+	require.NoError(t, ioutil.WriteFile(name, []byte(`{"version": 99, "units": {}}`), 0644))
+	assert.EqualError(t, (&StateStore{Path: name}).Load([]*Reconciler{r}), "state file has schema version 99, but this version of unitmgr only supports up to 2")
+}
+
+func TestWriteFileAtomicMode(t *testing.T) {
+	dir := t.TempDir()
+	name := path.Join(dir, "secret.service")
+	require.NoError(t, ioutil.WriteFile(name, []byte("old"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, ".secret.service.tmp"), []byte("crashed"), 0644))
+
+	require.NoError(t, WriteFileAtomicMode(name, []byte("new"), 0600))
+	content, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	stat, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	assert.NoFileExists(t, path.Join(dir, ".secret.service.tmp"))
+}
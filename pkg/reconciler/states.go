@@ -0,0 +1,113 @@
+package reconciler
+
+import (
+	"log"
+	"time"
+)
+
+// UnitState is a step of a unit's reconciliation. Units move from PendingCopy through Copied and Reloading or
+// Restarting to Healthy, Failed, or Quarantined, and unchanged units stay in their state across syncs.
+type UnitState string
+
+const (
+	StatePendingCopy UnitState = "PendingCopy" // the file in Src differs from the applied one, e.g. while its restart is deferred
+	StateCopied      UnitState = "Copied"      // the file was written but not acted on yet
+	StateReloading   UnitState = "Reloading"
+	StateRestarting  UnitState = "Restarting" // including the first start of new units
+	StateHealthy     UnitState = "Healthy"
+	StateFailed      UnitState = "Failed"
+	StateQuarantined UnitState = "Quarantined" // held back by the policy, linter, or security check
+	StateRemoved     UnitState = "Removed"     // only seen by TransitionHooks
+)
+
+// UnitStatus is the current state of a unit.
+type UnitStatus struct {
+	State  UnitState `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Transition is a change of a unit's state.
+type Transition struct {
+	Unit     string
+	From, To UnitState // From is empty for units this instance hasn't seen before
+	Reason   string
+	Time     time.Time
+}
+
+// TransitionHook is called after every change of a unit's state, see Reconciler.OnState.
+// Hooks are called by the goroutine reconciling the unit, so they block its reconciliation.
+type TransitionHook func(t *Transition)
+
+// transition moves the unit to a new state, logging the change and calling the OnState hooks.
+// Nothing happens if the unit already is in the state.
+func (r *Reconciler) transition(unit string, to UnitState, reason string) {
+	r.mu.Lock()
+	var from UnitState
+	if current, ok := r.states[unit]; ok {
+		from = current.State
+	}
+	if from == to {
+		r.mu.Unlock()
+		return
+	}
+	t := &Transition{Unit: unit, From: from, To: to, Reason: reason, Time: time.Now()}
+	if to == StateRemoved {
+		delete(r.states, unit)
+	} else {
+		if r.states == nil {
+			r.states = map[string]*UnitStatus{}
+		}
+		r.states[unit] = &UnitStatus{State: to, Reason: reason, Since: t.Time}
+	}
+	r.mu.Unlock()
+
+	if reason != "" {
+		log.Printf("unit %s: %s -> %s: %s", unit, stateName(from), to, reason)
+	} else {
+		log.Printf("unit %s: %s -> %s", unit, stateName(from), to)
+	}
+	for _, hook := range r.OnState {
+		hook(t)
+	}
+}
+
+func stateName(state UnitState) string {
+	if state == "" {
+		return "Unknown"
+	}
+	return string(state)
+}
+
+// quarantine moves a unit that was held back to Quarantined, unless it failed to be checked. It's recorded as a
+// ValidationError, since the unit isn't applied and the sync didn't converge.
+func (r *Reconciler) quarantine(unit, reason string) {
+	r.mu.Lock()
+	_, failed := r.Failures[unit]
+	r.mu.Unlock()
+	if !failed {
+		r.record(unit, ValidationError, "unit %q was %s", unit, reason)
+		r.transition(unit, StateQuarantined, reason)
+	}
+}
+
+// healthy moves an applied unit to Healthy, or to Quarantined if the security check stopped it.
+func (r *Reconciler) healthy(unit string, secure bool) {
+	if !secure {
+		r.transition(unit, StateQuarantined, "security exposure exceeds the threshold")
+		return
+	}
+	r.transition(unit, StateHealthy, "")
+}
+
+// States returns the current state of every unit this instance reconciled.
+func (r *Reconciler) States() map[string]*UnitStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make(map[string]*UnitStatus, len(r.states))
+	for unit, status := range r.states {
+		copied := *status
+		states[unit] = &copied
+	}
+	return states
+}
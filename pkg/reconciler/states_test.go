@@ -0,0 +1,73 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitStates(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeSystemd{Errs: map[string]error{}}
+	r := &Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+
+	var mu sync.Mutex
+	var transitions []string
+	r.OnState = append(r.OnState, func(t *Transition) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, t.Unit+": "+string(t.From)+" -> "+string(t.To))
+	})
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		seen := transitions
+		transitions = nil
+		return seen
+	}
+
+	// New units are started
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service:  -> PendingCopy", "a.service: PendingCopy -> Copied", "a.service: Copied -> Restarting", "a.service: Restarting -> Healthy"}, reset())
+	assert.Equal(t, StateHealthy, r.States()["a.service"].State)
+
+	// Unchanged units stay in their state
+	require.True(t, r.Sync(context.Background()))
+	assert.Empty(t, reset())
+
+	// Changed units are restarted
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a2\n"), 0644))
+	sysd.Errs["a.service"] = errors.New("oops")
+	assert.False(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service: Healthy -> PendingCopy", "a.service: PendingCopy -> Copied", "a.service: Copied -> Restarting", "a.service: Restarting -> Failed"}, reset())
+	status := r.Report(false).States["a.service"]
+	assert.Equal(t, StateFailed, status.State)
+	assert.Contains(t, status.Reason, "oops")
+
+	delete(sysd.Errs, "a.service")
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service: Failed -> Healthy"}, reset())
+
+	// Units held back by the linter are quarantined
+	linter, err := NewLinter("strict", "")
+	require.NoError(t, err)
+	r.Linter = linter
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a3\n"), 0644))
+	assert.False(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service: Healthy -> PendingCopy", "a.service: PendingCopy -> Quarantined"}, reset())
+	assert.Equal(t, "rejected by the policy or linter", r.States()["a.service"].Reason)
+
+	// Removed units leave the state machine
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	assert.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service: Quarantined -> Removed"}, reset())
+	assert.Empty(t, r.States())
+}
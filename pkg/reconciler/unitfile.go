@@ -0,0 +1,156 @@
+package reconciler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// UnitFile is a parsed systemd unit file.
+type UnitFile struct {
+	Entries []UnitEntry
+}
+
+type UnitEntry struct {
+	Section string
+	Key     string
+	Value   string
+	Line    int
+}
+
+// ParseUnitFile parses the ini-like systemd unit file format.
+// See systemd.syntax(7) for the details.
+func ParseUnitFile(r io.Reader) (*UnitFile, error) {
+	u := &UnitFile{}
+	scanner := bufio.NewScanner(r)
+
+	var (
+		section  string
+		lineNum  int
+		pending  *UnitEntry
+		pendingN int
+	)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if pending != nil {
+			if strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue // comments are allowed within continued lines
+			}
+			if strings.HasSuffix(line, "\\") {
+				pending.Value += " " + strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+				continue
+			}
+			pending.Value += " " + line
+			pending.Value = strings.TrimSpace(pending.Value)
+			u.Entries = append(u.Entries, *pending)
+			pending = nil
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header", lineNum)
+			}
+			section = line[1 : len(line)-1]
+			continue
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("line %d: assignment outside of section", lineNum)
+		}
+
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected key=value", lineNum)
+		}
+		entry := UnitEntry{
+			Section: section,
+			Key:     strings.TrimSpace(line[:i]),
+			Value:   strings.TrimSpace(line[i+1:]),
+			Line:    lineNum,
+		}
+		if strings.HasSuffix(entry.Value, "\\") {
+			entry.Value = strings.TrimSpace(strings.TrimSuffix(entry.Value, "\\"))
+			pending = &entry
+			pendingN = lineNum
+			continue
+		}
+		u.Entries = append(u.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", pendingN)
+	}
+
+	return u, nil
+}
+
+// Values returns every value assigned to the given key.
+// Like systemd, an empty assignment resets the list.
+func (u *UnitFile) Values(section, key string) []string {
+	var vals []string
+	for _, entry := range u.Entries {
+		if entry.Section != section || entry.Key != key {
+			continue
+		}
+		if entry.Value == "" {
+			vals = nil
+			continue
+		}
+		vals = append(vals, entry.Value)
+	}
+	return vals
+}
+
+// Value returns the last value assigned to the given key.
+func (u *UnitFile) Value(section, key string) (string, bool) {
+	vals := u.Values(section, key)
+	if len(vals) == 0 {
+		return "", false
+	}
+	return vals[len(vals)-1], true
+}
+
+// HasSection returns true when the section is present and contains at least one entry.
+func (u *UnitFile) HasSection(section string) bool {
+	for _, entry := range u.Entries {
+		if entry.Section == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize returns the unit file without comments, blank lines, line continuations, or insignificant whitespace,
+// with its sections and keys in sorted order. Repeated keys keep their relative order since it's significant.
+func (u *UnitFile) Normalize() string {
+	entries := make([]UnitEntry, len(u.Entries))
+	copy(entries, u.Entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Section != entries[j].Section {
+			return entries[i].Section < entries[j].Section
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	b := &strings.Builder{}
+	var section string
+	for i, entry := range entries {
+		if i == 0 || entry.Section != section {
+			section = entry.Section
+			fmt.Fprintf(b, "[%s]\n", section)
+		}
+		fmt.Fprintf(b, "%s=%s\n", entry.Key, entry.Value)
+	}
+	return b.String()
+}
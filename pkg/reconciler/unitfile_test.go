@@ -0,0 +1,62 @@
+package reconciler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUnitFile(t *testing.T) {
+	file, err := ParseUnitFile(strings.NewReader(`
+# comment
+[Unit]
+Description=test unit
+
+[Service]
+ExecStart=/bin/foo \
+  --bar
+Environment=A=1
+Environment=
+Environment=B=2
+`))
+	require.NoError(t, err)
+
+	val, ok := file.Value("Unit", "Description")
+	assert.True(t, ok)
+	assert.Equal(t, "test unit", val)
+
+	val, _ = file.Value("Service", "ExecStart")
+	assert.Equal(t, "/bin/foo --bar", val)
+
+	assert.Equal(t, []string{"B=2"}, file.Values("Service", "Environment"))
+	assert.True(t, file.HasSection("Service"))
+	assert.False(t, file.HasSection("Install"))
+}
+
+func TestParseUnitFileErrors(t *testing.T) {
+	_, err := ParseUnitFile(strings.NewReader("Foo=bar"))
+	assert.EqualError(t, err, "line 1: assignment outside of section")
+
+	_, err = ParseUnitFile(strings.NewReader("[Unit]\nFoo"))
+	assert.EqualError(t, err, "line 2: expected key=value")
+
+	_, err = ParseUnitFile(strings.NewReader("[Unit\n"))
+	assert.EqualError(t, err, "line 1: invalid section header")
+}
+
+func TestNormalize(t *testing.T) {
+	a, err := ParseUnitFile(strings.NewReader("[Unit]\nDescription=test\n\n[Service]\nExecStart=/bin/foo\nUser=foo\nEnvironment=A=1\nEnvironment=B=2\n"))
+	require.NoError(t, err)
+	b, err := ParseUnitFile(strings.NewReader("# a comment\n[Service]\nUser = foo\nEnvironment=A=1\nExecStart=/bin/foo\n\nEnvironment=B=2\n[Unit]\nDescription=test  \n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "[Service]\nEnvironment=A=1\nEnvironment=B=2\nExecStart=/bin/foo\nUser=foo\n[Unit]\nDescription=test\n", a.Normalize())
+	assert.Equal(t, a.Normalize(), b.Normalize())
+
+	// The order of repeated keys is significant
+	c, err := ParseUnitFile(strings.NewReader("[Service]\nEnvironment=B=2\nEnvironment=A=1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nEnvironment=B=2\nEnvironment=A=1\n", c.Normalize())
+}
@@ -0,0 +1,133 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// DependencyLink is a symlink in a .wants or .requires directory, created by enabling a unit or by hand.
+type DependencyLink struct {
+	Name   string // relative to the destination, e.g. multi-user.target.wants/web.service
+	Target string // absolute, resolved against the link's directory if it's relative
+}
+
+// Unit returns the name of the unit the link adds as a dependency, which systemd takes from the link's name.
+func (l *DependencyLink) Unit() string {
+	return path.Base(l.Name)
+}
+
+// DependencyLister is implemented by Destinations that can list the symlinks in their .wants and .requires directories.
+// They're unlinked with Linker.
+type DependencyLister interface {
+	DependencyLinks() ([]*DependencyLink, error)
+}
+
+func (l *LocalDir) DependencyLinks() ([]*DependencyLink, error) {
+	dirs, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var links []*DependencyLink
+	for _, dir := range dirs {
+		if !dir.IsDir() || !(strings.HasSuffix(dir.Name(), ".wants") || strings.HasSuffix(dir.Name(), ".requires")) {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(l.Dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			target, err := os.Readlink(path.Join(l.Dir, dir.Name(), file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(l.Dir, dir.Name(), target)
+			}
+			links = append(links, &DependencyLink{Name: path.Join(dir.Name(), file.Name()), Target: path.Clean(target)})
+		}
+	}
+	return links, nil
+}
+
+// DependencyLinks lists the links of the Default root, where persistent units are enabled.
+func (d *RootDirs) DependencyLinks() ([]*DependencyLink, error) {
+	return d.defaultRoot().DependencyLinks()
+}
+
+// dependencyLinks returns the .wants and .requires links into the destination's unit directory,
+// or false if it can't list and unlink them. Links to unit files elsewhere, e.g. of vendor units,
+// don't correspond to units unitmgr manages.
+func (r *Reconciler) dependencyLinks() ([]*DependencyLink, Linker, bool) {
+	lister, ok := r.target().(DependencyLister)
+	linker, linkable := r.target().(Linker)
+	if !ok || !linkable {
+		return nil, nil, false
+	}
+	all, err := lister.DependencyLinks()
+	if err != nil {
+		log.Printf("error while listing the .wants and .requires links of %s: %s", r.Dest, err)
+		return nil, nil, false
+	}
+
+	dest := r.Dest
+	if roots, ok := r.target().(*RootDirs); ok {
+		dest = roots.Default
+	}
+	var links []*DependencyLink
+	for _, link := range all {
+		if path.Dir(link.Target) == path.Clean(dest) {
+			links = append(links, link)
+		}
+	}
+	return links, linker, true
+}
+
+// unlinkDependencies removes the .wants and .requires links of a removed unit, so they don't dangle.
+func (r *Reconciler) unlinkDependencies(unit string) error {
+	links, linker, ok := r.dependencyLinks()
+	if !ok {
+		return nil
+	}
+	for _, link := range links {
+		if link.Unit() != unit && path.Base(link.Target) != unit {
+			continue
+		}
+		if err := linker.Unlink(link.Name); err != nil {
+			return err
+		}
+		log.Printf("removed link %s of unit %s", link.Name, unit)
+	}
+	return nil
+}
+
+// pruneDependencies removes the .wants and .requires links into the destination whose unit files are gone,
+// e.g. when they were made by hand or by enabling units that were removed while unitmgr wasn't running.
+func (r *Reconciler) pruneDependencies() {
+	links, linker, ok := r.dependencyLinks()
+	if !ok {
+		return
+	}
+	for _, link := range links {
+		if _, err := os.Stat(link.Target); !os.IsNotExist(err) {
+			continue
+		}
+		r.mu.Lock()
+		_, managed := r.State[link.Unit()]
+		r.mu.Unlock()
+		if managed {
+			continue // its unit file was removed out of band and is written again
+		}
+		if err := linker.Unlink(link.Name); err != nil {
+			log.Printf("error while removing dangling link %s: %s", link.Name, err)
+			continue
+		}
+		log.Printf("removed dangling link %s", link.Name)
+	}
+}
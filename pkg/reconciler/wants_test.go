@@ -0,0 +1,70 @@
+package reconciler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalDirDependencyLinks(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "multi-user.target.wants"), 0755))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "network.target.requires"), 0755))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "web.service.d"), 0755))
+	require.NoError(t, os.Symlink(path.Join(dir, "a.service"), path.Join(dir, "multi-user.target.wants", "a.service")))
+	require.NoError(t, os.Symlink("../b.service", path.Join(dir, "network.target.requires", "b.service")))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "multi-user.target.wants", "notes"), nil, 0644))
+	require.NoError(t, os.Symlink("../c.service", path.Join(dir, "web.service.d", "c.service")))
+
+	links, err := (&LocalDir{Dir: dir}).DependencyLinks()
+	require.NoError(t, err)
+	assert.Equal(t, []*DependencyLink{
+		{Name: "multi-user.target.wants/a.service", Target: path.Join(dir, "a.service")},
+		{Name: "network.target.requires/b.service", Target: path.Join(dir, "b.service")},
+	}, links)
+	assert.Equal(t, "b.service", links[1].Unit())
+}
+
+func TestDependencyLinks(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	r := &Reconciler{Src: src, Dest: dest, State: map[string]string{}, Systemd: &fakeSystemd{}}
+	wants := path.Join(dest, "multi-user.target.wants")
+	require.NoError(t, os.MkdirAll(wants, 0755))
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "a.service"), []byte("[Service]\nExecStart=/bin/a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "b.service"), []byte("[Service]\nExecStart=/bin/b\n"), 0644))
+	require.True(t, r.Sync(context.Background()))
+
+	// Links made by enabling the units, by hand, and to units elsewhere
+	require.NoError(t, os.Symlink(path.Join(dest, "a.service"), path.Join(wants, "a.service")))
+	require.NoError(t, os.Symlink("../b.service", path.Join(wants, "b.service")))
+	require.NoError(t, os.Symlink(path.Join(dest, "gone.service"), path.Join(wants, "gone.service")))
+	require.NoError(t, os.Symlink("/lib/systemd/system/vendor.service", path.Join(wants, "vendor.service")))
+
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"a.service", "b.service", "vendor.service"}, readLinks(t, wants), "dangling links into dest are pruned")
+
+	require.NoError(t, os.Remove(path.Join(src, "a.service")))
+	require.True(t, r.Sync(context.Background()))
+	assert.Equal(t, []string{"b.service", "vendor.service"}, readLinks(t, wants), "links of removed units are removed")
+
+	// Links of applied units whose files were removed out of band are kept, since the files are written again
+	require.NoError(t, os.Remove(path.Join(dest, "b.service")))
+	r.pruneDependencies()
+	assert.Equal(t, []string{"b.service", "vendor.service"}, readLinks(t, wants))
+}
+
+func readLinks(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
@@ -0,0 +1,81 @@
+package systemd
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Compose manages a compose project for each compose file in Dir with `docker compose` or `podman compose`.
+// Containers are created by the first sync, recreated when their definition changes, and removed with the file.
+type Compose struct {
+	initCommand
+	Dir string
+}
+
+// NewCompose returns the compose adapter using the given container engine's cli, e.g. docker or podman.
+func NewCompose(engine string, cfg *Config) *Compose {
+	return &Compose{initCommand: newInitCommand(engine, cfg), Dir: cfg.Dir}
+}
+
+// Restart recreates the containers whose definition changed, leaving the others running.
+func (c *Compose) Restart(ctx context.Context, unit string) error {
+	return c.exec(ctx, c.StartTimeout, c.args(unit, "up", "--detach", "--remove-orphans")...)
+}
+
+func (c *Compose) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	running, err := c.isRunning(ctx, unit)
+	if err != nil {
+		return false, err
+	}
+	if running {
+		return false, nil // already running
+	}
+	return true, c.Restart(ctx, unit)
+}
+
+func (c *Compose) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	out, err := c.output(ctx, c.QueryTimeout, c.args(unit, "ps", "--all", "--quiet")...)
+	if err == nil && len(strings.TrimSpace(string(out))) == 0 {
+		return false, nil // no containers
+	}
+	return true, c.exec(ctx, c.StopTimeout, c.args(unit, "down", "--remove-orphans")...)
+}
+
+// isRunning returns true when every service of the project has a running container.
+func (c *Compose) isRunning(ctx context.Context, unit string) (bool, error) {
+	if err := c.exec(ctx, c.QueryTimeout, c.args(unit, "config", "--quiet")...); err != nil {
+		return false, err // invalid compose file
+	}
+	services, err := c.query(ctx, c.QueryTimeout, c.args(unit, "config", "--services")...)
+	if err != nil {
+		return false, err
+	}
+	running, err := c.query(ctx, c.QueryTimeout, c.args(unit, "ps", "--services", "--status", "running")...)
+	if err != nil {
+		return false, err // e.g. the engine isn't running, which up wouldn't fix
+	}
+	return sortedLines(services) == sortedLines(running), nil
+}
+
+func (c *Compose) args(unit string, args ...string) []string {
+	return append([]string{"compose", "--project-name", projectName(unit), "--file", path.Join(c.Dir, unit)}, args...)
+}
+
+// projectName derives a valid compose project name from the name of a compose file.
+func projectName(unit string) string {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(unit, ".yml"), ".yaml"))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+func sortedLines(buf []byte) string {
+	lines := strings.Fields(string(buf))
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,50 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompose(t *testing.T) {
+	dir := t.TempDir()
+	c := &Compose{initCommand: newInitCommand(fakeCommand(t, dir, "web"), &Config{Timeout: time.Second * 5}), Dir: "/etc/unitmgr/compose"}
+
+	// Every service is running
+	changed, err := c.EnsureRunning(context.Background(), "My App.yml")
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	prefix := "compose --project-name my-app --file /etc/unitmgr/compose/My App.yml "
+	assert.Equal(t, prefix+"config --quiet\n"+prefix+"config --services\n"+prefix+"ps --services --status running\n", readCalls(t, dir))
+
+	require.NoError(t, os.Remove(path.Join(dir, "calls")))
+	changed, err = c.EnsureStopped(context.Background(), "My App.yml")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, prefix+"ps --all --quiet\n"+prefix+"down --remove-orphans\n", readCalls(t, dir))
+}
+
+func TestComposeEngineError(t *testing.T) {
+	dir := t.TempDir()
+	name := path.Join(dir, "fake")
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/calls\ncase \"$*\" in *ps*) echo 'cannot connect to the engine'; exit 1;; esac\necho web\n"
+	require.NoError(t, ioutil.WriteFile(name, []byte(script), 0755))
+	c := &Compose{initCommand: newInitCommand(name, &Config{Timeout: time.Second * 5}), Dir: "/etc/unitmgr/compose"}
+
+	// The project isn't brought up when its state can't be queried
+	_, err := c.EnsureRunning(context.Background(), "web.yml")
+	assert.EqualError(t, err, "fake error msg: cannot connect to the engine")
+	assert.NotContains(t, readCalls(t, dir), " up ")
+}
+
+func TestProjectName(t *testing.T) {
+	assert.Equal(t, "web", projectName("web.yaml"))
+	assert.Equal(t, "my_app-2", projectName("My_App.2.yml"))
+}
@@ -0,0 +1,280 @@
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of an init system adapter.
+type Config struct {
+	Dir           string // directory of the service files
+	Host          string // only supported by systemd
+	Timeout       time.Duration
+	QueryTimeout  time.Duration
+	StartTimeout  time.Duration
+	StopTimeout   time.Duration
+	ReloadTimeout time.Duration
+	Prefix        []string // optional, prepended to every command for privilege escalation, e.g. sudo -n
+	JobMode       string   // only supported by systemd, see Systemctl
+}
+
+// NewSystemctl returns the systemd adapter, retrying transient failures a few times.
+func NewSystemctl(cfg *Config) *Systemctl {
+	return &Systemctl{
+		Timeout:       cfg.Timeout,
+		QueryTimeout:  cfg.QueryTimeout,
+		StartTimeout:  cfg.StartTimeout,
+		StopTimeout:   cfg.StopTimeout,
+		ReloadTimeout: cfg.ReloadTimeout,
+		Host:          cfg.Host,
+		Prefix:        cfg.Prefix,
+		JobMode:       cfg.JobMode,
+		Retries:       3,
+		RetryDelay:    time.Millisecond * 250,
+	}
+}
+
+// NewOpenRC returns the OpenRC adapter.
+func NewOpenRC(cfg *Config) *OpenRC {
+	return &OpenRC{initCommand: newInitCommand("rc-service", cfg)}
+}
+
+// NewRunit returns the runit adapter for services linked into /var/service.
+func NewRunit(cfg *Config) *Runit {
+	return &Runit{initCommand: newInitCommand("sv", cfg), ServiceDir: "/var/service"}
+}
+
+// NewSupervisord returns the supervisord adapter.
+func NewSupervisord(cfg *Config) *Supervisord {
+	return &Supervisord{initCommand: newInitCommand("supervisorctl", cfg)}
+}
+
+// NewLaunchd returns the launchd adapter for system daemons.
+func NewLaunchd(cfg *Config) *Launchd {
+	return &Launchd{initCommand: newInitCommand("launchctl", cfg), Dir: cfg.Dir, Domain: "system"}
+}
+
+// initCommand runs the command line tool of an init system.
+type initCommand struct {
+	Command                                 string
+	Prefix                                  []string // optional
+	QueryTimeout, StartTimeout, StopTimeout time.Duration
+}
+
+func newInitCommand(command string, cfg *Config) initCommand {
+	c := initCommand{Command: command, Prefix: cfg.Prefix, QueryTimeout: cfg.QueryTimeout, StartTimeout: cfg.StartTimeout, StopTimeout: cfg.StopTimeout}
+	for _, d := range []*time.Duration{&c.QueryTimeout, &c.StartTimeout, &c.StopTimeout} {
+		if *d <= 0 {
+			*d = cfg.Timeout
+		}
+	}
+	return c
+}
+
+func (c *initCommand) output(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	ctx, done := context.WithTimeout(ctx, timeout)
+	defer done()
+	return prefixed(ctx, c.Prefix, c.Command, args...).CombinedOutput()
+}
+
+func (c *initCommand) exec(ctx context.Context, timeout time.Duration, args ...string) error {
+	_, err := c.query(ctx, timeout, args...)
+	return err
+}
+
+// query returns the output of the command, or an error holding the output if it fails.
+func (c *initCommand) query(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	out, err := c.output(ctx, timeout, args...)
+	if err == nil {
+		return out, nil
+	}
+	if len(out) > 0 {
+		return nil, fmt.Errorf("%s error msg: %s", path.Base(c.Command), bytes.TrimSpace(out))
+	}
+	return nil, fmt.Errorf("%s error: %w", path.Base(c.Command), err)
+}
+
+// OpenRC manages the init scripts in /etc/init.d with rc-service.
+type OpenRC struct {
+	initCommand
+}
+
+func (o *OpenRC) Restart(ctx context.Context, unit string) error {
+	return o.exec(ctx, o.StartTimeout, unit, "restart")
+}
+
+func (o *OpenRC) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	if o.isRunning(ctx, unit) {
+		return false, nil // already running
+	}
+	return true, o.exec(ctx, o.StartTimeout, unit, "start")
+}
+
+func (o *OpenRC) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	if !o.isRunning(ctx, unit) {
+		return false, nil // already stopped
+	}
+	return true, o.exec(ctx, o.StopTimeout, unit, "stop")
+}
+
+func (o *OpenRC) isRunning(ctx context.Context, unit string) bool {
+	_, err := o.output(ctx, o.QueryTimeout, unit, "status")
+	return err == nil
+}
+
+// Runit manages service directories linked into ServiceDir with sv.
+// Units are run scripts, see reconciler.RunitDir.
+type Runit struct {
+	initCommand
+	ServiceDir string
+}
+
+func (r *Runit) Restart(ctx context.Context, unit string) error {
+	return r.exec(ctx, r.StartTimeout, "restart", path.Join(r.ServiceDir, unit))
+}
+
+// EnsureRunning fails until runsvdir has picked up a newly linked service, which takes up to five seconds.
+// The unit is retried with the usual backoff in the meantime.
+func (r *Runit) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	if r.isRunning(ctx, unit) {
+		return false, nil // already running
+	}
+	return true, r.exec(ctx, r.StartTimeout, "up", path.Join(r.ServiceDir, unit))
+}
+
+func (r *Runit) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	if !r.isRunning(ctx, unit) {
+		return false, nil // already stopped
+	}
+	return true, r.exec(ctx, r.StopTimeout, "down", path.Join(r.ServiceDir, unit))
+}
+
+func (r *Runit) isRunning(ctx context.Context, unit string) bool {
+	out, err := r.output(ctx, r.QueryTimeout, "status", path.Join(r.ServiceDir, unit))
+	return err == nil && bytes.HasPrefix(out, []byte("run:"))
+}
+
+// Supervisord manages the programs configured by <name>.conf files with supervisorctl.
+// Each file is expected to configure a single program with the same name.
+type Supervisord struct {
+	initCommand
+}
+
+func (s *Supervisord) Restart(ctx context.Context, unit string) error {
+	if err := s.update(ctx, unit); err != nil {
+		return err
+	}
+	return s.exec(ctx, s.StartTimeout, "restart", programName(unit))
+}
+
+func (s *Supervisord) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	if s.isRunning(ctx, unit) {
+		return false, nil // already running
+	}
+	if err := s.update(ctx, unit); err != nil {
+		return false, err
+	}
+	if s.isRunning(ctx, unit) {
+		return true, nil // started by the update
+	}
+	return true, s.exec(ctx, s.StartTimeout, "start", programName(unit))
+}
+
+func (s *Supervisord) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	if !s.isRunning(ctx, unit) {
+		return false, nil // already stopped
+	}
+	return true, s.exec(ctx, s.StopTimeout, "stop", programName(unit))
+}
+
+// update loads the current configuration of the program, similar to systemd's daemon-reload.
+func (s *Supervisord) update(ctx context.Context, unit string) error {
+	if err := s.exec(ctx, s.QueryTimeout, "reread"); err != nil {
+		return err
+	}
+	return s.exec(ctx, s.StartTimeout, "update", programName(unit))
+}
+
+func (s *Supervisord) isRunning(ctx context.Context, unit string) bool {
+	out, _ := s.output(ctx, s.QueryTimeout, "status", programName(unit))
+	return bytes.Contains(out, []byte("RUNNING"))
+}
+
+func programName(unit string) string {
+	return strings.TrimSuffix(unit, ".conf")
+}
+
+// Launchd manages the jobs configured by <label>.plist files in Dir with launchctl.
+type Launchd struct {
+	initCommand
+	Dir    string
+	Domain string // e.g. system
+}
+
+func (l *Launchd) Restart(ctx context.Context, unit string) error {
+	// Jobs must be reloaded to pick up changes to their plist
+	if l.isLoaded(ctx, unit) {
+		if err := l.exec(ctx, l.StopTimeout, "bootout", l.target(unit)); err != nil {
+			return err
+		}
+	}
+	return l.start(ctx, unit)
+}
+
+func (l *Launchd) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	if l.isRunning(ctx, unit) {
+		return false, nil // already running
+	}
+	return true, l.start(ctx, unit)
+}
+
+func (l *Launchd) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	if !l.isLoaded(ctx, unit) {
+		return false, nil // already stopped
+	}
+	return true, l.exec(ctx, l.StopTimeout, "bootout", l.target(unit))
+}
+
+func (l *Launchd) start(ctx context.Context, unit string) error {
+	if !l.isLoaded(ctx, unit) {
+		if err := l.exec(ctx, l.StartTimeout, "bootstrap", l.Domain, path.Join(l.Dir, unit)); err != nil {
+			return err
+		}
+	}
+	return l.exec(ctx, l.StartTimeout, "kickstart", l.target(unit))
+}
+
+func (l *Launchd) isLoaded(ctx context.Context, unit string) bool {
+	_, err := l.output(ctx, l.QueryTimeout, "print", l.target(unit))
+	return err == nil
+}
+
+func (l *Launchd) isRunning(ctx context.Context, unit string) bool {
+	out, err := l.output(ctx, l.QueryTimeout, "print", l.target(unit))
+	return err == nil && bytes.Contains(out, []byte("state = running"))
+}
+
+func (l *Launchd) target(unit string) string {
+	return l.Domain + "/" + strings.TrimSuffix(unit, ".plist")
+}
+
+// prefixed returns the command, run through the prefix command if one is given.
+func prefixed(ctx context.Context, prefix []string, command string, args ...string) *exec.Cmd {
+	if len(prefix) == 0 {
+		return exec.CommandContext(ctx, command, args...)
+	}
+	args = append(append(append([]string{}, prefix[1:]...), command), args...)
+	return exec.CommandContext(ctx, prefix[0], args...)
+}
+
+// Noop doesn't manage services, for hosts where unit files are only synced, like containers and images.
+type Noop struct{}
+
+func (Noop) Restart(ctx context.Context, unit string) error               { return nil }
+func (Noop) EnsureRunning(ctx context.Context, unit string) (bool, error) { return false, nil }
+func (Noop) EnsureStopped(ctx context.Context, unit string) (bool, error) { return false, nil }
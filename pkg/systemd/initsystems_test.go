@@ -0,0 +1,78 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommand writes a script that records its arguments and exits with the status in <dir>/status (if any).
+func fakeCommand(t *testing.T, dir, output string) string {
+	name := path.Join(dir, "fake")
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/calls\necho '" + output + "'\nexit $(cat " + dir + "/status 2>/dev/null || echo 0)\n"
+	require.NoError(t, ioutil.WriteFile(name, []byte(script), 0755))
+	return name
+}
+
+func readCalls(t *testing.T, dir string) string {
+	calls, err := ioutil.ReadFile(path.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	require.NoError(t, err)
+	return string(calls)
+}
+
+func TestOpenRC(t *testing.T) {
+	dir := t.TempDir()
+	o := &OpenRC{initCommand: newInitCommand(fakeCommand(t, dir, ""), &Config{Timeout: time.Second * 5})}
+
+	// Running
+	changed, err := o.EnsureRunning(context.Background(), "nginx")
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "nginx status\n", readCalls(t, dir))
+
+	require.NoError(t, o.Restart(context.Background(), "nginx"))
+	assert.Equal(t, "nginx status\nnginx restart\n", readCalls(t, dir))
+
+	// Stopped
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "status"), []byte("3"), 0644))
+	changed, err = o.EnsureStopped(context.Background(), "nginx")
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestRunit(t *testing.T) {
+	dir := t.TempDir()
+	r := &Runit{initCommand: newInitCommand(fakeCommand(t, dir, "down: /var/service/web: 1s"), &Config{Timeout: time.Second * 5}), ServiceDir: "/var/service"}
+
+	changed, err := r.EnsureRunning(context.Background(), "web")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "status /var/service/web\nup /var/service/web\n", readCalls(t, dir))
+}
+
+func TestSupervisord(t *testing.T) {
+	dir := t.TempDir()
+	s := &Supervisord{initCommand: newInitCommand(fakeCommand(t, dir, "worker STOPPED"), &Config{Timeout: time.Second * 5})}
+
+	changed, err := s.EnsureRunning(context.Background(), "worker.conf")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "status worker\nreread\nupdate worker\nstatus worker\nstart worker\n", readCalls(t, dir))
+}
+
+func TestLaunchd(t *testing.T) {
+	dir := t.TempDir()
+	l := &Launchd{initCommand: newInitCommand(fakeCommand(t, dir, "state = waiting"), &Config{Timeout: time.Second * 5}), Dir: "/Library/LaunchDaemons", Domain: "system"}
+
+	require.NoError(t, l.Restart(context.Background(), "com.example.agent.plist"))
+	assert.Equal(t, "print system/com.example.agent\nbootout system/com.example.agent\nprint system/com.example.agent\nkickstart system/com.example.agent\n", readCalls(t, dir))
+}
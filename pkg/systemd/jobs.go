@@ -0,0 +1,92 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Job is a job queued by systemd for a unit, e.g. by a manual systemctl stop.
+type Job struct {
+	ID    string
+	Unit  string
+	Type  string // start, stop, restart, reload, ...
+	State string // waiting or running
+}
+
+// JobConflictError is returned when a unit has a conflicting job that wasn't waited for or replaced.
+type JobConflictError struct {
+	Job *Job
+}
+
+func (e *JobConflictError) Error() string {
+	return fmt.Sprintf("unit %s already has a %s %s job (id %s)", e.Job.Unit, e.Job.State, e.Job.Type, e.Job.ID)
+}
+
+// jobPollInterval is how often queued jobs are checked while waiting for them.
+var jobPollInterval = time.Millisecond * 500
+
+// queuedJob returns the job systemd has queued for the unit, or nil if there isn't one.
+func (s *Systemctl) queuedJob(ctx context.Context, unit string) (*Job, error) {
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "list-jobs", "--no-legend", "--full", unit)
+	if err != nil {
+		return nil, fmt.Errorf("listing jobs: %s", strings.TrimSpace(string(out)))
+	}
+	return parseJob(string(out), unit), nil
+}
+
+func parseJob(out, unit string) *Job {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == unit {
+			return &Job{ID: fields[0], Unit: fields[1], Type: fields[2], State: fields[3]}
+		}
+	}
+	return nil
+}
+
+// resolveJobs handles the jobs already queued for a unit according to JobMode before queueing another one.
+// It returns the flags of the systemctl command queueing the new job.
+func (s *Systemctl) resolveJobs(ctx context.Context, unit string, timeout time.Duration) ([]string, error) {
+	switch s.JobMode {
+	case "replace":
+		return []string{"--job-mode=replace"}, nil
+	case "fail":
+		job, err := s.queuedJob(ctx, unit)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return nil, &JobConflictError{Job: job}
+		}
+		return []string{"--job-mode=fail"}, nil
+	}
+
+	// Wait for the queued job to finish, it's likely to be a deliberate manual operation
+	deadline := time.Now().Add(timeout)
+	var waited *Job
+	for {
+		job, err := s.queuedJob(ctx, unit)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			if waited != nil {
+				log.Printf("waited for %s job of unit %s to finish", waited.Type, unit)
+			}
+			return nil, nil
+		}
+		waited = job
+		if time.Now().After(deadline) {
+			return nil, &JobConflictError{Job: job}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJob(t *testing.T) {
+	out := "12 other.service start waiting\n13 test.service stop running\n"
+	assert.Equal(t, &Job{ID: "13", Unit: "test.service", Type: "stop", State: "running"}, parseJob(out, "test.service"))
+	assert.Nil(t, parseJob(out, "missing.service"))
+	assert.Nil(t, parseJob("", "test.service"))
+}
+
+// jobsCommand writes a fake systemctl listing a stop job for test.service the first n times jobs are listed.
+func jobsCommand(t *testing.T, dir string, n int) string {
+	name := path.Join(dir, "systemctl")
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/calls\n" +
+		"if [ \"$1\" = list-jobs ]; then echo x >> " + dir + "/listed; " +
+		"if [ $(wc -l < " + dir + "/listed) -le " + strconv.Itoa(n) + " ]; then echo '7 test.service stop running'; fi; fi\n"
+	require.NoError(t, ioutil.WriteFile(name, []byte(script), 0755))
+	return name
+}
+
+func TestResolveJobs(t *testing.T) {
+	defer func(d time.Duration) { jobPollInterval = d }(jobPollInterval)
+	jobPollInterval = time.Millisecond
+
+	t.Run("wait", func(t *testing.T) {
+		dir := t.TempDir()
+		s := &Systemctl{Timeout: time.Second * 5, Command: jobsCommand(t, dir, 2)}
+		_, err := s.EnsureStopped(context.Background(), "test.service")
+		require.NoError(t, err)
+		assert.Equal(t, "is-active --quiet test.service\nlist-jobs --no-legend --full test.service\nlist-jobs --no-legend --full test.service\nlist-jobs --no-legend --full test.service\nstop test.service\n", readCalls(t, dir))
+	})
+
+	t.Run("wait timeout", func(t *testing.T) {
+		s := &Systemctl{Timeout: time.Second * 5, Command: jobsCommand(t, t.TempDir(), 9)}
+		_, err := s.resolveJobs(context.Background(), "test.service", time.Millisecond)
+
+		conflict := &JobConflictError{}
+		require.True(t, errors.As(err, &conflict))
+		assert.Equal(t, "unit test.service already has a running stop job (id 7)", err.Error())
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		dir := t.TempDir()
+		s := &Systemctl{Timeout: time.Second * 5, Command: jobsCommand(t, dir, 9), JobMode: "replace"}
+		require.NoError(t, s.Restart(context.Background(), "test.service"))
+		assert.Equal(t, "daemon-reload\n--job-mode=replace restart test.service\n", readCalls(t, dir))
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		s := &Systemctl{Timeout: time.Second * 5, Command: jobsCommand(t, t.TempDir(), 9), JobMode: "fail"}
+		err := s.Restart(context.Background(), "test.service")
+		assert.IsType(t, &JobConflictError{}, err)
+
+		dir := t.TempDir()
+		s.Command = jobsCommand(t, dir, 0)
+		require.NoError(t, s.Restart(context.Background(), "test.service"))
+		assert.Contains(t, readCalls(t, dir), "--job-mode=fail restart test.service\n")
+	})
+}
@@ -0,0 +1,449 @@
+// Package systemd controls services through the command line tools of systemd and other init systems.
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Systemctl struct {
+	Timeout       time.Duration                   // default for operations without a specific timeout
+	QueryTimeout  time.Duration                   // optional, for is-active checks
+	StartTimeout  time.Duration                   // optional, for starts and restarts
+	StopTimeout   time.Duration                   // optional, for stops since ExecStop may legitimately take minutes
+	ReloadTimeout time.Duration                   // optional, for daemon-reloads
+	Host          string                          // optional, operate on a remote host with systemctl -H
+	Command       string                          // defaults to systemctl
+	Prefix        []string                        // optional, prepended to every command for privilege escalation, e.g. sudo -n
+	Retries       int                             // optional, number of times transient failures are retried
+	RetryDelay    time.Duration                   // delay before the first retry, doubled after each one
+	JobMode       string                          // what to do when a unit already has a queued job: wait (default) for it to finish, replace it, or fail
+	UnitTimeout   func(unit string) time.Duration // optional, overrides StartTimeout for the units it returns a non-zero timeout for
+
+	reloadMu sync.Mutex // serializes daemon-reloads when units are restarted concurrently
+}
+
+func (s *Systemctl) Restart(ctx context.Context, unit string) error {
+	if err := s.daemonReload(ctx); err != nil {
+		return err
+	}
+	return s.queue(ctx, s.startTimeout(unit), "restart", unit)
+}
+
+// Reload reloads the unit files, then reloads the unit if it's running and supports reloading.
+func (s *Systemctl) Reload(ctx context.Context, unit string) error {
+	if err := s.daemonReload(ctx); err != nil {
+		return err
+	}
+
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "show", "--property=CanReload", unit)
+	if err != nil || strings.TrimSpace(string(out)) != "CanReload=yes" || !s.isRunning(ctx, unit) {
+		return nil
+	}
+	return s.exec(ctx, s.timeout(s.StartTimeout), "reload", unit)
+}
+
+// Reenable reloads the unit files and recreates the unit's symlinks according to its [Install] section.
+func (s *Systemctl) Reenable(ctx context.Context, unit string) error {
+	if err := s.daemonReload(ctx); err != nil {
+		return err
+	}
+	return s.exec(ctx, s.Timeout, "reenable", unit)
+}
+
+func (s *Systemctl) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	if s.isRunning(ctx, unit) {
+		return false, nil // already running
+	}
+
+	return true, s.queue(ctx, s.startTimeout(unit), "restart", unit)
+}
+
+func (s *Systemctl) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	if !s.isRunning(ctx, unit) {
+		return false, nil // already stopped
+	}
+
+	return true, s.queue(ctx, s.timeout(s.StopTimeout), "stop", unit)
+}
+
+// queue runs a systemctl command queueing a job for the unit, after handling the jobs it already has.
+func (s *Systemctl) queue(ctx context.Context, timeout time.Duration, command, unit string) error {
+	flags, err := s.resolveJobs(ctx, unit, timeout)
+	if err != nil {
+		return err
+	}
+	args := append(flags, command, unit)
+	err = s.exec(ctx, timeout, args...)
+	if err == nil || command == "stop" || !s.startLimitHit(ctx, unit) {
+		return err
+	}
+
+	// systemd refuses to start units that hit their StartLimitBurst until their failed state is reset
+	log.Printf("unit %s hit its start limit, resetting it before retrying", unit)
+	if err := s.exec(ctx, s.timeout(s.QueryTimeout), "reset-failed", unit); err != nil {
+		return err
+	}
+	return s.exec(ctx, timeout, args...)
+}
+
+// startLimitHit returns true if the unit's last start was refused because it was started too often.
+func (s *Systemctl) startLimitHit(ctx context.Context, unit string) bool {
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "show", "--property=Result", unit)
+	return err == nil && strings.TrimSpace(string(out)) == "Result=start-limit-hit"
+}
+
+// Forget reloads the unit files after a unit's file was removed and resets its failed state,
+// so removed units don't linger in systemctl --failed.
+func (s *Systemctl) Forget(ctx context.Context, unit string) error {
+	if err := s.daemonReload(ctx); err != nil {
+		return err
+	}
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "reset-failed", unit)
+	if err != nil && !bytes.Contains(out, []byte("not loaded")) {
+		return fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return nil
+}
+
+// Enable reloads the unit files and enables the unit to be started on boot.
+func (s *Systemctl) Enable(ctx context.Context, unit string) error {
+	if err := s.daemonReload(ctx); err != nil {
+		return err
+	}
+	return s.exec(ctx, s.Timeout, "enable", unit)
+}
+
+// Disable removes the unit's symlinks, so it's no longer started on boot.
+func (s *Systemctl) Disable(ctx context.Context, unit string) error {
+	return s.exec(ctx, s.Timeout, "disable", unit)
+}
+
+// DaemonReload reloads the configuration of every unit, e.g. after their files or drop-ins were edited out of band.
+func (s *Systemctl) DaemonReload(ctx context.Context) error {
+	return s.daemonReload(ctx)
+}
+
+// daemonReload reloads the unit files, serialized since units are reconciled concurrently.
+func (s *Systemctl) daemonReload(ctx context.Context) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.exec(ctx, s.timeout(s.ReloadTimeout), "daemon-reload")
+}
+
+// DaemonReexec re-executes the systemd manager, e.g. to run its binary after a package upgrade replaced it.
+func (s *Systemctl) DaemonReexec(ctx context.Context) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.exec(ctx, s.timeout(s.ReloadTimeout), "daemon-reexec")
+}
+
+// Reboot reboots the host managed by systemd.
+func (s *Systemctl) Reboot(ctx context.Context) error {
+	return s.exec(ctx, s.Timeout, "reboot")
+}
+
+// Ping returns an error if systemd isn't running or can't be reached by systemctl, e.g. in most containers.
+func (s *Systemctl) Ping(ctx context.Context) error {
+	if s.Host == "" {
+		if stat, err := os.Stat("/run/systemd/system"); err != nil || !stat.IsDir() {
+			return errors.New("systemd isn't the init system")
+		}
+	}
+	return s.exec(ctx, s.timeout(s.QueryTimeout), "show", "--property=Version")
+}
+
+// IsActive returns true if the unit is active.
+func (s *Systemctl) IsActive(ctx context.Context, unit string) (bool, error) {
+	return s.isRunning(ctx, unit), nil
+}
+
+// Stats returns the number of times systemd automatically restarted the unit since it was last started manually,
+// and when it last became active, or the zero time if it's inactive.
+func (s *Systemctl) Stats(ctx context.Context, unit string) (int, time.Time, error) {
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "show", "--property=NRestarts", "--property=ActiveState", "--property=ActiveEnterTimestamp", unit)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return parseStats(out)
+}
+
+// LastRestart returns how long the unit was down the last time it was restarted, from leaving the active state until
+// entering it again, or how long it took to start if it wasn't stopped since. It's zero if the unit never started.
+func (s *Systemctl) LastRestart(ctx context.Context, unit string) (time.Duration, error) {
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "show", "--property=ActiveExitTimestampMonotonic",
+		"--property=InactiveExitTimestampMonotonic", "--property=ActiveEnterTimestampMonotonic", unit)
+	if err != nil {
+		return 0, fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return parseLastRestart(out)
+}
+
+// parseLastRestart parses the monotonic timestamps of systemctl show, in microseconds and zero when unset.
+func parseLastRestart(out []byte) (time.Duration, error) {
+	props := map[string]int64{}
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(line[i+1:]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s", strings.TrimSpace(line))
+		}
+		props[line[:i]] = value
+	}
+
+	exited, started, entered := props["ActiveExitTimestampMonotonic"], props["InactiveExitTimestampMonotonic"], props["ActiveEnterTimestampMonotonic"]
+	switch {
+	case entered == 0 || started == 0 || entered < started:
+		return 0, nil // never started, or still starting
+	case exited != 0 && exited <= started:
+		return time.Duration(entered-exited) * time.Microsecond, nil
+	default:
+		return time.Duration(entered-started) * time.Microsecond, nil
+	}
+}
+
+// UnitState is the runtime state of a unit according to systemd.
+type UnitState struct {
+	Active  string `json:"active"`  // ActiveState, e.g. active or failed
+	Sub     string `json:"sub"`     // SubState, e.g. running or exited
+	Enabled string `json:"enabled"` // UnitFileState, e.g. enabled or static
+}
+
+// UnitStates returns the runtime state of several units with a single query.
+func (s *Systemctl) UnitStates(ctx context.Context, units []string) (map[string]*UnitState, error) {
+	if len(units) == 0 {
+		return map[string]*UnitState{}, nil
+	}
+	args := append([]string{"show", "--property=ActiveState", "--property=SubState", "--property=UnitFileState", "--"}, units...)
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), args...)
+	if err != nil {
+		return nil, fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return parseUnitStates(out, units)
+}
+
+// parseUnitStates parses the output of systemctl show, which separates the properties of each unit by an empty line
+// in the order the units were given.
+func parseUnitStates(out []byte, units []string) (map[string]*UnitState, error) {
+	blocks := strings.Split(strings.TrimSpace(string(out)), "\n\n")
+	if len(blocks) != len(units) {
+		return nil, fmt.Errorf("expected the properties of %d units, got %d", len(units), len(blocks))
+	}
+	states := make(map[string]*UnitState, len(units))
+	for i, block := range blocks {
+		state := &UnitState{}
+		for _, line := range strings.Split(block, "\n") {
+			j := strings.Index(line, "=")
+			if j < 0 {
+				continue
+			}
+			switch value := strings.TrimSpace(line[j+1:]); line[:j] {
+			case "ActiveState":
+				state.Active = value
+			case "SubState":
+				state.Sub = value
+			case "UnitFileState":
+				state.Enabled = value
+			}
+		}
+		states[units[i]] = state
+	}
+	return states, nil
+}
+
+// NeedDaemonReload returns whether systemd's loaded configuration of each unit is older than its files on disk,
+// e.g. because they were edited without a daemon-reload, with a single query.
+func (s *Systemctl) NeedDaemonReload(ctx context.Context, units []string) (map[string]bool, error) {
+	if len(units) == 0 {
+		return map[string]bool{}, nil
+	}
+	args := append([]string{"show", "--property=NeedDaemonReload", "--"}, units...)
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), args...)
+	if err != nil {
+		return nil, fmt.Errorf("systemctl error msg: %s", out)
+	}
+	blocks := strings.Split(strings.TrimSpace(string(out)), "\n\n")
+	if len(blocks) != len(units) {
+		return nil, fmt.Errorf("expected the properties of %d units, got %d", len(units), len(blocks))
+	}
+	stale := make(map[string]bool, len(units))
+	for i, block := range blocks {
+		stale[units[i]] = strings.TrimSpace(block) == "NeedDaemonReload=yes"
+	}
+	return stale, nil
+}
+
+// Dependents returns the units that declare Requires=, BindsTo=, or PartOf= on the unit.
+func (s *Systemctl) Dependents(ctx context.Context, unit string) ([]string, error) {
+	out, err := s.run(ctx, s.timeout(s.QueryTimeout), "show", "--property=RequiredBy", "--property=BoundBy", "--property=ConsistsOf", unit)
+	if err != nil {
+		return nil, fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return parseDependents(out), nil
+}
+
+func parseDependents(out []byte) []string {
+	seen := map[string]bool{}
+	var units []string
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		for _, unit := range strings.Fields(line[i+1:]) {
+			if !seen[unit] {
+				seen[unit] = true
+				units = append(units, unit)
+			}
+		}
+	}
+	sort.Strings(units)
+	return units
+}
+
+func parseStats(out []byte) (int, time.Time, error) {
+	props := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			props[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	restarts, err := strconv.Atoi(props["NRestarts"])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid NRestarts=%s", props["NRestarts"])
+	}
+	if props["ActiveState"] != "active" || props["ActiveEnterTimestamp"] == "" {
+		return restarts, time.Time{}, nil
+	}
+	since, err := time.Parse("Mon 2006-01-02 15:04:05 MST", props["ActiveEnterTimestamp"])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid ActiveEnterTimestamp=%s", props["ActiveEnterTimestamp"])
+	}
+	return restarts, since, nil
+}
+
+func (s *Systemctl) isRunning(ctx context.Context, unit string) bool {
+	_, err := s.run(ctx, s.timeout(s.QueryTimeout), "is-active", "--quiet", unit)
+	return err == nil
+}
+
+// timeout returns the given operation-specific timeout, or the default when it isn't set.
+func (s *Systemctl) timeout(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return s.Timeout
+}
+
+// startTimeout returns the timeout for starting or restarting the unit.
+func (s *Systemctl) startTimeout(unit string) time.Duration {
+	if s.UnitTimeout != nil {
+		if d := s.UnitTimeout(unit); d > 0 {
+			return d
+		}
+	}
+	return s.timeout(s.StartTimeout)
+}
+
+func (s *Systemctl) exec(ctx context.Context, timeout time.Duration, args ...string) error {
+	out, err := s.run(ctx, timeout, args...)
+	if err == nil {
+		return nil
+	}
+	if len(out) > 0 {
+		return fmt.Errorf("systemctl error msg: %s", out)
+	}
+	return fmt.Errorf("systemctl error: %w", err)
+}
+
+// run executes systemctl, retrying transient failures with a short exponential backoff.
+// Every attempt is bounded by the timeout.
+func (s *Systemctl) run(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		attemptCtx, done := context.WithTimeout(ctx, timeout)
+		out, err := s.command(attemptCtx, args...).CombinedOutput()
+		done()
+		if err == nil || attempt >= s.Retries || !transientError(out) {
+			return out, err
+		}
+
+		log.Printf("retrying systemctl %s after transient error: %s", strings.Join(args, " "), bytes.TrimSpace(out))
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// transientErrors are systemctl error messages caused by temporary D-Bus or job scheduling problems.
+var transientErrors = []string{
+	"connection timed out",
+	"connection reset by peer",
+	"transport endpoint is not connected",
+	"failed to connect to bus",
+	"activation of org.freedesktop.systemd1 timed out",
+	"transaction is destructive",
+	"transaction contains conflicting jobs",
+}
+
+func transientError(out []byte) bool {
+	msg := strings.ToLower(string(out))
+	for _, pattern := range transientErrors {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Systemctl) command(ctx context.Context, args ...string) *exec.Cmd {
+	if s.Host != "" {
+		args = append([]string{"-H", s.Host}, args...)
+	}
+	command := s.Command
+	if command == "" {
+		command = "systemctl"
+	}
+	return prefixed(ctx, s.Prefix, command, args...)
+}
+
+var exposurePattern = regexp.MustCompile(`Overall exposure level for \S+: ([0-9.]+)`)
+
+// SecurityScore returns the exposure score of a service according to systemd-analyze security.
+func (s *Systemctl) SecurityScore(unit string) (float64, error) {
+	ctx, done := context.WithTimeout(context.Background(), s.timeout(s.QueryTimeout))
+	defer done()
+
+	args := []string{"security", "--no-pager", unit}
+	if s.Host != "" {
+		args = append([]string{"-H", s.Host}, args...)
+	}
+	out, err := exec.CommandContext(ctx, "systemd-analyze", args...).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("systemd-analyze error: %w", err)
+	}
+
+	match := exposurePattern.FindSubmatch(out)
+	if match == nil {
+		return 0, fmt.Errorf("exposure level not found in systemd-analyze output")
+	}
+	return strconv.ParseFloat(string(match[1]), 64)
+}
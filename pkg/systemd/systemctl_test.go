@@ -0,0 +1,271 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemctlTimeouts(t *testing.T) {
+	// Fake systemctl with running units that are slow to stop
+	fake := path.Join(t.TempDir(), "systemctl")
+	err := ioutil.WriteFile(fake, []byte("#!/bin/sh\nif [ \"$1\" = stop ]; then sleep 0.2; fi\n"), 0755)
+	require.NoError(t, err)
+
+	s := &Systemctl{Timeout: time.Millisecond * 20, QueryTimeout: time.Second * 5, StopTimeout: time.Second * 5, Command: fake}
+	changed, err := s.EnsureStopped(context.Background(), "test.service")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	s.StopTimeout = 0
+	_, err = s.EnsureStopped(context.Background(), "test.service")
+	assert.Error(t, err)
+}
+
+func TestSystemctlUnitTimeout(t *testing.T) {
+	// Fake systemctl with units that are slow to restart
+	fake := path.Join(t.TempDir(), "systemctl")
+	require.NoError(t, ioutil.WriteFile(fake, []byte("#!/bin/sh\nif [ \"$1\" = restart ]; then sleep 0.2; fi\n"), 0755))
+
+	s := &Systemctl{Timeout: time.Second * 5, StartTimeout: time.Millisecond * 20, Command: fake}
+	s.UnitTimeout = func(unit string) time.Duration {
+		if unit == "slow.service" {
+			return time.Second * 5
+		}
+		return 0
+	}
+	assert.NoError(t, s.Restart(context.Background(), "slow.service"))
+	assert.Error(t, s.Restart(context.Background(), "other.service"))
+}
+
+func TestSystemctlTransientRetries(t *testing.T) {
+	// Fake systemctl that can't reach the bus on its first invocation
+	dir := t.TempDir()
+	fake := path.Join(dir, "systemctl")
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/calls\nif [ ! -e " + dir + "/connected ]; then touch " + dir + "/connected; echo 'Failed to connect to bus: Connection refused' >&2; exit 1; fi\n"
+	require.NoError(t, ioutil.WriteFile(fake, []byte(script), 0755))
+
+	s := &Systemctl{Timeout: time.Second * 5, Command: fake, Retries: 2, RetryDelay: time.Millisecond}
+	require.NoError(t, s.exec(context.Background(), s.Timeout, "restart", "test.service"))
+
+	calls, err := ioutil.ReadFile(path.Join(dir, "calls"))
+	require.NoError(t, err)
+	assert.Equal(t, "restart test.service\nrestart test.service\n", string(calls))
+}
+
+func TestSystemctlEnable(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.Enable(context.Background(), "test.service"))
+	assert.Equal(t, "daemon-reload\nenable test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlDisable(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.Disable(context.Background(), "test.service"))
+	assert.Equal(t, "disable test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlReload(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "CanReload=yes")}
+	require.NoError(t, s.Reload(context.Background(), "test.service"))
+	assert.Equal(t, "daemon-reload\nshow --property=CanReload test.service\nis-active --quiet test.service\nreload test.service\n", readCalls(t, dir))
+
+	dir = t.TempDir()
+	s.Command = fakeCommand(t, dir, "CanReload=no")
+	require.NoError(t, s.Reload(context.Background(), "test.service"))
+	assert.Equal(t, "daemon-reload\nshow --property=CanReload test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlReenable(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.Reenable(context.Background(), "test.service"))
+	assert.Equal(t, "daemon-reload\nreenable test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlPrefix(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSystemctl(&Config{Timeout: time.Second * 5, Prefix: []string{fakeCommand(t, dir, ""), "-u", "root"}})
+	require.NoError(t, s.Restart(context.Background(), "test.service"))
+	assert.Equal(t, "-u root systemctl daemon-reload\n-u root systemctl list-jobs --no-legend --full test.service\n-u root systemctl restart test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlPing(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Host: "host1", Command: fakeCommand(t, dir, "Version=249")}
+	require.NoError(t, s.Ping(context.Background()))
+	assert.Equal(t, "-H host1 show --property=Version\n", readCalls(t, dir))
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "status"), []byte("1"), 0644))
+	assert.Error(t, s.Ping(context.Background()))
+}
+
+func TestSystemctlStartLimit(t *testing.T) {
+	// Fake systemctl refusing to restart the unit until it's reset
+	dir := t.TempDir()
+	fake := path.Join(dir, "systemctl")
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/calls\n" +
+		"case \"$1\" in\n" +
+		"is-active) exit 3 ;;\n" +
+		"show) echo Result=start-limit-hit ;;\n" +
+		"reset-failed) touch " + dir + "/reset ;;\n" +
+		"restart) if [ ! -e " + dir + "/reset ]; then echo 'Job for test.service failed.' >&2; exit 1; fi ;;\n" +
+		"esac\n"
+	require.NoError(t, ioutil.WriteFile(fake, []byte(script), 0755))
+
+	s := &Systemctl{Timeout: time.Second * 5, Command: fake}
+	changed, err := s.EnsureRunning(context.Background(), "test.service")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "is-active --quiet test.service\nlist-jobs --no-legend --full test.service\nrestart test.service\nshow --property=Result test.service\nreset-failed test.service\nrestart test.service\n", readCalls(t, dir))
+
+	// Other failures aren't retried
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "calls"), nil, 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "reset")))
+	require.NoError(t, ioutil.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\" >> "+dir+"/calls\ncase \"$1\" in\nis-active) exit 3 ;;\nshow) echo Result=exit-code ;;\nrestart) exit 1 ;;\nesac\n"), 0755))
+	_, err = s.EnsureRunning(context.Background(), "test.service")
+	assert.Error(t, err)
+	assert.Equal(t, "is-active --quiet test.service\nlist-jobs --no-legend --full test.service\nrestart test.service\nshow --property=Result test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlForget(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "Failed to reset failed state of unit test.service: Unit test.service not loaded.")}
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "status"), []byte("1"), 0644))
+	assert.Error(t, s.Forget(context.Background(), "test.service")) // daemon-reload failed
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "calls"), nil, 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "status")))
+	require.NoError(t, s.Forget(context.Background(), "test.service"))
+	assert.Equal(t, "daemon-reload\nreset-failed test.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlReboot(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Host: "host1", Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.Reboot(context.Background()))
+	assert.Equal(t, "-H host1 reboot\n", readCalls(t, dir))
+}
+
+func TestSystemctlIsActive(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	active, err := s.IsActive(context.Background(), "test.service")
+	require.NoError(t, err)
+	assert.True(t, active)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "status"), []byte("3"), 0644))
+	active, err = s.IsActive(context.Background(), "test.service")
+	require.NoError(t, err)
+	assert.False(t, active)
+}
+
+func TestSystemctlDependents(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "RequiredBy=web.service sidecar.service\nBoundBy=sidecar.service\nConsistsOf=")}
+	units, err := s.Dependents(context.Background(), "db.service")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sidecar.service", "web.service"}, units)
+	assert.Equal(t, "show --property=RequiredBy --property=BoundBy --property=ConsistsOf db.service\n", readCalls(t, dir))
+}
+
+func TestSystemctlUnitStates(t *testing.T) {
+	dir := t.TempDir()
+	out := "ActiveState=active\nSubState=running\nUnitFileState=enabled\n\nActiveState=failed\nSubState=failed\nUnitFileState=\n"
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, out)}
+	states, err := s.UnitStates(context.Background(), []string{"a.service", "b.service"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*UnitState{
+		"a.service": {Active: "active", Sub: "running", Enabled: "enabled"},
+		"b.service": {Active: "failed", Sub: "failed"},
+	}, states)
+	assert.Equal(t, "show --property=ActiveState --property=SubState --property=UnitFileState -- a.service b.service\n", readCalls(t, dir))
+
+	_, err = parseUnitStates([]byte(out), []string{"a.service"})
+	assert.EqualError(t, err, "expected the properties of 1 units, got 2")
+}
+
+func TestSystemctlNeedDaemonReload(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "NeedDaemonReload=no\n\nNeedDaemonReload=yes\n")}
+	stale, err := s.NeedDaemonReload(context.Background(), []string{"a.service", "b.service"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a.service": false, "b.service": true}, stale)
+	assert.Equal(t, "show --property=NeedDaemonReload -- a.service b.service\n", readCalls(t, dir))
+
+	_, err = s.NeedDaemonReload(context.Background(), []string{"a.service"})
+	assert.EqualError(t, err, "expected the properties of 1 units, got 2")
+}
+
+func TestSystemctlDaemonReload(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.DaemonReload(context.Background()))
+	assert.Equal(t, "daemon-reload\n", readCalls(t, dir))
+}
+
+func TestSystemctlDaemonReexec(t *testing.T) {
+	dir := t.TempDir()
+	s := &Systemctl{Timeout: time.Second * 5, Command: fakeCommand(t, dir, "")}
+	require.NoError(t, s.DaemonReexec(context.Background()))
+	assert.Equal(t, "daemon-reexec\n", readCalls(t, dir))
+}
+
+func TestParseStats(t *testing.T) {
+	restarts, since, err := parseStats([]byte("NRestarts=3\nActiveState=active\nActiveEnterTimestamp=Mon 2021-01-04 10:00:00 UTC\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, restarts)
+	assert.Equal(t, time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC), since.UTC())
+
+	restarts, since, err = parseStats([]byte("NRestarts=0\nActiveState=failed\nActiveEnterTimestamp=Mon 2021-01-04 10:00:00 UTC\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, restarts)
+	assert.True(t, since.IsZero())
+
+	_, _, err = parseStats([]byte("ActiveState=active\n"))
+	assert.Error(t, err)
+}
+
+func TestParseLastRestart(t *testing.T) {
+	d, err := parseLastRestart([]byte("ActiveExitTimestampMonotonic=1000000\nInactiveExitTimestampMonotonic=1500000\nActiveEnterTimestampMonotonic=3500000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, d)
+
+	// Started once since boot
+	d, err = parseLastRestart([]byte("ActiveExitTimestampMonotonic=0\nInactiveExitTimestampMonotonic=1500000\nActiveEnterTimestampMonotonic=1750000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, d)
+
+	// Stopped after its last start
+	d, err = parseLastRestart([]byte("ActiveExitTimestampMonotonic=5000000\nInactiveExitTimestampMonotonic=1500000\nActiveEnterTimestampMonotonic=1750000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, d)
+
+	d, err = parseLastRestart([]byte("ActiveExitTimestampMonotonic=0\nInactiveExitTimestampMonotonic=0\nActiveEnterTimestampMonotonic=0\n"))
+	require.NoError(t, err)
+	assert.Zero(t, d)
+
+	_, err = parseLastRestart([]byte("ActiveEnterTimestampMonotonic=n/a\n"))
+	assert.Error(t, err)
+}
+
+func TestTransientError(t *testing.T) {
+	assert.True(t, transientError([]byte("Failed to connect to bus: Connection refused")))
+	assert.True(t, transientError([]byte("Failed to restart a.service: Transaction is destructive.")))
+	assert.False(t, transientError([]byte("Failed to restart a.service: Unit a.service not found.")))
+}
+
+func TestExposurePattern(t *testing.T) {
+	match := exposurePattern.FindSubmatch([]byte("✗ PrivateNetwork=  ...\n\n→ Overall exposure level for test.service: 9.6 UNSAFE 😨\n"))
+	require.NotNil(t, match)
+	assert.Equal(t, "9.6", string(match[1]))
+}
@@ -0,0 +1,154 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultCheckInterval is how often a Watcher checks its directories when its Interval isn't set.
+const DefaultCheckInterval = time.Second * 10
+
+// Watcher watches directories with inotify and recreates its watches once they were lost.
+// Inotify silently stops delivering events for a directory that was removed, replaced, or had a filesystem
+// mounted over it, so the watched directories are compared with the ones at their paths every Interval.
+type Watcher struct {
+	Dirs     []string
+	Interval time.Duration
+	Events   chan fsnotify.Event // directories whose watch was recreated are sent as Create events, since their changes may have been missed
+	Errors   chan error          // sent when no watcher can be created, which Run doesn't recover from
+
+	watcher *fsnotify.Watcher
+	ids     map[string]dirID // dir -> identity of the watched directory, zero while it's missing
+}
+
+// dirID tells directories at the same path apart.
+type dirID struct {
+	Dev, Ino uint64
+}
+
+// NewWatcher returns a watcher of the directories, which must exist.
+func NewWatcher(dirs []string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{Dirs: dirs, Interval: interval, Events: make(chan fsnotify.Event), Errors: make(chan error)}
+	if err := w.recreate(); err != nil {
+		if w.watcher != nil {
+			w.watcher.Close()
+		}
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run forwards events until the context is canceled, and closes the watcher once it returns.
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() { w.watcher.Close() }()
+
+	for {
+		var lost []string
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lost = w.lost()
+		case event := <-w.watcher.Events:
+			if !w.send(ctx, event) {
+				return
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && ContainsPath(w.Dirs, event.Name) {
+				lost = w.lost() // the directory itself is gone, don't wait for the next check
+			}
+		case err := <-w.watcher.Errors:
+			log.Printf("error while watching %s, recreating the watches: %s", strings.Join(w.Dirs, ", "), err)
+			lost = w.Dirs // e.g. the event queue overflowed, so any change may have been missed
+		}
+		if len(lost) == 0 {
+			continue
+		}
+
+		for _, dir := range lost {
+			log.Printf("lost the watch of %s, the directory was removed, replaced, or remounted", dir)
+		}
+		previous := w.watcher
+		if err := w.recreate(); err != nil && w.watcher == previous {
+			select {
+			case w.Errors <- err:
+			case <-ctx.Done():
+			}
+			return
+		} else if err != nil {
+			log.Printf("error while recreating watches: %s", err) // missing directories are watched again once they reappear
+		}
+		for _, dir := range lost {
+			if !w.send(ctx, fsnotify.Event{Name: dir, Op: fsnotify.Create}) {
+				return
+			}
+		}
+	}
+}
+
+func (w *Watcher) send(ctx context.Context, event fsnotify.Event) bool {
+	select {
+	case w.Events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recreate replaces the underlying watcher with one watching every directory that exists.
+// The previous watcher is kept if no new one can be created.
+func (w *Watcher) recreate() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if w.watcher != nil {
+		w.watcher.Close()
+	}
+	w.watcher = watcher
+	w.ids = make(map[string]dirID, len(w.Dirs))
+
+	var errs []string
+	for _, dir := range w.Dirs {
+		if err := watcher.Add(dir); err != nil {
+			errs = append(errs, fmt.Sprintf("watching %s: %s", dir, err))
+			continue
+		}
+		w.ids[dir], _ = statDir(dir)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// lost returns the directories that aren't the ones that were watched anymore.
+func (w *Watcher) lost() []string {
+	var lost []string
+	for _, dir := range w.Dirs {
+		if id, _ := statDir(dir); id != w.ids[dir] {
+			lost = append(lost, dir)
+		}
+	}
+	return lost
+}
+
+// statDir returns the identity of a directory, or zero if it doesn't exist.
+func statDir(dir string) (dirID, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return dirID{}, err
+	}
+	return dirID{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}, nil
+}
@@ -0,0 +1,74 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcherRemovedDir(t *testing.T) {
+	dir := path.Join(t.TempDir(), "src")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	w, err := NewWatcher([]string{dir}, time.Millisecond*10)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	require.NoError(t, os.Remove(dir))
+	awaitEvent(t, w, fsnotify.Event{Name: dir, Op: fsnotify.Create}) // the watch was lost
+
+	require.NoError(t, os.Mkdir(dir, 0755))
+	awaitEvent(t, w, fsnotify.Event{Name: dir, Op: fsnotify.Create}) // the directory reappeared
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test"), []byte("test"), 0644))
+	awaitEvent(t, w, fsnotify.Event{Name: path.Join(dir, "test"), Op: fsnotify.Create})
+}
+
+func TestWatcherReplacedDir(t *testing.T) {
+	tmp := t.TempDir()
+	dir := path.Join(tmp, "src")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	w, err := NewWatcher([]string{dir}, time.Millisecond*10)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	require.NoError(t, os.Mkdir(path.Join(tmp, "next"), 0755))
+	require.NoError(t, os.Rename(dir, path.Join(tmp, "previous")))
+	require.NoError(t, os.Rename(path.Join(tmp, "next"), dir))
+	awaitEvent(t, w, fsnotify.Event{Name: dir, Op: fsnotify.Create})
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test"), []byte("test"), 0644))
+	awaitEvent(t, w, fsnotify.Event{Name: path.Join(dir, "test"), Op: fsnotify.Create})
+}
+
+func TestNewWatcherMissingDir(t *testing.T) {
+	_, err := NewWatcher([]string{path.Join(t.TempDir(), "missing")}, 0)
+	assert.Error(t, err)
+}
+
+// awaitEvent skips events until the expected one is received.
+func awaitEvent(t *testing.T, w *Watcher, expected fsnotify.Event) {
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case event := <-w.Events:
+			if event == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+}
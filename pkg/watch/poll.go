@@ -0,0 +1,122 @@
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Poller detects changes by periodically listing directories,
+// for filesystems that don't deliver inotify events for changes made by other hosts.
+type Poller struct {
+	Dirs     []string
+	Interval time.Duration
+	Events   chan fsnotify.Event
+
+	snapshots map[string]map[string]fileMeta // dir -> file name -> metadata
+}
+
+type fileMeta struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// NewPoller returns a poller without directories.
+func NewPoller(interval time.Duration) *Poller {
+	return &Poller{Interval: interval, Events: make(chan fsnotify.Event)}
+}
+
+// Run sends an event on Events for every file that changed between polls.
+func (p *Poller) Run() {
+	p.poll() // take the initial snapshot
+	for {
+		time.Sleep(p.Interval)
+		for _, event := range p.poll() {
+			p.Events <- event
+		}
+	}
+}
+
+// poll lists every directory and returns events for the files that changed since the last poll.
+func (p *Poller) poll() []fsnotify.Event {
+	first := p.snapshots == nil
+	if first {
+		p.snapshots = map[string]map[string]fileMeta{}
+	}
+
+	var events []fsnotify.Event
+	for _, dir := range p.Dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("error while polling %s: %s", dir, err)
+			continue // try again next time, the mount may be temporarily unavailable
+		}
+
+		prev := p.snapshots[dir]
+		current := make(map[string]fileMeta, len(files))
+		for _, stat := range files {
+			meta := fileMeta{Size: stat.Size(), ModTime: stat.ModTime()}
+			current[stat.Name()] = meta
+
+			old, ok := prev[stat.Name()]
+			switch {
+			case first:
+			case !ok:
+				events = append(events, fsnotify.Event{Name: path.Join(dir, stat.Name()), Op: fsnotify.Create})
+			case old != meta:
+				events = append(events, fsnotify.Event{Name: path.Join(dir, stat.Name()), Op: fsnotify.Write})
+			}
+		}
+		for name := range prev {
+			if _, ok := current[name]; !ok {
+				events = append(events, fsnotify.Event{Name: path.Join(dir, name), Op: fsnotify.Remove})
+			}
+		}
+		p.snapshots[dir] = current
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// MergeEvents forwards events from both channels into a single channel.
+func MergeEvents(a, b <-chan fsnotify.Event) <-chan fsnotify.Event {
+	out := make(chan fsnotify.Event)
+	for _, ch := range []<-chan fsnotify.Event{a, b} {
+		go func(ch <-chan fsnotify.Event) {
+			for event := range ch {
+				out <- event
+			}
+		}(ch)
+	}
+	return out
+}
+
+// Filesystem magic numbers from statfs(2) for filesystems where inotify misses remote changes.
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x564c:     "ncp",
+	0x6b414653: "afs",
+	0x19830326: "fhgfs",
+	0x47504653: "gpfs",
+	0x0bd00bd0: "lustre",
+}
+
+// NetworkFilesystem returns the name of the filesystem if the directory is on a network or FUSE mount.
+func NetworkFilesystem(dir string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return "", fmt.Errorf("statfs %s: %w", dir, err)
+	}
+	return networkFilesystems[uint32(stat.Type)], nil
+}
@@ -0,0 +1,42 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoller(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test1.service"), []byte("test1"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test2.service"), []byte("test2"), 0644))
+
+	p := NewPoller(time.Second)
+	p.Dirs = []string{dir}
+	assert.Empty(t, p.poll(), "initial snapshot")
+	assert.Empty(t, p.poll(), "no changes")
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test1.service"), []byte("changed"), 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "test2.service")))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "test3.service"), []byte("test3"), 0644))
+
+	assert.Equal(t, []fsnotify.Event{
+		{Name: path.Join(dir, "test1.service"), Op: fsnotify.Write},
+		{Name: path.Join(dir, "test2.service"), Op: fsnotify.Remove},
+		{Name: path.Join(dir, "test3.service"), Op: fsnotify.Create},
+	}, p.poll())
+}
+
+func TestNetworkFilesystem(t *testing.T) {
+	_, err := NetworkFilesystem(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = NetworkFilesystem("/does/not/exist")
+	assert.Error(t, err)
+}
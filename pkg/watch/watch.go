@@ -0,0 +1,81 @@
+// Package watch turns filesystem events into debounced reconciliation passes.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Loop calls fn when its timer fires, or with the names of the changed files when events are received.
+// Changes are coalesced until no new events have been received for the debounce duration.
+// The timer is reset to the duration returned by fn. Returns nil once the context is canceled.
+func Loop(ctx context.Context, events <-chan fsnotify.Event, errs <-chan error, debounce time.Duration, fn func(changed []string) time.Duration) error {
+	ticker := time.NewTimer(1)
+	defer ticker.Stop()
+
+	settle := time.NewTimer(debounce)
+	settle.Stop()
+	defer settle.Stop()
+
+	pending := map[string]bool{}
+	flush := func() {
+		changed := make([]string, 0, len(pending))
+		for name := range pending {
+			changed = append(changed, name)
+		}
+		sort.Strings(changed)
+		pending = map[string]bool{}
+		ticker.Reset(fn(changed))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			ticker.Reset(fn(nil))
+		case <-settle.C:
+			flush()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename|fsnotify.Chmod) == 0 {
+				continue
+			}
+
+			pending[event.Name] = true
+			if debounce <= 0 {
+				flush()
+				continue
+			}
+			if !settle.Stop() {
+				select {
+				case <-settle.C:
+				default:
+				}
+			}
+			settle.Reset(debounce)
+		case err, ok := <-errs:
+			if !ok {
+				return nil
+			}
+			return fmt.Errorf("watcher error: %w", err)
+		}
+	}
+}
+
+// ContainsPath returns true if the cleaned name is among the given paths.
+func ContainsPath(names []string, name string) bool {
+	for _, n := range names {
+		if path.Clean(n) == path.Clean(name) {
+			return true
+		}
+	}
+	return false
+}
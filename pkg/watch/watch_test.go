@@ -0,0 +1,86 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoop(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	dir := t.TempDir()
+	err = watcher.Add(dir)
+	require.NoError(t, err)
+
+	n := 0
+	Loop(context.Background(), watcher.Events, watcher.Errors, 0, func(changed []string) time.Duration {
+		n++
+		switch n {
+		case 1: // initial resync
+			err := ioutil.WriteFile(path.Join(dir, "test1"), []byte("test1"), 0644)
+			require.NoError(t, err)
+			return time.Hour
+		case 2: // file changed
+			return time.Nanosecond
+		case 3: // resync
+			watcher.Close()
+		}
+		return time.Hour
+	})
+}
+
+func TestLoopDebounce(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	dir := t.TempDir()
+	err = watcher.Add(dir)
+	require.NoError(t, err)
+
+	n := 0
+	Loop(context.Background(), watcher.Events, watcher.Errors, time.Millisecond*50, func(changed []string) time.Duration {
+		n++
+		switch n {
+		case 1: // initial resync
+			for _, name := range []string{"test1", "test2", "test1"} {
+				err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644)
+				require.NoError(t, err)
+			}
+		case 2: // burst of changes
+			assert.Equal(t, []string{path.Join(dir, "test1"), path.Join(dir, "test2")}, changed)
+			watcher.Close()
+		}
+		return time.Hour
+	})
+	assert.Equal(t, 2, n)
+}
+
+func TestLoopCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan fsnotify.Event)
+	errs := make(chan error)
+
+	n := 0
+	err := Loop(ctx, events, errs, 0, func(changed []string) time.Duration {
+		n++
+		cancel()
+		return time.Hour
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestContainsPath(t *testing.T) {
+	assert.True(t, ContainsPath([]string{"/a/b/"}, "/a/b"))
+	assert.False(t, ContainsPath([]string{"/a/b/c"}, "/a/b"))
+}
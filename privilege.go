@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// privilegeModes are the ways unitmgr gets the privileges required to manage units.
+var privilegeModes = map[string]bool{
+	"none":   true, // run as root
+	"sudo":   true, // run systemctl and write unit files through the privileged helper with sudo, see privileged
+	"polkit": true, // run systemctl directly, authorized by a polkit rule, see polkitRule
+}
+
+// privilegePrefix returns the command prepended to init system commands, which runs them through the privileged helper.
+func privilegePrefix(mode, helper, dest string) []string {
+	if mode == "sudo" {
+		return []string{"sudo", "-n", helper, "privileged", dest}
+	}
+	return nil
+}
+
+// sudoDir is a local unit file directory that's read directly but written through the privileged helper with sudo,
+// so unitmgr only needs root for the operations that modify it.
+type sudoDir struct {
+	reconciler.LocalDir
+	Timeout time.Duration
+	Helper  string // the unitmgr binary sudo runs as root
+	Command string // defaults to sudo
+}
+
+func (d *sudoDir) Copy(src, unit string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return d.run(file, "write", unit, fmt.Sprintf("%o", stat.Mode().Perm()))
+}
+
+func (d *sudoDir) Remove(unit string) error {
+	return d.run(nil, "remove", unit)
+}
+
+func (d *sudoDir) Chmod(unit string, mode os.FileMode) error {
+	return d.run(nil, "chmod", unit, fmt.Sprintf("%o", mode))
+}
+
+func (d *sudoDir) Link(name, target string) error {
+	if current, err := os.Readlink(path.Join(d.Dir, name)); err == nil && current == target {
+		return nil
+	}
+	return d.run(nil, "link", name, target)
+}
+
+func (d *sudoDir) Unlink(name string) error {
+	return d.run(nil, "remove", name)
+}
+
+func (d *sudoDir) run(stdin io.Reader, args ...string) error {
+	ctx, done := context.WithTimeout(context.Background(), d.Timeout)
+	defer done()
+
+	command := d.Command
+	if command == "" {
+		command = "sudo"
+	}
+	cmd := exec.CommandContext(ctx, command, append(privilegePrefix("sudo", d.Helper, d.Dir)[1:], args...)...)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if len(out) > 0 {
+		return fmt.Errorf("sudo error msg: %s", bytes.TrimSpace(out))
+	}
+	return fmt.Errorf("sudo error: %w", err)
+}
+
+// privilegedVerbs are the systemctl commands the privileged helper runs. Commands like edit, link, or set-property
+// would let the unprivileged user run arbitrary code as root.
+var privilegedVerbs = map[string]bool{
+	"daemon-reexec": true, "daemon-reload": true, "disable": true, "enable": true, "is-active": true, "list-jobs": true,
+	"reboot": true, "reenable": true, "reload": true, "reset-failed": true, "restart": true, "show": true, "start": true,
+	"stop": true,
+}
+
+var privilegedFlag = regexp.MustCompile(`^(--|--quiet|--no-legend|--no-pager|--full|--job-mode=(replace|fail)|--property=[A-Za-z]+)$`)
+
+// privilegedCommand is the helper that -privilege=sudo runs as root, e.g. `unitmgr privileged /etc/systemd/system
+// systemctl restart web.service`. Its first argument is the destination fixed by the sudoers entry, and it only runs
+// the operations unitmgr needs on unit files in it and on units. Units can still run anything as root, so this keeps
+// a compromised user to the auditable path of writing and starting units rather than making the entry less than root.
+func privilegedCommand() int {
+	return privileged(os.Args[2:], os.Stdin, os.Stdout, os.Stderr)
+}
+
+func privileged(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 2 || !path.IsAbs(args[0]) {
+		fmt.Fprintln(stderr, "usage: unitmgr privileged <dest> systemctl|write|remove|chmod|link [args]")
+		return exitFailed
+	}
+	dest, op, args := path.Clean(args[0]), args[1], args[2:]
+
+	if op == "systemctl" {
+		if err := checkSystemctl(args); err != nil {
+			fmt.Fprintf(stderr, "refusing to run systemctl: %s\n", err)
+			return exitFailed
+		}
+		cmd := exec.Command("systemctl", args...)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		err := cmd.Run()
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode() // e.g. of is-active
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailed
+		}
+		return exitConverged
+	}
+
+	if err := privilegedFileOp(dest, op, args, stdin); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	return exitConverged
+}
+
+// checkSystemctl returns an error unless the arguments are an allowed verb, allowed flags, and names of units.
+func checkSystemctl(args []string) error {
+	verb := ""
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			for _, unit := range args[i+1:] {
+				if !validUnitName(unit) || strings.HasPrefix(unit, "-") {
+					return fmt.Errorf("invalid unit %q", unit)
+				}
+			}
+			if verb == "" {
+				return fmt.Errorf("missing command")
+			}
+			return nil
+		case strings.HasPrefix(arg, "-"):
+			if !privilegedFlag.MatchString(arg) {
+				return fmt.Errorf("flag %q isn't allowed", arg)
+			}
+		case verb == "":
+			if !privilegedVerbs[arg] {
+				return fmt.Errorf("command %q isn't allowed", arg)
+			}
+			verb = arg
+		case !validUnitName(arg):
+			return fmt.Errorf("invalid unit %q", arg) // paths would e.g. let enable link any file as a unit
+		}
+	}
+	if verb == "" {
+		return fmt.Errorf("missing command")
+	}
+	return nil
+}
+
+func privilegedFileOp(dest, op string, args []string, stdin io.Reader) error {
+	want := map[string]int{"write": 2, "remove": 1, "chmod": 2, "link": 2}
+	if n, ok := want[op]; !ok || len(args) != n {
+		return fmt.Errorf("invalid operation %q with %d arguments", op, len(args))
+	}
+	name, err := privilegedName(args[0])
+	if err != nil {
+		return err
+	}
+	name = path.Join(dest, name)
+
+	switch op {
+	case "write":
+		mode, err := privilegedMode(args[1])
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		if err := reconciler.WriteFileAtomic(name, content); err != nil {
+			return err
+		}
+		return os.Chmod(name, mode)
+
+	case "remove":
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case "chmod":
+		mode, err := privilegedMode(args[1])
+		if err != nil {
+			return err
+		}
+		if stat, err := os.Lstat(name); err != nil || !stat.Mode().IsRegular() {
+			return fmt.Errorf("%s isn't a unit file", name)
+		}
+		return os.Chmod(name, mode)
+
+	default: // link
+		target := args[1]
+		if _, err := privilegedName(path.Join(path.Dir(args[0]), target)); err != nil || path.IsAbs(target) {
+			return fmt.Errorf("link target %q is outside of %s", target, dest)
+		}
+		if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+		tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+		os.Remove(tmp)
+		if err := os.Symlink(target, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, name)
+	}
+}
+
+// privilegedName returns the name of a unit file or of a link in a .wants, .requires, or .d directory, relative to dest.
+func privilegedName(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	if path.Clean(name) != name || len(parts) > 2 {
+		return "", fmt.Errorf("invalid unit file name %q", name)
+	}
+	for _, part := range parts {
+		if !validUnitName(part) {
+			return "", fmt.Errorf("invalid unit file name %q", name)
+		}
+	}
+	return name, nil
+}
+
+// privilegedMode parses an octal file mode, which can't make unit files writable by others or setuid.
+func privilegedMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^0755 != 0 {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// polkitRule returns a polkit rule allowing the user to manage units and unit files and to reload systemd.
+func polkitRule(user string) string {
+	return fmt.Sprintf(`// Allows unitmgr running as %[1]s to manage systemd units
+polkit.addRule(function(action, subject) {
+    if ((action.id == "org.freedesktop.systemd1.manage-units" ||
+         action.id == "org.freedesktop.systemd1.manage-unit-files" ||
+         action.id == "org.freedesktop.systemd1.reload-daemon") &&
+        subject.user == %[2]q) {
+        return polkit.Result.YES;
+    }
+});
+`, user, user)
+}
+
+// sudoersRule returns a sudoers entry allowing the user to run the privileged helper for dest, and nothing else.
+func sudoersRule(user, dest, helper string) string {
+	return fmt.Sprintf("%s ALL=(root) NOPASSWD: %s privileged %s *\n", user, helper, path.Clean(dest))
+}
+
+type privilegeRule struct {
+	Privilege string `json:"privilege"`
+	User      string `json:"user"`
+	Rule      string `json:"rule"`
+}
+
+func privilegesCommand() int {
+	if *runAs == "" {
+		fmt.Fprintln(os.Stderr, "-user is required")
+		return exitFailed
+	}
+	if *dest == "" {
+		*dest = backends[*backendN].Dest
+	}
+
+	var rule string
+	switch *privilege {
+	case "polkit":
+		rule = polkitRule(*runAs)
+	case "sudo":
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while finding the unitmgr binary: %s\n", err)
+			return exitFailed
+		}
+		rule = sudoersRule(*runAs, *dest, exe)
+	default:
+		fmt.Fprintln(os.Stderr, "-privilege must be sudo or polkit")
+		return exitFailed
+	}
+	if !structured(os.Stdout, &privilegeRule{Privilege: *privilege, User: *runAs, Rule: rule}) {
+		fmt.Print(rule)
+	}
+	return exitConverged
+}
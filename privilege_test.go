@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSudoDir(t *testing.T) {
+	// Fake sudo that records the helper's arguments and input
+	dir := t.TempDir()
+	fake := path.Join(dir, "sudo")
+	require.NoError(t, ioutil.WriteFile(fake, []byte("#!/bin/sh\nprintf '%s\\n' \"$*\" >> "+dir+"/calls\ncat >> "+dir+"/calls\n"), 0755))
+	d := &sudoDir{LocalDir: reconciler.LocalDir{Dir: "/etc/systemd/system"}, Timeout: time.Second * 5, Helper: "/usr/bin/unitmgr", Command: fake}
+
+	src := path.Join(t.TempDir(), "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("test1\n"), 0600))
+	require.NoError(t, d.Copy(src, "test.service"))
+	require.NoError(t, d.Chmod("test.service", 0644))
+	require.NoError(t, d.Link("unitmgr.target.wants/test.service", "../test.service"))
+	require.NoError(t, d.Unlink("unitmgr.target.wants/test.service"))
+	require.NoError(t, d.Remove("test.service"))
+
+	calls, err := ioutil.ReadFile(path.Join(dir, "calls"))
+	require.NoError(t, err)
+	prefix := "-n /usr/bin/unitmgr privileged /etc/systemd/system "
+	assert.Equal(t, prefix+"write test.service 600\ntest1\n"+
+		prefix+"chmod test.service 644\n"+
+		prefix+"link unitmgr.target.wants/test.service ../test.service\n"+
+		prefix+"remove unitmgr.target.wants/test.service\n"+
+		prefix+"remove test.service\n", string(calls))
+
+	d.Command = "false"
+	assert.Error(t, d.Remove("test.service"))
+}
+
+func TestPrivileged(t *testing.T) {
+	dest := t.TempDir()
+	run := func(stdin string, args ...string) (int, string) {
+		var stderr bytes.Buffer
+		code := privileged(append([]string{dest}, args...), strings.NewReader(stdin), ioutil.Discard, &stderr)
+		return code, stderr.String()
+	}
+
+	code, _ := run("test1", "write", "test.service", "600")
+	require.Equal(t, exitConverged, code)
+	content, err := ioutil.ReadFile(path.Join(dest, "test.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "test1", string(content))
+	stat, err := os.Stat(path.Join(dest, "test.service"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	code, _ = run("", "chmod", "test.service", "644")
+	require.Equal(t, exitConverged, code)
+	stat, err = os.Stat(path.Join(dest, "test.service"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), stat.Mode().Perm())
+
+	code, _ = run("", "link", "unitmgr.target.wants/test.service", "../test.service")
+	require.Equal(t, exitConverged, code)
+	link, err := os.Readlink(path.Join(dest, "unitmgr.target.wants", "test.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "../test.service", link)
+
+	code, _ = run("", "remove", "unitmgr.target.wants/test.service")
+	require.Equal(t, exitConverged, code)
+	code, _ = run("", "remove", "test.service")
+	require.Equal(t, exitConverged, code)
+	assert.NoFileExists(t, path.Join(dest, "test.service"))
+
+	// Nothing outside of dest can be written, and unit files can't be made setuid or writable by others
+	for _, args := range [][]string{
+		{"write", "../../sudoers", "644"},
+		{"write", "../sudoers", "644"},
+		{"write", "/etc/sudoers", "644"},
+		{"write", "a.wants/../../sudoers", "644"},
+		{"write", "a/b/c.service", "644"},
+		{"write", "test.service", "4755"},
+		{"write", "test.service", "666"},
+		{"link", "evil.service", "/home/user/evil.service"},
+		{"link", "a.wants/evil.service", "../../home/user/evil.service"},
+		{"remove", ".."},
+		{"exec", "sh"},
+		{"systemctl", "edit", "test.service"},
+		{"systemctl", "enable", "/home/user/evil.service"},
+		{"systemctl", "start", "test.service", "--root=/tmp"},
+		{"systemctl", "--", "start"},
+	} {
+		code, stderr := run("evil", args...)
+		assert.Equal(t, exitFailed, code, args)
+		assert.NotEmpty(t, stderr, args)
+	}
+	files, err := ioutil.ReadDir(dest)
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "only the unitmgr.target.wants directory is left")
+	assert.NoFileExists(t, path.Join(path.Dir(dest), "sudoers"))
+}
+
+func TestCheckSystemctl(t *testing.T) {
+	for _, args := range [][]string{
+		{"--job-mode=replace", "restart", "web.service"},
+		{"show", "--property=ActiveState", "--property=SubState", "--", "a.service", "b@1.service"},
+		{"is-active", "--quiet", "web.service"},
+		{"list-jobs", "--no-legend", "--full", "web.service"},
+		{"daemon-reload"},
+		{"enable", "web.service"},
+	} {
+		assert.NoError(t, checkSystemctl(args), args)
+	}
+}
+
+func TestPrivilegeRules(t *testing.T) {
+	assert.Contains(t, polkitRule("unitmgr"), `subject.user == "unitmgr"`)
+	assert.Equal(t, "unitmgr ALL=(root) NOPASSWD: /usr/local/bin/unitmgr privileged /etc/systemd/system *\n", sudoersRule("unitmgr", "/etc/systemd/system/", "/usr/local/bin/unitmgr"))
+	assert.Equal(t, []string{"sudo", "-n", "/usr/local/bin/unitmgr", "privileged", "/etc/systemd/system"}, privilegePrefix("sudo", "/usr/local/bin/unitmgr", "/etc/systemd/system"))
+	assert.Nil(t, privilegePrefix("polkit", "/usr/local/bin/unitmgr", "/etc/systemd/system"))
+}
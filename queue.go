@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// queueEntry is an action postponed by one of the running instance's reconcilers.
+type queueEntry struct {
+	Src string `json:"src"`
+	*reconciler.QueuedAction
+}
+
+type queueRequest struct {
+	ID  string `json:"id"`
+	Src string `json:"src,omitempty"` // required when several reconcilers queued the same action, e.g. with -inventory
+}
+
+// queue returns the postponed actions of every reconciler.
+func (c *controlServer) queue() []*queueEntry {
+	c.mu.Lock()
+	reconcilers := c.reconcilers
+	c.mu.Unlock()
+
+	entries := []*queueEntry{}
+	for _, rec := range reconcilers {
+		for _, action := range rec.Queue() {
+			entries = append(entries, &queueEntry{Src: rec.Src, QueuedAction: action})
+		}
+	}
+	return entries
+}
+
+// handleQueue serves /v1/queue and its subpaths:
+//
+//	GET  /v1/queue           lists the postponed actions
+//	POST /v1/queue/run       runs an action now, e.g. a restart deferred by the resource guard
+//	POST /v1/queue/cancel    drops an action
+func (c *controlServer) handleQueue(w http.ResponseWriter, r *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/queue"), "/")
+	switch {
+	case op == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.queue())
+		return
+	case (op == "run" || op == "cancel") && r.Method == http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &queueRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ID == "" {
+		http.Error(w, "expected a json body with an id", http.StatusBadRequest)
+		return
+	}
+	var match *queueEntry
+	for _, entry := range c.queue() {
+		if entry.ID != req.ID || (req.Src != "" && entry.Src != req.Src) {
+			continue
+		}
+		if match != nil {
+			http.Error(w, fmt.Sprintf("%s is queued for several sources, pass one of them as src", req.ID), http.StatusConflict)
+			return
+		}
+		match = entry
+	}
+	if match == nil {
+		http.Error(w, fmt.Sprintf("no action %q is queued", req.ID), http.StatusNotFound)
+		return
+	}
+
+	if err := c.runQueued(r.Context(), op, match); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(match)
+}
+
+// runQueued runs or cancels the queued action, syncing its unit right away.
+func (c *controlServer) runQueued(ctx context.Context, op string, entry *queueEntry) error {
+	c.mu.Lock()
+	var rec *reconciler.Reconciler
+	for _, candidate := range c.reconcilers {
+		if candidate.Src == entry.Src {
+			rec = candidate
+		}
+	}
+	c.mu.Unlock()
+	if rec == nil {
+		return errors.New("the action's source is gone")
+	}
+
+	var (
+		unit string
+		err  error
+	)
+	switch {
+	case op == "cancel":
+		unit, err = rec.CancelQueued(entry.ID)
+	case entry.Action == "reboot":
+		if c.Reboot == nil {
+			return errors.New("the host can't be rebooted by unitmgr")
+		}
+		return c.Reboot(ctx, rec)
+	default:
+		unit, err = rec.RunQueued(entry.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Trigger != nil {
+		c.Trigger(path.Join(rec.Src, unit))
+	}
+	return nil
+}
+
+// postQueue asks the running instance to run or cancel a queued action.
+func postQueue(client *http.Client, op, id string) (*queueEntry, error) {
+	body, err := json.Marshal(&queueRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post("http://unitmgr/v1/queue/"+op, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	entry := &queueEntry{}
+	return entry, json.NewDecoder(resp.Body).Decode(entry)
+}
+
+func getQueue(client *http.Client) ([]*queueEntry, error) {
+	resp, err := client.Get("http://unitmgr/v1/queue")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var entries []*queueEntry
+	return entries, json.NewDecoder(resp.Body).Decode(&entries)
+}
+
+func queueCommand() int {
+	args := flag.Args()
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		entries, err := getQueue(controlClient(*control))
+		if err != nil && notRunning(err) && *statePath != "" {
+			entries, err = persistedQueue() // no instance is running, so list what it persisted
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while listing the queue: %s\n", err)
+			return exitFailed
+		}
+		if !structured(os.Stdout, entries) {
+			printQueue(os.Stdout, entries)
+		}
+		return exitConverged
+
+	case len(args) == 2 && (args[0] == "run" || args[0] == "cancel"):
+		entry, err := postQueue(controlClient(*control), args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while trying to %s %s, is unitmgr running? %s\n", args[0], args[1], err)
+			return exitFailed
+		}
+		if !structured(os.Stdout, entry) {
+			if args[0] == "run" {
+				fmt.Printf("running %s of %s\n", entry.Action, entry.Unit)
+			} else {
+				fmt.Printf("cancelled %s of %s\n", entry.Action, entry.Unit)
+			}
+		}
+		return exitConverged
+
+	default:
+		fmt.Fprintln(os.Stderr, "usage: unitmgr queue [list | run <id> | cancel <id>]")
+		return exitFailed
+	}
+}
+
+// persistedQueue reads the queued actions from the state file.
+func persistedQueue() ([]*queueEntry, error) {
+	_, reconcilers, err := setup()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := loadState(reconcilers); err != nil {
+		return nil, err
+	}
+	entries := []*queueEntry{}
+	for _, rec := range reconcilers {
+		for _, action := range rec.Queue() {
+			entries = append(entries, &queueEntry{Src: rec.Src, QueuedAction: action})
+		}
+	}
+	return entries, nil
+}
+
+func printQueue(w io.Writer, entries []*queueEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "no queued actions")
+		return
+	}
+	fmt.Fprintf(w, "%-40s %-20s %s\n", "ID", "QUEUED", "REASON")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%-40s %-20s %s\n", entry.ID, entry.Since.Local().Format("2006-01-02 15:04:05"), entry.Reason)
+	}
+}
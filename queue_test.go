@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlServerQueue(t *testing.T) {
+	name := path.Join(t.TempDir(), "unitmgr.sock")
+	listener, err := listenControl(name)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var triggered []string
+	cs := &controlServer{Trigger: func(name string) { triggered = append(triggered, name) }}
+	go http.Serve(listener, cs.Handler())
+	client := controlClient(name)
+
+	entries, err := getQueue(client)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	src := t.TempDir()
+	sysd := &fakeRebooter{}
+	rec := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+	unit := path.Join(src, "fsck.service")
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Service]\nExecStart=/bin/a\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, rec.Sync(context.Background()))
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Service]\nExecStart=/bin/b\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, rec.Sync(context.Background()))
+	cs.SetReports([]*reconciler.Reconciler{rec}, true)
+
+	entries, err = getQueue(client)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, src, entries[0].Src)
+	assert.Equal(t, "reboot:fsck.service", entries[0].ID)
+
+	_, err = postQueue(client, "run", "restart:fsck.service")
+	assert.EqualError(t, err, `unexpected status 404: no action "restart:fsck.service" is queued`)
+	_, err = postQueue(client, "run", "reboot:fsck.service")
+	assert.EqualError(t, err, "unexpected status 409: the host can't be rebooted by unitmgr")
+
+	// Queued reboots run right away
+	cs.Reboot = rebootHost
+	entry, err := postQueue(client, "run", "reboot:fsck.service")
+	require.NoError(t, err)
+	assert.Equal(t, "fsck.service", entry.Unit)
+	assert.Equal(t, 1, sysd.Reboots)
+	assert.Empty(t, rec.RebootRequired())
+	assert.Empty(t, triggered)
+
+	resp, err := client.Post("http://unitmgr/v1/queue/cancel", "application/json", bytes.NewBufferString("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPrintQueue(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printQueue(buf, nil)
+	assert.Equal(t, "no queued actions\n", buf.String())
+
+	buf.Reset()
+	since := time.Date(2021, 1, 2, 3, 4, 5, 0, time.Local)
+	printQueue(buf, []*queueEntry{{Src: "/src", QueuedAction: &reconciler.QueuedAction{ID: "restart:a.service", Since: since, Reason: "load 3.00 per cpu exceeds 2.00"}}})
+	assert.Equal(t, "ID                                       QUEUED               REASON\nrestart:a.service                        2021-01-02 03:04:05  load 3.00 per cpu exceeds 2.00\n", buf.String())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// readiness tells systemd that unitmgr started once the first sync succeeded, so units ordered after a Type=notify
+// unitmgr service only start on a converged host. Timeout bounds the wait, so hosts whose units keep failing still boot.
+type readiness struct {
+	Timeout time.Duration // zero to wait for a successful sync forever
+	Notify  func() error  // defaults to sdNotifyReady
+
+	once sync.Once
+}
+
+// Run signals readiness once Timeout passes, unless a sync succeeded before.
+func (r *readiness) Run(ctx context.Context) {
+	if r.Timeout <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(r.Timeout):
+		r.ready(fmt.Sprintf("warning: signaling readiness since no sync succeeded within %s", r.Timeout))
+	}
+}
+
+// Synced signals readiness after the first successful sync.
+func (r *readiness) Synced(ok bool) {
+	if ok {
+		r.ready("converged, signaling readiness")
+	}
+}
+
+func (r *readiness) ready(msg string) {
+	r.once.Do(func() {
+		notify := r.Notify
+		if notify == nil {
+			notify = sdNotifyReady
+		}
+		log.Print(msg)
+		if err := notify(); err != nil {
+			log.Printf("error while notifying systemd of readiness: %s", err)
+		}
+	})
+}
+
+// sdNotifyReady sends READY=1 to the socket systemd passes to Type=notify services, see sd_notify(3).
+// It does nothing when unitmgr isn't started by such a service.
+func sdNotifyReady() error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("READY=1"))
+	return err
+}
+
+// converged returns true if the running instance applied every unit: its last sync succeeded and no restart is deferred.
+func converged(reports []*reconciler.HostReport) bool {
+	if len(reports) == 0 {
+		return false // no sync has completed yet
+	}
+	for _, report := range reports {
+		if !report.OK || len(report.Deferred) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// waitCommand blocks until the running instance converged, e.g. for provisioning scripts to know units are applied.
+// The instance may not be running yet when it's called early during boot.
+func waitCommand() int {
+	if !*waitConv {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr wait -converged")
+		return exitFailed
+	}
+
+	ctx := context.Background()
+	if *waitT > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *waitT)
+		defer cancel()
+	}
+
+	client := controlClient(*control)
+	for {
+		reports, err := getStatus(client)
+		if err == nil && converged(reports) {
+			if !structured(os.Stdout, reports) {
+				printStatus(os.Stdout, reports)
+			}
+			return exitConverged
+		}
+		if err != nil && !notRunning(err) {
+			log.Printf("error while querying %s: %s", *control, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(os.Stderr, "unitmgr didn't converge within %s\n", *waitT)
+			if err == nil {
+				printStatus(os.Stderr, reports)
+			}
+			return exitFailed
+		case <-time.After(time.Second):
+		}
+	}
+}
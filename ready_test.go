@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	notified := 0
+	r := &readiness{Notify: func() error { notified++; return nil }}
+	r.Synced(false)
+	assert.Equal(t, 0, notified)
+	r.Synced(true)
+	r.Synced(true)
+	assert.Equal(t, 1, notified)
+
+	// Hosts whose units keep failing are still declared ready eventually
+	done := make(chan struct{})
+	r = &readiness{Timeout: time.Millisecond, Notify: func() error { close(done); return nil }}
+	go r.Run(context.Background())
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("readiness wasn't signaled after the timeout")
+	}
+}
+
+func TestSdNotifyReady(t *testing.T) {
+	name := path.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", name)
+	require.NoError(t, sdNotifyReady())
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(t, sdNotifyReady())
+}
+
+func TestWaitCommand(t *testing.T) {
+	defer func(c string, conv bool, timeout time.Duration) { *control, *waitConv, *waitT = c, conv, timeout }(*control, *waitConv, *waitT)
+	*control = path.Join(t.TempDir(), "unitmgr.sock")
+	*waitConv = true
+	*waitT = time.Millisecond * 100
+
+	// Nothing is listening yet
+	assert.Equal(t, exitFailed, waitCommand())
+
+	listener, err := listenControl(*control)
+	require.NoError(t, err)
+	defer listener.Close()
+	cs := &controlServer{}
+	go http.Serve(listener, cs.Handler())
+
+	r := &reconciler.Reconciler{Src: "/src", State: map[string]string{}}
+	cs.SetReports([]*reconciler.Reconciler{r}, false)
+	assert.Equal(t, exitFailed, waitCommand())
+
+	cs.SetReports([]*reconciler.Reconciler{r}, true)
+	assert.Equal(t, exitConverged, waitCommand())
+
+	*waitConv = false
+	assert.Equal(t, exitFailed, waitCommand())
+}
+
+func TestConverged(t *testing.T) {
+	assert.False(t, converged(nil))
+	assert.True(t, converged([]*reconciler.HostReport{{OK: true}}))
+	assert.False(t, converged([]*reconciler.HostReport{{OK: true}, {OK: false}}))
+	assert.False(t, converged([]*reconciler.HostReport{{OK: true, Deferred: map[string]string{"a.service": "load"}}}))
+}
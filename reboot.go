@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// rebooter is implemented by Systemd implementations that can reboot their host.
+type rebooter interface {
+	Reboot(ctx context.Context) error
+}
+
+// maintenanceWindow is a daily range of local time, optionally limited to some days of the week,
+// parsed from e.g. "02:00-04:00" or "Sat,Sun 22:00-02:00". Ranges ending before they start cross midnight.
+type maintenanceWindow struct {
+	Days       map[time.Weekday]bool // empty for every day
+	Start, End time.Duration         // since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	w := &maintenanceWindow{Days: map[time.Weekday]bool{}}
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+	case 2:
+		for _, day := range strings.Split(fields[0], ",") {
+			wd, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", day)
+			}
+			w.Days[wd] = true
+		}
+	default:
+		return nil, fmt.Errorf("expected [days] HH:MM-HH:MM, got %q", s)
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", fields[len(fields)-1])
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return nil, err
+	}
+	if w.End, err = parseTimeOfDay(times[1]); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if the given time falls within the window.
+// The days of windows crossing midnight refer to the day they start.
+func (w *maintenanceWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	day := t.Weekday()
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End && w.day(day)
+	}
+	if offset >= w.Start {
+		return w.day(day)
+	}
+	return offset < w.End && w.day((day+6)%7) // started the previous day
+}
+
+func (w *maintenanceWindow) day(d time.Weekday) bool {
+	return len(w.Days) == 0 || w.Days[d]
+}
+
+// rebootScheduler reboots hosts whose applied unit changes require it, within the maintenance window.
+type rebootScheduler struct {
+	Reconcilers []*reconciler.Reconciler
+	Window      *maintenanceWindow // optional, reboot at any time when nil
+	Paused      func() bool        // optional, e.g. while not holding the leader lease
+	now         func() time.Time
+}
+
+func (s *rebootScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+func (s *rebootScheduler) check(ctx context.Context) {
+	if s.Paused != nil && s.Paused() {
+		return
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	if s.Window != nil && !s.Window.Contains(now()) {
+		return
+	}
+
+	for _, rec := range s.Reconcilers {
+		units := rec.RebootRequired()
+		if len(units) == 0 {
+			continue
+		}
+		if _, ok := rec.Systemd.(rebooter); !ok {
+			continue // the reboot stays reported
+		}
+		if err := rebootHost(ctx, rec); err != nil {
+			log.Printf("error while rebooting: %s", err)
+		}
+	}
+}
+
+// rebootHost reboots the host of the reconciler to apply the changes requiring it.
+func rebootHost(ctx context.Context, rec *reconciler.Reconciler) error {
+	sysd, ok := rec.Systemd.(rebooter)
+	if !ok {
+		return errors.New("the backend can't reboot the host")
+	}
+	log.Printf("rebooting to apply changes to units: %s", strings.Join(rec.RebootRequired(), ", "))
+	if err := sysd.Reboot(ctx); err != nil {
+		return err
+	}
+	rec.Rebooted()
+	return nil
+}
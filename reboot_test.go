@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 1, day, hour, minute, 0, 0, time.UTC) // 2021-01-02 was a Saturday
+	}
+
+	w, err := parseMaintenanceWindow("02:00-04:00")
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(4, 2, 0)))
+	assert.True(t, w.Contains(at(4, 3, 59)))
+	assert.False(t, w.Contains(at(4, 4, 0)))
+	assert.False(t, w.Contains(at(4, 1, 59)))
+
+	w, err = parseMaintenanceWindow("Sat,sun 22:00-02:00")
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(2, 23, 0)))  // Saturday night
+	assert.True(t, w.Contains(at(3, 1, 0)))   // Sunday morning, started on Saturday
+	assert.True(t, w.Contains(at(4, 1, 0)))   // Monday morning, started on Sunday
+	assert.False(t, w.Contains(at(2, 1, 0)))  // Saturday morning, started on Friday
+	assert.False(t, w.Contains(at(4, 23, 0))) // Monday night
+
+	for _, invalid := range []string{"", "02:00", "25:00-04:00", "Caturday 02:00-04:00", "Sat 02:00-04:00 extra"} {
+		_, err := parseMaintenanceWindow(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRebootScheduler(t *testing.T) {
+	src := t.TempDir()
+	sysd := &fakeRebooter{}
+	rec := &reconciler.Reconciler{Src: src, Dest: t.TempDir(), State: map[string]string{}, Systemd: sysd}
+
+	unit := path.Join(src, "fsck.service")
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Service]\nExecStart=/bin/a\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, rec.Sync(context.Background()))
+	require.NoError(t, ioutil.WriteFile(unit, []byte("[Service]\nExecStart=/bin/b\n\n[Install]\nWantedBy=sysinit.target\n"), 0644))
+	require.True(t, rec.Sync(context.Background()))
+	require.Equal(t, []string{"fsck.service"}, rec.RebootRequired())
+
+	window, err := parseMaintenanceWindow("02:00-04:00")
+	require.NoError(t, err)
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.Local)
+	rs := &rebootScheduler{Reconcilers: []*reconciler.Reconciler{rec}, Window: window, now: func() time.Time { return now }}
+
+	rs.check(context.Background())
+	assert.Equal(t, 0, sysd.Reboots)
+
+	now = time.Date(2021, 1, 2, 3, 0, 0, 0, time.Local)
+	rs.check(context.Background())
+	assert.Equal(t, 1, sysd.Reboots)
+	assert.Empty(t, rec.RebootRequired())
+
+	rs.check(context.Background())
+	assert.Equal(t, 1, sysd.Reboots)
+}
+
+type fakeRebooter struct {
+	Reboots int
+}
+
+func (f *fakeRebooter) Restart(ctx context.Context, unit string) error { return nil }
+func (f *fakeRebooter) EnsureRunning(ctx context.Context, unit string) (bool, error) {
+	return false, nil
+}
+func (f *fakeRebooter) EnsureStopped(ctx context.Context, unit string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeRebooter) Reboot(ctx context.Context) error {
+	f.Reboots++
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reexecer is implemented by Systemd implementations that can re-execute the systemd manager.
+type reexecer interface {
+	DaemonReexec(ctx context.Context) error
+}
+
+// managerPackages are the package manager records of the systemd package, modified when it's upgraded.
+var managerPackages = []string{
+	"/var/lib/dpkg/info/systemd.list",
+	"/var/lib/pacman/local/systemd-[0-9]*/files",
+}
+
+// clockTicks is the USER_HZ of process start times in /proc, 100 on every architecture Linux supports.
+const clockTicks = 100
+
+// reexecScheduler re-executes systemd within the maintenance window once its binary on disk
+// is newer than the running manager, so long-lived hosts don't keep running stale managers after upgrades.
+type reexecScheduler struct {
+	Systemd  reexecer
+	Window   *maintenanceWindow // optional, re-execute at any time when nil
+	Paused   func() bool        // optional, e.g. while not holding the leader lease
+	Proc     string             // defaults to /proc
+	Packages []string           // defaults to managerPackages
+	now      func() time.Time
+
+	reexeced time.Time // changes made before the last re-exec are already running
+	lastErr  string
+}
+
+func (s *reexecScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+func (s *reexecScheduler) check(ctx context.Context) {
+	if s.Paused != nil && s.Paused() {
+		return
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	if s.Window != nil && !s.Window.Contains(now()) {
+		return
+	}
+
+	reason, err := s.stale()
+	if err != nil {
+		if err.Error() != s.lastErr { // e.g. without the privileges to read /proc/1/exe, which won't change every minute
+			log.Printf("error while checking whether systemd was upgraded: %s", err)
+		}
+		s.lastErr = err.Error()
+		return
+	}
+	s.lastErr = ""
+	if reason == "" {
+		return
+	}
+
+	log.Printf("re-executing systemd since %s", reason)
+	if err := s.Systemd.DaemonReexec(ctx); err != nil {
+		log.Printf("error while re-executing systemd: %s", err)
+		return
+	}
+	s.reexeced = now()
+}
+
+// stale returns why the running systemd manager is older than its binary or package on disk, or "" if it isn't.
+func (s *reexecScheduler) stale() (string, error) {
+	proc := s.Proc
+	if proc == "" {
+		proc = "/proc"
+	}
+	exe, err := os.Readlink(path.Join(proc, "1", "exe"))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(exe, " (deleted)") {
+		return fmt.Sprintf("its binary %s was replaced", strings.TrimSuffix(exe, " (deleted)")), nil
+	}
+
+	started, err := managerStarted(proc)
+	if err != nil {
+		return "", err
+	}
+	if s.reexeced.After(started) {
+		started = s.reexeced
+	}
+
+	patterns := s.Packages
+	if patterns == nil {
+		patterns = managerPackages
+	}
+	files := []string{exe}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if stat.ModTime().After(started) {
+			return fmt.Sprintf("%s was modified at %s, after it started at %s", file, stat.ModTime().Format(time.RFC3339), started.Format(time.RFC3339)), nil
+		}
+	}
+	return "", nil
+}
+
+// managerStarted returns when PID 1 started from the boot time in /proc/stat and its start time in /proc/1/stat.
+func managerStarted(proc string) (time.Time, error) {
+	buf, err := ioutil.ReadFile(path.Join(proc, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var boot int64 = -1
+	for _, line := range strings.Split(string(buf), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "btime" {
+			if boot, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+				return time.Time{}, fmt.Errorf("unexpected btime %q", fields[1])
+			}
+		}
+	}
+	if boot < 0 {
+		return time.Time{}, fmt.Errorf("no btime in %s", path.Join(proc, "stat"))
+	}
+
+	buf, err = ioutil.ReadFile(path.Join(proc, "1", "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the fields following the command name, which may contain spaces and parentheses
+	fields := strings.Fields(string(buf[strings.LastIndexByte(string(buf), ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected /proc/1/stat %q", buf)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected start time %q", fields[19])
+	}
+	return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
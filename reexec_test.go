@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReexecScheduler(t *testing.T) {
+	dir := t.TempDir()
+	proc := path.Join(dir, "proc")
+	require.NoError(t, os.MkdirAll(path.Join(proc, "1"), 0755))
+	boot := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, ioutil.WriteFile(path.Join(proc, "stat"), []byte(fmt.Sprintf("cpu  1 2 3\nbtime %d\nprocesses 10\n", boot.Unix())), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(proc, "1", "stat"), []byte("1 (systemd) S 0 1 1 0 -1 4194560 1 2 3 4 5 6 7 8 20 0 1 0 150 1000 100\n"), 0644))
+
+	binary := path.Join(dir, "systemd")
+	pkg := path.Join(dir, "systemd.list")
+	require.NoError(t, ioutil.WriteFile(binary, nil, 0755))
+	require.NoError(t, ioutil.WriteFile(pkg, nil, 0644))
+	require.NoError(t, os.Chtimes(binary, boot, boot))
+	require.NoError(t, os.Chtimes(pkg, boot, boot))
+	require.NoError(t, os.Symlink(binary, path.Join(proc, "1", "exe")))
+
+	started, err := managerStarted(proc)
+	require.NoError(t, err)
+	assert.Equal(t, boot.Add(time.Millisecond*1500), started.UTC())
+
+	window, err := parseMaintenanceWindow("02:00-04:00")
+	require.NoError(t, err)
+	now := time.Date(2021, 1, 2, 3, 0, 0, 0, time.Local)
+	sysd := &fakeReexecer{}
+	xs := &reexecScheduler{Systemd: sysd, Window: window, Proc: proc, Packages: []string{pkg}, now: func() time.Time { return now }}
+
+	xs.check(context.Background())
+	assert.Equal(t, 0, sysd.Reexecs, "up to date")
+
+	upgraded := boot.Add(time.Hour)
+	require.NoError(t, os.Chtimes(pkg, upgraded, upgraded))
+	now = time.Date(2021, 1, 2, 12, 0, 0, 0, time.Local)
+	xs.check(context.Background())
+	assert.Equal(t, 0, sysd.Reexecs, "outside of the window")
+
+	now = time.Date(2021, 1, 2, 3, 0, 0, 0, time.Local)
+	xs.check(context.Background())
+	assert.Equal(t, 1, sysd.Reexecs)
+
+	xs.check(context.Background())
+	assert.Equal(t, 1, sysd.Reexecs, "already re-executed")
+
+	require.NoError(t, os.Remove(path.Join(proc, "1", "exe")))
+	require.NoError(t, os.Symlink("/usr/lib/systemd/systemd (deleted)", path.Join(proc, "1", "exe")))
+	reason, err := xs.stale()
+	require.NoError(t, err)
+	assert.Equal(t, "its binary /usr/lib/systemd/systemd was replaced", reason)
+}
+
+type fakeReexecer struct {
+	Reexecs int
+}
+
+func (f *fakeReexecer) DaemonReexec(ctx context.Context) error {
+	f.Reexecs++
+	return nil
+}
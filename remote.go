@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inventory lists the remote hosts managed over ssh.
+type inventory struct {
+	Hosts []*inventoryHost `json:"hosts"`
+}
+
+type inventoryHost struct {
+	Name    string `json:"name"`
+	Address string `json:"address"` // ssh destination, e.g. root@web1.example.com
+	Src     string `json:"src"`     // defaults to <src>/hosts/<name>
+}
+
+func loadInventory(name, src string) (*inventory, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	inv := &inventory{}
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(inv); err != nil {
+		return nil, fmt.Errorf("decoding inventory: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, host := range inv.Hosts {
+		if !validUnitName(host.Name) || host.Address == "" {
+			return nil, fmt.Errorf("inventory hosts require a valid name and address")
+		}
+		if seen[host.Name] {
+			return nil, fmt.Errorf("duplicate inventory host %q", host.Name)
+		}
+		seen[host.Name] = true
+
+		if host.Src == "" {
+			host.Src = path.Join(src, "hosts", host.Name)
+		}
+	}
+
+	return inv, nil
+}
+
+// sshDir is a unit file directory on a remote host, accessed with the ssh client.
+type sshDir struct {
+	Address string
+	Dir     string
+	Timeout time.Duration
+	Command string // defaults to ssh
+}
+
+func (d *sshDir) Checksum(unit string) (string, error) {
+	name := path.Join(d.Dir, unit)
+	out, err := d.run(nil, fmt.Sprintf("if [ -e %s ]; then sha256sum %s; fi", shellQuote(name), shellQuote(name)))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", &os.PathError{Op: "open", Path: d.Address + ":" + name, Err: os.ErrNotExist}
+	}
+	return fields[0], nil
+}
+
+func (d *sshDir) Read(unit string) ([]byte, error) {
+	// The first byte distinguishes missing files from empty ones
+	name := shellQuote(path.Join(d.Dir, unit))
+	out, err := d.run(nil, fmt.Sprintf("if [ -e %s ]; then printf 1; cat %s; else printf 0; fi", name, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 || out[0] != '1' {
+		return nil, &os.PathError{Op: "open", Path: d.Address + ":" + path.Join(d.Dir, unit), Err: os.ErrNotExist}
+	}
+	return out[1:], nil
+}
+
+func (d *sshDir) Copy(src, unit string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := shellQuote(path.Join(d.Dir, unit))
+	tmp := shellQuote(path.Join(d.Dir, "."+unit+".tmp"))
+	_, err = d.run(file, fmt.Sprintf("cat > %s && chmod %o %s && mv %s %s", tmp, stat.Mode().Perm(), tmp, tmp, name))
+	return err
+}
+
+func (d *sshDir) Remove(unit string) error {
+	_, err := d.run(nil, "rm -f "+shellQuote(path.Join(d.Dir, unit)))
+	return err
+}
+
+func (d *sshDir) Mode(unit string) (os.FileMode, error) {
+	out, err := d.run(nil, "stat -c %a "+shellQuote(path.Join(d.Dir, unit)))
+	if err != nil {
+		return 0, err
+	}
+	mode, err := strconv.ParseUint(strings.TrimSpace(string(out)), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parsing mode: %w", err)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (d *sshDir) Chmod(unit string, mode os.FileMode) error {
+	_, err := d.run(nil, fmt.Sprintf("chmod %o %s", mode, shellQuote(path.Join(d.Dir, unit))))
+	return err
+}
+
+func (d *sshDir) Link(name, target string) error {
+	name = path.Join(d.Dir, name)
+	_, err := d.run(nil, fmt.Sprintf("mkdir -p %s && ln -sfn %s %s", shellQuote(path.Dir(name)), shellQuote(target), shellQuote(name)))
+	return err
+}
+
+func (d *sshDir) Unlink(name string) error {
+	_, err := d.run(nil, "rm -f "+shellQuote(path.Join(d.Dir, name)))
+	return err
+}
+
+func (d *sshDir) run(stdin *os.File, script string) ([]byte, error) {
+	ctx, done := context.WithTimeout(context.Background(), d.Timeout)
+	defer done()
+
+	command := d.Command
+	if command == "" {
+		command = "ssh"
+	}
+
+	cmd := exec.CommandContext(ctx, command, "-o", "BatchMode=yes", d.Address, script)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("ssh error msg: %s", strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("ssh error: %w", err)
+	}
+	return out, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadInventory(t *testing.T) {
+	name := path.Join(t.TempDir(), "inventory.json")
+	err := ioutil.WriteFile(name, []byte(`{"hosts": [
+		{"name": "web1", "address": "root@web1"},
+		{"name": "web2", "address": "root@web2", "src": "/elsewhere"}
+	]}`), 0644)
+	require.NoError(t, err)
+
+	inv, err := loadInventory(name, "/units")
+	require.NoError(t, err)
+	require.Len(t, inv.Hosts, 2)
+	assert.Equal(t, "/units/hosts/web1", inv.Hosts[0].Src)
+	assert.Equal(t, "/elsewhere", inv.Hosts[1].Src)
+
+	err = ioutil.WriteFile(name, []byte(`{"hosts": [{"name": "../web1", "address": "root@web1"}]}`), 0644)
+	require.NoError(t, err)
+	_, err = loadInventory(name, "/units")
+	assert.Error(t, err)
+}
+
+func TestSSHDir(t *testing.T) {
+	// Fake ssh client that runs the remote script locally
+	fake := path.Join(t.TempDir(), "ssh")
+	err := ioutil.WriteFile(fake, []byte("#!/bin/sh\nshift 3\nexec sh -c \"$1\"\n"), 0755)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	d := &sshDir{Address: "host", Dir: dir, Timeout: time.Second * 5, Command: fake}
+
+	_, err = d.Checksum("it's.service")
+	assert.True(t, os.IsNotExist(err))
+
+	src := path.Join(t.TempDir(), "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("test1"), 0644))
+	require.NoError(t, d.Copy(src, "it's.service"))
+
+	expected, err := reconciler.FileChecksum(src)
+	require.NoError(t, err)
+	checksum, err := d.Checksum("it's.service")
+	require.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+
+	content, err := d.Read("it's.service")
+	require.NoError(t, err)
+	assert.Equal(t, "test1", string(content))
+	_, err = d.Read("missing.service")
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, d.Link("unitmgr.target.wants/it's.service", "../it's.service"))
+	link, err := os.Readlink(path.Join(dir, "unitmgr.target.wants", "it's.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "../it's.service", link)
+	require.NoError(t, d.Unlink("unitmgr.target.wants/it's.service"))
+	assert.NoFileExists(t, path.Join(dir, "unitmgr.target.wants", "it's.service"))
+
+	require.NoError(t, d.Remove("it's.service"))
+	assert.NoFileExists(t, path.Join(dir, "it's.service"))
+}
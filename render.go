@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// renderedHeader starts every file rendered from a template, so renderers can tell them from other unit files.
+const renderedHeader = "# Rendered by unitmgr from %s, changes will be overwritten\n"
+
+// renderer renders the templates in the src directory, files named like <unit>.tmpl, into <unit> next to them.
+// Units are applied like any other once rendered, so a template rendering different content restarts its unit.
+type renderer struct {
+	Dir      string
+	Cloud    string         // provider of the .Cloud facts, see cloudProviders, empty to leave them unset
+	Client   *http.Client   // for metadata services
+	FactsTTL time.Duration  // how long facts are cached, zero to read them once
+	DNS      *dnsCache      // resolves the srv and ips functions, optional
+	Consul   *consulBackend // resolves consul-template's key, keyOrDefault, ls, and service functions, optional
+	Vault    *vaultBackend  // resolves consul-template's secret function, optional
+
+	mu      sync.Mutex
+	facts   *cloudFacts
+	fetched time.Time
+}
+
+// templateData is what templates are executed with.
+type templateData struct {
+	Host  string      // hostname
+	Cloud *cloudFacts // nil unless -cloud is set, so templates using it fail to render until the facts are known
+}
+
+// Run renders the templates until the context is canceled.
+func (r *renderer) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := r.Render(ctx); err != nil {
+			log.Printf("error while rendering templates: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Render renders every template, keeping the previously rendered file of templates that fail to render,
+// and removes the rendered files whose templates were removed.
+func (r *renderer) Render(ctx context.Context) error {
+	data := &templateData{Cloud: r.cloudFacts(ctx)}
+	data.Host, _ = os.Hostname()
+	funcs := r.funcs(ctx)
+
+	files, err := ioutil.ReadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, stat := range files {
+		name := stat.Name()
+		if !stat.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, reconciler.TemplateSuffix) && validUnitName(name) {
+			if err := r.render(name, stat.Mode().Perm(), funcs, data); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+			}
+			continue
+		}
+		if !hasTemplate(r.Dir, name) && r.renderedFile(name) {
+			if err := os.Remove(path.Join(r.Dir, name)); err != nil {
+				return err
+			}
+			log.Printf("removed unit whose template was removed: %s", name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// funcs returns the functions available to templates. Those of unconfigured backends fail to render.
+func (r *renderer) funcs(ctx context.Context) template.FuncMap {
+	if r.DNS == nil {
+		r.DNS = &dnsCache{}
+	}
+	if r.Consul == nil {
+		r.Consul = &consulBackend{}
+	}
+	if r.Vault == nil {
+		r.Vault = &vaultBackend{}
+	}
+	funcs := consulTemplateFuncs()
+	for _, backend := range []template.FuncMap{r.DNS.Funcs(ctx), r.Consul.Funcs(ctx), r.Vault.Funcs(ctx)} {
+		for name, fn := range backend {
+			funcs[name] = fn
+		}
+	}
+	return funcs
+}
+
+// render writes the output of a template if it changed.
+func (r *renderer) render(name string, mode os.FileMode, funcs template.FuncMap, data *templateData) error {
+	content, err := ioutil.ReadFile(path.Join(r.Dir, name))
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, renderedHeader, name)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return err
+	}
+
+	unit := path.Join(r.Dir, strings.TrimSuffix(name, reconciler.TemplateSuffix))
+	if current, err := ioutil.ReadFile(unit); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+	if err := reconciler.WriteFileAtomicMode(unit, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	log.Printf("rendered unit: %s", path.Base(unit))
+	return nil
+}
+
+// renderedFile returns true if the file was written by a renderer.
+func (r *renderer) renderedFile(name string) bool {
+	file, err := os.Open(path.Join(r.Dir, name))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	buf := make([]byte, 256)
+	n, _ := file.Read(buf)
+	return bytes.HasPrefix(buf[:n], []byte(fmt.Sprintf(renderedHeader, name+reconciler.TemplateSuffix)))
+}
+
+// cloudFacts returns the cached facts, reading them again once FactsTTL passed.
+// Stale facts are kept when they can't be read.
+func (r *renderer) cloudFacts(ctx context.Context) *cloudFacts {
+	if r.Cloud == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.facts != nil && (r.FactsTTL <= 0 || time.Since(r.fetched) < r.FactsTTL) {
+		return r.facts
+	}
+
+	facts, err := fetchCloudFacts(ctx, r.Client, r.Cloud)
+	if err != nil {
+		log.Printf("error while reading instance metadata: %s", err)
+		return r.facts
+	}
+	r.facts, r.fetched = facts, time.Now()
+	return facts
+}
+
+// hasTemplate returns true if the file in dir is rendered from a template, so sources mirroring
+// unit files into dir don't remove it.
+func hasTemplate(dir, name string) bool {
+	_, err := os.Stat(path.Join(dir, name+reconciler.TemplateSuffix))
+	return err == nil
+}
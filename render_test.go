@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "web.service.tmpl"), []byte("[Service]\nEnvironment=HOST={{.Host}}\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "db.service"), []byte("db"), 0644))
+
+	r := &renderer{Dir: dir}
+	require.NoError(t, r.Render(context.Background()))
+	hostname, _ := os.Hostname()
+	content, err := ioutil.ReadFile(path.Join(dir, "web.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "# Rendered by unitmgr from web.service.tmpl, changes will be overwritten\n[Service]\nEnvironment=HOST="+hostname+"\n", string(content))
+	stat, err := os.Stat(path.Join(dir, "web.service"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// Templates that fail to render keep their previous output
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "web.service.tmpl"), []byte("{{.Cloud.Region}}"), 0600))
+	assert.Error(t, r.Render(context.Background()))
+	content, err = ioutil.ReadFile(path.Join(dir, "web.service"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "HOST=")
+
+	// Sources keep rendered files they don't list
+	require.NoError(t, removeUnlisted(dir, map[string]bool{"web.service.tmpl": true}))
+	assert.FileExists(t, path.Join(dir, "web.service"))
+	assert.NoFileExists(t, path.Join(dir, "db.service"))
+
+	// Rendered files are removed with their templates
+	require.NoError(t, os.Remove(path.Join(dir, "web.service.tmpl")))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "db.service"), []byte("db"), 0644))
+	require.NoError(t, r.Render(context.Background()))
+	assert.NoFileExists(t, path.Join(dir, "web.service"))
+	assert.FileExists(t, path.Join(dir, "db.service"))
+}
+
+func TestRendererCloudFacts(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"vmId": "02aab8a4", "location": "westeurope", "tagsList": [{"name": "team", "value": "web"}]}`))
+	}))
+	defer server.Close()
+	defer func(providers map[string]*cloudProvider) { cloudProviders = providers }(cloudProviders)
+	cloudProviders = map[string]*cloudProvider{"azure": {Endpoint: server.URL, Fetch: fetchAzureFacts}}
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "web.service.tmpl"), []byte(`{{.Cloud.InstanceID}} {{.Cloud.Region}} {{index .Cloud.Tags "team"}}`), 0644))
+	r := &renderer{Dir: dir, Cloud: "azure", Client: server.Client()}
+	require.NoError(t, r.Render(context.Background()))
+	require.NoError(t, r.Render(context.Background()))
+	assert.Equal(t, 1, requests) // facts are cached
+
+	content, err := ioutil.ReadFile(path.Join(dir, "web.service"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "02aab8a4 westeurope web")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// statusReporter periodically posts the most recent host report to a central endpoint.
+type statusReporter struct {
+	URL    string
+	Token  string // optional bearer token
+	Client *http.Client
+
+	mu     sync.Mutex
+	report *reconciler.HostReport
+}
+
+func (s *statusReporter) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		s.mu.Lock()
+		report := s.report
+		s.mu.Unlock()
+		if report == nil {
+			continue // no sync has completed yet
+		}
+
+		if err := postReport(s.Client, s.URL, s.Token, report); err != nil {
+			log.Printf("error while reporting status: %s", err)
+		}
+	}
+}
+
+// SetReport stores the most recent state of the local reconciliation to be sent with the next report.
+func (s *statusReporter) SetReport(report *reconciler.HostReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = report
+}
+
+func postReport(client *http.Client, url, token string, report *reconciler.HostReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostReport(t *testing.T) {
+	var received *reconciler.HostReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		received = &reconciler.HostReport{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	r := &reconciler.Reconciler{
+		State:    map[string]string{"test.service": "abc"},
+		Failures: map[string]string{"broken.service": `error while restarting unit "broken.service": oops`},
+	}
+
+	err := postReport(server.Client(), server.URL, "secret", r.Report(false))
+	require.NoError(t, err)
+	assert.False(t, received.OK)
+	assert.NotEmpty(t, received.Host)
+	assert.Equal(t, map[string]string{"test.service": "abc"}, received.Units)
+	assert.Equal(t, map[string]string{"broken.service": `error while restarting unit "broken.service": oops`}, received.Failures)
+
+	err = postReport(server.Client(), server.URL+"/missing", "", r.Report(false))
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path"
+)
+
+// sandboxPath is a path unitmgr may access after sandboxing itself.
+type sandboxPath struct {
+	Path  string
+	Write bool
+}
+
+// sandboxPaths returns the paths unitmgr and the commands it runs need: the system directories read-only,
+// src read-only unless a fleet agent, http source, or rollback writes units to it, and dest, the state and lock directories,
+// the control socket's directory, and the temp directory read-write.
+func sandboxPaths(src, dest, state, lock, control string, mirror bool, home string) []*sandboxPath {
+	paths := []*sandboxPath{
+		{Path: src, Write: mirror},
+		{Path: dest, Write: true},
+		{Path: os.TempDir(), Write: true},
+	}
+	for _, name := range []string{state, lock, control} {
+		if name != "" {
+			paths = append(paths, &sandboxPath{Path: path.Dir(name), Write: true})
+		}
+	}
+	if home != "" {
+		paths = append(paths, &sandboxPath{Path: home}) // ssh keys and configuration
+	}
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib64", "/etc", "/proc", "/sys", "/dev", "/run"} {
+		paths = append(paths, &sandboxPath{Path: dir})
+	}
+	return paths
+}
@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// sandbox restricts the filesystem access of unitmgr and its child processes to the given paths with Landlock,
+// and denies syscalls it never needs with seccomp. Both are inherited by commands like systemctl.
+// Kernels without Landlock only get the seccomp filter.
+func sandbox(paths []*sandboxPath) error {
+	if err := sandboxSupported(); err != nil {
+		return err
+	}
+
+	// Required to install either without CAP_SYS_ADMIN
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+
+	err := landlock(paths)
+	if err == errLandlockUnavailable {
+		log.Printf("warning: landlock isn't available, filesystem access won't be restricted")
+	} else if err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+
+	filter := seccompFilter(seccompArch, seccompNrMask, deniedSyscalls)
+	prog := &syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(prog))); errno != 0 {
+		return fmt.Errorf("installing seccomp filter: %w", errno)
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
+
+// sandboxSupported returns an error if the sandbox can't be installed by this binary. Both restrictions have to
+// be applied to every thread with AllThreadsSyscall, which isn't possible in binaries linked with cgo.
+func sandboxSupported() error {
+	if len(deniedSyscalls) == 0 {
+		return fmt.Errorf("sandboxing isn't supported on %s", runtime.GOARCH)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_GETPID, 0, 0, 0); errno == syscall.ENOTSUP {
+		return errors.New("sandboxing requires a binary built without cgo (CGO_ENABLED=0)")
+	}
+	return nil
+}
+
+// errLandlockUnavailable is returned by landlock when the kernel doesn't support it or it's disabled.
+var errLandlockUnavailable = errors.New("landlock isn't available")
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	// Landlock syscalls have the same numbers on every architecture
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+
+	oPath = 0x200000 // O_PATH, missing from package syscall
+
+	// Access rights of the first Landlock ABI
+	landlockExecute    = 1 << 0
+	landlockWriteFile  = 1 << 1
+	landlockReadFile   = 1 << 2
+	landlockReadDir    = 1 << 3
+	landlockAccessAll  = 1<<13 - 1
+	landlockAccessRead = landlockExecute | landlockReadFile | landlockReadDir
+)
+
+type landlockRulesetAttr struct {
+	HandledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	AllowedAccess uint64
+	ParentFD      int32
+}
+
+func landlock(paths []*sandboxPath) error {
+	attr := &landlockRulesetAttr{HandledAccessFS: landlockAccessAll}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(attr)), unsafe.Sizeof(*attr), 0)
+	if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+		return errLandlockUnavailable
+	}
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(fd))
+
+	for _, p := range paths {
+		dir, err := os.OpenFile(p.Path, oPath|syscall.O_CLOEXEC, 0)
+		if os.IsNotExist(err) {
+			continue // optional system directories like /lib64
+		}
+		if err != nil {
+			return err
+		}
+
+		rule := &landlockPathBeneathAttr{AllowedAccess: landlockAccessRead, ParentFD: int32(dir.Fd())}
+		if p.Write {
+			rule.AllowedAccess = landlockAccessAll
+		}
+		if stat, err := dir.Stat(); err == nil && !stat.IsDir() {
+			rule.AllowedAccess &= landlockExecute | landlockWriteFile | landlockReadFile // only file rights apply to files
+		}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(rule)), 0, 0, 0)
+		dir.Close()
+		if errno != 0 {
+			return fmt.Errorf("adding rule for %s: %w", p.Path, errno)
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restricting threads: %w", errno)
+	}
+	return nil
+}
+
+const (
+	bpfLdAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+	seccompOK = 0x7fff0000
+	seccompEP = 0x00050000 | uint32(syscall.EPERM) // SECCOMP_RET_ERRNO
+)
+
+// seccompFilter returns a BPF program failing the given syscalls with EPERM and allowing everything else.
+// Syscalls of other architectures, like 32 bit compat calls, are denied. If nrMask isn't 0, so are syscall
+// numbers at or above it, like x32 calls on amd64, which share the arch of native calls but would match none of the denied numbers.
+func seccompFilter(arch, nrMask uint32, denied []uint32) []syscall.SockFilter {
+	filter := []syscall.SockFilter{
+		{Code: bpfLdAbs, K: 4}, // seccomp_data.arch
+		{Code: bpfJeqK, Jt: 1, K: arch},
+		{Code: bpfRetK, K: seccompEP},
+		{Code: bpfLdAbs, K: 0}, // seccomp_data.nr
+	}
+	if nrMask != 0 {
+		filter = append(filter, syscall.SockFilter{Code: bpfJgeK, Jt: uint8(len(denied) + 1), K: nrMask})
+	}
+	for i, nr := range denied {
+		// Jump to the final deny when matched
+		filter = append(filter, syscall.SockFilter{Code: bpfJeqK, Jt: uint8(len(denied) - i), K: nr})
+	}
+	return append(filter,
+		syscall.SockFilter{Code: bpfRetK, K: seccompOK},
+		syscall.SockFilter{Code: bpfRetK, K: seccompEP},
+	)
+}
@@ -0,0 +1,37 @@
+package main
+
+const (
+	seccompArch   = 0xc000003e // AUDIT_ARCH_X86_64
+	seccompNrMask = 0x40000000 // __X32_SYSCALL_BIT, x32 syscalls are denied
+)
+
+// deniedSyscalls are syscalls that unitmgr and the commands it runs never need, but that would help an attacker.
+var deniedSyscalls = []uint32{
+	101, // ptrace
+	155, // pivot_root
+	161, // chroot
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	175, // init_module
+	176, // delete_module
+	227, // clock_settime
+	246, // kexec_load
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	272, // unshare
+	298, // perf_event_open
+	304, // open_by_handle_at
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+}
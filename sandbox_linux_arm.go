@@ -0,0 +1,38 @@
+package main
+
+const (
+	seccompArch   = 0x40000028 // AUDIT_ARCH_ARM
+	seccompNrMask = 0
+)
+
+// deniedSyscalls are syscalls that unitmgr and the commands it runs never need, but that would help an attacker.
+var deniedSyscalls = []uint32{
+	21,  // mount
+	26,  // ptrace
+	51,  // acct
+	52,  // umount2
+	61,  // chroot
+	79,  // settimeofday
+	87,  // swapon
+	88,  // reboot
+	115, // swapoff
+	128, // init_module
+	129, // delete_module
+	218, // pivot_root
+	262, // clock_settime
+	309, // add_key
+	310, // request_key
+	311, // keyctl
+	337, // unshare
+	347, // kexec_load
+	364, // perf_event_open
+	371, // open_by_handle_at
+	375, // setns
+	376, // process_vm_readv
+	377, // process_vm_writev
+	379, // finit_module
+	386, // bpf
+	388, // userfaultfd
+	401, // kexec_file_load
+	404, // clock_settime64
+}
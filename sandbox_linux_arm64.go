@@ -0,0 +1,37 @@
+package main
+
+const (
+	seccompArch   = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	seccompNrMask = 0
+)
+
+// deniedSyscalls are syscalls that unitmgr and the commands it runs never need, but that would help an attacker.
+var deniedSyscalls = []uint32{
+	39,  // umount2
+	40,  // mount
+	41,  // pivot_root
+	51,  // chroot
+	89,  // acct
+	97,  // unshare
+	104, // kexec_load
+	105, // init_module
+	106, // delete_module
+	112, // clock_settime
+	117, // ptrace
+	142, // reboot
+	170, // settimeofday
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	224, // swapon
+	225, // swapoff
+	241, // perf_event_open
+	265, // open_by_handle_at
+	268, // setns
+	270, // process_vm_readv
+	271, // process_vm_writev
+	273, // finit_module
+	280, // bpf
+	282, // userfaultfd
+	294, // kexec_file_load
+}
@@ -0,0 +1,11 @@
+//go:build linux && !amd64 && !arm64 && !arm
+// +build linux,!amd64,!arm64,!arm
+
+package main
+
+const (
+	seccompArch   = 0
+	seccompNrMask = 0
+)
+
+var deniedSyscalls []uint32
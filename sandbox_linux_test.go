@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	filter := seccompFilter(0xc000003e, 0, []uint32{101, 165})
+	assert.Equal(t, []syscall.SockFilter{
+		{Code: bpfLdAbs, K: 4},
+		{Code: bpfJeqK, Jt: 1, K: 0xc000003e},
+		{Code: bpfRetK, K: seccompEP},
+		{Code: bpfLdAbs, K: 0},
+		{Code: bpfJeqK, Jt: 2, K: 101},
+		{Code: bpfJeqK, Jt: 1, K: 165},
+		{Code: bpfRetK, K: seccompOK},
+		{Code: bpfRetK, K: seccompEP},
+	}, filter)
+}
+
+func TestSeccompFilterX32(t *testing.T) {
+	filter := seccompFilter(0xc000003e, 0x40000000, []uint32{101, 165})
+	assert.Equal(t, []syscall.SockFilter{
+		{Code: bpfLdAbs, K: 4},
+		{Code: bpfJeqK, Jt: 1, K: 0xc000003e},
+		{Code: bpfRetK, K: seccompEP},
+		{Code: bpfLdAbs, K: 0},
+		{Code: bpfJgeK, Jt: 3, K: 0x40000000},
+		{Code: bpfJeqK, Jt: 2, K: 101},
+		{Code: bpfJeqK, Jt: 1, K: 165},
+		{Code: bpfRetK, K: seccompOK},
+		{Code: bpfRetK, K: seccompEP},
+	}, filter)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSandboxPaths(t *testing.T) {
+	paths := sandboxPaths("/units", "/etc/systemd/system", "/var/lib/unitmgr/state.json", "/etc/systemd/system/.unitmgr.lock", "", false, "")
+	assert.Equal(t, &sandboxPath{Path: "/units"}, paths[0])
+	assert.Equal(t, &sandboxPath{Path: "/etc/systemd/system", Write: true}, paths[1])
+	assert.Equal(t, &sandboxPath{Path: os.TempDir(), Write: true}, paths[2])
+	assert.Equal(t, &sandboxPath{Path: "/var/lib/unitmgr", Write: true}, paths[3])
+	assert.Contains(t, paths, &sandboxPath{Path: "/usr"})
+
+	// Fleet agents write into src
+	paths = sandboxPaths("/units", "/etc/systemd/system", "", "", "", true, "/root")
+	assert.Equal(t, &sandboxPath{Path: "/units", Write: true}, paths[0])
+	assert.Contains(t, paths, &sandboxPath{Path: "/root"})
+}
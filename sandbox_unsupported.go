@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// sandbox is implemented with Landlock and seccomp, which only exist on Linux.
+func sandbox(paths []*sandboxPath) error {
+	return sandboxSupported()
+}
+
+func sandboxSupported() error {
+	return fmt.Errorf("sandboxing isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// source mirrors unit files from elsewhere into the local src directory.
+type source interface {
+	Run(ctx context.Context, interval time.Duration) // polls until the context is canceled
+	Poll(ctx context.Context) error
+}
+
+// statusSource is implemented by sources that write the reconciliation status back to where the units come from.
+type statusSource interface {
+	SetReport(report *reconciler.HostReport)
+	WriteStatus(ctx context.Context) error
+}
+
+// httpSource mirrors the unit files listed by a manifest into the local src directory.
+type httpSource struct {
+	URL        string // of the manifest
+	Dir        string
+	Cache      string       // content-addressed store of downloaded files, hardlinked into Dir when on the same filesystem
+	Client     *http.Client // for the manifest
+	Downloader *downloader
+	Sealer     *reconciler.Sealer // optional, encrypts the cache, whose files are then copied into Dir
+	Gate       *pollGate          // optional, defers polls until the host meets its conditions
+
+	previous map[string]bool // checksums of the previous manifest
+	etag     string          // of the previous manifest, which isn't downloaded again while it's unchanged
+	last     *sourceManifest
+}
+
+// sourceManifest lists the unit files of an http source.
+type sourceManifest struct {
+	Files []*sourceFile `json:"files"`
+}
+
+type sourceFile struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"` // relative to the manifest, defaults to the name
+	SHA256 string `json:"sha256"`
+}
+
+// Run polls the source until the context is canceled. Downloads happen outside of syncs,
+// which only see complete files once they're renamed into place.
+func (s *httpSource) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := s.Poll(ctx); err != nil {
+			log.Printf("error while polling source: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll fetches the manifest, stages the files that changed, and applies the new set once every file is staged.
+// Nothing is applied if any file fails to download, so a partially fetched set is never synced.
+func (s *httpSource) Poll(ctx context.Context) error {
+	if s.Gate.Deferred(ctx) {
+		return nil
+	}
+	manifest, base, err := s.manifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, file := range manifest.Files {
+		if !validUnitName(file.Name) {
+			return fmt.Errorf("invalid unit name %q in manifest", file.Name)
+		}
+		file.SHA256 = strings.ToLower(file.SHA256)
+		if sum, err := hex.DecodeString(file.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("missing or invalid sha256 of %q in manifest", file.Name)
+		}
+		listed[file.Name] = true
+	}
+
+	var changed []*sourceFile
+	for _, file := range manifest.Files {
+		if current, err := sha256File(path.Join(s.Dir, file.Name)); err != nil || current != file.SHA256 {
+			changed = append(changed, file)
+		}
+	}
+	if err := s.stage(ctx, base, changed); err != nil {
+		return err
+	}
+
+	for _, file := range changed {
+		if err := s.link(file); err != nil {
+			return err
+		}
+		log.Printf("received unit from source: %s", file.Name)
+	}
+	if err := removeUnlisted(s.Dir, listed); err != nil {
+		return err
+	}
+	s.prune(manifest)
+	return nil
+}
+
+// object returns the path of a file's content in the cache.
+func (s *httpSource) object(checksum string) string {
+	return path.Join(s.Cache, checksum[:2], checksum)
+}
+
+// cached returns true if the cache holds the verified content of a file. Unencrypted content is downloaded again
+// when the cache is encrypted.
+func (s *httpSource) cached(checksum string) bool {
+	if s.Sealer == nil {
+		current, err := sha256File(s.object(checksum))
+		return err == nil && current == checksum
+	}
+	raw, err := ioutil.ReadFile(s.object(checksum))
+	if err != nil || !reconciler.IsSealed(raw) {
+		return false
+	}
+	content, err := s.Sealer.Open(raw)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]) == checksum
+}
+
+// read returns the content of a file in the cache.
+func (s *httpSource) read(checksum string) ([]byte, error) {
+	content, err := ioutil.ReadFile(s.object(checksum))
+	if err != nil {
+		return nil, err
+	}
+	return s.Sealer.Open(content)
+}
+
+// seal encrypts a downloaded file in the cache. Downloads are only kept unencrypted until they're verified,
+// since interrupted downloads are resumed.
+func (s *httpSource) seal(object string) error {
+	content, err := ioutil.ReadFile(object)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.Sealer.Seal(content)
+	if err != nil {
+		return err
+	}
+	return reconciler.WriteFileAtomic(object, sealed)
+}
+
+// stage makes sure the cache holds the content of every file, downloading the missing ones concurrently.
+func (s *httpSource) stage(ctx context.Context, base *url.URL, files []*sourceFile) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, file := range files {
+		object := s.object(file.SHA256)
+		if s.cached(file.SHA256) {
+			continue // already downloaded, e.g. for a previous manifest
+		}
+
+		ref := file.URL
+		if ref == "" {
+			ref = url.PathEscape(file.Name)
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return fmt.Errorf("invalid url of %q in manifest: %s", file.Name, err)
+		}
+		if err := os.MkdirAll(path.Dir(object), 0755); err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func(file *sourceFile, u string) {
+			defer wg.Done()
+			err := s.Downloader.Fetch(ctx, u, object, file.SHA256)
+			if err == nil && s.Sealer != nil {
+				err = s.seal(object)
+			}
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", file.Name, err))
+				mu.Unlock()
+			}
+		}(file, u.String())
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("error while downloading %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// link atomically replaces a unit file with its staged content, hardlinking it when the cache
+// is on the same filesystem and copying it otherwise.
+func (s *httpSource) link(file *sourceFile) error {
+	name := path.Join(s.Dir, file.Name)
+	if s.Sealer != nil {
+		content, err := s.read(file.SHA256)
+		if err != nil {
+			return err
+		}
+		return reconciler.WriteFileAtomic(name, content)
+	}
+	tmp := path.Join(s.Dir, "."+file.Name+".tmp")
+	os.Remove(tmp)
+
+	if err := os.Link(s.object(file.SHA256), tmp); err != nil {
+		content, err := ioutil.ReadFile(s.object(file.SHA256))
+		if err != nil {
+			return err
+		}
+		return reconciler.WriteFileAtomic(name, content)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// prune removes cached objects that neither the current nor the previous manifest reference,
+// so flipping back to the previous content doesn't download it again.
+func (s *httpSource) prune(manifest *sourceManifest) {
+	current := map[string]bool{}
+	for _, file := range manifest.Files {
+		current[file.SHA256] = true
+	}
+	keep := current
+	if s.previous != nil {
+		keep = map[string]bool{}
+		for checksum := range current {
+			keep[checksum] = true
+		}
+		for checksum := range s.previous {
+			keep[checksum] = true
+		}
+	}
+	s.previous = current
+
+	dirs, err := ioutil.ReadDir(s.Cache)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		objects, err := ioutil.ReadDir(path.Join(s.Cache, dir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, object := range objects {
+			checksum := strings.TrimSuffix(strings.TrimPrefix(object.Name(), "."), ".part") // includes partial downloads
+			if !keep[checksum] {
+				os.Remove(path.Join(s.Cache, dir.Name(), object.Name()))
+			}
+		}
+	}
+}
+
+func (s *httpSource) manifest(ctx context.Context) (*sourceManifest, *url.URL, error) {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.etag != "" && s.last != nil {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && s.last != nil {
+		return s.last, base, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	manifest := &sourceManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	s.etag, s.last = resp.Header.Get("ETag"), manifest
+	return manifest, base, nil
+}
+
+// removeUnlisted removes the unit files in dir that a source no longer lists.
+func removeUnlisted(dir string, listed map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, stat := range files {
+		if !stat.Mode().IsRegular() || !validUnitName(stat.Name()) || listed[stat.Name()] || hasTemplate(dir, stat.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, stat.Name())); err != nil {
+			return err
+		}
+		log.Printf("unit removed from source: %s", stat.Name())
+	}
+	return nil
+}
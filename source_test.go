@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSourceSealed(t *testing.T) {
+	manifest := `{"files": [{"name": "a.service", "sha256": "` + sha256Hex([]byte("secret")) + `"}]}`
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/manifest.json" {
+			w.Write([]byte(manifest))
+			return
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	sealer, err := reconciler.NewSealer([]byte("key"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	s := &httpSource{URL: server.URL + "/manifest.json", Dir: dir, Cache: path.Join(dir, ".cache"), Client: server.Client(), Downloader: &downloader{Client: server.Client()}, Sealer: sealer}
+	require.NoError(t, s.Poll(context.Background()))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(content))
+	cached, err := ioutil.ReadFile(s.object(sha256Hex([]byte("secret"))))
+	require.NoError(t, err)
+	assert.True(t, reconciler.IsSealed(cached))
+	assert.NotContains(t, string(cached), "secret")
+
+	// Encrypted content isn't downloaded again
+	requests = nil
+	require.NoError(t, s.Poll(context.Background()))
+	assert.Equal(t, []string{"/manifest.json"}, requests)
+}
+
+func TestHTTPSource(t *testing.T) {
+	files := map[string]string{"/units/a.service": "a", "/blobs/b": "b"}
+	manifest := `{"files": [
+		{"name": "a.service", "sha256": "` + sha256Hex([]byte("a")) + `"},
+		{"name": "b.service", "url": "../blobs/b", "sha256": "` + sha256Hex([]byte("b")) + `"}
+	]}`
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/units/manifest.json" {
+			w.Write([]byte(manifest))
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "old.service"), []byte("old"), 0644))
+	s := &httpSource{URL: server.URL + "/units/manifest.json", Dir: dir, Cache: path.Join(dir, ".cache"), Client: server.Client(), Downloader: &downloader{Client: server.Client()}}
+	require.NoError(t, s.Poll(context.Background()))
+	assert.ElementsMatch(t, []string{"/units/manifest.json", "/units/a.service", "/blobs/b"}, requests)
+
+	content, err := ioutil.ReadFile(path.Join(dir, "b.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+	assert.NoFileExists(t, path.Join(dir, "old.service"))
+
+	// Unchanged files aren't downloaded again
+	requests = nil
+	require.NoError(t, s.Poll(context.Background()))
+	assert.Equal(t, []string{"/units/manifest.json"}, requests)
+
+	// Nothing is applied unless every file was downloaded
+	files["/units/a.service"] = "a2"
+	files["/units/c.service"] = "c"
+	manifest = `{"files": [
+		{"name": "a.service", "sha256": "` + sha256Hex([]byte("a2")) + `"},
+		{"name": "c.service", "sha256": "` + sha256Hex([]byte("c2")) + `"}
+	]}`
+	assert.Error(t, s.Poll(context.Background()))
+	content, err = ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+	assert.FileExists(t, path.Join(dir, "b.service"))
+	assert.NoFileExists(t, path.Join(dir, "c.service"))
+
+	// Staged content is linked into place
+	files["/units/c.service"] = "c2"
+	requests = nil
+	require.NoError(t, s.Poll(context.Background()))
+	assert.Equal(t, []string{"/units/manifest.json", "/units/c.service"}, requests) // a.service was already staged
+	linked, err := os.Stat(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	object, err := os.Stat(s.object(sha256Hex([]byte("a2"))))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(linked, object))
+
+	// Reverting to cached content doesn't download it again, and content of older manifests is pruned
+	manifest = `{"files": [{"name": "a.service", "sha256": "` + sha256Hex([]byte("a")) + `"}]}`
+	requests = nil
+	require.NoError(t, s.Poll(context.Background()))
+	assert.Equal(t, []string{"/units/manifest.json"}, requests)
+	content, err = ioutil.ReadFile(path.Join(dir, "a.service"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+	assert.FileExists(t, s.object(sha256Hex([]byte("c2"))))
+	assert.NoFileExists(t, s.object(sha256Hex([]byte("b"))))
+}
+
+func TestHTTPSourceETag(t *testing.T) {
+	var conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/manifest.json":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				conditional++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(`{"files": [{"name": "a.service", "sha256": "` + sha256Hex([]byte("a")) + `"}]}`))
+		case "/a.service":
+			w.Write([]byte("a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	s := &httpSource{URL: server.URL + "/manifest.json", Dir: dir, Cache: path.Join(dir, ".cache"), Client: server.Client(), Downloader: &downloader{Client: server.Client()}}
+	require.NoError(t, s.Poll(context.Background()))
+	require.NoError(t, os.Remove(path.Join(dir, "a.service")))
+
+	// The unchanged manifest isn't downloaded again, but its files are still restored
+	require.NoError(t, s.Poll(context.Background()))
+	assert.Equal(t, 1, conditional)
+	assert.FileExists(t, path.Join(dir, "a.service"))
+}
+
+func TestHTTPSourceInvalidManifest(t *testing.T) {
+	for _, manifest := range []string{
+		`{"files": [{"name": "../escape.service", "sha256": "` + sha256Hex(nil) + `"}]}`,
+		`{"files": [{"name": "a.service"}]}`,
+		`not json`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(manifest))
+		}))
+		dir := t.TempDir()
+		s := &httpSource{URL: server.URL, Dir: dir, Cache: path.Join(dir, ".cache"), Client: server.Client(), Downloader: &downloader{Client: server.Client()}}
+		assert.Error(t, s.Poll(context.Background()), manifest)
+		server.Close()
+	}
+}
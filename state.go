@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+func stateCommand() int {
+	args := flag.Args()
+	if len(args) != 1 || (args[0] != "check" && args[0] != "repair" && args[0] != "compact") || *statePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: unitmgr state -state <path> check|repair|compact")
+		return exitFailed
+	}
+	_, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+	sealer, err := newSealer()
+	if err != nil {
+		return setupFailed(err)
+	}
+	store := &reconciler.StateStore{Path: *statePath, Sealer: sealer, TombstoneTTL: *stateTTL, Hasher: reconciler.Hashers[*checksumA]}
+
+	if args[0] == "check" {
+		check := store.Check(reconcilers)
+		if !structured(os.Stdout, check) {
+			printStateCheck(os.Stdout, check)
+		}
+		if len(check.Problems) > 0 {
+			return exitFailed
+		}
+		return exitConverged
+	}
+
+	// The running instance would overwrite the repaired file with its own state
+	if _, err := getStatus(controlClient(*control)); err == nil || !notRunning(err) {
+		fmt.Fprintf(os.Stderr, "error while repairing the state: unitmgr is running or %s can't be queried, stop it first\n", *control)
+		return exitFailed
+	}
+	check, err := store.Repair(reconcilers, args[0] == "compact")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while repairing the state: %s\n", err)
+		return exitFailed
+	}
+	if !structured(os.Stdout, check) {
+		printStateCheck(os.Stdout, check)
+		fmt.Printf("wrote %s with schema version %d\n", *statePath, reconciler.StateVersion)
+	}
+	return exitConverged
+}
+
+func printStateCheck(w io.Writer, check *reconciler.StateCheck) {
+	if check.Version == 0 && len(check.Problems) == 0 {
+		fmt.Fprintf(w, "%s doesn't exist\n", check.Path)
+		return
+	}
+	fmt.Fprintf(w, "%s: schema version %d, %d units recorded, %d problems\n", check.Path, check.Version, check.Units, len(check.Problems))
+	for _, p := range check.Problems {
+		switch {
+		case p.Unit != "":
+			fmt.Fprintf(w, "  %s %s: %s, %s\n", p.Src, p.Unit, p.Problem, p.Detail)
+		case p.Src != "":
+			fmt.Fprintf(w, "  %s: %s, %s\n", p.Src, p.Problem, p.Detail)
+		default:
+			fmt.Fprintf(w, "  %s, %s\n", p.Problem, p.Detail)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintStateCheck(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printStateCheck(buf, &reconciler.StateCheck{Path: "/var/lib/unitmgr/state.json", Problems: []*reconciler.StateProblem{}})
+	assert.Equal(t, "/var/lib/unitmgr/state.json doesn't exist\n", buf.String())
+
+	buf.Reset()
+	printStateCheck(buf, &reconciler.StateCheck{Path: "state.json", Version: 2, Units: 3, Problems: []*reconciler.StateProblem{
+		{Problem: "corrupt", Detail: "decoding state file: unexpected EOF"},
+		{Src: "/old", Problem: "unknown-source", Detail: "1 units are recorded for a source that isn't configured"},
+		{Src: "/units", Unit: "gone.service", Problem: "tombstone", Detail: "removed from src 48h0m0s ago, the next sync stops and removes it"},
+	}})
+	assert.Equal(t, `state.json: schema version 2, 3 units recorded, 3 problems
+  corrupt, decoding state file: unexpected EOF
+  /old: unknown-source, 1 units are recorded for a source that isn't configured
+  /units gone.service: tombstone, removed from src 48h0m0s ago, the next sync stops and removes it
+`, buf.String())
+}
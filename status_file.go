@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// writeStatusFile atomically replaces the file at name with the reports of every reconciler,
+// for monitoring agents that read files rather than scraping an http endpoint.
+func writeStatusFile(name string, reconcilers []*reconciler.Reconciler, ok bool) error {
+	reports := make([]*reconciler.HostReport, len(reconcilers))
+	for i, rec := range reconcilers {
+		reports[i] = rec.Report(ok)
+	}
+
+	buf, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return reconciler.WriteFileAtomic(name, append(buf, '\n'))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStatusFile(t *testing.T) {
+	name := path.Join(t.TempDir(), "status.json")
+	r := &reconciler.Reconciler{
+		Src:      "/src",
+		State:    map[string]string{"a.service": "abc"},
+		Failures: map[string]string{"b.service": "oops"},
+	}
+	require.NoError(t, writeStatusFile(name, []*reconciler.Reconciler{r}, false))
+
+	buf, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	var reports []*reconciler.HostReport
+	require.NoError(t, json.Unmarshal(buf, &reports))
+	require.Len(t, reports, 1)
+	assert.Equal(t, "/src", reports[0].Src)
+	assert.Equal(t, map[string]string{"a.service": "abc"}, reports[0].Units)
+	assert.Equal(t, map[string]string{"b.service": "oops"}, reports[0].Failures)
+	assert.False(t, reports[0].OK)
+
+	// Replaced after the next sync
+	delete(r.Failures, "b.service")
+	require.NoError(t, writeStatusFile(name, []*reconciler.Reconciler{r}, true))
+	buf, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	reports = nil
+	require.NoError(t, json.Unmarshal(buf, &reports))
+	assert.True(t, reports[0].OK)
+	assert.Empty(t, reports[0].Failures)
+}
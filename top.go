@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+)
+
+// Escape sequences switching to the terminal's alternate screen, so the dashboard doesn't clobber the scrollback,
+// and redrawing it from the top left.
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l"
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+	redraw      = "\x1b[H\x1b[2J"
+)
+
+// topEvents is how many of the most recent state transitions unitmgr top shows.
+const topEvents = 10
+
+// topCommand shows the managed units of the running instance, refreshed every -top-interval until interrupted.
+// When stdout isn't a terminal the dashboard is printed once, e.g. for watch or scripts.
+func topCommand() int {
+	client := controlClient(*control)
+	if _, err := getStatus(client); err != nil {
+		fmt.Fprintf(os.Stderr, "error while querying %s, is unitmgr running? %s\n", *control, err)
+		return exitFailed
+	}
+	if *output != "table" {
+		return printTopSnapshot(client)
+	}
+	if !isTerminal(os.Stdout) {
+		return drawTop(os.Stdout, client)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprint(os.Stdout, enterScreen)
+	defer fmt.Fprint(os.Stdout, leaveScreen)
+
+	ticker := time.NewTicker(*topI)
+	defer ticker.Stop()
+	for {
+		buf := &bytes.Buffer{}
+		buf.WriteString(redraw)
+		drawTop(buf, client)
+		os.Stdout.Write(buf.Bytes()) // written at once to avoid flickering
+
+		select {
+		case <-ctx.Done():
+			return exitConverged
+		case <-ticker.C:
+		}
+	}
+}
+
+// drawTop queries the running instance and renders the dashboard. Failed queries are shown rather than ending it,
+// since the instance may be restarting.
+func drawTop(w io.Writer, client *http.Client) int {
+	reports, err := getStatus(client)
+	if err != nil {
+		fmt.Fprintf(w, "error while querying %s: %s\n", *control, err)
+		return exitFailed
+	}
+	units, err := getUnits(client) // the dashboard is still useful without systemd's view of the units
+	events, _ := getEvents(client)
+	renderTop(w, time.Now(), reports, units, events)
+	if err != nil {
+		fmt.Fprintf(w, "\nerror while querying unit states: %s\n", err)
+	}
+	return exitConverged
+}
+
+// topSnapshot is the data shown by unitmgr top, printed once with -output json or yaml.
+type topSnapshot struct {
+	Reports []*reconciler.HostReport `json:"reports"`
+	Units   []*hostUnits             `json:"units"`
+	Events  []*controlEvent          `json:"events"`
+}
+
+func printTopSnapshot(client *http.Client) int {
+	snapshot := &topSnapshot{}
+	var err error
+	if snapshot.Reports, err = getStatus(client); err == nil {
+		if snapshot.Units, err = getUnits(client); err == nil {
+			snapshot.Events, err = getEvents(client)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while querying %s: %s\n", *control, err)
+		return exitFailed
+	}
+	structured(os.Stdout, snapshot)
+	return exitConverged
+}
+
+// renderTop writes a table of every managed unit followed by the most recent state transitions.
+func renderTop(w io.Writer, now time.Time, reports []*reconciler.HostReport, units []*hostUnits, events []*controlEvent) {
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "waiting for the first sync")
+	}
+	for _, report := range reports {
+		state := "ok"
+		if !report.OK {
+			state = "failing"
+		}
+		fmt.Fprintf(w, "%s %s: %s, %d units, generation %d, last synced %s ago\n", report.Host, report.Src, state, len(report.Units), report.Generation, since(now, report.LastSync))
+
+		var runtime map[string]*systemd.UnitState
+		for _, hu := range units {
+			if hu.Host == report.Host && hu.Src == report.Src {
+				runtime = hu.Units
+			}
+		}
+		drift := map[string]string{}
+		for _, change := range report.Pending {
+			drift[change.Unit] = "would " + change.Action
+		}
+		for unit, status := range report.States {
+			if status.State == reconciler.StatePendingCopy {
+				drift[unit] = "pending"
+			}
+		}
+		for unit := range report.Failures {
+			drift[unit] = "failing"
+			if class, ok := report.Classes[unit]; ok {
+				drift[unit] = "failing (" + string(class) + ")"
+			}
+		}
+
+		seen := map[string]bool{}
+		var names []string
+		for _, m := range []map[string]string{report.Units, report.Failures, drift} {
+			for unit := range m {
+				if !seen[unit] {
+					seen[unit] = true
+					names = append(names, unit)
+				}
+			}
+		}
+		sort.Strings(names)
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "\nUNIT\tSTATE\tACTIVE\tENABLED\tLAST ACTION\tDRIFT")
+		for _, unit := range names {
+			state, active, enabled, action := "-", "-", "-", "-"
+			if status, ok := report.States[unit]; ok {
+				state = string(status.State)
+			}
+			if rt, ok := runtime[unit]; ok {
+				active, enabled = rt.Active, rt.Enabled
+				if rt.Sub != "" {
+					active += " (" + rt.Sub + ")"
+				}
+				if enabled == "" {
+					enabled = "-"
+				}
+			}
+			if last, ok := report.Actions[unit]; ok {
+				action = fmt.Sprintf("%s %s ago", last.Action, since(now, last.Time))
+			}
+			d := drift[unit]
+			if d == "" {
+				d = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", unit, state, active, enabled, action, d)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "RECENT EVENTS")
+	if len(events) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	if len(events) > topEvents {
+		events = events[len(events)-topEvents:]
+	}
+	for i := len(events) - 1; i >= 0; i-- { // newest first
+		event := events[i]
+		from := event.From
+		if from == "" {
+			from = "new"
+		}
+		line := fmt.Sprintf("  %s  %s: %s -> %s", event.Time.Local().Format("15:04:05"), event.Unit, from, event.To)
+		if event.Reason != "" {
+			line += ", " + event.Reason
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// since formats the time elapsed since t, rounded to the second.
+func since(now, t time.Time) string {
+	d := now.Sub(t).Round(time.Second)
+	if d < 0 {
+		d = 0
+	}
+	return d.String()
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/jveski/unitmgr/pkg/systemd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTop(t *testing.T) {
+	buf := &bytes.Buffer{}
+	renderTop(buf, time.Now(), nil, nil, nil)
+	assert.Equal(t, "waiting for the first sync\nRECENT EVENTS\n  none\n", buf.String())
+
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.Local)
+	reports := []*reconciler.HostReport{{
+		Host:       "host1",
+		Src:        "/src",
+		OK:         true,
+		Units:      map[string]string{"a.service": "abc", "b.service": "def"},
+		LastSync:   now.Add(-time.Second * 5),
+		Failures:   map[string]string{"b.service": "oops"},
+		Classes:    map[string]reconciler.ErrorClass{"b.service": reconciler.SystemdError},
+		Pending:    []*reconciler.Change{{Unit: "c.service", Action: "create"}},
+		Generation: 3,
+		Actions:    map[string]*reconciler.UnitAction{"a.service": {Action: "restarted", Time: now.Add(-time.Minute)}},
+		States: map[string]*reconciler.UnitStatus{
+			"a.service": {State: reconciler.StateHealthy},
+			"b.service": {State: reconciler.StateFailed},
+		},
+	}}
+	units := []*hostUnits{{Host: "host1", Src: "/src", Units: map[string]*systemd.UnitState{
+		"a.service": {Active: "active", Sub: "running", Enabled: "enabled"},
+		"b.service": {Active: "failed", Sub: "failed"},
+	}}}
+	events := []*controlEvent{
+		{Unit: "a.service", To: reconciler.StateCopied, Time: time.Date(2021, 1, 1, 11, 59, 0, 0, time.Local)},
+		{Unit: "b.service", From: reconciler.StateCopied, To: reconciler.StateFailed, Reason: "oops", Time: time.Date(2021, 1, 1, 11, 59, 30, 0, time.Local)},
+	}
+
+	buf.Reset()
+	renderTop(buf, now, reports, units, events)
+	assert.Equal(t, `host1 /src: ok, 2 units, generation 3, last synced 5s ago
+
+UNIT       STATE    ACTIVE            ENABLED  LAST ACTION         DRIFT
+a.service  Healthy  active (running)  enabled  restarted 1m0s ago  -
+b.service  Failed   failed (failed)   -        -                   failing (systemd)
+c.service  -        -                 -        -                   would create
+
+RECENT EVENTS
+  11:59:30  b.service: Copied -> Failed, oops
+  11:59:00  a.service: new -> Copied
+`, buf.String())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+func validateCommand() int {
+	_, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+
+	code := exitConverged
+	problems := []*unitProblem{}
+	for _, rec := range reconcilers {
+		found, err := unitProblems(rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while validating %s: %s\n", rec.Src, err)
+			return exitFailed
+		}
+		if len(found) > 0 {
+			code = exitFailed
+		}
+		problems = append(problems, found...)
+	}
+	if !structured(os.Stdout, problems) {
+		writeProblems(os.Stdout, problems)
+	}
+	return code
+}
+
+// unitProblem is a problem of a unit file found by the validate command.
+type unitProblem struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+}
+
+// validateUnits writes the problems of every unit file in rec.Src and returns false if there are any.
+func validateUnits(w io.Writer, rec *reconciler.Reconciler) (bool, error) {
+	problems, err := unitProblems(rec)
+	if err != nil {
+		return false, err
+	}
+	writeProblems(w, problems)
+	return len(problems) == 0, nil
+}
+
+func writeProblems(w io.Writer, problems []*unitProblem) {
+	for _, p := range problems {
+		fmt.Fprintf(w, "%s: %s\n", p.File, p.Problem)
+	}
+}
+
+// unitProblems returns the problems of every unit file in rec.Src.
+// Unit files are linted even when -lint is off.
+func unitProblems(rec *reconciler.Reconciler) ([]*unitProblem, error) {
+	if rec.Linter == nil {
+		linter, err := reconciler.NewLinter("warn", *nolint)
+		if err != nil {
+			return nil, err
+		}
+		rec.Linter = linter
+	}
+
+	units, err := rec.Units()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(units)
+
+	var result []*unitProblem
+	for _, unit := range units {
+		problems, err := rec.Validate(unit)
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range problems {
+			result = append(result, &unitProblem{File: path.Join(rec.Src, unit), Problem: rec.Redact.String(problem)})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUnits(t *testing.T) {
+	src := t.TempDir()
+	r := &reconciler.Reconciler{Src: src}
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "good.service"), []byte("[Unit]\nDescription=good\n\n[Service]\nExecStart=/bin/good\nRestart=always\n\n[Install]\nWantedBy=multi-user.target\n"), 0644))
+
+	buf := &bytes.Buffer{}
+	ok, err := validateUnits(buf, r)
+	require.NoError(t, err)
+	assert.True(t, ok, buf.String())
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, ioutil.WriteFile(path.Join(src, "bad.service"), []byte("[Service]\nExecStart=relative\n"), 0644))
+	buf.Reset()
+	ok, err = validateUnits(buf, r)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Contains(t, buf.String(), path.Join(src, "bad.service")+": lint error")
+	assert.NotContains(t, buf.String(), "good.service")
+}
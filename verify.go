@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+)
+
+// integrityReport is the discrepancies between the applied units of a reconciler and their recorded checksums.
+type integrityReport struct {
+	Src           string                    `json:"src"`
+	Units         int                       `json:"units"` // verified
+	Discrepancies []*reconciler.Discrepancy `json:"discrepancies"`
+}
+
+func verifyCommand() int {
+	_, reconcilers, err := setup()
+	if err != nil {
+		return setupFailed(err)
+	}
+
+	// The running instance's checksums are current, the persisted state may lag behind its last save
+	reports, err := getStatus(controlClient(*control))
+	switch {
+	case err == nil:
+		for _, rec := range reconcilers {
+			for _, report := range reports {
+				if report.Src == rec.Src {
+					rec.State = report.Units
+				}
+			}
+		}
+	case notRunning(err) && *statePath != "":
+		if _, err := loadState(reconcilers); err != nil {
+			return setupFailed(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "error while querying %s for the applied checksums, pass -state when unitmgr isn't running: %s\n", *control, err)
+		return exitFailed
+	}
+
+	code := exitConverged
+	results := make([]*integrityReport, 0, len(reconcilers))
+	for _, rec := range reconcilers {
+		discrepancies, err := rec.VerifyApplied(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while verifying %s: %s\n", rec.Src, err)
+			return exitFailed
+		}
+		if len(discrepancies) > 0 {
+			code = exitFailed
+		}
+		results = append(results, &integrityReport{Src: rec.Src, Units: len(rec.State), Discrepancies: discrepancies})
+	}
+	if !structured(os.Stdout, results) {
+		printIntegrity(os.Stdout, results)
+	}
+	return code
+}
+
+func printIntegrity(w io.Writer, results []*integrityReport) {
+	for _, result := range results {
+		if len(result.Discrepancies) == 0 {
+			fmt.Fprintf(w, "%s: %d units verified\n", result.Src, result.Units)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d discrepancies in %d units\n", result.Src, len(result.Discrepancies), result.Units)
+		for _, d := range result.Discrepancies {
+			fmt.Fprintf(w, "  %s: %s, %s\n", d.Unit, d.Problem, d.Detail)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jveski/unitmgr/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintIntegrity(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printIntegrity(buf, []*integrityReport{
+		{Src: "/units", Units: 3},
+		{Src: "/other", Units: 2, Discrepancies: []*reconciler.Discrepancy{
+			{Unit: "a.service", Problem: "missing", Detail: "the applied unit file was removed"},
+			{Unit: "b.service", Problem: "stale", Detail: "systemd's loaded configuration is older than the unit file, it needs a daemon-reload"},
+		}},
+	})
+	assert.Equal(t, "/units: 3 units verified\n/other: 2 discrepancies in 2 units\n  a.service: missing, the applied unit file was removed\n  b.service: stale, systemd's loaded configuration is older than the unit file, it needs a daemon-reload\n", buf.String())
+}
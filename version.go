@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set by the release build with -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func versionCommand() int {
+	if !structured(os.Stdout, buildInfo()) {
+		printVersion(os.Stdout)
+	}
+	return 0
+}
+
+// versionInfo describes the unitmgr binary.
+type versionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+func buildInfo() *versionInfo {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version // installed with go install
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	d := date
+	if d == "" {
+		d = "unknown"
+	}
+	return &versionInfo{Version: v, Commit: c, Date: d, Go: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+func printVersion(w io.Writer) {
+	info := buildInfo()
+	fmt.Fprintf(w, "unitmgr %s (commit %s, built %s, %s %s/%s)\n", info.Version, info.Commit, info.Date, info.Go, info.OS, info.Arch)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "1.2.3", "abc123", "2021-01-01T00:00:00Z"
+
+	buf := &bytes.Buffer{}
+	printVersion(buf)
+	assert.Equal(t, "unitmgr 1.2.3 (commit abc123, built 2021-01-01T00:00:00Z, "+runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH+")\n", buf.String())
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// webhookNotifier posts digests as json to a url. The summary and events are also sent as text,
+// which is what Slack and Mattermost incoming webhooks display.
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *webhookNotifier) Notify(d *digest) error {
+	text := "unitmgr: " + d.Summary() + "\n" + strings.Join(d.Lines(), "\n")
+	return postJSON(w.Client, w.URL, &struct {
+		*digest
+		Text string `json:"text"`
+	}{d, text})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer server.Close()
+
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := &webhookNotifier{URL: server.URL, Client: server.Client()}
+	require.NoError(t, w.Notify(&digest{Host: "host1", Time: at, Events: []*notifyEvent{
+		{Src: "/src", Unit: "a.service", Kind: "changed", Detail: "restarted", Time: at},
+	}}))
+
+	assert.Equal(t, "host1", body["host"])
+	assert.Len(t, body["events"], 1)
+	assert.Equal(t, "unitmgr: 1 change on host1\n"+at.Local().Format(time.RFC3339)+" changed a.service: restarted", body["text"])
+}